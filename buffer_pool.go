@@ -0,0 +1,79 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// BufferPoolMaxBufSize is the max capacity, in bytes, of a buffer
+// that's returned to a pool for reuse, so that the pools don't hold
+// on to the memory of rare, large results or batches.
+var BufferPoolMaxBufSize = 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// GetBuffer returns an empty buffer from a pool, which should be
+// returned via PutBuffer() once the caller is done with it.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns a buffer from GetBuffer() to the pool.  Neither
+// the buffer nor any slice of its bytes may be used afterwards.
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > BufferPoolMaxBufSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// A jsonEncoder is a pooled json.Encoder with its own buffer.
+type jsonEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonEncoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &jsonEncoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+// EncodeJSON writes the JSON encoding of v, followed by a newline
+// like json.Encoder.Encode(), to a writer with a single Write(), via
+// a pooled encoder and buffer, such as for query results.
+func EncodeJSON(w io.Writer, v interface{}) error {
+	e := jsonEncoderPool.Get().(*jsonEncoder)
+
+	err := e.enc.Encode(v)
+	if err == nil {
+		_, err = w.Write(e.buf.Bytes())
+	}
+
+	if e.buf.Cap() <= BufferPoolMaxBufSize {
+		e.buf.Reset()
+		jsonEncoderPool.Put(e)
+	}
+
+	return err
+}
@@ -0,0 +1,54 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		buf := GetBuffer()
+		if buf.Len() != 0 {
+			t.Errorf("expected an empty buffer, got: %q", buf.String())
+		}
+		buf.WriteString("hello")
+		PutBuffer(buf)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	v := map[string]interface{}{"a": 1, "b": []string{"x", "y"}}
+
+	var expected bytes.Buffer
+	json.NewEncoder(&expected).Encode(v)
+
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		err := EncodeJSON(&buf, v)
+		if err != nil {
+			t.Errorf("expected EncodeJSON() to work, err: %v", err)
+		}
+		if buf.String() != expected.String() {
+			t.Errorf("expected: %q, got: %q", expected.String(), buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	err := EncodeJSON(&buf, func() {})
+	if err == nil || buf.Len() != 0 {
+		t.Errorf("expected an error and no output, got: %v, %q",
+			err, buf.String())
+	}
+}
@@ -0,0 +1,104 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Large Cfg values (like the PlanPIndexes of a big cluster) can bump
+// against the value size limits of a Cfg backend (such as metakv or
+// a couchbase bucket).  So, the Cfg providers transparently gzip
+// values that are larger than CfgCompressThreshold, marking the
+// stored value with the CfgCompressPrefix magic bytes so that readers
+// know to decompress it.  Values are decompressed before being
+// returned by Cfg.Get(), so Cfg clients never see the compressed form.
+//
+// As nodes from before compression can't read compressed values, the
+// Cfg providers only compress values once the cluster's compat
+// version (see COMPAT_VERSION_KEY) in the same Cfg is at least
+// CfgCompressVersion, meaning every known node understands the
+// compressed format.
+
+// CfgCompressPrefix are the magic bytes that are prepended to a
+// compressed Cfg value, and should be immutable after process
+// init()'ialization.  JSON values never start with a zero byte.
+var CfgCompressPrefix = []byte("\x00cbgt-gz\x00")
+
+// CfgCompressThreshold is the size in bytes over which a Cfg value
+// will be compressed.  A threshold <= 0 disables compression.
+var CfgCompressThreshold = 64 * 1024
+
+// CfgCompressVersion is the compat version from which all the nodes
+// of a cluster understand compressed Cfg values.
+var CfgCompressVersion = "5.0.0"
+
+// CfgCompressAllowed returns true if a cluster's compat version, as
+// stored under the COMPAT_VERSION_KEY, allows compressed Cfg values.
+func CfgCompressAllowed(compatVersion string) bool {
+	return compatVersion != "" &&
+		VersionGTE(compatVersion, CfgCompressVersion)
+}
+
+// CfgCompressVal returns a compressed, magic-prefixed version of val
+// if val is larger than the CfgCompressThreshold; otherwise, val is
+// returned as-is.
+func CfgCompressVal(val []byte) ([]byte, error) {
+	if CfgCompressThreshold <= 0 || len(val) <= CfgCompressThreshold {
+		return val, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(CfgCompressPrefix)
+
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(val)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_compress: write, err: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cfg_compress: close, err: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CfgDecompressVal returns the uncompressed version of a val that was
+// previously returned by CfgCompressVal().  A val that does not have
+// the CfgCompressPrefix is returned as-is.
+func CfgDecompressVal(val []byte) ([]byte, error) {
+	if !CfgValCompressed(val) {
+		return val, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(val[len(CfgCompressPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("cfg_compress: reader, err: %v", err)
+	}
+	defer r.Close()
+
+	rv, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_compress: read, err: %v", err)
+	}
+
+	return rv, nil
+}
+
+// CfgValCompressed returns true if val has the CfgCompressPrefix.
+func CfgValCompressed(val []byte) bool {
+	return bytes.HasPrefix(val, CfgCompressPrefix)
+}
@@ -0,0 +1,142 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCfgCompressVal(t *testing.T) {
+	small := []byte(`{"hello":"world"}`)
+	v, err := CfgCompressVal(small)
+	if err != nil || !bytes.Equal(v, small) {
+		t.Errorf("expected small val to not be compressed, v: %s", v)
+	}
+
+	big := bytes.Repeat([]byte(`{"a":"b"},`), CfgCompressThreshold)
+	v, err = CfgCompressVal(big)
+	if err != nil || !CfgValCompressed(v) {
+		t.Errorf("expected big val to be compressed, err: %v", err)
+	}
+	if len(v) >= len(big) {
+		t.Errorf("expected compressed val to be smaller")
+	}
+
+	d, err := CfgDecompressVal(v)
+	if err != nil || !bytes.Equal(d, big) {
+		t.Errorf("expected decompressed val to match, err: %v", err)
+	}
+
+	d, err = CfgDecompressVal(small)
+	if err != nil || !bytes.Equal(d, small) {
+		t.Errorf("expected uncompressed val to be returned as-is")
+	}
+
+	_, err = CfgDecompressVal(append(CfgCompressPrefix, []byte("bad")...))
+	if err == nil {
+		t.Errorf("expected err on corrupted compressed val")
+	}
+}
+
+func TestCfgCompressMem(t *testing.T) {
+	testCfgCompress(t, NewCfgMem())
+}
+
+func TestCfgCompressSimple(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	testCfgCompress(t, NewCfgSimple(path))
+
+	c := NewCfgSimple(path)
+	err := c.Load()
+	if err != nil {
+		t.Errorf("expected Load() to work, err: %v", err)
+	}
+	v, _, err := c.Get("big", 0)
+	if err != nil || len(v) != 10*CfgCompressThreshold {
+		t.Errorf("expected reloaded big val, err: %v, len(v): %d", err, len(v))
+	}
+}
+
+func testCfgCompress(t *testing.T, c Cfg) {
+	_, err := c.Set(COMPAT_VERSION_KEY, []byte(CfgCompressVersion), 0)
+	if err != nil {
+		t.Errorf("expected Set() of compat version to work, err: %v", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), CfgCompressThreshold)
+
+	cas, err := c.Set("big", big, 0)
+	if err != nil || cas == 0 {
+		t.Errorf("expected Set() of big val to work, err: %v", err)
+	}
+
+	v, cas2, err := c.Get("big", 0)
+	if err != nil || cas2 != cas || !bytes.Equal(v, big) {
+		t.Errorf("expected Get() to return the uncompressed big val,"+
+			" err: %v", err)
+	}
+}
+
+func TestCfgCompressMemEntries(t *testing.T) {
+	c := NewCfgMem()
+
+	big := bytes.Repeat([]byte("x"), CfgCompressThreshold+1)
+
+	// Until all nodes understand compressed values, nothing is
+	// compressed.
+	for i, compatVersion := range []string{"", "4.5.0"} {
+		if compatVersion != "" {
+			_, err := c.Set(COMPAT_VERSION_KEY,
+				[]byte(compatVersion), CFG_CAS_FORCE)
+			if err != nil {
+				t.Errorf("expected Set() to work, err: %v", err)
+			}
+		}
+		_, err := c.Set("big", big, CFG_CAS_FORCE)
+		if err != nil {
+			t.Errorf("expected Set() to work, err: %v", err)
+		}
+		if CfgValCompressed(c.Entries["big"].Val) {
+			t.Errorf("i: %d, expected big entry to not be compressed"+
+				" before the upgrade", i)
+		}
+	}
+
+	_, err := c.Set(COMPAT_VERSION_KEY,
+		[]byte(CfgCompressVersion), CFG_CAS_FORCE)
+	if err != nil {
+		t.Errorf("expected Set() to work, err: %v", err)
+	}
+
+	_, err = c.Set("big", big, CFG_CAS_FORCE)
+	if err != nil {
+		t.Errorf("expected Set() to work, err: %v", err)
+	}
+	if !CfgValCompressed(c.Entries["big"].Val) {
+		t.Errorf("expected big entry to be stored compressed")
+	}
+
+	_, err = c.Set("small", []byte("x"), 0)
+	if err != nil {
+		t.Errorf("expected Set() to work, err: %v", err)
+	}
+	if CfgValCompressed(c.Entries["small"].Val) {
+		t.Errorf("expected small entry to not be stored compressed")
+	}
+}
@@ -0,0 +1,198 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A CfgLease is an exclusive, time-limited claim on a named resource
+// that's coordinated through CAS operations on a Cfg entry, so that
+// components on different nodes (like a rebalancer or a planner) can
+// coordinate exclusive work without an external coordination service.
+//
+// Lease expirations are based on the wall clocks of the nodes, so
+// the ttl of a lease should be much larger than the expected clock
+// skew between nodes.  Also, a lease is only as strong as the CAS
+// support of the Cfg provider.
+type CfgLease struct {
+	Key     string    `json:"key"`
+	Owner   string    `json:"owner"`   // Ex: a node UUID.
+	UUID    string    `json:"uuid"`    // Unique to every acquisition.
+	Expires time.Time `json:"expires"` // Wall clock time.
+
+	cas uint64
+}
+
+// CfgLeaseHeldError is returned when a lease is currently held by
+// another owner.
+type CfgLeaseHeldError struct {
+	Key     string
+	Owner   string
+	Expires time.Time
+}
+
+func (e *CfgLeaseHeldError) Error() string {
+	return fmt.Sprintf("cfg_lease: lease held, key: %s, owner: %s,"+
+		" expires: %v", e.Key, e.Owner, e.Expires)
+}
+
+// ErrCfgLeaseLost is returned when renewing or releasing a lease that
+// has expired and was acquired by someone else, or was removed.
+var ErrCfgLeaseLost = errors.New("cfg_lease: lease lost")
+
+// CfgLeaseKey returns the Cfg key used for a named lease.
+func CfgLeaseKey(name string) string {
+	return "lease-" + name
+}
+
+// CfgGetLease returns the current lease for a key, or nil if there is
+// no lease entry.  The returned lease might be expired.
+func CfgGetLease(cfg Cfg, key string) (*CfgLease, error) {
+	v, cas, err := cfg.Get(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	rv := &CfgLease{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, err
+	}
+	rv.cas = cas
+
+	return rv, nil
+}
+
+// CfgAcquireLease attempts to acquire the lease for a key on behalf
+// of an owner, for a duration of ttl.  A *CfgLeaseHeldError is
+// returned if the lease is held by a different owner and has not
+// expired.  If the owner already holds the lease, the lease is
+// renewed.
+func CfgAcquireLease(cfg Cfg, key, owner string, ttl time.Duration) (
+	*CfgLease, error) {
+	curr, err := CfgGetLease(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas uint64
+
+	if curr != nil {
+		if curr.Owner != owner && time.Now().Before(curr.Expires) {
+			return nil, &CfgLeaseHeldError{
+				Key:     key,
+				Owner:   curr.Owner,
+				Expires: curr.Expires,
+			}
+		}
+
+		if curr.Owner == owner && time.Now().Before(curr.Expires) {
+			err = CfgRenewLease(cfg, curr, ttl)
+			if err != nil {
+				return nil, err
+			}
+			return curr, nil
+		}
+
+		cas = curr.cas
+	}
+
+	lease := &CfgLease{
+		Key:     key,
+		Owner:   owner,
+		UUID:    NewUUID(),
+		Expires: time.Now().Add(ttl),
+	}
+
+	lease.cas, err = cfgSetLease(cfg, lease, cas)
+	if err != nil {
+		// We lost a race to another acquirer, so report who won.
+		winner, errGet := CfgGetLease(cfg, key)
+		if errGet == nil && winner != nil && winner.UUID != lease.UUID {
+			return nil, &CfgLeaseHeldError{
+				Key:     key,
+				Owner:   winner.Owner,
+				Expires: winner.Expires,
+			}
+		}
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// CfgRenewLease extends a lease that's held by the caller to expire
+// ttl from now.  ErrCfgLeaseLost is returned if the caller no longer
+// holds the lease.
+func CfgRenewLease(cfg Cfg, lease *CfgLease, ttl time.Duration) error {
+	curr, err := CfgGetLease(cfg, lease.Key)
+	if err != nil {
+		return err
+	}
+	if curr == nil || curr.UUID != lease.UUID {
+		return ErrCfgLeaseLost
+	}
+
+	next := *curr
+	next.Expires = time.Now().Add(ttl)
+
+	cas, err := cfgSetLease(cfg, &next, curr.cas)
+	if err != nil {
+		if _, ok := err.(*CfgCASError); ok {
+			return ErrCfgLeaseLost
+		}
+		return err
+	}
+
+	lease.Expires = next.Expires
+	lease.cas = cas
+
+	return nil
+}
+
+// CfgReleaseLease gives up a lease that's held by the caller, so
+// that others may immediately acquire it.  ErrCfgLeaseLost is
+// returned if the caller no longer holds the lease.
+func CfgReleaseLease(cfg Cfg, lease *CfgLease) error {
+	curr, err := CfgGetLease(cfg, lease.Key)
+	if err != nil {
+		return err
+	}
+	if curr == nil || curr.UUID != lease.UUID {
+		return ErrCfgLeaseLost
+	}
+
+	err = cfg.Del(lease.Key, curr.cas)
+	if err != nil {
+		if _, ok := err.(*CfgCASError); ok {
+			return ErrCfgLeaseLost
+		}
+		return err
+	}
+
+	return nil
+}
+
+func cfgSetLease(cfg Cfg, lease *CfgLease, cas uint64) (uint64, error) {
+	buf, err := json.Marshal(lease)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(lease.Key, buf, cas)
+}
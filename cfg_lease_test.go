@@ -0,0 +1,96 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCfgLease(t *testing.T) {
+	cfg := NewCfgMem()
+	key := CfgLeaseKey("rebalance")
+
+	l, err := CfgGetLease(cfg, key)
+	if err != nil || l != nil {
+		t.Errorf("expected no lease on new cfg, err: %v", err)
+	}
+
+	a, err := CfgAcquireLease(cfg, key, "a", time.Minute)
+	if err != nil || a == nil || a.Owner != "a" {
+		t.Errorf("expected a to acquire, err: %v", err)
+	}
+
+	_, err = CfgAcquireLease(cfg, key, "b", time.Minute)
+	if e, ok := err.(*CfgLeaseHeldError); !ok || e.Owner != "a" {
+		t.Errorf("expected b to see lease held by a, err: %v", err)
+	}
+
+	a2, err := CfgAcquireLease(cfg, key, "a", time.Minute)
+	if err != nil || a2.UUID != a.UUID {
+		t.Errorf("expected a to re-acquire its own lease, err: %v", err)
+	}
+
+	expires := a.Expires
+	time.Sleep(time.Millisecond)
+	err = CfgRenewLease(cfg, a, time.Minute)
+	if err != nil || !a.Expires.After(expires) {
+		t.Errorf("expected renew to extend, err: %v", err)
+	}
+
+	err = CfgReleaseLease(cfg, a)
+	if err != nil {
+		t.Errorf("expected release to work, err: %v", err)
+	}
+	err = CfgReleaseLease(cfg, a)
+	if err != ErrCfgLeaseLost {
+		t.Errorf("expected lost on double release, err: %v", err)
+	}
+	err = CfgRenewLease(cfg, a, time.Minute)
+	if err != ErrCfgLeaseLost {
+		t.Errorf("expected lost on renew after release, err: %v", err)
+	}
+
+	b, err := CfgAcquireLease(cfg, key, "b", time.Minute)
+	if err != nil || b.Owner != "b" {
+		t.Errorf("expected b to acquire after release, err: %v", err)
+	}
+}
+
+func TestCfgLeaseExpired(t *testing.T) {
+	cfg := NewCfgMem()
+	key := CfgLeaseKey("planner")
+
+	a, err := CfgAcquireLease(cfg, key, "a", -time.Second)
+	if err != nil {
+		t.Errorf("expected a to acquire, err: %v", err)
+	}
+
+	b, err := CfgAcquireLease(cfg, key, "b", time.Minute)
+	if err != nil || b.Owner != "b" {
+		t.Errorf("expected b to take over expired lease, err: %v", err)
+	}
+
+	err = CfgRenewLease(cfg, a, time.Minute)
+	if err != ErrCfgLeaseLost {
+		t.Errorf("expected a to have lost its lease, err: %v", err)
+	}
+	err = CfgReleaseLease(cfg, a)
+	if err != ErrCfgLeaseLost {
+		t.Errorf("expected a to not release b's lease, err: %v", err)
+	}
+
+	l, err := CfgGetLease(cfg, key)
+	if err != nil || l.UUID != b.UUID {
+		t.Errorf("expected b to still hold the lease, err: %v", err)
+	}
+}
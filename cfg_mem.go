@@ -59,6 +59,14 @@ func (c *CfgMem) Get(key string, cas uint64) (
 		return nil, 0, &CfgCASError{}
 	}
 
+	if CfgValCompressed(entry.Val) {
+		val, err := CfgDecompressVal(entry.Val)
+		if err != nil {
+			return nil, 0, err
+		}
+		return val, entry.CAS, nil
+	}
+
 	val := make([]byte, len(entry.Val))
 	copy(val, entry.Val)
 	return val, entry.CAS, nil
@@ -111,6 +119,18 @@ func (c *CfgMem) Set(key string, val []byte, cas uint64) (
 		}
 	}
 
+	compatVersion := ""
+	if compatEntry := c.Entries[COMPAT_VERSION_KEY]; compatEntry != nil {
+		compatVersion = string(compatEntry.Val)
+	}
+	if CfgCompressAllowed(compatVersion) {
+		var err error
+		val, err = CfgCompressVal(val)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	nextEntry := &CfgMemEntry{
 		CAS: c.CASNext,
 		Val: make([]byte, len(val)),
@@ -88,7 +88,7 @@ func NewCfgMetaKv(nodeUUID string) (*CfgMetaKv, error) {
 	backoffFactor := float32(1.5)
 	backoffMaxSleepMS := 5000
 
-	go ExponentialBackoffLoop("cfg_metakv.RunObserveChildren",
+	go ExponentialBackoffLoopEx("cfg_metakv.RunObserveChildren",
 		func() int {
 			err := metakv.RunObserveChildren(cfg.prefix, cfg.metaKVCallback,
 				cfg.cancelCh)
@@ -100,7 +100,13 @@ func NewCfgMetaKv(nodeUUID string) (*CfgMetaKv, error) {
 
 			return 0 // No progress, so exponential backoff.
 		},
-		backoffStartSleepMS, backoffFactor, backoffMaxSleepMS)
+		BackoffOptions{
+			StartSleepMS:  backoffStartSleepMS,
+			BackoffFactor: backoffFactor,
+			MaxSleepMS:    backoffMaxSleepMS,
+			Jitter:        0.5,
+			StopCh:        cfg.cancelCh,
+		})
 
 	return cfg, nil
 }
@@ -130,6 +136,11 @@ func (c *CfgMetaKv) getRawLOCKED(key string, cas uint64) ([]byte, uint64, error)
 		return nil, 0, err
 	}
 
+	v, err = CfgDecompressVal(v)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	return v, 1, nil
 }
 
@@ -161,7 +172,12 @@ func (c *CfgMetaKv) setRawLOCKED(key string, val []byte, cas uint64) (
 
 	log.Printf("cfg_metakv: Set path: %v", path)
 
-	err := metakv.Set(path, val, nil) // TODO: Handle rev better.
+	val, err := c.compressValLOCKED(val)
+	if err != nil {
+		return 0, err
+	}
+
+	err = metakv.Set(path, val, nil) // TODO: Handle rev better.
 	if err != nil {
 		return 0, err
 	}
@@ -169,6 +185,17 @@ func (c *CfgMetaKv) setRawLOCKED(key string, val []byte, cas uint64) (
 	return 1, nil
 }
 
+// compressValLOCKED compresses a val when the cluster's compat
+// version allows it, see CfgCompressAllowed().
+func (c *CfgMetaKv) compressValLOCKED(val []byte) ([]byte, error) {
+	compatVersion, _, err := c.getRawLOCKED(COMPAT_VERSION_KEY, 0)
+	if err != nil || !CfgCompressAllowed(string(compatVersion)) {
+		return val, nil
+	}
+
+	return CfgCompressVal(val)
+}
+
 func (c *CfgMetaKv) Del(key string, cas uint64) error {
 	c.m.Lock()
 	err := c.delLOCKED(key, cas)
@@ -291,7 +318,12 @@ func (a *cfgMetaKvNodeDefsSplitHandler) get(
 	for _, v := range m {
 		var childNodeDefs NodeDefs
 
-		err = json.Unmarshal(v.Value, &childNodeDefs)
+		childVal, err := CfgDecompressVal(v.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		err = json.Unmarshal(childVal, &childNodeDefs)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -414,6 +446,11 @@ LOOP:
 			return 0, err
 		}
 
+		val, err = c.compressValLOCKED(val)
+		if err != nil {
+			return 0, err
+		}
+
 		childPath := path + "/" + k
 
 		log.Printf("cfg_metakv: Set split, key: %v, childPath: %v",
@@ -0,0 +1,128 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+// CfgRetryOptions controls how CfgRetry() retries a read-modify-write
+// of the Cfg when there are CAS conflicts, such as when multiple
+// nodes or planners are racing to update the same Cfg entry.
+type CfgRetryOptions struct {
+	// MaxTries is the max number of attempts, where <= 0 means retry
+	// forever until there's no CAS conflict.
+	MaxTries int
+
+	// The exponential backoff sleep parameters between attempts.
+	// See ExponentialBackoffLoop().
+	StartSleepMS  int
+	BackoffFactor float32
+	MaxSleepMS    int
+
+	// StopCh, when not nil and closed, stops the retries, such as
+	// when a manager is stopped, instead of sleeping for the next
+	// attempt.
+	StopCh <-chan struct{}
+}
+
+// CfgRetryOptionsDefault are the retry options used by cbgt's own
+// Cfg writers, like the planner and node registration.
+var CfgRetryOptionsDefault = CfgRetryOptions{
+	MaxTries:      100,
+	StartSleepMS:  10,
+	BackoffFactor: 1.5,
+	MaxSleepMS:    1000,
+}
+
+// CfgRetry invokes f until it succeeds, returns a non-CAS error, or
+// has been invoked opts.MaxTries times.  On a CAS conflict (when f
+// returns a *CfgCASError), CfgRetry sleeps with jittered exponential
+// backoff before invoking f again, unless opts.StopCh is closed.  The
+// f callback should re-read the latest Cfg entries on every
+// invocation and re-apply (or merge) its changes, as the tries
+// parameter is 0 on the first invocation.  The last error from f is
+// returned.
+func CfgRetry(opts CfgRetryOptions, f func(tries int) error) error {
+	var err error
+
+	tries := 0
+
+	ExponentialBackoffLoopEx("cfg_retry", func() int {
+		err = f(tries)
+		tries++
+
+		if err == nil {
+			return -1 // Success.
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return -1 // Not retryable.
+		}
+
+		return 0 // CAS conflict, so backoff and retry.
+	}, BackoffOptions{
+		StartSleepMS:  opts.StartSleepMS,
+		BackoffFactor: opts.BackoffFactor,
+		MaxSleepMS:    opts.MaxSleepMS,
+		Jitter:        0.5,
+		StopCh:        opts.StopCh,
+		MaxAttempts:   opts.MaxTries,
+	})
+
+	return err
+}
+
+// CfgSetRetry performs a read-modify-write of a single Cfg entry,
+// retrying on CAS conflicts.  The merge callback is invoked with the
+// latest value and CAS of the entry (a nil val if the entry does not
+// exist), and returns the next value to store.  When merge returns a
+// nil next value, the entry is left unchanged.  On a CAS conflict,
+// merge is invoked again with the newer, conflicting value, allowing
+// the caller to merge its changes with the concurrent changes.
+// Returns the CAS of the stored entry.
+func CfgSetRetry(cfg Cfg, key string, opts CfgRetryOptions,
+	merge func(val []byte, cas uint64) ([]byte, error)) (uint64, error) {
+	var casResult uint64
+
+	err := CfgRetry(opts, func(tries int) error {
+		val, cas, err := cfg.Get(key, 0)
+		if err != nil {
+			return err
+		}
+
+		valNext, err := merge(val, cas)
+		if err != nil {
+			return err
+		}
+		if valNext == nil {
+			casResult = cas
+			return nil
+		}
+
+		if val == nil {
+			cas = 0 // The entry must be created.
+		}
+
+		casResult, err = cfg.Set(key, valNext, cas)
+		if err != nil && val == nil {
+			// Losing a creation race to a concurrent writer is
+			// also treated as a CAS conflict.
+			v, _, errGet := cfg.Get(key, 0)
+			if errGet == nil && v != nil {
+				return &CfgCASError{}
+			}
+		}
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return casResult, nil
+}
@@ -0,0 +1,153 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"testing"
+)
+
+var testCfgRetryOptions = CfgRetryOptions{
+	MaxTries:      5,
+	StartSleepMS:  1,
+	BackoffFactor: 1.5,
+	MaxSleepMS:    5,
+}
+
+func TestCfgRetry(t *testing.T) {
+	n := 0
+	err := CfgRetry(testCfgRetryOptions, func(tries int) error {
+		if tries != n {
+			t.Errorf("expected tries: %d, got: %d", n, tries)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("expected success on first try, n: %d, err: %v", n, err)
+	}
+
+	n = 0
+	err = CfgRetry(testCfgRetryOptions, func(tries int) error {
+		n++
+		if tries < 2 {
+			return &CfgCASError{}
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("expected success after CAS retries, n: %d, err: %v", n, err)
+	}
+
+	n = 0
+	err = CfgRetry(testCfgRetryOptions, func(tries int) error {
+		n++
+		return &CfgCASError{}
+	})
+	if _, ok := err.(*CfgCASError); !ok || n != testCfgRetryOptions.MaxTries {
+		t.Errorf("expected CAS err after max tries, n: %d, err: %v", n, err)
+	}
+
+	n = 0
+	err = CfgRetry(testCfgRetryOptions, func(tries int) error {
+		n++
+		return fmt.Errorf("not a CAS err")
+	})
+	if err == nil || n != 1 {
+		t.Errorf("expected no retries on non-CAS err, n: %d, err: %v", n, err)
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	opts := testCfgRetryOptions
+	opts.MaxTries = 0
+	opts.StartSleepMS = 100000
+	opts.StopCh = stopCh
+
+	n = 0
+	err = CfgRetry(opts, func(tries int) error {
+		n++
+		return &CfgCASError{}
+	})
+	if _, ok := err.(*CfgCASError); !ok || n != 1 {
+		t.Errorf("expected CAS err when stopped, n: %d, err: %v", n, err)
+	}
+}
+
+// A racingCfg performs a concurrent Set() before each of the first
+// numRaces Set()'s, to simulate a racing writer.
+type racingCfg struct {
+	Cfg
+	numRaces int
+}
+
+func (c *racingCfg) Set(key string, val []byte, cas uint64) (uint64, error) {
+	if c.numRaces > 0 {
+		c.numRaces--
+		_, err := CfgSetRetry(c.Cfg, key, testCfgRetryOptions,
+			func(v []byte, cas uint64) ([]byte, error) {
+				return append(v, 'r'), nil
+			})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.Cfg.Set(key, val, cas)
+}
+
+func TestCfgSetRetry(t *testing.T) {
+	cfg := &racingCfg{Cfg: NewCfgMem(), numRaces: 2}
+
+	merges := 0
+
+	cas, err := CfgSetRetry(cfg, "k", testCfgRetryOptions,
+		func(val []byte, cas uint64) ([]byte, error) {
+			merges++
+			return append(val, 'x'), nil
+		})
+	if err != nil || cas == 0 {
+		t.Errorf("expected CfgSetRetry to work, err: %v", err)
+	}
+	if merges != 3 {
+		t.Errorf("expected 3 merges, got: %d", merges)
+	}
+
+	val, cas2, err := cfg.Get("k", 0)
+	if err != nil || cas2 != cas || string(val) != "rrx" {
+		t.Errorf("expected merged val, val: %s, err: %v", val, err)
+	}
+
+	cas3, err := CfgSetRetry(cfg, "k", testCfgRetryOptions,
+		func(val []byte, cas uint64) ([]byte, error) {
+			return nil, nil
+		})
+	if err != nil || cas3 != cas {
+		t.Errorf("expected unchanged entry on nil merge, err: %v", err)
+	}
+
+	_, err = CfgSetRetry(cfg, "k", testCfgRetryOptions,
+		func(val []byte, cas uint64) ([]byte, error) {
+			return nil, fmt.Errorf("merge err")
+		})
+	if err == nil {
+		t.Errorf("expected merge err")
+	}
+
+	_, err = CfgSetRetry(&ErrorOnlyCfg{}, "k", testCfgRetryOptions,
+		func(val []byte, cas uint64) ([]byte, error) {
+			return val, nil
+		})
+	if err == nil {
+		t.Errorf("expected err from ErrorOnlyCfg")
+	}
+}
@@ -0,0 +1,311 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// BenchOptions configures a RunBench() of a pindex implementation
+// type, which must be registered in cbgt.PIndexImplTypes, so that
+// applications can benchmark their own index types by calling
+// RunBench() after registering them.
+type BenchOptions struct {
+	IndexType   string
+	IndexParams string
+	Dir         string // The path of the benchmarked pindex.
+
+	NumPartitions int     // Source partitions, named "0", "1", etc.
+	NumKeys       int     // The size of the key space.
+	NumOps        int     // The total number of updates and deletes.
+	BatchSize     int     // Ops per snapshot.
+	ValSize       int     // Bytes per update value.
+	DeleteRatio   float64 // Fraction of ops that are deletes.
+	KeyDist       string  // One of the BENCH_KEY_DIST_* values.
+	Writers       int     // Concurrent writers, each with own partitions.
+
+	Queriers   int // Concurrent queriers, started with the writers.
+	NumQueries int // The total number of queries.
+	QueryBody  string
+
+	Seed int64
+}
+
+const (
+	BENCH_KEY_DIST_UNIFORM    = "uniform"
+	BENCH_KEY_DIST_ZIPF       = "zipf"
+	BENCH_KEY_DIST_SEQUENTIAL = "sequential"
+)
+
+// BenchLatencies summarizes the latencies of one kind of operation.
+type BenchLatencies struct {
+	Count int           `json:"count"`
+	Errs  int           `json:"errs"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// BenchResult is the outcome of a RunBench().
+type BenchResult struct {
+	Duration      time.Duration   `json:"duration"`
+	OpsPerSec     float64         `json:"opsPerSec"`
+	QueriesPerSec float64         `json:"queriesPerSec"`
+	Updates       *BenchLatencies `json:"updates"`
+	Deletes       *BenchLatencies `json:"deletes"`
+	Queries       *BenchLatencies `json:"queries"`
+}
+
+// benchLatencyRecorder collects the latencies of one worker, so that
+// workers don't contend on a lock.
+type benchLatencyRecorder struct {
+	updates, deletes, queries         []time.Duration
+	updateErrs, deleteErrs, queryErrs int
+}
+
+// RunBench creates a pindex of the given type in opts.Dir, drives
+// synthetic DataUpdate() and DataDelete() batches into its Dest,
+// along with concurrent queries, and reports the throughput and
+// latency percentiles.
+func RunBench(opts BenchOptions) (*BenchResult, error) {
+	if opts.NumPartitions <= 0 || opts.NumKeys <= 0 ||
+		opts.Writers <= 0 || opts.BatchSize <= 0 {
+		return nil, fmt.Errorf("bench: numPartitions, numKeys, writers" +
+			" and batchSize must be > 0")
+	}
+	if opts.Writers > opts.NumPartitions {
+		opts.Writers = opts.NumPartitions
+	}
+
+	keyGen, err := newBenchKeyGen(opts.KeyDist, opts.NumKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	impl, dest, err := cbgt.NewPIndexImpl(opts.IndexType,
+		opts.IndexParams, opts.Dir, func() {})
+	if err != nil {
+		return nil, fmt.Errorf("bench: NewPIndexImpl, err: %v", err)
+	}
+	defer dest.Close()
+
+	partitions := make([]string, opts.NumPartitions)
+	for i := range partitions {
+		partitions[i] = strconv.Itoa(i)
+	}
+
+	pindex := &cbgt.PIndex{
+		Name:             "bench",
+		UUID:             cbgt.NewUUID(),
+		IndexType:        opts.IndexType,
+		IndexName:        "bench",
+		IndexParams:      opts.IndexParams,
+		SourcePartitions: fmt.Sprintf("%v", partitions),
+		Path:             opts.Dir,
+		Impl:             impl,
+		Dest:             dest,
+	}
+
+	val := make([]byte, opts.ValSize)
+	for i := range val {
+		val[i] = 'a' + byte(i%26)
+	}
+
+	recorders := make([]*benchLatencyRecorder, opts.Writers+opts.Queriers)
+	for i := range recorders {
+		recorders[i] = &benchLatencyRecorder{}
+	}
+
+	var wgWriters, wgQueriers sync.WaitGroup
+
+	start := time.Now()
+
+	for w := 0; w < opts.Writers; w++ {
+		wgWriters.Add(1)
+		go func(w int) {
+			defer wgWriters.Done()
+
+			rec := recorders[w]
+			rnd := rand.New(rand.NewSource(opts.Seed + int64(w)))
+			nextKey := keyGen(rnd)
+
+			// Each writer owns the partitions p where p % Writers == w,
+			// so that the seqs of a partition are monotonic.
+			var myPartitions []string
+			for p := w; p < opts.NumPartitions; p += opts.Writers {
+				myPartitions = append(myPartitions, partitions[p])
+			}
+			seqs := make([]uint64, len(myPartitions))
+
+			numOps := opts.NumOps / opts.Writers
+			if w < opts.NumOps%opts.Writers {
+				numOps++
+			}
+
+			for op := 0; op < numOps; op++ {
+				pi := op % len(myPartitions)
+				partition := myPartitions[pi]
+
+				if seqs[pi]%uint64(opts.BatchSize) == 0 {
+					dest.SnapshotStart(partition, seqs[pi]+1,
+						seqs[pi]+uint64(opts.BatchSize))
+				}
+				seqs[pi]++
+
+				key := []byte(fmt.Sprintf("k%d", nextKey()))
+
+				t0 := time.Now()
+				if rnd.Float64() < opts.DeleteRatio {
+					err := dest.DataDelete(partition, key, seqs[pi],
+						0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+					rec.deletes = append(rec.deletes, time.Since(t0))
+					if err != nil {
+						rec.deleteErrs++
+					}
+				} else {
+					err := dest.DataUpdate(partition, key, seqs[pi], val,
+						0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+					rec.updates = append(rec.updates, time.Since(t0))
+					if err != nil {
+						rec.updateErrs++
+					}
+				}
+			}
+		}(w)
+	}
+
+	var queriesLeft int64 = int64(opts.NumQueries)
+
+	for q := 0; q < opts.Queriers; q++ {
+		wgQueriers.Add(1)
+		go func(rec *benchLatencyRecorder) {
+			defer wgQueriers.Done()
+
+			cancelCh := make(chan bool)
+
+			for atomic.AddInt64(&queriesLeft, -1) >= 0 {
+				t0 := time.Now()
+				err := dest.Query(pindex, []byte(opts.QueryBody),
+					ioutil.Discard, cancelCh)
+				rec.queries = append(rec.queries, time.Since(t0))
+				if err != nil {
+					rec.queryErrs++
+				}
+			}
+		}(recorders[opts.Writers+q])
+	}
+
+	wgWriters.Wait()
+	opsDuration := time.Since(start)
+
+	wgQueriers.Wait()
+	duration := time.Since(start)
+
+	var updates, deletes, queries []time.Duration
+	var updateErrs, deleteErrs, queryErrs int
+	for _, rec := range recorders {
+		updates = append(updates, rec.updates...)
+		deletes = append(deletes, rec.deletes...)
+		queries = append(queries, rec.queries...)
+		updateErrs += rec.updateErrs
+		deleteErrs += rec.deleteErrs
+		queryErrs += rec.queryErrs
+	}
+
+	rv := &BenchResult{
+		Duration: duration,
+		Updates:  benchLatencies(updates, updateErrs),
+		Deletes:  benchLatencies(deletes, deleteErrs),
+		Queries:  benchLatencies(queries, queryErrs),
+	}
+	if opsDuration > 0 {
+		rv.OpsPerSec = float64(len(updates)+len(deletes)) /
+			opsDuration.Seconds()
+	}
+	if duration > 0 {
+		rv.QueriesPerSec = float64(len(queries)) / duration.Seconds()
+	}
+
+	return rv, nil
+}
+
+// newBenchKeyGen returns a func that creates per-worker generators
+// of keys in [0, numKeys) that follow a distribution.
+func newBenchKeyGen(keyDist string, numKeys int) (
+	func(rnd *rand.Rand) func() uint64, error) {
+	switch keyDist {
+	case "", BENCH_KEY_DIST_UNIFORM:
+		return func(rnd *rand.Rand) func() uint64 {
+			return func() uint64 { return uint64(rnd.Intn(numKeys)) }
+		}, nil
+	case BENCH_KEY_DIST_ZIPF:
+		return func(rnd *rand.Rand) func() uint64 {
+			z := rand.NewZipf(rnd, 1.1, 1, uint64(numKeys-1))
+			return z.Uint64
+		}, nil
+	case BENCH_KEY_DIST_SEQUENTIAL:
+		return func(rnd *rand.Rand) func() uint64 {
+			next := uint64(0)
+			return func() uint64 {
+				rv := next % uint64(numKeys)
+				next++
+				return rv
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("bench: unknown key distribution: %q", keyDist)
+}
+
+// benchLatencies computes the percentiles of some latencies.
+func benchLatencies(latencies []time.Duration, errs int) *BenchLatencies {
+	rv := &BenchLatencies{Count: len(latencies), Errs: errs}
+	if len(latencies) <= 0 {
+		return rv
+	}
+
+	sort.Sort(durations(latencies))
+
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+
+	rv.P50 = percentile(50)
+	rv.P90 = percentile(90)
+	rv.P99 = percentile(99)
+	rv.Max = latencies[len(latencies)-1]
+
+	return rv
+}
+
+type durations []time.Duration
+
+func (a durations) Len() int {
+	return len(a)
+}
+
+func (a durations) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a durations) Less(i, j int) bool {
+	return a[i] < a[j]
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	for _, keyDist := range []string{BENCH_KEY_DIST_UNIFORM,
+		BENCH_KEY_DIST_ZIPF, BENCH_KEY_DIST_SEQUENTIAL} {
+		r, err := RunBench(BenchOptions{
+			IndexType:     "blackhole",
+			Dir:           emptyDir,
+			NumPartitions: 4,
+			NumKeys:       100,
+			NumOps:        1000,
+			BatchSize:     10,
+			ValSize:       10,
+			DeleteRatio:   0.5,
+			KeyDist:       keyDist,
+			Writers:       3,
+			Queriers:      2,
+			NumQueries:    50,
+		})
+		if err != nil {
+			t.Errorf("expected RunBench() to work, keyDist: %s, err: %v",
+				keyDist, err)
+			continue
+		}
+		if r.Updates.Count+r.Deletes.Count != 1000 ||
+			r.Queries.Count != 50 {
+			t.Errorf("expected all ops and queries, keyDist: %s, r: %#v",
+				keyDist, r)
+		}
+		if r.Updates.P50 > r.Updates.P99 || r.Updates.P99 > r.Updates.Max {
+			t.Errorf("expected ordered percentiles, r: %#v", r.Updates)
+		}
+	}
+
+	_, err := RunBench(BenchOptions{IndexType: "blackhole", Dir: emptyDir,
+		NumPartitions: 1, NumKeys: 1, Writers: 1, BatchSize: 1,
+		KeyDist: "not-a-dist"})
+	if err == nil {
+		t.Errorf("expected RunBench() to fail on an unknown key dist")
+	}
+
+	_, err = RunBench(BenchOptions{IndexType: "not-a-type", Dir: emptyDir,
+		NumPartitions: 1, NumKeys: 1, Writers: 1, BatchSize: 1})
+	if err == nil {
+		t.Errorf("expected RunBench() to fail on an unknown index type")
+	}
+}
+
+func TestBenchLatencies(t *testing.T) {
+	l := benchLatencies(nil, 0)
+	if l.Count != 0 || l.Max != 0 {
+		t.Errorf("expected empty latencies, got: %#v", l)
+	}
+
+	var d []time.Duration
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i))
+	}
+	l = benchLatencies(d, 1)
+	if l.Count != 100 || l.Errs != 1 ||
+		l.P50 != 50 || l.P90 != 90 || l.P99 != 99 || l.Max != 100 {
+		t.Errorf("unexpected latencies: %#v", l)
+	}
+}
@@ -0,0 +1,243 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/couchbase/cbgt"
+)
+
+// A command wraps one or more REST API requests.  A command's table
+// func renders a response as a table, and is nil when the response
+// is printed as-is.
+type command struct {
+	args  string
+	about string
+	nargs int // The min number of args.
+	run   func(c *client, args []string) ([]byte, error)
+	table func(w io.Writer, resp []byte) error
+}
+
+var commands = map[string]*command{
+	"indexes": {
+		about: "lists the index definitions.",
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("GET", "/api/index", nil, nil)
+		},
+		table: tableIndexes,
+	},
+	"index-create": {
+		args: "INDEX-NAME INDEX-DEF-JSON",
+		about: "creates or updates an index, where the JSON is like" +
+			"\n      '{\"type\":\"blackhole\",\"sourceType\":\"nil\"}'.",
+		nargs: 2,
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("PUT", "/api/index/"+args[0], nil, []byte(args[1]))
+		},
+		table: tableStatus,
+	},
+	"index-delete": {
+		args:  "INDEX-NAME",
+		about: "deletes an index.",
+		nargs: 1,
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("DELETE", "/api/index/"+args[0], nil, nil)
+		},
+		table: tableStatus,
+	},
+	"plan": {
+		about: "shows the assignments of index partitions to nodes.",
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("GET", "/api/cfg", nil, nil)
+		},
+		table: tablePlan,
+	},
+	"kick": {
+		args:  "[MSG]",
+		about: "kicks the planner and janitor of the node.",
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("POST", "/api/managerKick",
+				url.Values{"msg": []string{strings.Join(args, " ")}}, nil)
+		},
+		table: tableStatus,
+	},
+	"ingest-pause": {
+		args:  "INDEX-NAME",
+		about: "pauses the ingest of document mutations into an index.",
+		nargs: 1,
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("POST", "/api/index/"+args[0]+
+				"/ingestControl/pause", nil, nil)
+		},
+		table: tableStatus,
+	},
+	"ingest-resume": {
+		args:  "INDEX-NAME",
+		about: "resumes the ingest of document mutations into an index.",
+		nargs: 1,
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("POST", "/api/index/"+args[0]+
+				"/ingestControl/resume", nil, nil)
+		},
+		table: tableStatus,
+	},
+	"rebalance": {
+		about: "replans the index partitions over the current nodes.",
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("POST", "/api/managerKick",
+				url.Values{"msg": []string{"cbgt-admin rebalance"}}, nil)
+		},
+		table: tableStatus,
+	},
+	"node-remove": {
+		args: "NODE-UUID",
+		about: "gracefully removes a node, moving its index partitions" +
+			"\n      to the remaining nodes.",
+		nargs: 1,
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("POST", "/api/node/"+args[0]+"/remove", nil, nil)
+		},
+		table: tableStatus,
+	},
+	"diag": {
+		about: "fetches the diagnostic info of the node.",
+		run: func(c *client, args []string) ([]byte, error) {
+			return c.do("GET", "/api/diag", nil, nil)
+		},
+	},
+}
+
+// runCommand runs the command named by args[0] and prints its
+// response to w, as a table unless asJSON is true.
+func runCommand(c *client, w io.Writer, args []string, asJSON bool) error {
+	cmd, exists := commands[args[0]]
+	if !exists {
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	if len(args)-1 < cmd.nargs {
+		return fmt.Errorf("usage: %s %s", args[0], cmd.args)
+	}
+
+	resp, err := cmd.run(c, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if asJSON || cmd.table == nil {
+		var buf bytes.Buffer
+		if json.Indent(&buf, resp, "", "  ") == nil {
+			resp = buf.Bytes()
+		}
+		_, err = fmt.Fprintf(w, "%s\n", bytes.TrimSpace(resp))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	err = cmd.table(tw, resp)
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// ------------------------------------------------
+
+func tableStatus(w io.Writer, resp []byte) error {
+	var r struct {
+		Status string `json:"status"`
+	}
+	err := json.Unmarshal(resp, &r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, r.Status)
+	return nil
+}
+
+func tableIndexes(w io.Writer, resp []byte) error {
+	var r struct {
+		IndexDefs *cbgt.IndexDefs `json:"indexDefs"`
+	}
+	err := json.Unmarshal(resp, &r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "NAME\tTYPE\tSOURCE TYPE\tSOURCE NAME\tUUID")
+
+	if r.IndexDefs == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(r.IndexDefs.IndexDefs))
+	for name := range r.IndexDefs.IndexDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := r.IndexDefs.IndexDefs[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			d.Name, d.Type, d.SourceType, d.SourceName, d.UUID)
+	}
+	return nil
+}
+
+func tablePlan(w io.Writer, resp []byte) error {
+	var r struct {
+		PlanPIndexes *cbgt.PlanPIndexes `json:"planPIndexes"`
+	}
+	err := json.Unmarshal(resp, &r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "PINDEX\tINDEX\tSOURCE PARTITIONS\tNODES (UUID:PRIORITY)")
+
+	if r.PlanPIndexes == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(r.PlanPIndexes.PlanPIndexes))
+	for name := range r.PlanPIndexes.PlanPIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := r.PlanPIndexes.PlanPIndexes[name]
+
+		nodeUUIDs := make([]string, 0, len(p.Nodes))
+		for nodeUUID := range p.Nodes {
+			nodeUUIDs = append(nodeUUIDs, nodeUUID)
+		}
+		sort.Strings(nodeUUIDs)
+
+		nodes := make([]string, 0, len(nodeUUIDs))
+		for _, nodeUUID := range nodeUUIDs {
+			nodes = append(nodes,
+				fmt.Sprintf("%s:%d", nodeUUID, p.Nodes[nodeUUID].Priority))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.IndexName,
+			p.SourcePartitions, strings.Join(nodes, ","))
+	}
+	return nil
+}
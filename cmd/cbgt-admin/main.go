@@ -0,0 +1,111 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// The cbgt-admin tool administers a cbgt cluster through the REST API
+// of any of its nodes, unlike cbgt-ctl, which works directly on the
+// Cfg.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+func main() {
+	flag.Parse()
+
+	if flags.Version {
+		fmt.Printf("%s main: %s, data: %s\n",
+			path.Base(os.Args[0]), cbgt.VERSION, cbgt.VERSION)
+		os.Exit(0)
+	}
+
+	if flags.Help || flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{
+		baseURL: strings.TrimSuffix(flags.URL, "/"),
+		auth:    flags.Auth,
+		http: &http.Client{
+			Timeout: time.Duration(flags.Timeout) * time.Second,
+		},
+	}
+
+	err := runCommand(c, os.Stdout, flag.Args(), flags.JSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+// ------------------------------------------------
+
+// A client sends requests to the REST API of a node.
+type client struct {
+	baseURL string
+	auth    string // Optional "user:pswd".
+	http    *http.Client
+}
+
+// do sends a REST request and returns the response body, or an error
+// if the response isn't an HTTP 200.
+func (c *client) do(method, path string, params url.Values,
+	body []byte) ([]byte, error) {
+	u := c.baseURL + path
+	if len(params) > 0 {
+		u = u + "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.auth != "" {
+		a := strings.SplitN(c.auth, ":", 2)
+		if len(a) < 2 {
+			a = append(a, "")
+		}
+		req.SetBasicAuth(a[0], a[1])
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s, status code: %d, resp: %s",
+			method, path, resp.StatusCode,
+			strings.TrimSpace(string(respBuf)))
+	}
+
+	return respBuf, nil
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type Flags struct {
+	Auth    string
+	Help    bool
+	JSON    bool
+	Timeout int
+	URL     string
+	Version bool
+}
+
+var flags Flags
+var flagAliases map[string][]string
+
+func init() {
+	flagAliases = initFlags(&flags)
+}
+
+func initFlags(flags *Flags) map[string][]string {
+	flagAliases := map[string][]string{} // main flag name => all aliases.
+	flagKinds := map[string]string{}
+
+	s := func(v *string, names []string, kind string,
+		defaultVal, usage string) { // String cmd-line param.
+		for _, name := range names {
+			flag.StringVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	i := func(v *int, names []string, kind string,
+		defaultVal int, usage string) { // Integer cmd-line param.
+		for _, name := range names {
+			flag.IntVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	b := func(v *bool, names []string, kind string,
+		defaultVal bool, usage string) { // Bool cmd-line param.
+		for _, name := range names {
+			flag.BoolVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	s(&flags.Auth,
+		[]string{"auth", "u"}, "USER:PSWD", "",
+		"optional credentials for the REST API, sent as basic auth.")
+	b(&flags.Help,
+		[]string{"help", "?", "H", "h"}, "", false,
+		"print this usage message and exit.")
+	b(&flags.JSON,
+		[]string{"json", "j"}, "", false,
+		"print the JSON responses of the REST API instead of tables.")
+	i(&flags.Timeout,
+		[]string{"timeout"}, "SECS", 60,
+		"seconds to wait for each REST API request.")
+	s(&flags.URL,
+		[]string{"url", "s"}, "URL", "http://localhost:8095",
+		"URL of the REST API of any node of the cluster;"+
+			"\ndefault is 'http://localhost:8095'.")
+	b(&flags.Version,
+		[]string{"version", "v"}, "", false,
+		"print version string and exit.")
+
+	flag.Usage = func() {
+		base := path.Base(os.Args[0])
+
+		fmt.Fprintf(os.Stderr, "%s: administration tool for a cbgt cluster\n", base)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [flags] COMMAND [ARGS]\n", base)
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+
+		names := []string(nil)
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			c := commands[name]
+			fmt.Fprintf(os.Stderr, "  %s %s\n      %s\n", name, c.args, c.about)
+		}
+
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+
+		flagsByName := map[string]*flag.Flag{}
+		flag.VisitAll(func(f *flag.Flag) {
+			flagsByName[f.Name] = f
+		})
+
+		flags := []string(nil)
+		for name := range flagAliases {
+			flags = append(flags, name)
+		}
+		sort.Strings(flags)
+
+		for _, name := range flags {
+			aliases := flagAliases[name]
+			a := []string(nil)
+			for i := len(aliases) - 1; i >= 0; i-- {
+				a = append(a, aliases[i])
+			}
+			f := flagsByName[name]
+			fmt.Fprintf(os.Stderr, "  -%s %s\n",
+				strings.Join(a, ", -"), flagKinds[name])
+			fmt.Fprintf(os.Stderr, "      %s\n",
+				strings.Join(strings.Split(f.Usage, "\n"),
+					"\n      "))
+		}
+
+		fmt.Fprintf(os.Stderr, "\nExamples:")
+		fmt.Fprintf(os.Stderr, examples)
+	}
+
+	return flagAliases
+}
+
+const examples = `
+  List the index definitions of a cluster:
+    ./cbgt-admin -url=http://10.1.1.10:8095 indexes
+  Create an index:
+    ./cbgt-admin index-create myIndex '{"type":"blackhole","sourceType":"nil"}'
+  Pause the ingest of an index, printing the JSON response:
+    ./cbgt-admin -json ingest-pause myIndex
+
+`
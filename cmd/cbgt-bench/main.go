@@ -0,0 +1,101 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// The cbgt-bench tool drives synthetic mutations and concurrent
+// queries into a pindex implementation type and reports throughput
+// and latency percentiles.  Applications with their own pindex types
+// can instead call cmd.RunBench() after registering their types.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/cmd"
+)
+
+func main() {
+	flag.Parse()
+
+	if flags.Help {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if flags.Version {
+		fmt.Printf("%s main: %s, data: %s\n",
+			path.Base(os.Args[0]), cbgt.VERSION, cbgt.VERSION)
+		os.Exit(0)
+	}
+
+	dir := flags.DataDir
+	if dir == "" {
+		tmpDir, err := ioutil.TempDir("", "cbgt-bench")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path.Base(os.Args[0]), err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(tmpDir)
+		dir = tmpDir
+	}
+
+	r, err := cmd.RunBench(cmd.BenchOptions{
+		IndexType:     flags.IndexType,
+		IndexParams:   flags.IndexParams,
+		Dir:           dir,
+		NumPartitions: flags.NumPartitions,
+		NumKeys:       flags.NumKeys,
+		NumOps:        flags.NumOps,
+		BatchSize:     flags.BatchSize,
+		ValSize:       flags.ValSize,
+		DeleteRatio:   flags.DeleteRatio,
+		KeyDist:       flags.KeyDist,
+		Writers:       flags.Writers,
+		Queriers:      flags.Queriers,
+		NumQueries:    flags.NumQueries,
+		QueryBody:     flags.Query,
+		Seed:          flags.Seed,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+
+	if flags.JSON {
+		j, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Printf("%s\n", j)
+		return
+	}
+
+	fmt.Printf("duration: %v, ops/sec: %.1f, queries/sec: %.1f\n\n",
+		r.Duration, r.OpsPerSec, r.QueriesPerSec)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OP\tCOUNT\tERRS\tP50\tP90\tP99\tMAX")
+	for _, x := range []struct {
+		op string
+		l  *cmd.BenchLatencies
+	}{
+		{"update", r.Updates},
+		{"delete", r.Deletes},
+		{"query", r.Queries},
+	} {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\n", x.op,
+			x.l.Count, x.l.Errs, x.l.P50, x.l.P90, x.l.P99, x.l.Max)
+	}
+	tw.Flush()
+}
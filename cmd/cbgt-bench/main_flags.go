@@ -0,0 +1,209 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/cbgt/cmd"
+)
+
+type Flags struct {
+	BatchSize     int
+	DataDir       string
+	DeleteRatio   float64
+	Help          bool
+	IndexParams   string
+	IndexType     string
+	JSON          bool
+	KeyDist       string
+	NumKeys       int
+	NumOps        int
+	NumPartitions int
+	NumQueries    int
+	Queriers      int
+	Query         string
+	Seed          int64
+	ValSize       int
+	Version       bool
+	Writers       int
+}
+
+var flags Flags
+var flagAliases map[string][]string
+
+func init() {
+	flagAliases = initFlags(&flags)
+}
+
+func initFlags(flags *Flags) map[string][]string {
+	flagAliases := map[string][]string{} // main flag name => all aliases.
+	flagKinds := map[string]string{}
+
+	s := func(v *string, names []string, kind string,
+		defaultVal, usage string) { // String cmd-line param.
+		for _, name := range names {
+			flag.StringVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	i := func(v *int, names []string, kind string,
+		defaultVal int, usage string) { // Integer cmd-line param.
+		for _, name := range names {
+			flag.IntVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	i64 := func(v *int64, names []string, kind string,
+		defaultVal int64, usage string) { // Int64 cmd-line param.
+		for _, name := range names {
+			flag.Int64Var(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	f := func(v *float64, names []string, kind string,
+		defaultVal float64, usage string) { // Float cmd-line param.
+		for _, name := range names {
+			flag.Float64Var(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	b := func(v *bool, names []string, kind string,
+		defaultVal bool, usage string) { // Bool cmd-line param.
+		for _, name := range names {
+			flag.BoolVar(v, name, defaultVal, usage)
+		}
+		flagAliases[names[0]] = names
+		flagKinds[names[0]] = kind
+	}
+
+	i(&flags.BatchSize,
+		[]string{"batchSize"}, "INTEGER", 100,
+		"number of mutations per snapshot of a partition.")
+	s(&flags.DataDir,
+		[]string{"dataDir", "data"}, "DIR", "",
+		"optional directory path for the benchmarked pindex;"+
+			"\ndefault is a temporary directory that's removed on exit.")
+	f(&flags.DeleteRatio,
+		[]string{"deleteRatio"}, "FLOAT", 0.1,
+		"fraction of the mutations that are deletes.")
+	b(&flags.Help,
+		[]string{"help", "?", "H", "h"}, "", false,
+		"print this usage message and exit.")
+	s(&flags.IndexParams,
+		[]string{"indexParams"}, "JSON", "",
+		"optional index params JSON for the pindex.")
+	s(&flags.IndexType,
+		[]string{"indexType", "t"}, "TYPE", "blackhole",
+		"the registered pindex implementation type to benchmark.")
+	b(&flags.JSON,
+		[]string{"json", "j"}, "", false,
+		"print the results as JSON.")
+	s(&flags.KeyDist,
+		[]string{"keyDist"}, "DIST", cmd.BENCH_KEY_DIST_UNIFORM,
+		"distribution of the mutated keys, one of uniform,"+
+			"\nzipf or sequential.")
+	i(&flags.NumKeys,
+		[]string{"numKeys"}, "INTEGER", 100000,
+		"number of distinct keys.")
+	i(&flags.NumOps,
+		[]string{"numOps", "n"}, "INTEGER", 1000000,
+		"total number of mutations.")
+	i(&flags.NumPartitions,
+		[]string{"numPartitions"}, "INTEGER", 64,
+		"number of source partitions.")
+	i(&flags.NumQueries,
+		[]string{"numQueries"}, "INTEGER", 0,
+		"total number of queries.")
+	i(&flags.Queriers,
+		[]string{"queriers"}, "INTEGER", 0,
+		"number of concurrent queriers.")
+	s(&flags.Query,
+		[]string{"query", "q"}, "JSON", "",
+		"the request body of each query.")
+	i64(&flags.Seed,
+		[]string{"seed"}, "INTEGER", 0,
+		"random number seed, for repeatable runs.")
+	i(&flags.ValSize,
+		[]string{"valSize"}, "BYTES", 100,
+		"size of each update's value.")
+	b(&flags.Version,
+		[]string{"version", "v"}, "", false,
+		"print version string and exit.")
+	i(&flags.Writers,
+		[]string{"writers", "w"}, "INTEGER", 4,
+		"number of concurrent writers.")
+
+	flag.Usage = func() {
+		if !flags.Help {
+			return
+		}
+
+		base := path.Base(os.Args[0])
+
+		fmt.Fprintf(os.Stderr, "%s: benchmark tool for pindex types\n", base)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [flags]\n", base)
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+
+		flagsByName := map[string]*flag.Flag{}
+		flag.VisitAll(func(f *flag.Flag) {
+			flagsByName[f.Name] = f
+		})
+
+		flags := []string(nil)
+		for name := range flagAliases {
+			flags = append(flags, name)
+		}
+		sort.Strings(flags)
+
+		for _, name := range flags {
+			aliases := flagAliases[name]
+			a := []string(nil)
+			for i := len(aliases) - 1; i >= 0; i-- {
+				a = append(a, aliases[i])
+			}
+			f := flagsByName[name]
+			fmt.Fprintf(os.Stderr, "  -%s %s\n",
+				strings.Join(a, ", -"), flagKinds[name])
+			fmt.Fprintf(os.Stderr, "      %s\n",
+				strings.Join(strings.Split(f.Usage, "\n"),
+					"\n      "))
+		}
+
+		fmt.Fprintf(os.Stderr, "\nExamples:")
+		fmt.Fprintf(os.Stderr, examples)
+	}
+
+	return flagAliases
+}
+
+const examples = `
+  Benchmark mutations into a blackhole pindex:
+    ./cbgt-bench -indexType=blackhole -numOps=1000000 -writers=8
+  With zipf distributed keys and concurrent queries:
+    ./cbgt-bench -keyDist=zipf -queriers=4 -numQueries=10000 \
+      -query='{"q":"foo"}'
+
+`
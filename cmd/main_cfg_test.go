@@ -13,7 +13,10 @@ package cmd
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -65,3 +68,62 @@ func TestMainCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestMainCfgJoin(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	status := http.StatusOK
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/api/cluster/join" {
+				t.Errorf("unexpected join request: %s %s", r.Method, r.URL.Path)
+			}
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "admin" || password != "pswd" {
+				t.Errorf("expected join request credentials, got: %s, %s",
+					user, password)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{"status":"ok","cfgConnect":"simple"}`))
+		}))
+	defer s.Close()
+
+	seedURL := strings.Replace(s.URL, "http://", "http://admin:pswd@", 1)
+
+	options := map[string]string{}
+
+	cfg, err := MainCfgEx("cbgt", "join:"+seedURL, "10.1.1.20:8095",
+		"wanted", emptyDir, "", options)
+	if err != nil || cfg == nil {
+		t.Errorf("expected join to work, err: %v", err)
+	}
+	if options["cfgConnect"] != "simple" {
+		t.Errorf("expected cfgConnect option, got: %v", options)
+	}
+
+	status = http.StatusBadRequest
+
+	cfg, err = MainCfgEx("cbgt", "join:"+seedURL, "10.1.1.20:8095",
+		"wanted", emptyDir, "", nil)
+	if err == nil || cfg != nil {
+		t.Errorf("expected join to fail on a bad seed response")
+	}
+}
+
+func TestCfgConnectWithPassword(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"metakv", "metakv"},
+		{"couchbase:http://cb:8091", "couchbase:http://cb:8091"},
+		{"couchbase:http://b@cb:8091", "couchbase:http://b:p%40ss@cb:8091"},
+		{"couchbase:http://b:x@cb:8091", "couchbase:http://b:x@cb:8091"},
+	}
+	for i, test := range tests {
+		out := cfgConnectWithPassword(test.in, "p@ss")
+		if out != test.out {
+			t.Errorf("test: %d, expected: %s, got: %s", i, test.out, out)
+		}
+	}
+}
@@ -88,6 +88,11 @@ type CtlOptions struct {
 	Verbose            int
 	FavorMinNodes      bool
 	WaitForMemberNodes int // Seconds to wait for wanted member nodes to appear.
+
+	// Optional, invoked with a cbgt.MANAGER_EVENT_REBALANCE_DONE
+	// event when a topology change completes, such as with
+	// cbgt.Manager.EmitEvent.
+	EventSink func(cbgt.ManagerEvent)
 }
 
 type CtlNode struct {
@@ -577,6 +582,17 @@ func (ctl *Ctl) startCtlLOCKED(
 
 			ctl.m.Unlock()
 
+			if ctl.optionsCtl.EventSink != nil {
+				event := cbgt.ManagerEvent{
+					Kind: cbgt.MANAGER_EVENT_REBALANCE_DONE,
+					Msg:  "mode: " + mode,
+				}
+				if len(ctlErrs) > 0 {
+					event.Err = fmt.Sprintf("%v", ctlErrs)
+				}
+				ctl.optionsCtl.EventSink(event)
+			}
+
 			close(ctlDoneCh)
 		}()
 
@@ -43,6 +43,7 @@ type IndexDef struct {
 	SourceUUID   string     `json:"sourceUUID,omitempty"`
 	SourceParams string     `json:"sourceParams,omitempty"` // Optional connection info.
 	PlanParams   PlanParams `json:"planParams,omitempty"`
+	Namespace    string     `json:"namespace,omitempty"` // See NamespacedIndexName().
 
 	// NOTE: Any auth credentials to access datasource, if any, may be
 	// stored as part of SourceParams.
@@ -62,6 +63,7 @@ type indexDefBase struct {
 	SourceName string     `json:"sourceName,omitempty"`
 	SourceUUID string     `json:"sourceUUID,omitempty"`
 	PlanParams PlanParams `json:"planParams,omitempty"`
+	Namespace  string     `json:"namespace,omitempty"`
 }
 
 // A PlanParams holds input parameters to the planner, that control
@@ -111,6 +113,41 @@ type PlanParams struct {
 	// there was no previous plan.  Defaults to false (allow
 	// re-planning).
 	PlanFrozen bool `json:"planFrozen,omitempty"`
+
+	// BuildPriority allows users to have the pindexes of an index
+	// built before those of lower priority indexes, when a node
+	// limits its concurrent pindex builds (see
+	// MaxConcurrentPIndexBuildsOption).  Defaults to 0.
+	BuildPriority int `json:"buildPriority,omitempty"`
+
+	// NodeSelector allows users to pin the PIndexes of an index to
+	// the nodes whose tags or container match every entry, such as
+	// {"ssd":"true","zone":"us-east-1a"}.  See
+	// NodeDefMatchesSelector().  Defaults to nil, meaning any node.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// ZoneSpread controls whether the planner checks that the copies
+	// of each PIndex are in distinct zones, where "" (the default)
+	// means only best effort via the HierarchyRules.  See
+	// ZONE_SPREAD_WARN and ZONE_SPREAD_STRICT.
+	ZoneSpread string `json:"zoneSpread,omitempty"`
+
+	// Resplit is non-nil while an index is being re-split into a new
+	// generation of pindexes, during which the previous generation
+	// keeps serving queries.  See Manager.ApplyPartitionsAdvice().
+	Resplit *PlanResplit `json:"resplit,omitempty"`
+}
+
+// A PlanResplit represents the progress of a controlled re-split of
+// an index into a new generation of pindexes.
+type PlanResplit struct {
+	// The index UUID of the previous generation of pindexes, which
+	// the planner keeps in the plan until the re-split is done.
+	PrevIndexUUID string `json:"prevIndexUUID"`
+
+	// The UUIDs of the nodes whose pindexes of the new generation
+	// have caught up with the data source.
+	Ready map[string]bool `json:"ready,omitempty"`
 }
 
 // A NodePlanParam defines whether a particular node can service a
@@ -139,6 +176,8 @@ type NodeDef struct {
 	Container   string   `json:"container"`
 	Weight      int      `json:"weight"`
 	Extras      string   `json:"extras"`
+
+	Capabilities *NodeCapabilities `json:"capabilities,omitempty"`
 }
 
 // ------------------------------------------------------------------------
@@ -150,6 +189,12 @@ type PlanPIndexes struct {
 	PlanPIndexes map[string]*PlanPIndex `json:"planPIndexes"` // Key is PlanPIndex.Name.
 	ImplVersion  string                 `json:"implVersion"`  // See VERSION.
 	Warnings     map[string][]string    `json:"warnings"`     // Key is IndexDef.Name.
+
+	// Shards is non-empty only in a PlanPIndexes manifest, where the
+	// PlanPIndex children have been sharded into separate Cfg
+	// entries.  Keyed by IndexDef.Name, value is the shard's Cfg key.
+	// See CfgPlanPIndexesSharding.
+	Shards map[string]string `json:"shards,omitempty"`
 }
 
 // A PlanPIndex represents the plan for a particular index partition,
@@ -331,6 +376,33 @@ func CfgSetNodeDefs(cfg Cfg, kind string, nodeDefs *NodeDefs,
 	return cfg.Set(CfgNodeDefsKey(kind), buf, cas)
 }
 
+// CfgAddNodeDef adds or replaces a NodeDef in the Cfg.
+func CfgAddNodeDef(cfg Cfg, kind string, nodeDef *NodeDef,
+	version string) error {
+	nodeDefs, cas, err := CfgGetNodeDefs(cfg, kind)
+	if err != nil {
+		return err
+	}
+
+	if nodeDefs == nil {
+		nodeDefs = NewNodeDefs(version)
+	}
+
+	nodeDefPrev, exists := nodeDefs.NodeDefs[nodeDef.UUID]
+	if exists && reflect.DeepEqual(nodeDefPrev, nodeDef) {
+		return nil
+	}
+
+	nodeDefs.NodeDefs[nodeDef.UUID] = nodeDef
+
+	nodeDefs.UUID = NewUUID()
+	nodeDefs.ImplVersion = version
+
+	_, err = CfgSetNodeDefs(cfg, kind, nodeDefs, cas)
+
+	return err
+}
+
 // CfgRemoveNodeDef removes a NodeDef with the given uuid from the Cfg.
 func CfgRemoveNodeDef(cfg Cfg, kind, uuid, version string) error {
 	nodeDefs, cas, err := CfgGetNodeDefs(cfg, kind)
@@ -360,7 +432,8 @@ func CfgRemoveNodeDef(cfg Cfg, kind, uuid, version string) error {
 // ------------------------------------------------------------------------
 
 // UnregisterNodes removes the given nodes (by their UUID) from the
-// nodes wanted & known cfg entries.
+// nodes wanted & known cfg entries, along with their heartbeat and
+// failover leases.
 func UnregisterNodes(cfg Cfg, version string, nodeUUIDs []string) error {
 	return UnregisterNodesWithRetries(cfg, version, nodeUUIDs, 10)
 }
@@ -370,22 +443,44 @@ func UnregisterNodes(cfg Cfg, version string, nodeUUIDs []string) error {
 // max number of times if there were CAS conflict errors.
 func UnregisterNodesWithRetries(cfg Cfg, version string, nodeUUIDs []string,
 	maxTries int) error {
+	opts := CfgRetryOptionsDefault
+	opts.MaxTries = maxTries
+
 	for _, nodeUUID := range nodeUUIDs {
 		for _, kind := range []string{NODE_DEFS_WANTED, NODE_DEFS_KNOWN} {
-		LOOP_TRIES:
-			for tries := 0; tries < maxTries; tries++ {
-				err := CfgRemoveNodeDef(cfg, kind, nodeUUID, version)
-				if err != nil {
-					if _, ok := err.(*CfgCASError); ok {
-						continue LOOP_TRIES
-					}
-
-					return fmt.Errorf("defs: UnregisterNodes,"+
-						" nodeUUID: %s, kind: %s, tries; %d, err: %v",
-						nodeUUID, kind, tries, err)
+			var tries int
+
+			err := CfgRetry(opts, func(t int) error {
+				tries = t
+				return CfgRemoveNodeDef(cfg, kind, nodeUUID, version)
+			})
+			if err != nil {
+				if _, ok := err.(*CfgCASError); ok {
+					continue // Ran out of tries on CAS conflicts.
+				}
+
+				return fmt.Errorf("defs: UnregisterNodes,"+
+					" nodeUUID: %s, kind: %s, tries; %d, err: %v",
+					nodeUUID, kind, tries, err)
+			}
+		}
+
+		for _, key := range []string{
+			CfgHeartbeatKey(nodeUUID),
+			CfgFailoverKey(nodeUUID),
+		} {
+			lease, err := CfgGetLease(cfg, key)
+			if err == nil && lease != nil {
+				err = cfg.Del(key, lease.cas)
+			}
+			if err != nil {
+				if _, ok := err.(*CfgCASError); ok {
+					continue // The lease was concurrently updated.
 				}
 
-				break LOOP_TRIES // Success.
+				return fmt.Errorf("defs: UnregisterNodes,"+
+					" nodeUUID: %s, key: %s, err: %v",
+					nodeUUID, key, err)
 			}
 		}
 	}
@@ -420,26 +515,49 @@ func CopyPlanPIndexes(planPIndexes *PlanPIndexes,
 	return r
 }
 
-// Retrieves PlanPIndexes from a Cfg provider.
+// Retrieves PlanPIndexes from a Cfg provider, reassembling any
+// sharded PlanPIndexes.
 func CfgGetPlanPIndexes(cfg Cfg) (*PlanPIndexes, uint64, error) {
-	v, cas, err := cfg.Get(PLAN_PINDEXES_KEY, 0)
-	if err != nil {
-		return nil, cas, err
-	}
-	if v == nil {
-		return nil, cas, nil
-	}
-	rv := &PlanPIndexes{}
-	err = json.Unmarshal(v, rv)
-	if err != nil {
-		return nil, cas, err
+	for tries := 0; ; tries++ {
+		v, cas, err := cfg.Get(PLAN_PINDEXES_KEY, 0)
+		if err != nil {
+			return nil, cas, err
+		}
+		if v == nil {
+			return nil, cas, nil
+		}
+		rv := &PlanPIndexes{}
+		err = json.Unmarshal(v, rv)
+		if err != nil {
+			return nil, cas, err
+		}
+		if len(rv.Shards) <= 0 {
+			return rv, cas, nil
+		}
+
+		err = cfgGetPlanPIndexesShards(cfg, rv)
+		if err != nil {
+			if _, ok := err.(*cfgPlanPIndexesShardMissingError); ok &&
+				tries < CfgPlanPIndexesShardMaxTries {
+				// A concurrent writer replaced the manifest and
+				// removed an old shard, so re-read the manifest.
+				continue
+			}
+			return nil, cas, err
+		}
+		return rv, cas, nil
 	}
-	return rv, cas, nil
 }
 
-// Updates PlanPIndexes on a Cfg provider.
+// Updates PlanPIndexes on a Cfg provider.  When
+// CfgPlanPIndexesSharding is enabled, the PlanPIndex children are
+// stored as per-index shards with a manifest at PLAN_PINDEXES_KEY.
 func CfgSetPlanPIndexes(cfg Cfg, planPIndexes *PlanPIndexes, cas uint64) (
 	uint64, error) {
+	if CfgPlanPIndexesSharding {
+		return cfgSetPlanPIndexesSharded(cfg, planPIndexes, cas)
+	}
+
 	buf, err := json.Marshal(planPIndexes)
 	if err != nil {
 		return 0, err
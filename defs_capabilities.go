@@ -0,0 +1,108 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sort"
+)
+
+// A node publishes its NodeCapabilities in its NodeDef when it
+// registers, so that in a mixed-version cluster the planner and
+// queriers can avoid the nodes that don't support a feature, instead
+// of failing on them.  A NodeDef without capabilities is from an
+// older node, which is assumed to support every index type, but only
+// the NODE_PROTOCOL_VERSION_BASELINE, and neither TLS nor gRPC.
+
+// NODE_PROTOCOL_VERSION_BASELINE is the inter-node protocol version
+// that every node supports.
+const NODE_PROTOCOL_VERSION_BASELINE = 1
+
+// NodeProtocolVersions are the inter-node protocol versions that
+// this node supports, which applications may extend during init().
+var NodeProtocolVersions = []int{NODE_PROTOCOL_VERSION_BASELINE}
+
+// NodeCapabilities describes the features that a node supports.
+type NodeCapabilities struct {
+	IndexTypes       []string `json:"indexTypes,omitempty"`
+	ProtocolVersions []int    `json:"protocolVersions,omitempty"`
+	TLS              bool     `json:"tls,omitempty"`
+	GRPC             bool     `json:"grpc,omitempty"`
+}
+
+// NodeCapabilities returns the capabilities of this node, where the
+// index types are the instantiable PIndexImplTypes, and TLS and gRPC
+// support are from the "capabilityTLS" and "capabilityGRPC" manager
+// options.
+func (mgr *Manager) NodeCapabilities() *NodeCapabilities {
+	var indexTypes []string
+	for indexType, t := range PIndexImplTypes {
+		if t != nil && t.New != nil && t.Open != nil {
+			indexTypes = append(indexTypes, indexType)
+		}
+	}
+	sort.Strings(indexTypes)
+
+	options := mgr.Options()
+
+	return &NodeCapabilities{
+		IndexTypes:       indexTypes,
+		ProtocolVersions: append([]int(nil), NodeProtocolVersions...),
+		TLS:              options["capabilityTLS"] == "true",
+		GRPC:             options["capabilityGRPC"] == "true",
+	}
+}
+
+// NodeDefSupportsIndexType returns true if a node can host the
+// pindexes of an index type.
+func NodeDefSupportsIndexType(nodeDef *NodeDef, indexType string) bool {
+	if nodeDef == nil || nodeDef.Capabilities == nil {
+		return true
+	}
+	for _, t := range nodeDef.Capabilities.IndexTypes {
+		if t == indexType {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeDefProtocolVersion returns the highest inter-node protocol
+// version that both this node and another node support, or 0 if
+// there's none.
+func NodeDefProtocolVersion(nodeDef *NodeDef) int {
+	theirs := []int{NODE_PROTOCOL_VERSION_BASELINE}
+	if nodeDef != nil && nodeDef.Capabilities != nil {
+		theirs = nodeDef.Capabilities.ProtocolVersions
+	}
+
+	rv := 0
+	for _, v := range NodeProtocolVersions {
+		for _, vTheirs := range theirs {
+			if v == vTheirs && v > rv {
+				rv = v
+			}
+		}
+	}
+	return rv
+}
+
+// NodeDefSupportsTLS returns true if a node accepts TLS connections.
+func NodeDefSupportsTLS(nodeDef *NodeDef) bool {
+	return nodeDef != nil && nodeDef.Capabilities != nil &&
+		nodeDef.Capabilities.TLS
+}
+
+// NodeDefSupportsGRPC returns true if a node accepts gRPC requests.
+func NodeDefSupportsGRPC(nodeDef *NodeDef) bool {
+	return nodeDef != nil && nodeDef.Capabilities != nil &&
+		nodeDef.Capabilities.GRPC
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNodeDefCapabilities(t *testing.T) {
+	old := &NodeDef{UUID: "old"}
+	if !NodeDefSupportsIndexType(old, "blackhole") ||
+		NodeDefProtocolVersion(old) != NODE_PROTOCOL_VERSION_BASELINE ||
+		NodeDefSupportsTLS(old) || NodeDefSupportsGRPC(old) {
+		t.Errorf("expected baseline capabilities for an older node")
+	}
+
+	NodeProtocolVersions = []int{1, 2, 3}
+	defer func() { NodeProtocolVersions = []int{NODE_PROTOCOL_VERSION_BASELINE} }()
+
+	n := &NodeDef{
+		UUID: "n",
+		Capabilities: &NodeCapabilities{
+			IndexTypes:       []string{"fulltext-index"},
+			ProtocolVersions: []int{1, 2, 4},
+			TLS:              true,
+		},
+	}
+	if NodeDefSupportsIndexType(n, "blackhole") ||
+		!NodeDefSupportsIndexType(n, "fulltext-index") {
+		t.Errorf("expected index types from capabilities")
+	}
+	if NodeDefProtocolVersion(n) != 2 {
+		t.Errorf("expected negotiated protocol version 2, got: %d",
+			NodeDefProtocolVersion(n))
+	}
+	if !NodeDefSupportsTLS(n) || NodeDefSupportsGRPC(n) {
+		t.Errorf("expected TLS but not gRPC")
+	}
+}
+
+func TestSaveNodeDefCapabilities(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	m.SetOptions(map[string]string{"capabilityGRPC": "true"})
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if err != nil || nodeDefs == nil {
+		t.Fatalf("expected nodeDefs, err: %v", err)
+	}
+	c := nodeDefs.NodeDefs[m.UUID()].Capabilities
+	if c == nil || !c.GRPC || c.TLS ||
+		!reflect.DeepEqual(c.ProtocolVersions, NodeProtocolVersions) ||
+		!NodeDefSupportsIndexType(nodeDefs.NodeDefs[m.UUID()], "blackhole") {
+		t.Errorf("expected published capabilities, got: %#v", c)
+	}
+}
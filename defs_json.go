@@ -77,7 +77,9 @@ func (def *IndexDef) UnmarshalJSON(b []byte) error {
 
 // Implemention of json.Marshaler interface.  The IndexDef JSON output
 // format is now the natural, nested JSON format (as opposed to the
-// previous, enveloped format).
+// previous, enveloped format), unless the Params or SourceParams
+// aren't JSON objects, which are then kept as-is via the enveloped
+// format, as UnmarshalJSON() accepts both formats.
 func (def *IndexDef) MarshalJSON() ([]byte, error) {
 	var idn IndexDefNested
 
@@ -88,7 +90,7 @@ func (def *IndexDef) MarshalJSON() ([]byte, error) {
 
 		err := json.Unmarshal([]byte(def.Params), &mp)
 		if err != nil {
-			return nil, err
+			return def.marshalJSONEnveloped()
 		}
 
 		idn.Params = mp
@@ -99,7 +101,7 @@ func (def *IndexDef) MarshalJSON() ([]byte, error) {
 
 		err := json.Unmarshal([]byte(def.SourceParams), &ms)
 		if err != nil {
-			return nil, err
+			return def.marshalJSONEnveloped()
 		}
 
 		idn.SourceParams = ms
@@ -108,6 +110,17 @@ func (def *IndexDef) MarshalJSON() ([]byte, error) {
 	return json.Marshal(idn)
 }
 
+func (def *IndexDef) marshalJSONEnveloped() ([]byte, error) {
+	var ide IndexDefEnveloped
+
+	indexDefToBase(def, &ide.indexDefBase)
+
+	ide.Params = def.Params
+	ide.SourceParams = def.SourceParams
+
+	return json.Marshal(ide)
+}
+
 // indexDefToBase copies non-envelope'able fields from the indexDef to
 // the indexDefBase.
 func indexDefToBase(indexDef *IndexDef, base *indexDefBase) {
@@ -118,6 +131,7 @@ func indexDefToBase(indexDef *IndexDef, base *indexDefBase) {
 	base.SourceName = indexDef.SourceName
 	base.SourceUUID = indexDef.SourceUUID
 	base.PlanParams = indexDef.PlanParams
+	base.Namespace = indexDef.Namespace
 }
 
 // indexDefFromBase copies non-envelope'able fields from the
@@ -130,6 +144,7 @@ func indexDefFromBase(base *indexDefBase, indexDef *IndexDef) {
 	indexDef.SourceName = base.SourceName
 	indexDef.SourceUUID = base.SourceUUID
 	indexDef.PlanParams = base.PlanParams
+	indexDef.Namespace = base.Namespace
 }
 
 // -------------------------------------------------------------------
@@ -0,0 +1,198 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// On clusters with many indexes, a single PlanPIndexes Cfg value can
+// exceed the value size limits of a Cfg backend, and every planner
+// change rewrites the entire value.  With CfgPlanPIndexesSharding
+// enabled, the PlanPIndex children of each index are instead stored
+// in their own "shard" Cfg entry, and the PLAN_PINDEXES_KEY entry
+// becomes a small manifest that maps index names to shard keys.
+//
+// Shard keys include a fresh UUID every time a shard's content
+// changes, so a writer first creates any new shards, then CAS-updates
+// the manifest, and only then removes the shards that the previous
+// manifest referenced.  Readers that race with a writer and find a
+// missing shard simply re-read the manifest.  Unchanged shards are
+// reused as-is, so only the indexes whose plans changed are
+// rewritten.
+
+// CfgPlanPIndexesSharding enables sharded writes of PlanPIndexes.
+// Sharded PlanPIndexes are always readable, but all nodes in a
+// cluster must be able to read the sharded format before this is
+// enabled, so it should be set during process init()'ialization.
+var CfgPlanPIndexesSharding = false
+
+// CfgPlanPIndexesShardMaxTries is the max number of times a reader
+// will re-read the PlanPIndexes manifest when it races with a writer.
+var CfgPlanPIndexesShardMaxTries = 10
+
+// CfgPlanPIndexesShardKey returns the Cfg key of a PlanPIndexes shard
+// for an index.
+func CfgPlanPIndexesShardKey(indexName, shardUUID string) string {
+	return PLAN_PINDEXES_KEY + "-shard-" + indexName + "-" + shardUUID
+}
+
+type cfgPlanPIndexesShardMissingError struct {
+	key string
+}
+
+func (e *cfgPlanPIndexesShardMissingError) Error() string {
+	return fmt.Sprintf("defs_shards: missing PlanPIndexes shard, key: %s",
+		e.key)
+}
+
+// ------------------------------------------------------------------------
+
+// cfgGetPlanPIndexesShards merges the PlanPIndex children of the
+// shards referenced by a manifest into the manifest.
+func cfgGetPlanPIndexesShards(cfg Cfg, manifest *PlanPIndexes) error {
+	if manifest.PlanPIndexes == nil {
+		manifest.PlanPIndexes = make(map[string]*PlanPIndex)
+	}
+
+	for _, shardKey := range manifest.Shards {
+		shard, err := cfgGetPlanPIndexesShard(cfg, shardKey)
+		if err != nil {
+			return err
+		}
+
+		for name, planPIndex := range shard.PlanPIndexes {
+			manifest.PlanPIndexes[name] = planPIndex
+		}
+	}
+
+	manifest.Shards = nil
+
+	return nil
+}
+
+func cfgGetPlanPIndexesShard(cfg Cfg, shardKey string) (
+	*PlanPIndexes, error) {
+	v, _, err := cfg.Get(shardKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, &cfgPlanPIndexesShardMissingError{key: shardKey}
+	}
+
+	rv := &PlanPIndexes{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// cfgSetPlanPIndexesSharded stores the PlanPIndexes as per-index
+// shards, and then CAS-updates the manifest.
+func cfgSetPlanPIndexesSharded(cfg Cfg, planPIndexes *PlanPIndexes,
+	cas uint64) (uint64, error) {
+	prevShards := map[string]string{}
+
+	v, _, err := cfg.Get(PLAN_PINDEXES_KEY, 0)
+	if err != nil {
+		return 0, err
+	}
+	if v != nil {
+		var prev PlanPIndexes
+		if json.Unmarshal(v, &prev) == nil && prev.Shards != nil {
+			prevShards = prev.Shards
+		}
+	}
+
+	shards := map[string]*PlanPIndexes{} // Keyed by indexName.
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		shard := shards[planPIndex.IndexName]
+		if shard == nil {
+			shard = &PlanPIndexes{
+				UUID:         planPIndexes.UUID,
+				PlanPIndexes: make(map[string]*PlanPIndex),
+				ImplVersion:  planPIndexes.ImplVersion,
+			}
+			shards[planPIndex.IndexName] = shard
+		}
+		shard.PlanPIndexes[name] = planPIndex
+	}
+
+	manifest := &PlanPIndexes{
+		UUID:         planPIndexes.UUID,
+		PlanPIndexes: make(map[string]*PlanPIndex),
+		ImplVersion:  planPIndexes.ImplVersion,
+		Warnings:     planPIndexes.Warnings,
+		Shards:       make(map[string]string),
+	}
+
+	var added []string
+
+	removeAdded := func() {
+		// Best effort cleanup, where errors leave only unreferenced,
+		// harmless shards behind.
+		for _, shardKey := range added {
+			cfg.Del(shardKey, 0)
+		}
+	}
+
+	for indexName, shard := range shards {
+		prevKey := prevShards[indexName]
+		if prevKey != "" {
+			prevShard, err := cfgGetPlanPIndexesShard(cfg, prevKey)
+			if err == nil && SamePlanPIndexes(prevShard, shard) {
+				manifest.Shards[indexName] = prevKey
+				continue
+			}
+		}
+
+		buf, err := json.Marshal(shard)
+		if err != nil {
+			removeAdded()
+			return 0, err
+		}
+
+		shardKey := CfgPlanPIndexesShardKey(indexName, NewUUID())
+
+		_, err = cfg.Set(shardKey, buf, 0)
+		if err != nil {
+			removeAdded()
+			return 0, err
+		}
+
+		added = append(added, shardKey)
+		manifest.Shards[indexName] = shardKey
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		removeAdded()
+		return 0, err
+	}
+
+	casResult, err := cfg.Set(PLAN_PINDEXES_KEY, buf, cas)
+	if err != nil {
+		removeAdded()
+		return 0, err
+	}
+
+	for indexName, prevKey := range prevShards {
+		if manifest.Shards[indexName] != prevKey {
+			cfg.Del(prevKey, 0)
+		}
+	}
+
+	return casResult, nil
+}
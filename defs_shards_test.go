@@ -0,0 +1,137 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func numPlanPIndexesShards(cfg *CfgMem) int {
+	n := 0
+	for key := range cfg.Entries {
+		if strings.HasPrefix(key, PLAN_PINDEXES_KEY+"-shard-") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPlanPIndexesSharded(t *testing.T) {
+	CfgPlanPIndexesSharding = true
+	defer func() { CfgPlanPIndexesSharding = false }()
+
+	cfg := NewCfgMem()
+
+	p := NewPlanPIndexes("1.2.3")
+	p.PlanPIndexes["x0"] = &PlanPIndex{Name: "x0", IndexName: "x"}
+	p.PlanPIndexes["x1"] = &PlanPIndex{Name: "x1", IndexName: "x"}
+	p.PlanPIndexes["y0"] = &PlanPIndex{Name: "y0", IndexName: "y"}
+
+	cas1, err := CfgSetPlanPIndexes(cfg, p, 0)
+	if err != nil || cas1 == 0 {
+		t.Errorf("expected sharded save to work, err: %v", err)
+	}
+	if numPlanPIndexesShards(cfg) != 2 {
+		t.Errorf("expected 2 shards, got: %d", numPlanPIndexesShards(cfg))
+	}
+
+	p2, cas, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || cas != cas1 || p2.UUID != p.UUID ||
+		!SamePlanPIndexes(p, p2) || p2.Shards != nil {
+		t.Errorf("expected sharded get to match, err: %v, p2: %#v", err, p2)
+	}
+
+	manifest := &PlanPIndexes{}
+	v, _, _ := cfg.Get(PLAN_PINDEXES_KEY, 0)
+	if err = json.Unmarshal(v, manifest); err != nil {
+		t.Errorf("expected manifest to parse, err: %v", err)
+	}
+	if len(manifest.PlanPIndexes) != 0 || len(manifest.Shards) != 2 {
+		t.Errorf("expected manifest with only shards, got: %#v", manifest)
+	}
+
+	// Only the changed shard should be rewritten.
+	p2.PlanPIndexes["x2"] = &PlanPIndex{Name: "x2", IndexName: "x"}
+
+	cas2, err := CfgSetPlanPIndexes(cfg, p2, cas1)
+	if err != nil {
+		t.Errorf("expected sharded update to work, err: %v", err)
+	}
+	if numPlanPIndexesShards(cfg) != 2 {
+		t.Errorf("expected old shard to be removed, got: %d",
+			numPlanPIndexesShards(cfg))
+	}
+
+	manifest2 := &PlanPIndexes{}
+	v, _, _ = cfg.Get(PLAN_PINDEXES_KEY, 0)
+	json.Unmarshal(v, manifest2)
+	if manifest2.Shards["y"] != manifest.Shards["y"] {
+		t.Errorf("expected unchanged shard to be reused")
+	}
+	if manifest2.Shards["x"] == manifest.Shards["x"] {
+		t.Errorf("expected changed shard to be rewritten")
+	}
+
+	// A CAS mismatch should not leave any new shards behind.
+	p2.PlanPIndexes["y1"] = &PlanPIndex{Name: "y1", IndexName: "y"}
+
+	_, err = CfgSetPlanPIndexes(cfg, p2, cas1)
+	if err == nil {
+		t.Errorf("expected CAS mismatch")
+	}
+	if numPlanPIndexesShards(cfg) != 2 {
+		t.Errorf("expected no leftover shards, got: %d",
+			numPlanPIndexesShards(cfg))
+	}
+
+	p3, cas, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || cas != cas2 || len(p3.PlanPIndexes) != 4 {
+		t.Errorf("expected get after update, err: %v, p3: %#v", err, p3)
+	}
+
+	// Sharded PlanPIndexes are still readable after sharding is
+	// disabled.
+	CfgPlanPIndexesSharding = false
+
+	p4, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || !SamePlanPIndexes(p3, p4) {
+		t.Errorf("expected sharded get with sharding disabled, err: %v", err)
+	}
+}
+
+func TestPlanPIndexesShardMissing(t *testing.T) {
+	CfgPlanPIndexesSharding = true
+	defer func() { CfgPlanPIndexesSharding = false }()
+
+	cfg := NewCfgMem()
+
+	p := NewPlanPIndexes("1.2.3")
+	p.PlanPIndexes["x0"] = &PlanPIndex{Name: "x0", IndexName: "x"}
+
+	_, err := CfgSetPlanPIndexes(cfg, p, 0)
+	if err != nil {
+		t.Errorf("expected sharded save to work, err: %v", err)
+	}
+
+	for key := range cfg.Entries {
+		if key != PLAN_PINDEXES_KEY {
+			cfg.Del(key, 0)
+		}
+	}
+
+	_, _, err = CfgGetPlanPIndexes(cfg)
+	if err == nil {
+		t.Errorf("expected err on missing shard")
+	}
+}
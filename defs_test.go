@@ -358,6 +358,20 @@ func TestIndexDefJSON(t *testing.T) {
 	if !reflect.DeepEqual(&id1, &id2) {
 		t.Errorf("expected equal: %#v, versus: %#v", id1, id2)
 	}
+
+	id1.Params = `not json`
+	id1.SourceParams = `{"hey":"there"}`
+	b, err = json.Marshal(id1)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	err = json.Unmarshal(b, &id2)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if !reflect.DeepEqual(&id1, &id2) {
+		t.Errorf("expected equal: %#v, versus: %#v", id1, id2)
+	}
 }
 
 func TestPlanPIndexJSON(t *testing.T) {
@@ -12,6 +12,7 @@
 package cbgt
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync/atomic"
@@ -30,7 +31,8 @@ type Dest interface {
 
 	// Invoked when there's a new mutation from a data source for a
 	// partition.  Dest implementation is responsible for making its
-	// own copies of the key, val and extras data.
+	// own copies of the key, val and extras data, as a feed may reuse
+	// their memory once DataUpdate() returns.
 	DataUpdate(partition string, key []byte, seq uint64, val []byte,
 		cas uint64,
 		extrasType DestExtrasType, extras []byte) error
@@ -99,6 +101,70 @@ type Dest interface {
 	Stats(io.Writer) error
 }
 
+// A DestCtx is an optional interface of a Dest that takes a ctx,
+// whose cancellation or deadline should be honored, instead of a
+// cancelCh.  See DestCountContext() and DestQueryContext().
+type DestCtx interface {
+	CountCtx(ctx context.Context, pindex *PIndex) (uint64, error)
+
+	QueryCtx(ctx context.Context, pindex *PIndex, req []byte,
+		w io.Writer) error
+}
+
+// DestCountContext counts a Dest, using its DestCtx interface when
+// available, or else via a cancelCh that's closed when the ctx is
+// done.
+func DestCountContext(ctx context.Context, dest Dest,
+	pindex *PIndex) (uint64, error) {
+	if destCtx, ok := dest.(DestCtx); ok {
+		return destCtx.CountCtx(ctx, pindex)
+	}
+
+	cancelCh, stop := ContextCancelChan(ctx)
+	defer stop()
+
+	return dest.Count(pindex, cancelCh)
+}
+
+// DestQueryContext queries a Dest, using its DestCtx interface when
+// available, or else via a cancelCh that's closed when the ctx is
+// done.
+func DestQueryContext(ctx context.Context, dest Dest,
+	pindex *PIndex, req []byte, w io.Writer) error {
+	if destCtx, ok := dest.(DestCtx); ok {
+		return destCtx.QueryCtx(ctx, pindex, req, w)
+	}
+
+	cancelCh, stop := ContextCancelChan(ctx)
+	defer stop()
+
+	return dest.Query(pindex, req, w, cancelCh)
+}
+
+// A DestExpirer is an optional interface of a Dest that's told of
+// document expirations apart from deletions, such as a Dest that
+// tracks expirations or counts them separately.  See
+// DestDataExpire().
+type DestExpirer interface {
+	// Invoked when a document has expired, with the same params as a
+	// Dest.DataDelete().
+	DataExpire(partition string, key []byte, seq uint64,
+		cas uint64,
+		extrasType DestExtrasType, extras []byte) error
+}
+
+// DestDataExpire tells a Dest of a document expiration, using its
+// DestExpirer interface when available, or else as a DataDelete().
+func DestDataExpire(dest Dest, partition string, key []byte, seq uint64,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	if destExpirer, ok := dest.(DestExpirer); ok {
+		return destExpirer.DataExpire(partition, key, seq,
+			cas, extrasType, extras)
+	}
+
+	return dest.DataDelete(partition, key, seq, cas, extrasType, extras)
+}
+
 // DestExtrasType represents the encoding for the
 // Dest.DataUpdate/DataDelete() extras parameter.
 type DestExtrasType uint16
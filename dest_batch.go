@@ -0,0 +1,407 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dest batching delivers a feed's data mutations for a partition to
+// a Dest in batches, for Dest implementations that also implement the
+// DestBatch interface, so that a Dest can apply a whole batch with a
+// single lock acquisition or flush.  A partition's buffered mutations
+// are applied when the end seq of the partition's current snapshot is
+// reached, when the batch is full, when the batch has been buffered
+// for the destBatchFlushInterval manager option, or before any other
+// call for the partition, like SnapshotStart() or OpaqueSet().  Dest
+// batching is controlled by the destBatchSize manager option, which
+// takes effect as feeds are (re-)started, and is the max number of
+// mutations in a batch; it defaults to DEST_BATCH_SIZE, and is
+// disabled when "0".  When ApplyBatch() fails, the batch stays
+// buffered, ahead of any later mutations, to be retried by the
+// partition's next flush, and the error is returned to the feed.
+
+// DEST_BATCH_SIZE is the default for the destBatchSize manager
+// option.
+var DEST_BATCH_SIZE = 1000
+
+// DEST_BATCH_FLUSH_INTERVAL is the default for the
+// destBatchFlushInterval manager option, which is the max time that
+// a partition's mutations stay buffered, so that a quiet partition or
+// a snapshot that's still streaming doesn't hold back its mutations.
+// A "0s" interval disables the timed flushes.
+var DEST_BATCH_FLUSH_INTERVAL = 100 * time.Millisecond
+
+// The ops of a DestMutation.
+const (
+	DEST_MUTATION_UPDATE = "update"
+	DEST_MUTATION_DELETE = "delete"
+	DEST_MUTATION_EXPIRE = "expire"
+)
+
+// A DestMutation is a data mutation of a batch, with the params of a
+// Dest.DataUpdate(), DataDelete() or DestExpirer.DataExpire().
+type DestMutation struct {
+	Op         string
+	Key        []byte
+	Seq        uint64
+	Val        []byte // Nil unless the Op is DEST_MUTATION_UPDATE.
+	Cas        uint64
+	ExtrasType DestExtrasType
+	Extras     []byte
+}
+
+// A DestBatch is a Dest that can apply a batch of data mutations for
+// a partition, in seq order, at once.  Like the params of a
+// DataUpdate(), the mutations and their Key, Val and Extras are owned
+// by the caller and are only valid until ApplyBatch() returns, as
+// their memory is reused for later batches, so an implementation must
+// make its own copies of anything it keeps.
+type DestBatch interface {
+	ApplyBatch(partition string, mutations []DestMutation) error
+}
+
+func destBatchSize(options map[string]string) int {
+	v, exists := options["destBatchSize"]
+	if !exists || v == "" {
+		return DEST_BATCH_SIZE
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return DEST_BATCH_SIZE
+	}
+	return n
+}
+
+func destBatchFlushInterval(options map[string]string) time.Duration {
+	v, exists := options["destBatchFlushInterval"]
+	if !exists || v == "" {
+		return DEST_BATCH_FLUSH_INTERVAL
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return DEST_BATCH_FLUSH_INTERVAL
+	}
+	return d
+}
+
+// feedDestBatch wraps a feed's Dest with a DestBatcher when dest
+// batching is enabled and the Dest supports it.
+func (mgr *Manager) feedDestBatch(dest Dest) Dest {
+	options := mgr.Options()
+	batchSize := destBatchSize(options)
+	if batchSize <= 1 {
+		return dest
+	}
+
+	destBatch, ok := dest.(DestBatch)
+	if !ok {
+		return dest
+	}
+
+	return &DestBatcher{
+		Dest:          dest,
+		mgr:           mgr,
+		destBatch:     destBatch,
+		batchSize:     batchSize,
+		flushInterval: destBatchFlushInterval(options),
+		partitions:    map[string]*destBatchPartition{},
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// DestBatcher is a Dest wrapper that buffers the data mutations of
+// each partition and applies them as batches via the wrapped Dest's
+// DestBatch interface.
+type DestBatcher struct {
+	Dest
+
+	mgr           *Manager
+	destBatch     DestBatch
+	batchSize     int
+	flushInterval time.Duration // Zero when there are no timed flushes.
+
+	m          sync.Mutex
+	partitions map[string]*destBatchPartition
+}
+
+type destBatchPartition struct {
+	snapEnd uint64
+	buf     *destBatchBuf // Nil when there are no buffered mutations.
+	err     error         // From a timed flush, for the next add().
+
+	flushM sync.Mutex // Serializes the flushes of the partition.
+}
+
+// A destBatchBuf holds the buffered mutations of a partition, whose
+// Key, Val and Extras are copied into a single arena, and is pooled
+// so that steady ingest doesn't allocate per mutation.
+type destBatchBuf struct {
+	mutations []DestMutation
+	arena     []byte
+}
+
+var destBatchBufPool = sync.Pool{
+	New: func() interface{} {
+		return &destBatchBuf{}
+	},
+}
+
+// copyBytes returns a copy of v in the arena, or nil if v is nil.
+func (b *destBatchBuf) copyBytes(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	start := len(b.arena)
+	b.arena = append(b.arena, v...)
+	return b.arena[start:len(b.arena):len(b.arena)]
+}
+
+func putDestBatchBuf(b *destBatchBuf) {
+	if cap(b.arena) > BufferPoolMaxBufSize {
+		return
+	}
+	for i := range b.mutations {
+		b.mutations[i] = DestMutation{}
+	}
+	b.mutations = b.mutations[:0]
+	b.arena = b.arena[:0]
+	destBatchBufPool.Put(b)
+}
+
+// appendMutations copies the mutations of another buffer into b.
+func (b *destBatchBuf) appendMutations(o *destBatchBuf) {
+	for _, m := range o.mutations {
+		m.Key = b.copyBytes(m.Key)
+		m.Val = b.copyBytes(m.Val)
+		m.Extras = b.copyBytes(m.Extras)
+		b.mutations = append(b.mutations, m)
+	}
+}
+
+func (d *DestBatcher) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return d.add(partition, DEST_MUTATION_UPDATE, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (d *DestBatcher) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return d.add(partition, DEST_MUTATION_DELETE, key, seq, nil,
+		cas, extrasType, extras)
+}
+
+func (d *DestBatcher) DataExpire(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return d.add(partition, DEST_MUTATION_EXPIRE, key, seq, nil,
+		cas, extrasType, extras)
+}
+
+func (d *DestBatcher) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	err := d.flush(partition)
+	if err != nil {
+		return err
+	}
+
+	d.m.Lock()
+	d.partitionLOCKED(partition).snapEnd = snapEnd
+	d.m.Unlock()
+
+	return d.Dest.SnapshotStart(partition, snapStart, snapEnd)
+}
+
+func (d *DestBatcher) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	err = d.flush(partition)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.Dest.OpaqueGet(partition)
+}
+
+func (d *DestBatcher) OpaqueSet(partition string, value []byte) error {
+	err := d.flush(partition)
+	if err != nil {
+		return err
+	}
+	return d.Dest.OpaqueSet(partition, value)
+}
+
+// Rollback drops the partition's buffered mutations, which are
+// beyond the rollback.
+func (d *DestBatcher) Rollback(partition string, rollbackSeq uint64) error {
+	d.m.Lock()
+	if p := d.partitions[partition]; p != nil && p.buf != nil {
+		putDestBatchBuf(p.buf)
+	}
+	delete(d.partitions, partition)
+	d.m.Unlock()
+
+	return d.Dest.Rollback(partition, rollbackSeq)
+}
+
+// PartitionSeqMax implements the DestUnflushed interface, counting
+// the buffered mutations as unflushed.
+func (d *DestBatcher) PartitionSeqMax(partition string) (
+	seqMax, seqMaxBatch uint64) {
+	destUnflushed, ok := d.Dest.(DestUnflushed)
+	if !ok {
+		return 0, 0
+	}
+
+	seqMax, seqMaxBatch = destUnflushed.PartitionSeqMax(partition)
+
+	d.m.Lock()
+	if p := d.partitions[partition]; p != nil && p.buf != nil {
+		mutations := p.buf.mutations
+		if seq := mutations[len(mutations)-1].Seq; seq > seqMax {
+			seqMax = seq
+		}
+	}
+	d.m.Unlock()
+
+	return seqMax, seqMaxBatch
+}
+
+func (d *DestBatcher) partitionLOCKED(partition string) *destBatchPartition {
+	p := d.partitions[partition]
+	if p == nil {
+		p = &destBatchPartition{}
+		d.partitions[partition] = p
+	}
+	return p
+}
+
+// add buffers a mutation, copying its params into the partition's
+// arena as a feed may reuse their buffers, and applies the
+// partition's batch when it's full or the end of the snapshot is
+// reached.  Until a partition's first SnapshotStart(), its snapshot
+// end is unknown, so each mutation is applied as a batch of one.  A
+// new batch schedules a timed flush, whose error, if any, is returned
+// by the partition's next add().
+func (d *DestBatcher) add(partition, op string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	p := d.partitionLOCKED(partition)
+	if p.buf == nil {
+		p.buf = destBatchBufPool.Get().(*destBatchBuf)
+		d.scheduleFlushLOCKED(partition, p.buf)
+	}
+	b := p.buf
+	b.mutations = append(b.mutations, DestMutation{
+		Op:         op,
+		Key:        b.copyBytes(key),
+		Seq:        seq,
+		Val:        b.copyBytes(val),
+		Cas:        cas,
+		ExtrasType: extrasType,
+		Extras:     b.copyBytes(extras),
+	})
+	full := len(b.mutations) >= d.batchSize || seq >= p.snapEnd
+	err := p.err
+	p.err = nil
+	d.m.Unlock()
+
+	if full {
+		return d.flush(partition)
+	}
+
+	return err
+}
+
+// scheduleFlushLOCKED starts the timer of a timed flush for a
+// partition's new buffer.
+func (d *DestBatcher) scheduleFlushLOCKED(partition string, b *destBatchBuf) {
+	if d.flushInterval <= 0 {
+		return
+	}
+	time.AfterFunc(d.flushInterval, func() {
+		d.m.Lock()
+		p := d.partitions[partition]
+		if p == nil || p.buf != b {
+			d.m.Unlock()
+			return // The buffer was already flushed or dropped.
+		}
+		d.m.Unlock()
+
+		err := d.flush(partition)
+		if err != nil {
+			d.m.Lock()
+			if d.partitions[partition] == p {
+				p.err = err
+			}
+			d.m.Unlock()
+		}
+	})
+}
+
+// flush applies the buffered mutations of a partition, and then
+// returns their buffer to the pool.  On an ApplyBatch() error, the
+// mutations are buffered again, ahead of any mutations that were
+// added meanwhile, so that they're retried rather than dropped.
+func (d *DestBatcher) flush(partition string) error {
+	d.m.Lock()
+	p := d.partitions[partition]
+	d.m.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	p.flushM.Lock()
+	defer p.flushM.Unlock()
+
+	d.m.Lock()
+	b := p.buf
+	p.buf = nil
+	d.m.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	n := len(b.mutations)
+
+	err := d.destBatch.ApplyBatch(partition, b.mutations)
+	if err != nil {
+		atomic.AddUint64(&d.mgr.stats.TotDestBatchApplyErr, 1)
+
+		d.m.Lock()
+		if d.partitions[partition] == p { // Not rolled back meanwhile.
+			if p.buf != nil {
+				b.appendMutations(p.buf)
+				putDestBatchBuf(p.buf)
+			}
+			p.buf = b
+			d.scheduleFlushLOCKED(partition, b)
+		} else {
+			putDestBatchBuf(b)
+		}
+		d.m.Unlock()
+
+		return err
+	}
+
+	putDestBatchBuf(b)
+
+	atomic.AddUint64(&d.mgr.stats.TotDestBatchApply, 1)
+	atomic.AddUint64(&d.mgr.stats.TotDestBatchMutations, uint64(n))
+
+	return nil
+}
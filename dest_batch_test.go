@@ -0,0 +1,312 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestDestBatch struct {
+	TestDestUnflushed
+
+	m       sync.Mutex
+	batches [][]DestMutation
+	err     error
+}
+
+func (t *TestDestBatch) numBatches() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.batches)
+}
+
+func (t *TestDestBatch) ApplyBatch(partition string,
+	mutations []DestMutation) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	// The mutations are only valid during the call.
+	var batch []DestMutation
+	for _, mutation := range mutations {
+		mutation.Key = append([]byte(nil), mutation.Key...)
+		mutation.Val = append([]byte(nil), mutation.Val...)
+		batch = append(batch, mutation)
+	}
+	t.batches = append(t.batches, batch)
+	return nil
+}
+
+func TestFeedDestBatch(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize": "0",
+		})
+
+	dest := &TestDestBatch{}
+	if m.feedDestBatch(dest) != dest {
+		t.Errorf("expected no batching when disabled")
+	}
+
+	m = NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize":          "3",
+			"destBatchFlushInterval": "0s",
+		})
+
+	blackHole := &BlackHole{}
+	if m.feedDestBatch(blackHole) != blackHole {
+		t.Errorf("expected no batching for a Dest without ApplyBatch")
+	}
+
+	d, ok := m.feedDestBatch(dest).(*DestBatcher)
+	if !ok {
+		t.Fatalf("expected a DestBatcher")
+	}
+	if unwrapFeedDest(d) != dest {
+		t.Errorf("expected unwrapFeedDest() to find the dest")
+	}
+
+	// Before a snapshot, each mutation is its own batch.
+	d.DataUpdate("0", []byte("a"), 1, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if len(dest.batches) != 1 || len(dest.batches[0]) != 1 {
+		t.Errorf("expected a batch of one, got: %#v", dest.batches)
+	}
+
+	d.SnapshotStart("0", 2, 10)
+
+	key := []byte("b")
+	d.DataUpdate("0", key, 2, []byte("y"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	key[0] = 'z' // The batcher must copy the feed's buffers.
+	d.DataDelete("0", []byte("c"), 3, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if len(dest.batches) != 1 {
+		t.Errorf("expected mutations to be buffered, got: %#v", dest.batches)
+	}
+
+	dest.setSeqs(1, 1)
+	if seqMax, seqMaxBatch := d.PartitionSeqMax("0"); seqMax != 3 ||
+		seqMaxBatch != 1 {
+		t.Errorf("expected buffered mutations to be unflushed,"+
+			" got: %d, %d", seqMax, seqMaxBatch)
+	}
+
+	// A full batch is applied.
+	d.DataExpire("0", []byte("d"), 4, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if len(dest.batches) != 2 || len(dest.batches[1]) != 3 {
+		t.Fatalf("expected a full batch, got: %#v", dest.batches)
+	}
+	b := dest.batches[1]
+	if b[0].Op != DEST_MUTATION_UPDATE || string(b[0].Key) != "b" ||
+		string(b[0].Val) != "y" ||
+		b[1].Op != DEST_MUTATION_DELETE || b[1].Seq != 3 ||
+		b[2].Op != DEST_MUTATION_EXPIRE || b[2].Seq != 4 {
+		t.Errorf("expected batch mutations in order, got: %#v", b)
+	}
+
+	// An OpaqueSet applies a partial batch.
+	d.DataUpdate("0", []byte("e"), 5, []byte("y"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	d.OpaqueSet("0", nil)
+	if len(dest.batches) != 3 || len(dest.batches[2]) != 1 {
+		t.Errorf("expected a partial batch, got: %#v", dest.batches)
+	}
+
+	// The snapshot end applies a partial batch.
+	d.DataUpdate("0", []byte("f"), 6, []byte("y"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	d.DataUpdate("0", []byte("g"), 10, []byte("y"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if len(dest.batches) != 4 || len(dest.batches[3]) != 2 {
+		t.Errorf("expected a snapshot end batch, got: %#v", dest.batches)
+	}
+
+	// A rollback drops the buffered mutations.
+	d.SnapshotStart("0", 11, 20)
+	d.DataUpdate("0", []byte("h"), 11, []byte("y"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	d.Rollback("0", 5)
+	d.OpaqueSet("0", nil)
+	if len(dest.batches) != 4 {
+		t.Errorf("expected no batch after rollback, got: %#v", dest.batches)
+	}
+
+	if m.stats.TotDestBatchApply != 4 || m.stats.TotDestBatchMutations != 7 {
+		t.Errorf("expected batch stats, got: %d, %d",
+			m.stats.TotDestBatchApply, m.stats.TotDestBatchMutations)
+	}
+}
+
+func TestSubsetApplyBatch(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/a","equals":1}]}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	s := dest.(*Subset)
+
+	dest.DataUpdate("0", []byte("k0"), 1, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("0", []byte("k1"), 2, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	err = s.ApplyBatch("0", []DestMutation{
+		{Op: DEST_MUTATION_UPDATE, Key: []byte("k2"), Seq: 3,
+			Val: []byte(`{"a":1}`)},
+		{Op: DEST_MUTATION_UPDATE, Key: []byte("k3"), Seq: 4,
+			Val: []byte(`{"a":2}`)},
+		{Op: DEST_MUTATION_DELETE, Key: []byte("k0"), Seq: 5},
+		{Op: DEST_MUTATION_EXPIRE, Key: []byte("k1"), Seq: 6},
+	})
+	if err != nil {
+		t.Fatalf("expected ApplyBatch() to work, err: %v", err)
+	}
+
+	rv := querySubset(t, s, `{}`)
+	if subsetRowKeys(rv.Rows) != `["k2"]` {
+		t.Errorf("expected batch applied, got: %s", subsetRowKeys(rv.Rows))
+	}
+
+	if seqMax, _ := s.PartitionSeqMax("0"); seqMax != 6 {
+		t.Errorf("expected seqMax 6, got: %d", seqMax)
+	}
+}
+
+// The BenchmarkSubsetIngest benchmarks compare per-mutation and
+// batched ingest of a snapshot into a subset pindex.
+
+func BenchmarkSubsetIngest(b *testing.B) {
+	benchmarkSubsetIngest(b, 0)
+}
+
+func BenchmarkSubsetIngestBatch100(b *testing.B) {
+	benchmarkSubsetIngest(b, 100)
+}
+
+func BenchmarkSubsetIngestBatch1000(b *testing.B) {
+	benchmarkSubsetIngest(b, 1000)
+}
+
+func benchmarkSubsetIngest(b *testing.B, batchSize int) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize": strconv.Itoa(batchSize),
+		})
+
+	_, subset, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/a","equals":1}]}`, emptyDir, nil)
+	if err != nil {
+		b.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+	defer subset.Close()
+
+	dest := m.feedDestBatch(subset)
+
+	val := []byte(`{"a":1,"b":"some value"}`)
+
+	b.ResetTimer()
+
+	dest.SnapshotStart("0", 1, uint64(b.N))
+	for i := 0; i < b.N; i++ {
+		dest.DataUpdate("0", []byte(strconv.Itoa(i)), uint64(i+1), val,
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+	}
+}
+
+func TestDestBatchFlushInterval(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize":          "100",
+			"destBatchFlushInterval": "10ms",
+		})
+
+	dest := &TestDestBatch{}
+	d := m.feedDestBatch(dest).(*DestBatcher)
+
+	d.SnapshotStart("0", 1, 1000)
+	d.DataUpdate("0", []byte("a"), 1, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	d.DataUpdate("0", []byte("b"), 2, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if dest.numBatches() != 0 {
+		t.Errorf("expected mutations to be buffered")
+	}
+
+	for i := 0; i < 100 && dest.numBatches() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dest.m.Lock()
+	if len(dest.batches) != 1 || len(dest.batches[0]) != 2 {
+		t.Errorf("expected a timed flush, got: %#v", dest.batches)
+	}
+	dest.m.Unlock()
+}
+
+func TestDestBatchApplyBatchErr(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize":          "2",
+			"destBatchFlushInterval": "0s",
+		})
+
+	dest := &TestDestBatch{err: fmt.Errorf("apply err")}
+	d := m.feedDestBatch(dest).(*DestBatcher)
+
+	d.SnapshotStart("0", 1, 1000)
+	d.DataUpdate("0", []byte("a"), 1, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	err := d.DataUpdate("0", []byte("b"), 2, []byte("x"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if err == nil {
+		t.Errorf("expected the ApplyBatch err")
+	}
+	if m.stats.TotDestBatchApplyErr != 1 {
+		t.Errorf("expected an apply err stat, got: %d",
+			m.stats.TotDestBatchApplyErr)
+	}
+
+	// The failed mutations are retried ahead of later mutations.
+	dest.m.Lock()
+	dest.err = nil
+	dest.m.Unlock()
+
+	d.DataUpdate("0", []byte("c"), 3, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err := d.OpaqueSet("0", nil); err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if len(dest.batches) != 1 || len(dest.batches[0]) != 3 {
+		t.Fatalf("expected a retried batch, got: %#v", dest.batches)
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		if string(dest.batches[0][i].Key) != key ||
+			dest.batches[0][i].Seq != uint64(i+1) {
+			t.Errorf("expected mutations in order, got: %#v", dest.batches[0])
+		}
+	}
+}
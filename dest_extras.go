@@ -0,0 +1,171 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// DEST_EXTRAS_TYPE_META represents extras that are an encoded
+// DestExtrasMeta, which carries a mutation's metadata, such as its
+// xattrs, datatype, flags, expiry and revSeq, so that pindex
+// implementations can index metadata without re-fetching documents.
+// See EncodeDestExtrasMeta() and DecodeDestExtrasMeta().
+const DEST_EXTRAS_TYPE_META = DestExtrasType(0x0003)
+
+// Datatype flags of a mutation, as defined by the memcached protocol.
+const (
+	DEST_DATATYPE_JSON   = uint8(0x01)
+	DEST_DATATYPE_SNAPPY = uint8(0x02)
+	DEST_DATATYPE_XATTR  = uint8(0x04)
+)
+
+// DestExtrasMeta is the metadata of a data mutation or deletion.
+type DestExtrasMeta struct {
+	Datatype uint8
+	Flags    uint32
+	Expiry   uint32
+	RevSeq   uint64
+
+	// The raw xattrs section of the document, in the memcached
+	// protocol's encoding, which can be decoded with DecodeXAttrs().
+	// Nil when the document has no xattrs.
+	XAttrs []byte
+}
+
+// destExtrasMetaLen is the length of the fixed fields of an encoded
+// DestExtrasMeta: datatype (1 byte), flags (4), expiry (4) and revSeq
+// (8), in big endian order, followed by the raw xattrs.
+const destExtrasMetaLen = 17
+
+// EncodeDestExtrasMeta encodes a DestExtrasMeta for use as the extras
+// of a DEST_EXTRAS_TYPE_META data mutation or deletion.
+func EncodeDestExtrasMeta(m *DestExtrasMeta) []byte {
+	buf := make([]byte, destExtrasMetaLen+len(m.XAttrs))
+	buf[0] = m.Datatype
+	binary.BigEndian.PutUint32(buf[1:5], m.Flags)
+	binary.BigEndian.PutUint32(buf[5:9], m.Expiry)
+	binary.BigEndian.PutUint64(buf[9:17], m.RevSeq)
+	copy(buf[destExtrasMetaLen:], m.XAttrs)
+	return buf
+}
+
+// DecodeDestExtrasMeta decodes the extras of a data mutation or
+// deletion into a DestExtrasMeta.  The extrasType may be
+// DEST_EXTRAS_TYPE_META, or DEST_EXTRAS_TYPE_DCP, in which case only
+// the flags, expiry and revSeq are available.  The returned
+// DestExtrasMeta.XAttrs refers to the extras buffer, so a Dest should
+// copy it if it's retained beyond the DataUpdate/DataDelete() call.
+func DecodeDestExtrasMeta(extrasType DestExtrasType, extras []byte) (
+	*DestExtrasMeta, error) {
+	switch extrasType {
+	case DEST_EXTRAS_TYPE_META:
+		if len(extras) < destExtrasMetaLen {
+			return nil, fmt.Errorf("dest_extras: extras too short,"+
+				" len: %d", len(extras))
+		}
+		rv := &DestExtrasMeta{
+			Datatype: extras[0],
+			Flags:    binary.BigEndian.Uint32(extras[1:5]),
+			Expiry:   binary.BigEndian.Uint32(extras[5:9]),
+			RevSeq:   binary.BigEndian.Uint64(extras[9:17]),
+		}
+		if len(extras) > destExtrasMetaLen {
+			rv.XAttrs = extras[destExtrasMetaLen:]
+		}
+		return rv, nil
+
+	case DEST_EXTRAS_TYPE_DCP:
+		return DecodeDCPExtras(extras)
+	}
+
+	return nil, fmt.Errorf("dest_extras: unsupported extrasType: %d",
+		extrasType)
+}
+
+// DecodeDCPExtras decodes the raw extras of a DCP mutation, which
+// start with the bySeq (8 bytes), revSeq (8), flags (4) and expiry
+// (4), or of a DCP deletion, which start with the bySeq and revSeq.
+func DecodeDCPExtras(extras []byte) (*DestExtrasMeta, error) {
+	if len(extras) < 16 {
+		return nil, fmt.Errorf("dest_extras: DCP extras too short,"+
+			" len: %d", len(extras))
+	}
+
+	rv := &DestExtrasMeta{
+		RevSeq: binary.BigEndian.Uint64(extras[8:16]),
+	}
+	if len(extras) >= 24 {
+		rv.Flags = binary.BigEndian.Uint32(extras[16:20])
+		rv.Expiry = binary.BigEndian.Uint32(extras[20:24])
+	}
+
+	return rv, nil
+}
+
+// SplitXAttrs splits the value of a mutation with the
+// DEST_DATATYPE_XATTR datatype into its raw xattrs section and its
+// document body.
+func SplitXAttrs(val []byte) (xattrs, body []byte, err error) {
+	if len(val) < 4 {
+		return nil, nil, fmt.Errorf("dest_extras: xattrs value too short,"+
+			" len: %d", len(val))
+	}
+
+	n := 4 + int(binary.BigEndian.Uint32(val[0:4]))
+	if n > len(val) {
+		return nil, nil, fmt.Errorf("dest_extras: xattrs length: %d"+
+			" exceeds value length: %d", n, len(val))
+	}
+
+	return val[:n], val[n:], nil
+}
+
+// DecodeXAttrs decodes a raw xattrs section, which is a 4 byte total
+// length followed by pairs of a 4 byte pair length and a
+// null-terminated key and null-terminated value, into a map of xattr
+// values keyed by xattr key.
+func DecodeXAttrs(xattrs []byte) (map[string][]byte, error) {
+	rv := map[string][]byte{}
+	if len(xattrs) <= 0 {
+		return rv, nil
+	}
+
+	xattrs, _, err := SplitXAttrs(xattrs)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := xattrs[4:]
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("dest_extras: xattr pair too short")
+		}
+		n := 4 + int(binary.BigEndian.Uint32(buf[0:4]))
+		if n > len(buf) {
+			return nil, fmt.Errorf("dest_extras: xattr pair length: %d"+
+				" exceeds remaining length: %d", n, len(buf))
+		}
+
+		pair := bytes.SplitN(buf[4:n], []byte{0}, 3)
+		if len(pair) != 3 || len(pair[2]) != 0 {
+			return nil, fmt.Errorf("dest_extras: malformed xattr pair")
+		}
+		rv[string(pair[0])] = pair[1]
+
+		buf = buf[n:]
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func testXAttrs(pairs ...string) []byte {
+	var buf []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		pair := []byte(pairs[i] + "\x00" + pairs[i+1] + "\x00")
+		n := make([]byte, 4)
+		binary.BigEndian.PutUint32(n, uint32(len(pair)))
+		buf = append(append(buf, n...), pair...)
+	}
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint32(n, uint32(len(buf)))
+	return append(n, buf...)
+}
+
+func TestDestExtrasMeta(t *testing.T) {
+	m := &DestExtrasMeta{
+		Datatype: DEST_DATATYPE_JSON | DEST_DATATYPE_XATTR,
+		Flags:    0x01020304,
+		Expiry:   1000,
+		RevSeq:   42,
+		XAttrs:   testXAttrs("_sync", `{"rev":1}`),
+	}
+	m2, err := DecodeDestExtrasMeta(DEST_EXTRAS_TYPE_META,
+		EncodeDestExtrasMeta(m))
+	if err != nil || !reflect.DeepEqual(m, m2) {
+		t.Errorf("expected round trip, got: %#v, err: %v", m2, err)
+	}
+
+	m = &DestExtrasMeta{RevSeq: 1}
+	m2, err = DecodeDestExtrasMeta(DEST_EXTRAS_TYPE_META,
+		EncodeDestExtrasMeta(m))
+	if err != nil || !reflect.DeepEqual(m, m2) {
+		t.Errorf("expected round trip without xattrs, got: %#v, err: %v",
+			m2, err)
+	}
+
+	if _, err = DecodeDestExtrasMeta(DEST_EXTRAS_TYPE_META,
+		[]byte{1, 2}); err == nil {
+		t.Errorf("expected err on short extras")
+	}
+	if _, err = DecodeDestExtrasMeta(DEST_EXTRAS_TYPE_NIL, nil); err == nil {
+		t.Errorf("expected err on unsupported extras type")
+	}
+}
+
+func TestDecodeDCPExtras(t *testing.T) {
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint64(extras[0:8], 100)
+	binary.BigEndian.PutUint64(extras[8:16], 7)
+	binary.BigEndian.PutUint32(extras[16:20], 3)
+	binary.BigEndian.PutUint32(extras[20:24], 60)
+
+	m, err := DecodeDestExtrasMeta(DEST_EXTRAS_TYPE_DCP, extras)
+	if err != nil || m.RevSeq != 7 || m.Flags != 3 || m.Expiry != 60 {
+		t.Errorf("expected DCP mutation extras, got: %#v, err: %v", m, err)
+	}
+
+	m, err = DecodeDCPExtras(extras[:18])
+	if err != nil || m.RevSeq != 7 || m.Flags != 0 {
+		t.Errorf("expected DCP deletion extras, got: %#v, err: %v", m, err)
+	}
+
+	if _, err = DecodeDCPExtras(extras[:8]); err == nil {
+		t.Errorf("expected err on short DCP extras")
+	}
+}
+
+func TestXAttrs(t *testing.T) {
+	xattrs := testXAttrs("_sync", `{"rev":1}`, "meta", `"x"`)
+
+	x, body, err := SplitXAttrs(append(xattrs, []byte(`{"a":1}`)...))
+	if err != nil || !reflect.DeepEqual(x, xattrs) || string(body) != `{"a":1}` {
+		t.Errorf("expected split xattrs, got: %s, %s, err: %v", x, body, err)
+	}
+
+	m, err := DecodeXAttrs(xattrs)
+	if err != nil || len(m) != 2 ||
+		string(m["_sync"]) != `{"rev":1}` || string(m["meta"]) != `"x"` {
+		t.Errorf("expected decoded xattrs, got: %#v, err: %v", m, err)
+	}
+
+	m, err = DecodeXAttrs(nil)
+	if err != nil || len(m) != 0 {
+		t.Errorf("expected no xattrs, got: %#v, err: %v", m, err)
+	}
+
+	if _, _, err = SplitXAttrs([]byte{0, 0, 1, 0}); err == nil {
+		t.Errorf("expected err on bad xattrs length")
+	}
+	if _, err = DecodeXAttrs([]byte{0, 0, 0, 3, 0, 0, 0}); err == nil {
+		t.Errorf("expected err on bad xattr pair")
+	}
+}
+
+func TestDCPExtrasMeta(t *testing.T) {
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint64(extras[8:16], 9)
+
+	xattrs := testXAttrs("k", "v")
+	req := &gomemcached.MCRequest{
+		Extras:   extras,
+		Body:     append(append([]byte(nil), xattrs...), []byte(`{}`)...),
+		DataType: DEST_DATATYPE_JSON | DEST_DATATYPE_XATTR,
+	}
+
+	m, val, err := DCPExtrasMeta(req)
+	if err != nil || m.RevSeq != 9 || m.Datatype != req.DataType ||
+		!reflect.DeepEqual(m.XAttrs, xattrs) || string(val) != `{}` {
+		t.Errorf("expected DCP extras meta, got: %#v, %s, err: %v",
+			m, val, err)
+	}
+
+	feed := &DCPFeed{params: &DCPFeedParams{ExtrasMeta: true}}
+	val, extrasType, buf, err := feed.destExtras(req)
+	if err != nil || extrasType != DEST_EXTRAS_TYPE_META || string(val) != `{}` {
+		t.Errorf("expected meta extras, got: %d, %s, err: %v",
+			extrasType, val, err)
+	}
+	m2, err := DecodeDestExtrasMeta(extrasType, buf)
+	if err != nil || !reflect.DeepEqual(m, m2) {
+		t.Errorf("expected decoded meta extras, got: %#v, err: %v", m2, err)
+	}
+
+	feed = &DCPFeed{params: NewDCPFeedParams()}
+	val, extrasType, buf, err = feed.destExtras(req)
+	if err != nil || extrasType != DEST_EXTRAS_TYPE_DCP ||
+		!reflect.DeepEqual(val, req.Body) || !reflect.DeepEqual(buf, extras) {
+		t.Errorf("expected raw DCP extras, got: %d, err: %v", extrasType, err)
+	}
+}
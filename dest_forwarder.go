@@ -70,6 +70,19 @@ func (t *DestForwarder) DataDelete(partition string,
 		cas, extrasType, extras)
 }
 
+func (t *DestForwarder) DataExpire(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	dest, err := t.DestProvider.Dest(partition)
+	if err != nil {
+		return err
+	}
+
+	return DestDataExpire(dest, partition, key, seq,
+		cas, extrasType, extras)
+}
+
 func (t *DestForwarder) SnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
 	dest, err := t.DestProvider.Dest(partition)
@@ -134,3 +147,21 @@ func (t *DestForwarder) Query(pindex *PIndex, req []byte, res io.Writer,
 func (t *DestForwarder) Stats(w io.Writer) error {
 	return t.DestProvider.Stats(w)
 }
+
+// PartitionSeqMax implements the DestUnflushed interface when the
+// DestProvider's Dest for the partition does, and otherwise returns
+// zeros.
+func (t *DestForwarder) PartitionSeqMax(partition string) (
+	seqMax, seqMaxBatch uint64) {
+	dest, err := t.DestProvider.Dest(partition)
+	if err != nil {
+		return 0, 0
+	}
+
+	destUnflushed, ok := dest.(DestUnflushed)
+	if !ok {
+		return 0, 0
+	}
+
+	return destUnflushed.PartitionSeqMax(partition)
+}
@@ -234,3 +234,66 @@ func TestDestStatsWriteJSON(t *testing.T) {
 		t.Errorf("expected some m")
 	}
 }
+
+type TestDestExpirer struct {
+	TestDest
+	deletes  int
+	expires  int
+	lastSeen string
+}
+
+func (s *TestDestExpirer) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	s.deletes++
+	s.lastSeen = string(key)
+	return nil
+}
+
+func (s *TestDestExpirer) DataExpire(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	s.expires++
+	s.lastSeen = string(key)
+	return nil
+}
+
+func TestDestDataExpire(t *testing.T) {
+	d := &TestDestExpirer{}
+
+	DestDataExpire(d, "0", []byte("a"), 1, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if d.expires != 1 || d.deletes != 0 || d.lastSeen != "a" {
+		t.Errorf("expected DataExpire, got: %#v", d)
+	}
+
+	// Dest wrappers pass expirations through.
+	var w Dest = &DestBackpressure{Dest: d}
+	w = &DestForwarder{&FanInDestProvider{w}}
+	DestDataExpire(w, "0", []byte("b"), 2, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if d.expires != 2 || d.deletes != 0 || d.lastSeen != "b" {
+		t.Errorf("expected wrapped DataExpire, got: %#v", d)
+	}
+
+	// A Dest without DataExpire sees a DataDelete.
+	var deleted bool
+	DestDataExpire(&TestDestDelete{deleted: &deleted}, "0", []byte("c"), 3,
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	if !deleted {
+		t.Errorf("expected DataDelete fallback")
+	}
+}
+
+type TestDestDelete struct {
+	TestDest
+	deleted *bool
+}
+
+func (s *TestDestDelete) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	*s.deleted = true
+	return nil
+}
@@ -37,6 +37,12 @@ type Feed interface {
 	Stats(io.Writer) error
 }
 
+// A FeedErrorCounter is an optional interface of a Feed that counts
+// the errors the feed has seen, such as from its data source.
+type FeedErrorCounter interface {
+	ErrorCount() uint64
+}
+
 // Default values for feed parameters.
 const FEED_SLEEP_MAX_MS = 10000
 const FEED_SLEEP_INIT_MS = 100
@@ -54,6 +60,8 @@ type FeedType struct {
 	PartitionSeqs   FeedPartitionSeqsFunc   // Optional.
 	Stats           FeedStatsFunc           // Optional.
 	PartitionLookUp FeedPartitionLookUpFunc // Optional.
+	Validate        FeedValidateFunc        // Optional.
+	Topology        FeedTopologyFunc        // Optional.
 	Public          bool
 	Description     string
 	StartSample     interface{}
@@ -97,6 +105,20 @@ type FeedPartitionLookUpFunc func(docID, server string,
 	sourceDetails *IndexDef,
 	req *http.Request) (string, error)
 
+// Checks that a data source is usable, such as its connectivity, auth
+// and existence, before an index is created.  The error should be a
+// *SourceValidateError when the problem is known.
+type FeedValidateFunc func(sourceType, sourceName, sourceUUID,
+	sourceParams, server string,
+	options map[string]string) error
+
+// Returns an opaque signature of the current topology of a data
+// source, such as which servers own which partitions, so that
+// topology changes that keep the same partitions can be noticed.
+type FeedTopologyFunc func(sourceType, sourceName, sourceUUID,
+	sourceParams, server string,
+	options map[string]string) (string, error)
+
 // StopAfterSourceParams defines optional fields for the sourceParams
 // that can stop the data source feed (i.e., index ingest) if the seqs
 // per partition have been reached.  It can be used, for example, to
@@ -118,9 +140,45 @@ func RegisterFeedType(sourceType string, f *FeedType) {
 // ------------------------------------------------------------------------
 
 // DataSourcePartitions is a helper function that returns the data
-// source partitions for a named data source or feed type.
+// source partitions for a named data source or feed type.  The
+// partitions may come from a cache, per the
+// "dataSourcePartitionsCacheTTL" option (see feed_partitions_cache.go).
 func DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	server string, options map[string]string) ([]string, error) {
+	ttl := dataSourcePartitionsCacheTTL(options)
+	if ttl <= 0 {
+		return dataSourcePartitions(sourceType, sourceName, sourceUUID,
+			sourceParams, server, options)
+	}
+
+	k := dataSourcePartitionsKey{
+		sourceType:   sourceType,
+		sourceName:   sourceName,
+		sourceUUID:   sourceUUID,
+		sourceParams: sourceParams,
+		server:       server,
+	}
+
+	if partitions, ok := dataSourcePartitionsCacheGet(k); ok {
+		return partitions, nil
+	}
+
+	partitions, err := dataSourcePartitions(sourceType, sourceName,
+		sourceUUID, sourceParams, server, options)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSourcePartitionsCachePut(k, partitions, ttl)
+
+	return partitions, nil
+}
+
+// dataSourcePartitions returns the data source partitions without
+// any caching.
+func dataSourcePartitions(sourceType, sourceName, sourceUUID,
+	sourceParams, server string, options map[string]string) (
+	[]string, error) {
 	feedType, exists := FeedTypes[sourceType]
 	if !exists || feedType == nil {
 		return nil, fmt.Errorf("feed: DataSourcePartitions"+
@@ -133,6 +191,39 @@ func DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 
 // ------------------------------------------------------------------------
 
+// DataSourceTopology is a helper function that returns the topology
+// signature of a data source, bypassing any partitions cache.  When
+// the feed type has no Topology func, the signature is just the data
+// source's partitions.
+func DataSourceTopology(sourceType, sourceName, sourceUUID, sourceParams,
+	server string, options map[string]string) (string, error) {
+	feedType, exists := FeedTypes[sourceType]
+	if !exists || feedType == nil {
+		return "", fmt.Errorf("feed: DataSourceTopology"+
+			" unknown sourceType: %s", sourceType)
+	}
+
+	if feedType.Topology != nil {
+		return feedType.Topology(sourceType, sourceName, sourceUUID,
+			sourceParams, server, options)
+	}
+
+	partitions, err := feedType.Partitions(sourceType, sourceName,
+		sourceUUID, sourceParams, server, options)
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := json.Marshal(partitions)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// ------------------------------------------------------------------------
+
 // DataSourcePrepParams parses and validates the sourceParams,
 // possibly transforming it.  One transform is if the
 // "markPartitionSeqs" field in the sourceParams has a string value of
@@ -196,3 +287,68 @@ func DataSourcePrepParams(sourceType, sourceName, sourceUUID, sourceParams,
 
 	return sourceParams, nil
 }
+
+// ------------------------------------------------------------------------
+
+// The kinds of SourceValidateError.
+const (
+	SOURCE_VALIDATE_UNKNOWN_TYPE   = "unknownSourceType"
+	SOURCE_VALIDATE_PARAMS         = "sourceParams"
+	SOURCE_VALIDATE_CONNECT        = "connect"
+	SOURCE_VALIDATE_AUTH           = "auth"
+	SOURCE_VALIDATE_NOT_FOUND      = "notFound"
+	SOURCE_VALIDATE_UUID_MISMATCH  = "uuidMismatch"
+	SOURCE_VALIDATE_SOURCE_GENERAL = "source"
+)
+
+// A SourceValidateError is a structured error of why a data source
+// isn't usable, so that, for example, a UI can show the problem
+// before an index is created.
+type SourceValidateError struct {
+	Kind string `json:"kind"`
+	Msg  string `json:"msg"`
+}
+
+func (e *SourceValidateError) Error() string {
+	return "feed: source validate, " + e.Kind + ": " + e.Msg
+}
+
+// DataSourceValidate checks that a data source is usable, via the
+// optional FeedType.Validate of the source type and then by
+// retrieving the data source's partitions.  A nil result means the
+// data source is valid.
+func DataSourceValidate(sourceType, sourceName, sourceUUID, sourceParams,
+	server string, options map[string]string) *SourceValidateError {
+	feedType, exists := FeedTypes[sourceType]
+	if !exists || feedType == nil {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_UNKNOWN_TYPE,
+			Msg:  fmt.Sprintf("unknown sourceType: %s", sourceType),
+		}
+	}
+
+	if feedType.Validate != nil {
+		err := feedType.Validate(sourceType, sourceName, sourceUUID,
+			sourceParams, server, options)
+		if err != nil {
+			if sve, ok := err.(*SourceValidateError); ok {
+				return sve
+			}
+			return &SourceValidateError{
+				Kind: SOURCE_VALIDATE_SOURCE_GENERAL,
+				Msg:  err.Error(),
+			}
+		}
+	}
+
+	_, err := DataSourcePrepParams(sourceType, sourceName, sourceUUID,
+		sourceParams, server, options)
+	if err != nil {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_SOURCE_GENERAL,
+			Msg:  err.Error(),
+		}
+	}
+
+	return nil
+}
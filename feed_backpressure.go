@@ -0,0 +1,185 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Feed backpressure pauses a feed's ingestion for a partition while
+// the partition's Dest has too many received but unflushed mutations,
+// so that slow storage doesn't lead to unbounded memory growth.  Only
+// Dest implementations that also implement the DestUnflushed
+// interface are throttled.  Feed backpressure is controlled by these
+// manager options, which take effect as feeds are (re-)started:
+//
+// * feedBackpressureMaxLag - the max number of unflushed mutations
+//   (seqMax - seqMaxBatch) for a partition before its incoming
+//   mutations are paused; disabled when empty or "0".
+// * feedBackpressureMaxWait - the max time an incoming mutation is
+//   paused, after which it's passed through to the Dest anyway, so
+//   that a stalled Dest slows, but never blocks, its feed; like "10s",
+//   which is parsed by time.ParseDuration(); defaults to
+//   FEED_BACKPRESSURE_MAX_WAIT.
+
+// FEED_BACKPRESSURE_MAX_WAIT is the default for the
+// feedBackpressureMaxWait manager option.
+var FEED_BACKPRESSURE_MAX_WAIT = 10 * time.Second
+
+// FEED_BACKPRESSURE_CHECK_INTERVAL is how often a paused mutation
+// rechecks its Dest's unflushed mutations.
+var FEED_BACKPRESSURE_CHECK_INTERVAL = 10 * time.Millisecond
+
+// A DestUnflushed is a Dest that can report how far its persistence
+// lags behind the mutations that it has received for a partition.
+type DestUnflushed interface {
+	// PartitionSeqMax returns the max seq received for a partition
+	// (seqMax), and the max seq that's been flushed to storage
+	// (seqMaxBatch).
+	PartitionSeqMax(partition string) (seqMax, seqMaxBatch uint64)
+}
+
+func feedBackpressureMaxLag(options map[string]string) uint64 {
+	v, err := strconv.ParseUint(options["feedBackpressureMaxLag"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// feedDestBackpressure wraps a feed's Dest with a DestBackpressure
+// when feed backpressure is enabled and the Dest supports it.
+func (mgr *Manager) feedDestBackpressure(dest Dest) Dest {
+	maxLag := feedBackpressureMaxLag(mgr.Options())
+	if maxLag <= 0 {
+		return dest
+	}
+
+	if _, ok := unwrapFeedDest(dest).(DestUnflushed); !ok {
+		return dest
+	}
+
+	maxWait := mgr.optionDuration("feedBackpressureMaxWait")
+	if maxWait <= 0 {
+		maxWait = FEED_BACKPRESSURE_MAX_WAIT
+	}
+
+	return &DestBackpressure{
+		Dest:    dest,
+		mgr:     mgr,
+		maxLag:  maxLag,
+		maxWait: maxWait,
+	}
+}
+
+// unwrapFeedDest returns the pindex Dest underlying a feed's Dest.
+func unwrapFeedDest(dest Dest) Dest {
+	for {
+		next := unwrapFeedDestOnce(dest)
+		if next == dest {
+			return dest
+		}
+		dest = next
+	}
+}
+
+// unwrapFeedDestOnce returns the Dest wrapped by a feed Dest wrapper,
+// or the dest itself when it's not a wrapper.
+func unwrapFeedDestOnce(dest Dest) Dest {
+	switch d := dest.(type) {
+	case *DestReadOnly:
+		return d.Dest
+	case *DestBackpressure:
+		return d.Dest
+	case *DestMemoryThrottle:
+		return d.Dest
+	case *DestFaults:
+		return d.Dest
+	case *DestDocTrace:
+		return d.Dest
+	case *DestBatcher:
+		return d.Dest
+	}
+	return dest
+}
+
+// ------------------------------------------------------------------------
+
+// DestBackpressure is a Dest wrapper that pauses incoming data
+// mutations for a partition while the wrapped Dest has more than
+// maxLag unflushed mutations for the partition, waiting at most
+// maxWait per mutation.
+type DestBackpressure struct {
+	Dest
+
+	mgr     *Manager
+	maxLag  uint64
+	maxWait time.Duration
+}
+
+func (d *DestBackpressure) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait(partition)
+	return d.Dest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (d *DestBackpressure) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait(partition)
+	return d.Dest.DataDelete(partition, key, seq,
+		cas, extrasType, extras)
+}
+
+func (d *DestBackpressure) DataExpire(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait(partition)
+	return DestDataExpire(d.Dest, partition, key, seq,
+		cas, extrasType, extras)
+}
+
+// wait blocks while the partition's unflushed mutations exceed the
+// maxLag, until maxWait has elapsed or the manager is stopped.
+func (d *DestBackpressure) wait(partition string) {
+	destUnflushed, ok := d.Dest.(DestUnflushed)
+	if !ok {
+		return
+	}
+
+	var paused time.Time
+
+	for {
+		seqMax, seqMaxBatch := destUnflushed.PartitionSeqMax(partition)
+		if seqMax <= seqMaxBatch || seqMax-seqMaxBatch <= d.maxLag {
+			return
+		}
+
+		if paused.IsZero() {
+			paused = time.Now()
+			atomic.AddUint64(&d.mgr.stats.TotFeedBackpressurePause, 1)
+		} else if time.Since(paused) >= d.maxWait {
+			atomic.AddUint64(&d.mgr.stats.TotFeedBackpressureTimeout, 1)
+			return
+		}
+
+		select {
+		case <-d.mgr.stopCh:
+			return
+		case <-time.After(FEED_BACKPRESSURE_CHECK_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestDestUnflushed struct {
+	BlackHole
+
+	m           sync.Mutex
+	seqMax      uint64
+	seqMaxBatch uint64
+}
+
+func (t *TestDestUnflushed) PartitionSeqMax(partition string) (
+	uint64, uint64) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.seqMax, t.seqMaxBatch
+}
+
+func (t *TestDestUnflushed) setSeqs(seqMax, seqMaxBatch uint64) {
+	t.m.Lock()
+	t.seqMax, t.seqMaxBatch = seqMax, seqMaxBatch
+	t.m.Unlock()
+}
+
+type TestDestUnflushedProvider struct {
+	dest Dest
+}
+
+func (t *TestDestUnflushedProvider) Dest(partition string) (Dest, error) {
+	return t.dest, nil
+}
+
+func (t *TestDestUnflushedProvider) Count(pindex *PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	return 0, nil
+}
+
+func (t *TestDestUnflushedProvider) Query(pindex *PIndex, req []byte,
+	res io.Writer, cancelCh <-chan bool) error {
+	return nil
+}
+
+func (t *TestDestUnflushedProvider) Stats(io.Writer) error {
+	return nil
+}
+
+func (t *TestDestUnflushedProvider) Close() error {
+	return nil
+}
+
+func TestFeedBackpressure(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"feedBackpressureMaxLag":  "2",
+			"feedBackpressureMaxWait": "50ms",
+		})
+
+	blackHole := &BlackHole{}
+	if m.feedDestBackpressure(blackHole) != blackHole {
+		t.Errorf("expected dests without DestUnflushed to be unwrapped")
+	}
+
+	d := &TestDestUnflushed{}
+	dest := m.feedDestBackpressure(d)
+	if _, ok := dest.(*DestBackpressure); !ok || unwrapFeedDest(dest) != d {
+		t.Errorf("expected DestBackpressure, got: %#v", dest)
+	}
+
+	d.setSeqs(10, 8)
+	dest.DataUpdate("0", []byte("k"), 11, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotFeedBackpressurePause != 0 {
+		t.Errorf("expected no pause within the max lag")
+	}
+
+	d.setSeqs(10, 5)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.setSeqs(10, 10)
+	}()
+	dest.DataDelete("0", []byte("k"), 11, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotFeedBackpressurePause != 1 ||
+		m.stats.TotFeedBackpressureTimeout != 0 {
+		t.Errorf("expected pause until flushed, got: %d, %d",
+			m.stats.TotFeedBackpressurePause,
+			m.stats.TotFeedBackpressureTimeout)
+	}
+
+	d.setSeqs(10, 5)
+	dest.DataUpdate("0", []byte("k"), 11, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotFeedBackpressurePause != 2 ||
+		m.stats.TotFeedBackpressureTimeout != 1 {
+		t.Errorf("expected pause until max wait, got: %d, %d",
+			m.stats.TotFeedBackpressurePause,
+			m.stats.TotFeedBackpressureTimeout)
+	}
+
+	forwarder := &DestForwarder{
+		DestProvider: &TestDestUnflushedProvider{dest: d},
+	}
+	if seqMax, seqMaxBatch := forwarder.PartitionSeqMax("0"); seqMax != 10 ||
+		seqMaxBatch != 5 {
+		t.Errorf("expected forwarded seqs, got: %d, %d", seqMax, seqMaxBatch)
+	}
+
+	forwarder = &DestForwarder{
+		DestProvider: &TestDestUnflushedProvider{dest: blackHole},
+	}
+	if seqMax, seqMaxBatch := forwarder.PartitionSeqMax("0"); seqMax != 0 ||
+		seqMaxBatch != 0 {
+		t.Errorf("expected zero seqs, got: %d, %d", seqMax, seqMaxBatch)
+	}
+}
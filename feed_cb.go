@@ -90,6 +90,13 @@ func init() {
 func CouchbasePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	serverIn string, options map[string]string) (
 	partitions []string, err error) {
+	_, err = ParseDCPFeedParams(sourceParams)
+	if err != nil {
+		return nil, fmt.Errorf("feed_cb: CouchbasePartitions"+
+			" invalid sourceParams, sourceName: %s, err: %v",
+			sourceName, err)
+	}
+
 	bucket, err := CouchbaseBucket(sourceName, sourceUUID, sourceParams,
 		serverIn, options)
 	if err != nil {
@@ -117,6 +124,37 @@ func CouchbasePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 
 // ----------------------------------------------------------------
 
+// CouchbaseTopology returns the VBServerMap of a couchbase bucket,
+// that is, its server list and vbucket to server assignments, as a
+// JSON signature, so that rebalances and failovers that keep the same
+// number of vbuckets are noticed.
+func CouchbaseTopology(sourceType, sourceName, sourceUUID, sourceParams,
+	serverIn string, options map[string]string) (string, error) {
+	bucket, err := CouchbaseBucket(sourceName, sourceUUID, sourceParams,
+		serverIn, options)
+	if err != nil {
+		return "", err
+	}
+
+	defer bucket.Close()
+
+	vbm := bucket.VBServerMap()
+	if vbm == nil {
+		return "", fmt.Errorf("feed_cb: CouchbaseTopology"+
+			" no VBServerMap, server: %s, sourceName: %s",
+			serverIn, sourceName)
+	}
+
+	buf, err := json.Marshal(vbm)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// ----------------------------------------------------------------
+
 // CouchbaseBucket is a helper function to connect to a couchbase bucket.
 func CouchbaseBucket(sourceName, sourceUUID, sourceParams, serverIn string,
 	options map[string]string) (*couchbase.Bucket, error) {
@@ -163,6 +201,81 @@ func CouchbaseBucket(sourceName, sourceUUID, sourceParams, serverIn string,
 
 // ----------------------------------------------------------------
 
+// CouchbaseValidateSource checks a couchbase bucket data source step
+// by step, so that a *SourceValidateError can tell apart problems
+// with the sourceParams, connectivity, auth, bucket existence and
+// bucket UUID.
+func CouchbaseValidateSource(sourceType, sourceName, sourceUUID,
+	sourceParams, serverIn string, options map[string]string) error {
+	_, err := ParseDCPFeedParams(sourceParams)
+	if err != nil {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_PARAMS,
+			Msg:  err.Error(),
+		}
+	}
+
+	server, poolName, bucketName :=
+		CouchbaseParseSourceName(serverIn, "default", sourceName)
+
+	auth, err := CBAuth(sourceName, sourceParams, options)
+	if err != nil {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_AUTH,
+			Msg:  err.Error(),
+		}
+	}
+
+	client, err := couchbase.ConnectWithAuth(server, auth)
+	if err != nil {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_CONNECT,
+			Msg: fmt.Sprintf("server: %s, err: %v",
+				server, err),
+		}
+	}
+
+	pool, err := client.GetPool(poolName)
+	if err != nil {
+		kind := SOURCE_VALIDATE_CONNECT
+		if strings.Contains(err.Error(), "401") {
+			kind = SOURCE_VALIDATE_AUTH
+		}
+		return &SourceValidateError{
+			Kind: kind,
+			Msg: fmt.Sprintf("server: %s, poolName: %s, err: %v",
+				server, poolName, err),
+		}
+	}
+
+	bucket, err := pool.GetBucket(bucketName)
+	if err != nil {
+		kind := SOURCE_VALIDATE_CONNECT
+		if _, ok := err.(*couchbase.BucketNotFoundError); ok {
+			kind = SOURCE_VALIDATE_NOT_FOUND
+		}
+		return &SourceValidateError{
+			Kind: kind,
+			Msg: fmt.Sprintf("bucketName: %s, err: %v",
+				bucketName, err),
+		}
+	}
+
+	defer bucket.Close()
+
+	if sourceUUID != "" && sourceUUID != bucket.UUID {
+		return &SourceValidateError{
+			Kind: SOURCE_VALIDATE_UUID_MISMATCH,
+			Msg: fmt.Sprintf("bucketName: %s, sourceUUID: %s,"+
+				" bucket UUID: %s", bucketName, sourceUUID, bucket.UUID),
+		}
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------
+
 // CouchbaseParseSourceName parses a sourceName, if it's a couchbase
 // REST/HTTP URL, into a server URL, poolName and bucketName.
 // Otherwise, returns the serverURLDefault, poolNameDefault, and treat
@@ -12,13 +12,16 @@
 package cbgt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/couchbase/clog"
 
@@ -41,6 +44,8 @@ func init() {
 		PartitionSeqs:   CouchbasePartitionSeqs,
 		Stats:           CouchbaseStats,
 		PartitionLookUp: CouchbaseSourceVBucketLookUp,
+		Validate:        CouchbaseValidateSource,
+		Topology:        CouchbaseTopology,
 		Public:          true,
 		Description: "general/couchbase" +
 			" - a Couchbase Server bucket will be the data source",
@@ -52,6 +57,8 @@ func init() {
 		PartitionSeqs:   CouchbasePartitionSeqs,
 		Stats:           CouchbaseStats,
 		PartitionLookUp: CouchbaseSourceVBucketLookUp,
+		Validate:        CouchbaseValidateSource,
+		Topology:        CouchbaseTopology,
 		Public:          false, // Won't be listed in /api/managerMeta output.
 		Description: "general/couchbase-dcp" +
 			" - a Couchbase Server bucket will be the data source," +
@@ -107,16 +114,30 @@ type DCPFeed struct {
 	dests      map[string]Dest
 	disable    bool
 	stopAfter  map[string]UUIDSeq // May be nil.
-	bds        cbdatasource.BucketDataSource
 	mgr        *Manager
 	auth       couchbase.AuthHandler
 
+	// One bucket data source per group of vbuckets, where there's
+	// more than one group only when maxConcurrentVBucketStreams
+	// limits the stream opens of the feed.
+	bdss      []cbdatasource.BucketDataSource
+	bdsGroups [][]uint16
+
 	m       sync.Mutex // Protects the fields that follow.
 	closed  bool
 	lastErr error
 	stats   *DestStats
 
+	bdsStarted int             // Number of started bdss.
+	bdsOpening map[uint16]bool // Vbuckets of the latest started group.
+
 	stopAfterReached map[string]bool // May be nil.
+
+	// Keyed by vbucketId, true when the vbucket is streamed from a
+	// replica, per the latest vbucket map seen by the feed.
+	replicaVBuckets map[uint16]bool
+
+	totReplicaRollback uint64
 }
 
 // DCPFeedParams are DCP data-source/feed specific connection
@@ -159,11 +180,89 @@ type DCPFeedParams struct {
 	// percentage of FeedBufferSizeBytes is reached.
 	FeedBufferAckThreshold float32 `json:"feedBufferAckThreshold,omitempty"`
 
+	// Time interval in seconds of DCP noop messages, which the data
+	// manager uses to detect a dead connection.  Zero means the
+	// cbdatasource default.
+	NoopTimeIntervalSecs uint32 `json:"noopTimeIntervalSecs,omitempty"`
+
+	// Maximum number of vbucket streams that a single feed opens at
+	// once, where zero means no limit.  The vbuckets of a feed are
+	// split into groups of at most this size, and a group's streams
+	// are only opened once every stream of the previous group has
+	// opened.  As the groups need the feed's vbuckets to be known, a
+	// feed for all the vbuckets of a bucket fails to start.
+	MaxConcurrentVBucketStreams int `json:"maxConcurrentVBucketStreams,omitempty"`
+
 	// Used to specify whether the applications are interested
 	// in receiving the xattrs information in a dcp stream.
 	IncludeXAttrs bool `json:"includeXAttrs,omitempty"`
+
+	// When true, data mutations and deletions are sent to dests with
+	// DEST_EXTRAS_TYPE_META extras, which hold the xattrs (split out
+	// of the document body), datatype, flags, expiry and revSeq,
+	// instead of with the raw DEST_EXTRAS_TYPE_DCP extras.
+	ExtrasMeta bool `json:"extrasMeta,omitempty"`
+
+	// Controls streaming from replica vbuckets, where valid values
+	// are "" (only stream from active vbuckets), "fallback" (stream
+	// from a replica vbucket only when the vbucket has no available
+	// active) and "prefer" (stream from a replica vbucket whenever
+	// there is one, such as for latency-insensitive indexes, to
+	// reduce load on the active KV nodes).
+	ReplicaReads string `json:"replicaReads,omitempty"`
+}
+
+// Validate returns an error if the DCPFeedParams have out of range
+// flow control settings.
+func (d *DCPFeedParams) Validate() error {
+	if d.FeedBufferSizeBytes > DCP_FEED_BUFFER_SIZE_BYTES_MAX {
+		return fmt.Errorf("feed_dcp: feedBufferSizeBytes: %d,"+
+			" must be <= %d",
+			d.FeedBufferSizeBytes, DCP_FEED_BUFFER_SIZE_BYTES_MAX)
+	}
+	if d.FeedBufferAckThreshold < 0 || d.FeedBufferAckThreshold > 1 {
+		return fmt.Errorf("feed_dcp: feedBufferAckThreshold: %f,"+
+			" must be between 0 and 1", d.FeedBufferAckThreshold)
+	}
+	if d.NoopTimeIntervalSecs > DCP_NOOP_TIME_INTERVAL_SECS_MAX {
+		return fmt.Errorf("feed_dcp: noopTimeIntervalSecs: %d,"+
+			" must be <= %d",
+			d.NoopTimeIntervalSecs, DCP_NOOP_TIME_INTERVAL_SECS_MAX)
+	}
+	if d.MaxConcurrentVBucketStreams < 0 {
+		return fmt.Errorf("feed_dcp: maxConcurrentVBucketStreams: %d,"+
+			" must be >= 0", d.MaxConcurrentVBucketStreams)
+	}
+	if d.ReplicaReads != "" &&
+		d.ReplicaReads != DCP_REPLICA_READS_FALLBACK &&
+		d.ReplicaReads != DCP_REPLICA_READS_PREFER {
+		return fmt.Errorf("feed_dcp: unknown replicaReads: %q",
+			d.ReplicaReads)
+	}
+	return nil
+}
+
+// ParseDCPFeedParams parses and validates the DCPFeedParams of a
+// sourceParams JSON, starting from the NewDCPFeedParams() defaults.
+func ParseDCPFeedParams(paramsStr string) (*DCPFeedParams, error) {
+	params := NewDCPFeedParams()
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, params.Validate()
 }
 
+// Upper bounds for the DCPFeedParams flow control settings.
+const DCP_FEED_BUFFER_SIZE_BYTES_MAX = 1024 * 1024 * 1024 // 1GB.
+const DCP_NOOP_TIME_INTERVAL_SECS_MAX = 60 * 60           // 1 hour.
+
+// Valid values for DCPFeedParams.ReplicaReads.
+const DCP_REPLICA_READS_FALLBACK = "fallback"
+const DCP_REPLICA_READS_PREFER = "prefer"
+
 // NewDCPFeedParams returns a DCPFeedParams initialized with default
 // values.
 func NewDCPFeedParams() *DCPFeedParams {
@@ -212,6 +311,11 @@ func NewDCPFeed(name, indexName, url, poolName,
 		}
 	}
 
+	err = params.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	vbucketIds, err := ParsePartitionsToVBucketIds(dests)
 	if err != nil {
 		return nil, err
@@ -220,6 +324,13 @@ func NewDCPFeed(name, indexName, url, poolName,
 		vbucketIds = nil
 	}
 
+	if params.MaxConcurrentVBucketStreams > 0 && vbucketIds == nil {
+		return nil, fmt.Errorf("feed_dcp: NewDCPFeed, name: %s,"+
+			" vbuckets: all, needs known vbuckets for"+
+			" maxConcurrentVBucketStreams: %d",
+			name, params.MaxConcurrentVBucketStreams)
+	}
+
 	urls := strings.Split(url, ";")
 
 	options := &cbdatasource.BucketDataSourceOptions{
@@ -232,6 +343,7 @@ func NewDCPFeed(name, indexName, url, poolName,
 		DataManagerSleepMaxMS:       params.DataManagerSleepMaxMS,
 		FeedBufferSizeBytes:         params.FeedBufferSizeBytes,
 		FeedBufferAckThreshold:      params.FeedBufferAckThreshold,
+		NoopTimeIntervalSecs:        params.NoopTimeIntervalSecs,
 		Logf:          log.Printf,
 		TraceCapacity: 20,
 		IncludeXAttrs: params.IncludeXAttrs,
@@ -255,16 +367,42 @@ func NewDCPFeed(name, indexName, url, poolName,
 		stats:      NewDestStats(),
 	}
 
-	feed.bds, err = cbdatasource.NewBucketDataSource(
-		urls, poolName, bucketName, bucketUUID,
-		vbucketIds, auth, feed, options)
-	if err != nil {
-		return nil, err
+	if params.ReplicaReads != "" {
+		options.ConnectBucket = feed.connectBucketReplicaReads
+	}
+
+	feed.bdsGroups = groupVBucketIds(vbucketIds,
+		params.MaxConcurrentVBucketStreams)
+
+	for _, group := range feed.bdsGroups {
+		bds, err := cbdatasource.NewBucketDataSource(
+			urls, poolName, bucketName, bucketUUID,
+			group, auth, feed, options)
+		if err != nil {
+			return nil, err
+		}
+
+		feed.bdss = append(feed.bdss, bds)
 	}
 
 	return feed, nil
 }
 
+// groupVBucketIds splits the vbucketIds into groups of at most max
+// vbuckets, where a max of zero means a single group.
+func groupVBucketIds(vbucketIds []uint16, max int) [][]uint16 {
+	if max <= 0 || len(vbucketIds) <= max {
+		return [][]uint16{vbucketIds}
+	}
+
+	var rv [][]uint16
+	for len(vbucketIds) > max {
+		rv = append(rv, vbucketIds[:max])
+		vbucketIds = vbucketIds[max:]
+	}
+	return append(rv, vbucketIds)
+}
+
 func (t *DCPFeed) Name() string {
 	return t.name
 }
@@ -280,7 +418,53 @@ func (t *DCPFeed) Start() error {
 	}
 
 	log.Printf("feed_dcp: start, name: %s", t.Name())
-	return t.bds.Start()
+	return t.startNextBDS()
+}
+
+// startNextBDS starts the bucket data source of the next group of
+// vbuckets, if any.
+func (t *DCPFeed) startNextBDS() error {
+	t.m.Lock()
+	if t.closed || t.bdsStarted >= len(t.bdss) {
+		t.m.Unlock()
+		return nil
+	}
+	bds := t.bdss[t.bdsStarted]
+	t.bdsOpening = map[uint16]bool{}
+	for _, vbucketId := range t.bdsGroups[t.bdsStarted] {
+		t.bdsOpening[vbucketId] = true
+	}
+	t.bdsStarted++
+	if t.bdsStarted > 1 {
+		log.Printf("feed_dcp: start, name: %s, vbucket group: %d of %d",
+			t.name, t.bdsStarted, len(t.bdss))
+	}
+	t.m.Unlock()
+
+	return bds.Start()
+}
+
+// streamOpened tracks the opened streams of the latest started group
+// of vbuckets, starting the next group once they've all opened.
+func (t *DCPFeed) streamOpened(vbucketId uint16) {
+	t.m.Lock()
+	if !t.bdsOpening[vbucketId] {
+		t.m.Unlock()
+		return
+	}
+	delete(t.bdsOpening, vbucketId)
+	next := len(t.bdsOpening) <= 0 && t.bdsStarted < len(t.bdss)
+	t.m.Unlock()
+
+	if next {
+		// Not in the callback, which is on a bds worker goroutine.
+		go func() {
+			err := t.startNextBDS()
+			if err != nil {
+				t.OnError(err)
+			}
+		}()
+	}
 }
 
 func (t *DCPFeed) Close() error {
@@ -290,10 +474,19 @@ func (t *DCPFeed) Close() error {
 		return nil
 	}
 	t.closed = true
+	bdss := t.bdss[:t.bdsStarted]
 	t.m.Unlock()
 
 	log.Printf("feed_dcp: close, name: %s", t.Name())
-	return t.bds.Close()
+
+	var rv error
+	for _, bds := range bdss {
+		err := bds.Close()
+		if err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
 }
 
 func (t *DCPFeed) Dests() map[string]Dest {
@@ -302,12 +495,22 @@ func (t *DCPFeed) Dests() map[string]Dest {
 
 var prefixBucketDataSourceStats = []byte(`{"bucketDataSourceStats":`)
 var prefixDestStats = []byte(`,"destStats":`)
+var prefixTotReplicaRollback = []byte(`,"totReplicaRollback":`)
+
+// ErrorCount returns the number of errors seen by the feed.
+func (t *DCPFeed) ErrorCount() uint64 {
+	return atomic.LoadUint64(&t.stats.TotError)
+}
 
 func (t *DCPFeed) Stats(w io.Writer) error {
 	bdss := cbdatasource.BucketDataSourceStats{}
-	err := t.bds.Stats(&bdss)
-	if err != nil {
-		return err
+	for _, bds := range t.bdss {
+		bdssGroup := cbdatasource.BucketDataSourceStats{}
+		err := bds.Stats(&bdssGroup)
+		if err != nil {
+			return err
+		}
+		addBucketDataSourceStats(&bdss, &bdssGroup)
 	}
 	w.Write(prefixBucketDataSourceStats)
 	json.NewEncoder(w).Encode(&bdss)
@@ -315,10 +518,24 @@ func (t *DCPFeed) Stats(w io.Writer) error {
 	w.Write(prefixDestStats)
 	t.stats.WriteJSON(w)
 
-	_, err = w.Write(JsonCloseBrace)
+	w.Write(prefixTotReplicaRollback)
+	fmt.Fprintf(w, "%d", atomic.LoadUint64(&t.totReplicaRollback))
+
+	_, err := w.Write(JsonCloseBrace)
 	return err
 }
 
+// addBucketDataSourceStats adds the counters of src to dst.
+func addBucketDataSourceStats(dst, src *cbdatasource.BucketDataSourceStats) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < d.NumField(); i++ {
+		if d.Field(i).Kind() == reflect.Uint64 {
+			d.Field(i).SetUint(d.Field(i).Uint() + s.Field(i).Uint())
+		}
+	}
+}
+
 // --------------------------------------------------------
 
 // checkStopAfter checks to see if we've already reached the
@@ -379,6 +596,14 @@ func (r *DCPFeed) OnError(err error) {
 	if r.mgr != nil && r.mgr.meh != nil {
 		go r.mgr.meh.OnFeedError("couchbase", r, err)
 	}
+	if r.mgr != nil {
+		r.mgr.EmitEvent(ManagerEvent{
+			Kind:      MANAGER_EVENT_FEED_ERROR,
+			IndexName: r.indexName,
+			FeedName:  r.name,
+			Err:       err.Error(),
+		})
+	}
 
 	r.m.Lock()
 	r.lastErr = err
@@ -394,8 +619,15 @@ func (r *DCPFeed) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 			return err
 		}
 
-		err = dest.DataUpdate(partition, key, seq, req.Body,
-			req.Cas, DEST_EXTRAS_TYPE_DCP, req.Extras)
+		val, extrasType, extras, err := r.destExtras(req)
+		if err != nil {
+			return fmt.Errorf("feed_dcp: DataUpdate extras,"+
+				" name: %s, partition: %s, key: %s, seq: %d, err: %v",
+				r.name, partition, key, seq, err)
+		}
+
+		err = dest.DataUpdate(partition, key, seq, val,
+			req.Cas, extrasType, extras)
 		if err != nil {
 			return fmt.Errorf("feed_dcp: DataUpdate,"+
 				" name: %s, partition: %s, key: %s, seq: %d, err: %v",
@@ -408,6 +640,43 @@ func (r *DCPFeed) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 	}, r.stats.TimerDataUpdate)
 }
 
+// destExtras returns the value, extras type and extras that a DCP
+// mutation or deletion should be sent to a dest with.
+func (r *DCPFeed) destExtras(req *gomemcached.MCRequest) (
+	[]byte, DestExtrasType, []byte, error) {
+	if r.params == nil || !r.params.ExtrasMeta {
+		return req.Body, DEST_EXTRAS_TYPE_DCP, req.Extras, nil
+	}
+
+	meta, val, err := DCPExtrasMeta(req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return val, DEST_EXTRAS_TYPE_META, EncodeDestExtrasMeta(meta), nil
+}
+
+// DCPExtrasMeta returns the DestExtrasMeta of a DCP mutation or
+// deletion, along with its value without any xattrs.
+func DCPExtrasMeta(req *gomemcached.MCRequest) (
+	*DestExtrasMeta, []byte, error) {
+	meta, err := DecodeDCPExtras(req.Extras)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.Datatype = req.DataType
+
+	val := req.Body
+	if req.DataType&DEST_DATATYPE_XATTR != 0 {
+		meta.XAttrs, val, err = SplitXAttrs(req.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return meta, val, nil
+}
+
 func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
 	return Timer(func() error {
@@ -417,8 +686,22 @@ func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 			return err
 		}
 
-		err = dest.DataDelete(partition, key, seq,
-			req.Cas, DEST_EXTRAS_TYPE_DCP, req.Extras)
+		_, extrasType, extras, err := r.destExtras(req)
+		if err != nil {
+			return fmt.Errorf("feed_dcp: DataDelete extras,"+
+				" name: %s, partition: %s, key: %s, seq: %d, err: %v",
+				r.name, partition, key, seq, err)
+		}
+
+		// Expirations arrive as deletions, but are told apart for
+		// Dests that implement the DestExpirer interface.
+		if req.Opcode == gomemcached.UPR_EXPIRATION {
+			err = DestDataExpire(dest, partition, key, seq,
+				req.Cas, extrasType, extras)
+		} else {
+			err = dest.DataDelete(partition, key, seq,
+				req.Cas, extrasType, extras)
+		}
 		if err != nil {
 			return fmt.Errorf("feed_dcp: DataDelete,"+
 				" name: %s, partition: %s, key: %s, seq: %d, err: %v",
@@ -433,6 +716,8 @@ func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 
 func (r *DCPFeed) SnapshotStart(vbucketId uint16,
 	snapStart, snapEnd uint64, snapType uint32) error {
+	r.streamOpened(vbucketId)
+
 	return Timer(func() error {
 		partition, dest, err :=
 			VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
@@ -448,11 +733,37 @@ func (r *DCPFeed) SnapshotStart(vbucketId uint16,
 			}
 		}
 
-		return dest.SnapshotStart(partition, snapStart, snapEnd)
+		if r.mgr != nil {
+			defer r.mgr.timers.TimerFeedBatch.UpdateSince(time.Now())
+		}
+
+		LogDebugf("feed", "feed_dcp: SnapshotStart, name: %s,"+
+			" partition: %s, snapStart: %d, snapEnd: %d",
+			r.name, partition, snapStart, snapEnd)
+
+		if r.mgr == nil {
+			return dest.SnapshotStart(partition, snapStart, snapEnd)
+		}
+
+		_, span := r.mgr.StartTraceSpan(context.Background(),
+			"cbgt.feed.snapshot")
+		span.SetTag("feedName", r.name)
+		span.SetTag("partition", partition)
+		span.SetTag("snapStart", snapStart)
+		span.SetTag("snapEnd", snapEnd)
+
+		err = dest.SnapshotStart(partition, snapStart, snapEnd)
+
+		span.Finish(err)
+
+		return err
 	}, r.stats.TimerSnapshotStart)
 }
 
 func (r *DCPFeed) SetMetaData(vbucketId uint16, value []byte) error {
+	// The failover log of a newly opened stream is saved as metadata.
+	r.streamOpened(vbucketId)
+
 	return Timer(func() error {
 		partition, dest, err :=
 			VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
@@ -494,15 +805,113 @@ func (r *DCPFeed) Rollback(vbucketId uint16, rollbackSeq uint64) error {
 			return err
 		}
 
+		// A replica vbucket may be behind the active vbucket that
+		// the dest had been fed from, in which case the replica asks
+		// for a rollback to the seq that it has.  The dest still must
+		// rollback, as the replica's history is what'll be streamed.
+		replica := r.isReplicaVBucket(vbucketId)
+		if replica {
+			atomic.AddUint64(&r.totReplicaRollback, 1)
+		}
+
 		log.Printf("feed_dcp: rollback, name: %s: vbucketId: %d,"+
-			" rollbackSeq: %d, partition: %s, opaqueValue: %s, lastSeq: %d",
+			" rollbackSeq: %d, partition: %s, opaqueValue: %s,"+
+			" lastSeq: %d, replica: %t",
 			r.name, vbucketId, rollbackSeq,
-			partition, opaqueValue, lastSeq)
+			partition, opaqueValue, lastSeq, replica)
 
-		return dest.Rollback(partition, rollbackSeq)
+		err = dest.Rollback(partition, rollbackSeq)
+		if err == nil && r.mgr != nil {
+			r.mgr.emitRollbackEvent(r.name, dest, partition, rollbackSeq)
+		}
+
+		return err
 	}, r.stats.TimerRollback)
 }
 
+// --------------------------------------------------------
+
+// dcpReplicaReadsBucket wraps a cbdatasource.Bucket so that the
+// vbucket map that it provides to the cbdatasource points at replica
+// vbuckets, per the DCPFeedParams.ReplicaReads mode.
+type dcpReplicaReadsBucket struct {
+	cbdatasource.Bucket
+	feed *DCPFeed
+}
+
+func (b *dcpReplicaReadsBucket) VBServerMap() *couchbase.VBucketServerMap {
+	vbm, replicaVBuckets :=
+		DCPReplicaVBServerMap(b.Bucket.VBServerMap(), b.feed.params.ReplicaReads)
+
+	b.feed.m.Lock()
+	b.feed.replicaVBuckets = replicaVBuckets
+	b.feed.m.Unlock()
+
+	return vbm
+}
+
+func (r *DCPFeed) connectBucketReplicaReads(serverURL, poolName,
+	bucketName string, auth couchbase.AuthHandler) (
+	cbdatasource.Bucket, error) {
+	bucket, err := cbdatasource.ConnectBucket(serverURL, poolName,
+		bucketName, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dcpReplicaReadsBucket{Bucket: bucket, feed: r}, nil
+}
+
+func (r *DCPFeed) isReplicaVBucket(vbucketId uint16) bool {
+	r.m.Lock()
+	replica := r.replicaVBuckets[vbucketId]
+	r.m.Unlock()
+
+	return replica
+}
+
+// DCPReplicaVBServerMap returns a copy of a vbucket server map where
+// the first (or "master") server of a vbucket is replaced by one of
+// the vbucket's replica servers, per a DCPFeedParams.ReplicaReads
+// mode.  A vbucket without a usable replica is left as is.  The
+// returned map is keyed by the vbucketId's that were replaced.
+func DCPReplicaVBServerMap(vbm *couchbase.VBucketServerMap,
+	replicaReads string) (*couchbase.VBucketServerMap, map[uint16]bool) {
+	if vbm == nil || replicaReads == "" {
+		return vbm, nil
+	}
+
+	validServer := func(i int) bool {
+		return i >= 0 && i < len(vbm.ServerList)
+	}
+
+	rv := *vbm
+	rv.VBucketMap = make([][]int, len(vbm.VBucketMap))
+
+	replicaVBuckets := map[uint16]bool{}
+
+	for vbid, servers := range vbm.VBucketMap {
+		servers = append([]int(nil), servers...)
+		rv.VBucketMap[vbid] = servers
+
+		if len(servers) <= 1 ||
+			(replicaReads == DCP_REPLICA_READS_FALLBACK &&
+				validServer(servers[0])) {
+			continue
+		}
+
+		for j := 1; j < len(servers); j++ {
+			if validServer(servers[j]) {
+				servers[0], servers[j] = servers[j], servers[0]
+				replicaVBuckets[uint16(vbid)] = true
+				break
+			}
+		}
+	}
+
+	return &rv, replicaVBuckets
+}
+
 // VerifyBucketNotExists returns true only if it's sure the bucket
 // does not exist anymore (including if UUID's no longer match).  A
 // rejected auth or connection failure, for example, results in false.
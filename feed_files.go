@@ -59,6 +59,15 @@ func init() {
 // FilesFeed supports optional regexp patterns to allow you to filter
 // for only the file paths that you want.
 //
+// By default, file paths are hashed to FilesFeedParams.NumPartitions
+// partitions.  With FilesFeedParams.PartitionBySubdir, instead, each
+// top-level subdirectory of the tree is a partition...
+//
+//    <dataDir>/files/<sourceName>/<partition>/**
+//
+// where the subdirectories are listed when the index is planned, so
+// subdirectories that are added later are not seen until a replan.
+//
 // Limitations:
 //
 // - Only a small number of files will work well (hundreds to low
@@ -92,6 +101,11 @@ type FilesFeedParams struct {
 	SleepStartMS  int      `json:"sleepStartMS"`
 	BackoffFactor float32  `json:"backoffFactor"`
 	MaxSleepMS    int      `json:"maxSleepMS"`
+
+	// When true, the top-level subdirectories are the partitions,
+	// and NumPartitions is ignored.  Listing the subdirectories
+	// requires the "dataDir" option.
+	PartitionBySubdir bool `json:"partitionBySubdir"`
 }
 
 // FileDoc represents the JSON for each file/document that will be
@@ -198,6 +212,12 @@ func (t *FilesFeed) Start() error {
 		partitions[i] = strconv.Itoa(i)
 	}
 
+	filesDir := FilesFeedDir(t.mgr.DataDir(), t.sourceName)
+
+	t.m.Lock()
+	stopCh := t.closeCh
+	t.m.Unlock()
+
 	go func() {
 		initTime := time.Now()
 		initTimeMicroSecs := initTime.UnixNano() / int64(1000)
@@ -213,7 +233,7 @@ func (t *FilesFeed) Start() error {
 
 		var prevStartTime time.Time
 
-		ExponentialBackoffLoop(t.Name(),
+		ExponentialBackoffLoopEx(t.Name(),
 			func() int {
 				t.m.Lock()
 				closeCh := t.closeCh
@@ -227,6 +247,20 @@ func (t *FilesFeed) Start() error {
 
 				h := crc32.NewIEEE()
 
+				pathToPartition := func(path string) string {
+					return FilesPathToPartition(h, partitions, path)
+				}
+				if t.params.PartitionBySubdir {
+					root, err := filepath.EvalSymlinks(filesDir)
+					if err != nil {
+						log.Printf("feed_files, EvalSymlinks, err: %v", err)
+						return -1
+					}
+					pathToPartition = func(path string) string {
+						return FilesPathToSubdir(root, path)
+					}
+				}
+
 				startTime := time.Now()
 
 				progress := false
@@ -244,7 +278,7 @@ func (t *FilesFeed) Start() error {
 				seqEnds := map[string]uint64{}
 
 				for _, path := range paths {
-					partition := FilesPathToPartition(h, partitions, path)
+					partition := pathToPartition(path)
 
 					if t.dests[partition] == nil {
 						continue
@@ -274,7 +308,7 @@ func (t *FilesFeed) Start() error {
 					default:
 					}
 
-					partition := FilesPathToPartition(h, partitions, path)
+					partition := pathToPartition(path)
 
 					dest := t.dests[partition]
 					if dest == nil {
@@ -356,9 +390,12 @@ func (t *FilesFeed) Start() error {
 				}
 				return 0
 			},
-			startSleepMS,
-			backoffFactor,
-			maxSleepMS)
+			BackoffOptions{
+				StartSleepMS:  startSleepMS,
+				BackoffFactor: backoffFactor,
+				MaxSleepMS:    maxSleepMS,
+				StopCh:        stopCh,
+			})
 	}()
 
 	return nil
@@ -387,7 +424,8 @@ func (t *FilesFeed) Stats(w io.Writer) error {
 // -----------------------------------------------------
 
 // FilesFeedPartitions returns the partitions, controlled by
-// FilesFeedParams.NumPartitions, for a FilesFeed instance.
+// FilesFeedParams.NumPartitions or FilesFeedParams.PartitionBySubdir,
+// for a FilesFeed instance.
 func FilesFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	server string, options map[string]string) ([]string, error) {
 	ffp := &FilesFeedParams{}
@@ -399,6 +437,14 @@ func FilesFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
 				sourceParams, err)
 		}
 	}
+	if ffp.PartitionBySubdir {
+		dataDir := options["dataDir"]
+		if dataDir == "" {
+			return nil, fmt.Errorf("feed_files:" +
+				" partitionBySubdir requires the dataDir option")
+		}
+		return FilesSubdirs(dataDir, sourceName)
+	}
 	rv := make([]string, ffp.NumPartitions)
 	for i := 0; i < ffp.NumPartitions; i++ {
 		rv[i] = strconv.Itoa(i)
@@ -420,9 +466,7 @@ func FilesFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
 func FilesFindMatches(dataDir, sourceName string,
 	regExps []string, modTimeGTE time.Time, maxSize int64) (
 	[]string, error) {
-	walkPath, err := filepath.EvalSymlinks(dataDir +
-		string(os.PathSeparator) + "files" +
-		string(os.PathSeparator) + sourceName)
+	walkPath, err := filepath.EvalSymlinks(FilesFeedDir(dataDir, sourceName))
 	if err != nil {
 		return nil, err
 	}
@@ -477,3 +521,53 @@ func FilesPathToPartition(h hash.Hash32,
 	i := h.Sum32() % uint32(len(partitions))
 	return partitions[i]
 }
+
+// -----------------------------------------------------
+
+// FilesFeedDir returns the directory of the subdirectory tree that's
+// the data source of a FilesFeed.
+func FilesFeedDir(dataDir, sourceName string) string {
+	return dataDir +
+		string(os.PathSeparator) + "files" +
+		string(os.PathSeparator) + sourceName
+}
+
+// FilesSubdirs returns the sorted names of the top-level
+// subdirectories of a FilesFeed's subdirectory tree.  Names that
+// can't be used as a partition, such as those with a comma, are
+// skipped.
+func FilesSubdirs(dataDir, sourceName string) ([]string, error) {
+	if strings.Index(sourceName, "..") >= 0 {
+		return nil, fmt.Errorf("feed_files: disallowed source name,"+
+			" sourceName: %q", sourceName)
+	}
+
+	fis, err := ioutil.ReadDir(FilesFeedDir(dataDir, sourceName))
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() && !strings.ContainsAny(fi.Name(), ",") {
+			rv = append(rv, fi.Name())
+		}
+	}
+	return rv, nil
+}
+
+// FilesPathToSubdir returns the top-level subdirectory of a path
+// within a root directory, which is the partition of the path when
+// partitioning by subdirectory.  An empty string is returned for
+// paths that aren't within a subdirectory of the root.
+func FilesPathToSubdir(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	if len(parts) < 2 || parts[0] == ".." {
+		return ""
+	}
+	return parts[0]
+}
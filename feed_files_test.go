@@ -16,6 +16,7 @@ import (
 	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"sort"
 	"testing"
 	"time"
@@ -215,6 +216,52 @@ func TestFilesFeedPartitions(t *testing.T) {
 	}
 }
 
+func TestFilesFeedPartitionsBySubdir(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	sourceParams := `{"partitionBySubdir":true}`
+
+	_, err := FilesFeedPartitions("files", "s", "", sourceParams, "", nil)
+	if err == nil {
+		t.Errorf("expected err with no dataDir option")
+	}
+
+	options := map[string]string{"dataDir": testDir}
+
+	_, err = FilesFeedPartitions("files", "s", "", sourceParams, "", options)
+	if err == nil {
+		t.Errorf("expected err with no source dir")
+	}
+
+	for _, dir := range []string{"b", "a", "c,d"} {
+		os.MkdirAll(testDir+"/files/s/"+dir, 0700)
+	}
+	ioutil.WriteFile(testDir+"/files/s/top.txt", []byte("hi"), 0600)
+
+	partitions, err := FilesFeedPartitions("files", "s", "",
+		sourceParams, "", options)
+	if err != nil || !reflect.DeepEqual(partitions, []string{"a", "b"}) {
+		t.Errorf("expected subdir partitions, got: %v, err: %v",
+			partitions, err)
+	}
+}
+
+func TestFilesPathToSubdir(t *testing.T) {
+	tests := map[string]string{
+		"/r/a/x.txt":   "a",
+		"/r/a/b/x.txt": "a",
+		"/r/x.txt":     "",
+		"/other/x.txt": "",
+	}
+	for path, expected := range tests {
+		if got := FilesPathToSubdir("/r", path); got != expected {
+			t.Errorf("expected %q for path: %s, got: %q",
+				expected, path, got)
+		}
+	}
+}
+
 func TestFilesFeedDisabled(t *testing.T) {
 	params := ""
 	dests := map[string]Dest{}
@@ -0,0 +1,644 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build kafka
+// +build kafka
+
+// The kafka feed type is only built with the "kafka" build tag, like
+// "go build -tags kafka", so that applications that don't need it
+// don't depend on sarama.  The tested sarama version is pinned in
+// dist/kafka-manifest, which can be applied via dist/go-set-versions.
+
+package cbgt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/Shopify/sarama"
+)
+
+func init() {
+	RegisterFeedType("kafka", &FeedType{
+		Start:         StartKafkaFeed,
+		Partitions:    KafkaFeedPartitions,
+		PartitionSeqs: KafkaFeedPartitionSeqs,
+		Public:        true,
+		Description: "general/kafka" +
+			" - a Kafka topic will be the data source",
+		StartSample: &KafkaFeedParams{
+			Brokers:     []string{"localhost:9092"},
+			StartOffset: "oldest",
+		},
+	})
+}
+
+// KafkaFeed is a Feed interface implementation that emits the
+// messages of a Kafka topic, where each topic partition is a source
+// partition.  A message with a nil value is emitted as a deletion of
+// its key, following Kafka's log compaction convention.
+//
+// Offsets are managed by the KafkaFeed instead of by a Kafka consumer
+// group.  A message's seq is its offset + 1, so that seqs start at 1,
+// and a KafkaFeed resumes a partition from the lastSeq returned by
+// the partition's Dest.OpaqueGet().  The opaque value, which is set
+// via Dest.OpaqueSet() at the start of every snapshot, records the
+// topic, so that a Dest is rolled back if the topic is changed or
+// recreated.
+type KafkaFeed struct {
+	mgr       *Manager
+	name      string
+	indexName string
+	topic     string
+	params    *KafkaFeedParams
+	pf        DestPartitionFunc
+	dests     map[string]Dest
+	disable   bool
+	stats     *DestStats
+
+	m         sync.Mutex // Protects the fields that follow.
+	closed    bool
+	closeCh   chan struct{}
+	client    sarama.Client
+	consumer  sarama.Consumer
+	consumers []sarama.PartitionConsumer
+}
+
+// KafkaFeedParams represents the JSON expected as the sourceParams
+// for a KafkaFeed.
+type KafkaFeedParams struct {
+	Brokers []string `json:"brokers"`
+
+	// The topic, which defaults to the sourceName when empty.
+	Topic string `json:"topic,omitempty"`
+
+	ClientID string `json:"clientID,omitempty"`
+
+	// Where a partition is consumed from when its Dest has no
+	// previously persisted offset, either "oldest" (the default) or
+	// "newest".
+	StartOffset string `json:"startOffset,omitempty"`
+
+	TLS                   bool   `json:"tls,omitempty"`
+	TLSCAFile             string `json:"tlsCAFile,omitempty"`
+	TLSCertFile           string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile            string `json:"tlsKeyFile,omitempty"`
+	TLSInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify,omitempty"`
+
+	SASLUser     string `json:"saslUser,omitempty"`
+	SASLPassword string `json:"saslPassword,omitempty"`
+}
+
+// KafkaOpaque represents the opaque value that a KafkaFeed stores
+// via Dest.OpaqueSet() for a partition.
+type KafkaOpaque struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"` // Offset of the snapshot start.
+}
+
+// ParseKafkaFeedParams parses the sourceParams of a KafkaFeed.
+func ParseKafkaFeedParams(sourceName, paramsStr string) (
+	*KafkaFeedParams, error) {
+	params := &KafkaFeedParams{}
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, fmt.Errorf("feed_kafka: could not parse"+
+				" sourceParams: %s, err: %v", paramsStr, err)
+		}
+	}
+	if params.Topic == "" {
+		params.Topic = sourceName
+	}
+	if params.Topic == "" {
+		return nil, fmt.Errorf("feed_kafka: missing topic")
+	}
+	if len(params.Brokers) <= 0 {
+		return nil, fmt.Errorf("feed_kafka: missing brokers")
+	}
+	if params.StartOffset != "" &&
+		params.StartOffset != "oldest" && params.StartOffset != "newest" {
+		return nil, fmt.Errorf("feed_kafka: unknown startOffset: %q",
+			params.StartOffset)
+	}
+	return params, nil
+}
+
+// SaramaConfig returns the Kafka client config for the params.
+func (p *KafkaFeedParams) SaramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	if p.ClientID != "" {
+		config.ClientID = p.ClientID
+	}
+	config.Consumer.Return.Errors = true
+
+	if p.TLS {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: p.TLSInsecureSkipVerify,
+		}
+
+		if p.TLSCAFile != "" {
+			caCert, err := ioutil.ReadFile(p.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("feed_kafka: could not read"+
+					" tlsCAFile, err: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("feed_kafka: no certs in tlsCAFile")
+			}
+		}
+
+		if p.TLSCertFile != "" || p.TLSKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(p.TLSCertFile, p.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("feed_kafka: could not load"+
+					" tlsCertFile/tlsKeyFile, err: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if p.SASLUser != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = p.SASLUser
+		config.Net.SASL.Password = p.SASLPassword
+	}
+
+	return config, nil
+}
+
+// NewSaramaClient returns a connected Kafka client for the params.
+func (p *KafkaFeedParams) NewSaramaClient() (sarama.Client, error) {
+	config, err := p.SaramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewClient(p.Brokers, config)
+}
+
+// StartKafkaFeed starts a KafkaFeed and is the the callback function
+// registered at init/startup time.
+func StartKafkaFeed(mgr *Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, params string,
+	dests map[string]Dest) error {
+	feed, err := NewKafkaFeed(mgr, feedName, indexName, sourceName,
+		params, BasicPartitionFunc, dests,
+		mgr.tagsMap != nil && !mgr.tagsMap["feed"])
+	if err != nil {
+		return fmt.Errorf("feed_kafka: NewKafkaFeed,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = feed.Start()
+	if err != nil {
+		feed.Close()
+		return fmt.Errorf("feed_kafka: could not start,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = mgr.registerFeed(feed)
+	if err != nil {
+		feed.Close()
+		return err
+	}
+	return nil
+}
+
+// NewKafkaFeed creates a ready-to-be-started KafkaFeed.
+func NewKafkaFeed(mgr *Manager, name, indexName, sourceName,
+	paramsStr string, pf DestPartitionFunc, dests map[string]Dest,
+	disable bool) (*KafkaFeed, error) {
+	params, err := ParseKafkaFeedParams(sourceName, paramsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaFeed{
+		mgr:       mgr,
+		name:      name,
+		indexName: indexName,
+		topic:     params.Topic,
+		params:    params,
+		pf:        pf,
+		dests:     dests,
+		disable:   disable,
+		stats:     NewDestStats(),
+		closeCh:   make(chan struct{}),
+	}, nil
+}
+
+func (t *KafkaFeed) Name() string {
+	return t.name
+}
+
+func (t *KafkaFeed) IndexName() string {
+	return t.indexName
+}
+
+func (t *KafkaFeed) Start() error {
+	if t.disable {
+		log.Printf("feed_kafka: disable, name: %s", t.Name())
+		return nil
+	}
+
+	client, err := t.params.NewSaramaClient()
+	if err != nil {
+		return err
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		consumer.Close()
+		client.Close()
+		return nil
+	}
+	t.client = client
+	t.consumer = consumer
+	t.m.Unlock()
+
+	partitions, err := t.partitions(client)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		err = t.startPartition(client, consumer, partition)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("feed_kafka: start, name: %s, topic: %s, partitions: %v",
+		t.Name(), t.topic, partitions)
+
+	return nil
+}
+
+// partitions returns the topic partitions that the feed's dests
+// cover, where a "" dest covers all the topic's partitions.
+func (t *KafkaFeed) partitions(client sarama.Client) ([]int32, error) {
+	if _, exists := t.dests[""]; exists {
+		return client.Partitions(t.topic)
+	}
+
+	rv := make([]int32, 0, len(t.dests))
+	for partition := range t.dests {
+		p, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("feed_kafka: could not parse"+
+				" partition: %q, err: %v", partition, err)
+		}
+		rv = append(rv, int32(p))
+	}
+	sort.Sort(int32s(rv))
+
+	return rv, nil
+}
+
+// startPartition starts consuming a topic partition from the offset
+// after the Dest's lastSeq.
+func (t *KafkaFeed) startPartition(client sarama.Client,
+	consumer sarama.Consumer, p int32) error {
+	partition := strconv.Itoa(int(p))
+
+	dest, err := t.pf(partition, nil, t.dests)
+	if err != nil {
+		return err
+	}
+
+	var opaqueValue []byte
+	var lastSeq uint64
+
+	err = Timer(func() error {
+		opaqueValue, lastSeq, err = dest.OpaqueGet(partition)
+		return err
+	}, t.stats.TimerOpaqueGet)
+	if err != nil {
+		return err
+	}
+
+	oldest, err := client.GetOffset(t.topic, p, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	newest, err := client.GetOffset(t.topic, p, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+
+	if len(opaqueValue) > 0 {
+		opaque := KafkaOpaque{}
+		err = json.Unmarshal(opaqueValue, &opaque)
+		if err != nil || opaque.Topic != t.topic ||
+			int64(lastSeq) > newest {
+			// The topic changed, or was recreated with fewer messages,
+			// so the Dest's data is no longer valid.
+			log.Printf("feed_kafka: rollback, name: %s, partition: %s,"+
+				" opaqueValue: %s, lastSeq: %d, newest: %d",
+				t.name, partition, opaqueValue, lastSeq, newest)
+
+			return Timer(func() error {
+				err := dest.Rollback(partition, 0)
+				if err == nil && t.mgr != nil {
+					t.mgr.emitRollbackEvent(t.name, dest, partition, 0)
+				}
+				return err
+			}, t.stats.TimerRollback)
+		}
+	}
+
+	offset := oldest
+	if len(opaqueValue) > 0 || lastSeq > 0 {
+		offset = int64(lastSeq)
+		if offset < oldest {
+			// Messages were removed by the topic's retention.
+			offset = oldest
+		}
+	} else if t.params.StartOffset == "newest" {
+		offset = newest
+	}
+
+	pc, err := consumer.ConsumePartition(t.topic, p, offset)
+	if err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		pc.Close()
+		return nil
+	}
+	t.consumers = append(t.consumers, pc)
+	t.m.Unlock()
+
+	go t.consumePartition(pc, partition, p)
+
+	return nil
+}
+
+// consumePartition emits a topic partition's messages to its Dest
+// until the feed is closed.
+func (t *KafkaFeed) consumePartition(pc sarama.PartitionConsumer,
+	partition string, p int32) {
+	var snapEnd uint64
+
+	errorsCh := pc.Errors()
+
+	for {
+		select {
+		case <-t.closeCh:
+			return
+
+		case consumerErr, ok := <-errorsCh:
+			if !ok {
+				errorsCh = nil // Keep draining messages until closed.
+				continue
+			}
+			t.onError(consumerErr.Err)
+
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return
+			}
+
+			seq := uint64(msg.Offset + 1)
+			if seq > snapEnd {
+				snapEnd = uint64(pc.HighWaterMarkOffset())
+				if snapEnd < seq {
+					snapEnd = seq
+				}
+
+				err := t.snapshotStart(partition, p, seq, snapEnd)
+				if err != nil {
+					t.onError(err)
+					return
+				}
+			}
+
+			err := t.dataMessage(partition, msg, seq)
+			if err != nil {
+				t.onError(err)
+				return
+			}
+		}
+	}
+}
+
+func (t *KafkaFeed) snapshotStart(partition string, p int32,
+	snapStart, snapEnd uint64) error {
+	return Timer(func() error {
+		dest, err := t.pf(partition, nil, t.dests)
+		if err != nil {
+			return err
+		}
+
+		err = dest.SnapshotStart(partition, snapStart, snapEnd)
+		if err != nil {
+			return err
+		}
+
+		opaqueValue, err := json.Marshal(&KafkaOpaque{
+			Topic:     t.topic,
+			Partition: p,
+			Offset:    int64(snapStart) - 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		return dest.OpaqueSet(partition, opaqueValue)
+	}, t.stats.TimerSnapshotStart)
+}
+
+func (t *KafkaFeed) dataMessage(partition string,
+	msg *sarama.ConsumerMessage, seq uint64) error {
+	key := msg.Key
+	if key == nil {
+		key = []byte(fmt.Sprintf("%s-%s-%d", t.topic, partition, msg.Offset))
+	}
+
+	dest, err := t.pf(partition, key, t.dests)
+	if err != nil {
+		return err
+	}
+
+	if msg.Value == nil {
+		err = Timer(func() error {
+			return dest.DataDelete(partition, key, seq,
+				0, DEST_EXTRAS_TYPE_NIL, nil)
+		}, t.stats.TimerDataDelete)
+	} else {
+		err = Timer(func() error {
+			return dest.DataUpdate(partition, key, seq, msg.Value,
+				0, DEST_EXTRAS_TYPE_NIL, nil)
+		}, t.stats.TimerDataUpdate)
+	}
+	if err != nil {
+		return fmt.Errorf("feed_kafka: data message, name: %s,"+
+			" partition: %s, key: %s, seq: %d, err: %v",
+			t.name, partition, key, seq, err)
+	}
+
+	return nil
+}
+
+func (t *KafkaFeed) onError(err error) {
+	log.Printf("feed_kafka: onError, name: %s, topic: %s, err: %v",
+		t.name, t.topic, err)
+
+	atomic.AddUint64(&t.stats.TotError, 1)
+	if t.mgr != nil && t.mgr.meh != nil {
+		go t.mgr.meh.OnFeedError("kafka", t, err)
+	}
+	if t.mgr != nil {
+		t.mgr.EmitEvent(ManagerEvent{
+			Kind:      MANAGER_EVENT_FEED_ERROR,
+			IndexName: t.indexName,
+			FeedName:  t.name,
+			Err:       err.Error(),
+		})
+	}
+}
+
+func (t *KafkaFeed) Close() error {
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closeCh)
+	consumers, consumer, client := t.consumers, t.consumer, t.client
+	t.m.Unlock()
+
+	log.Printf("feed_kafka: close, name: %s", t.Name())
+
+	for _, pc := range consumers {
+		pc.AsyncClose()
+	}
+	if consumer != nil {
+		consumer.Close()
+	}
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+func (t *KafkaFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+var prefixKafkaDestStats = []byte(`{"destStats":`)
+
+// ErrorCount returns the number of errors seen by the feed.
+func (t *KafkaFeed) ErrorCount() uint64 {
+	return atomic.LoadUint64(&t.stats.TotError)
+}
+
+func (t *KafkaFeed) Stats(w io.Writer) error {
+	w.Write(prefixKafkaDestStats)
+	t.stats.WriteJSON(w)
+	_, err := w.Write(JsonCloseBrace)
+	return err
+}
+
+// -----------------------------------------------------
+
+// KafkaFeedPartitions returns the partitions of a Kafka topic.
+func KafkaFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
+	server string, options map[string]string) ([]string, error) {
+	params, err := ParseKafkaFeedParams(sourceName, sourceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := params.NewSaramaClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(params.Topic)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(int32s(partitions))
+
+	rv := make([]string, len(partitions))
+	for i, p := range partitions {
+		rv[i] = strconv.Itoa(int(p))
+	}
+	return rv, nil
+}
+
+// KafkaFeedPartitionSeqs returns the current seq of each partition
+// of a Kafka topic, which is the partition's newest offset, as the
+// seq of a message is its offset + 1.
+func KafkaFeedPartitionSeqs(sourceType, sourceName, sourceUUID,
+	sourceParams, server string, options map[string]string) (
+	map[string]UUIDSeq, error) {
+	params, err := ParseKafkaFeedParams(sourceName, sourceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := params.NewSaramaClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(params.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]UUIDSeq{}
+	for _, p := range partitions {
+		newest, err := client.GetOffset(params.Topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		rv[strconv.Itoa(int(p))] = UUIDSeq{
+			UUID: params.Topic,
+			Seq:  uint64(newest),
+		}
+	}
+	return rv, nil
+}
+
+type int32s []int32
+
+func (a int32s) Len() int           { return len(a) }
+func (a int32s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int32s) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,165 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+//go:build kafka
+// +build kafka
+
+package cbgt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+type TestPartitionConsumer struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+	hwm      int64
+}
+
+func (t *TestPartitionConsumer) AsyncClose() {
+	close(t.messages)
+	close(t.errors)
+}
+
+func (t *TestPartitionConsumer) Close() error {
+	t.AsyncClose()
+	return nil
+}
+
+func (t *TestPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return t.messages
+}
+
+func (t *TestPartitionConsumer) Errors() <-chan *sarama.ConsumerError {
+	return t.errors
+}
+
+func (t *TestPartitionConsumer) HighWaterMarkOffset() int64 {
+	return t.hwm
+}
+
+func (t *TestPartitionConsumer) Pause() {}
+
+func (t *TestPartitionConsumer) Resume() {}
+
+func (t *TestPartitionConsumer) IsPaused() bool {
+	return false
+}
+
+func TestParseKafkaFeedParams(t *testing.T) {
+	params, err := ParseKafkaFeedParams("events",
+		`{"brokers":["a:9092"],"saslUser":"u","saslPassword":"p"}`)
+	if err != nil || params.Topic != "events" {
+		t.Errorf("expected topic from sourceName, got: %#v, err: %v",
+			params, err)
+	}
+
+	config, err := params.SaramaConfig()
+	if err != nil || !config.Net.SASL.Enable ||
+		config.Net.SASL.User != "u" || config.Net.TLS.Enable ||
+		!config.Consumer.Return.Errors {
+		t.Errorf("expected SASL config, got: %#v, err: %v", config, err)
+	}
+
+	params, err = ParseKafkaFeedParams("events",
+		`{"brokers":["a:9092"],"topic":"other","tls":true}`)
+	if err != nil || params.Topic != "other" {
+		t.Errorf("expected topic param, got: %#v, err: %v", params, err)
+	}
+	config, err = params.SaramaConfig()
+	if err != nil || !config.Net.TLS.Enable || config.Net.SASL.Enable {
+		t.Errorf("expected TLS config, got: %#v, err: %v", config, err)
+	}
+
+	params.TLSCAFile = "./not-a-file"
+	if _, err = params.SaramaConfig(); err == nil {
+		t.Errorf("expected err on missing tlsCAFile")
+	}
+
+	bad := []string{
+		`{"brokers":["a:9092"]}`,
+		`{"topic":"t"}`,
+		`{"brokers":["a:9092"],"topic":"t","startOffset":"middle"}`,
+		`not json`,
+	}
+	for _, paramsStr := range bad {
+		if _, err = ParseKafkaFeedParams("", paramsStr); err == nil {
+			t.Errorf("expected err on params: %s", paramsStr)
+		}
+	}
+}
+
+func TestKafkaFeedConsumePartition(t *testing.T) {
+	dest := &TestRecordDest{}
+
+	feed, err := NewKafkaFeed(nil, "f", "i", "events",
+		`{"brokers":["a:9092"]}`, BasicPartitionFunc,
+		map[string]Dest{"3": dest, "1": dest}, false)
+	if err != nil {
+		t.Fatalf("expected NewKafkaFeed() to work, err: %v", err)
+	}
+
+	partitions, err := feed.partitions(nil)
+	if err != nil || !reflect.DeepEqual(partitions, []int32{1, 3}) {
+		t.Errorf("expected sorted dest partitions, got: %v, err: %v",
+			partitions, err)
+	}
+
+	pc := &TestPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 10),
+		errors:   make(chan *sarama.ConsumerError, 10),
+		hwm:      12,
+	}
+	pc.messages <- &sarama.ConsumerMessage{
+		Key: []byte("a"), Value: []byte("va"), Partition: 3, Offset: 10,
+	}
+	pc.messages <- &sarama.ConsumerMessage{
+		Key: []byte("a"), Value: nil, Partition: 3, Offset: 11,
+	}
+	pc.messages <- &sarama.ConsumerMessage{
+		Value: []byte("vb"), Partition: 3, Offset: 12,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		feed.consumePartition(pc, "3", 3)
+		close(done)
+	}()
+
+	pc.AsyncClose()
+	<-done
+
+	expected := []string{
+		"snapshot 3 11 12",
+		"update 3 a 11 va",
+		"delete 3 a 12",
+		"snapshot 3 13 13",
+		"update 3 events-3-12 13 vb",
+	}
+	if !reflect.DeepEqual(dest.events, expected) {
+		t.Errorf("expected events: %#v, got: %#v", expected, dest.events)
+	}
+
+	opaque := KafkaOpaque{}
+	err = json.Unmarshal(dest.opaque, &opaque)
+	if err != nil || opaque.Topic != "events" ||
+		opaque.Partition != 3 || opaque.Offset != 12 {
+		t.Errorf("expected opaque, got: %s, err: %v", dest.opaque, err)
+	}
+
+	if err = feed.Close(); err != nil {
+		t.Errorf("expected Close() to work, err: %v", err)
+	}
+}
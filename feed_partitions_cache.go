@@ -0,0 +1,96 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync"
+	"time"
+)
+
+// The planner asks for the partitions of the data source of every
+// index on every planning pass, which for some source types, like
+// couchbase, means a round trip to the cluster.  Successfully
+// retrieved partitions can be cached by DataSourcePartitions() to
+// reduce that load, controlled by the option:
+//
+// * dataSourcePartitionsCacheTTL - how long cached partitions are
+//   used, like "1m"; caching is disabled when empty.
+//
+// The source watcher (see SourceWatchOnce()) invalidates the cached
+// partitions of a data source when it sees them change.
+
+type dataSourcePartitionsKey struct {
+	sourceType   string
+	sourceName   string
+	sourceUUID   string
+	sourceParams string
+	server       string
+}
+
+type dataSourcePartitionsEntry struct {
+	partitions []string
+	expires    time.Time
+}
+
+var dataSourcePartitionsCacheM sync.Mutex // Protects the cache.
+var dataSourcePartitionsCache = map[dataSourcePartitionsKey]*dataSourcePartitionsEntry{}
+
+func dataSourcePartitionsCacheTTL(options map[string]string) time.Duration {
+	v := options["dataSourcePartitionsCacheTTL"]
+	if v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func dataSourcePartitionsCacheGet(k dataSourcePartitionsKey) (
+	[]string, bool) {
+	dataSourcePartitionsCacheM.Lock()
+	defer dataSourcePartitionsCacheM.Unlock()
+
+	e := dataSourcePartitionsCache[k]
+	if e == nil {
+		return nil, false
+	}
+	if !e.expires.After(time.Now()) {
+		delete(dataSourcePartitionsCache, k)
+		return nil, false
+	}
+
+	return append([]string(nil), e.partitions...), true
+}
+
+func dataSourcePartitionsCachePut(k dataSourcePartitionsKey,
+	partitions []string, ttl time.Duration) {
+	dataSourcePartitionsCacheM.Lock()
+	dataSourcePartitionsCache[k] = &dataSourcePartitionsEntry{
+		partitions: append([]string(nil), partitions...),
+		expires:    time.Now().Add(ttl),
+	}
+	dataSourcePartitionsCacheM.Unlock()
+}
+
+// InvalidateDataSourcePartitions removes the cached partitions of a
+// data source, whatever its sourceUUID, sourceParams or server, so
+// that the next DataSourcePartitions() retrieves them again.
+func InvalidateDataSourcePartitions(sourceType, sourceName string) {
+	dataSourcePartitionsCacheM.Lock()
+	for k := range dataSourcePartitionsCache {
+		if k.sourceType == sourceType && k.sourceName == sourceName {
+			delete(dataSourcePartitionsCache, k)
+		}
+	}
+	dataSourcePartitionsCacheM.Unlock()
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+var testPartitionsCacheCalls uint64
+
+func init() {
+	RegisterFeedType("testPartitionsCache", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			n := atomic.AddUint64(&testPartitionsCacheCalls, 1)
+			if sourceName == "bad" {
+				return nil, fmt.Errorf("bad source")
+			}
+			return []string{fmt.Sprintf("%d", n)}, nil
+		},
+	})
+}
+
+func TestDataSourcePartitionsCache(t *testing.T) {
+	get := func(sourceName string, options map[string]string) []string {
+		partitions, _ := DataSourcePartitions("testPartitionsCache",
+			sourceName, "", "", "", options)
+		return partitions
+	}
+
+	// Without the option, there's no caching.
+	p0 := get("a", nil)
+	p1 := get("a", nil)
+	if reflect.DeepEqual(p0, p1) {
+		t.Errorf("expected uncached partitions, got: %v, %v", p0, p1)
+	}
+
+	options := map[string]string{"dataSourcePartitionsCacheTTL": "1h"}
+
+	p0 = get("a", options)
+	p0[0] = "mutated"
+	p1 = get("a", options)
+	if p1[0] == "mutated" || !reflect.DeepEqual(p1, get("a", options)) {
+		t.Errorf("expected cached partitions, got: %v", p1)
+	}
+
+	InvalidateDataSourcePartitions("testPartitionsCache", "a")
+
+	p2 := get("a", options)
+	if reflect.DeepEqual(p1, p2) {
+		t.Errorf("expected invalidated partitions, got: %v, %v", p1, p2)
+	}
+
+	// Errors aren't cached.
+	calls := atomic.LoadUint64(&testPartitionsCacheCalls)
+	get("bad", options)
+	get("bad", options)
+	if atomic.LoadUint64(&testPartitionsCacheCalls) != calls+2 {
+		t.Errorf("expected errors to not be cached")
+	}
+
+	// Expired entries aren't used.
+	options = map[string]string{"dataSourcePartitionsCacheTTL": "1ns"}
+	p0 = get("b", options)
+	p1 = get("b", options)
+	if reflect.DeepEqual(p0, p1) {
+		t.Errorf("expected expired partitions, got: %v, %v", p0, p1)
+	}
+}
@@ -0,0 +1,405 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+func init() {
+	RegisterFeedType("push", &FeedType{
+		Start:      StartPushFeed,
+		Partitions: PushFeedPartitions,
+		Public:     true,
+		Description: "general/push" +
+			" - mutations are pushed by applications via REST" +
+			" to /api/pindex/{pindexName}/ingest",
+		StartSample: &PushFeedParams{},
+	})
+}
+
+// PushFeed is a Feed interface implementation that does not pull
+// from a data source, but instead forwards batches of mutations that
+// are pushed to it, such as via the REST ingest endpoint of a pindex,
+// to its Dest instances.  It allows applications that do not speak
+// DCP to feed an index directly.
+//
+// The pushed seq numbers are expected to increase per partition.  A
+// mutation whose seq is not greater than the partition's last seq is
+// skipped, so that a client may safely retry a batch.  A mutation
+// with a seq of 0 is assigned the partition's next seq.
+type PushFeed struct {
+	name      string
+	indexName string
+	params    *PushFeedParams
+	dests     map[string]Dest
+	disable   bool
+
+	m          sync.Mutex // Protects the fields that follow.
+	closed     bool
+	partitions []string          // Sorted partitions of the dests.
+	seqs       map[string]uint64 // Keyed by partition, the last seq.
+
+	keyPartitions []string // All of the source's partitions, for keys.
+
+	totIngested uint64
+	totSkipped  uint64
+}
+
+// PushFeedParams represents the JSON expected as the sourceParams
+// for a PushFeed.
+type PushFeedParams struct {
+	NumPartitions int `json:"numPartitions"`
+}
+
+// PushMutation represents a single mutation that's pushed to a
+// PushFeed.  The Partition is optional, and when empty the mutation
+// is assigned to a partition by hashing its Key over all of the
+// source's partitions, so that a key maps to the same partition no
+// matter which pindex receives it.
+type PushMutation struct {
+	Partition string          `json:"partition,omitempty"`
+	Key       string          `json:"key"`
+	Val       json.RawMessage `json:"val,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Delete    bool            `json:"delete,omitempty"`
+}
+
+// PushIngestResult summarizes the outcome of PushFeed.Ingest().
+type PushIngestResult struct {
+	Ingested int `json:"ingested"`
+	Skipped  int `json:"skipped"`
+}
+
+// StartPushFeed starts a PushFeed and is the the callback function
+// registered at init/startup time.
+func StartPushFeed(mgr *Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, params string,
+	dests map[string]Dest) error {
+	feed, err := NewPushFeed(feedName, indexName, params, dests,
+		mgr.tagsMap != nil && !mgr.tagsMap["feed"])
+	if err != nil {
+		return fmt.Errorf("feed_push: NewPushFeed,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = feed.Start()
+	if err != nil {
+		return fmt.Errorf("feed_push: could not start,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = mgr.registerFeed(feed)
+	if err != nil {
+		feed.Close()
+		return err
+	}
+	return nil
+}
+
+// NewPushFeed creates a ready-to-be-started PushFeed.
+func NewPushFeed(name, indexName, paramsStr string,
+	dests map[string]Dest, disable bool) (*PushFeed, error) {
+	params := &PushFeedParams{}
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	partitions := make([]string, 0, len(dests))
+	for partition := range dests {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+
+	keyPartitions := partitions
+	if params.NumPartitions > 0 {
+		keyPartitions = make([]string, params.NumPartitions)
+		for i := range keyPartitions {
+			keyPartitions[i] = strconv.Itoa(i)
+		}
+	}
+
+	return &PushFeed{
+		name:          name,
+		indexName:     indexName,
+		params:        params,
+		dests:         dests,
+		disable:       disable,
+		partitions:    partitions,
+		seqs:          map[string]uint64{},
+		keyPartitions: keyPartitions,
+	}, nil
+}
+
+func (t *PushFeed) Name() string {
+	return t.name
+}
+
+func (t *PushFeed) IndexName() string {
+	return t.indexName
+}
+
+// Start initializes the last seq of each partition from its Dest, so
+// that pushed mutations which were already ingested are skipped.
+func (t *PushFeed) Start() error {
+	if t.disable {
+		log.Printf("feed_push: disable, name: %s", t.Name())
+		return nil
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for partition, dest := range t.dests {
+		_, lastSeq, err := dest.OpaqueGet(partition)
+		if err != nil {
+			return fmt.Errorf("feed_push: OpaqueGet,"+
+				" name: %s, partition: %s, err: %v",
+				t.Name(), partition, err)
+		}
+		t.seqs[partition] = lastSeq
+	}
+
+	return nil
+}
+
+func (t *PushFeed) Close() error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *PushFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+func (t *PushFeed) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"totIngested":%d,"totSkipped":%d}`,
+		atomic.LoadUint64(&t.totIngested),
+		atomic.LoadUint64(&t.totSkipped))
+	return err
+}
+
+// Ingest forwards a batch of mutations to the feed's Dest instances,
+// restricted to the given source partitions (or to all the feed's
+// partitions when sourcePartitions is nil).  A batch with a mutation
+// whose partition, including a partition hashed from its key, is
+// outside of those partitions is rejected.  Each partition that
+// receives mutations gets a single snapshot that spans the
+// partition's seqs in the batch.
+func (t *PushFeed) Ingest(sourcePartitions map[string]bool,
+	mutations []PushMutation) (*PushIngestResult, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.disable || t.closed {
+		return nil, fmt.Errorf("feed_push: not ingesting, name: %s",
+			t.Name())
+	}
+
+	partitions := t.partitions
+	if sourcePartitions != nil {
+		partitions = make([]string, 0, len(sourcePartitions))
+		for _, partition := range t.partitions {
+			if sourcePartitions[partition] {
+				partitions = append(partitions, partition)
+			}
+		}
+	}
+	if len(partitions) <= 0 {
+		return nil, fmt.Errorf("feed_push: no partitions, name: %s",
+			t.Name())
+	}
+
+	// Validate and assign partitions and seqs for the whole batch
+	// before sending anything, so that a bad batch has no effect.
+	h := crc32.NewIEEE()
+
+	seqs := map[string]uint64{}
+	for partition, seq := range t.seqs {
+		seqs[partition] = seq
+	}
+
+	snapStarts := map[string]uint64{}
+	snapEnds := map[string]uint64{}
+
+	batch := make([]PushMutation, 0, len(mutations))
+
+	for i, mutation := range mutations {
+		if mutation.Key == "" {
+			return nil, fmt.Errorf("feed_push: missing key,"+
+				" name: %s, mutation: %d", t.Name(), i)
+		}
+
+		if mutation.Partition == "" {
+			mutation.Partition = FilesPathToPartition(h,
+				t.keyPartitions, mutation.Key)
+			if t.dests[mutation.Partition] == nil ||
+				(sourcePartitions != nil && !sourcePartitions[mutation.Partition]) {
+				return nil, fmt.Errorf("feed_push: key's partition is not local,"+
+					" name: %s, mutation: %d, key: %s, partition: %s",
+					t.Name(), i, mutation.Key, mutation.Partition)
+			}
+		} else if t.dests[mutation.Partition] == nil ||
+			(sourcePartitions != nil && !sourcePartitions[mutation.Partition]) {
+			return nil, fmt.Errorf("feed_push: unknown partition,"+
+				" name: %s, mutation: %d, partition: %s",
+				t.Name(), i, mutation.Partition)
+		}
+
+		if mutation.Seq == 0 {
+			mutation.Seq = seqs[mutation.Partition] + 1
+		} else if mutation.Seq <= seqs[mutation.Partition] {
+			continue
+		}
+		seqs[mutation.Partition] = mutation.Seq
+
+		if _, exists := snapStarts[mutation.Partition]; !exists {
+			snapStarts[mutation.Partition] = mutation.Seq
+		}
+		snapEnds[mutation.Partition] = mutation.Seq
+
+		batch = append(batch, mutation)
+	}
+
+	rv := &PushIngestResult{Skipped: len(mutations) - len(batch)}
+
+	atomic.AddUint64(&t.totSkipped, uint64(rv.Skipped))
+
+	snapshotSent := map[string]bool{}
+
+	for _, mutation := range batch {
+		partition := mutation.Partition
+		dest := t.dests[partition]
+
+		if !snapshotSent[partition] {
+			err := dest.SnapshotStart(partition,
+				snapStarts[partition], snapEnds[partition])
+			if err != nil {
+				return rv, fmt.Errorf("feed_push: SnapshotStart,"+
+					" name: %s, partition: %s, err: %v",
+					t.Name(), partition, err)
+			}
+
+			snapshotSent[partition] = true
+		}
+
+		var err error
+		if mutation.Delete {
+			err = dest.DataDelete(partition, []byte(mutation.Key),
+				mutation.Seq, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		} else {
+			err = dest.DataUpdate(partition, []byte(mutation.Key),
+				mutation.Seq, mutation.Val, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		}
+		if err != nil {
+			return rv, fmt.Errorf("feed_push: data,"+
+				" name: %s, partition: %s, key: %s, seq: %d, err: %v",
+				t.Name(), partition, mutation.Key, mutation.Seq, err)
+		}
+
+		t.seqs[partition] = mutation.Seq
+
+		rv.Ingested++
+
+		atomic.AddUint64(&t.totIngested, 1)
+	}
+
+	return rv, nil
+}
+
+// -----------------------------------------------------
+
+// PushFeedPartitions returns the partitions, controlled by
+// PushFeedParams.NumPartitions, for a PushFeed instance.
+func PushFeedPartitions(sourceType, sourceName, sourceUUID, sourceParams,
+	server string, options map[string]string) ([]string, error) {
+	pfp := &PushFeedParams{}
+	if sourceParams != "" {
+		err := json.Unmarshal([]byte(sourceParams), pfp)
+		if err != nil {
+			return nil, fmt.Errorf("feed_push:"+
+				" could not parse sourceParams: %s, err: %v",
+				sourceParams, err)
+		}
+	}
+	rv := make([]string, pfp.NumPartitions)
+	for i := 0; i < pfp.NumPartitions; i++ {
+		rv[i] = strconv.Itoa(i)
+	}
+	return rv, nil
+}
+
+// -----------------------------------------------------
+
+// PushIngest forwards a batch of mutations to the PushFeed of a
+// pindex on this node, restricted to the pindex's source partitions.
+func (mgr *Manager) PushIngest(pindexName string,
+	mutations []PushMutation) (*PushIngestResult, error) {
+	return mgr.PushIngestCtx(context.Background(), pindexName, mutations)
+}
+
+// PushIngestCtx is like PushIngest, but traces the batch as a child
+// of the ctx, such as for the request ID of a REST request.
+func (mgr *Manager) PushIngestCtx(ctx context.Context, pindexName string,
+	mutations []PushMutation) (rv *PushIngestResult, err error) {
+	_, span := mgr.StartTraceSpan(ctx, "cbgt.feed.ingest")
+	span.SetTag("pindexName", pindexName)
+	span.SetTag("numMutations", len(mutations))
+	defer func() { span.Finish(err) }()
+
+	defer mgr.timers.TimerFeedBatch.UpdateSince(time.Now())
+
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return nil, fmt.Errorf("feed_push: no pindex, pindexName: %s",
+			pindexName)
+	}
+
+	if pindex.SourceType != "push" {
+		return nil, fmt.Errorf("feed_push: pindex sourceType is not push,"+
+			" pindexName: %s, sourceType: %s",
+			pindexName, pindex.SourceType)
+	}
+
+	feedName := FeedNameForPIndex(pindex,
+		mgr.GetOptions()[FeedAllotmentOption])
+
+	feeds, _ := mgr.CurrentMaps()
+
+	feed, ok := feeds[feedName].(*PushFeed)
+	if !ok {
+		return nil, fmt.Errorf("feed_push: no push feed,"+
+			" pindexName: %s, feedName: %s", pindexName, feedName)
+	}
+
+	var sourcePartitions map[string]bool
+	if pindex.SourcePartitions != "" {
+		sourcePartitions = pindex.sourcePartitionsMap
+	}
+
+	return feed.Ingest(sourcePartitions, mutations)
+}
@@ -0,0 +1,226 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestRecordDest is a Dest that records the mutations it receives.
+type TestRecordDest struct {
+	BlackHole
+
+	m      sync.Mutex
+	events []string
+	opaque []byte
+}
+
+func (t *TestRecordDest) record(event string) {
+	t.m.Lock()
+	t.events = append(t.events, event)
+	t.m.Unlock()
+}
+
+func (t *TestRecordDest) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	t.record(fmt.Sprintf("update %s %s %d %s", partition, key, seq, val))
+	return nil
+}
+
+func (t *TestRecordDest) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	t.record(fmt.Sprintf("delete %s %s %d", partition, key, seq))
+	return nil
+}
+
+func (t *TestRecordDest) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	t.record(fmt.Sprintf("snapshot %s %d %d", partition, snapStart, snapEnd))
+	return nil
+}
+
+func (t *TestRecordDest) OpaqueSet(partition string, value []byte) error {
+	t.m.Lock()
+	t.opaque = append([]byte(nil), value...)
+	t.m.Unlock()
+	return nil
+}
+
+func TestPushFeedPartitions(t *testing.T) {
+	partitions, err := PushFeedPartitions("push", "s", "", "",
+		"", nil)
+	if err != nil || len(partitions) != 0 {
+		t.Errorf("expected no partitions, got: %v, err: %v",
+			partitions, err)
+	}
+
+	partitions, err = PushFeedPartitions("push", "s", "",
+		`{"numPartitions":2}`, "", nil)
+	if err != nil || !reflect.DeepEqual(partitions, []string{"0", "1"}) {
+		t.Errorf("expected 2 partitions, got: %v, err: %v",
+			partitions, err)
+	}
+
+	_, err = PushFeedPartitions("push", "s", "", "not json", "", nil)
+	if err == nil {
+		t.Errorf("expected bad sourceParams to fail")
+	}
+}
+
+func TestPushFeedIngest(t *testing.T) {
+	dest := &TestRecordDest{}
+
+	feed, err := NewPushFeed("f", "i", `{"numPartitions":2}`,
+		map[string]Dest{"0": dest, "1": dest}, false)
+	if err != nil {
+		t.Fatalf("expected NewPushFeed() to work, err: %v", err)
+	}
+	if err = feed.Start(); err != nil {
+		t.Fatalf("expected Start() to work, err: %v", err)
+	}
+
+	_, err = feed.Ingest(nil, []PushMutation{{Partition: "0"}})
+	if err == nil {
+		t.Errorf("expected missing key to fail")
+	}
+	_, err = feed.Ingest(nil, []PushMutation{{Partition: "9", Key: "a"}})
+	if err == nil {
+		t.Errorf("expected unknown partition to fail")
+	}
+	_, err = feed.Ingest(map[string]bool{"1": true},
+		[]PushMutation{{Partition: "0", Key: "a"}})
+	if err == nil {
+		t.Errorf("expected partition outside of sourcePartitions to fail")
+	}
+	if len(dest.events) != 0 {
+		t.Errorf("expected failed batches to have no events, got: %#v",
+			dest.events)
+	}
+
+	result, err := feed.Ingest(nil, []PushMutation{
+		{Partition: "0", Key: "a", Val: []byte(`{"x":1}`), Seq: 10},
+		{Partition: "0", Key: "b", Val: []byte(`{"x":2}`)},
+		{Partition: "0", Key: "a", Delete: true, Seq: 20},
+		{Partition: "1", Key: "c", Val: []byte(`{}`)},
+	})
+	if err != nil || result.Ingested != 4 || result.Skipped != 0 {
+		t.Errorf("expected ingest to work, result: %#v, err: %v",
+			result, err)
+	}
+
+	expected := []string{
+		"snapshot 0 10 20",
+		`update 0 a 10 {"x":1}`,
+		`update 0 b 11 {"x":2}`,
+		"delete 0 a 20",
+		"snapshot 1 1 1",
+		"update 1 c 1 {}",
+	}
+	if !reflect.DeepEqual(dest.events, expected) {
+		t.Errorf("expected events: %#v, got: %#v", expected, dest.events)
+	}
+
+	// A retried batch is skipped.
+	dest.events = nil
+	result, err = feed.Ingest(nil, []PushMutation{
+		{Partition: "0", Key: "a", Val: []byte(`{"x":1}`), Seq: 10},
+		{Partition: "0", Key: "d", Val: []byte(`{}`), Seq: 21},
+	})
+	if err != nil || result.Ingested != 1 || result.Skipped != 1 {
+		t.Errorf("expected retry to skip, result: %#v, err: %v",
+			result, err)
+	}
+	expected = []string{
+		"snapshot 0 21 21",
+		"update 0 d 21 {}",
+	}
+	if !reflect.DeepEqual(dest.events, expected) {
+		t.Errorf("expected events: %#v, got: %#v", expected, dest.events)
+	}
+
+	if err = feed.Close(); err != nil {
+		t.Errorf("expected Close() to work, err: %v", err)
+	}
+	_, err = feed.Ingest(nil, []PushMutation{{Key: "e"}})
+	if err == nil {
+		t.Errorf("expected ingest after Close() to fail")
+	}
+}
+
+func TestPushFeedIngestKeyPartitions(t *testing.T) {
+	dest := &TestRecordDest{}
+
+	// The feed only has 2 of the source's 4 partitions.
+	feed, err := NewPushFeed("f", "i", `{"numPartitions":4}`,
+		map[string]Dest{"1": dest, "2": dest}, false)
+	if err != nil {
+		t.Fatalf("expected NewPushFeed() to work, err: %v", err)
+	}
+	if err = feed.Start(); err != nil {
+		t.Fatalf("expected Start() to work, err: %v", err)
+	}
+
+	// Find a key for each of the source's partitions.
+	h := crc32.NewIEEE()
+	all := []string{"0", "1", "2", "3"}
+	keys := map[string]string{}
+	for i := 0; len(keys) < len(all); i++ {
+		key := fmt.Sprintf("k%d", i)
+		partition := FilesPathToPartition(h, all, key)
+		if keys[partition] == "" {
+			keys[partition] = key
+		}
+	}
+
+	for _, partition := range []string{"0", "3"} {
+		_, err = feed.Ingest(nil, []PushMutation{{Key: keys[partition]}})
+		if err == nil {
+			t.Errorf("expected key of non-local partition %s to fail",
+				partition)
+		}
+	}
+
+	_, err = feed.Ingest(map[string]bool{"2": true},
+		[]PushMutation{{Key: keys["1"]}})
+	if err == nil {
+		t.Errorf("expected key outside of sourcePartitions to fail")
+	}
+	if len(dest.events) != 0 {
+		t.Errorf("expected failed batches to have no events, got: %#v",
+			dest.events)
+	}
+
+	result, err := feed.Ingest(nil, []PushMutation{
+		{Key: keys["1"], Val: []byte(`{}`)},
+		{Key: keys["2"], Val: []byte(`{}`)},
+	})
+	if err != nil || result.Ingested != 2 {
+		t.Errorf("expected ingest to work, result: %#v, err: %v",
+			result, err)
+	}
+
+	expected := []string{
+		"snapshot 1 1 1",
+		"update 1 " + keys["1"] + " 1 {}",
+		"snapshot 2 1 1",
+		"update 2 " + keys["2"] + " 1 {}",
+	}
+	if !reflect.DeepEqual(dest.events, expected) {
+		t.Errorf("expected events: %#v, got: %#v", expected, dest.events)
+	}
+}
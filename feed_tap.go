@@ -30,6 +30,7 @@ func init() {
 		&FeedType{
 			Start:      StartTAPFeed,
 			Partitions: CouchbasePartitions,
+			Topology:   CouchbaseTopology,
 			Public:     false,
 			Description: "general/couchbase-tap" +
 				" - Couchbase Server data source, via TAP protocol",
@@ -79,7 +80,7 @@ type TAPFeed struct {
 	pf         DestPartitionFunc
 	dests      map[string]Dest
 	disable    bool
-	closeCh    chan bool
+	closeCh    chan struct{}
 	doneCh     chan bool
 	doneErr    error
 	doneMsg    string
@@ -116,7 +117,7 @@ func NewTAPFeed(name, indexName, url, poolName, bucketName, bucketUUID,
 		pf:         pf,
 		dests:      dests,
 		disable:    disable,
-		closeCh:    make(chan bool),
+		closeCh:    make(chan struct{}),
 		doneCh:     make(chan bool),
 		doneErr:    nil,
 		doneMsg:    "",
@@ -152,16 +153,30 @@ func (t *TAPFeed) Start() error {
 		sleepMaxMS = FEED_SLEEP_MAX_MS
 	}
 
-	go ExponentialBackoffLoop(t.Name(),
-		func() int {
-			progress, err := t.feed()
-			if err != nil {
-				log.Printf("feed_tap: name: %s, progress: %d, err: %v",
-					t.Name(), progress, err)
-			}
-			return progress
-		},
-		sleepInitMS, backoffFactor, sleepMaxMS)
+	go func() {
+		err := ExponentialBackoffLoopEx(t.Name(),
+			func() int {
+				progress, err := t.feed()
+				if err != nil {
+					log.Printf("feed_tap: name: %s, progress: %d, err: %v",
+						t.Name(), progress, err)
+				}
+				return progress
+			},
+			BackoffOptions{
+				StartSleepMS:  sleepInitMS,
+				BackoffFactor: backoffFactor,
+				MaxSleepMS:    sleepMaxMS,
+				Jitter:        0.5,
+				StopCh:        t.closeCh,
+			})
+		if err == ErrBackoffStopped {
+			// Closed while sleeping between reconnects.
+			t.doneErr = nil
+			t.doneMsg = "closeCh closed"
+			close(t.doneCh)
+		}
+	}()
 
 	return nil
 }
@@ -18,6 +18,8 @@ import (
 	"net/http"
 	"reflect"
 	"testing"
+
+	"github.com/couchbase/go-couchbase"
 )
 
 type ErrorOnlyFeed struct {
@@ -317,6 +319,163 @@ func TestDCPFeedBasics(t *testing.T) {
 	}
 }
 
+func TestDataSourceValidate(t *testing.T) {
+	sve := DataSourceValidate("not-a-source-type", "", "", "", "", nil)
+	if sve == nil || sve.Kind != SOURCE_VALIDATE_UNKNOWN_TYPE {
+		t.Errorf("expected unknown source type, got: %#v", sve)
+	}
+
+	sve = DataSourceValidate("nil", "", "", "", "", nil)
+	if sve != nil {
+		t.Errorf("expected nil source to be valid, got: %#v", sve)
+	}
+
+	sve = DataSourceValidate("files", "", "", "not json", "", nil)
+	if sve == nil || sve.Kind != SOURCE_VALIDATE_SOURCE_GENERAL {
+		t.Errorf("expected bad files sourceParams to fail, got: %#v", sve)
+	}
+
+	sve = DataSourceValidate("couchbase", "default", "",
+		`{"replicaReads":"always"}`, "http://127.0.0.1:1", nil)
+	if sve == nil || sve.Kind != SOURCE_VALIDATE_PARAMS {
+		t.Errorf("expected bad couchbase sourceParams, got: %#v", sve)
+	}
+}
+
+func TestDCPFeedReplicaReadsParams(t *testing.T) {
+	_, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID",
+		`{"replicaReads":"prefer"}`,
+		BasicPartitionFunc, map[string]Dest{}, false, nil)
+	if err != nil {
+		t.Errorf("expected replicaReads prefer to work, err: %v", err)
+	}
+	_, err = NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID",
+		`{"replicaReads":"always"}`,
+		BasicPartitionFunc, map[string]Dest{}, false, nil)
+	if err == nil {
+		t.Errorf("expected unknown replicaReads to fail")
+	}
+}
+
+func TestParseDCPFeedParams(t *testing.T) {
+	params, err := ParseDCPFeedParams(`{"feedBufferSizeBytes":20000000,` +
+		`"feedBufferAckThreshold":0.8,"noopTimeIntervalSecs":120,` +
+		`"maxConcurrentVBucketStreams":64}`)
+	if err != nil || params.FeedBufferSizeBytes != 20000000 ||
+		params.NoopTimeIntervalSecs != 120 ||
+		params.MaxConcurrentVBucketStreams != 64 ||
+		params.ClusterManagerSleepMaxMS != 2000 {
+		t.Errorf("expected params to parse, got: %#v, err: %v",
+			params, err)
+	}
+
+	for _, paramsStr := range []string{
+		`{"feedBufferSizeBytes":4294967295}`,
+		`{"feedBufferAckThreshold":1.5}`,
+		`{"feedBufferAckThreshold":-0.1}`,
+		`{"noopTimeIntervalSecs":86400}`,
+		`{"maxConcurrentVBucketStreams":-1}`,
+		`{"replicaReads":"always"}`,
+		`not json`,
+	} {
+		if _, err = ParseDCPFeedParams(paramsStr); err == nil {
+			t.Errorf("expected err, paramsStr: %s", paramsStr)
+		}
+	}
+}
+
+func TestDCPFeedMaxConcurrentVBucketStreams(t *testing.T) {
+	dests := map[string]Dest{"0": nil, "1": nil, "2": nil}
+
+	_, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID",
+		`{"maxConcurrentVBucketStreams":3}`,
+		BasicPartitionFunc, dests, false, nil)
+	if err != nil {
+		t.Errorf("expected feed within limit to work, err: %v", err)
+	}
+
+	feed, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID",
+		`{"maxConcurrentVBucketStreams":2}`,
+		BasicPartitionFunc, dests, false, nil)
+	if err != nil || len(feed.bdss) != 2 {
+		t.Errorf("expected feed over limit to be grouped, err: %v", err)
+	}
+
+	_, err = NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID",
+		`{"maxConcurrentVBucketStreams":2}`,
+		BasicPartitionFunc, map[string]Dest{"": nil}, false, nil)
+	if err == nil {
+		t.Errorf("expected feed for all vbuckets to fail")
+	}
+}
+
+func TestGroupVBucketIds(t *testing.T) {
+	tests := []struct {
+		vbucketIds []uint16
+		max        int
+		expected   [][]uint16
+	}{
+		{[]uint16{0, 1, 2}, 0, [][]uint16{{0, 1, 2}}},
+		{[]uint16{0, 1, 2}, 3, [][]uint16{{0, 1, 2}}},
+		{[]uint16{0, 1, 2}, 2, [][]uint16{{0, 1}, {2}}},
+		{[]uint16{0, 1, 2, 3}, 2, [][]uint16{{0, 1}, {2, 3}}},
+		{[]uint16{0, 1, 2}, 1, [][]uint16{{0}, {1}, {2}}},
+	}
+	for i, test := range tests {
+		got := groupVBucketIds(test.vbucketIds, test.max)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test: %d, expected: %v, got: %v",
+				i, test.expected, got)
+		}
+	}
+}
+
+func TestDCPReplicaVBServerMap(t *testing.T) {
+	vbm := &couchbase.VBucketServerMap{
+		ServerList: []string{"a:11210", "b:11210", "c:11210"},
+		VBucketMap: [][]int{
+			{0, 1},
+			{-1, 2},
+			{1, -1},
+			{-1, -1, 0},
+		},
+	}
+
+	rv, replicaVBuckets := DCPReplicaVBServerMap(vbm, "")
+	if rv != vbm || replicaVBuckets != nil {
+		t.Errorf("expected no replica reads to be a no-op")
+	}
+
+	rv, replicaVBuckets = DCPReplicaVBServerMap(vbm,
+		DCP_REPLICA_READS_FALLBACK)
+	expected := [][]int{{0, 1}, {2, -1}, {1, -1}, {0, -1, -1}}
+	if !reflect.DeepEqual(rv.VBucketMap, expected) ||
+		!reflect.DeepEqual(replicaVBuckets,
+			map[uint16]bool{1: true, 3: true}) {
+		t.Errorf("expected fallback map, got: %v, %v",
+			rv.VBucketMap, replicaVBuckets)
+	}
+
+	rv, replicaVBuckets = DCPReplicaVBServerMap(vbm,
+		DCP_REPLICA_READS_PREFER)
+	expected = [][]int{{1, 0}, {2, -1}, {1, -1}, {0, -1, -1}}
+	if !reflect.DeepEqual(rv.VBucketMap, expected) ||
+		!reflect.DeepEqual(replicaVBuckets,
+			map[uint16]bool{0: true, 1: true, 3: true}) {
+		t.Errorf("expected prefer map, got: %v, %v",
+			rv.VBucketMap, replicaVBuckets)
+	}
+
+	if !reflect.DeepEqual(vbm.VBucketMap[0], []int{0, 1}) {
+		t.Errorf("expected original map to be unchanged")
+	}
+}
+
 func TestCouchbaseParseSourceName(t *testing.T) {
 	s, p, b := CouchbaseParseSourceName("s", "p", "b")
 	if s != "s" ||
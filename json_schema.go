@@ -0,0 +1,255 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// JSON_SCHEMA_MAX_DEPTH limits how deeply JSONSchema() descends into
+// nested (or recursive) types.
+var JSON_SCHEMA_MAX_DEPTH = 10
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
+
+// JSONSchema derives a JSON Schema for the JSON form of a sample
+// value, such as the StartSample of a PIndexImplType or FeedType, so
+// that UIs can render forms and validate inputs.  Property names come
+// from the json struct tags, and the sample's values are used as the
+// defaults of its leaf properties.  The optional docs describe the
+// top-level properties, like a FeedType's StartSampleDocs.
+func JSONSchema(sample interface{},
+	docs map[string]string) map[string]interface{} {
+	rv := jsonSchemaValue(reflect.ValueOf(sample), 0)
+	rv["$schema"] = "http://json-schema.org/draft-04/schema#"
+
+	props, _ := rv["properties"].(map[string]interface{})
+	for k, doc := range docs {
+		if prop, ok := props[k].(map[string]interface{}); ok {
+			prop["description"] = doc
+		}
+	}
+
+	return rv
+}
+
+// QuerySchema derives a JSON Schema for the query requests of an
+// index type, from the QueryCtlParams and the properties of its query
+// samples.
+func QuerySchema(samples []Documentation) map[string]interface{} {
+	rv := JSONSchema(&QueryCtlParams{}, map[string]string{
+		"ctl": "query controls, independent of the index type",
+	})
+
+	props := rv["properties"].(map[string]interface{})
+	for _, sample := range samples {
+		s := jsonSchemaValue(reflect.ValueOf(sample.JSON), 0)
+		sampleProps, _ := s["properties"].(map[string]interface{})
+		for k, prop := range sampleProps {
+			if props[k] == nil {
+				props[k] = prop
+			}
+		}
+	}
+
+	return rv
+}
+
+func jsonSchemaValue(v reflect.Value, depth int) map[string]interface{} {
+	for v.IsValid() &&
+		(v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			if v.Kind() == reflect.Ptr {
+				return jsonSchemaType(v.Type().Elem(), depth)
+			}
+			return map[string]interface{}{}
+		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return map[string]interface{}{} // Any JSON.
+	}
+
+	if depth > JSON_SCHEMA_MAX_DEPTH {
+		return map[string]interface{}{}
+	}
+
+	t := v.Type()
+
+	if t != timeType && v.CanInterface() &&
+		reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		// Custom JSON, so use the schema of its generic JSON form.
+		var generic interface{}
+		buf, err := json.Marshal(v.Interface())
+		if err != nil || json.Unmarshal(buf, &generic) != nil {
+			return map[string]interface{}{}
+		}
+		return jsonSchemaValue(reflect.ValueOf(generic), depth)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if t == timeType {
+			return jsonSchemaType(t, depth)
+		}
+
+		props := map[string]interface{}{}
+		jsonSchemaStructFields(v, props, depth)
+
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return jsonSchemaType(t, depth)
+		}
+
+		props := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			props[k.String()] = jsonSchemaValue(v.MapIndex(k), depth+1)
+		}
+
+		rv := jsonSchemaType(t, depth)
+		if len(props) > 0 {
+			rv["properties"] = props
+		}
+		return rv
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 || v.Len() <= 0 {
+			return jsonSchemaType(t, depth)
+		}
+
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaValue(v.Index(0), depth+1),
+		}
+	}
+
+	rv := jsonSchemaType(t, depth)
+	if rv["type"] != nil && v.CanInterface() {
+		rv["default"] = v.Interface()
+	}
+	return rv
+}
+
+// jsonSchemaStructFields adds the schemas of the JSON fields of a
+// struct value to props, including the fields of embedded structs.
+func jsonSchemaStructFields(v reflect.Value, props map[string]interface{},
+	depth int) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := f.Name
+		opts := ""
+		if tag != "" {
+			parts := strings.SplitN(tag, ",", 2)
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			if len(parts) > 1 {
+				opts = parts[1]
+			}
+		}
+
+		if f.Anonymous && tag == "" {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				jsonSchemaStructFields(fv, props, depth)
+				continue
+			}
+		}
+
+		if f.PkgPath != "" {
+			continue // Unexported.
+		}
+
+		if strings.Contains(","+opts+",", ",string,") {
+			props[name] = map[string]interface{}{"type": "string"}
+			continue
+		}
+
+		props[name] = jsonSchemaValue(v.Field(i), depth+1)
+	}
+}
+
+// jsonSchemaType returns the schema of a type, without any sample
+// values.
+func jsonSchemaType(t reflect.Type, depth int) map[string]interface{} {
+	if depth > JSON_SCHEMA_MAX_DEPTH {
+		return map[string]interface{}{}
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+
+	case reflect.Struct:
+		return jsonSchemaValue(reflect.New(t).Elem(), depth)
+
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchemaType(t.Elem(), depth+1),
+		}
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"} // Base64.
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaType(t.Elem(), depth+1),
+		}
+	}
+
+	return map[string]interface{}{} // Any JSON, like an interface{}.
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testSchemaInner struct {
+	Size int64 `json:"size"`
+}
+
+type testSchemaEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type testSchemaSample struct {
+	testSchemaEmbedded
+
+	Name     string            `json:"name"`
+	Enabled  bool              `json:"enabled,omitempty"`
+	Ratio    float64           `json:"ratio"`
+	Count    uint64            `json:"count,string"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Inner    *testSchemaInner  `json:"inner"`
+	Raw      json.RawMessage   `json:"raw"`
+	Ignored  string            `json:"-"`
+	Untagged int
+	private  int
+}
+
+func TestJSONSchema(t *testing.T) {
+	s := JSONSchema(&testSchemaSample{Name: "foo", Ratio: 0.5},
+		map[string]string{"name": "the name", "missing": "ignored"})
+
+	if s["type"] != "object" || s["$schema"] == nil {
+		t.Fatalf("expected an object schema, got: %#v", s)
+	}
+
+	props := s["properties"].(map[string]interface{})
+
+	expectedTypes := map[string]interface{}{
+		"embedded": "string",
+		"name":     "string",
+		"enabled":  "boolean",
+		"ratio":    "number",
+		"count":    "string",
+		"tags":     "array",
+		"labels":   "object",
+		"inner":    "object",
+		"raw":      nil,
+		"Untagged": "integer",
+	}
+	if len(props) != len(expectedTypes) {
+		t.Errorf("expected props: %v, got: %#v", expectedTypes, props)
+	}
+	for k, expectedType := range expectedTypes {
+		prop, ok := props[k].(map[string]interface{})
+		if !ok || prop["type"] != expectedType {
+			t.Errorf("expected %s type: %v, got: %#v", k, expectedType, prop)
+		}
+	}
+
+	name := props["name"].(map[string]interface{})
+	if name["default"] != "foo" || name["description"] != "the name" {
+		t.Errorf("expected default and description, got: %#v", name)
+	}
+
+	inner := props["inner"].(map[string]interface{})
+	innerProps := inner["properties"].(map[string]interface{})
+	if innerProps["size"].(map[string]interface{})["type"] != "integer" {
+		t.Errorf("expected inner size, got: %#v", inner)
+	}
+
+	tags := props["tags"].(map[string]interface{})
+	if tags["items"].(map[string]interface{})["type"] != "string" {
+		t.Errorf("expected string items, got: %#v", tags)
+	}
+
+	// The schema must itself be JSON.
+	_, err := json.Marshal(s)
+	if err != nil {
+		t.Errorf("expected JSON schema, err: %v", err)
+	}
+}
+
+func TestJSONSchemaGeneric(t *testing.T) {
+	s := JSONSchema(map[string]interface{}{
+		"query": map[string]interface{}{"match": "x"},
+		"size":  10.0,
+		"any":   nil,
+	}, nil)
+
+	props := s["properties"].(map[string]interface{})
+	if props["size"].(map[string]interface{})["type"] != "number" ||
+		!reflect.DeepEqual(props["any"], map[string]interface{}{}) {
+		t.Errorf("unexpected generic schema: %#v", s)
+	}
+
+	query := props["query"].(map[string]interface{})
+	if query["type"] != "object" || query["properties"] == nil {
+		t.Errorf("expected query properties, got: %#v", query)
+	}
+}
+
+func TestQuerySchema(t *testing.T) {
+	s := QuerySchema([]Documentation{
+		{JSON: map[string]interface{}{"q": "hello", "ctl": "ignored"}},
+	})
+
+	props := s["properties"].(map[string]interface{})
+	if props["q"] == nil {
+		t.Errorf("expected sample props, got: %#v", s)
+	}
+
+	ctl := props["ctl"].(map[string]interface{})
+	ctlProps := ctl["properties"].(map[string]interface{})
+	if ctlProps["timeout"] == nil || ctlProps["consistency"] == nil {
+		t.Errorf("expected ctl props, got: %#v", ctl)
+	}
+	if ctl["description"] == nil {
+		t.Errorf("expected ctl description, got: %#v", ctl)
+	}
+}
@@ -0,0 +1,99 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// The log levels of a subsystem, where a subsystem logs the messages
+// at or below its level.
+const (
+	LOG_LEVEL_ERROR int32 = iota
+	LOG_LEVEL_WARN
+	LOG_LEVEL_INFO
+	LOG_LEVEL_DEBUG
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+// The log levels of the subsystems, which default to info.  The map
+// is not modified after init, so only its values need atomic access.
+var logSubsystemLevels = map[string]*int32{
+	"planner": newLogLevel(),
+	"janitor": newLogLevel(),
+	"feed":    newLogLevel(),
+	"pindex":  newLogLevel(),
+	"rest":    newLogLevel(),
+}
+
+func newLogLevel() *int32 {
+	level := LOG_LEVEL_INFO
+	return &level
+}
+
+// SetLogLevel changes the log level of a subsystem at runtime, where
+// the subsystem is one of planner, janitor, feed, pindex or rest, and
+// the level is one of error, warn, info or debug.
+func SetLogLevel(subsystem, level string) error {
+	p := logSubsystemLevels[subsystem]
+	if p == nil {
+		return fmt.Errorf("log_level: unknown subsystem: %s", subsystem)
+	}
+
+	for i, name := range logLevelNames {
+		if name == level {
+			atomic.StoreInt32(p, int32(i))
+			log.Printf("log_level: subsystem: %s, level: %s",
+				subsystem, level)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("log_level: unknown level: %s", level)
+}
+
+// LogLevels returns the log level names of the subsystems.
+func LogLevels() map[string]string {
+	rv := make(map[string]string, len(logSubsystemLevels))
+	for subsystem, p := range logSubsystemLevels {
+		rv[subsystem] = logLevelNames[atomic.LoadInt32(p)]
+	}
+	return rv
+}
+
+// LogEnabled returns true if a subsystem logs messages of a level,
+// which allows callers to skip preparing expensive log messages.
+func LogEnabled(subsystem string, level int32) bool {
+	p := logSubsystemLevels[subsystem]
+	if p == nil {
+		return level <= LOG_LEVEL_INFO
+	}
+	return level <= atomic.LoadInt32(p)
+}
+
+// Logf logs a message of a subsystem if the subsystem's log level
+// allows it.
+func Logf(subsystem string, level int32, format string,
+	args ...interface{}) {
+	if LogEnabled(subsystem, level) {
+		log.Printf(format, args...)
+	}
+}
+
+// LogDebugf logs a debug message of a subsystem.
+func LogDebugf(subsystem string, format string, args ...interface{}) {
+	Logf(subsystem, LOG_LEVEL_DEBUG, format, args...)
+}
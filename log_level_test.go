@@ -0,0 +1,49 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"testing"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	defer SetLogLevel("feed", "info")
+
+	if LogLevels()["feed"] != "info" {
+		t.Errorf("expected default info level, got: %v", LogLevels())
+	}
+	if LogEnabled("feed", LOG_LEVEL_DEBUG) {
+		t.Errorf("expected debug to be disabled by default")
+	}
+
+	err := SetLogLevel("feed", "debug")
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if !LogEnabled("feed", LOG_LEVEL_DEBUG) ||
+		LogEnabled("planner", LOG_LEVEL_DEBUG) {
+		t.Errorf("expected debug for only feed, got: %v", LogLevels())
+	}
+
+	err = SetLogLevel("feed", "error")
+	if err != nil || LogEnabled("feed", LOG_LEVEL_WARN) ||
+		!LogEnabled("feed", LOG_LEVEL_ERROR) {
+		t.Errorf("expected error level, got: %v, err: %v", LogLevels(), err)
+	}
+
+	if SetLogLevel("not-a-subsystem", "debug") == nil {
+		t.Errorf("expected err on unknown subsystem")
+	}
+	if SetLogLevel("feed", "loud") == nil {
+		t.Errorf("expected err on unknown level")
+	}
+}
@@ -14,8 +14,6 @@ package cbgt
 import (
 	"container/list"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -57,6 +55,7 @@ type Manager struct {
 	dataDir   string
 	server    string // The default datasource that will be indexed.
 	stopCh    chan struct{}
+	stopOnce  sync.Once
 
 	m         sync.Mutex // Protects the fields that follow.
 	options   map[string]string
@@ -75,8 +74,68 @@ type Manager struct {
 
 	coveringCache map[CoveringPIndexesSpec]*CoveringPIndexes
 
+	indexDefsDerived map[string]*indexDefsDerived // Keyed by caller's key.
+
+	nodeLiveness map[string]time.Time // Heartbeat lease expirations.
+	nodeDead     map[string]bool      // Nodes with expired heartbeats.
+
+	shuttingDown    bool
+	queriesInFlight int
+	queriesDoneCh   chan struct{} // Closed when queriesInFlight drops to 0.
+
+	queries  map[string]*QueryHandle // Active queries, keyed by ID.
+	querySeq uint64                  // For QueryHandle ID's.
+
+	nodeQueryLatencies map[string]float64 // Moving averages, in ns.
+	balancedSeq        uint64             // Atomic, for round-robin.
+
+	pausedPIndexes map[string]int         // Ref-counts of pindexes with paused ingest.
+	pausedFeeds    map[string][][]*PIndex // Pindexes of feeds stopped by pauses.
+
+	pindexVerifyResults map[string]*PIndexVerifyResult // Keyed by pindex name.
+
+	pindexReadOnly map[string]string // Read-only policies, keyed by pindex name.
+
+	pindexDiskUsage map[string]uint64 // See DiskUsageOnce().
+	diskLow         bool
+	diskPaused      map[string]bool // Pindexes paused due to diskLow.
+
+	pindexMemoryUsage map[string]uint64 // See MemoryOnce().
+	memoryOverQuota   int32             // Atomic, 1 when over memoryQuota.
+
+	pindexWarmup map[string]*PIndexWarmup // Keyed by pindex name.
+
+	eventSubs []chan<- ManagerEvent // Copy-on-write, see SubscribeEvents().
+
+	cfgChangeSubs    []chan<- CfgEvent // Copy-on-write, see SubscribeCfgChanges().
+	cfgChangeStarted bool
+
+	// The node's own options, before the runtime options are overlaid
+	// onto them, and the latest runtime options, see SetOptions().
+	optionsBase    map[string]string
+	runtimeOptions map[string]string
+
+	pindexBuilds       map[string]time.Time // Start times of building pindexes.
+	pindexBuildsQueued []string             // Names of queued plan pindexes.
+
+	pindexRestartsPending  map[string]time.Time // See filterPIndexRestarts().
+	pindexRestartsRetrying bool                 // See retryPIndexRestarts().
+
+	janitorPlanPIndexesPrev *PlanPIndexes // Last plan applied by janitor.
+
+	sourceTopology map[sourceWatchKey]string // See SourceWatchOnce().
+	sourceBroken   map[string]string         // Keyed by index name.
+
+	faults map[string]*Fault // Injected faults, keyed by fault name.
+
+	docTraces map[string]*DocTrace // Keyed by index name.
+
 	stats  ManagerStats
+	timers *ManagerTimers
 	events *list.List
+
+	errorsM sync.Mutex                   // Protects the errors.
+	errors  map[string]*managerErrorList // Keyed by error category.
 }
 
 // ManagerStats represents the stats/metrics tracked by a Manager
@@ -145,6 +204,79 @@ type ManagerStats struct {
 	TotRefreshLastNodeDefs     uint64
 	TotRefreshLastIndexDefs    uint64
 	TotRefreshLastPlanPIndexes uint64
+	TotRefreshNodeLiveness     uint64
+	TotRefreshPIndexWarmup     uint64
+
+	TotHeartbeat             uint64
+	TotHeartbeatErr          uint64
+	TotHeartbeatAutoFailover uint64
+
+	TotQueryRejected  uint64
+	TotQueryCancelled uint64
+
+	TotBackupPIndex     uint64
+	TotBackupPIndexErr  uint64
+	TotRestorePIndex    uint64
+	TotRestorePIndexErr uint64
+
+	TotVerifyPIndex    uint64
+	TotVerifyPIndexErr uint64
+	TotRepairPIndex    uint64
+
+	TotReadOnlyDrop uint64
+
+	TotFeedBackpressurePause   uint64
+	TotFeedBackpressureTimeout uint64
+
+	TotDestBatchApply     uint64
+	TotDestBatchApplyErr  uint64
+	TotDestBatchMutations uint64
+
+	TotMemoryThrottlePause   uint64
+	TotMemoryThrottleTimeout uint64
+	TotMemoryEvictHint       uint64
+
+	TotFaultLatency  uint64
+	TotFaultDrop     uint64
+	TotFaultRollback uint64
+	TotFaultErr      uint64
+
+	TotOrphanQuarantine uint64
+	TotOrphanDelete     uint64
+	TotOrphanErr        uint64
+
+	TotEventDrop uint64
+
+	TotCfgChangeDrop uint64
+
+	TotWebhookPost    uint64
+	TotWebhookPostErr uint64
+	TotWebhookDrop    uint64
+
+	TotPIndexBuildStart   uint64
+	TotPIndexBuildDone    uint64
+	TotPIndexBuildTimeout uint64
+	NumPIndexBuildQueued  uint64 // Gauge of the current queue length.
+
+	TotPIndexRestart    uint64
+	TotPIndexRestartErr uint64
+
+	TotTaskSubmit    uint64
+	TotTaskSubmitErr uint64
+
+	TotMaintenanceRun    uint64
+	TotMaintenanceRunErr uint64
+
+	TotSourceWatch        uint64
+	TotSourceWatchErr     uint64
+	TotSourceWatchChanged uint64
+	TotSourceWatchMissing uint64
+
+	TotCoveringCacheHit  uint64
+	TotCoveringCacheMiss uint64
+
+	TotIndexDefsDerivedHit  uint64
+	TotIndexDefsDerivedMiss uint64
 }
 
 // MANAGER_MAX_EVENTS limits the number of events tracked by a Manager
@@ -197,13 +329,20 @@ func NewManagerEx(version string, cfg Cfg, uuid string, tags []string,
 		janitorCh: make(chan *workReq),
 		meh:       meh,
 		events:    list.New(),
+		timers:    NewManagerTimers(),
 
 		lastNodeDefs: make(map[string]*NodeDefs),
+
+		optionsBase: options,
 	}
 }
 
+// Stop stops the planner, janitor and other child goroutines of a
+// Manager.  See also Shutdown() for a graceful stop.
 func (mgr *Manager) Stop() {
-	close(mgr.stopCh)
+	mgr.stopOnce.Do(func() {
+		close(mgr.stopCh)
+	})
 }
 
 // Start will start and register a Manager instance with its
@@ -215,6 +354,11 @@ func (mgr *Manager) Start(register string) error {
 		return err
 	}
 
+	err = mgr.LoadRuntimeOptions()
+	if err != nil {
+		return err
+	}
+
 	if mgr.tagsMap == nil || mgr.tagsMap["pindex"] {
 		mldd := mgr.options["managerLoadDataDir"]
 		if mldd == "sync" || mldd == "" {
@@ -232,14 +376,25 @@ func (mgr *Manager) Start(register string) error {
 	if mgr.tagsMap == nil || mgr.tagsMap["planner"] {
 		go mgr.PlannerLoop()
 		go mgr.PlannerKick("start")
+		go mgr.PlanRolloutLoop()
+		go mgr.SourceWatchLoop()
 	}
 
 	if mgr.tagsMap == nil ||
 		(mgr.tagsMap["pindex"] && mgr.tagsMap["janitor"]) {
 		go mgr.JanitorLoop()
 		go mgr.JanitorKick("start")
+		go mgr.OrphanSweepLoop()
 	}
 
+	go mgr.HeartbeatLoop()
+	go mgr.WarmupLoop()
+	go mgr.DiskUsageLoop()
+	go mgr.ResplitLoop()
+	go mgr.MemoryLoop()
+	go mgr.MaintenanceLoop()
+	mgr.startWebhooks()
+
 	return mgr.StartCfg()
 }
 
@@ -272,6 +427,29 @@ func (mgr *Manager) StartCfg() error {
 			}
 		}()
 
+		// The runtime options are subscribed to before StartCfg()
+		// returns, and reloaded after subscribing, so that a change
+		// since Start() loaded them isn't missed.
+		eo := make(chan CfgEvent)
+		mgr.cfg.Subscribe(MANAGER_OPTIONS_KEY, eo)
+		go func() {
+			err := mgr.LoadRuntimeOptions()
+			if err != nil {
+				log.Printf("manager: LoadRuntimeOptions, err: %v", err)
+			}
+			for {
+				select {
+				case <-mgr.stopCh:
+					return
+				case <-eo:
+					err := mgr.LoadRuntimeOptions()
+					if err != nil {
+						log.Printf("manager: LoadRuntimeOptions, err: %v", err)
+					}
+				}
+			}
+		}()
+
 		kinds := []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED}
 		for _, kind := range kinds {
 			go func(kind string) {
@@ -361,9 +539,24 @@ func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
 		Container:   mgr.container,
 		Weight:      mgr.weight,
 		Extras:      mgr.extras,
+
+		Capabilities: mgr.NodeCapabilities(),
 	}
 
-	for {
+	// Retry on CAS mismatches, as perhaps multiple nodes are all
+	// racing to register themselves, such as in a full datacenter
+	// power restart.
+	opts := CfgRetryOptionsDefault
+	opts.MaxTries = 0
+	opts.StopCh = mgr.stopCh
+
+	same := false
+
+	err := CfgRetry(opts, func(tries int) error {
+		if tries > 0 {
+			atomic.AddUint64(&mgr.stats.TotSaveNodeDefRetry, 1)
+		}
+
 		nodeDefs, cas, err := CfgGetNodeDefs(mgr.cfg, kind)
 		if err != nil {
 			atomic.AddUint64(&mgr.stats.TotSaveNodeDefGetErr, 1)
@@ -375,8 +568,7 @@ func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
 		nodeDefPrev, exists := nodeDefs.NodeDefs[mgr.uuid]
 		if exists && !force {
 			if reflect.DeepEqual(nodeDefPrev, nodeDef) {
-				atomic.AddUint64(&mgr.stats.TotSaveNodeDefSame, 1)
-				atomic.AddUint64(&mgr.stats.TotSaveNodeDefOk, 1)
+				same = true
 				return nil // No changes, so leave the existing nodeDef.
 			}
 		}
@@ -387,17 +579,17 @@ func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
 
 		_, err = CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
 		if err != nil {
-			if _, ok := err.(*CfgCASError); ok {
-				// Retry if it was a CAS mismatch, as perhaps
-				// multiple nodes are all racing to register themselves,
-				// such as in a full datacenter power restart.
-				atomic.AddUint64(&mgr.stats.TotSaveNodeDefRetry, 1)
-				continue
+			if _, ok := err.(*CfgCASError); !ok {
+				atomic.AddUint64(&mgr.stats.TotSaveNodeDefSetErr, 1)
 			}
-			atomic.AddUint64(&mgr.stats.TotSaveNodeDefSetErr, 1)
-			return err
 		}
-		break
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if same {
+		atomic.AddUint64(&mgr.stats.TotSaveNodeDefSame, 1)
 	}
 	atomic.AddUint64(&mgr.stats.TotSaveNodeDefOk, 1)
 	return nil
@@ -412,21 +604,16 @@ func (mgr *Manager) RemoveNodeDef(kind string) error {
 		return nil // Occurs during testing.
 	}
 
-	for {
-		err := CfgRemoveNodeDef(mgr.cfg, kind, mgr.uuid, mgr.version)
-		if err != nil {
-			if _, ok := err.(*CfgCASError); ok {
-				// Retry if it was a CAS mismatch, as perhaps multiple
-				// nodes are racing to register/unregister themselves,
-				// such as in a full cluster power restart.
-				continue
-			}
-			return err
-		}
-		break
-	}
+	// Retry on CAS mismatches, as perhaps multiple nodes are racing
+	// to register/unregister themselves, such as in a full cluster
+	// power restart.
+	opts := CfgRetryOptionsDefault
+	opts.MaxTries = 0
+	opts.StopCh = mgr.stopCh
 
-	return nil
+	return CfgRetry(opts, func(tries int) error {
+		return CfgRemoveNodeDef(mgr.cfg, kind, mgr.uuid, mgr.version)
+	})
 }
 
 // ---------------------------------------------------------------
@@ -435,28 +622,29 @@ func (mgr *Manager) RemoveNodeDef(kind string) error {
 func (mgr *Manager) LoadDataDir() error {
 	log.Printf("manager: loading dataDir...")
 
-	dirEntries, err := ioutil.ReadDir(mgr.dataDir)
+	err := mgr.MigrateDataDir()
+	if err != nil {
+		log.Printf("manager: could not migrate dataDir, err: %v", err)
+	}
+
+	paths, err := dataDirPIndexPaths(mgr.dataDir)
 	if err != nil {
 		return fmt.Errorf("manager: could not read dataDir: %s, err: %v",
 			mgr.dataDir, err)
 	}
 
-	for _, dirInfo := range dirEntries {
-		path := mgr.dataDir + string(os.PathSeparator) + dirInfo.Name()
-		_, ok := mgr.ParsePIndexPath(path)
-		if !ok {
-			continue // Skip the entry that doesn't match the naming pattern.
-		}
-
+	for _, path := range paths {
 		log.Printf("manager: opening pindex path: %s", path)
 		pindex, err := OpenPIndex(mgr, path)
 		if err != nil {
-			log.Printf("manager: could not open pindex path: %s, err: %v",
-				path, err)
+			mgr.notePIndexOpenErr(path, err)
 			continue
 		}
 
-		mgr.registerPIndex(pindex)
+		err = mgr.registerPIndex(pindex)
+		if err == nil {
+			mgr.emitPIndexEvent(MANAGER_EVENT_PINDEX_OPENED, pindex)
+		}
 	}
 
 	log.Printf("manager: loading dataDir... done")
@@ -510,6 +698,13 @@ func (mgr *Manager) registerPIndex(pindex *PIndex) error {
 	atomic.AddUint64(&mgr.stats.TotRegisterPIndex, 1)
 	mgr.coveringCache = nil
 
+	if mgr.warmupEnabledLOCKED() {
+		if mgr.pindexWarmup == nil {
+			mgr.pindexWarmup = map[string]*PIndexWarmup{}
+		}
+		mgr.pindexWarmup[pindex.Name] = &PIndexWarmup{}
+	}
+
 	if mgr.meh != nil {
 		mgr.meh.OnRegisterPIndex(pindex)
 	}
@@ -536,6 +731,9 @@ func (mgr *Manager) unregisterPIndex(name string, pindexToMatch *PIndex) *PIndex
 		atomic.AddUint64(&mgr.stats.TotUnregisterPIndex, 1)
 		mgr.coveringCache = nil
 
+		delete(mgr.pindexWarmup, name)
+		delete(mgr.pindexBuilds, name)
+
 		if mgr.meh != nil {
 			mgr.meh.OnUnregisterPIndex(pindex)
 		}
@@ -641,6 +839,9 @@ func (mgr *Manager) GetIndexDefs(refresh bool) (
 		if err != nil {
 			return nil, nil, err
 		}
+		if indexDefsUUID(mgr.lastIndexDefs) != indexDefsUUID(indexDefs) {
+			mgr.indexDefsDerived = nil
+		}
 		mgr.lastIndexDefs = indexDefs
 		atomic.AddUint64(&mgr.stats.TotRefreshLastIndexDefs, 1)
 
@@ -719,10 +920,10 @@ func (mgr *Manager) GetPlanPIndexes(refresh bool) (
 
 // ---------------------------------------------------------------
 
-// PIndexPath returns the filesystem path for a given named pindex.
-// See also ParsePIndexPath().
+// PIndexPath returns the filesystem path for a given named pindex,
+// based on the dataDir layout.  See also ParsePIndexPath().
 func (mgr *Manager) PIndexPath(pindexName string) string {
-	return PIndexPath(mgr.dataDir, pindexName)
+	return PIndexPathEx(mgr.dataDir, mgr.DataDirLayout(), pindexName)
 }
 
 // ParsePIndexPath returns the name for a pindex given a filesystem
@@ -809,15 +1010,26 @@ func (mgr *Manager) GetOptions() map[string]string {
 	return options
 }
 
-// SetOptions replaces the options map with the provided map, which
-// should be considered immutable after this call.
+// SetOptions replaces the node's own options map with the provided
+// map, which should be considered immutable after this call.  The
+// runtime options, if any, stay overlaid onto the node's own options.
 func (mgr *Manager) SetOptions(options map[string]string) {
 	mgr.m.Lock()
-	mgr.options = options
-	atomic.AddUint64(&mgr.stats.TotSetOptions, 1)
+	mgr.optionsBase = options
+	mgr.overlayRuntimeOptionsLOCKED()
 	mgr.m.Unlock()
 }
 
+// BaseOptions returns the (read-only) options of the node itself,
+// without the overlaid runtime options.  Callers must not modify the
+// returned map.
+func (mgr *Manager) BaseOptions() map[string]string {
+	mgr.m.Lock()
+	options := mgr.optionsBase
+	mgr.m.Unlock()
+	return options
+}
+
 // Copies the current manager stats to the dst manager stats.
 func (mgr *Manager) StatsCopyTo(dst *ManagerStats) {
 	mgr.stats.AtomicCopyTo(dst)
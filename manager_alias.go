@@ -0,0 +1,463 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// An index alias, like cbft's "fulltext-alias" index type, is an
+// index whose params JSON has a "targets" object, keyed by the names
+// of the indexes that the alias points to, such as:
+//
+//     {"targets": {"sales-2014Q3": {}, "sales-2014Q4": {"weight": 3}},
+//      "routing": "weighted"}
+//
+// The optional "routing" policy decides which targets serve a count
+// or query of the alias, which helps with blue/green cutovers and A/B
+// layouts, where a target's optional "weight" defaults to 1, and a
+// target is healthy when CoveringPIndexes() can cover it.
+
+// ALIAS_ROUTING_ALL fans out to all the targets of an alias, as their
+// union, and is the default routing policy.
+const ALIAS_ROUTING_ALL = "all"
+
+// ALIAS_ROUTING_FIRST_HEALTHY routes to the first healthy target of an
+// alias, ordered by descending weight and then by index name.
+const ALIAS_ROUTING_FIRST_HEALTHY = "firstHealthy"
+
+// ALIAS_ROUTING_WEIGHTED routes to a healthy target of an alias that's
+// chosen randomly in proportion to the targets' weights.
+const ALIAS_ROUTING_WEIGHTED = "weighted"
+
+// AliasRoutings are the valid routing policies of an alias.
+var AliasRoutings = map[string]bool{
+	ALIAS_ROUTING_ALL:           true,
+	ALIAS_ROUTING_FIRST_HEALTHY: true,
+	ALIAS_ROUTING_WEIGHTED:      true,
+}
+
+// AliasTargetsUpdate describes a change to the targets of an index
+// alias, where the removals are applied before the additions, so
+// that a swap is a removal and an addition.
+type AliasTargetsUpdate struct {
+	// When not empty, the update fails unless the alias's index
+	// definition still has this UUID.
+	PrevIndexUUID string `json:"prevIndexUUID,omitempty"`
+
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+
+	// Weights of targets to set, keyed by target index name, which
+	// are applied after the additions.
+	Weights map[string]int `json:"weights,omitempty"`
+
+	// When not empty, the routing policy to set.
+	Routing string `json:"routing,omitempty"`
+}
+
+// UpdateAliasTargets atomically changes the targets, weights and
+// routing policy of an index alias, verifying that the removed and
+// weighted targets are targets and that the added targets are
+// existing indexes.  Returns the new UUID of the alias's index
+// definition.
+func (mgr *Manager) UpdateAliasTargets(aliasName string,
+	u AliasTargetsUpdate) (string, error) {
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return "", err
+	}
+	if indexDefs == nil {
+		return "", fmt.Errorf("manager_alias: no indexes")
+	}
+
+	aliasDef := indexDefs.IndexDefs[aliasName]
+	if aliasDef == nil {
+		return "", fmt.Errorf("manager_alias: no alias, name: %s", aliasName)
+	}
+	if u.PrevIndexUUID != "" && u.PrevIndexUUID != aliasDef.UUID {
+		return "", fmt.Errorf("manager_alias: alias changed, name: %s,"+
+			" current UUID: %s, did not match input UUID: %s",
+			aliasName, aliasDef.UUID, u.PrevIndexUUID)
+	}
+
+	params, targets, err := parseAliasParams(aliasDef)
+	if err != nil {
+		return "", err
+	}
+
+	for _, target := range u.Remove {
+		if targets[target] == nil {
+			return "", fmt.Errorf("manager_alias: not a target: %s,"+
+				" name: %s", target, aliasName)
+		}
+		delete(targets, target)
+	}
+
+	for _, target := range u.Add {
+		if target == aliasName || indexDefs.IndexDefs[target] == nil {
+			return "", fmt.Errorf("manager_alias: no target index: %s,"+
+				" name: %s", target, aliasName)
+		}
+		if targets[target] == nil {
+			targets[target] = json.RawMessage("{}")
+		}
+	}
+
+	for target, weight := range u.Weights {
+		if targets[target] == nil {
+			return "", fmt.Errorf("manager_alias: not a target: %s,"+
+				" name: %s", target, aliasName)
+		}
+		if weight < 0 {
+			return "", fmt.Errorf("manager_alias: negative weight: %d,"+
+				" target: %s, name: %s", weight, target, aliasName)
+		}
+
+		targetParams := map[string]json.RawMessage{}
+		err = json.Unmarshal(targets[target], &targetParams)
+		if err != nil {
+			return "", fmt.Errorf("manager_alias: could not parse"+
+				" target: %s, name: %s, err: %v", target, aliasName, err)
+		}
+		targetParams["weight"], _ = json.Marshal(weight)
+		targets[target], err = json.Marshal(targetParams)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if u.Routing != "" {
+		if !AliasRoutings[u.Routing] {
+			return "", fmt.Errorf("manager_alias: unknown routing: %s,"+
+				" name: %s", u.Routing, aliasName)
+		}
+		params["routing"], _ = json.Marshal(u.Routing)
+	}
+
+	params["targets"], err = json.Marshal(targets)
+	if err != nil {
+		return "", err
+	}
+
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	// CreateIndex() checks the UUID of the alias's index definition,
+	// so a concurrent change fails this update.
+	err = mgr.CreateIndex(aliasDef.SourceType,
+		aliasDef.SourceName, aliasDef.SourceUUID, aliasDef.SourceParams,
+		aliasDef.Type, aliasDef.Name, string(paramsJSON),
+		aliasDef.PlanParams, aliasDef.UUID)
+	if err != nil {
+		return "", err
+	}
+
+	aliasDef, _, err = mgr.GetIndexDef(aliasName, false)
+	if err != nil || aliasDef == nil {
+		return "", fmt.Errorf("manager_alias: could not get updated"+
+			" alias, name: %s, err: %v", aliasName, err)
+	}
+
+	return aliasDef.UUID, nil
+}
+
+// parseAliasParams returns the params of an index alias and its
+// "targets" object, keyed by target index name.
+func parseAliasParams(aliasDef *IndexDef) (
+	map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	params := map[string]json.RawMessage{}
+	if aliasDef.Params != "" {
+		err := json.Unmarshal([]byte(aliasDef.Params), &params)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manager_alias: could not parse"+
+				" params, name: %s, err: %v", aliasDef.Name, err)
+		}
+	}
+
+	targets := map[string]json.RawMessage{}
+	if len(params["targets"]) > 0 {
+		err := json.Unmarshal(params["targets"], &targets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manager_alias: could not parse"+
+				" targets, name: %s, err: %v", aliasDef.Name, err)
+		}
+	}
+
+	return params, targets, nil
+}
+
+// ------------------------------------------------
+
+// AliasTarget is an index that's a target of an index alias.
+type AliasTarget struct {
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID"`
+	IndexType string `json:"indexType"`
+	Weight    int    `json:"weight"`
+}
+
+// AliasTargets returns the targets of an index alias, sorted by index
+// name.  A target whose JSON object has an "indexUUID" must still
+// have that index UUID.  Targets that are themselves aliases are not
+// expanded.
+func (mgr *Manager) AliasTargets(aliasName string) ([]AliasTarget, error) {
+	targets, _, err := mgr.aliasTargets(aliasName)
+	return targets, err
+}
+
+// aliasTargets returns the targets and the routing policy of an index
+// alias.
+func (mgr *Manager) aliasTargets(aliasName string) (
+	[]AliasTarget, string, error) {
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if indexDefs == nil || indexDefs.IndexDefs[aliasName] == nil {
+		return nil, "", fmt.Errorf("manager_alias: no alias, name: %s",
+			aliasName)
+	}
+
+	params, targets, err := parseAliasParams(indexDefs.IndexDefs[aliasName])
+	if err != nil {
+		return nil, "", err
+	}
+
+	routing := ALIAS_ROUTING_ALL
+	if len(params["routing"]) > 0 {
+		err = json.Unmarshal(params["routing"], &routing)
+		if err != nil || !AliasRoutings[routing] {
+			return nil, "", fmt.Errorf("manager_alias: unknown routing: %s,"+
+				" name: %s", params["routing"], aliasName)
+		}
+	}
+
+	rv := make([]AliasTarget, 0, len(targets))
+	for target, targetJSON := range targets {
+		indexDef := indexDefs.IndexDefs[target]
+		if indexDef == nil {
+			return nil, "", fmt.Errorf("manager_alias: no target index: %s,"+
+				" name: %s", target, aliasName)
+		}
+
+		t := struct {
+			IndexUUID string `json:"indexUUID"`
+			Weight    int    `json:"weight"`
+		}{Weight: 1}
+		json.Unmarshal(targetJSON, &t)
+		if t.IndexUUID != "" && t.IndexUUID != indexDef.UUID {
+			return nil, "", fmt.Errorf("manager_alias: target index: %s,"+
+				" UUID mismatch, name: %s", target, aliasName)
+		}
+
+		rv = append(rv, AliasTarget{
+			IndexName: indexDef.Name,
+			IndexUUID: indexDef.UUID,
+			IndexType: indexDef.Type,
+			Weight:    t.Weight,
+		})
+	}
+
+	sort.Sort(aliasTargetsByIndexName(rv))
+
+	return rv, routing, nil
+}
+
+// RouteAlias returns the targets of an index alias that serve a count
+// or query, per the alias's routing policy.
+func (mgr *Manager) RouteAlias(aliasName string) ([]AliasTarget, error) {
+	targets, routing, err := mgr.aliasTargets(aliasName)
+	if err != nil || routing == ALIAS_ROUTING_ALL {
+		return targets, err
+	}
+
+	var healthy []AliasTarget
+	totWeight := 0
+	for _, target := range targets {
+		if target.Weight > 0 && mgr.aliasTargetHealthy(target) {
+			healthy = append(healthy, target)
+			totWeight += target.Weight
+		}
+	}
+	if len(healthy) <= 0 {
+		return nil, fmt.Errorf("manager_alias: no healthy targets,"+
+			" name: %s, routing: %s", aliasName, routing)
+	}
+
+	if routing == ALIAS_ROUTING_FIRST_HEALTHY {
+		sort.Stable(aliasTargetsByWeight(healthy))
+		return healthy[:1], nil
+	}
+
+	n := AliasRandIntn(totWeight)
+	for _, target := range healthy {
+		n -= target.Weight
+		if n < 0 {
+			return []AliasTarget{target}, nil
+		}
+	}
+	return healthy[len(healthy)-1:], nil
+}
+
+// AliasRandIntn chooses the weighted targets of aliases, and may be
+// overridden, such as for testing.
+var AliasRandIntn = rand.Intn
+
+// aliasTargetHealthy returns true if every partition of an alias
+// target has a readable pindex.
+func (mgr *Manager) aliasTargetHealthy(target AliasTarget) bool {
+	_, _, err := mgr.CoveringPIndexes(target.IndexName, target.IndexUUID,
+		PlanPIndexNodeCanRead, "queries")
+	return err == nil
+}
+
+type aliasTargetsByIndexName []AliasTarget
+
+func (a aliasTargetsByIndexName) Len() int {
+	return len(a)
+}
+
+func (a aliasTargetsByIndexName) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a aliasTargetsByIndexName) Less(i, j int) bool {
+	return a[i].IndexName < a[j].IndexName
+}
+
+type aliasTargetsByWeight []AliasTarget
+
+func (a aliasTargetsByWeight) Len() int {
+	return len(a)
+}
+
+func (a aliasTargetsByWeight) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a aliasTargetsByWeight) Less(i, j int) bool {
+	return a[i].Weight > a[j].Weight
+}
+
+// groupAliasTargets groups alias targets by index type, returning the
+// index types in sorted order.
+func groupAliasTargets(targets []AliasTarget) (
+	[]string, map[string][]AliasTarget) {
+	var indexTypes []string
+
+	groups := map[string][]AliasTarget{}
+	for _, target := range targets {
+		if groups[target.IndexType] == nil {
+			indexTypes = append(indexTypes, target.IndexType)
+		}
+		groups[target.IndexType] = append(groups[target.IndexType], target)
+	}
+
+	sort.Strings(indexTypes)
+
+	return indexTypes, groups
+}
+
+// CountAlias counts the documents of the routed targets of an index
+// alias (see RouteAlias()), dispatching each group of targets of the
+// same index type to that type's AliasCount(), or else counting each
+// target on its own.
+func (mgr *Manager) CountAlias(ctx context.Context, aliasName string) (
+	uint64, error) {
+	targets, err := mgr.RouteAlias(aliasName)
+	if err != nil {
+		return 0, err
+	}
+
+	indexTypes, groups := groupAliasTargets(targets)
+
+	rv, err := ScatterGather(ctx, indexTypes, ScatterGatherOptions{},
+		func(ctx context.Context, indexType string) (interface{}, error) {
+			t := PIndexImplTypes[indexType]
+			if t == nil {
+				return nil, fmt.Errorf("manager_alias: no pindexImplType,"+
+					" indexType: %s", indexType)
+			}
+
+			if t.AliasCount != nil {
+				return t.AliasCount(ctx, mgr, groups[indexType])
+			}
+
+			var count uint64
+			for _, target := range groups[indexType] {
+				n, err := t.CountContext(ctx, mgr,
+					target.IndexName, target.IndexUUID)
+				if err != nil {
+					return nil, err
+				}
+				count += n
+			}
+			return count, nil
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	for _, n := range rv.Results {
+		count += n.(uint64)
+	}
+
+	return count, nil
+}
+
+// QueryAlias queries the routed targets of an index alias (see
+// RouteAlias()), which must all be of the same index type,
+// dispatching to that type's AliasQuery(), or else to its regular
+// query func when a single target is routed to.
+func (mgr *Manager) QueryAlias(ctx context.Context, aliasName string,
+	req []byte, res io.Writer) error {
+	targets, err := mgr.RouteAlias(aliasName)
+	if err != nil {
+		return err
+	}
+	if len(targets) <= 0 {
+		return fmt.Errorf("manager_alias: no targets, name: %s", aliasName)
+	}
+
+	indexTypes, _ := groupAliasTargets(targets)
+	if len(indexTypes) > 1 {
+		return fmt.Errorf("manager_alias: targets have mixed index types,"+
+			" name: %s, indexTypes: %v", aliasName, indexTypes)
+	}
+
+	t := PIndexImplTypes[indexTypes[0]]
+	if t == nil {
+		return fmt.Errorf("manager_alias: no pindexImplType,"+
+			" indexType: %s", indexTypes[0])
+	}
+
+	if t.AliasQuery != nil {
+		return t.AliasQuery(ctx, mgr, targets, req, res)
+	}
+
+	if len(targets) == 1 {
+		return t.QueryContext(ctx, mgr,
+			targets[0].IndexName, targets[0].IndexUUID, req, res)
+	}
+
+	return fmt.Errorf("manager_alias: AliasQuery not supported,"+
+		" name: %s, indexType: %s", aliasName, indexTypes[0])
+}
@@ -0,0 +1,294 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateAliasTargets(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	for _, indexName := range []string{"blue", "green"} {
+		if err := m.CreateIndex("primary", "default", "123", "",
+			"blackhole", indexName, "", PlanParams{}, ""); err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+	if err := m.CreateIndex("nil", "", "", "",
+		"blackhole", "live", `{"targets":{"blue":{}},"other":1}`,
+		PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() of alias to work, err: %v", err)
+	}
+
+	targets := func() map[string]interface{} {
+		indexDef, _, _ := m.GetIndexDef("live", false)
+		var params map[string]interface{}
+		json.Unmarshal([]byte(indexDef.Params), &params)
+		if params["other"] != 1.0 {
+			t.Errorf("expected other params to be kept, got: %v", params)
+		}
+		targets, _ := params["targets"].(map[string]interface{})
+		return targets
+	}
+
+	aliasDef, _, _ := m.GetIndexDef("live", false)
+
+	uuid, err := m.UpdateAliasTargets("live", AliasTargetsUpdate{
+		PrevIndexUUID: aliasDef.UUID,
+		Remove:        []string{"blue"},
+		Add:           []string{"green"},
+	})
+	if err != nil || uuid == "" || uuid == aliasDef.UUID {
+		t.Errorf("expected swap to work, uuid: %s, err: %v", uuid, err)
+	}
+	if !reflect.DeepEqual(targets(),
+		map[string]interface{}{"green": map[string]interface{}{}}) {
+		t.Errorf("expected green target, got: %v", targets())
+	}
+
+	// The stale UUID must fail.
+	_, err = m.UpdateAliasTargets("live", AliasTargetsUpdate{
+		PrevIndexUUID: aliasDef.UUID,
+		Add:           []string{"blue"},
+	})
+	if err == nil {
+		t.Errorf("expected stale prevIndexUUID to fail")
+	}
+
+	for _, u := range []AliasTargetsUpdate{
+		{Add: []string{"missing"}},
+		{Add: []string{"live"}},
+		{Remove: []string{"blue"}},
+	} {
+		_, err = m.UpdateAliasTargets("live", u)
+		if err == nil {
+			t.Errorf("expected err for update: %+v", u)
+		}
+	}
+
+	_, err = m.UpdateAliasTargets("not-an-alias", AliasTargetsUpdate{})
+	if err == nil {
+		t.Errorf("expected err for missing alias")
+	}
+
+	_, err = m.UpdateAliasTargets("live", AliasTargetsUpdate{
+		Add: []string{"blue"},
+	})
+	if err != nil || len(targets()) != 2 {
+		t.Errorf("expected add-target to work, targets: %v, err: %v",
+			targets(), err)
+	}
+
+	_, err = m.UpdateAliasTargets("live", AliasTargetsUpdate{
+		Weights: map[string]int{"blue": 3},
+		Routing: ALIAS_ROUTING_WEIGHTED,
+	})
+	if err != nil {
+		t.Errorf("expected weights and routing to work, err: %v", err)
+	}
+	aliasTargets, routing, err := m.aliasTargets("live")
+	if err != nil || routing != ALIAS_ROUTING_WEIGHTED ||
+		len(aliasTargets) != 2 ||
+		aliasTargets[0].Weight != 3 || aliasTargets[1].Weight != 1 {
+		t.Errorf("expected weighted targets, got: %+v, routing: %s, err: %v",
+			aliasTargets, routing, err)
+	}
+
+	for _, u := range []AliasTargetsUpdate{
+		{Weights: map[string]int{"missing": 1}},
+		{Weights: map[string]int{"blue": -1}},
+		{Routing: "random"},
+	} {
+		_, err = m.UpdateAliasTargets("live", u)
+		if err == nil {
+			t.Errorf("expected err for update: %+v", u)
+		}
+	}
+}
+
+func TestCountAndQueryAlias(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	blackhole := PIndexImplTypes["blackhole"]
+	defer func() {
+		blackhole.CountCtx = nil
+		blackhole.QueryCtx = nil
+		blackhole.AliasCount = nil
+		blackhole.AliasQuery = nil
+	}()
+
+	blackhole.CountCtx = func(ctx context.Context, mgr *Manager,
+		indexName, indexUUID string) (uint64, error) {
+		return uint64(len(indexName)), nil
+	}
+	blackhole.QueryCtx = func(ctx context.Context, mgr *Manager,
+		indexName, indexUUID string, req []byte, res io.Writer) error {
+		_, err := res.Write([]byte(indexName))
+		return err
+	}
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	for _, indexName := range []string{"blue", "green"} {
+		if err := m.CreateIndex("primary", "default", "123", "",
+			"blackhole", indexName, "", PlanParams{}, ""); err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+	for aliasName, params := range map[string]string{
+		"one":  `{"targets":{"blue":{}}}`,
+		"both": `{"targets":{"blue":{},"green":{}}}`,
+	} {
+		if err := m.CreateIndex("nil", "", "", "", "blackhole", aliasName,
+			params, PlanParams{}, ""); err != nil {
+			t.Fatalf("expected CreateIndex() of alias to work, err: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+
+	count, err := m.CountAlias(ctx, "both")
+	if err != nil || count != uint64(len("blue")+len("green")) {
+		t.Errorf("expected per-target counts, count: %d, err: %v",
+			count, err)
+	}
+
+	var res bytes.Buffer
+	err = m.QueryAlias(ctx, "one", nil, &res)
+	if err != nil || res.String() != "blue" {
+		t.Errorf("expected single target query, res: %s, err: %v",
+			res.String(), err)
+	}
+
+	err = m.QueryAlias(ctx, "both", nil, &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("expected err for multiple targets without AliasQuery")
+	}
+
+	var gathered []AliasTarget
+
+	blackhole.AliasCount = func(ctx context.Context, mgr *Manager,
+		targets []AliasTarget) (uint64, error) {
+		return 100, nil
+	}
+	blackhole.AliasQuery = func(ctx context.Context, mgr *Manager,
+		targets []AliasTarget, req []byte, res io.Writer) error {
+		gathered = targets
+		return nil
+	}
+
+	count, err = m.CountAlias(ctx, "both")
+	if err != nil || count != 100 {
+		t.Errorf("expected AliasCount, count: %d, err: %v", count, err)
+	}
+
+	err = m.QueryAlias(ctx, "both", nil, &bytes.Buffer{})
+	if err != nil || len(gathered) != 2 ||
+		gathered[0].IndexName != "blue" || gathered[1].IndexName != "green" ||
+		gathered[0].IndexType != "blackhole" {
+		t.Errorf("expected AliasQuery, gathered: %+v, err: %v",
+			gathered, err)
+	}
+}
+
+func TestRouteAlias(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	defer func() { AliasRandIntn = rand.Intn }()
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	for _, indexName := range []string{"blue", "green"} {
+		if err := m.CreateIndex("primary", "default", "123", "",
+			"blackhole", indexName, "", PlanParams{}, ""); err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+	for aliasName, params := range map[string]string{
+		"all":      `{"targets":{"blue":{},"green":{}}}`,
+		"first":    `{"targets":{"blue":{},"green":{"weight":2}},"routing":"firstHealthy"}`,
+		"weighted": `{"targets":{"blue":{"weight":2},"green":{}},"routing":"weighted"}`,
+		"none":     `{"targets":{"blue":{"weight":0}},"routing":"weighted"}`,
+	} {
+		if err := m.CreateIndex("nil", "", "", "", "blackhole", aliasName,
+			params, PlanParams{}, ""); err != nil {
+			t.Fatalf("expected CreateIndex() of alias to work, err: %v", err)
+		}
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	routed := func(aliasName string) []string {
+		targets, err := m.RouteAlias(aliasName)
+		if err != nil {
+			t.Errorf("expected RouteAlias() to work, alias: %s, err: %v",
+				aliasName, err)
+		}
+		var rv []string
+		for _, target := range targets {
+			rv = append(rv, target.IndexName)
+		}
+		return rv
+	}
+
+	if got := routed("all"); !reflect.DeepEqual(got,
+		[]string{"blue", "green"}) {
+		t.Errorf("expected all targets, got: %v", got)
+	}
+	if got := routed("first"); !reflect.DeepEqual(got, []string{"green"}) {
+		t.Errorf("expected heaviest healthy target, got: %v", got)
+	}
+
+	AliasRandIntn = func(n int) int { return 0 }
+	if got := routed("weighted"); !reflect.DeepEqual(got,
+		[]string{"blue"}) {
+		t.Errorf("expected low pick of blue, got: %v", got)
+	}
+	AliasRandIntn = func(n int) int { return n - 1 }
+	if got := routed("weighted"); !reflect.DeepEqual(got,
+		[]string{"green"}) {
+		t.Errorf("expected high pick of green, got: %v", got)
+	}
+
+	if _, err := m.RouteAlias("none"); err == nil {
+		t.Errorf("expected err without weighted targets")
+	}
+}
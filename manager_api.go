@@ -12,6 +12,7 @@
 package cbgt
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"sync/atomic"
@@ -30,15 +31,24 @@ func (mgr *Manager) CreateIndex(sourceType,
 	prevIndexUUID string) error {
 	atomic.AddUint64(&mgr.stats.TotCreateIndex, 1)
 
-	matched, err := regexp.Match(INDEX_NAME_REGEXP, []byte(indexName))
-	if err != nil {
-		return fmt.Errorf("manager_api: CreateIndex,"+
-			" indexName parsing problem,"+
-			" indexName: %s, err: %v", indexName, err)
+	// An indexName may be qualified by a namespace, where both parts
+	// must be valid names.
+	ns, indexNameInNS := SplitNamespacedIndexName(indexName)
+	names := []string{indexNameInNS}
+	if ns != "" || indexNameInNS != indexName {
+		names = append(names, ns)
 	}
-	if !matched {
-		return fmt.Errorf("manager_api: CreateIndex,"+
-			" indexName is invalid, indexName: %q", indexName)
+	for _, name := range names {
+		matched, err := regexp.Match(INDEX_NAME_REGEXP, []byte(name))
+		if err != nil {
+			return fmt.Errorf("manager_api: CreateIndex,"+
+				" indexName parsing problem,"+
+				" indexName: %s, err: %v", indexName, err)
+		}
+		if !matched {
+			return fmt.Errorf("manager_api: CreateIndex,"+
+				" indexName is invalid, indexName: %q", indexName)
+		}
 	}
 
 	pindexImplType, exists := PIndexImplTypes[indexType]
@@ -54,6 +64,29 @@ func (mgr *Manager) CreateIndex(sourceType,
 		}
 	}
 
+	// The index and source params, when provided, are JSON objects.
+	for _, params := range []string{indexParams, sourceParams} {
+		if params == "" {
+			continue
+		}
+		var m map[string]interface{}
+		err := json.Unmarshal([]byte(params), &m)
+		if err != nil {
+			return fmt.Errorf("manager_api: CreateIndex,"+
+				" params are not a JSON object, params: %q, err: %v",
+				params, err)
+		}
+	}
+
+	// New plan features are gated until the cluster is upgraded.
+	err := mgr.checkIndexDefCompat(&IndexDef{
+		Namespace:  ns,
+		PlanParams: planParams,
+	})
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex, err: %v", err)
+	}
+
 	// First, check that the source exists.
 	sourceParams, err = DataSourcePrepParams(sourceType,
 		sourceName, sourceUUID, sourceParams, mgr.server, mgr.Options())
@@ -123,6 +156,7 @@ func (mgr *Manager) CreateIndex(sourceType,
 			SourceUUID:   sourceUUID,
 			SourceParams: sourceParams,
 			PlanParams:   planParams,
+			Namespace:    ns,
 		}
 
 		indexDefs.UUID = indexUUID
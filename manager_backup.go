@@ -0,0 +1,621 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// PINDEX_BACKUP_FILENAME is the name of the archive entry that
+// describes each pindex in a backup archive.  It's not installed into
+// the pindex's directory on restore.
+const PINDEX_BACKUP_FILENAME string = "PINDEX_BACKUP"
+
+// A PIndexBackup describes a backed up pindex, including the files
+// and checksums of the pindex's directory and the last sequence
+// numbers that the pindex had persisted for each source partition,
+// both taken while ingest into the pindex was paused.
+type PIndexBackup struct {
+	PIndexFiles
+	Seqs map[string]uint64 `json:"seqs"`
+}
+
+// PausePIndex pauses ingest into a local pindex, by synchronously
+// stopping the pindex's feeds and flushing any mutations that their
+// dests have buffered, and then leaving the pindex as-is, even if the
+// plan changes, until a matching ResumePIndex().  On nodes with a
+// janitor, the janitor stops the feeds, and otherwise the feeds are
+// stopped directly.  Pauses are ref-counted.
+func (mgr *Manager) PausePIndex(pindexName string) {
+	mgr.m.Lock()
+	if mgr.pausedPIndexes == nil {
+		mgr.pausedPIndexes = map[string]int{}
+	}
+	mgr.pausedPIndexes[pindexName]++
+	first := mgr.pausedPIndexes[pindexName] == 1
+	mgr.m.Unlock()
+
+	feeds := mgr.pindexFeeds(pindexName)
+
+	if mgr.janitorEnabled() {
+		mgr.JanitorKick("api/PausePIndex, pindex: " + pindexName)
+	} else if first {
+		_, pindexes := mgr.CurrentMaps()
+
+		var stopped [][]*PIndex
+		for _, feed := range feeds {
+			err := mgr.stopFeed(feed)
+			if err != nil {
+				log.Printf("manager_backup: PausePIndex, stopFeed,"+
+					" pindex: %s, feed: %s, err: %v",
+					pindexName, feed.Name(), err)
+				continue
+			}
+			stopped = append(stopped, feedPIndexes(feed, pindexes))
+		}
+
+		mgr.m.Lock()
+		if mgr.pausedFeeds == nil {
+			mgr.pausedFeeds = map[string][][]*PIndex{}
+		}
+		mgr.pausedFeeds[pindexName] = stopped
+		mgr.m.Unlock()
+	}
+
+	for _, feed := range feeds {
+		flushFeedDests(feed)
+	}
+}
+
+// ResumePIndex undoes a previous PausePIndex(), so that the pindex's
+// feeds are restarted, and continue from the pindex's persisted
+// sequence numbers.
+func (mgr *Manager) ResumePIndex(pindexName string) {
+	var stopped [][]*PIndex
+
+	mgr.m.Lock()
+	if mgr.pausedPIndexes[pindexName] > 1 {
+		mgr.pausedPIndexes[pindexName]--
+	} else {
+		delete(mgr.pausedPIndexes, pindexName)
+		stopped = mgr.pausedFeeds[pindexName]
+		delete(mgr.pausedFeeds, pindexName)
+	}
+	mgr.m.Unlock()
+
+	if mgr.janitorEnabled() {
+		mgr.JanitorKick("api/ResumePIndex, pindex: " + pindexName)
+		return
+	}
+
+	_, currPIndexes := mgr.CurrentMaps()
+
+	for _, pindexes := range stopped {
+		var restart []*PIndex
+		for _, pindex := range pindexes {
+			if currPIndexes[pindex.Name] == pindex &&
+				!mgr.IsPIndexPaused(pindex.Name) {
+				restart = append(restart, pindex)
+			}
+		}
+
+		err := mgr.startFeed(restart)
+		if err != nil {
+			log.Printf("manager_backup: ResumePIndex, startFeed,"+
+				" pindex: %s, err: %v", pindexName, err)
+		}
+	}
+}
+
+// janitorEnabled returns true when this node runs a janitor, which
+// then owns the starting and stopping of feeds.
+func (mgr *Manager) janitorEnabled() bool {
+	return mgr.tagsMap == nil ||
+		(mgr.tagsMap["pindex"] && mgr.tagsMap["janitor"])
+}
+
+// pindexFeeds returns the current feeds that send to a pindex.
+func (mgr *Manager) pindexFeeds(pindexName string) []Feed {
+	feeds, pindexes := mgr.CurrentMaps()
+
+	pindex := pindexes[pindexName]
+	if pindex == nil {
+		return nil
+	}
+
+	var rv []Feed
+	for _, feed := range feeds {
+		for _, dest := range feed.Dests() {
+			if unwrapFeedDest(dest) == pindex.Dest {
+				rv = append(rv, feed)
+				break
+			}
+		}
+	}
+
+	return rv
+}
+
+// feedPIndexes returns the pindexes that a feed sends to.
+func feedPIndexes(feed Feed, pindexes map[string]*PIndex) []*PIndex {
+	dests := map[Dest]bool{}
+	for _, dest := range feed.Dests() {
+		dests[unwrapFeedDest(dest)] = true
+	}
+
+	var rv []*PIndex
+	for _, pindex := range pindexes {
+		if pindex.Dest != nil && dests[pindex.Dest] {
+			rv = append(rv, pindex)
+		}
+	}
+
+	sort.Sort(pindexesByName(rv))
+
+	return rv
+}
+
+type pindexesByName []*PIndex
+
+func (a pindexesByName) Len() int           { return len(a) }
+func (a pindexesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a pindexesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// flushFeedDests applies the mutations that a stopped feed's dests
+// have buffered, so that they're reflected in the pindexes' files
+// and persisted sequence numbers.
+func flushFeedDests(feed Feed) {
+	for partition, dest := range feed.Dests() {
+		for {
+			if d, ok := dest.(*DestBatcher); ok {
+				err := d.flush(partition)
+				if err != nil {
+					log.Printf("manager_backup: flushFeedDests,"+
+						" feed: %s, partition: %s, err: %v",
+						feed.Name(), partition, err)
+				}
+				break
+			}
+
+			next := unwrapFeedDestOnce(dest)
+			if next == dest {
+				break
+			}
+			dest = next
+		}
+	}
+}
+
+// IsPIndexPaused returns true if ingest into a pindex is paused.
+func (mgr *Manager) IsPIndexPaused(pindexName string) bool {
+	mgr.m.Lock()
+	rv := mgr.pausedPIndexes[pindexName] > 0
+	mgr.m.Unlock()
+	return rv
+}
+
+// filterPausedPIndexes removes the paused pindexes from the outputs
+// of CalcPIndexesDelta().
+func (mgr *Manager) filterPausedPIndexes(addPlanPIndexes []*PlanPIndex,
+	removePIndexes []*PIndex) ([]*PlanPIndex, []*PIndex) {
+	var addRV []*PlanPIndex
+	for _, planPIndex := range addPlanPIndexes {
+		if !mgr.IsPIndexPaused(planPIndex.Name) {
+			addRV = append(addRV, planPIndex)
+		}
+	}
+
+	var removeRV []*PIndex
+	for _, pindex := range removePIndexes {
+		if !mgr.IsPIndexPaused(pindex.Name) {
+			removeRV = append(removeRV, pindex)
+		}
+	}
+
+	return addRV, removeRV
+}
+
+// ------------------------------------------------------------------------
+
+// LocalPIndexNamesForIndex returns the sorted names of the local
+// pindexes of an index.
+func (mgr *Manager) LocalPIndexNamesForIndex(indexName string) []string {
+	var rv []string
+
+	_, pindexes := mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if pindex.IndexName == indexName {
+			rv = append(rv, pindex.Name)
+		}
+	}
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// BackupPIndexes writes a tar archive of the named local pindexes to
+// w.  Ingest into each pindex is paused while its files are copied
+// into a snapshot, so that the archive holds a consistent snapshot of
+// each pindex's files, including its PINDEX_META and whatever
+// sequence numbers and opaque state the pindex implementation has
+// persisted.
+func (mgr *Manager) BackupPIndexes(pindexNames []string, w io.Writer) error {
+	err := mgr.backupPIndexes(pindexNames, w)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotBackupPIndexErr, 1)
+		return err
+	}
+
+	atomic.AddUint64(&mgr.stats.TotBackupPIndex, uint64(len(pindexNames)))
+
+	return nil
+}
+
+func (mgr *Manager) backupPIndexes(pindexNames []string, w io.Writer) error {
+	pindexes := make([]*PIndex, 0, len(pindexNames))
+	for _, pindexName := range pindexNames {
+		pindex := mgr.GetPIndex(pindexName)
+		if pindex == nil {
+			return fmt.Errorf("manager_backup: no pindex, pindexName: %s",
+				pindexName)
+		}
+		pindexes = append(pindexes, pindex)
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, pindex := range pindexes {
+		err := mgr.backupPIndex(pindex, tw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func (mgr *Manager) backupPIndex(pindex *PIndex, tw *tar.Writer) error {
+	backup, snapshotDir, err := mgr.snapshotPIndexBackup(pindex)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		os.RemoveAll(snapshotDir)
+		os.Remove(pindex.Path + pindexSnapshotSuffix) // Only when empty.
+	}()
+
+	buf, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+
+	dir := pindex.Name + pindexPathSuffix
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     dir + "/" + PINDEX_BACKUP_FILENAME,
+		Mode:     0600,
+		Size:     int64(len(buf)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range backup.Files {
+		path, err := pindexFilePath(snapshotDir, file.Path)
+		if err != nil {
+			return err
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:     dir + "/" + file.Path,
+			Mode:     0600,
+			Size:     file.Size,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, file.Size)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("manager_backup: pindex: %s, file: %s,"+
+				" err: %v", pindex.Name, file.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotPIndexBackup pauses ingest into a pindex while it records
+// the pindex's persisted sequence numbers and copies the pindex's
+// files into a new snapshot directory, so that the seqs and the files
+// of a backup are from the same point in time.  The caller should
+// remove the returned snapshot directory.
+func (mgr *Manager) snapshotPIndexBackup(pindex *PIndex) (
+	*PIndexBackup, string, error) {
+	snapshotDir := filepath.Join(pindex.Path+pindexSnapshotSuffix, NewUUID())
+
+	seqs := map[string]uint64{}
+
+	mgr.PausePIndex(pindex.Name)
+
+	var err error
+	if pindex.Dest != nil {
+		for partition := range pindex.sourcePartitionsMap {
+			_, lastSeq, errGet := pindex.Dest.OpaqueGet(partition)
+			if errGet != nil {
+				err = fmt.Errorf("manager_backup: OpaqueGet,"+
+					" pindex: %s, partition: %s, err: %v",
+					pindex.Name, partition, errGet)
+				break
+			}
+			seqs[partition] = lastSeq
+		}
+	}
+	if err == nil {
+		err = copyPIndexFiles(pindex, snapshotDir)
+	}
+
+	mgr.ResumePIndex(pindex.Name)
+
+	if err != nil {
+		os.RemoveAll(snapshotDir)
+		return nil, "", err
+	}
+
+	files, err := listPIndexFiles(pindex, snapshotDir)
+	if err != nil {
+		os.RemoveAll(snapshotDir)
+		return nil, "", err
+	}
+
+	return &PIndexBackup{PIndexFiles: *files, Seqs: seqs}, snapshotDir, nil
+}
+
+// ------------------------------------------------------------------------
+
+// RestorePIndexes installs the pindexes from a tar archive that was
+// written by BackupPIndexes(), returning the names of the restored
+// pindexes.  Every pindex in the archive is verified against its
+// checksums and must be planned for this node, or nothing is
+// restored.  Any existing local copy of a restored pindex is removed,
+// and the janitor then reopens the restored pindex, whose feed
+// resumes from the pindex's persisted sequence numbers.
+func (mgr *Manager) RestorePIndexes(r io.Reader) ([]string, error) {
+	pindexNames, err := mgr.restorePIndexes(r)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotRestorePIndexErr, 1)
+		return nil, err
+	}
+
+	atomic.AddUint64(&mgr.stats.TotRestorePIndex, uint64(len(pindexNames)))
+
+	return pindexNames, nil
+}
+
+func (mgr *Manager) restorePIndexes(r io.Reader) ([]string, error) {
+	stageDir, err := ioutil.TempDir(mgr.dataDir, "restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stageDir)
+
+	backups, err := untarPIndexes(r, stageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pindexNames := make([]string, 0, len(backups))
+
+	for pindexName, backup := range backups {
+		err = verifyRestoredPIndex(mgr.uuid, planPIndexes,
+			filepath.Join(stageDir, pindexName+pindexPathSuffix), backup)
+		if err != nil {
+			return nil, err
+		}
+		pindexNames = append(pindexNames, pindexName)
+	}
+
+	sort.Strings(pindexNames)
+
+	for _, pindexName := range pindexNames {
+		err = mgr.installRestoredPIndex(pindexName,
+			filepath.Join(stageDir, pindexName+pindexPathSuffix))
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("manager_backup: restored pindex: %s, seqs: %v",
+			pindexName, backups[pindexName].Seqs)
+	}
+
+	return pindexNames, nil
+}
+
+// untarPIndexes extracts a backup archive into the stage directory,
+// returning the PIndexBackup descriptions keyed by pindex name.
+func untarPIndexes(r io.Reader, stageDir string) (
+	map[string]*PIndexBackup, error) {
+	backups := map[string]*PIndexBackup{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("manager_backup: read archive, err: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], pindexPathSuffix) ||
+			parts[0] == pindexPathSuffix {
+			return nil, fmt.Errorf("manager_backup: unexpected archive"+
+				" entry: %q", hdr.Name)
+		}
+
+		pindexName := strings.TrimSuffix(parts[0], pindexPathSuffix)
+
+		if parts[1] == PINDEX_BACKUP_FILENAME {
+			backup := &PIndexBackup{}
+			err = json.NewDecoder(tr).Decode(backup)
+			if err != nil || backup.PIndexName != pindexName {
+				return nil, fmt.Errorf("manager_backup: could not parse"+
+					" %s, pindex: %s, err: %v",
+					PINDEX_BACKUP_FILENAME, pindexName, err)
+			}
+			backups[pindexName] = backup
+			continue
+		}
+
+		if backups[pindexName] == nil {
+			return nil, fmt.Errorf("manager_backup: missing %s,"+
+				" pindex: %s", PINDEX_BACKUP_FILENAME, pindexName)
+		}
+
+		path, err := pindexFilePath(filepath.Join(stageDir, parts[0]), parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		errClose := f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if errClose != nil {
+			return nil, errClose
+		}
+	}
+
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("manager_backup: no pindexes in archive")
+	}
+
+	return backups, nil
+}
+
+// verifyRestoredPIndex checks an extracted pindex against the
+// checksums of its PIndexBackup and against the current plan.
+func verifyRestoredPIndex(nodeUUID string, planPIndexes *PlanPIndexes,
+	path string, backup *PIndexBackup) error {
+	for _, file := range backup.Files {
+		filePath, err := pindexFilePath(path, file.Path)
+		if err != nil {
+			return err
+		}
+		checksum, err := checksumFile(filePath)
+		if err != nil || checksum != file.Checksum {
+			return fmt.Errorf("manager_backup: checksum mismatch,"+
+				" pindex: %s, file: %s, err: %v",
+				backup.PIndexName, file.Path, err)
+		}
+	}
+
+	buf, err := ReadPIndexMeta(path)
+	if err != nil {
+		return fmt.Errorf("manager_backup: could not load"+
+			" PINDEX_META_FILENAME, pindex: %s, err: %v",
+			backup.PIndexName, err)
+	}
+
+	pindex := &PIndex{}
+	err = json.Unmarshal(buf, pindex)
+	if err != nil {
+		return fmt.Errorf("manager_backup: could not parse"+
+			" PINDEX_META_FILENAME, pindex: %s, err: %v",
+			backup.PIndexName, err)
+	}
+
+	var planPIndex *PlanPIndex
+	if planPIndexes != nil {
+		planPIndex = planPIndexes.PlanPIndexes[backup.PIndexName]
+	}
+	if planPIndex == nil || planPIndex.Nodes[nodeUUID] == nil ||
+		!PIndexMatchesPlan(pindex, planPIndex) {
+		return fmt.Errorf("manager_backup: pindex is not planned"+
+			" for this node, pindex: %s", backup.PIndexName)
+	}
+
+	return nil
+}
+
+// installRestoredPIndex replaces any local copy of a pindex with the
+// extracted pindex directory.  The pindex is paused meanwhile, so the
+// janitor won't concurrently (re-)create the pindex.
+func (mgr *Manager) installRestoredPIndex(pindexName, stagePath string) error {
+	mgr.PausePIndex(pindexName)
+	defer mgr.ResumePIndex(pindexName)
+
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex != nil {
+		err := mgr.RemovePIndex(pindex)
+		if err != nil {
+			return fmt.Errorf("manager_backup: could not remove pindex: %s,"+
+				" err: %v", pindexName, err)
+		}
+	}
+
+	path := mgr.PIndexPath(pindexName)
+
+	err := os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+
+	err = mgr.mkPIndexParentDir(path)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(stagePath, path)
+}
@@ -0,0 +1,201 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerPausePIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexNames := m.LocalPIndexNamesForIndex("foo")
+	if len(pindexNames) != 1 {
+		t.Errorf("expected 1 pindex, got: %v", pindexNames)
+	}
+
+	m.PausePIndex(pindexNames[0])
+	m.PausePIndex(pindexNames[0])
+	feeds, pindexes := m.CurrentMaps()
+	if len(feeds) != 0 || len(pindexes) != 1 {
+		t.Errorf("expected paused pindex to have no feed,"+
+			" feeds: %+v, pindexes: %+v", feeds, pindexes)
+	}
+
+	m.ResumePIndex(pindexNames[0])
+	if !m.IsPIndexPaused(pindexNames[0]) {
+		t.Errorf("expected pindex to remain paused")
+	}
+
+	m.ResumePIndex(pindexNames[0])
+	feeds, _ = m.CurrentMaps()
+	if m.IsPIndexPaused(pindexNames[0]) || len(feeds) != 1 {
+		t.Errorf("expected resumed pindex to have a feed, feeds: %+v", feeds)
+	}
+
+	// Without a janitor, the feeds are stopped and restarted directly.
+	m.tagsMap = map[string]bool{"pindex": true}
+
+	m.PausePIndex(pindexNames[0])
+	feeds, _ = m.CurrentMaps()
+	if len(feeds) != 0 {
+		t.Errorf("expected paused pindex to have no feed without a janitor,"+
+			" feeds: %+v", feeds)
+	}
+
+	m.ResumePIndex(pindexNames[0])
+	feeds, _ = m.CurrentMaps()
+	if len(feeds) != 1 {
+		t.Errorf("expected resumed pindex to have a feed without a janitor,"+
+			" feeds: %+v", feeds)
+	}
+
+	m.tagsMap = nil
+}
+
+func TestFlushFeedDests(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, map[string]string{
+			"destBatchSize":          "10",
+			"destBatchFlushInterval": "1h",
+		})
+
+	dest := &TestDestBatch{}
+	d := m.feedDestBatch(dest)
+
+	d.SnapshotStart("0", 1, 10)
+	d.DataUpdate("0", []byte("a"), 1, []byte("x"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if dest.numBatches() != 0 {
+		t.Errorf("expected the mutation to be buffered")
+	}
+
+	flushFeedDests(NewNILFeed("f", "i", map[string]Dest{
+		"0": &DestDocTrace{Dest: d, mgr: m, indexName: "i"},
+	}))
+	if dest.numBatches() != 1 {
+		t.Errorf("expected the buffered mutation to be flushed,"+
+			" batches: %d", dest.numBatches())
+	}
+}
+
+func TestManagerBackupRestore(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexNames := m.LocalPIndexNamesForIndex("foo")
+	if len(pindexNames) != 1 {
+		t.Errorf("expected 1 pindex, got: %v", pindexNames)
+	}
+
+	if m.BackupPIndexes([]string{"not-a-pindex"}, ioutil.Discard) == nil {
+		t.Errorf("expected backup of unknown pindex to fail")
+	}
+
+	var buf bytes.Buffer
+	err := m.BackupPIndexes(pindexNames, &buf)
+	if err != nil {
+		t.Errorf("expected backup to work, err: %v", err)
+	}
+
+	entries := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected tar archive, err: %v", err)
+		}
+		entries[hdr.Name] = true
+	}
+	dir := pindexNames[0] + pindexPathSuffix
+	if len(entries) != 3 ||
+		!entries[dir+"/"+PINDEX_BACKUP_FILENAME] ||
+		!entries[dir+"/"+PINDEX_META_FILENAME] {
+		t.Errorf("expected backup entries, got: %v", entries)
+	}
+
+	_, err = m.RestorePIndexes(bytes.NewReader([]byte("not a tar")))
+	if err == nil {
+		t.Errorf("expected restore of garbage to fail")
+	}
+
+	pindexBefore := m.GetPIndex(pindexNames[0])
+
+	restored, err := m.RestorePIndexes(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(restored) != 1 || restored[0] != pindexNames[0] {
+		t.Errorf("expected restore to work, restored: %v, err: %v",
+			restored, err)
+	}
+
+	pindexAfter := m.GetPIndex(pindexNames[0])
+	if pindexAfter == nil || pindexAfter == pindexBefore ||
+		pindexAfter.UUID != pindexBefore.UUID {
+		t.Errorf("expected restored pindex to be reopened,"+
+			" before: %#v, after: %#v", pindexBefore, pindexAfter)
+	}
+	feeds, _ := m.CurrentMaps()
+	if len(feeds) != 1 {
+		t.Errorf("expected restored pindex to have a feed, feeds: %+v", feeds)
+	}
+
+	// A pindex that's no longer planned is not restored.
+	if err = m.DeleteIndex("foo"); err != nil {
+		t.Errorf("expected DeleteIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	_, err = m.RestorePIndexes(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Errorf("expected restore of unplanned pindex to fail")
+	}
+	if m.GetPIndex(pindexNames[0]) != nil {
+		t.Errorf("expected no pindex after failed restore")
+	}
+}
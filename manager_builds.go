@@ -0,0 +1,230 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaxConcurrentPIndexBuildsOption is the manager option key that
+// limits how many new pindexes may be building, or catching up with
+// their data source, at the same time on a node.  Additional new
+// pindexes are queued by the janitor until earlier builds finish.
+// Pindexes that are opened from existing files aren't limited.  No
+// limit is applied when the option is empty or "0".
+const MaxConcurrentPIndexBuildsOption = "maxConcurrentPIndexBuilds"
+
+// PINDEX_BUILDS_CHECK_INTERVAL is how often pindex builds are
+// checked for completion when builds are limited but the
+// pindexWarmupInterval manager option is not set.
+var PINDEX_BUILDS_CHECK_INTERVAL = time.Second
+
+// PINDEX_BUILD_TIMEOUT is the default of the pindexBuildTimeout
+// manager option, which is how long a pindex may be building before
+// its build is considered finished even if the pindex isn't warm,
+// such as when its source's seqs are unavailable or when the source
+// is ingesting too quickly for the pindex to ever catch up, so that
+// queued builds aren't starved.
+var PINDEX_BUILD_TIMEOUT = 30 * time.Minute
+
+// PIndexBuilds represents the new local pindexes that are building,
+// and the planned pindexes that are queued to be built.
+type PIndexBuilds struct {
+	Building []string `json:"building"`
+	Queued   []string `json:"queued"`
+}
+
+func maxConcurrentPIndexBuilds(options map[string]string) int {
+	v, err := strconv.Atoi(options[MaxConcurrentPIndexBuildsOption])
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// PIndexBuilds returns the pindexes that are building or queued.
+func (mgr *Manager) PIndexBuilds() *PIndexBuilds {
+	rv := &PIndexBuilds{Building: []string{}, Queued: []string{}}
+
+	mgr.m.Lock()
+	for pindexName := range mgr.pindexBuilds {
+		rv.Building = append(rv.Building, pindexName)
+	}
+	rv.Queued = append(rv.Queued, mgr.pindexBuildsQueued...)
+	mgr.m.Unlock()
+
+	sort.Strings(rv.Building)
+
+	return rv
+}
+
+// startPIndexBuild tracks a newly created pindex as building, when
+// builds are limited.  A build finishes when the pindex is warm (see
+// Manager.IsPIndexWarm()).
+func (mgr *Manager) startPIndexBuild(pindex *PIndex) {
+	mgr.m.Lock()
+	if maxConcurrentPIndexBuilds(mgr.options) > 0 &&
+		mgr.pindexes[pindex.Name] == pindex {
+		if mgr.pindexBuilds == nil {
+			mgr.pindexBuilds = map[string]time.Time{}
+		}
+		mgr.pindexBuilds[pindex.Name] = time.Now()
+		atomic.AddUint64(&mgr.stats.TotPIndexBuildStart, 1)
+	}
+	mgr.m.Unlock()
+}
+
+// finishPIndexBuildLOCKED returns true if the pindex was building.
+func (mgr *Manager) finishPIndexBuildLOCKED(pindexName string) bool {
+	if _, exists := mgr.pindexBuilds[pindexName]; !exists {
+		return false
+	}
+	delete(mgr.pindexBuilds, pindexName)
+	atomic.AddUint64(&mgr.stats.TotPIndexBuildDone, 1)
+	return true
+}
+
+// timeoutPIndexBuilds finishes the builds that have been building for
+// longer than the pindexBuildTimeout manager option, and kicks the
+// janitor so that any queued pindex builds may start.
+func (mgr *Manager) timeoutPIndexBuilds() {
+	timeout := mgr.optionDuration("pindexBuildTimeout")
+	if timeout <= 0 {
+		timeout = PINDEX_BUILD_TIMEOUT
+	}
+
+	var timedOut []string
+
+	mgr.m.Lock()
+	for pindexName, start := range mgr.pindexBuilds {
+		if time.Since(start) > timeout &&
+			mgr.finishPIndexBuildLOCKED(pindexName) {
+			atomic.AddUint64(&mgr.stats.TotPIndexBuildTimeout, 1)
+			timedOut = append(timedOut, pindexName)
+		}
+	}
+	mgr.m.Unlock()
+
+	if len(timedOut) > 0 {
+		sort.Strings(timedOut)
+
+		mgr.JanitorKick(fmt.Sprintf("builds: pindex builds timed out: %v",
+			timedOut))
+	}
+}
+
+// throttlePIndexBuilds splits the plan pindexes that the janitor
+// wants to add into those that can be added now, and those that
+// need to be queued because too many new pindexes are building.
+// Queued builds are ordered by their index's PlanParams.BuildPriority
+// (higher first), then by smaller PlanParams.PIndexWeights, then by
+// fewer source partitions.
+func (mgr *Manager) throttlePIndexBuilds(addPlanPIndexes []*PlanPIndex,
+	removePIndexes []*PIndex) ([]*PlanPIndex, []*PlanPIndex) {
+	maxBuilds := maxConcurrentPIndexBuilds(mgr.Options())
+	if maxBuilds <= 0 {
+		return addPlanPIndexes, nil
+	}
+
+	removing := map[string]bool{}
+	for _, removePIndex := range removePIndexes {
+		removing[removePIndex.Name] = true
+	}
+
+	numBuilding := 0
+	mgr.m.Lock()
+	for pindexName := range mgr.pindexBuilds {
+		if !removing[pindexName] {
+			numBuilding++
+		}
+	}
+	mgr.m.Unlock()
+
+	var adds, builds []*PlanPIndex
+	for _, addPlanPIndex := range addPlanPIndexes {
+		_, err := os.Stat(mgr.PIndexPath(addPlanPIndex.Name))
+		if os.IsNotExist(err) {
+			builds = append(builds, addPlanPIndex)
+		} else {
+			adds = append(adds, addPlanPIndex)
+		}
+	}
+
+	_, indexDefsByName, _ := mgr.GetIndexDefs(false)
+
+	sort.Sort(&planPIndexBuildSorter{builds, indexDefsByName})
+
+	n := maxBuilds - numBuilding
+	if n < 0 {
+		n = 0
+	}
+	if n > len(builds) {
+		n = len(builds)
+	}
+
+	return append(adds, builds[:n]...), builds[n:]
+}
+
+type planPIndexBuildSorter struct {
+	planPIndexes    []*PlanPIndex
+	indexDefsByName map[string]*IndexDef
+}
+
+func (s *planPIndexBuildSorter) Len() int {
+	return len(s.planPIndexes)
+}
+
+func (s *planPIndexBuildSorter) Swap(i, j int) {
+	s.planPIndexes[i], s.planPIndexes[j] = s.planPIndexes[j], s.planPIndexes[i]
+}
+
+func (s *planPIndexBuildSorter) Less(i, j int) bool {
+	pi, pj := s.planPIndexes[i], s.planPIndexes[j]
+
+	priorityi, weighti := s.priorityWeight(pi)
+	priorityj, weightj := s.priorityWeight(pj)
+	if priorityi != priorityj {
+		return priorityi > priorityj
+	}
+	if weighti != weightj {
+		return weighti < weightj
+	}
+
+	partitionsi := strings.Count(pi.SourcePartitions, ",")
+	partitionsj := strings.Count(pj.SourcePartitions, ",")
+	if partitionsi != partitionsj {
+		return partitionsi < partitionsj
+	}
+
+	return pi.Name < pj.Name
+}
+
+func (s *planPIndexBuildSorter) priorityWeight(
+	planPIndex *PlanPIndex) (int, int) {
+	indexDef := s.indexDefsByName[planPIndex.IndexName]
+	if indexDef == nil {
+		return 0, 1
+	}
+
+	weight, exists := indexDef.PlanParams.PIndexWeights[planPIndex.Name]
+	if !exists {
+		weight = 1
+	}
+
+	return indexDef.PlanParams.BuildPriority, weight
+}
@@ -0,0 +1,131 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestManagerMaxConcurrentPIndexBuilds(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			MaxConcurrentPIndexBuildsOption: "1",
+			// Check builds explicitly instead of in the background.
+			"pindexWarmupInterval": "1h",
+		})
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":3}`,
+		"blackhole", "foo", "", PlanParams{MaxPartitionsPerPIndex: 1},
+		""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	builds := m.PIndexBuilds()
+	if len(builds.Building) != 1 || len(builds.Queued) != 2 {
+		t.Errorf("expected 1 building and 2 queued, got: %#v", builds)
+	}
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 1 {
+		t.Errorf("expected 1 pindex, got: %d", len(pindexes))
+	}
+
+	janitorPlan, err := m.JanitorPlan()
+	if err != nil || len(janitorPlan.AddPIndexes) != 0 ||
+		len(janitorPlan.QueuedPIndexes) != 2 {
+		t.Errorf("expected queued janitor plan, got: %#v, err: %v",
+			janitorPlan, err)
+	}
+	if m.stats.NumPIndexBuildQueued != 2 {
+		t.Errorf("expected 2 queued builds, got: %d",
+			m.stats.NumPIndexBuildQueued)
+	}
+
+	// A build that doesn't finish in time no longer holds up the queue.
+	m.m.Lock()
+	for pindexName := range m.pindexBuilds {
+		m.pindexBuilds[pindexName] = time.Now().Add(-2 * PINDEX_BUILD_TIMEOUT)
+	}
+	m.m.Unlock()
+	m.timeoutPIndexBuilds()
+
+	builds = m.PIndexBuilds()
+	if len(builds.Building) != 1 || len(builds.Queued) != 1 ||
+		m.stats.TotPIndexBuildTimeout != 1 ||
+		m.stats.NumPIndexBuildQueued != 1 {
+		t.Errorf("expected a timed out build, got: %#v, timeouts: %d,"+
+			" queued: %d", builds, m.stats.TotPIndexBuildTimeout,
+			m.stats.NumPIndexBuildQueued)
+	}
+
+	// The primary source has no partition seqs, so each build
+	// finishes on its next check, which starts the next queued build.
+	for i := 0; i < 3; i++ {
+		m.WarmupOnce()
+	}
+
+	builds = m.PIndexBuilds()
+	if len(builds.Building) != 0 || len(builds.Queued) != 0 {
+		t.Errorf("expected no builds, got: %#v", builds)
+	}
+	_, pindexes = m.CurrentMaps()
+	if len(pindexes) != 3 {
+		t.Errorf("expected 3 pindexes, got: %d", len(pindexes))
+	}
+	if m.stats.TotPIndexBuildStart != 3 || m.stats.TotPIndexBuildDone != 3 {
+		t.Errorf("expected 3 build starts and dones, got: %d, %d",
+			m.stats.TotPIndexBuildStart, m.stats.TotPIndexBuildDone)
+	}
+	if m.stats.NumPIndexBuildQueued != 0 {
+		t.Errorf("expected no queued builds, got: %d",
+			m.stats.NumPIndexBuildQueued)
+	}
+}
+
+func TestPlanPIndexBuildSorter(t *testing.T) {
+	s := &planPIndexBuildSorter{
+		planPIndexes: []*PlanPIndex{
+			{Name: "a0", IndexName: "a", SourcePartitions: "0,1"},
+			{Name: "a1", IndexName: "a", SourcePartitions: "2"},
+			{Name: "b0", IndexName: "b", SourcePartitions: "0"},
+			{Name: "b1", IndexName: "b", SourcePartitions: "1"},
+		},
+		indexDefsByName: map[string]*IndexDef{
+			"b": {PlanParams: PlanParams{
+				BuildPriority: 1,
+				PIndexWeights: map[string]int{"b0": 10},
+			}},
+		},
+	}
+	sort.Sort(s)
+
+	var names []string
+	for _, planPIndex := range s.planPIndexes {
+		names = append(names, planPIndex.Name)
+	}
+	if names[0] != "b1" || names[1] != "b0" ||
+		names[2] != "a1" || names[3] != "a0" {
+		t.Errorf("expected build order by priority, weight, partitions,"+
+			" got: %v", names)
+	}
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// CfgChangeKeys returns the Cfg keys whose changes are sent to the
+// subscribers of Manager.SubscribeCfgChanges().
+func CfgChangeKeys() []string {
+	return []string{
+		INDEX_DEFS_KEY,
+		PLAN_PINDEXES_KEY,
+		CfgNodeDefsKey(NODE_DEFS_KNOWN),
+		CfgNodeDefsKey(NODE_DEFS_WANTED),
+		PLAN_ROLLOUT_KEY,
+		MAINTENANCE_SCHEDULES_KEY,
+		TASKS_KEY,
+		MANAGER_OPTIONS_KEY,
+	}
+}
+
+// SubscribeCfgChanges registers a channel that will receive the Cfg
+// events of the CfgChangeKeys(), such as for external controllers
+// that react to index definition or plan changes.  As a Cfg has no
+// way to unsubscribe, the manager subscribes to the Cfg only once,
+// on the first call, and fans out the events to its subscribers.
+// Like SubscribeEvents(), events are sent without blocking, so events
+// are dropped (see ManagerStats.TotCfgChangeDrop) when the channel
+// isn't ready.
+func (mgr *Manager) SubscribeCfgChanges(ch chan<- CfgEvent) error {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	if !mgr.cfgChangeStarted {
+		if mgr.cfg == nil {
+			return fmt.Errorf("manager_cfg_changes: no cfg")
+		}
+
+		cfgCh := make(chan CfgEvent, 10)
+		for _, key := range CfgChangeKeys() {
+			err := mgr.cfg.Subscribe(key, cfgCh)
+			if err != nil {
+				return err
+			}
+		}
+
+		go mgr.cfgChangeLoop(cfgCh)
+
+		mgr.cfgChangeStarted = true
+	}
+
+	cfgChangeSubs := make([]chan<- CfgEvent, 0, len(mgr.cfgChangeSubs)+1)
+	cfgChangeSubs = append(cfgChangeSubs, mgr.cfgChangeSubs...)
+	mgr.cfgChangeSubs = append(cfgChangeSubs, ch)
+
+	return nil
+}
+
+// UnsubscribeCfgChanges unregisters a channel previously registered
+// by SubscribeCfgChanges.
+func (mgr *Manager) UnsubscribeCfgChanges(ch chan<- CfgEvent) {
+	mgr.m.Lock()
+	cfgChangeSubs := make([]chan<- CfgEvent, 0, len(mgr.cfgChangeSubs))
+	for _, cfgChangeSub := range mgr.cfgChangeSubs {
+		if cfgChangeSub != ch {
+			cfgChangeSubs = append(cfgChangeSubs, cfgChangeSub)
+		}
+	}
+	mgr.cfgChangeSubs = cfgChangeSubs
+	mgr.m.Unlock()
+}
+
+func (mgr *Manager) cfgChangeLoop(cfgCh chan CfgEvent) {
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+
+		case e := <-cfgCh:
+			mgr.m.Lock()
+			cfgChangeSubs := mgr.cfgChangeSubs
+			mgr.m.Unlock()
+
+			for _, cfgChangeSub := range cfgChangeSubs {
+				select {
+				case cfgChangeSub <- e:
+				default:
+					atomic.AddUint64(&mgr.stats.TotCfgChangeDrop, 1)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerSubscribeCfgChanges(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	defer m.Stop()
+
+	ch0 := make(chan CfgEvent, 10)
+	ch1 := make(chan CfgEvent, 10)
+	if err := m.SubscribeCfgChanges(ch0); err != nil {
+		t.Fatalf("expected SubscribeCfgChanges() to work, err: %v", err)
+	}
+	if err := m.SubscribeCfgChanges(ch1); err != nil {
+		t.Fatalf("expected SubscribeCfgChanges() to work, err: %v", err)
+	}
+
+	next := func(ch chan CfgEvent) *CfgEvent {
+		select {
+		case e := <-ch:
+			return &e
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	cas, err := cfg.Set(INDEX_DEFS_KEY, []byte(`{}`), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work, err: %v", err)
+	}
+
+	for _, ch := range []chan CfgEvent{ch0, ch1} {
+		e := next(ch)
+		if e == nil || e.Key != INDEX_DEFS_KEY || e.CAS != cas {
+			t.Errorf("expected an indexDefs change, got: %#v", e)
+		}
+	}
+
+	m.UnsubscribeCfgChanges(ch0)
+
+	cas, err = cfg.Set(PLAN_PINDEXES_KEY, []byte(`{}`), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work, err: %v", err)
+	}
+
+	e := next(ch1)
+	if e == nil || e.Key != PLAN_PINDEXES_KEY || e.CAS != cas {
+		t.Errorf("expected a planPIndexes change, got: %#v", e)
+	}
+
+	select {
+	case e := <-ch0:
+		t.Errorf("expected no change after unsubscribe, got: %#v", e)
+	default:
+	}
+}
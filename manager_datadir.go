@@ -0,0 +1,182 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/couchbase/clog"
+)
+
+// The layout of the pindexes in a dataDir is chosen by the
+// "dataDirLayout" manager option, which is one of:
+//
+// * DATA_DIR_LAYOUT_V1 (the default) - flat, where every pindex is at
+//   dataDir/pindexName.pindex.
+// * DATA_DIR_LAYOUT_V2 - index-scoped, where every pindex is at
+//   dataDir/indexName/pindexName.pindex, so that the disk usage,
+//   backup and cleanup of an index can work on a single directory.
+//
+// Pindexes of both layouts are loaded on startup, and are first moved
+// to the configured layout, so switching the option either way is a
+// migration.
+
+// DATA_DIR_LAYOUT_V1 and DATA_DIR_LAYOUT_V2 are the dataDirLayout
+// manager option values.
+const DATA_DIR_LAYOUT_V1 = "v1"
+const DATA_DIR_LAYOUT_V2 = "v2"
+
+// DataDirLayout returns the configured layout of the dataDir.
+func (mgr *Manager) DataDirLayout() string {
+	if mgr.Options()["dataDirLayout"] == DATA_DIR_LAYOUT_V2 {
+		return DATA_DIR_LAYOUT_V2
+	}
+	return DATA_DIR_LAYOUT_V1
+}
+
+// PIndexPathEx computes the storage path for a pindex in a dataDir
+// layout.  Pindex names that don't follow PlanPIndexName() are kept
+// flat in every layout.
+func PIndexPathEx(dataDir, layout, pindexName string) string {
+	if layout == DATA_DIR_LAYOUT_V2 {
+		indexName := PIndexIndexName(pindexName)
+		if indexName != "" {
+			return IndexDataDir(dataDir, indexName) +
+				string(os.PathSeparator) + pindexName + pindexPathSuffix
+		}
+	}
+	return PIndexPath(dataDir, pindexName)
+}
+
+// IndexDataDir returns the directory of an index's pindexes in the
+// DATA_DIR_LAYOUT_V2 layout.
+func IndexDataDir(dataDir, indexName string) string {
+	return dataDir + string(os.PathSeparator) + indexName
+}
+
+// PIndexIndexName returns the index name of a pindex name that was
+// generated by PlanPIndexName(), or "" if the name has another form.
+func PIndexIndexName(pindexName string) string {
+	parts := strings.Split(pindexName, "_")
+	if len(parts) < 3 {
+		return ""
+	}
+	return strings.Join(parts[:len(parts)-2], "_")
+}
+
+// ---------------------------------------------------------------
+
+// dataDirPIndexPaths returns the paths of the pindexes in a dataDir
+// of either layout.
+func dataDirPIndexPaths(dataDir string) ([]string, error) {
+	dirEntries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []string
+
+	for _, dirInfo := range dirEntries {
+		path := dataDir + string(os.PathSeparator) + dirInfo.Name()
+		if _, ok := ParsePIndexPath(dataDir, path); ok {
+			rv = append(rv, path)
+			continue
+		}
+
+		if !dirInfo.IsDir() {
+			continue
+		}
+
+		subEntries, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+
+		for _, subInfo := range subEntries {
+			subPath := path + string(os.PathSeparator) + subInfo.Name()
+			if _, ok := ParsePIndexPath(dataDir, subPath); ok {
+				rv = append(rv, subPath)
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// MigrateDataDir moves the pindexes of the dataDir, which must not be
+// opened, into the configured dataDir layout.
+func (mgr *Manager) MigrateDataDir() error {
+	layout := mgr.DataDirLayout()
+
+	paths, err := dataDirPIndexPaths(mgr.dataDir)
+	if err != nil {
+		return fmt.Errorf("manager_datadir: could not read dataDir: %s,"+
+			" err: %v", mgr.dataDir, err)
+	}
+
+	for _, path := range paths {
+		pindexName, _ := ParsePIndexPath(mgr.dataDir, path)
+
+		wantPath := PIndexPathEx(mgr.dataDir, layout, pindexName)
+		if wantPath == path {
+			continue
+		}
+
+		if _, err = os.Stat(wantPath); err == nil {
+			log.Printf("manager_datadir: skipping migration of pindex"+
+				" path: %s, already exists: %s", path, wantPath)
+			continue
+		}
+
+		err = mgr.mkPIndexParentDir(wantPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(path, wantPath)
+		if err != nil {
+			return fmt.Errorf("manager_datadir: could not migrate pindex,"+
+				" from: %s, to: %s, err: %v", path, wantPath, err)
+		}
+
+		mgr.removeEmptyPIndexParentDir(path)
+
+		log.Printf("manager_datadir: migrated pindex, from: %s, to: %s",
+			path, wantPath)
+	}
+
+	return nil
+}
+
+// mkPIndexParentDir creates the parent directory of a pindex path,
+// which might be an index directory.
+func (mgr *Manager) mkPIndexParentDir(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("manager_datadir: could not make parent dir,"+
+			" path: %s, err: %v", path, err)
+	}
+	return nil
+}
+
+// removeEmptyPIndexParentDir removes the parent directory of a
+// removed pindex path, if it's an index directory that's now empty.
+func (mgr *Manager) removeEmptyPIndexParentDir(path string) {
+	dir := filepath.Dir(path)
+	if dir != filepath.Clean(mgr.dataDir) {
+		os.Remove(dir) // Fails if the dir isn't empty.
+	}
+}
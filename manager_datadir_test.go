@@ -0,0 +1,106 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPIndexPathEx(t *testing.T) {
+	sep := string(os.PathSeparator)
+
+	tests := []struct {
+		pindexName string
+		indexName  string
+		pathV2     string
+	}{
+		{"idx_uuid_0123abcd", "idx", "dir" + sep + "idx" + sep +
+			"idx_uuid_0123abcd.pindex"},
+		{"my_idx_uuid_0123abcd", "my_idx", "dir" + sep + "my_idx" + sep +
+			"my_idx_uuid_0123abcd.pindex"},
+		{"p0", "", "dir" + sep + "p0.pindex"},
+	}
+
+	for _, test := range tests {
+		if n := PIndexIndexName(test.pindexName); n != test.indexName {
+			t.Errorf("expected index name: %s, got: %s", test.indexName, n)
+		}
+
+		p := PIndexPathEx("dir", DATA_DIR_LAYOUT_V2, test.pindexName)
+		if p != test.pathV2 {
+			t.Errorf("expected v2 path: %s, got: %s", test.pathV2, p)
+		}
+		if n, ok := ParsePIndexPath("dir", p); !ok || n != test.pindexName {
+			t.Errorf("expected ParsePIndexPath() of v2 path: %s, got: %s",
+				p, n)
+		}
+
+		p = PIndexPathEx("dir", DATA_DIR_LAYOUT_V1, test.pindexName)
+		if p != PIndexPath("dir", test.pindexName) {
+			t.Errorf("expected flat v1 path, got: %s", p)
+		}
+	}
+
+	for _, p := range []string{
+		"dir" + sep + "other" + sep + "idx_uuid_0123abcd.pindex",
+		"dir" + sep + "idx" + sep + "x" + sep + "idx_uuid_0123abcd.pindex",
+	} {
+		if _, ok := ParsePIndexPath("dir", p); ok {
+			t.Errorf("expected ParsePIndexPath() to reject: %s", p)
+		}
+	}
+}
+
+func TestMigrateDataDir(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	names := []string{"idx_uuid_00000000", "idx_uuid_11111111", "p0"}
+	for _, name := range names {
+		os.MkdirAll(m.PIndexPath(name), 0700)
+	}
+
+	m.SetOptions(map[string]string{"dataDirLayout": DATA_DIR_LAYOUT_V2})
+
+	if err := m.MigrateDataDir(); err != nil {
+		t.Errorf("expected MigrateDataDir() to v2 to work, err: %v", err)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(m.PIndexPath(name)); err != nil {
+			t.Errorf("expected v2 path for pindex: %s, err: %v", name, err)
+		}
+	}
+
+	m.removeEmptyPIndexParentDir(m.PIndexPath("idx_uuid_00000000"))
+	if _, err := os.Stat(IndexDataDir(emptyDir, "idx")); err != nil {
+		t.Errorf("expected non-empty index dir to remain, err: %v", err)
+	}
+
+	m.SetOptions(map[string]string{"dataDirLayout": DATA_DIR_LAYOUT_V1})
+
+	if err := m.MigrateDataDir(); err != nil {
+		t.Errorf("expected MigrateDataDir() to v1 to work, err: %v", err)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(m.PIndexPath(name)); err != nil {
+			t.Errorf("expected v1 path for pindex: %s, err: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(IndexDataDir(emptyDir, "idx")); err == nil {
+		t.Errorf("expected empty index dir to be removed")
+	}
+}
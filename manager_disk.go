@@ -0,0 +1,173 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// DISK_USAGE_INTERVAL is the default interval of the measurements of
+// the on-disk sizes of the local pindexes, which can be overridden by
+// the "diskUsageInterval" manager option.
+var DISK_USAGE_INTERVAL = time.Minute
+
+// DiskUsageLoop periodically measures the on-disk sizes of the local
+// pindexes and enforces the disk free watermark, and exits when the
+// manager is stopped.
+func (mgr *Manager) DiskUsageLoop() {
+	interval := mgr.optionDuration("diskUsageInterval")
+	if interval <= 0 {
+		interval = DISK_USAGE_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		mgr.DiskUsageOnce()
+	}
+}
+
+// DiskUsageOnce measures the on-disk sizes of the local pindexes.
+// When the "diskFreeWatermarkBytes" manager option is set and the
+// free space of the data dir is below it, the ingest of the local
+// pindexes is paused via the PINDEX_READ_ONLY_BUFFER policy until the
+// free space recovers.  Pindexes that were already read-only are left
+// alone.
+func (mgr *Manager) DiskUsageOnce() {
+	_, pindexes := mgr.CurrentMaps()
+
+	diskUsage := make(map[string]uint64, len(pindexes))
+	for pindexName, pindex := range pindexes {
+		if pindex.Path != "" {
+			diskUsage[pindexName] = dirSize(pindex.Path)
+		}
+	}
+
+	mgr.m.Lock()
+	mgr.pindexDiskUsage = diskUsage
+	mgr.m.Unlock()
+
+	watermark, _ :=
+		strconv.ParseUint(mgr.Options()["diskFreeWatermarkBytes"], 10, 64)
+	if watermark <= 0 || mgr.dataDir == "" {
+		return
+	}
+
+	free, err := DiskFreeBytes(mgr.dataDir)
+	if err != nil {
+		log.Printf("manager_disk: DiskFreeBytes, dataDir: %s, err: %v",
+			mgr.dataDir, err)
+		return
+	}
+
+	mgr.m.Lock()
+	wasLow := mgr.diskLow
+	mgr.diskLow = free < watermark
+	mgr.m.Unlock()
+
+	if free < watermark {
+		if !wasLow {
+			log.Printf("manager_disk: disk low, dataDir: %s,"+
+				" free: %d, watermark: %d", mgr.dataDir, free, watermark)
+			mgr.EmitEvent(ManagerEvent{
+				Kind: MANAGER_EVENT_DISK_LOW,
+				Msg: fmt.Sprintf("free: %d, watermark: %d",
+					free, watermark),
+			})
+		}
+
+		// Also pauses any pindexes that were added since.
+		for pindexName := range pindexes {
+			if mgr.PIndexReadOnly(pindexName) != "" {
+				continue
+			}
+			err := mgr.SetPIndexReadOnly(pindexName, PINDEX_READ_ONLY_BUFFER)
+			if err == nil {
+				mgr.m.Lock()
+				if mgr.diskPaused == nil {
+					mgr.diskPaused = map[string]bool{}
+				}
+				mgr.diskPaused[pindexName] = true
+				mgr.m.Unlock()
+			}
+		}
+
+		return
+	}
+
+	if wasLow {
+		log.Printf("manager_disk: disk ok, dataDir: %s,"+
+			" free: %d, watermark: %d", mgr.dataDir, free, watermark)
+
+		mgr.m.Lock()
+		diskPaused := mgr.diskPaused
+		mgr.diskPaused = nil
+		mgr.m.Unlock()
+
+		for pindexName := range diskPaused {
+			if mgr.PIndexReadOnly(pindexName) == PINDEX_READ_ONLY_BUFFER {
+				mgr.SetPIndexReadOnly(pindexName, "")
+			}
+		}
+
+		mgr.EmitEvent(ManagerEvent{
+			Kind: MANAGER_EVENT_DISK_OK,
+			Msg:  fmt.Sprintf("free: %d, watermark: %d", free, watermark),
+		})
+	}
+}
+
+// PIndexesDiskUsage returns the last measured on-disk sizes of the
+// local pindexes, keyed by pindex name.
+func (mgr *Manager) PIndexesDiskUsage() map[string]uint64 {
+	mgr.m.Lock()
+	rv := make(map[string]uint64, len(mgr.pindexDiskUsage))
+	for pindexName, size := range mgr.pindexDiskUsage {
+		rv[pindexName] = size
+	}
+	mgr.m.Unlock()
+	return rv
+}
+
+// DiskLow returns true when the free disk space of the data dir was
+// last measured to be below the disk free watermark.
+func (mgr *Manager) DiskLow() bool {
+	mgr.m.Lock()
+	rv := mgr.diskLow
+	mgr.m.Unlock()
+	return rv
+}
+
+// dirSize returns the total size of the files under a dir.
+func dirSize(dir string) uint64 {
+	var rv uint64
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err == nil && f != nil && !f.IsDir() {
+			rv += uint64(f.Size())
+		}
+		return nil
+	})
+	return rv
+}
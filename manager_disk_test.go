@@ -0,0 +1,104 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDirSize(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	if dirSize(emptyDir) != 0 {
+		t.Errorf("expected empty dir")
+	}
+
+	ioutil.WriteFile(filepath.Join(emptyDir, "a"), make([]byte, 10), 0600)
+	os.Mkdir(filepath.Join(emptyDir, "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(emptyDir, "sub", "b"), make([]byte, 5), 0600)
+
+	if dirSize(emptyDir) != 15 {
+		t.Errorf("expected 15 bytes, got: %d", dirSize(emptyDir))
+	}
+}
+
+func TestDiskUsageOnce(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+
+	m.DiskUsageOnce()
+
+	if _, exists := m.PIndexesDiskUsage()[pindexName]; !exists {
+		t.Errorf("expected disk usage of pindex, got: %v",
+			m.PIndexesDiskUsage())
+	}
+	if m.DiskLow() {
+		t.Errorf("expected no disk low without a watermark")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	eventCh := make(chan ManagerEvent, 100)
+	m.SubscribeEvents(eventCh)
+
+	m.SetOptions(map[string]string{
+		"diskFreeWatermarkBytes": "18446744073709551615",
+	})
+
+	m.DiskUsageOnce()
+
+	if !m.DiskLow() ||
+		m.PIndexReadOnly(pindexName) != PINDEX_READ_ONLY_BUFFER {
+		t.Errorf("expected disk low to pause the pindex")
+	}
+
+	m.SetOptions(map[string]string{
+		"diskFreeWatermarkBytes": "1",
+	})
+
+	m.DiskUsageOnce()
+
+	if m.DiskLow() || m.PIndexReadOnly(pindexName) != "" {
+		t.Errorf("expected disk ok to resume the pindex")
+	}
+
+	kinds := map[string]bool{}
+	for len(eventCh) > 0 {
+		kinds[(<-eventCh).Kind] = true
+	}
+	if !kinds[MANAGER_EVENT_DISK_LOW] || !kinds[MANAGER_EVENT_DISK_OK] {
+		t.Errorf("expected disk events, got: %v", kinds)
+	}
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DocLookUpResult describes where a document lives in an index and,
+// when the owning pindex is on this node, what the pindex stores for
+// the document.
+type DocLookUpResult struct {
+	IndexName       string      `json:"indexName"`
+	DocID           string      `json:"docID"`
+	SourcePartition string      `json:"sourcePartition,omitempty"`
+	PIndexName      string      `json:"pindexName"`
+	Nodes           []string    `json:"nodes"` // NodeDef UUIDs of the pindex.
+	Local           bool        `json:"local"` // Whether the pindex is here.
+	Doc             interface{} `json:"doc,omitempty"`
+}
+
+// LookUpDoc locates the pindex of an index that owns a document, via
+// the source feed type's PartitionLookUp(), and when that pindex is
+// on this node, returns what the pindex stores for the document via
+// its PIndexImplType's DocLookUp().  A feed type without a
+// PartitionLookUp() is supported only when the index has a single
+// pindex.  The req provides any auth for the PartitionLookUp().
+func (mgr *Manager) LookUpDoc(indexName, docID string,
+	req *http.Request) (*DocLookUpResult, error) {
+	indexDef, pindexImplType, err := GetIndexDef(mgr.cfg, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, err := mgr.GetPlanPIndexes(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*PlanPIndex
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.IndexName == indexDef.Name &&
+				planPIndex.IndexUUID == indexDef.UUID {
+				candidates = append(candidates, planPIndex)
+			}
+		}
+	}
+
+	rv := &DocLookUpResult{
+		IndexName: indexDef.Name,
+		DocID:     docID,
+	}
+
+	var owner *PlanPIndex
+
+	feedType := FeedTypes[indexDef.SourceType]
+	if feedType != nil && feedType.PartitionLookUp != nil {
+		rv.SourcePartition, err = feedType.PartitionLookUp(docID,
+			mgr.server, indexDef, req)
+		if err != nil {
+			return nil, fmt.Errorf("manager_doc: PartitionLookUp,"+
+				" indexName: %s, docID: %s, err: %v",
+				indexName, docID, err)
+		}
+
+	CANDIDATES:
+		for _, planPIndex := range candidates {
+			for _, sp := range strings.Split(planPIndex.SourcePartitions, ",") {
+				if sp == rv.SourcePartition {
+					owner = planPIndex
+					break CANDIDATES
+				}
+			}
+		}
+	} else if len(candidates) == 1 {
+		owner = candidates[0]
+	} else {
+		return nil, fmt.Errorf("manager_doc: PartitionLookUp not supported,"+
+			" indexName: %s, sourceType: %s", indexName, indexDef.SourceType)
+	}
+
+	if owner == nil {
+		return nil, fmt.Errorf("manager_doc: no pindex,"+
+			" indexName: %s, docID: %s", indexName, docID)
+	}
+
+	rv.PIndexName = owner.Name
+
+	rv.Nodes = make([]string, 0, len(owner.Nodes))
+	for nodeUUID := range owner.Nodes {
+		rv.Nodes = append(rv.Nodes, nodeUUID)
+	}
+	sort.Strings(rv.Nodes)
+
+	_, pindexes := mgr.CurrentMaps()
+
+	pindex := pindexes[owner.Name]
+	if pindex == nil {
+		return rv, nil
+	}
+
+	rv.Local = true
+
+	if pindexImplType.DocLookUp != nil {
+		rv.Doc, err = pindexImplType.DocLookUp(pindex, docID)
+		if err != nil {
+			return nil, fmt.Errorf("manager_doc: DocLookUp,"+
+				" pindexName: %s, docID: %s, err: %v",
+				pindex.Name, docID, err)
+		}
+	}
+
+	return rv, nil
+}
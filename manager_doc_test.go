@@ -0,0 +1,67 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLookUpDoc(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexNames := m.LocalPIndexNamesForIndex("foo")
+	if len(pindexNames) != 1 {
+		t.Fatalf("expected 1 pindex, got: %v", pindexNames)
+	}
+
+	if _, err := m.LookUpDoc("not-an-index", "doc", nil); err == nil {
+		t.Errorf("expected err for missing index")
+	}
+
+	rv, err := m.LookUpDoc("foo", "doc", nil)
+	if err != nil || rv.PIndexName != pindexNames[0] || !rv.Local ||
+		!reflect.DeepEqual(rv.Nodes, []string{m.UUID()}) || rv.Doc != nil {
+		t.Errorf("expected local pindex without doc, rv: %+v, err: %v",
+			rv, err)
+	}
+
+	blackhole := PIndexImplTypes["blackhole"]
+	blackhole.DocLookUp = func(pindex *PIndex, docID string) (
+		interface{}, error) {
+		return map[string]string{"id": docID}, nil
+	}
+	defer func() { blackhole.DocLookUp = nil }()
+
+	rv, err = m.LookUpDoc("foo", "doc", nil)
+	if err != nil || !reflect.DeepEqual(rv.Doc,
+		map[string]string{"id": "doc"}) {
+		t.Errorf("expected DocLookUp, rv: %+v, err: %v", rv, err)
+	}
+}
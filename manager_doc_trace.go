@@ -0,0 +1,236 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Doc tracing records the ingest of specific documents into an
+// index, for debugging why a document is missing from an index.  It's
+// disabled unless the manager option "docTracing" is "true" when
+// feeds are (re-)started, in which case feeds send their data to
+// pindexes through a DestDocTrace wrapper.  The traced doc IDs of an
+// index may then be set and removed at runtime.
+//
+// The data mutations of the traced docs are recorded, along with the
+// snapshot starts, opaque sets (which checkpoint, or flush, the
+// partition) and rollbacks of the partitions where traced docs were
+// seen.
+
+// DOC_TRACE_MAX_EVENTS is the max number of events kept per index.
+var DOC_TRACE_MAX_EVENTS = 1000
+
+// A DocTraceEvent is a recorded Dest call for a traced document, or
+// for a partition that has traced documents, when DocID is empty.
+type DocTraceEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"` // Like "dataUpdate" or "rollback".
+	DocID     string    `json:"docID,omitempty"`
+	Partition string    `json:"partition"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Err       string    `json:"err,omitempty"`
+}
+
+// A DocTrace is the set of traced doc IDs of an index and the events
+// recorded for them, oldest first.
+type DocTrace struct {
+	IndexName string          `json:"indexName"`
+	DocIDs    []string        `json:"docIDs"`
+	Events    []DocTraceEvent `json:"events"`
+
+	docIDs     map[string]bool
+	partitions map[string]bool // Partitions where docs were seen.
+}
+
+// docTracing returns true if doc tracing is enabled.
+func (mgr *Manager) docTracing() bool {
+	return mgr.Options()["docTracing"] == "true"
+}
+
+// SetDocTrace starts tracing the given doc IDs of an index on this
+// node, replacing any previous doc IDs and events of the index.
+func (mgr *Manager) SetDocTrace(indexName string, docIDs []string) error {
+	if !mgr.docTracing() {
+		return fmt.Errorf("manager_doc_trace: doc tracing is disabled")
+	}
+	if indexName == "" || len(docIDs) <= 0 {
+		return fmt.Errorf("manager_doc_trace: index name and doc IDs" +
+			" are required")
+	}
+
+	dt := &DocTrace{
+		IndexName:  indexName,
+		docIDs:     map[string]bool{},
+		partitions: map[string]bool{},
+	}
+	for _, docID := range docIDs {
+		if !dt.docIDs[docID] {
+			dt.docIDs[docID] = true
+			dt.DocIDs = append(dt.DocIDs, docID)
+		}
+	}
+	sort.Strings(dt.DocIDs)
+
+	mgr.m.Lock()
+	if mgr.docTraces == nil {
+		mgr.docTraces = map[string]*DocTrace{}
+	}
+	mgr.docTraces[indexName] = dt
+	mgr.m.Unlock()
+
+	return nil
+}
+
+// DeleteDocTrace stops tracing the docs of an index on this node.
+func (mgr *Manager) DeleteDocTrace(indexName string) error {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	if mgr.docTraces[indexName] == nil {
+		return fmt.Errorf("manager_doc_trace: no doc trace,"+
+			" indexName: %s", indexName)
+	}
+	delete(mgr.docTraces, indexName)
+
+	return nil
+}
+
+// GetDocTrace returns a copy of the doc trace of an index, or nil.
+func (mgr *Manager) GetDocTrace(indexName string) *DocTrace {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	dt := mgr.docTraces[indexName]
+	if dt == nil {
+		return nil
+	}
+
+	return &DocTrace{
+		IndexName: dt.IndexName,
+		DocIDs:    append([]string(nil), dt.DocIDs...),
+		Events:    append([]DocTraceEvent(nil), dt.Events...),
+	}
+}
+
+// docTraceRecord records an event if it's for a traced doc, or if
+// it's for a partition with traced docs when docID is empty.
+func (mgr *Manager) docTraceRecord(indexName string, ev DocTraceEvent) {
+	mgr.m.Lock()
+	dt := mgr.docTraces[indexName]
+	if dt != nil {
+		if ev.DocID != "" {
+			if dt.docIDs[ev.DocID] {
+				dt.partitions[ev.Partition] = true
+			} else {
+				dt = nil
+			}
+		} else if !dt.partitions[ev.Partition] {
+			dt = nil
+		}
+	}
+	if dt != nil {
+		ev.Time = time.Now()
+		dt.Events = append(dt.Events, ev)
+		if len(dt.Events) > DOC_TRACE_MAX_EVENTS {
+			dt.Events = append([]DocTraceEvent(nil),
+				dt.Events[len(dt.Events)-DOC_TRACE_MAX_EVENTS:]...)
+		}
+	}
+	mgr.m.Unlock()
+}
+
+// ------------------------------------------------------------------------
+
+// feedDestDocTrace wraps a feed's Dest with a DestDocTrace when doc
+// tracing is enabled.
+func (mgr *Manager) feedDestDocTrace(indexName string, dest Dest) Dest {
+	if !mgr.docTracing() {
+		return dest
+	}
+
+	return &DestDocTrace{Dest: dest, mgr: mgr, indexName: indexName}
+}
+
+// DestDocTrace is a Dest wrapper that records the calls for the
+// manager's traced docs of an index.
+type DestDocTrace struct {
+	Dest
+
+	mgr       *Manager
+	indexName string
+}
+
+func (d *DestDocTrace) record(kind, docID, partition string,
+	seq uint64, err error) {
+	ev := DocTraceEvent{
+		Kind:      kind,
+		DocID:     docID,
+		Partition: partition,
+		Seq:       seq,
+	}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	d.mgr.docTraceRecord(d.indexName, ev)
+}
+
+func (d *DestDocTrace) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	docID := string(key) // Copied before the Dest may reuse the key.
+	err := d.Dest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+	d.record("dataUpdate", docID, partition, seq, err)
+	return err
+}
+
+func (d *DestDocTrace) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	docID := string(key)
+	err := d.Dest.DataDelete(partition, key, seq,
+		cas, extrasType, extras)
+	d.record("dataDelete", docID, partition, seq, err)
+	return err
+}
+
+func (d *DestDocTrace) DataExpire(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	docID := string(key)
+	err := DestDataExpire(d.Dest, partition, key, seq,
+		cas, extrasType, extras)
+	d.record("dataExpire", docID, partition, seq, err)
+	return err
+}
+
+func (d *DestDocTrace) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	err := d.Dest.SnapshotStart(partition, snapStart, snapEnd)
+	d.record("snapshotStart", "", partition, snapEnd, err)
+	return err
+}
+
+func (d *DestDocTrace) OpaqueSet(partition string, value []byte) error {
+	err := d.Dest.OpaqueSet(partition, value)
+	d.record("opaqueSet", "", partition, 0, err)
+	return err
+}
+
+func (d *DestDocTrace) Rollback(partition string, rollbackSeq uint64) error {
+	err := d.Dest.Rollback(partition, rollbackSeq)
+	d.record("rollback", "", partition, rollbackSeq, err)
+	return err
+}
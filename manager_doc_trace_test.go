@@ -0,0 +1,101 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDocTrace(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	d := &TestDestRollback{}
+	if m.feedDestDocTrace("idx", d) != d {
+		t.Errorf("expected no DestDocTrace when disabled")
+	}
+	if err := m.SetDocTrace("idx", []string{"a"}); err == nil {
+		t.Errorf("expected SetDocTrace() to fail when disabled")
+	}
+
+	m.SetOptions(map[string]string{"docTracing": "true"})
+
+	dest := m.feedDestDocTrace("idx", d)
+	if _, ok := dest.(*DestDocTrace); !ok || unwrapFeedDest(dest) != d {
+		t.Errorf("expected DestDocTrace, got: %#v", dest)
+	}
+
+	if err := m.SetDocTrace("idx", nil); err == nil {
+		t.Errorf("expected SetDocTrace() to fail without doc IDs")
+	}
+	if err := m.SetDocTrace("idx", []string{"b", "a", "b"}); err != nil {
+		t.Errorf("expected SetDocTrace() to work, err: %v", err)
+	}
+
+	dest.SnapshotStart("0", 1, 10) // Before any traced docs were seen.
+	dest.DataUpdate("0", []byte("a"), 1, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("0", []byte("untraced"), 2, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataDelete("1", []byte("untraced"), 3, 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	dest.OpaqueSet("0", nil)
+	dest.OpaqueSet("1", nil) // Partition without traced docs.
+	dest.Rollback("0", 0)
+
+	dt := m.GetDocTrace("idx")
+	if dt == nil || len(dt.DocIDs) != 2 || dt.DocIDs[0] != "a" {
+		t.Fatalf("expected doc trace, got: %#v", dt)
+	}
+
+	kinds := []string{"dataUpdate", "opaqueSet", "rollback"}
+	if len(dt.Events) != len(kinds) {
+		t.Fatalf("expected events: %v, got: %#v", kinds, dt.Events)
+	}
+	for i, kind := range kinds {
+		ev := dt.Events[i]
+		if ev.Kind != kind || ev.Partition != "0" || ev.Time.IsZero() {
+			t.Errorf("expected event kind: %s, got: %#v", kind, ev)
+		}
+	}
+	if dt.Events[0].DocID != "a" || dt.Events[0].Seq != 1 {
+		t.Errorf("expected traced doc event, got: %#v", dt.Events[0])
+	}
+	if d.rollbacks != 1 {
+		t.Errorf("expected rollback to reach the dest")
+	}
+
+	maxEvents := DOC_TRACE_MAX_EVENTS
+	DOC_TRACE_MAX_EVENTS = 2
+	defer func() { DOC_TRACE_MAX_EVENTS = maxEvents }()
+
+	dest.DataDelete("0", []byte("b"), 4, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	dt = m.GetDocTrace("idx")
+	if len(dt.Events) != 2 || dt.Events[1].Kind != "dataDelete" {
+		t.Errorf("expected events to be capped, got: %#v", dt.Events)
+	}
+
+	if err := m.DeleteDocTrace("idx"); err != nil {
+		t.Errorf("expected DeleteDocTrace() to work, err: %v", err)
+	}
+	if err := m.DeleteDocTrace("idx"); err == nil {
+		t.Errorf("expected DeleteDocTrace() of a missing trace to fail")
+	}
+	if m.GetDocTrace("idx") != nil {
+		t.Errorf("expected no doc trace")
+	}
+}
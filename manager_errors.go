@@ -0,0 +1,95 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"container/list"
+	"time"
+)
+
+// MANAGER_MAX_ERRORS is the max number of recent errors that a
+// Manager tracks per error category.
+var MANAGER_MAX_ERRORS = 40
+
+// The categories of the errors tracked by a Manager.
+const (
+	MANAGER_ERROR_FEED    = "feed"
+	MANAGER_ERROR_PLANNER = "planner"
+	MANAGER_ERROR_JANITOR = "janitor"
+	MANAGER_ERROR_QUERY   = "query"
+)
+
+// A ManagerError is a recent error tracked by a Manager.
+type ManagerError struct {
+	Time      time.Time `json:"time"`
+	IndexName string    `json:"indexName,omitempty"`
+	Err       string    `json:"err"`
+}
+
+// ManagerErrors are the recent errors of an error category, newest
+// last, along with the total count of the category's errors, which
+// includes the errors that were dropped due to MANAGER_MAX_ERRORS.
+type ManagerErrors struct {
+	TotErrors uint64          `json:"totErrors"`
+	Errors    []*ManagerError `json:"errors"`
+}
+
+type managerErrorList struct {
+	totErrors uint64
+	errors    *list.List // Of *ManagerError, capped.
+}
+
+// AddError tracks an error of a category, like MANAGER_ERROR_FEED,
+// where the indexName is optional.
+func (mgr *Manager) AddError(category, indexName, err string) {
+	e := &ManagerError{
+		Time:      time.Now(),
+		IndexName: indexName,
+		Err:       err,
+	}
+
+	mgr.errorsM.Lock()
+	if mgr.errors == nil {
+		mgr.errors = map[string]*managerErrorList{}
+	}
+	l := mgr.errors[category]
+	if l == nil {
+		l = &managerErrorList{errors: list.New()}
+		mgr.errors[category] = l
+	}
+	l.totErrors++
+	l.errors.PushBack(e)
+	for l.errors.Len() > MANAGER_MAX_ERRORS {
+		l.errors.Remove(l.errors.Front())
+	}
+	mgr.errorsM.Unlock()
+}
+
+// Errors returns a copy of the recent errors, keyed by category.
+func (mgr *Manager) Errors() map[string]*ManagerErrors {
+	rv := map[string]*ManagerErrors{}
+
+	mgr.errorsM.Lock()
+	for category, l := range mgr.errors {
+		errors := make([]*ManagerError, 0, l.errors.Len())
+		for e := l.errors.Front(); e != nil; e = e.Next() {
+			errors = append(errors, e.Value.(*ManagerError))
+		}
+		rv[category] = &ManagerErrors{
+			TotErrors: l.totErrors,
+			Errors:    errors,
+		}
+	}
+	mgr.errorsM.Unlock()
+
+	return rv
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestManagerErrors(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	if len(m.Errors()) != 0 {
+		t.Errorf("expected no errors")
+	}
+
+	for i := 0; i < MANAGER_MAX_ERRORS+5; i++ {
+		m.AddError(MANAGER_ERROR_PLANNER, "", fmt.Sprintf("err-%d", i))
+	}
+
+	m.EmitEvent(ManagerEvent{
+		Kind:      MANAGER_EVENT_FEED_ERROR,
+		IndexName: "foo",
+		FeedName:  "feed0",
+		Err:       "oops",
+	})
+
+	errors := m.Errors()
+
+	planner := errors[MANAGER_ERROR_PLANNER]
+	if planner == nil ||
+		planner.TotErrors != uint64(MANAGER_MAX_ERRORS+5) ||
+		len(planner.Errors) != MANAGER_MAX_ERRORS ||
+		planner.Errors[0].Err != "err-5" ||
+		planner.Errors[MANAGER_MAX_ERRORS-1].Err !=
+			fmt.Sprintf("err-%d", MANAGER_MAX_ERRORS+4) {
+		t.Errorf("unexpected planner errors: %#v", planner)
+	}
+
+	feed := errors[MANAGER_ERROR_FEED]
+	if feed == nil || feed.TotErrors != 1 ||
+		feed.Errors[0].IndexName != "foo" ||
+		feed.Errors[0].Err != "feed: feed0, err: oops" ||
+		feed.Errors[0].Time.IsZero() {
+		t.Errorf("unexpected feed errors: %#v", feed)
+	}
+}
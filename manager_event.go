@@ -0,0 +1,150 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of lifecycle events emitted by a Manager to its event
+// subscribers.
+const (
+	MANAGER_EVENT_PINDEX_CREATED     = "pindexCreated"
+	MANAGER_EVENT_PINDEX_OPENED      = "pindexOpened"
+	MANAGER_EVENT_PINDEX_CLOSED      = "pindexClosed"
+	MANAGER_EVENT_PINDEX_ROLLED_BACK = "pindexRolledBack"
+	MANAGER_EVENT_PINDEX_CORRUPT     = "pindexCorrupt" // See ReadPIndexMeta().
+	MANAGER_EVENT_FEED_STARTED       = "feedStarted"
+	MANAGER_EVENT_FEED_ERROR         = "feedError"
+	MANAGER_EVENT_PLAN_CHANGED       = "planChanged"
+	MANAGER_EVENT_JANITOR            = "janitor"
+	MANAGER_EVENT_REBALANCE_DONE     = "rebalanceDone"
+	MANAGER_EVENT_SOURCE_CHANGED     = "sourceChanged"
+	MANAGER_EVENT_SOURCE_MISSING     = "sourceMissing"
+	MANAGER_EVENT_DISK_LOW           = "diskLow" // See DiskUsageOnce().
+	MANAGER_EVENT_DISK_OK            = "diskOk"
+	MANAGER_EVENT_MEMORY_OVER_QUOTA  = "memoryOverQuota" // See MemoryOnce().
+	MANAGER_EVENT_MEMORY_OK          = "memoryOk"
+)
+
+// A ManagerEvent represents a structured lifecycle event of a
+// Manager, or of the pindexes and feeds that it manages.  Fields that
+// don't apply to an event's Kind are left empty.
+type ManagerEvent struct {
+	Kind       string    `json:"kind"`
+	Time       time.Time `json:"time"`
+	IndexName  string    `json:"indexName,omitempty"`
+	PIndexName string    `json:"pindexName,omitempty"`
+	FeedName   string    `json:"feedName,omitempty"`
+	Partition  string    `json:"partition,omitempty"`
+	Seq        uint64    `json:"seq,omitempty"`
+	Removed    bool      `json:"removed,omitempty"` // For pindexClosed.
+	Msg        string    `json:"msg,omitempty"`
+	Err        string    `json:"err,omitempty"`
+}
+
+// SubscribeEvents registers a channel that will receive the
+// Manager's lifecycle events.  Events are sent without blocking, so
+// events are dropped (see ManagerStats.TotEventDrop) when the channel
+// isn't ready, and subscribers should use a buffered channel that's
+// drained promptly.
+func (mgr *Manager) SubscribeEvents(ch chan<- ManagerEvent) {
+	mgr.m.Lock()
+	eventSubs := make([]chan<- ManagerEvent, 0, len(mgr.eventSubs)+1)
+	eventSubs = append(eventSubs, mgr.eventSubs...)
+	mgr.eventSubs = append(eventSubs, ch)
+	mgr.m.Unlock()
+}
+
+// UnsubscribeEvents unregisters a channel previously registered by
+// SubscribeEvents.
+func (mgr *Manager) UnsubscribeEvents(ch chan<- ManagerEvent) {
+	mgr.m.Lock()
+	eventSubs := make([]chan<- ManagerEvent, 0, len(mgr.eventSubs))
+	for _, eventSub := range mgr.eventSubs {
+		if eventSub != ch {
+			eventSubs = append(eventSubs, eventSub)
+		}
+	}
+	mgr.eventSubs = eventSubs
+	mgr.m.Unlock()
+}
+
+// EmitEvent sends an event to the event subscribers.  Applications
+// may also emit their own events, such as MANAGER_EVENT_REBALANCE_DONE
+// from a rebalance orchestrator.
+func (mgr *Manager) EmitEvent(event ManagerEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if event.Kind == MANAGER_EVENT_FEED_ERROR {
+		mgr.AddError(MANAGER_ERROR_FEED, event.IndexName,
+			"feed: "+event.FeedName+", err: "+event.Err)
+	}
+
+	mgr.m.Lock()
+	eventSubs := mgr.eventSubs
+	mgr.m.Unlock()
+
+	for _, eventSub := range eventSubs {
+		select {
+		case eventSub <- event:
+		default:
+			atomic.AddUint64(&mgr.stats.TotEventDrop, 1)
+		}
+	}
+}
+
+// emitPIndexEvent sends a pindex lifecycle event to the event
+// subscribers.
+func (mgr *Manager) emitPIndexEvent(kind string, pindex *PIndex) {
+	mgr.EmitEvent(ManagerEvent{
+		Kind:       kind,
+		IndexName:  pindex.IndexName,
+		PIndexName: pindex.Name,
+	})
+}
+
+// pindexForDest returns the registered pindex that a feed's dest
+// sends data to, or nil.
+func (mgr *Manager) pindexForDest(dest Dest) *PIndex {
+	dest = unwrapFeedDest(dest)
+
+	_, pindexes := mgr.CurrentMaps()
+	for _, pindex := range pindexes {
+		if pindex.Dest == dest {
+			return pindex
+		}
+	}
+
+	return nil
+}
+
+// emitRollbackEvent sends a pindexRolledBack event to the event
+// subscribers after a feed has rolled back a partition of a dest.
+func (mgr *Manager) emitRollbackEvent(feedName string, dest Dest,
+	partition string, rollbackSeq uint64) {
+	event := ManagerEvent{
+		Kind:      MANAGER_EVENT_PINDEX_ROLLED_BACK,
+		FeedName:  feedName,
+		Partition: partition,
+		Seq:       rollbackSeq,
+	}
+	if pindex := mgr.pindexForDest(dest); pindex != nil {
+		event.IndexName = pindex.IndexName
+		event.PIndexName = pindex.Name
+	}
+
+	mgr.EmitEvent(event)
+}
@@ -0,0 +1,96 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerSubscribeEvents(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	ch := make(chan ManagerEvent, 100)
+	m.SubscribeEvents(ch)
+
+	drain := func() map[string][]ManagerEvent {
+		rv := map[string][]ManagerEvent{}
+		for {
+			select {
+			case event := <-ch:
+				rv[event.Kind] = append(rv[event.Kind], event)
+			default:
+				return rv
+			}
+		}
+	}
+
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+
+	events := drain()
+	created := events[MANAGER_EVENT_PINDEX_CREATED]
+	if len(created) != 1 ||
+		created[0].PIndexName != pindexName || created[0].IndexName != "foo" {
+		t.Errorf("expected pindexCreated event, got: %#v", created)
+	}
+	if len(events[MANAGER_EVENT_FEED_STARTED]) != 1 {
+		t.Errorf("expected feedStarted event, got: %#v", events)
+	}
+	if len(events[MANAGER_EVENT_JANITOR]) < 1 {
+		t.Errorf("expected janitor event, got: %#v", events)
+	}
+
+	m.RemovePIndex(m.GetPIndex(pindexName))
+
+	events = drain()
+	closed := events[MANAGER_EVENT_PINDEX_CLOSED]
+	if len(closed) != 1 || closed[0].PIndexName != pindexName ||
+		!closed[0].Removed || closed[0].Time.IsZero() {
+		t.Errorf("expected pindexClosed event, got: %#v", closed)
+	}
+
+	m.UnsubscribeEvents(ch)
+	m.JanitorKick("test")
+
+	if events = drain(); len(events) != 0 {
+		t.Errorf("expected no events after unsubscribe, got: %#v", events)
+	}
+}
+
+func TestManagerEventDrop(t *testing.T) {
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", ":1000",
+		"", "some-datasource", nil)
+
+	ch := make(chan ManagerEvent)
+	m.SubscribeEvents(ch)
+	m.EmitEvent(ManagerEvent{Kind: MANAGER_EVENT_PLAN_CHANGED})
+
+	if m.stats.TotEventDrop != 1 {
+		t.Errorf("expected a dropped event")
+	}
+}
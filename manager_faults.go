@@ -0,0 +1,260 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection is for chaos-style testing of consistency and
+// recovery logic.  It's disabled unless the manager option
+// "faultInjection" is "true" when feeds are (re-)started, in which
+// case feeds send their data to pindexes through a DestFaults
+// wrapper.  Faults may then be added and removed at runtime, and take
+// effect immediately on the node's running feeds.
+
+// ErrFaultInjected is the error returned by an injected error fault.
+var ErrFaultInjected = errors.New("fault injected")
+
+// A Fault describes faults to inject into the data that a node's
+// feeds send to its pindexes.  The rates are probabilities between 0
+// and 1.
+type Fault struct {
+	Name      string `json:"name"`
+	IndexName string `json:"indexName,omitempty"` // Empty matches all.
+	Partition string `json:"partition,omitempty"` // Empty matches all.
+
+	// Latency is added to each data mutation, like "50ms".
+	Latency string `json:"latency,omitempty"`
+
+	// DropSnapshotRate is the rate of snapshot starts that are dropped
+	// instead of being sent to the pindex.
+	DropSnapshotRate float64 `json:"dropSnapshotRate,omitempty"`
+
+	// RollbackRate is the rate of snapshot starts that are replaced
+	// by a rollback of the partition to seq 0.
+	RollbackRate float64 `json:"rollbackRate,omitempty"`
+
+	// ErrRate is the rate of data mutations and opaque sets that fail
+	// with ErrFaultInjected instead of reaching the pindex, like a
+	// failed flush to storage.
+	ErrRate float64 `json:"errRate,omitempty"`
+
+	latency time.Duration
+}
+
+func (f *Fault) matches(indexName, partition string) bool {
+	return (f.IndexName == "" || f.IndexName == indexName) &&
+		(f.Partition == "" || f.Partition == partition)
+}
+
+// faultInjection returns true if fault injection is enabled.
+func (mgr *Manager) faultInjection() bool {
+	return mgr.Options()["faultInjection"] == "true"
+}
+
+// SetFault adds or replaces a fault on this node.
+func (mgr *Manager) SetFault(f *Fault) error {
+	if !mgr.faultInjection() {
+		return fmt.Errorf("manager_faults: fault injection is disabled")
+	}
+	if f.Name == "" {
+		return fmt.Errorf("manager_faults: fault name is required")
+	}
+
+	for _, rate := range []float64{f.DropSnapshotRate, f.RollbackRate,
+		f.ErrRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("manager_faults: rates must be between"+
+				" 0 and 1, name: %s", f.Name)
+		}
+	}
+
+	c := *f
+	if c.Latency != "" {
+		latency, err := time.ParseDuration(c.Latency)
+		if err != nil || latency < 0 {
+			return fmt.Errorf("manager_faults: could not parse latency: %q,"+
+				" name: %s", c.Latency, f.Name)
+		}
+		c.latency = latency
+	}
+
+	mgr.m.Lock()
+	if mgr.faults == nil {
+		mgr.faults = map[string]*Fault{}
+	}
+	mgr.faults[c.Name] = &c
+	mgr.m.Unlock()
+
+	return nil
+}
+
+// DeleteFault removes a fault from this node.
+func (mgr *Manager) DeleteFault(name string) error {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	if mgr.faults[name] == nil {
+		return fmt.Errorf("manager_faults: no fault, name: %s", name)
+	}
+	delete(mgr.faults, name)
+
+	return nil
+}
+
+// ListFaults returns the faults of this node, sorted by name.
+func (mgr *Manager) ListFaults() []*Fault {
+	mgr.m.Lock()
+	rv := make([]*Fault, 0, len(mgr.faults))
+	for _, f := range mgr.faults {
+		c := *f
+		rv = append(rv, &c)
+	}
+	mgr.m.Unlock()
+
+	sort.Sort(faultsByName(rv))
+
+	return rv
+}
+
+// matchingFaults returns the faults for an index partition.
+func (mgr *Manager) matchingFaults(indexName, partition string) []*Fault {
+	var rv []*Fault
+
+	mgr.m.Lock()
+	for _, f := range mgr.faults {
+		if f.matches(indexName, partition) {
+			rv = append(rv, f)
+		}
+	}
+	mgr.m.Unlock()
+
+	return rv
+}
+
+type faultsByName []*Fault
+
+func (a faultsByName) Len() int {
+	return len(a)
+}
+
+func (a faultsByName) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a faultsByName) Less(i, j int) bool {
+	return a[i].Name < a[j].Name
+}
+
+// ------------------------------------------------------------------------
+
+// feedDestFaults wraps a feed's Dest with a DestFaults when fault
+// injection is enabled.
+func (mgr *Manager) feedDestFaults(indexName string, dest Dest) Dest {
+	if !mgr.faultInjection() {
+		return dest
+	}
+
+	return &DestFaults{Dest: dest, mgr: mgr, indexName: indexName}
+}
+
+// DestFaults is a Dest wrapper that injects the manager's faults for
+// an index into the data sent to the wrapped Dest.
+type DestFaults struct {
+	Dest
+
+	mgr       *Manager
+	indexName string
+}
+
+func (d *DestFaults) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := d.mutation(partition)
+	if err != nil {
+		return err
+	}
+	return d.Dest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (d *DestFaults) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := d.mutation(partition)
+	if err != nil {
+		return err
+	}
+	return d.Dest.DataDelete(partition, key, seq,
+		cas, extrasType, extras)
+}
+
+func (d *DestFaults) DataExpire(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := d.mutation(partition)
+	if err != nil {
+		return err
+	}
+	return DestDataExpire(d.Dest, partition, key, seq,
+		cas, extrasType, extras)
+}
+
+func (d *DestFaults) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	for _, f := range d.mgr.matchingFaults(d.indexName, partition) {
+		if f.DropSnapshotRate > 0 && rand.Float64() < f.DropSnapshotRate {
+			atomic.AddUint64(&d.mgr.stats.TotFaultDrop, 1)
+			return nil
+		}
+		if f.RollbackRate > 0 && rand.Float64() < f.RollbackRate {
+			atomic.AddUint64(&d.mgr.stats.TotFaultRollback, 1)
+			return d.Dest.Rollback(partition, 0)
+		}
+	}
+	return d.Dest.SnapshotStart(partition, snapStart, snapEnd)
+}
+
+func (d *DestFaults) OpaqueSet(partition string, value []byte) error {
+	for _, f := range d.mgr.matchingFaults(d.indexName, partition) {
+		if f.ErrRate > 0 && rand.Float64() < f.ErrRate {
+			atomic.AddUint64(&d.mgr.stats.TotFaultErr, 1)
+			return ErrFaultInjected
+		}
+	}
+	return d.Dest.OpaqueSet(partition, value)
+}
+
+// mutation sleeps for the latency faults of a partition, and returns
+// ErrFaultInjected when an error fault fires.
+func (d *DestFaults) mutation(partition string) error {
+	for _, f := range d.mgr.matchingFaults(d.indexName, partition) {
+		if f.latency > 0 {
+			atomic.AddUint64(&d.mgr.stats.TotFaultLatency, 1)
+			select {
+			case <-d.mgr.stopCh:
+			case <-time.After(f.latency):
+			}
+		}
+		if f.ErrRate > 0 && rand.Float64() < f.ErrRate {
+			atomic.AddUint64(&d.mgr.stats.TotFaultErr, 1)
+			return ErrFaultInjected
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type TestDestRollback struct {
+	BlackHole
+
+	rollbacks int
+}
+
+func (t *TestDestRollback) Rollback(partition string,
+	rollbackSeq uint64) error {
+	t.rollbacks++
+	return nil
+}
+
+func TestFaults(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	d := &TestDestRollback{}
+	if m.feedDestFaults("idx", d) != d {
+		t.Errorf("expected no DestFaults when disabled")
+	}
+	if err := m.SetFault(&Fault{Name: "f"}); err == nil {
+		t.Errorf("expected SetFault() to fail when disabled")
+	}
+
+	m.SetOptions(map[string]string{"faultInjection": "true"})
+
+	dest := m.feedDestFaults("idx", d)
+	if _, ok := dest.(*DestFaults); !ok || unwrapFeedDest(dest) != d {
+		t.Errorf("expected DestFaults, got: %#v", dest)
+	}
+
+	for _, f := range []*Fault{
+		{},
+		{Name: "f", ErrRate: 2},
+		{Name: "f", Latency: "not-a-duration"},
+	} {
+		if err := m.SetFault(f); err == nil {
+			t.Errorf("expected SetFault() to fail, fault: %#v", f)
+		}
+	}
+
+	err := m.SetFault(&Fault{Name: "err", IndexName: "idx", Partition: "0",
+		ErrRate: 1, Latency: "10ms"})
+	if err != nil {
+		t.Errorf("expected SetFault() to work, err: %v", err)
+	}
+
+	start := time.Now()
+	err = dest.DataUpdate("0", []byte("k"), 1, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if err != ErrFaultInjected || time.Since(start) < 10*time.Millisecond {
+		t.Errorf("expected a delayed injected error, err: %v", err)
+	}
+	if err = dest.OpaqueSet("0", nil); err != ErrFaultInjected {
+		t.Errorf("expected an injected OpaqueSet() error, err: %v", err)
+	}
+	if err = dest.DataDelete("1", []byte("k"), 1, 0,
+		DEST_EXTRAS_TYPE_NIL, nil); err != nil {
+		t.Errorf("expected no fault on another partition, err: %v", err)
+	}
+
+	m.SetFault(&Fault{Name: "rollback", RollbackRate: 1})
+	dest.SnapshotStart("1", 1, 10)
+	if d.rollbacks != 1 || m.stats.TotFaultRollback != 1 {
+		t.Errorf("expected an injected rollback, got: %d", d.rollbacks)
+	}
+
+	faults := m.ListFaults()
+	if len(faults) != 2 || faults[0].Name != "err" ||
+		faults[1].Name != "rollback" {
+		t.Errorf("expected sorted faults, got: %#v", faults)
+	}
+
+	if err = m.DeleteFault("rollback"); err != nil {
+		t.Errorf("expected DeleteFault() to work, err: %v", err)
+	}
+	if err = m.DeleteFault("rollback"); err == nil {
+		t.Errorf("expected DeleteFault() of a missing fault to fail")
+	}
+
+	dest.SnapshotStart("1", 1, 10)
+	if d.rollbacks != 1 {
+		t.Errorf("expected no rollback after DeleteFault()")
+	}
+}
@@ -0,0 +1,242 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// A Manager heartbeats by periodically renewing a lease in the Cfg
+// (see CfgHeartbeatKey()), so that other nodes can track its
+// liveness.  Heartbeats are controlled by these manager options,
+// which are parsed by time.ParseDuration():
+//
+// * heartbeatInterval - how often to heartbeat, like "2s"; heartbeats
+//   are disabled when empty.
+// * heartbeatTTL - how long a heartbeat lease lasts before the node
+//   is considered dead; defaults to 3 x heartbeatInterval.
+// * heartbeatAutoFailover - when non-empty, a planner node will
+//   failover a wanted node whose heartbeat lease has been expired
+//   for longer than this grace window.  Planner nodes race for a
+//   failover lease on the dead node (see CfgFailoverKey()), so that
+//   only one planner performs any given auto-failover.
+
+// CfgHeartbeatKey returns the Cfg key of the heartbeat lease of a node.
+func CfgHeartbeatKey(nodeUUID string) string {
+	return CfgLeaseKey("heartbeat-" + nodeUUID)
+}
+
+// CfgFailoverKey returns the Cfg key of the lease that a planner
+// node holds while it auto-fails over a node.
+func CfgFailoverKey(nodeUUID string) string {
+	return CfgLeaseKey("failover-" + nodeUUID)
+}
+
+func (mgr *Manager) optionDuration(name string) time.Duration {
+	v := mgr.Options()[name]
+	if v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// HeartbeatLoop is the main loop for heartbeats, and exits when the
+// manager is stopped.
+func (mgr *Manager) HeartbeatLoop() {
+	interval := mgr.optionDuration("heartbeatInterval")
+	if interval <= 0 || mgr.cfg == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := mgr.HeartbeatOnce()
+		if err != nil {
+			log.Printf("heartbeat: HeartbeatOnce, err: %v", err)
+		}
+
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HeartbeatOnce renews this node's heartbeat lease, refreshes the
+// liveness of the wanted nodes, and, if configured and this node is
+// a planner, fails over the wanted nodes that have been dead for
+// longer than the auto-failover grace window.
+func (mgr *Manager) HeartbeatOnce() error {
+	atomic.AddUint64(&mgr.stats.TotHeartbeat, 1)
+
+	ttl := mgr.optionDuration("heartbeatTTL")
+	if ttl <= 0 {
+		ttl = 3 * mgr.optionDuration("heartbeatInterval")
+	}
+
+	_, err := CfgAcquireLease(mgr.cfg, CfgHeartbeatKey(mgr.uuid), mgr.uuid, ttl)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotHeartbeatErr, 1)
+		return err
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotHeartbeatErr, 1)
+		return err
+	}
+
+	nodeLiveness := map[string]time.Time{}
+	if nodeDefs != nil {
+		for nodeUUID := range nodeDefs.NodeDefs {
+			lease, err := CfgGetLease(mgr.cfg, CfgHeartbeatKey(nodeUUID))
+			if err != nil {
+				atomic.AddUint64(&mgr.stats.TotHeartbeatErr, 1)
+				return err
+			}
+			if lease != nil {
+				nodeLiveness[nodeUUID] = lease.Expires
+			}
+		}
+	}
+
+	mgr.setNodeLiveness(nodeLiveness)
+
+	autoFailover := mgr.optionDuration("heartbeatAutoFailover")
+	if autoFailover <= 0 ||
+		(mgr.tagsMap != nil && !mgr.tagsMap["planner"]) {
+		return nil
+	}
+
+	deadline := time.Now().Add(-autoFailover)
+
+	for nodeUUID, expires := range nodeLiveness {
+		if nodeUUID == mgr.uuid || expires.After(deadline) {
+			continue
+		}
+
+		failedOver, err := mgr.autoFailoverNode(nodeUUID, deadline, ttl)
+		if err != nil {
+			atomic.AddUint64(&mgr.stats.TotHeartbeatErr, 1)
+			return err
+		}
+
+		if failedOver {
+			atomic.AddUint64(&mgr.stats.TotHeartbeatAutoFailover, 1)
+		}
+	}
+
+	return nil
+}
+
+// autoFailoverNode fails over a dead node, but only if this node wins
+// the failover lease on the dead node and the dead node is still
+// wanted and still dead once the lease is held, so that concurrent
+// planners do not fail over the same node.
+func (mgr *Manager) autoFailoverNode(nodeUUID string,
+	deadline time.Time, ttl time.Duration) (bool, error) {
+	lease, err := CfgAcquireLease(mgr.cfg, CfgFailoverKey(nodeUUID),
+		mgr.uuid, ttl)
+	if err != nil {
+		if _, ok := err.(*CfgLeaseHeldError); ok {
+			return false, nil // Another planner is failing it over.
+		}
+		return false, err
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return false, err
+	}
+	if nodeDefs == nil || nodeDefs.NodeDefs[nodeUUID] == nil {
+		CfgReleaseLease(mgr.cfg, lease)
+		return false, nil // Already failed over or removed.
+	}
+
+	heartbeat, err := CfgGetLease(mgr.cfg, CfgHeartbeatKey(nodeUUID))
+	if err != nil {
+		return false, err
+	}
+	if heartbeat == nil || heartbeat.Expires.After(deadline) {
+		CfgReleaseLease(mgr.cfg, lease)
+		return false, nil // The node has heartbeated again.
+	}
+
+	log.Printf("heartbeat: auto-failover, nodeUUID: %s,"+
+		" heartbeat expired: %v", nodeUUID, heartbeat.Expires)
+
+	// On success, the failover lease is removed along with the
+	// node's other leases by UnregisterNodes().
+	err = mgr.FailoverNode(nodeUUID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// setNodeLiveness updates the tracked heartbeat lease expirations of
+// the nodes.  The covering pindexes cache is invalidated only when
+// the set of dead nodes changes.
+func (mgr *Manager) setNodeLiveness(nodeLiveness map[string]time.Time) {
+	now := time.Now()
+
+	nodeDead := map[string]bool{}
+	for nodeUUID, expires := range nodeLiveness {
+		if nodeUUID != mgr.uuid && !expires.After(now) {
+			nodeDead[nodeUUID] = true
+		}
+	}
+
+	mgr.m.Lock()
+	changed := !reflect.DeepEqual(nodeDead, mgr.nodeDead)
+	mgr.nodeLiveness = nodeLiveness
+	mgr.nodeDead = nodeDead
+	if changed {
+		atomic.AddUint64(&mgr.stats.TotRefreshNodeLiveness, 1)
+	}
+	mgr.m.Unlock()
+}
+
+// IsNodeAlive returns false only when a node's heartbeat lease was
+// seen as expired by the latest heartbeat.  Nodes without any
+// heartbeat info, such as nodes that do not heartbeat, are considered
+// alive.
+func (mgr *Manager) IsNodeAlive(nodeUUID string) bool {
+	mgr.m.Lock()
+	dead := mgr.nodeDead[nodeUUID]
+	mgr.m.Unlock()
+
+	return !dead
+}
+
+// NodeLiveness returns a copy of the tracked heartbeat lease
+// expirations of the wanted nodes, keyed by node UUID.
+func (mgr *Manager) NodeLiveness() map[string]time.Time {
+	mgr.m.Lock()
+	rv := make(map[string]time.Time, len(mgr.nodeLiveness))
+	for nodeUUID, expires := range mgr.nodeLiveness {
+		rv[nodeUUID] = expires
+	}
+	mgr.m.Unlock()
+	return rv
+}
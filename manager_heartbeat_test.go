@@ -0,0 +1,116 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerHeartbeat(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil,
+		map[string]string{"heartbeatTTL": "1m"})
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	err = m.AddNode(&NodeDef{UUID: "b", HostPort: "b:1000"})
+	if err != nil {
+		t.Errorf("expected AddNode to work, err: %v", err)
+	}
+
+	_, err = CfgAcquireLease(cfg, CfgHeartbeatKey("b"), "b", -time.Second)
+	if err != nil {
+		t.Errorf("expected expired lease for b, err: %v", err)
+	}
+
+	err = m.HeartbeatOnce()
+	if err != nil {
+		t.Errorf("expected HeartbeatOnce to work, err: %v", err)
+	}
+
+	lease, err := CfgGetLease(cfg, CfgHeartbeatKey(m.uuid))
+	if err != nil || lease == nil || !lease.Expires.After(time.Now()) {
+		t.Errorf("expected heartbeat lease for mgr, err: %v", err)
+	}
+	if len(m.NodeLiveness()) != 2 {
+		t.Errorf("expected liveness for 2 nodes, got: %#v", m.NodeLiveness())
+	}
+	if !m.IsNodeAlive(m.uuid) {
+		t.Errorf("expected mgr to be alive")
+	}
+	if m.IsNodeAlive("b") {
+		t.Errorf("expected b to be dead")
+	}
+	if !m.IsNodeAlive("c") {
+		t.Errorf("expected unknown node c to be treated as alive")
+	}
+
+	m.SetOptions(map[string]string{
+		"heartbeatTTL":          "1m",
+		"heartbeatAutoFailover": "1ms",
+	})
+
+	// Another planner holding the failover lease wins the failover.
+	other, err := CfgAcquireLease(cfg, CfgFailoverKey("b"), "other", time.Minute)
+	if err != nil {
+		t.Errorf("expected failover lease for other, err: %v", err)
+	}
+
+	err = m.HeartbeatOnce()
+	if err != nil {
+		t.Errorf("expected HeartbeatOnce to work, err: %v", err)
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotHeartbeatAutoFailover != 0 {
+		t.Errorf("expected no auto-failover while other holds the lease,"+
+			" got: %d", stats.TotHeartbeatAutoFailover)
+	}
+
+	err = CfgReleaseLease(cfg, other)
+	if err != nil {
+		t.Errorf("expected release of failover lease to work, err: %v", err)
+	}
+
+	err = m.HeartbeatOnce()
+	if err != nil {
+		t.Errorf("expected HeartbeatOnce to work, err: %v", err)
+	}
+
+	m.StatsCopyTo(&stats)
+	if stats.TotHeartbeatAutoFailover != 1 {
+		t.Errorf("expected 1 auto-failover, got: %d",
+			stats.TotHeartbeatAutoFailover)
+	}
+
+	nd, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if err != nil || nd.NodeDefs["b"] != nil || nd.NodeDefs[m.uuid] == nil {
+		t.Errorf("expected b to be failed over, err: %v", err)
+	}
+
+	for _, key := range []string{CfgHeartbeatKey("b"), CfgFailoverKey("b")} {
+		lease, err := CfgGetLease(cfg, key)
+		if err != nil || lease != nil {
+			t.Errorf("expected lease removed, key: %s, err: %v", key, err)
+		}
+	}
+}
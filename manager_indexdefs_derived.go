@@ -0,0 +1,82 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync/atomic"
+)
+
+// An IndexDefsDerivedFunc computes a value from the index
+// definitions, such as the resolved target indexes of an index alias.
+type IndexDefsDerivedFunc func(indexDefs *IndexDefs,
+	indexDefsByName map[string]*IndexDef) (interface{}, error)
+
+type indexDefsDerived struct {
+	uuid string // The IndexDefs.UUID that the val was derived from.
+	val  interface{}
+}
+
+// GetIndexDefsDerived returns the value that f derives from the
+// latest index definitions, cached by the caller's key, so that
+// applications (like index alias resolution on every query) don't
+// re-walk the index definitions until they change.  The cache is
+// invalidated whenever the manager refreshes its index definitions to
+// a different IndexDefs.UUID, such as on a Cfg change of the
+// INDEX_DEFS_KEY, and entries are also checked against the
+// IndexDefs.UUID.  A nil IndexDefs has a UUID of "", so that values
+// derived while there are no index definitions are cached, too.
+func (mgr *Manager) GetIndexDefsDerived(key string,
+	f IndexDefsDerivedFunc) (interface{}, error) {
+	indexDefs, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+
+	uuid := indexDefsUUID(indexDefs)
+
+	mgr.m.Lock()
+	d := mgr.indexDefsDerived[key]
+	mgr.m.Unlock()
+
+	if d != nil && d.uuid == uuid {
+		atomic.AddUint64(&mgr.stats.TotIndexDefsDerivedHit, 1)
+		return d.val, nil
+	}
+
+	atomic.AddUint64(&mgr.stats.TotIndexDefsDerivedMiss, 1)
+
+	val, err := f(indexDefs, indexDefsByName)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.m.Lock()
+	// Only cache the val if the index definitions haven't changed
+	// while it was being derived, so a stale val isn't cached.
+	if mgr.lastIndexDefs == indexDefs {
+		if mgr.indexDefsDerived == nil {
+			mgr.indexDefsDerived = map[string]*indexDefsDerived{}
+		}
+		mgr.indexDefsDerived[key] = &indexDefsDerived{uuid: uuid, val: val}
+	}
+	mgr.m.Unlock()
+
+	return val, nil
+}
+
+// indexDefsUUID returns the UUID of the IndexDefs, or "" for nil.
+func indexDefsUUID(indexDefs *IndexDefs) string {
+	if indexDefs == nil {
+		return ""
+	}
+	return indexDefs.UUID
+}
@@ -0,0 +1,90 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetIndexDefsDerived(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		"", "some-datasource", nil)
+
+	// An alias whose IndexDef.Params names its target index.
+	repoint := func(target string) {
+		indexDefs, cas, _ := CfgGetIndexDefs(cfg)
+		if indexDefs == nil {
+			indexDefs = NewIndexDefs(VERSION)
+		}
+		indexDefs.UUID = NewUUID()
+		indexDefs.IndexDefs["alias"] = &IndexDef{
+			Name:   "alias",
+			Type:   "alias",
+			Params: target,
+		}
+		_, err := CfgSetIndexDefs(cfg, indexDefs, cas)
+		if err != nil {
+			t.Fatalf("expected CfgSetIndexDefs() to work, err: %v", err)
+		}
+		m.GetIndexDefs(true) // As on a Cfg event for INDEX_DEFS_KEY.
+	}
+
+	calls := 0
+	resolve := func() string {
+		val, err := m.GetIndexDefsDerived("alias",
+			func(indexDefs *IndexDefs,
+				indexDefsByName map[string]*IndexDef) (interface{}, error) {
+				calls++
+				if indexDefsByName["alias"] == nil {
+					return "", nil
+				}
+				return indexDefsByName["alias"].Params, nil
+			})
+		if err != nil {
+			t.Fatalf("expected GetIndexDefsDerived() to work, err: %v", err)
+		}
+		return val.(string)
+	}
+
+	if resolve() != "" || resolve() != "" || calls != 1 {
+		t.Errorf("expected cached empty resolution, calls: %d", calls)
+	}
+
+	repoint("blue")
+	if resolve() != "blue" || resolve() != "blue" || calls != 2 {
+		t.Errorf("expected cached blue resolution, calls: %d", calls)
+	}
+
+	// Rapid repointing must never return a stale target.
+	for i := 0; i < 20; i++ {
+		target := fmt.Sprintf("green-%d", i)
+		repoint(target)
+		if resolve() != target {
+			t.Errorf("expected target: %s, got stale: %s", target, resolve())
+		}
+	}
+
+	_, err := m.GetIndexDefsDerived("err",
+		func(*IndexDefs, map[string]*IndexDef) (interface{}, error) {
+			return nil, fmt.Errorf("oops")
+		})
+	if err == nil {
+		t.Errorf("expected err")
+	}
+
+	if m.stats.TotIndexDefsDerivedHit == 0 ||
+		m.stats.TotIndexDefsDerivedMiss == 0 {
+		t.Errorf("expected hits and misses")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -59,12 +60,18 @@ func (mgr *Manager) JanitorLoop() {
 			ec := make(chan CfgEvent)
 			mgr.cfg.Subscribe(PLAN_PINDEXES_KEY, ec)
 			mgr.cfg.Subscribe(CfgNodeDefsKey(NODE_DEFS_WANTED), ec)
+			mgr.cfg.Subscribe(PLAN_ROLLOUT_KEY, ec)
 			for {
 				select {
 				case <-mgr.stopCh:
 					return
 				case e := <-ec:
 					atomic.AddUint64(&mgr.stats.TotJanitorSubscriptionEvent, 1)
+					if e.Key == PLAN_PINDEXES_KEY {
+						mgr.EmitEvent(ManagerEvent{
+							Kind: MANAGER_EVENT_PLAN_CHANGED,
+						})
+					}
 					mgr.JanitorKick("cfg changed, key: " + e.Key)
 				}
 			}
@@ -91,6 +98,9 @@ func (mgr *Manager) JanitorLoop() {
 					// Keep looping as perhaps it's a transient issue.
 					// TODO: Perhaps need a rescheduled janitor kick.
 					log.Printf("janitor: JanitorOnce, err: %v", err)
+					if err != errJanitorNoPlan {
+						mgr.AddError(MANAGER_ERROR_JANITOR, "", err.Error())
+					}
 					atomic.AddUint64(&mgr.stats.TotJanitorKickErr, 1)
 				} else {
 					atomic.AddUint64(&mgr.stats.TotJanitorKickOk, 1)
@@ -126,12 +136,20 @@ func (mgr *Manager) JanitorLoop() {
 	}
 }
 
+// errJanitorNoPlan is returned by JanitorOnce when there's no plan
+// yet, which is normal on startup, so it's not a manager error.
+var errJanitorNoPlan = fmt.Errorf("janitor: skipped on nil planPIndexes")
+
 // JanitorOnce is the main body of a JanitorLoop.
 func (mgr *Manager) JanitorOnce(reason string) error {
 	if mgr.cfg == nil { // Can occur during testing.
 		return fmt.Errorf("janitor: skipped due to nil cfg")
 	}
 
+	LogDebugf("janitor", "janitor: once, reason: %s", reason)
+
+	defer mgr.timers.TimerJanitorOnce.UpdateSince(time.Now())
+
 	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
 
 	// NOTE: The janitor doesn't reconfirm that we're a wanted node
@@ -144,13 +162,32 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	}
 	if planPIndexes == nil {
 		// Might happen if janitor wins an initialization race.
-		return fmt.Errorf("janitor: skipped on nil planPIndexes")
+		return errJanitorNoPlan
+	}
+
+	// During a staged rollout, this node might need to keep applying
+	// its previous plan.
+	planPIndexes, rollout, err := mgr.janitorPlanPIndexes(planPIndexes)
+	if err != nil {
+		return err
 	}
 
+	mgr.ackPIndexRestart()
+
 	currFeeds, currPIndexes := mgr.CurrentMaps()
 
-	addPlanPIndexes, removePIndexes :=
-		CalcPIndexesDelta(mgr.uuid, currPIndexes, planPIndexes)
+	addPlanPIndexes, removePIndexes, queuedPlanPIndexes, restartPIndexes :=
+		mgr.janitorPIndexesDelta(currPIndexes, planPIndexes)
+
+	queuedNames := make([]string, 0, len(queuedPlanPIndexes))
+	for _, queuedPlanPIndex := range queuedPlanPIndexes {
+		queuedNames = append(queuedNames, queuedPlanPIndex.Name)
+	}
+	mgr.m.Lock()
+	mgr.pindexBuildsQueued = queuedNames
+	mgr.m.Unlock()
+	atomic.StoreUint64(&mgr.stats.NumPIndexBuildQueued,
+		uint64(len(queuedNames)))
 
 	log.Printf("janitor: pindexes to remove: %d", len(removePIndexes))
 	for _, pi := range removePIndexes {
@@ -160,6 +197,13 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	for _, ppi := range addPlanPIndexes {
 		log.Printf("  %+v", ppi)
 	}
+	if len(queuedNames) > 0 {
+		log.Printf("janitor: pindex builds queued: %d", len(queuedNames))
+	}
+	for _, r := range restartPIndexes {
+		log.Printf("janitor: pindex to restart: %s, as: %s",
+			r.pindex.Name, r.planPIndex.Name)
+	}
 
 	var errs []error
 
@@ -173,6 +217,15 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 					removePIndex.Name, err))
 		}
 	}
+	// Then, restart pindexes that can adopt their updated plan.
+	for _, restartPIndex := range restartPIndexes {
+		err = mgr.restartPIndexUsing(restartPIndex)
+		if err != nil {
+			errs = append(errs,
+				fmt.Errorf("janitor: restarting pindex: %s, err: %v",
+					restartPIndex.pindex.Name, err))
+		}
+	}
 	// Then, (re-)create pindexes that we're missing.
 	for _, addPlanPIndex := range addPlanPIndexes {
 		log.Printf("janitor: adding pindex: %s", addPlanPIndex.Name)
@@ -186,9 +239,8 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 
 	currFeeds, currPIndexes = mgr.CurrentMaps()
 
-	addFeeds, removeFeeds :=
-		CalcFeedsDelta(mgr.uuid, planPIndexes, currFeeds, currPIndexes,
-			feedAllotment)
+	addFeeds, removeFeeds := mgr.janitorFeedsDelta(currFeeds, currPIndexes,
+		planPIndexes, feedAllotment)
 
 	log.Printf("janitor: feeds to remove: %d", len(removeFeeds))
 	for _, removeFeed := range removeFeeds {
@@ -219,6 +271,27 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		}
 	}
 
+	mgr.m.Lock()
+	mgr.janitorPlanPIndexesPrev = planPIndexes
+	mgr.m.Unlock()
+
+	if rollout != nil {
+		mgr.ackPlanRollout(rollout, errs)
+	}
+
+	if len(removePIndexes) > 0 || len(addPlanPIndexes) > 0 ||
+		len(restartPIndexes) > 0 ||
+		len(removeFeeds) > 0 || len(addFeeds) > 0 {
+		mgr.EmitEvent(ManagerEvent{
+			Kind: MANAGER_EVENT_JANITOR,
+			Msg: fmt.Sprintf("reason: %s, pindexes removed: %d, added: %d,"+
+				" restarted: %d, feeds removed: %d, added: %d, errors: %d",
+				reason, len(removePIndexes), len(addPlanPIndexes),
+				len(restartPIndexes), len(removeFeeds), len(addFeeds),
+				len(errs)),
+		})
+	}
+
 	if len(errs) > 0 {
 		var s []string
 		for i, err := range errs {
@@ -231,6 +304,180 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 	return nil
 }
 
+// janitorPIndexesDelta determines the pindexes that the janitor
+// needs to add and remove, leaving pindexes with paused ingest as-is,
+// such as during a backup or restore.  Pindexes whose builds need to
+// wait (see MaxConcurrentPIndexBuildsOption) are returned as queued,
+// and pindexes that are ready for a rolling restart (see
+// PINDEXES_RESTART) are returned as restarts.
+func (mgr *Manager) janitorPIndexesDelta(currPIndexes map[string]*PIndex,
+	planPIndexes *PlanPIndexes) (
+	[]*PlanPIndex, []*PIndex, []*PlanPIndex, []*pindexRestart) {
+	addPlanPIndexes, removePIndexes :=
+		CalcPIndexesDelta(mgr.uuid, currPIndexes, planPIndexes)
+
+	addPlanPIndexes, removePIndexes =
+		mgr.filterPausedPIndexes(addPlanPIndexes, removePIndexes)
+
+	addPlanPIndexes, removePIndexes, restartPIndexes :=
+		mgr.filterPIndexRestarts(addPlanPIndexes, removePIndexes)
+
+	addPlanPIndexes, queuedPlanPIndexes :=
+		mgr.throttlePIndexBuilds(addPlanPIndexes, removePIndexes)
+
+	return addPlanPIndexes, removePIndexes, queuedPlanPIndexes,
+		restartPIndexes
+}
+
+// janitorFeedsDelta determines the feeds that the janitor needs to
+// add and remove.
+func (mgr *Manager) janitorFeedsDelta(currFeeds map[string]Feed,
+	currPIndexes map[string]*PIndex, planPIndexes *PlanPIndexes,
+	feedAllotment string) ([][]*PIndex, []Feed) {
+	// Pindexes with paused ingest, or that are read-only with the
+	// buffer policy, have their feeds removed.
+	feedPIndexes := make(map[string]*PIndex, len(currPIndexes))
+	for pindexName, pindex := range currPIndexes {
+		if !mgr.IsPIndexPaused(pindexName) &&
+			mgr.PIndexReadOnly(pindexName) != PINDEX_READ_ONLY_BUFFER {
+			feedPIndexes[pindexName] = pindex
+		}
+	}
+
+	addFeeds, removeFeeds :=
+		CalcFeedsDelta(mgr.uuid, planPIndexes, currFeeds, feedPIndexes,
+			feedAllotment)
+
+	// Restart any remaining feeds whose dests are stale due to
+	// changed read-only policies.
+	return mgr.restartStaleFeeds(currFeeds, planPIndexes,
+		feedPIndexes, feedAllotment, addFeeds, removeFeeds)
+}
+
+// --------------------------------------------------------
+
+// A JanitorPlan represents the actions that the janitor intends to
+// take on this node to reconcile its pindexes and feeds with the
+// current plan.
+type JanitorPlan struct {
+	AddPIndexes    []string `json:"addPIndexes"`
+	RemovePIndexes []string `json:"removePIndexes"`
+	AddFeeds       []string `json:"addFeeds"`
+	RemoveFeeds    []string `json:"removeFeeds"`
+	QueuedPIndexes []string `json:"queuedPIndexes"` // Queued builds.
+
+	RestartPIndexes []string `json:"restartPIndexes"` // Rolling restarts.
+}
+
+// JanitorPlan returns what the janitor would do if it were kicked
+// now, without making any changes.  The feeds to add and remove are
+// computed as if the pindexes to add and remove had succeeded.
+func (mgr *Manager) JanitorPlan() (*JanitorPlan, error) {
+	if mgr.cfg == nil { // Can occur during testing.
+		return nil, fmt.Errorf("janitor: JanitorPlan, nil cfg")
+	}
+
+	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("janitor: JanitorPlan,"+
+			" CfgGetPlanPIndexes err: %v", err)
+	}
+
+	rv := &JanitorPlan{
+		AddPIndexes:    []string{},
+		RemovePIndexes: []string{},
+		AddFeeds:       []string{},
+		RemoveFeeds:    []string{},
+		QueuedPIndexes: []string{},
+
+		RestartPIndexes: []string{},
+	}
+
+	if planPIndexes == nil {
+		// The janitor skips its work until there's a plan.
+		return rv, nil
+	}
+
+	planPIndexes, _, err = mgr.janitorPlanPIndexes(planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	currFeeds, currPIndexes := mgr.CurrentMaps()
+
+	addPlanPIndexes, removePIndexes, queuedPlanPIndexes, restartPIndexes :=
+		mgr.janitorPIndexesDelta(currPIndexes, planPIndexes)
+
+	for _, queuedPlanPIndex := range queuedPlanPIndexes {
+		rv.QueuedPIndexes = append(rv.QueuedPIndexes, queuedPlanPIndex.Name)
+	}
+	for _, restartPIndex := range restartPIndexes {
+		rv.RestartPIndexes = append(rv.RestartPIndexes, restartPIndex.pindex.Name)
+	}
+
+	nextPIndexes := make(map[string]*PIndex, len(currPIndexes))
+	for pindexName, pindex := range currPIndexes {
+		nextPIndexes[pindexName] = pindex
+	}
+	for _, removePIndex := range removePIndexes {
+		rv.RemovePIndexes = append(rv.RemovePIndexes, removePIndex.Name)
+		delete(nextPIndexes, removePIndex.Name)
+	}
+	for _, addPlanPIndex := range addPlanPIndexes {
+		rv.AddPIndexes = append(rv.AddPIndexes, addPlanPIndex.Name)
+		nextPIndexes[addPlanPIndex.Name] = planPIndexToPIndex(addPlanPIndex)
+	}
+	for _, restartPIndex := range restartPIndexes {
+		delete(nextPIndexes, restartPIndex.pindex.Name)
+		nextPIndexes[restartPIndex.planPIndex.Name] =
+			planPIndexToPIndex(restartPIndex.planPIndex)
+	}
+
+	addFeeds, removeFeeds := mgr.janitorFeedsDelta(currFeeds, nextPIndexes,
+		planPIndexes, feedAllotment)
+	for _, addFeedPIndexes := range addFeeds {
+		if len(addFeedPIndexes) > 0 {
+			rv.AddFeeds = append(rv.AddFeeds,
+				FeedNameForPIndex(addFeedPIndexes[0], feedAllotment))
+		}
+	}
+	for _, removeFeed := range removeFeeds {
+		rv.RemoveFeeds = append(rv.RemoveFeeds, removeFeed.Name())
+	}
+
+	sort.Strings(rv.AddPIndexes)
+	sort.Strings(rv.RemovePIndexes)
+	sort.Strings(rv.AddFeeds)
+	sort.Strings(rv.RemoveFeeds)
+	sort.Strings(rv.QueuedPIndexes)
+
+	return rv, nil
+}
+
+// planPIndexToPIndex returns a placeholder, unopened pindex for a
+// plan pindex, used to simulate the janitor's feed decisions.
+func planPIndexToPIndex(planPIndex *PlanPIndex) *PIndex {
+	pindex := &PIndex{
+		Name:             planPIndex.Name,
+		IndexType:        planPIndex.IndexType,
+		IndexName:        planPIndex.IndexName,
+		IndexUUID:        planPIndex.IndexUUID,
+		IndexParams:      planPIndex.IndexParams,
+		SourceType:       planPIndex.SourceType,
+		SourceName:       planPIndex.SourceName,
+		SourceUUID:       planPIndex.SourceUUID,
+		SourceParams:     planPIndex.SourceParams,
+		SourcePartitions: planPIndex.SourcePartitions,
+	}
+	pindex.sourcePartitionsMap = map[string]bool{}
+	for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+		pindex.sourcePartitionsMap[partition] = true
+	}
+	return pindex
+}
+
 // --------------------------------------------------------
 
 // Functionally determine the delta of which pindexes need creation
@@ -382,12 +629,30 @@ func (mgr *Manager) startPIndex(planPIndex *PlanPIndex) error {
 
 	path := mgr.PIndexPath(planPIndex.Name)
 
+	err = mgr.mkPIndexParentDir(path)
+	if err != nil {
+		return err
+	}
+
+	// When enabled, try copying the pindex's files from another node
+	// that's assigned the same pindex, instead of rebuilding the
+	// pindex from its data source.
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) && mgr.pindexTransferEnabled() {
+		err = mgr.transferPIndex(planPIndex, path)
+		if err != nil {
+			log.Printf("janitor: startPIndex, transferPIndex error,"+
+				" falling back to NewPIndex, path: %s, err: %v", path, err)
+		}
+	}
+
 	// First, try reading the path with OpenPIndex().  An
 	// existing path might happen during a case of rollback.
 	_, err = os.Stat(path)
 	if err == nil {
 		pindex, err = OpenPIndex(mgr, path)
 		if err != nil {
+			mgr.notePIndexOpenErr(path, err)
 			log.Printf("janitor: startPIndex, OpenPIndex error,"+
 				" cleaning up and trying NewPIndex,"+
 				" path: %s, err: %v", path, err)
@@ -403,7 +668,11 @@ func (mgr *Manager) startPIndex(planPIndex *PlanPIndex) error {
 		}
 	}
 
+	eventKind := MANAGER_EVENT_PINDEX_OPENED
+
 	if pindex == nil {
+		eventKind = MANAGER_EVENT_PINDEX_CREATED
+
 		pindex, err = NewPIndex(mgr, planPIndex.Name, NewUUID(),
 			planPIndex.IndexType,
 			planPIndex.IndexName,
@@ -427,6 +696,12 @@ func (mgr *Manager) startPIndex(planPIndex *PlanPIndex) error {
 		return err
 	}
 
+	if eventKind == MANAGER_EVENT_PINDEX_CREATED {
+		mgr.startPIndexBuild(pindex)
+	}
+
+	mgr.emitPIndexEvent(eventKind, pindex)
+
 	return nil
 }
 
@@ -435,7 +710,7 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 	feeds, _ := mgr.CurrentMaps()
 	for _, feed := range feeds {
 		for _, dest := range feed.Dests() {
-			if dest == pindex.Dest {
+			if unwrapFeedDest(dest) == pindex.Dest {
 				err := mgr.stopFeed(feed)
 				if err != nil {
 					return err
@@ -465,7 +740,19 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 			" pindex: %#v, pindexUnreg: %#v", pindex, pindexUnreg)
 	}
 
-	return pindex.Close(remove)
+	err := pindex.Close(remove)
+	if remove {
+		mgr.removeEmptyPIndexParentDir(pindex.Path)
+	}
+
+	mgr.EmitEvent(ManagerEvent{
+		Kind:       MANAGER_EVENT_PINDEX_CLOSED,
+		IndexName:  pindex.IndexName,
+		PIndexName: pindex.Name,
+		Removed:    remove,
+	})
+
+	return err
 }
 
 // --------------------------------------------------------
@@ -487,13 +774,15 @@ func (mgr *Manager) startFeed(pindexes []*PIndex) error {
 				" pindex: %#v", f, feedName, pindex)
 		}
 
+		dest := mgr.feedDest(pindex)
+
 		addSourcePartition := func(sourcePartition string) error {
 			if _, exists := dests[sourcePartition]; exists {
 				return fmt.Errorf("janitor: startFeed collision,"+
 					" sourcePartition: %s, feedName: %s, pindex: %#v",
 					sourcePartition, feedName, pindex)
 			}
-			dests[sourcePartition] = pindex.Dest
+			dests[sourcePartition] = dest
 			return nil
 		}
 
@@ -535,8 +824,25 @@ func (mgr *Manager) startFeedByType(feedName, indexName, indexUUID,
 		return fmt.Errorf("janitor: unknown sourceType: %s", sourceType)
 	}
 
-	return feedType.Start(mgr, feedName, indexName, indexUUID,
+	err := feedType.Start(mgr, feedName, indexName, indexUUID,
 		sourceType, sourceName, sourceUUID, sourceParams, dests)
+	if err != nil {
+		mgr.EmitEvent(ManagerEvent{
+			Kind:      MANAGER_EVENT_FEED_ERROR,
+			IndexName: indexName,
+			FeedName:  feedName,
+			Err:       err.Error(),
+		})
+		return err
+	}
+
+	mgr.EmitEvent(ManagerEvent{
+		Kind:      MANAGER_EVENT_FEED_STARTED,
+		IndexName: indexName,
+		FeedName:  feedName,
+	})
+
+	return nil
 }
 
 func (mgr *Manager) stopFeed(feed Feed) error {
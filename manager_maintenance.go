@@ -0,0 +1,441 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// Heavy background operations, like compactions, verifications or
+// planned rebalances, can be deferred to maintenance windows.  A
+// MaintenanceSchedule runs a MaintenanceOp once per occurrence of its
+// window, which starts at a time of day (in UTC) on some days of the
+// week and lasts for a duration.  The schedules are kept in the Cfg,
+// so they apply to the whole cluster, and every node checks them
+// periodically, per the "maintenanceCheckInterval" manager option,
+// like "1m", which defaults to MAINTENANCE_CHECK_INTERVAL.  An op
+// that's not PerNode runs on only one node per window occurrence.
+
+// MAINTENANCE_SCHEDULES_KEY is the key used for Cfg access of the
+// MaintenanceSchedules.
+const MAINTENANCE_SCHEDULES_KEY = "maintenanceSchedules"
+
+// MAINTENANCE_CHECK_INTERVAL is the default for the
+// maintenanceCheckInterval manager option.
+var MAINTENANCE_CHECK_INTERVAL = time.Minute
+
+// MAINTENANCE_OP_VERIFY verifies the local pindexes of every node,
+// where the schedule's params are like {"repair": true}.  See
+// Manager.VerifyPIndexes().
+const MAINTENANCE_OP_VERIFY = "verify"
+
+// MAINTENANCE_OP_TASK submits a task, like a compaction, to the
+// schedule's index, where the schedule's params are the task
+// request.  See Manager.SubmitTask().
+const MAINTENANCE_OP_TASK = "task"
+
+// A MaintenanceOp is an operation that can be deferred to a
+// maintenance window.
+type MaintenanceOp struct {
+	// PerNode ops run on every node, rather than on one node.
+	PerNode bool
+
+	Run func(mgr *Manager, s *MaintenanceSchedule) error
+}
+
+// MaintenanceOps allows applications to register more operations,
+// like a planned rebalance, by name.  It should be modified only
+// during the init()'ialization phase of process startup.
+var MaintenanceOps = map[string]*MaintenanceOp{
+	MAINTENANCE_OP_VERIFY: {
+		PerNode: true,
+		Run: func(mgr *Manager, s *MaintenanceSchedule) error {
+			var params struct {
+				Repair bool `json:"repair"`
+			}
+			if len(s.Params) > 0 {
+				err := json.Unmarshal(s.Params, &params)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := mgr.VerifyPIndexes(params.Repair)
+			return err
+		},
+	},
+	MAINTENANCE_OP_TASK: {
+		Run: func(mgr *Manager, s *MaintenanceSchedule) error {
+			_, err := mgr.SubmitTask(s.IndexName, s.Params)
+			return err
+		},
+	},
+}
+
+// A MaintenanceSchedule represents an operation that's deferred to a
+// recurring maintenance window.
+type MaintenanceSchedule struct {
+	Name      string          `json:"name"`
+	Op        string          `json:"op"` // A MaintenanceOps name.
+	IndexName string          `json:"indexName,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Disabled  bool            `json:"disabled,omitempty"`
+
+	// Days of the week of the window, where 0 is Sunday, or every
+	// day when empty.
+	Days []int `json:"days,omitempty"`
+
+	Start    string `json:"start"`    // Time of day in UTC, like "02:30".
+	Duration string `json:"duration"` // Like "2h".
+
+	// The last runs and errors of the op, keyed by node UUID, or by
+	// "" for an op that's not PerNode.
+	LastRuns map[string]time.Time `json:"lastRuns,omitempty"`
+	LastErrs map[string]string    `json:"lastErrs,omitempty"`
+}
+
+// MaintenanceSchedules represents the maintenance schedules of a
+// cluster, keyed by schedule name.
+type MaintenanceSchedules struct {
+	Schedules   map[string]*MaintenanceSchedule `json:"schedules"`
+	ImplVersion string                          `json:"implVersion"`
+}
+
+// Validate checks a schedule's op and window.
+func (s *MaintenanceSchedule) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("manager_maintenance: name is required")
+	}
+	if MaintenanceOps[s.Op] == nil {
+		return fmt.Errorf("manager_maintenance: unknown op: %q", s.Op)
+	}
+	for _, day := range s.Days {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("manager_maintenance: bad day: %d", day)
+		}
+	}
+	_, _, err := s.window()
+	return err
+}
+
+func (s *MaintenanceSchedule) window() (
+	start time.Duration, duration time.Duration, err error) {
+	t, err := time.Parse("15:04", s.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("manager_maintenance: bad start: %q,"+
+			" err: %v", s.Start, err)
+	}
+	start = time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute
+
+	duration, err = time.ParseDuration(s.Duration)
+	if err != nil || duration <= 0 || duration > 24*time.Hour {
+		return 0, 0, fmt.Errorf("manager_maintenance: bad duration: %q,"+
+			" err: %v", s.Duration, err)
+	}
+
+	return start, duration, nil
+}
+
+// WindowStart returns the start of the schedule's window occurrence
+// that's open at the given time, if any.
+func (s *MaintenanceSchedule) WindowStart(now time.Time) (time.Time, bool) {
+	start, duration, err := s.window()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		time.UTC)
+
+	// A window that started yesterday might still be open.
+	for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+		windowStart := day.Add(start)
+		if s.onDay(windowStart.Weekday()) &&
+			!now.Before(windowStart) && now.Before(windowStart.Add(duration)) {
+			return windowStart, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func (s *MaintenanceSchedule) onDay(weekday time.Weekday) bool {
+	if len(s.Days) <= 0 {
+		return true
+	}
+	for _, day := range s.Days {
+		if time.Weekday(day) == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// CfgGetMaintenanceSchedules retrieves the MaintenanceSchedules from
+// a Cfg provider.
+func CfgGetMaintenanceSchedules(cfg Cfg) (
+	*MaintenanceSchedules, uint64, error) {
+	v, cas, err := cfg.Get(MAINTENANCE_SCHEDULES_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &MaintenanceSchedules{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// cfgUpdateMaintenanceSchedules performs a read-modify-write of the
+// MaintenanceSchedules with CAS retries, where the update callback
+// returns false to leave the MaintenanceSchedules unchanged.
+func cfgUpdateMaintenanceSchedules(cfg Cfg, version string,
+	update func(ms *MaintenanceSchedules) (bool, error)) error {
+	_, err := CfgSetRetry(cfg, MAINTENANCE_SCHEDULES_KEY,
+		CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			ms := &MaintenanceSchedules{}
+			if val != nil {
+				err := json.Unmarshal(val, ms)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if ms.Schedules == nil {
+				ms.Schedules = map[string]*MaintenanceSchedule{}
+			}
+
+			changed, err := update(ms)
+			if err != nil || !changed {
+				return nil, err
+			}
+
+			ms.ImplVersion = version
+
+			return json.Marshal(ms)
+		})
+
+	return err
+}
+
+// SetMaintenanceSchedule adds or replaces a maintenance schedule,
+// keeping the last runs of a replaced schedule.
+func (mgr *Manager) SetMaintenanceSchedule(s *MaintenanceSchedule) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+
+	return cfgUpdateMaintenanceSchedules(mgr.cfg, mgr.version,
+		func(ms *MaintenanceSchedules) (bool, error) {
+			if prev := ms.Schedules[s.Name]; prev != nil {
+				s.LastRuns = prev.LastRuns
+				s.LastErrs = prev.LastErrs
+			}
+			ms.Schedules[s.Name] = s
+			return true, nil
+		})
+}
+
+// DeleteMaintenanceSchedule removes a maintenance schedule.
+func (mgr *Manager) DeleteMaintenanceSchedule(name string) error {
+	return cfgUpdateMaintenanceSchedules(mgr.cfg, mgr.version,
+		func(ms *MaintenanceSchedules) (bool, error) {
+			if ms.Schedules[name] == nil {
+				return false, fmt.Errorf("manager_maintenance: no schedule,"+
+					" name: %s", name)
+			}
+			delete(ms.Schedules, name)
+			return true, nil
+		})
+}
+
+// ListMaintenanceSchedules returns the maintenance schedules, sorted
+// by name.
+func (mgr *Manager) ListMaintenanceSchedules() ([]*MaintenanceSchedule, error) {
+	ms, _, err := CfgGetMaintenanceSchedules(mgr.cfg)
+	if err != nil || ms == nil {
+		return []*MaintenanceSchedule{}, err
+	}
+
+	names := make([]string, 0, len(ms.Schedules))
+	for name := range ms.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rv := make([]*MaintenanceSchedule, 0, len(names))
+	for _, name := range names {
+		rv = append(rv, ms.Schedules[name])
+	}
+	return rv, nil
+}
+
+// MaintenanceLoop periodically runs the maintenance schedules whose
+// windows are open, and exits when the manager is stopped.
+func (mgr *Manager) MaintenanceLoop() {
+	interval := mgr.optionDuration("maintenanceCheckInterval")
+	if interval <= 0 {
+		interval = MAINTENANCE_CHECK_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		mgr.MaintenanceOnce(time.Now())
+	}
+}
+
+// MaintenanceOnce runs the ops of the enabled maintenance schedules
+// whose windows are open at the given time, and which haven't run yet
+// during their current window occurrence.
+func (mgr *Manager) MaintenanceOnce(now time.Time) {
+	if mgr.cfg == nil { // Can occur during testing.
+		return
+	}
+
+	schedules, err := mgr.ListMaintenanceSchedules()
+	if err != nil {
+		log.Printf("manager_maintenance: ListMaintenanceSchedules, err: %v",
+			err)
+		return
+	}
+
+	for _, s := range schedules {
+		windowStart, open := s.WindowStart(now)
+		if s.Disabled || !open {
+			continue
+		}
+
+		op := MaintenanceOps[s.Op]
+		if op == nil {
+			continue
+		}
+
+		runKey := ""
+		if op.PerNode {
+			runKey = mgr.uuid
+		}
+
+		// Claim the run, so that an op that's not PerNode runs on
+		// only one node.
+		claimed := false
+		err = cfgUpdateMaintenanceSchedules(mgr.cfg, mgr.version,
+			func(ms *MaintenanceSchedules) (bool, error) {
+				claimed = false
+				curr := ms.Schedules[s.Name]
+				if curr == nil || curr.Disabled ||
+					!curr.LastRuns[runKey].Before(windowStart) {
+					return false, nil
+				}
+				if curr.LastRuns == nil {
+					curr.LastRuns = map[string]time.Time{}
+				}
+				curr.LastRuns[runKey] = now
+				claimed = true
+				return true, nil
+			})
+		if err != nil {
+			log.Printf("manager_maintenance: claim, name: %s, err: %v",
+				s.Name, err)
+			continue
+		}
+
+		if claimed {
+			mgr.runMaintenance(s, op, runKey, now)
+		}
+	}
+}
+
+// RunMaintenanceNow runs a maintenance schedule's op on this node
+// right away, regardless of its window.
+func (mgr *Manager) RunMaintenanceNow(name string) error {
+	ms, _, err := CfgGetMaintenanceSchedules(mgr.cfg)
+	if err != nil {
+		return err
+	}
+	if ms == nil || ms.Schedules[name] == nil {
+		return fmt.Errorf("manager_maintenance: no schedule, name: %s", name)
+	}
+
+	s := ms.Schedules[name]
+
+	op := MaintenanceOps[s.Op]
+	if op == nil {
+		return fmt.Errorf("manager_maintenance: unknown op: %q", s.Op)
+	}
+
+	runKey := ""
+	if op.PerNode {
+		runKey = mgr.uuid
+	}
+
+	return mgr.runMaintenance(s, op, runKey, time.Now())
+}
+
+// runMaintenance runs a schedule's op and records the outcome.
+func (mgr *Manager) runMaintenance(s *MaintenanceSchedule,
+	op *MaintenanceOp, runKey string, now time.Time) error {
+	log.Printf("manager_maintenance: running, name: %s, op: %s",
+		s.Name, s.Op)
+
+	atomic.AddUint64(&mgr.stats.TotMaintenanceRun, 1)
+
+	errRun := op.Run(mgr, s)
+	if errRun != nil {
+		atomic.AddUint64(&mgr.stats.TotMaintenanceRunErr, 1)
+		log.Printf("manager_maintenance: run, name: %s, op: %s, err: %v",
+			s.Name, s.Op, errRun)
+	}
+
+	err := cfgUpdateMaintenanceSchedules(mgr.cfg, mgr.version,
+		func(ms *MaintenanceSchedules) (bool, error) {
+			curr := ms.Schedules[s.Name]
+			if curr == nil {
+				return false, nil
+			}
+			if curr.LastRuns == nil {
+				curr.LastRuns = map[string]time.Time{}
+			}
+			curr.LastRuns[runKey] = now
+			if curr.LastErrs == nil {
+				curr.LastErrs = map[string]string{}
+			}
+			if errRun != nil {
+				curr.LastErrs[runKey] = errRun.Error()
+			} else {
+				delete(curr.LastErrs, runKey)
+			}
+			return true, nil
+		})
+	if err != nil {
+		log.Printf("manager_maintenance: record run, name: %s, err: %v",
+			s.Name, err)
+	}
+
+	return errRun
+}
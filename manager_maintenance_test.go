@@ -0,0 +1,140 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceScheduleWindowStart(t *testing.T) {
+	// 2016-01-03 was a Sunday.
+	s := &MaintenanceSchedule{
+		Name: "s", Op: MAINTENANCE_OP_VERIFY,
+		Days: []int{0}, Start: "23:00", Duration: "2h",
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected valid schedule, err: %v", err)
+	}
+
+	tests := []struct {
+		now  time.Time
+		open bool
+	}{
+		{time.Date(2016, 1, 3, 22, 59, 0, 0, time.UTC), false},
+		{time.Date(2016, 1, 3, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2016, 1, 4, 0, 30, 0, 0, time.UTC), true},
+		{time.Date(2016, 1, 4, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2016, 1, 4, 23, 30, 0, 0, time.UTC), false},
+	}
+	for i, test := range tests {
+		windowStart, open := s.WindowStart(test.now)
+		if open != test.open {
+			t.Errorf("test %d, expected open: %v, got: %v",
+				i, test.open, open)
+		}
+		if open && !windowStart.Equal(
+			time.Date(2016, 1, 3, 23, 0, 0, 0, time.UTC)) {
+			t.Errorf("test %d, wrong windowStart: %v", i, windowStart)
+		}
+	}
+
+	for _, bad := range []*MaintenanceSchedule{
+		{Name: "", Op: MAINTENANCE_OP_VERIFY, Start: "01:00", Duration: "1h"},
+		{Name: "s", Op: "not-an-op", Start: "01:00", Duration: "1h"},
+		{Name: "s", Op: MAINTENANCE_OP_VERIFY, Start: "25:00", Duration: "1h"},
+		{Name: "s", Op: MAINTENANCE_OP_VERIFY, Start: "01:00", Duration: "0s"},
+		{Name: "s", Op: MAINTENANCE_OP_VERIFY, Start: "01:00", Duration: "1h",
+			Days: []int{7}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("expected invalid schedule: %#v", bad)
+		}
+	}
+}
+
+func TestMaintenanceOnce(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	runs := 0
+	MaintenanceOps["test"] = &MaintenanceOp{
+		Run: func(mgr *Manager, s *MaintenanceSchedule) error {
+			runs++
+			if runs > 1 {
+				return fmt.Errorf("again")
+			}
+			return nil
+		},
+	}
+	defer delete(MaintenanceOps, "test")
+
+	cfg := NewCfgMem()
+	m0 := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	m1 := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1001",
+		emptyDir, "some-datasource", nil)
+
+	err := m0.SetMaintenanceSchedule(&MaintenanceSchedule{
+		Name: "nightly", Op: "test", Start: "02:00", Duration: "1h",
+	})
+	if err != nil {
+		t.Errorf("expected SetMaintenanceSchedule to work, err: %v", err)
+	}
+
+	// Windows in the future, so that a run now doesn't count as a
+	// window's run.
+	future := time.Now().UTC().AddDate(0, 0, 2)
+	now := time.Date(future.Year(), future.Month(), future.Day(),
+		2, 30, 0, 0, time.UTC)
+
+	m0.MaintenanceOnce(now.Add(-time.Hour))
+	if runs != 0 {
+		t.Errorf("expected no run outside of the window")
+	}
+
+	// An op that's not PerNode runs on one node per window.
+	m0.MaintenanceOnce(now)
+	m1.MaintenanceOnce(now)
+	m0.MaintenanceOnce(now.Add(time.Minute))
+	if runs != 1 {
+		t.Errorf("expected 1 run in the window, got: %d", runs)
+	}
+
+	if err = m1.RunMaintenanceNow("nightly"); err == nil || runs != 2 {
+		t.Errorf("expected run now with an err, got runs: %d", runs)
+	}
+
+	schedules, err := m1.ListMaintenanceSchedules()
+	if err != nil || len(schedules) != 1 ||
+		schedules[0].LastErrs[""] != "again" {
+		t.Errorf("expected recorded err, got: %#v, err: %v", schedules, err)
+	}
+
+	m0.MaintenanceOnce(now.Add(24 * time.Hour))
+	if runs != 3 {
+		t.Errorf("expected a run in the next window, got: %d", runs)
+	}
+
+	if err = m0.DeleteMaintenanceSchedule("nightly"); err != nil {
+		t.Errorf("expected delete to work, err: %v", err)
+	}
+	if err = m0.DeleteMaintenanceSchedule("nightly"); err == nil {
+		t.Errorf("expected err on deleting a missing schedule")
+	}
+	if err = m0.RunMaintenanceNow("nightly"); err == nil {
+		t.Errorf("expected err on running a missing schedule")
+	}
+}
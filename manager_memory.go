@@ -0,0 +1,290 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// Pindex implementations that hold their data in memory can report
+// their estimated memory usage, so that the manager can enforce a
+// soft, node-level memory quota instead of letting the process OOM.
+// The memory quota is controlled by these manager options:
+//
+// * memoryQuota - the max total estimated memory usage in bytes of
+//   the local pindexes; disabled when empty or "0".  While the usage
+//   is over the quota, the ingest of the local pindexes is throttled
+//   and the pindexes that support it are asked to evict memory.
+// * memoryCheckInterval - how often the memory usage is measured;
+//   like "1s", which is parsed by time.ParseDuration(); defaults to
+//   MEMORY_CHECK_INTERVAL.
+// * memoryThrottleMaxWait - the max time an incoming mutation is
+//   paused while over the quota, after which it's passed through to
+//   the Dest anyway; defaults to MEMORY_THROTTLE_MAX_WAIT.
+
+// MEMORY_CHECK_INTERVAL is the default for the memoryCheckInterval
+// manager option.
+var MEMORY_CHECK_INTERVAL = time.Second
+
+// MEMORY_THROTTLE_MAX_WAIT is the default for the
+// memoryThrottleMaxWait manager option.
+var MEMORY_THROTTLE_MAX_WAIT = 10 * time.Second
+
+// A PIndexMemoryUser is a pindex Impl or Dest that can report its
+// estimated memory usage.
+type PIndexMemoryUser interface {
+	MemoryUsed() uint64
+}
+
+// A PIndexMemoryEvicter is a pindex Impl or Dest that can release
+// memory, such as by flushing or dropping caches, when asked.  The
+// request is a hint, and the pindex may free less than asked.
+type PIndexMemoryEvicter interface {
+	EvictMemory(targetBytes uint64)
+}
+
+// MemoryUsage represents the last measured memory usage of the local
+// pindexes against the memory quota.
+type MemoryUsage struct {
+	Quota     uint64            `json:"quota"`
+	Used      uint64            `json:"used"`
+	OverQuota bool              `json:"overQuota"`
+	PIndexes  map[string]uint64 `json:"pindexes"`
+}
+
+func memoryQuota(options map[string]string) uint64 {
+	v, err := strconv.ParseUint(options["memoryQuota"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// pindexMemoryUser returns the PIndexMemoryUser of a pindex, if any.
+func pindexMemoryUser(pindex *PIndex) PIndexMemoryUser {
+	if u, ok := pindex.Impl.(PIndexMemoryUser); ok {
+		return u
+	}
+	if u, ok := pindex.Dest.(PIndexMemoryUser); ok {
+		return u
+	}
+	return nil
+}
+
+// pindexMemoryEvicter returns the PIndexMemoryEvicter of a pindex,
+// if any.
+func pindexMemoryEvicter(pindex *PIndex) PIndexMemoryEvicter {
+	if e, ok := pindex.Impl.(PIndexMemoryEvicter); ok {
+		return e
+	}
+	if e, ok := pindex.Dest.(PIndexMemoryEvicter); ok {
+		return e
+	}
+	return nil
+}
+
+// MemoryLoop periodically measures the memory usage of the local
+// pindexes and enforces the memory quota, and exits when the manager
+// is stopped.
+func (mgr *Manager) MemoryLoop() {
+	interval := mgr.optionDuration("memoryCheckInterval")
+	if interval <= 0 {
+		interval = MEMORY_CHECK_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		mgr.MemoryOnce()
+	}
+}
+
+// MemoryOnce measures the memory usage of the local pindexes.  When
+// the usage is over the memoryQuota manager option, the ingest of the
+// local pindexes is throttled, and each evictable pindex is asked to
+// evict its share of the excess, in proportion to its usage.
+func (mgr *Manager) MemoryOnce() {
+	_, pindexes := mgr.CurrentMaps()
+
+	var used uint64
+
+	pindexUsage := make(map[string]uint64, len(pindexes))
+	for pindexName, pindex := range pindexes {
+		if u := pindexMemoryUser(pindex); u != nil {
+			pindexUsage[pindexName] = u.MemoryUsed()
+			used += pindexUsage[pindexName]
+		}
+	}
+
+	quota := memoryQuota(mgr.Options())
+	overQuota := quota > 0 && used > quota
+
+	mgr.m.Lock()
+	mgr.pindexMemoryUsage = pindexUsage
+	mgr.m.Unlock()
+
+	var overQuotaFlag int32
+	if overQuota {
+		overQuotaFlag = 1
+	}
+	wasOverQuota := atomic.SwapInt32(&mgr.memoryOverQuota, overQuotaFlag) != 0
+
+	if overQuota {
+		if !wasOverQuota {
+			log.Printf("manager_memory: over quota, used: %d, quota: %d",
+				used, quota)
+			mgr.EmitEvent(ManagerEvent{
+				Kind: MANAGER_EVENT_MEMORY_OVER_QUOTA,
+				Msg:  fmt.Sprintf("used: %d, quota: %d", used, quota),
+			})
+		}
+
+		excess := used - quota
+		for pindexName, pindex := range pindexes {
+			e := pindexMemoryEvicter(pindex)
+			if e == nil || pindexUsage[pindexName] <= 0 {
+				continue
+			}
+			target := uint64(float64(excess) *
+				float64(pindexUsage[pindexName]) / float64(used))
+			if target > 0 {
+				atomic.AddUint64(&mgr.stats.TotMemoryEvictHint, 1)
+				e.EvictMemory(target)
+			}
+		}
+
+		return
+	}
+
+	if wasOverQuota {
+		log.Printf("manager_memory: under quota, used: %d, quota: %d",
+			used, quota)
+		mgr.EmitEvent(ManagerEvent{
+			Kind: MANAGER_EVENT_MEMORY_OK,
+			Msg:  fmt.Sprintf("used: %d, quota: %d", used, quota),
+		})
+	}
+}
+
+// MemoryUsage returns the last measured memory usage of the local
+// pindexes.
+func (mgr *Manager) MemoryUsage() *MemoryUsage {
+	rv := &MemoryUsage{
+		Quota:     memoryQuota(mgr.Options()),
+		OverQuota: mgr.MemoryOverQuota(),
+	}
+
+	mgr.m.Lock()
+	rv.PIndexes = make(map[string]uint64, len(mgr.pindexMemoryUsage))
+	for pindexName, used := range mgr.pindexMemoryUsage {
+		rv.PIndexes[pindexName] = used
+		rv.Used += used
+	}
+	mgr.m.Unlock()
+
+	return rv
+}
+
+// MemoryOverQuota returns true when the memory usage of the local
+// pindexes was last measured to be over the memory quota.
+func (mgr *Manager) MemoryOverQuota() bool {
+	return atomic.LoadInt32(&mgr.memoryOverQuota) != 0
+}
+
+// feedDestMemoryThrottle wraps a feed's Dest with a
+// DestMemoryThrottle when the memory quota is enabled.
+func (mgr *Manager) feedDestMemoryThrottle(dest Dest) Dest {
+	if memoryQuota(mgr.Options()) <= 0 {
+		return dest
+	}
+
+	maxWait := mgr.optionDuration("memoryThrottleMaxWait")
+	if maxWait <= 0 {
+		maxWait = MEMORY_THROTTLE_MAX_WAIT
+	}
+
+	return &DestMemoryThrottle{
+		Dest:    dest,
+		mgr:     mgr,
+		maxWait: maxWait,
+	}
+}
+
+// ------------------------------------------------------------------------
+
+// DestMemoryThrottle is a Dest wrapper that pauses incoming data
+// mutations while the local pindexes are over the memory quota,
+// waiting at most maxWait per mutation.
+type DestMemoryThrottle struct {
+	Dest
+
+	mgr     *Manager
+	maxWait time.Duration
+}
+
+func (d *DestMemoryThrottle) DataUpdate(partition string, key []byte,
+	seq uint64, val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait()
+	return d.Dest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (d *DestMemoryThrottle) DataDelete(partition string, key []byte,
+	seq uint64, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait()
+	return d.Dest.DataDelete(partition, key, seq,
+		cas, extrasType, extras)
+}
+
+func (d *DestMemoryThrottle) DataExpire(partition string, key []byte,
+	seq uint64, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.wait()
+	return DestDataExpire(d.Dest, partition, key, seq,
+		cas, extrasType, extras)
+}
+
+// wait blocks while the manager is over the memory quota, until
+// maxWait has elapsed or the manager is stopped.
+func (d *DestMemoryThrottle) wait() {
+	var paused time.Time
+
+	for d.mgr.MemoryOverQuota() {
+		if paused.IsZero() {
+			paused = time.Now()
+			atomic.AddUint64(&d.mgr.stats.TotMemoryThrottlePause, 1)
+		} else if time.Since(paused) >= d.maxWait {
+			atomic.AddUint64(&d.mgr.stats.TotMemoryThrottleTimeout, 1)
+			return
+		}
+
+		select {
+		case <-d.mgr.stopCh:
+			return
+		case <-time.After(FEED_BACKPRESSURE_CHECK_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+type TestMemoryImpl struct {
+	m       sync.Mutex
+	used    uint64
+	evicted uint64
+}
+
+func (t *TestMemoryImpl) MemoryUsed() uint64 {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.used
+}
+
+func (t *TestMemoryImpl) EvictMemory(targetBytes uint64) {
+	t.m.Lock()
+	t.evicted += targetBytes
+	t.m.Unlock()
+}
+
+func TestMemoryOnce(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	impl0 := &TestMemoryImpl{used: 300}
+	impl1 := &TestMemoryImpl{used: 100}
+	m.registerPIndex(&PIndex{Name: "p0", Impl: impl0})
+	m.registerPIndex(&PIndex{Name: "p1", Impl: impl1})
+	m.registerPIndex(&PIndex{Name: "p2"})
+
+	eventCh := make(chan ManagerEvent, 100)
+	m.SubscribeEvents(eventCh)
+
+	m.MemoryOnce()
+
+	u := m.MemoryUsage()
+	if u.Used != 400 || u.Quota != 0 || u.OverQuota ||
+		len(u.PIndexes) != 2 || u.PIndexes["p0"] != 300 {
+		t.Errorf("unexpected memory usage without a quota, got: %#v", u)
+	}
+
+	m.SetOptions(map[string]string{"memoryQuota": "200"})
+
+	m.MemoryOnce()
+
+	if !m.MemoryOverQuota() {
+		t.Errorf("expected over quota")
+	}
+	if impl0.evicted != 150 || impl1.evicted != 50 {
+		t.Errorf("expected proportional eviction hints, got: %d, %d",
+			impl0.evicted, impl1.evicted)
+	}
+
+	impl0.m.Lock()
+	impl0.used = 50
+	impl0.m.Unlock()
+
+	m.MemoryOnce()
+
+	if m.MemoryOverQuota() {
+		t.Errorf("expected under quota")
+	}
+
+	kinds := map[string]bool{}
+	for len(eventCh) > 0 {
+		kinds[(<-eventCh).Kind] = true
+	}
+	if !kinds[MANAGER_EVENT_MEMORY_OVER_QUOTA] ||
+		!kinds[MANAGER_EVENT_MEMORY_OK] {
+		t.Errorf("expected memory events, got: %v", kinds)
+	}
+}
+
+func TestDestMemoryThrottle(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	blackHole := &BlackHole{}
+	if m.feedDestMemoryThrottle(blackHole) != blackHole {
+		t.Errorf("expected no throttle without a memory quota")
+	}
+
+	m.SetOptions(map[string]string{
+		"memoryQuota":           "100",
+		"memoryThrottleMaxWait": "20ms",
+	})
+
+	dest := m.feedDestMemoryThrottle(blackHole)
+	if _, ok := dest.(*DestMemoryThrottle); !ok ||
+		unwrapFeedDest(dest) != blackHole {
+		t.Errorf("expected DestMemoryThrottle, got: %#v", dest)
+	}
+
+	dest.DataUpdate("0", []byte("k"), 1, []byte("v"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotMemoryThrottlePause != 0 {
+		t.Errorf("expected no pause while under quota")
+	}
+
+	m.memoryOverQuota = 1
+
+	dest.DataUpdate("0", []byte("k"), 2, []byte("v"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotMemoryThrottlePause != 1 ||
+		m.stats.TotMemoryThrottleTimeout != 1 {
+		t.Errorf("expected pause and timeout while over quota, got: %#v",
+			m.stats)
+	}
+}
@@ -0,0 +1,528 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// REMOVE_NODE_TIMEOUT is the default for the removeNodeTimeout
+// manager option, which is how long RemoveNode() waits for the new
+// owners of a removed node's pindexes to build them.
+var REMOVE_NODE_TIMEOUT = 5 * time.Minute
+
+// REMOVE_NODE_CHECK_INTERVAL is how often RemoveNode() checks whether
+// the new owners of a removed node's pindexes have built them.
+var REMOVE_NODE_CHECK_INTERVAL = time.Second
+
+// RemoveNodeHttpDo is used to issue the http requests that check the
+// pindexes of other nodes during RemoveNode(), and may be overridden
+// such as for authentication or for testing.
+var RemoveNodeHttpDo = http.DefaultClient.Do
+
+// AddNode registers a node as both known and wanted in the Cfg, so
+// that planners will start assigning pindexes to the node.  The
+// nodeDef's ImplVersion defaults to the manager's version.
+func (mgr *Manager) AddNode(nodeDef *NodeDef) error {
+	if nodeDef == nil || nodeDef.UUID == "" {
+		return fmt.Errorf("manager_nodes: AddNode, node uuid is required")
+	}
+	if nodeDef.HostPort == "" {
+		return fmt.Errorf("manager_nodes: AddNode, node hostPort is required,"+
+			" nodeUUID: %s", nodeDef.UUID)
+	}
+	if nodeDef.ImplVersion == "" {
+		nodeDef.ImplVersion = mgr.version
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		err := CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+			return CfgAddNodeDef(mgr.cfg, kind, nodeDef, mgr.version)
+		})
+		if err != nil {
+			return fmt.Errorf("manager_nodes: AddNode, nodeUUID: %s,"+
+				" kind: %s, err: %v", nodeDef.UUID, kind, err)
+		}
+	}
+
+	log.Printf("manager_nodes: node added, nodeUUID: %s, hostPort: %s",
+		nodeDef.UUID, nodeDef.HostPort)
+
+	mgr.GetNodeDefs(NODE_DEFS_WANTED, true)
+	mgr.PlannerKick("api/AddNode, nodeUUID: " + nodeDef.UUID)
+
+	return nil
+}
+
+// RemoveNode gracefully removes a node from the cluster.  The node is
+// first unregistered as wanted and a new plan is computed, which
+// moves the node's pindexes to the remaining nodes.  Once the node no
+// longer has any pindexes assigned, and the new owners of its
+// pindexes have built them (see the removeNodeTimeout manager
+// option), it's also unregistered as known.  If the node still has
+// pindexes assigned (such as due to a frozen plan), or the new owners
+// haven't built the pindexes in time, an error is returned and the
+// node remains known, so that RemoveNode may be retried later.
+func (mgr *Manager) RemoveNode(nodeUUID string) error {
+	err := mgr.checkNodeKnown(nodeUUID)
+	if err != nil {
+		return err
+	}
+
+	planPIndexesPrev, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" could not get plan, err: %v", nodeUUID, err)
+	}
+
+	err = CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+		return CfgRemoveNodeDef(mgr.cfg, NODE_DEFS_WANTED, nodeUUID, mgr.version)
+	})
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" could not unregister wanted, err: %v", nodeUUID, err)
+	}
+
+	_, err = Plan(mgr.cfg, mgr.version, "", mgr.server, mgr.Options(), nil)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" could not plan, err: %v", nodeUUID, err)
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" could not get plan, err: %v", nodeUUID, err)
+	}
+
+	numPIndexes := NumPlanPIndexesForNode(planPIndexes, nodeUUID)
+	if numPIndexes > 0 {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" node still has pindexes assigned, numPIndexes: %d",
+			nodeUUID, numPIndexes)
+	}
+
+	timeout := mgr.optionDuration("removeNodeTimeout")
+	if timeout <= 0 {
+		timeout = REMOVE_NODE_TIMEOUT
+	}
+
+	err = mgr.waitPIndexMovesBuilt(
+		PIndexMovesFromNode(nodeUUID, planPIndexesPrev, planPIndexes),
+		timeout)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" err: %v", nodeUUID, err)
+	}
+
+	err = CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+		return CfgRemoveNodeDef(mgr.cfg, NODE_DEFS_KNOWN, nodeUUID, mgr.version)
+	})
+	if err != nil {
+		return fmt.Errorf("manager_nodes: RemoveNode, nodeUUID: %s,"+
+			" could not unregister known, err: %v", nodeUUID, err)
+	}
+
+	log.Printf("manager_nodes: node removed, nodeUUID: %s", nodeUUID)
+
+	mgr.Kick("api/RemoveNode, nodeUUID: " + nodeUUID)
+
+	return nil
+}
+
+// FailoverNode immediately removes a dead node from the cluster.  The
+// node is unregistered and its pindexes are reassigned to the
+// remaining nodes, promoting replicas to primary where possible.
+// See FailoverNodes().
+func (mgr *Manager) FailoverNode(nodeUUID string) error {
+	if nodeUUID == mgr.uuid {
+		return fmt.Errorf("manager_nodes: FailoverNode,"+
+			" cannot failover this node, nodeUUID: %s", nodeUUID)
+	}
+
+	err := mgr.checkNodeKnown(nodeUUID)
+	if err != nil {
+		return err
+	}
+
+	err = UnregisterNodes(mgr.cfg, mgr.version, []string{nodeUUID})
+	if err != nil {
+		return fmt.Errorf("manager_nodes: FailoverNode, nodeUUID: %s,"+
+			" err: %v", nodeUUID, err)
+	}
+
+	_, err = FailoverNodes(mgr.cfg, mgr.version, mgr.server, mgr.Options(),
+		[]string{nodeUUID})
+	if err != nil {
+		return fmt.Errorf("manager_nodes: FailoverNode, nodeUUID: %s,"+
+			" err: %v", nodeUUID, err)
+	}
+
+	log.Printf("manager_nodes: node failed over, nodeUUID: %s", nodeUUID)
+
+	// Promote any standby nodes that are now the only remaining
+	// nodes for some pindexes.
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: FailoverNode, nodeUUID: %s,"+
+			" err: %v", nodeUUID, err)
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: FailoverNode, nodeUUID: %s,"+
+			" err: %v", nodeUUID, err)
+	}
+
+	for _, standbyUUID := range StandbyNodesToPromote(planPIndexes, nodeDefs) {
+		err = mgr.PromoteNode(standbyUUID)
+		if err != nil {
+			return fmt.Errorf("manager_nodes: FailoverNode, nodeUUID: %s,"+
+				" could not promote standby: %s, err: %v",
+				nodeUUID, standbyUUID, err)
+		}
+	}
+
+	mgr.Kick("api/FailoverNode, nodeUUID: " + nodeUUID)
+
+	return nil
+}
+
+// PromoteNode promotes a standby node to a regular node that serves
+// queries, by removing the "standby" tag from the node's NodeDef
+// registrations and then replanning.
+//
+// NOTE: A standby node that's restarted with its "standby" tag will
+// re-register itself as a standby node.
+func (mgr *Manager) PromoteNode(nodeUUID string) error {
+	err := mgr.checkNodeKnown(nodeUUID)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		err = CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+			nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, kind)
+			if err != nil || nodeDefs == nil {
+				return err
+			}
+
+			nodeDef := nodeDefs.NodeDefs[nodeUUID]
+			if !NodeDefIsStandby(nodeDef) {
+				return nil
+			}
+
+			nodeDefNext := *nodeDef
+			nodeDefNext.Tags = StringsRemoveStrings(nodeDef.Tags,
+				[]string{"standby"})
+
+			return CfgAddNodeDef(mgr.cfg, kind, &nodeDefNext, mgr.version)
+		})
+		if err != nil {
+			return fmt.Errorf("manager_nodes: PromoteNode, nodeUUID: %s,"+
+				" kind: %s, err: %v", nodeUUID, kind, err)
+		}
+	}
+
+	_, err = Plan(mgr.cfg, mgr.version, "", mgr.server, mgr.Options(), nil)
+	if err != nil {
+		return fmt.Errorf("manager_nodes: PromoteNode, nodeUUID: %s,"+
+			" could not plan, err: %v", nodeUUID, err)
+	}
+
+	log.Printf("manager_nodes: node promoted, nodeUUID: %s", nodeUUID)
+
+	mgr.Kick("api/PromoteNode, nodeUUID: " + nodeUUID)
+
+	return nil
+}
+
+// NodeDefIsStandby returns true if the node is tagged as "standby".
+// A standby node keeps its assigned pindexes up to date, preferably
+// as replicas, but serves no queries until it's promoted.
+func NodeDefIsStandby(nodeDef *NodeDef) bool {
+	if nodeDef != nil {
+		for _, tag := range nodeDef.Tags {
+			if tag == "standby" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StandbyNodesToPromote returns the sorted UUID's of the standby
+// nodes that are the only remaining nodes assigned to some pindexes,
+// such as after a failover.
+func StandbyNodesToPromote(planPIndexes *PlanPIndexes,
+	nodeDefs *NodeDefs) []string {
+	if planPIndexes == nil || nodeDefs == nil {
+		return nil
+	}
+
+	var rv []string
+
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		standbyUUID := ""
+		for nodeUUID := range planPIndex.Nodes {
+			if !NodeDefIsStandby(nodeDefs.NodeDefs[nodeUUID]) {
+				standbyUUID = ""
+				break
+			}
+			if standbyUUID == "" || nodeUUID < standbyUUID {
+				standbyUUID = nodeUUID
+			}
+		}
+		if standbyUUID != "" {
+			rv = append(rv, standbyUUID)
+		}
+	}
+
+	rv = StringsIntersectStrings(rv, rv) // Dedupe.
+	sort.Strings(rv)
+
+	return rv
+}
+
+// checkNodeKnown returns an error if the node isn't registered as
+// either known or wanted.
+func (mgr *Manager) checkNodeKnown(nodeUUID string) error {
+	if nodeUUID == "" {
+		return fmt.Errorf("manager_nodes: node uuid is required")
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, kind)
+		if err != nil {
+			return err
+		}
+		if nodeDefs != nil && nodeDefs.NodeDefs[nodeUUID] != nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("manager_nodes: no such node, nodeUUID: %s", nodeUUID)
+}
+
+// NumPlanPIndexesForNode returns the number of planned pindexes that
+// are assigned to a node.
+func NumPlanPIndexesForNode(planPIndexes *PlanPIndexes,
+	nodeUUID string) int {
+	n := 0
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.Nodes[nodeUUID] != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// ------------------------------------------------------------------------
+
+// A PIndexMove represents a pindex that a node newly owns after a
+// replan, such as when another node is removed.
+type PIndexMove struct {
+	NodeUUID   string `json:"nodeUUID"` // The new owner.
+	IndexName  string `json:"indexName"`
+	PIndexName string `json:"pindexName"`
+}
+
+// PIndexMovesFromNode returns the pindexes that were assigned to a
+// node in the previous plan and that are assigned to other nodes in
+// the next plan which didn't have them before, sorted by node UUID
+// and pindex name.
+func PIndexMovesFromNode(nodeUUID string,
+	planPIndexesPrev, planPIndexes *PlanPIndexes) []*PIndexMove {
+	if planPIndexesPrev == nil || planPIndexes == nil {
+		return nil
+	}
+
+	var rv []*PIndexMove
+
+	for name, planPIndexPrev := range planPIndexesPrev.PlanPIndexes {
+		if planPIndexPrev.Nodes[nodeUUID] == nil {
+			continue
+		}
+		planPIndex := planPIndexes.PlanPIndexes[name]
+		if planPIndex == nil {
+			continue // Such as a deleted index.
+		}
+		for ownerUUID := range planPIndex.Nodes {
+			if planPIndexPrev.Nodes[ownerUUID] == nil {
+				rv = append(rv, &PIndexMove{
+					NodeUUID:   ownerUUID,
+					IndexName:  planPIndex.IndexName,
+					PIndexName: name,
+				})
+			}
+		}
+	}
+
+	sort.Sort(pindexMovesByNode(rv))
+
+	return rv
+}
+
+type pindexMovesByNode []*PIndexMove
+
+func (a pindexMovesByNode) Len() int {
+	return len(a)
+}
+
+func (a pindexMovesByNode) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a pindexMovesByNode) Less(i, j int) bool {
+	if a[i].NodeUUID != a[j].NodeUUID {
+		return a[i].NodeUUID < a[j].NodeUUID
+	}
+	return a[i].PIndexName < a[j].PIndexName
+}
+
+// waitPIndexMovesBuilt waits until the new owners of the moved
+// pindexes have built them, or until the timeout.
+func (mgr *Manager) waitPIndexMovesBuilt(moves []*PIndexMove,
+	timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var waiting []*PIndexMove
+		var errs []string
+
+		built := map[string]map[string]bool{} // Keyed by node, index.
+		for _, move := range moves {
+			k := move.NodeUUID + "/" + move.IndexName
+			if built[k] == nil {
+				pindexNames, err :=
+					mgr.nodePIndexesBuilt(move.NodeUUID, move.IndexName)
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+				built[k] = StringsToMap(pindexNames)
+			}
+			if !built[k][move.PIndexName] {
+				waiting = append(waiting, move)
+			}
+		}
+
+		if len(waiting) <= 0 {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("manager_nodes: new owners have not built"+
+				" pindexes, timeout: %v, waiting: %d, first: %+v, errs: %v",
+				timeout, len(waiting), waiting[0], errs)
+		}
+
+		log.Printf("manager_nodes: waiting for new owners to build"+
+			" pindexes, waiting: %d", len(waiting))
+
+		select {
+		case <-mgr.stopCh:
+			return fmt.Errorf("manager_nodes: stopped")
+		case <-time.After(REMOVE_NODE_CHECK_INTERVAL):
+		}
+
+		moves = waiting
+	}
+}
+
+// nodePIndexesBuilt returns the names of a node's pindexes of an
+// index that the node has built, via the node's index progress.
+func (mgr *Manager) nodePIndexesBuilt(nodeUUID, indexName string) (
+	[]string, error) {
+	var progress *IndexProgress
+
+	if nodeUUID == mgr.uuid {
+		var err error
+		progress, err = mgr.IndexProgress(indexName)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+		if err != nil {
+			return nil, err
+		}
+		if nodeDefs == nil || nodeDefs.NodeDefs[nodeUUID] == nil {
+			return nil, fmt.Errorf("manager_nodes: no such node,"+
+				" nodeUUID: %s", nodeUUID)
+		}
+
+		progress, err = getIndexProgress("http://"+
+			nodeDefs.NodeDefs[nodeUUID].HostPort, indexName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rv []string
+	for pindexName, p := range progress.PIndexes {
+		if p != nil && !p.Building {
+			rv = append(rv, pindexName)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv, nil
+}
+
+func getIndexProgress(baseURL, indexName string) (*IndexProgress, error) {
+	req, err := http.NewRequest("GET",
+		baseURL+"/api/index/"+url.QueryEscape(indexName)+"/progress", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := RemoveNodeHttpDo(req)
+	if err != nil {
+		return nil, fmt.Errorf("manager_nodes: getIndexProgress,"+
+			" index: %s, err: %v", indexName, err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("manager_nodes: getIndexProgress,"+
+			" index: %s, status code: %d, resp: %s",
+			indexName, resp.StatusCode, buf)
+	}
+
+	rv := struct {
+		Status   string         `json:"status"`
+		Progress *IndexProgress `json:"progress"`
+	}{}
+	err = json.Unmarshal(buf, &rv)
+	if err != nil || rv.Progress == nil {
+		return nil, fmt.Errorf("manager_nodes: getIndexProgress,"+
+			" index: %s, could not parse resp: %s, err: %v",
+			indexName, buf, err)
+	}
+
+	return rv.Progress, nil
+}
@@ -0,0 +1,369 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagerAddRemoveNode(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if m.AddNode(&NodeDef{UUID: "b"}) == nil {
+		t.Errorf("expected AddNode err with no hostPort")
+	}
+	if m.AddNode(&NodeDef{HostPort: "b:1000"}) == nil {
+		t.Errorf("expected AddNode err with no uuid")
+	}
+
+	err = m.AddNode(&NodeDef{UUID: "b", HostPort: "b:1000"})
+	if err != nil {
+		t.Errorf("expected AddNode to work, err: %v", err)
+	}
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nd, _, err := CfgGetNodeDefs(cfg, kind)
+		if err != nil || nd == nil || nd.NodeDefs["b"] == nil ||
+			nd.NodeDefs["b"].ImplVersion != VERSION {
+			t.Errorf("expected node b in %s, err: %v", kind, err)
+		}
+	}
+
+	if m.RemoveNode("not-a-node") == nil {
+		t.Errorf("expected RemoveNode err on unknown node")
+	}
+
+	err = m.RemoveNode("b")
+	if err != nil {
+		t.Errorf("expected RemoveNode to work, err: %v", err)
+	}
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nd, _, err := CfgGetNodeDefs(cfg, kind)
+		if err != nil || nd == nil || nd.NodeDefs["b"] != nil ||
+			nd.NodeDefs[m.uuid] == nil {
+			t.Errorf("expected only node b removed from %s, err: %v",
+				kind, err)
+		}
+	}
+}
+
+func TestManagerFailoverNode(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if m.FailoverNode(m.uuid) == nil {
+		t.Errorf("expected FailoverNode err on self")
+	}
+	if m.FailoverNode("not-a-node") == nil {
+		t.Errorf("expected FailoverNode err on unknown node")
+	}
+
+	err = m.AddNode(&NodeDef{UUID: "b", HostPort: "b:1000"})
+	if err != nil {
+		t.Errorf("expected AddNode to work, err: %v", err)
+	}
+
+	err = m.FailoverNode("b")
+	if err != nil {
+		t.Errorf("expected FailoverNode to work, err: %v", err)
+	}
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nd, _, err := CfgGetNodeDefs(cfg, kind)
+		if err != nil || nd == nil || nd.NodeDefs["b"] != nil {
+			t.Errorf("expected node b removed from %s, err: %v", kind, err)
+		}
+	}
+}
+
+func TestFailoverNodes(t *testing.T) {
+	cfg := NewCfgMem()
+
+	p := NewPlanPIndexes(VERSION)
+	p.PlanPIndexes["x0"] = &PlanPIndex{
+		Name:      "x0",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true, Priority: 0},
+			"b": {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	p.PlanPIndexes["x1"] = &PlanPIndex{
+		Name:      "x1",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"b": {CanRead: true, CanWrite: true, Priority: 0},
+			"a": {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	_, err := CfgSetPlanPIndexes(cfg, p, 0)
+	if err != nil {
+		t.Errorf("expected plan save to work, err: %v", err)
+	}
+
+	changed, err := FailoverNodes(cfg, VERSION, "", nil, []string{"a"})
+	if err != nil || !changed {
+		t.Errorf("expected failover to change plan, err: %v", err)
+	}
+
+	p2, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || p2 == nil {
+		t.Errorf("expected plan, err: %v", err)
+	}
+	if NumPlanPIndexesForNode(p2, "a") != 0 ||
+		NumPlanPIndexesForNode(p2, "b") != 2 {
+		t.Errorf("expected all pindexes on b, p2: %#v", p2)
+	}
+	if p2.PlanPIndexes["x0"].Nodes["b"].Priority != 0 {
+		t.Errorf("expected replica on b to be promoted")
+	}
+
+	changed, err = FailoverNodes(cfg, VERSION, "", nil, []string{"a"})
+	if err != nil || changed {
+		t.Errorf("expected repeated failover to be a no-op, err: %v", err)
+	}
+}
+
+func TestStandbyPlanPIndexes(t *testing.T) {
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a"}
+	nodeDefs.NodeDefs["s"] = &NodeDef{UUID: "s", Tags: []string{"standby"}}
+
+	planPIndexes := map[string]*PlanPIndex{
+		"x0": {
+			Name: "x0",
+			Nodes: map[string]*PlanPIndexNode{
+				"s": {CanRead: true, CanWrite: true, Priority: 0},
+				"a": {CanRead: true, CanWrite: true, Priority: 1},
+			},
+		},
+		"x1": {
+			Name: "x1",
+			Nodes: map[string]*PlanPIndexNode{
+				"s": {CanRead: true, CanWrite: true, Priority: 0},
+			},
+		},
+	}
+
+	StandbyPlanPIndexes(planPIndexes, nodeDefs)
+
+	x0 := planPIndexes["x0"].Nodes
+	if x0["a"].Priority != 0 || x0["s"].Priority != 1 ||
+		x0["s"].CanRead || !x0["a"].CanRead || !x0["s"].CanWrite {
+		t.Errorf("expected standby to be a non-readable replica, x0: %#v", x0)
+	}
+
+	x1 := planPIndexes["x1"].Nodes
+	if x1["s"].Priority != 0 || x1["s"].CanRead {
+		t.Errorf("expected lone standby to stay primary, x1: %#v", x1)
+	}
+
+	p := NewPlanPIndexes(VERSION)
+	p.PlanPIndexes = planPIndexes
+	standbys := StandbyNodesToPromote(p, nodeDefs)
+	if len(standbys) != 1 || standbys[0] != "s" {
+		t.Errorf("expected s to be promotable, got: %#v", standbys)
+	}
+}
+
+func TestManagerPromoteNode(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	for _, nodeUUID := range []string{"s0", "s1"} {
+		err = m.AddNode(&NodeDef{UUID: nodeUUID, HostPort: nodeUUID + ":1000",
+			Tags: []string{"pindex", "standby"}})
+		if err != nil {
+			t.Errorf("expected AddNode to work, err: %v", err)
+		}
+	}
+
+	err = m.PromoteNode("s0")
+	if err != nil {
+		t.Errorf("expected PromoteNode to work, err: %v", err)
+	}
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nd, _, _ := CfgGetNodeDefs(cfg, kind)
+		if NodeDefIsStandby(nd.NodeDefs["s0"]) ||
+			len(nd.NodeDefs["s0"].Tags) != 1 ||
+			!NodeDefIsStandby(nd.NodeDefs["s1"]) {
+			t.Errorf("expected only s0 to be promoted in %s", kind)
+		}
+	}
+
+	// A failover that leaves a standby as the only node of a pindex
+	// promotes the standby.
+	_, cas, _ := CfgGetPlanPIndexes(cfg)
+	p := NewPlanPIndexes(VERSION)
+	p.PlanPIndexes["x0"] = &PlanPIndex{
+		Name:      "x0",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"s0": {CanRead: true, CanWrite: true, Priority: 0},
+			"s1": {CanRead: false, CanWrite: true, Priority: 1},
+		},
+	}
+	_, err = CfgSetPlanPIndexes(cfg, p, cas)
+	if err != nil {
+		t.Errorf("expected plan save to work, err: %v", err)
+	}
+
+	err = m.FailoverNode("s0")
+	if err != nil {
+		t.Errorf("expected FailoverNode to work, err: %v", err)
+	}
+	nd, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if nd.NodeDefs["s1"] == nil || NodeDefIsStandby(nd.NodeDefs["s1"]) {
+		t.Errorf("expected s1 to be promoted on failover")
+	}
+}
+
+func TestPIndexMovesFromNode(t *testing.T) {
+	prev := NewPlanPIndexes(VERSION)
+	prev.PlanPIndexes["x0"] = &PlanPIndex{
+		Name:      "x0",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true},
+			"b": {CanRead: true, CanWrite: true},
+		},
+	}
+	prev.PlanPIndexes["x1"] = &PlanPIndex{
+		Name:      "x1",
+		IndexName: "x",
+		Nodes:     map[string]*PlanPIndexNode{"a": {}},
+	}
+	prev.PlanPIndexes["y0"] = &PlanPIndex{
+		Name:      "y0",
+		IndexName: "y",
+		Nodes:     map[string]*PlanPIndexNode{"b": {}},
+	}
+
+	next := NewPlanPIndexes(VERSION)
+	next.PlanPIndexes["x0"] = &PlanPIndex{
+		Name:      "x0",
+		IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{
+			"a": {CanRead: true, CanWrite: true},
+			"c": {CanRead: true, CanWrite: true},
+		},
+	}
+	next.PlanPIndexes["x1"] = prev.PlanPIndexes["x1"]
+
+	moves := PIndexMovesFromNode("b", prev, next)
+	if !reflect.DeepEqual(moves, []*PIndexMove{
+		{NodeUUID: "c", IndexName: "x", PIndexName: "x0"},
+	}) {
+		t.Errorf("expected only x0 moved to c, got: %+v", moves)
+	}
+
+	if len(PIndexMovesFromNode("b", nil, next)) != 0 {
+		t.Errorf("expected no moves without a previous plan")
+	}
+}
+
+func TestManagerWaitPIndexMovesBuilt(t *testing.T) {
+	prevRemoveNodeHttpDo := RemoveNodeHttpDo
+	defer func() { RemoveNodeHttpDo = prevRemoveNodeHttpDo }()
+
+	prevInterval := REMOVE_NODE_CHECK_INTERVAL
+	defer func() { REMOVE_NODE_CHECK_INTERVAL = prevInterval }()
+	REMOVE_NODE_CHECK_INTERVAL = time.Millisecond
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	err = m.AddNode(&NodeDef{UUID: "c", HostPort: "10.0.0.3:8094"})
+	if err != nil {
+		t.Errorf("expected AddNode to work, err: %v", err)
+	}
+
+	var reqURL string
+	building := 2
+
+	RemoveNodeHttpDo = func(req *http.Request) (*http.Response, error) {
+		reqURL = req.URL.String()
+		building--
+		body := `{"status":"ok","progress":{"pindexes":{"x0":{"building":false}}}}`
+		if building > 0 {
+			body = strings.Replace(body, "false", "true", 1)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	moves := []*PIndexMove{{NodeUUID: "c", IndexName: "x", PIndexName: "x0"}}
+
+	err = m.waitPIndexMovesBuilt(moves, time.Minute)
+	if err != nil || building > 0 {
+		t.Errorf("expected to wait until built, err: %v, building: %d",
+			err, building)
+	}
+	if reqURL != "http://10.0.0.3:8094/api/index/x/progress" {
+		t.Errorf("unexpected request, url: %s", reqURL)
+	}
+
+	building = 1000
+
+	err = m.waitPIndexMovesBuilt(moves, 10*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected a timeout while the new owner is building")
+	}
+
+	// An unknown new owner never reports its pindexes.
+	err = m.waitPIndexMovesBuilt([]*PIndexMove{
+		{NodeUUID: "not-a-node", IndexName: "x", PIndexName: "x0"},
+	}, 10*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected a timeout on an unknown node")
+	}
+}
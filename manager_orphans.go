@@ -0,0 +1,208 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// An orphaned pindex directory is a pindex path in the dataDir that's
+// neither opened by this node nor assigned to this node by the
+// current plan, such as might be left behind after a crash.  The
+// orphan sweep first moves orphans into the ORPHAN_QUARANTINE_DIR of
+// the dataDir, and deletes them once they've been quarantined for the
+// retention period.  The orphan sweep is controlled by these manager
+// options:
+//
+// * orphanSweepInterval - how often the sweep runs, like "10m";
+//   disabled when empty.
+// * orphanRetention - how long orphans are quarantined before they're
+//   deleted; defaults to ORPHAN_RETENTION.
+
+// ORPHAN_QUARANTINE_DIR is the name of the quarantine directory in the
+// dataDir, which isn't a valid index name.
+const ORPHAN_QUARANTINE_DIR = "_quarantine"
+
+// ORPHAN_RETENTION is the default for the orphanRetention manager
+// option.
+var ORPHAN_RETENTION = 24 * time.Hour
+
+// OrphanSweepResult is the outcome of a SweepOrphans().
+type OrphanSweepResult struct {
+	DryRun      bool     `json:"dryRun"`
+	Quarantined []string `json:"quarantined"` // Paths of new orphans.
+	Deleted     []string `json:"deleted"`     // Paths of expired orphans.
+	Errs        []string `json:"errs,omitempty"`
+}
+
+// OrphanSweepLoop periodically sweeps orphaned pindex directories,
+// and exits when the manager is stopped.
+func (mgr *Manager) OrphanSweepLoop() {
+	interval := mgr.optionDuration("orphanSweepInterval")
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := mgr.SweepOrphans(false, time.Now())
+		if err != nil {
+			log.Printf("manager_orphans: SweepOrphans, err: %v", err)
+		}
+	}
+}
+
+// SweepOrphans quarantines the orphaned pindex directories of the
+// dataDir, and deletes the quarantined ones that are older than the
+// retention period.  With dryRun, nothing is moved or deleted.
+func (mgr *Manager) SweepOrphans(dryRun bool, now time.Time) (
+	*OrphanSweepResult, error) {
+	rv := &OrphanSweepResult{
+		DryRun:      dryRun,
+		Quarantined: []string{},
+		Deleted:     []string{},
+	}
+
+	orphans, err := mgr.orphanPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	quarantineDir := filepath.Join(mgr.dataDir, ORPHAN_QUARANTINE_DIR)
+
+	for _, path := range orphans {
+		rv.Quarantined = append(rv.Quarantined, path)
+		if dryRun {
+			continue
+		}
+
+		err = os.MkdirAll(quarantineDir, 0700)
+		if err == nil {
+			err = os.Rename(path, filepath.Join(quarantineDir,
+				filepath.Base(path)+"."+strconv.FormatInt(now.Unix(), 10)))
+		}
+		if err != nil {
+			atomic.AddUint64(&mgr.stats.TotOrphanErr, 1)
+			rv.Errs = append(rv.Errs, err.Error())
+			continue
+		}
+
+		atomic.AddUint64(&mgr.stats.TotOrphanQuarantine, 1)
+		mgr.removeEmptyPIndexParentDir(path)
+
+		log.Printf("manager_orphans: quarantined orphan, path: %s", path)
+	}
+
+	retention := mgr.optionDuration("orphanRetention")
+	if retention <= 0 {
+		retention = ORPHAN_RETENTION
+	}
+
+	entries, _ := ioutil.ReadDir(quarantineDir)
+	for _, entry := range entries {
+		at := strings.LastIndex(entry.Name(), ".")
+		secs, err := strconv.ParseInt(entry.Name()[at+1:], 10, 64)
+		if at < 0 || err != nil ||
+			now.Sub(time.Unix(secs, 0)) < retention {
+			continue
+		}
+
+		path := filepath.Join(quarantineDir, entry.Name())
+		rv.Deleted = append(rv.Deleted, path)
+		if dryRun {
+			continue
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			atomic.AddUint64(&mgr.stats.TotOrphanErr, 1)
+			rv.Errs = append(rv.Errs, err.Error())
+			continue
+		}
+
+		atomic.AddUint64(&mgr.stats.TotOrphanDelete, 1)
+
+		log.Printf("manager_orphans: deleted orphan, path: %s", path)
+	}
+
+	return rv, nil
+}
+
+// orphanPaths returns the sorted paths of the orphaned pindex
+// directories in the dataDir.
+func (mgr *Manager) orphanPaths() ([]string, error) {
+	// Read the latest plan, not a cached one, as orphans are deleted.
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if planPIndexes == nil {
+		return nil, fmt.Errorf("manager_orphans: no plan")
+	}
+
+	paths, err := dataDirPIndexPaths(mgr.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+
+	opened := map[string]bool{}
+	for _, pindex := range pindexes {
+		opened[pindex.Path] = true
+	}
+
+	mgr.m.Lock()
+	building := map[string]bool{}
+	for pindexName := range mgr.pindexBuilds {
+		building[pindexName] = true
+	}
+	mgr.m.Unlock()
+
+	var rv []string
+
+	for _, path := range paths {
+		pindexName, _ := ParsePIndexPath(mgr.dataDir, path)
+		if opened[path] || building[pindexName] {
+			continue
+		}
+
+		planPIndex := planPIndexes.PlanPIndexes[pindexName]
+		if planPIndex != nil && planPIndex.Nodes[mgr.uuid] != nil {
+			continue // The janitor will open it.
+		}
+
+		rv = append(rv, path)
+	}
+
+	sort.Strings(rv)
+
+	return rv, nil
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSweepOrphans(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	if _, err := m.SweepOrphans(true, time.Now()); err == nil {
+		t.Errorf("expected SweepOrphans() to fail without a plan")
+	}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["planned"] = &PlanPIndex{
+		Name:  "planned",
+		Nodes: map[string]*PlanPIndexNode{m.UUID(): {}},
+	}
+	planPIndexes.PlanPIndexes["elsewhere"] = &PlanPIndex{
+		Name:  "elsewhere",
+		Nodes: map[string]*PlanPIndexNode{"other": {}},
+	}
+	if _, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+	}
+
+	for _, name := range []string{"planned", "elsewhere", "opened", "gone"} {
+		os.MkdirAll(m.PIndexPath(name), 0700)
+	}
+	m.registerPIndex(&PIndex{Name: "opened", Path: m.PIndexPath("opened")})
+
+	now := time.Now()
+
+	r, err := m.SweepOrphans(true, now)
+	if err != nil || len(r.Quarantined) != 2 || len(r.Deleted) != 0 ||
+		r.Quarantined[0] != m.PIndexPath("elsewhere") ||
+		r.Quarantined[1] != m.PIndexPath("gone") {
+		t.Errorf("expected 2 orphans on dry run, got: %#v, err: %v", r, err)
+	}
+	if _, err = os.Stat(m.PIndexPath("gone")); err != nil {
+		t.Errorf("expected dry run to leave orphans, err: %v", err)
+	}
+
+	r, err = m.SweepOrphans(false, now)
+	if err != nil || len(r.Quarantined) != 2 ||
+		m.stats.TotOrphanQuarantine != 2 {
+		t.Errorf("expected 2 quarantined orphans, got: %#v, err: %v", r, err)
+	}
+	if _, err = os.Stat(m.PIndexPath("gone")); err == nil {
+		t.Errorf("expected orphan to be moved into quarantine")
+	}
+	if _, err = os.Stat(m.PIndexPath("planned")); err != nil {
+		t.Errorf("expected planned pindex to remain, err: %v", err)
+	}
+
+	r, err = m.SweepOrphans(false, now.Add(time.Hour))
+	if err != nil || len(r.Quarantined) != 0 || len(r.Deleted) != 0 {
+		t.Errorf("expected no deletes within retention, got: %#v, err: %v",
+			r, err)
+	}
+
+	r, err = m.SweepOrphans(false, now.Add(ORPHAN_RETENTION))
+	if err != nil || len(r.Deleted) != 2 || m.stats.TotOrphanDelete != 2 {
+		t.Errorf("expected 2 deletes after retention, got: %#v, err: %v",
+			r, err)
+	}
+}
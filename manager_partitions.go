@@ -0,0 +1,489 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// The partitions advisor compares the sizes of an index's pindexes
+// against target sizes and recommends a new MaxPartitionsPerPIndex,
+// so that an index whose data has grown, or shrunk, can be re-split
+// without a manual delete and recreate.  Sizes are measured from the
+// local pindexes of the index, and are extrapolated per source
+// partition to the whole index.  The targets are controlled by these
+// manager options:
+//
+// * partitionsAdvisorTargetDocs - the target doc count of a pindex;
+//   defaults to PARTITIONS_ADVISOR_TARGET_DOCS.
+// * partitionsAdvisorTargetBytes - the target on-disk size in bytes
+//   of a pindex; defaults to PARTITIONS_ADVISOR_TARGET_BYTES.
+//
+// A change is only recommended when the recommended
+// MaxPartitionsPerPIndex is at least twice or at most half of the
+// current one, so that small amounts of growth don't cause re-splits.
+//
+// An applied change re-splits the index into a new generation of
+// pindexes, while the previous generation keeps ingesting and serving
+// queries (see PlanResplit).  Each node periodically checks whether
+// its pindexes of the new generation have caught up with the data
+// source, every resplitCheckInterval (defaults to
+// RESPLIT_CHECK_INTERVAL), and the previous generation is removed
+// once the new generation has caught up on all its nodes.
+
+// RESPLIT_CHECK_INTERVAL is the default for the resplitCheckInterval
+// manager option.
+var RESPLIT_CHECK_INTERVAL = 5 * time.Second
+
+// PARTITIONS_ADVISOR_TARGET_DOCS is the default for the
+// partitionsAdvisorTargetDocs manager option.
+var PARTITIONS_ADVISOR_TARGET_DOCS = uint64(10000000)
+
+// PARTITIONS_ADVISOR_TARGET_BYTES is the default for the
+// partitionsAdvisorTargetBytes manager option.
+var PARTITIONS_ADVISOR_TARGET_BYTES = uint64(5 * 1024 * 1024 * 1024)
+
+// PartitionsAdvice represents the analysis of the partitioning of an
+// index and the recommended MaxPartitionsPerPIndex.
+type PartitionsAdvice struct {
+	IndexName string `json:"indexName"`
+	IndexUUID string `json:"indexUUID"`
+
+	NumSourcePartitions    int `json:"numSourcePartitions"`
+	NumPIndexes            int `json:"numPIndexes"`
+	MaxPartitionsPerPIndex int `json:"maxPartitionsPerPIndex"`
+
+	// Totals across the local pindexes of the index.
+	DocCount   uint64 `json:"docCount"`
+	Bytes      uint64 `json:"bytes"`
+	Partitions int    `json:"partitions"`
+
+	DocsPerPartition  float64 `json:"docsPerPartition"`
+	BytesPerPartition float64 `json:"bytesPerPartition"`
+
+	TargetDocs  uint64 `json:"targetDocs"`
+	TargetBytes uint64 `json:"targetBytes"`
+
+	Recommended int    `json:"recommendedMaxPartitionsPerPIndex"`
+	Change      bool   `json:"change"`
+	Reason      string `json:"reason"`
+
+	// Keyed by local pindex name.
+	PIndexes map[string]*PIndexSize `json:"pindexes"`
+
+	// The UUID of the updated index definition when the advice was
+	// applied.
+	AppliedIndexUUID string `json:"appliedIndexUUID,omitempty"`
+}
+
+// A PIndexSize represents the measured size of a local pindex.
+type PIndexSize struct {
+	DocCount   uint64 `json:"docCount"`
+	Bytes      uint64 `json:"bytes"`
+	Partitions int    `json:"partitions"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// PartitionsAdvice analyzes the sizes of the local pindexes of an
+// index and recommends a MaxPartitionsPerPIndex for the index.
+func (mgr *Manager) PartitionsAdvice(indexName string) (
+	*PartitionsAdvice, error) {
+	indexDef, _, err := mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &PartitionsAdvice{
+		IndexName:              indexName,
+		IndexUUID:              indexDef.UUID,
+		MaxPartitionsPerPIndex: indexDef.PlanParams.MaxPartitionsPerPIndex,
+		TargetDocs: mgr.optionUint64("partitionsAdvisorTargetDocs",
+			PARTITIONS_ADVISOR_TARGET_DOCS),
+		TargetBytes: mgr.optionUint64("partitionsAdvisorTargetBytes",
+			PARTITIONS_ADVISOR_TARGET_BYTES),
+		PIndexes: map[string]*PIndexSize{},
+	}
+
+	for _, planPIndex := range planPIndexesByName[indexName] {
+		if planPIndex.IndexUUID != indexDef.UUID {
+			continue
+		}
+		rv.NumPIndexes++
+		if planPIndex.SourcePartitions != "" {
+			rv.NumSourcePartitions +=
+				len(strings.Split(planPIndex.SourcePartitions, ","))
+		}
+	}
+
+	if rv.NumPIndexes <= 0 {
+		return nil, fmt.Errorf("manager_partitions: index not planned yet,"+
+			" indexName: %s", indexName)
+	}
+
+	diskUsage := mgr.PIndexesDiskUsage()
+
+	_, pindexes := mgr.CurrentMaps()
+	for pindexName, pindex := range pindexes {
+		if pindex.IndexName != indexName || pindex.IndexUUID != indexDef.UUID {
+			continue
+		}
+
+		s := &PIndexSize{Partitions: len(pindex.sourcePartitionsMap)}
+
+		if pindex.Dest != nil {
+			s.DocCount, err = pindex.Dest.Count(pindex, nil)
+			if err != nil {
+				s.Err = err.Error()
+			}
+		}
+
+		bytes, exists := diskUsage[pindexName]
+		if !exists && pindex.Path != "" {
+			bytes = dirSize(pindex.Path)
+		}
+		s.Bytes = bytes
+
+		rv.PIndexes[pindexName] = s
+
+		if s.Err == "" {
+			rv.DocCount += s.DocCount
+			rv.Bytes += s.Bytes
+			rv.Partitions += s.Partitions
+		}
+	}
+
+	if rv.Partitions > 0 {
+		rv.DocsPerPartition = float64(rv.DocCount) / float64(rv.Partitions)
+		rv.BytesPerPartition = float64(rv.Bytes) / float64(rv.Partitions)
+	}
+
+	rv.Recommended, rv.Change, rv.Reason = RecommendMaxPartitionsPerPIndex(
+		rv.MaxPartitionsPerPIndex, rv.NumSourcePartitions,
+		rv.DocsPerPartition, rv.BytesPerPartition,
+		rv.TargetDocs, rv.TargetBytes)
+
+	return rv, nil
+}
+
+// RecommendMaxPartitionsPerPIndex returns the MaxPartitionsPerPIndex
+// that keeps pindexes within the target doc count and size, given
+// the measured docs and bytes per source partition, and whether
+// that's enough of a change from the current MaxPartitionsPerPIndex
+// to be worth a re-split.  A current MaxPartitionsPerPIndex of 0
+// means all the source partitions are in a single pindex.
+func RecommendMaxPartitionsPerPIndex(current, numSourcePartitions int,
+	docsPerPartition, bytesPerPartition float64,
+	targetDocs, targetBytes uint64) (int, bool, string) {
+	if numSourcePartitions <= 0 {
+		return current, false, "no source partitions"
+	}
+
+	effective := current
+	if effective <= 0 || effective > numSourcePartitions {
+		effective = numSourcePartitions
+	}
+
+	if docsPerPartition <= 0 && bytesPerPartition <= 0 {
+		return current, false, "no local data to measure"
+	}
+
+	recommended := numSourcePartitions
+	reason := "pindexes are small"
+
+	if docsPerPartition > 0 && targetDocs > 0 {
+		n := int(float64(targetDocs) / docsPerPartition)
+		if n < recommended {
+			recommended = n
+			reason = fmt.Sprintf("target docs per pindex: %d", targetDocs)
+		}
+	}
+
+	if bytesPerPartition > 0 && targetBytes > 0 {
+		n := int(float64(targetBytes) / bytesPerPartition)
+		if n < recommended {
+			recommended = n
+			reason = fmt.Sprintf("target bytes per pindex: %d", targetBytes)
+		}
+	}
+
+	if recommended < 1 {
+		recommended = 1
+	}
+
+	if recommended*2 > effective && recommended < effective*2 {
+		return current, false, "partitioning is within 2x of " + reason
+	}
+
+	return recommended, true, reason
+}
+
+// ApplyPartitionsAdvice analyzes an index and, when a change is
+// recommended, updates the index definition with the recommended
+// MaxPartitionsPerPIndex and a PlanResplit.  The planner then plans a
+// new generation of pindexes for the index, while keeping the
+// previous generation, which serves queries until the new generation
+// has caught up (see ResplitOnce()).  A non-"" prevIndexUUID must
+// match the current index UUID.
+func (mgr *Manager) ApplyPartitionsAdvice(indexName,
+	prevIndexUUID string) (*PartitionsAdvice, error) {
+	indexDef, _, err := mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		return nil, err
+	}
+	if indexDef.PlanParams.Resplit != nil {
+		return nil, fmt.Errorf("manager_partitions: index is already"+
+			" being re-split, indexName: %s", indexName)
+	}
+
+	advice, err := mgr.PartitionsAdvice(indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	if prevIndexUUID != "" && prevIndexUUID != advice.IndexUUID {
+		return nil, fmt.Errorf("manager_partitions:"+
+			" perhaps there was concurrent index definition update,"+
+			" current index UUID: %s, did not match input UUID: %s",
+			advice.IndexUUID, prevIndexUUID)
+	}
+
+	if !advice.Change {
+		return advice, nil
+	}
+
+	planParams := indexDef.PlanParams
+	planParams.MaxPartitionsPerPIndex = advice.Recommended
+	planParams.Resplit = &PlanResplit{PrevIndexUUID: advice.IndexUUID}
+
+	err = mgr.CreateIndex(indexDef.SourceType,
+		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		indexDef.Type, indexDef.Name, indexDef.Params, planParams,
+		advice.IndexUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDef, _, err = mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		return nil, err
+	}
+	advice.AppliedIndexUUID = indexDef.UUID
+
+	log.Printf("manager_partitions: re-split index, indexName: %s,"+
+		" maxPartitionsPerPIndex: %d => %d, reason: %s",
+		indexName, advice.MaxPartitionsPerPIndex, advice.Recommended,
+		advice.Reason)
+
+	return advice, nil
+}
+
+// ResplitLoop periodically checks the progress of the re-splits of
+// indexes, and exits when the manager is stopped.
+func (mgr *Manager) ResplitLoop() {
+	if mgr.cfg == nil { // Can occur during testing.
+		return
+	}
+
+	interval := mgr.optionDuration("resplitCheckInterval")
+	if interval <= 0 {
+		interval = RESPLIT_CHECK_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		mgr.ResplitOnce()
+	}
+}
+
+// ResplitOnce marks this node as ready in the re-splits of indexes
+// whose new generation of pindexes on this node has caught up with
+// the data source, and finishes the re-splits whose new generation
+// has caught up on all of its nodes, so that the planner removes the
+// previous generation.  The check is cheap when there are no
+// re-splits, as the index definitions are then the manager's cached
+// ones.
+func (mgr *Manager) ResplitOnce() {
+	if mgr.cfg == nil { // Can occur during testing.
+		return
+	}
+
+	indexDefs, _, err := mgr.GetIndexDefs(false)
+	if err != nil || indexDefs == nil {
+		return
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return
+	}
+
+	selfUUID := mgr.UUID()
+
+	for indexName, indexDef := range indexDefs.IndexDefs {
+		resplit := indexDef.PlanParams.Resplit
+		if resplit == nil {
+			continue
+		}
+
+		// The nodes of the new generation, which is empty until the
+		// planner has planned the new generation.
+		nodes := map[string]bool{}
+		for _, planPIndex := range planPIndexesByName[indexName] {
+			if planPIndex.IndexUUID == indexDef.UUID {
+				for nodeUUID := range planPIndex.Nodes {
+					nodes[nodeUUID] = true
+				}
+			}
+		}
+		if len(nodes) <= 0 {
+			continue
+		}
+
+		ready := nodes[selfUUID] && !resplit.Ready[selfUUID] &&
+			mgr.resplitCaughtUp(indexDef, planPIndexesByName[indexName])
+
+		done := true
+		for nodeUUID := range nodes {
+			if !resplit.Ready[nodeUUID] && !(ready && nodeUUID == selfUUID) {
+				done = false
+			}
+		}
+
+		if !ready && !done {
+			continue
+		}
+
+		err = mgr.updateResplit(indexName, indexDef.UUID, ready, done)
+		if err != nil {
+			log.Printf("manager_partitions: updateResplit,"+
+				" indexName: %s, err: %v", indexName, err)
+			continue
+		}
+
+		if done {
+			log.Printf("manager_partitions: re-split done,"+
+				" indexName: %s, indexUUID: %s, prevIndexUUID: %s",
+				indexName, indexDef.UUID, resplit.PrevIndexUUID)
+
+			// Replan now, so that the previous generation is removed.
+			mgr.PlannerKick("resplit done, indexName: " + indexName)
+		}
+	}
+}
+
+// resplitCaughtUp returns true when the local pindexes of the new
+// generation of an index that's being re-split all exist and have
+// caught up with the data source.
+func (mgr *Manager) resplitCaughtUp(indexDef *IndexDef,
+	planPIndexes []*PlanPIndex) bool {
+	progress, err := mgr.IndexProgress(indexDef.Name)
+	if err != nil {
+		return false
+	}
+
+	selfUUID := mgr.UUID()
+
+	for _, planPIndex := range planPIndexes {
+		if planPIndex.IndexUUID != indexDef.UUID ||
+			planPIndex.Nodes[selfUUID] == nil {
+			continue
+		}
+
+		p := progress.PIndexes[planPIndex.Name]
+		if p == nil || p.Building || len(p.Errors) > 0 ||
+			p.PercentComplete < 100.0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// updateResplit marks this node as ready in the re-split of an index,
+// and, when done, removes the index's PlanResplit, while keeping the
+// index UUID, so that the new generation's pindexes are kept.
+func (mgr *Manager) updateResplit(indexName, indexUUID string,
+	ready, done bool) error {
+	for tries := 1; tries <= 100; tries++ {
+		indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+		if err != nil {
+			return err
+		}
+		if indexDefs == nil {
+			return fmt.Errorf("manager_partitions: no indexes")
+		}
+		if VersionGTE(mgr.version, indexDefs.ImplVersion) == false {
+			return fmt.Errorf("manager_partitions:"+
+				" indexDefs.ImplVersion: %s > mgr.version: %s",
+				indexDefs.ImplVersion, mgr.version)
+		}
+
+		indexDef := indexDefs.IndexDefs[indexName]
+		if indexDef == nil || indexDef.UUID != indexUUID ||
+			indexDef.PlanParams.Resplit == nil {
+			return nil // The index was deleted or updated since.
+		}
+
+		if done {
+			indexDef.PlanParams.Resplit = nil
+		} else {
+			resplit := indexDef.PlanParams.Resplit
+			if resplit.Ready == nil {
+				resplit.Ready = map[string]bool{}
+			}
+			resplit.Ready[mgr.UUID()] = true
+		}
+
+		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				continue // Retry on CAS mismatch.
+			}
+			return err
+		}
+
+		mgr.GetIndexDefs(true)
+
+		return nil
+	}
+
+	return fmt.Errorf("manager_partitions: updateResplit, too many tries")
+}
+
+// optionUint64 returns a manager option parsed as a uint64, or the
+// default when the option is missing or invalid.
+func (mgr *Manager) optionUint64(name string, defaultVal uint64) uint64 {
+	v, err := strconv.ParseUint(mgr.Options()[name], 10, 64)
+	if err != nil || v <= 0 {
+		return defaultVal
+	}
+	return v
+}
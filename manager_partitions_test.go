@@ -0,0 +1,180 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecommendMaxPartitionsPerPIndex(t *testing.T) {
+	tests := []struct {
+		current, numSourcePartitions int
+		docsPerPartition             float64
+		bytesPerPartition            float64
+		targetDocs, targetBytes      uint64
+		expected                     int
+		expectedChange               bool
+	}{
+		{1, 0, 0, 0, 100, 100, 1, false},
+		{1, 1024, 0, 0, 100, 100, 1, false},
+		// Small pindexes, so merge them.
+		{1, 1024, 10, 0, 100, 0, 10, true},
+		// Within 2x, so no change.
+		{8, 1024, 10, 0, 100, 0, 8, false},
+		{16, 1024, 10, 0, 100, 0, 16, false},
+		// Large pindexes, so split them.
+		{64, 1024, 10, 0, 100, 0, 10, true},
+		{0, 1024, 10, 0, 100, 0, 10, true},
+		// The smaller of the docs and bytes recommendations wins.
+		{64, 1024, 10, 100, 100, 300, 3, true},
+		{64, 1024, 1000, 100, 100, 300, 1, true},
+		// Capped by the number of source partitions.
+		{1, 8, 1, 0, 100, 0, 8, true},
+	}
+
+	for i, test := range tests {
+		recommended, change, reason := RecommendMaxPartitionsPerPIndex(
+			test.current, test.numSourcePartitions,
+			test.docsPerPartition, test.bytesPerPartition,
+			test.targetDocs, test.targetBytes)
+		if recommended != test.expected || change != test.expectedChange {
+			t.Errorf("test: %d, expected: %d, change: %v,"+
+				" got: %d, change: %v, reason: %s", i,
+				test.expected, test.expectedChange,
+				recommended, change, reason)
+		}
+	}
+}
+
+func TestManagerPartitionsAdvice(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			"partitionsAdvisorTargetBytes": "1",
+		})
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if _, err := m.PartitionsAdvice("foo"); err == nil {
+		t.Errorf("expected err on missing index")
+	}
+
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":8}`,
+		"blackhole", "foo", "", PlanParams{MaxPartitionsPerPIndex: 8},
+		""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	advice, err := m.PartitionsAdvice("foo")
+	if err != nil {
+		t.Fatalf("expected PartitionsAdvice() to work, err: %v", err)
+	}
+	if advice.NumPIndexes != 1 || advice.NumSourcePartitions != 8 ||
+		advice.Partitions != 8 || advice.Bytes <= 0 ||
+		!advice.Change || advice.Recommended != 1 {
+		t.Errorf("expected a split recommendation, got: %#v", advice)
+	}
+
+	_, err = m.ApplyPartitionsAdvice("foo", "not-the-uuid")
+	if err == nil {
+		t.Errorf("expected err on mismatched prevIndexUUID")
+	}
+
+	advice, err = m.ApplyPartitionsAdvice("foo", advice.IndexUUID)
+	if err != nil {
+		t.Fatalf("expected ApplyPartitionsAdvice() to work, err: %v", err)
+	}
+	if advice.AppliedIndexUUID == "" ||
+		advice.AppliedIndexUUID == advice.IndexUUID {
+		t.Errorf("expected an updated index definition, got: %#v", advice)
+	}
+
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	indexDef, _, err := m.GetIndexDef("foo", true)
+	if err != nil || indexDef.PlanParams.MaxPartitionsPerPIndex != 1 ||
+		indexDef.PlanParams.Resplit == nil ||
+		indexDef.PlanParams.Resplit.PrevIndexUUID != advice.IndexUUID {
+		t.Fatalf("expected a re-split index definition, got: %#v, err: %v",
+			indexDef, err)
+	}
+	_, planPIndexesByName, _ := m.GetPlanPIndexes(true)
+	if len(planPIndexesByName["foo"]) != 9 {
+		t.Errorf("expected both generations in the plan, got: %d",
+			len(planPIndexesByName["foo"]))
+	}
+
+	// The previous generation serves queries during the re-split.
+	localPIndexes, _, err := m.CoveringPIndexes("foo", "",
+		PlanPIndexNodeOk, "queries")
+	if err != nil || len(localPIndexes) != 1 ||
+		localPIndexes[0].IndexUUID != advice.IndexUUID {
+		t.Errorf("expected the previous generation, got: %v, err: %v",
+			localPIndexes, err)
+	}
+
+	_, err = m.ApplyPartitionsAdvice("foo", "")
+	if err == nil {
+		t.Errorf("expected err on an index that's being re-split")
+	}
+
+	// Without source seqs, the new generation is caught up.
+	m.ResplitOnce()
+
+	indexDef, _, err = m.GetIndexDef("foo", true)
+	if err != nil || indexDef.PlanParams.Resplit != nil ||
+		indexDef.UUID != advice.AppliedIndexUUID {
+		t.Errorf("expected a done re-split, got: %#v, err: %v",
+			indexDef, err)
+	}
+
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	advice, err = m.PartitionsAdvice("foo")
+	if err != nil {
+		t.Fatalf("expected PartitionsAdvice() to work, err: %v", err)
+	}
+	if advice.NumPIndexes != 8 || advice.Change {
+		t.Errorf("expected a re-split index, got: %#v", advice)
+	}
+
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 8 {
+		t.Errorf("expected the previous generation removed, got: %d",
+			len(pindexes))
+	}
+
+	localPIndexes, _, err = m.CoveringPIndexes("foo", "",
+		PlanPIndexNodeOk, "queries")
+	if err != nil || len(localPIndexes) != 8 {
+		t.Errorf("expected the new generation, got: %d, err: %v",
+			len(localPIndexes), err)
+	}
+}
+
+func TestResplitNilCfg(t *testing.T) {
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", "",
+		"", "", nil)
+	m.ResplitOnce()
+	m.ResplitLoop() // Returns right away without a Cfg.
+}
@@ -0,0 +1,121 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// The health values of a PIndexSummary, from worst to best.
+const (
+	PINDEX_HEALTH_ERROR    = "error"    // The pindex's seqs are unavailable.
+	PINDEX_HEALTH_VERIFY   = "verify"   // The last verify found problems.
+	PINDEX_HEALTH_READONLY = "readOnly" // Ingest is stopped or paused.
+	PINDEX_HEALTH_BUILDING = "building"
+	PINDEX_HEALTH_WARMING  = "warming"
+	PINDEX_HEALTH_OK       = "ok"
+)
+
+// A PIndexSummary is a cheap summary of a local pindex, which avoids
+// the index params, source params and impl stats of a full pindex
+// listing, for nodes with many pindexes.
+type PIndexSummary struct {
+	Name             string `json:"name"`
+	IndexName        string `json:"indexName"`
+	IndexUUID        string `json:"indexUUID"`
+	IndexType        string `json:"indexType"`
+	SourcePartitions string `json:"sourcePartitions"`
+
+	// The total of the persisted seqs of the source partitions.
+	Seq uint64 `json:"seq"`
+
+	Health string `json:"health"`
+
+	// The Dest stats of the pindex, only when requested.
+	Stats json.RawMessage `json:"stats,omitempty"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// PIndexSummaries returns summaries of the local pindexes, keyed by
+// pindex name.  The Dest stats are retrieved only for the pindexes
+// named in statsPIndexes, as impl stats can be expensive.
+func (mgr *Manager) PIndexSummaries(
+	statsPIndexes map[string]bool) map[string]*PIndexSummary {
+	_, pindexes := mgr.CurrentMaps()
+
+	readOnly := mgr.PIndexesReadOnly()
+	verify := mgr.PIndexVerifyResults()
+
+	mgr.m.Lock()
+	building := make(map[string]bool, len(mgr.pindexBuilds))
+	for pindexName := range mgr.pindexBuilds {
+		building[pindexName] = true
+	}
+	mgr.m.Unlock()
+
+	rv := make(map[string]*PIndexSummary, len(pindexes))
+
+	for pindexName, pindex := range pindexes {
+		s := &PIndexSummary{
+			Name:             pindex.Name,
+			IndexName:        pindex.IndexName,
+			IndexUUID:        pindex.IndexUUID,
+			IndexType:        pindex.IndexType,
+			SourcePartitions: pindex.SourcePartitions,
+			Health:           PINDEX_HEALTH_OK,
+		}
+
+		if !mgr.IsPIndexWarm(pindexName) {
+			s.Health = PINDEX_HEALTH_WARMING
+		}
+		if building[pindexName] {
+			s.Health = PINDEX_HEALTH_BUILDING
+		}
+		if readOnly[pindexName] != "" {
+			s.Health = PINDEX_HEALTH_READONLY
+		}
+		if v := verify[pindexName]; v != nil && !v.OK {
+			s.Health = PINDEX_HEALTH_VERIFY
+		}
+
+		if pindex.Dest != nil {
+			for partition := range pindex.sourcePartitionsMap {
+				_, lastSeq, err := pindex.Dest.OpaqueGet(partition)
+				if err != nil {
+					s.Errors = append(s.Errors, fmt.Sprintf("OpaqueGet,"+
+						" partition: %s, err: %v", partition, err))
+					s.Health = PINDEX_HEALTH_ERROR
+					continue
+				}
+				s.Seq += lastSeq
+			}
+
+			if statsPIndexes[pindexName] {
+				var buf bytes.Buffer
+				err := pindex.Dest.Stats(&buf)
+				if err != nil {
+					s.Errors = append(s.Errors, fmt.Sprintf("Stats,"+
+						" err: %v", err))
+				} else {
+					s.Stats = json.RawMessage(buf.Bytes())
+				}
+			}
+		}
+
+		rv[pindexName] = s
+	}
+
+	return rv
+}
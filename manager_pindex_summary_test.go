@@ -0,0 +1,69 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPIndexSummaries(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if len(m.PIndexSummaries(nil)) != 0 {
+		t.Errorf("expected no summaries")
+	}
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+
+	summaries := m.PIndexSummaries(nil)
+	s := summaries[pindexName]
+	if len(summaries) != 1 || s == nil {
+		t.Fatalf("expected a summary, got: %#v", summaries)
+	}
+	if s.Name != pindexName || s.IndexName != "foo" ||
+		s.IndexType != "blackhole" || s.Health != PINDEX_HEALTH_OK ||
+		s.Stats != nil || len(s.Errors) != 0 {
+		t.Errorf("expected an ok summary without stats, got: %#v", s)
+	}
+
+	s = m.PIndexSummaries(map[string]bool{pindexName: true})[pindexName]
+	if string(s.Stats) != "null" {
+		t.Errorf("expected blackhole stats, got: %s", s.Stats)
+	}
+
+	err := m.SetPIndexReadOnly(pindexName, PINDEX_READ_ONLY_BUFFER)
+	if err != nil {
+		t.Fatalf("expected read-only to work, err: %v", err)
+	}
+
+	s = m.PIndexSummaries(nil)[pindexName]
+	if s.Health != PINDEX_HEALTH_READONLY {
+		t.Errorf("expected read-only health, got: %s", s.Health)
+	}
+}
@@ -12,6 +12,7 @@
 package cbgt
 
 import (
+	"context"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -132,6 +133,7 @@ func (mgr *Manager) PlannerLoop() {
 				changed, err := mgr.PlannerOnce(m.msg)
 				if err != nil {
 					log.Printf("planner: PlannerOnce, err: %v", err)
+					mgr.AddError(MANAGER_ERROR_PLANNER, "", err.Error())
 					atomic.AddUint64(&mgr.stats.TotPlannerKickErr, 1)
 					// Keep looping as perhaps it's a transient issue.
 				} else {
@@ -171,8 +173,23 @@ func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
 		return false, fmt.Errorf("planner: skipped due to nil cfg")
 	}
 
-	return Plan(mgr.cfg, mgr.version, mgr.uuid, mgr.server,
-		mgr.Options(), nil)
+	_, span := mgr.StartTraceSpan(context.Background(), "cbgt.planner")
+	span.SetTag("reason", reason)
+
+	var changed bool
+	err := Timer(func() (err error) {
+		changed, err = Plan(mgr.cfg, mgr.version, mgr.uuid, mgr.server,
+			mgr.Options(), nil)
+		return err
+	}, mgr.timers.TimerPlannerOnce)
+
+	span.SetTag("changed", changed)
+	span.Finish(err)
+
+	LogDebugf("planner", "planner: once done, reason: %s,"+
+		" changed: %v, err: %v", reason, changed, err)
+
+	return changed, err
 }
 
 // A PlannerFilter callback func should return true if the plans for
@@ -181,33 +198,186 @@ func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
 type PlannerFilter func(indexDef *IndexDef,
 	planPIndexesPrev, planPIndexes *PlanPIndexes) bool
 
-// Plan runs the planner once.
+// Plan runs the planner once.  If a concurrent planner saved a plan
+// first, the plan is recomputed from the latest Cfg and saved again,
+// following CfgRetryOptionsDefault.
 func Plan(cfg Cfg, version, uuid, server string, options map[string]string,
 	plannerFilter PlannerFilter) (bool, error) {
-	indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
-		PlannerGetPlan(cfg, version, uuid)
+	changed := false
+
+	err := CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+		indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
+			PlannerGetPlan(cfg, version, uuid)
+		if err != nil {
+			return err
+		}
+
+		planPIndexes, err := CalcPlan("", indexDefs, nodeDefs,
+			planPIndexesPrev, version, server, options, plannerFilter)
+		if err != nil {
+			return fmt.Errorf("planner: CalcPlan, err: %v", err)
+		}
+
+		if SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
+			changed = false
+			return nil
+		}
+
+		// Save the staged rollout before the plan, so that janitors
+		// never see the new plan without its rollout.  A first plan,
+		// with no previously planned pindexes, isn't staged.
+		wavePercent := PlanRolloutWavePercent(options)
+		if wavePercent > 0 && planPIndexesPrev != nil &&
+			len(planPIndexesPrev.PlanPIndexes) > 0 {
+			_, rolloutCAS, err := CfgGetPlanRollout(cfg)
+			if err != nil {
+				return fmt.Errorf("planner: CfgGetPlanRollout, err: %v", err)
+			}
+
+			_, err = CfgSetPlanRollout(cfg, NewPlanRollout(planPIndexes,
+				planPIndexesPrev, wavePercent, version), rolloutCAS)
+			if err != nil {
+				if _, ok := err.(*CfgCASError); ok {
+					return err
+				}
+				return fmt.Errorf("planner: could not save plan rollout,"+
+					" err: %v", err)
+			}
+		}
+
+		_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				log.Printf("planner: could not save new plan,"+
+					" perhaps a concurrent planner won, re-planning,"+
+					" cas: %d, tries: %d", cas, tries)
+				return err
+			}
+
+			return fmt.Errorf("planner: could not save new plan,"+
+				" cas: %d, err: %v", cas, err)
+		}
+
+		changed = true
+		return nil
+	})
 	if err != nil {
+		if _, ok := err.(*CfgCASError); ok {
+			return false, fmt.Errorf("planner: could not save new plan,"+
+				" perhaps concurrent planners kept winning, err: %v", err)
+		}
 		return false, err
 	}
 
-	planPIndexes, err := CalcPlan("", indexDefs, nodeDefs,
-		planPIndexesPrev, version, server, options, plannerFilter)
-	if err != nil {
-		return false, fmt.Errorf("planner: CalcPlan, err: %v", err)
-	}
+	return changed, nil
+}
 
-	if SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
-		return false, nil
-	}
+// FailoverNodes updates the plan so that the given nodes no longer
+// have any pindexes assigned, promoting replicas to primary on the
+// remaining nodes.  Unlike Plan(), the remaining assignments are left
+// as-is, so that a failover is fast and has minimal data movement.
+func FailoverNodes(cfg Cfg, version, server string,
+	options map[string]string, nodesFailover []string) (bool, error) {
+	mapNodesFailover := StringsToMap(nodesFailover)
 
-	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	changed := false
+
+	err := CfgRetry(CfgRetryOptionsDefault, func(tries int) error {
+		indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
+			PlannerGetPlan(cfg, version, "")
+		if err != nil {
+			return err
+		}
+
+		planPIndexesCalc, err := CalcPlan("failover",
+			indexDefs, nodeDefs, planPIndexesPrev, version, server,
+			options, nil)
+		if err != nil {
+			return fmt.Errorf("planner: failover CalcPlan, err: %v", err)
+		}
+
+		planPIndexesNext := CopyPlanPIndexes(planPIndexesPrev, version)
+		for planPIndexName, planPIndex := range planPIndexesNext.PlanPIndexes {
+			for node, planPIndexNode := range planPIndex.Nodes {
+				if !mapNodesFailover[node] {
+					continue
+				}
+
+				if planPIndexNode.Priority <= 0 {
+					// Failover'ed node used to be a primary for this
+					// pindex, so find a replica to promote.
+					promoted := ""
+
+				PROMOTE_REPLICA:
+					for nodePro, ppnPro := range planPIndex.Nodes {
+						if mapNodesFailover[nodePro] {
+							continue
+						}
+
+						if ppnPro.Priority >= 1 {
+							ppnPro.Priority = 0
+							planPIndex.Nodes[nodePro] = ppnPro
+							promoted = nodePro
+							break PROMOTE_REPLICA
+						}
+					}
+
+					// If we didn't find a replica to promote, and
+					// we're configured with the option to
+					// "failoverAssignAllPrimaries-IndexName" or
+					// "failoverAssignAllPrimaries" (default true),
+					// then assign the primary from the calculated
+					// plan.
+					if promoted == "" && ParseOptionsBool(options,
+						"failoverAssignAllPrimaries", planPIndex.IndexName, true) {
+						planPIndexCalc, exists :=
+							planPIndexesCalc.PlanPIndexes[planPIndexName]
+						if exists && planPIndexCalc != nil {
+						ASSIGN_PRIMARY:
+							for nodeCalc, ppnCalc := range planPIndexCalc.Nodes {
+								if ppnCalc.Priority <= 0 &&
+									!mapNodesFailover[nodeCalc] {
+									planPIndex.Nodes[nodeCalc] = ppnCalc
+									promoted = nodeCalc
+									break ASSIGN_PRIMARY
+								}
+							}
+						}
+					}
+				}
+
+				delete(planPIndex.Nodes, node)
+			}
+		}
+
+		// TODO: Missing under-replication constraint warnings.
+
+		if SamePlanPIndexes(planPIndexesNext, planPIndexesPrev) {
+			changed = false
+			return nil
+		}
+
+		_, err = CfgSetPlanPIndexes(cfg, planPIndexesNext, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				log.Printf("planner: failover could not save plan,"+
+					" perhaps a concurrent planner won, re-planning,"+
+					" cas: %d, tries: %d", cas, tries)
+				return err
+			}
+
+			return fmt.Errorf("planner: failover could not save plan,"+
+				" cas: %d, err: %v", cas, err)
+		}
+
+		changed = true
+		return nil
+	})
 	if err != nil {
-		return false, fmt.Errorf("planner: could not save new plan,"+
-			" perhaps a concurrent planner won, cas: %d, err: %v",
-			cas, err)
+		return false, err
 	}
 
-	return true, nil
+	return changed, nil
 }
 
 // PlannerGetPlan retrieves plan related info from the Cfg.
@@ -222,6 +392,11 @@ func PlannerGetPlan(cfg Cfg, version string, uuid string) (
 		return nil, nil, nil, 0, err
 	}
 
+	_, err = CfgAdvanceCompatVersion(cfg)
+	if err != nil {
+		log.Printf("planner: CfgAdvanceCompatVersion, err: %v", err)
+	}
+
 	indexDefs, err = PlannerGetIndexDefs(cfg, version)
 	if err != nil {
 		return nil, nil, nil, 0, err
@@ -252,6 +427,21 @@ func PlannerCheckVersion(cfg Cfg, version string) error {
 	return nil
 }
 
+// plannerCheckImplVersion errors if the ImplVersion of a Cfg entry is
+// greater than the planner's version, or if either can't be parsed.
+func plannerCheckImplVersion(what, implVersion, version string) error {
+	c, err := CompareVersions(version, implVersion)
+	if err != nil {
+		return fmt.Errorf("planner: %s.ImplVersion: %s, version: %s,"+
+			" err: %v", what, implVersion, version, err)
+	}
+	if c < 0 {
+		return fmt.Errorf("planner: %s.ImplVersion: %s"+
+			" > version: %s", what, implVersion, version)
+	}
+	return nil
+}
+
 // PlannerGetIndexDefs retrives index definitions from a Cfg.
 func PlannerGetIndexDefs(cfg Cfg, version string) (*IndexDefs, error) {
 	indexDefs, _, err := CfgGetIndexDefs(cfg)
@@ -261,9 +451,9 @@ func PlannerGetIndexDefs(cfg Cfg, version string) (*IndexDefs, error) {
 	if indexDefs == nil {
 		return NewIndexDefs(version), nil
 	}
-	if VersionGTE(version, indexDefs.ImplVersion) == false {
-		return nil, fmt.Errorf("planner: indexDefs.ImplVersion: %s"+
-			" > version: %s", indexDefs.ImplVersion, version)
+	err = plannerCheckImplVersion("indexDefs", indexDefs.ImplVersion, version)
+	if err != nil {
+		return nil, err
 	}
 	return indexDefs, nil
 }
@@ -278,9 +468,9 @@ func PlannerGetNodeDefs(cfg Cfg, version, uuid string) (
 	if nodeDefs == nil {
 		nodeDefs = NewNodeDefs(version)
 	}
-	if VersionGTE(version, nodeDefs.ImplVersion) == false {
-		return nil, fmt.Errorf("planner: nodeDefs.ImplVersion: %s"+
-			" > version: %s", nodeDefs.ImplVersion, version)
+	err = plannerCheckImplVersion("nodeDefs", nodeDefs.ImplVersion, version)
+	if err != nil {
+		return nil, err
 	}
 	if uuid == "" { // The caller may not be a node, so has empty uuid.
 		return nodeDefs, nil
@@ -325,9 +515,10 @@ func PlannerGetPlanPIndexes(cfg Cfg, version string) (
 	if planPIndexesPrev == nil {
 		planPIndexesPrev = NewPlanPIndexes(version)
 	}
-	if VersionGTE(version, planPIndexesPrev.ImplVersion) == false {
-		return nil, 0, fmt.Errorf("planner: planPIndexesPrev.ImplVersion: %s"+
-			" > version: %s", planPIndexesPrev.ImplVersion, version)
+	err = plannerCheckImplVersion("planPIndexesPrev",
+		planPIndexesPrev.ImplVersion, version)
+	if err != nil {
+		return nil, 0, err
 	}
 	return planPIndexesPrev, cas, nil
 }
@@ -435,6 +626,10 @@ func CalcPlan(mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 		}
 		indexDef = pho.IndexDef
 
+		// During a re-split, the previous generation of the index is
+		// kept in the plan.
+		CaseResplit(indexDef, planPIndexesPrev, planPIndexes)
+
 		// If the plan is frozen, CasePlanFrozen clones the previous
 		// plan for this index.
 		if CasePlanFrozen(indexDef, planPIndexesPrev, planPIndexes) {
@@ -478,14 +673,36 @@ func CalcPlan(mode string, indexDefs *IndexDefs, nodeDefs *NodeDefs,
 		indexDef = pho.IndexDef
 		planPIndexesForIndex = pho.PlanPIndexesForIndex
 
+		nodeUUIDsToAddForIndex, nodeUUIDsToRemoveForIndex :=
+			CalcNodesLayoutForIndex(indexDef, nodeDefs,
+				nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove)
+
 		// Once we have a 1 or more PlanPIndexes for an IndexDef, use
 		// blance to assign the PlanPIndexes to nodes.
 		warnings := BlancePlanPIndexes(mode, indexDef,
 			planPIndexesForIndex, planPIndexesPrev,
-			nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove,
+			nodeUUIDsAll, nodeUUIDsToAddForIndex, nodeUUIDsToRemoveForIndex,
 			nodeWeights, nodeHierarchy)
+
+		// A strict zone spread fails the plan, except for a failover,
+		// which shouldn't be blocked by a lost zone.
+		if indexDef.PlanParams.ZoneSpread != "" {
+			zoneWarnings := CheckZoneSpread(indexDef,
+				planPIndexesForIndex, nodeDefs)
+			if len(zoneWarnings) > 0 && mode != "failover" &&
+				indexDef.PlanParams.ZoneSpread == ZONE_SPREAD_STRICT {
+				return planPIndexes, &ZoneViolationError{
+					IndexName:  indexDef.Name,
+					Violations: zoneWarnings,
+				}
+			}
+			warnings = append(warnings, zoneWarnings...)
+		}
+
 		planPIndexes.Warnings[indexDef.Name] = warnings
 
+		StandbyPlanPIndexes(planPIndexesForIndex, nodeDefs)
+
 		for _, warning := range warnings {
 			log.Printf("planner: indexDef.Name: %s,"+
 				" PlanNextMap warning: %s", indexDef.Name, warning)
@@ -566,6 +783,76 @@ func CalcNodesLayout(indexDefs *IndexDefs, nodeDefs *NodeDefs,
 		nodeWeights, nodeHierarchy
 }
 
+// CalcNodesLayoutForIndex narrows the cluster-wide node deltas from
+// CalcNodesLayout() for an index definition, where the nodes that
+// are ineligible to host the index's pindexes, due to the index's
+// namespace (see NamespaceIneligibleNodeUUIDs()), the index's
+// PlanParams.NodeSelector or the index type not being among a node's
+// capabilities, are treated as nodes to remove, so that blance moves
+// the index's pindexes off of them.
+func CalcNodesLayoutForIndex(indexDef *IndexDef, nodeDefs *NodeDefs,
+	nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove []string) (
+	nodeUUIDsToAddForIndex []string,
+	nodeUUIDsToRemoveForIndex []string,
+) {
+	nodeUUIDsIneligible := NamespaceIneligibleNodeUUIDs(nodeDefs,
+		indexDef.Namespace, nodeUUIDsAll)
+
+	if nodeDefs != nil {
+		for _, nodeUUID := range nodeUUIDsAll {
+			nodeDef, exists := nodeDefs.NodeDefs[nodeUUID]
+			if !exists || nodeDef == nil {
+				continue
+			}
+			if !NodeDefSupportsIndexType(nodeDef, indexDef.Type) ||
+				!NodeDefMatchesSelector(nodeDef,
+					indexDef.PlanParams.NodeSelector) {
+				nodeUUIDsIneligible = append(nodeUUIDsIneligible, nodeUUID)
+			}
+		}
+	}
+
+	if len(nodeUUIDsIneligible) <= 0 {
+		return nodeUUIDsToAdd, nodeUUIDsToRemove
+	}
+
+	nodeUUIDsToAddForIndex =
+		StringsRemoveStrings(nodeUUIDsToAdd, nodeUUIDsIneligible)
+
+	nodeUUIDsToRemoveForIndex = append([]string(nil), nodeUUIDsToRemove...)
+	nodeUUIDsToRemoveForIndex =
+		append(nodeUUIDsToRemoveForIndex, nodeUUIDsIneligible...)
+	nodeUUIDsToRemoveForIndex = StringsIntersectStrings( // Dedupe.
+		nodeUUIDsToRemoveForIndex, nodeUUIDsToRemoveForIndex)
+	sort.Strings(nodeUUIDsToRemoveForIndex)
+
+	return nodeUUIDsToAddForIndex, nodeUUIDsToRemoveForIndex
+}
+
+// NodeDefMatchesSelector returns true if a node matches every entry
+// of a PlanParams.NodeSelector.  A selector entry of "k": "v" matches
+// a node tag of "k:v", or a plain node tag of "k" when v is "true".
+// A selector entry keyed by "container" instead matches the node's
+// container path or an ancestor of it, like "zone1" for a node whose
+// container is "zone1/rack2".
+func NodeDefMatchesSelector(nodeDef *NodeDef,
+	selector map[string]string) bool {
+	tags := StringsToMap(nodeDef.Tags)
+	for k, v := range selector {
+		if k == "container" {
+			if nodeDef.Container != v &&
+				!strings.HasPrefix(nodeDef.Container, v+"/") {
+				return false
+			}
+			continue
+		}
+		if !tags[k+":"+v] && !(v == "true" && tags[k]) {
+			return false
+		}
+	}
+	return true
+}
+
 // Split an IndexDef into 1 or more PlanPIndex'es, assigning data
 // source partitions from the IndexDef to a PlanPIndex based on
 // modulus of MaxPartitionsPerPIndex.
@@ -741,6 +1028,45 @@ func BlancePlanPIndexes(mode string,
 	return warnings
 }
 
+// StandbyPlanPIndexes adjusts the node assignments of planPIndexes
+// so that nodes tagged as "standby" are not readable, and are not
+// primaries whenever a non-standby node is available to be the
+// primary instead.  See NodeDefIsStandby().
+func StandbyPlanPIndexes(planPIndexes map[string]*PlanPIndex,
+	nodeDefs *NodeDefs) {
+	if nodeDefs == nil {
+		return
+	}
+
+	for _, planPIndex := range planPIndexes {
+		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+			if !NodeDefIsStandby(nodeDefs.NodeDefs[nodeUUID]) {
+				continue
+			}
+
+			planPIndexNode.CanRead = false
+
+			if planPIndexNode.Priority > 0 {
+				continue
+			}
+
+			// Swap priorities with the best non-standby replica.
+			var swap *PlanPIndexNode
+			for nodeUUIDOther, ppnOther := range planPIndex.Nodes {
+				if ppnOther.Priority > 0 &&
+					!NodeDefIsStandby(nodeDefs.NodeDefs[nodeUUIDOther]) &&
+					(swap == nil || ppnOther.Priority < swap.Priority) {
+					swap = ppnOther
+				}
+			}
+			if swap != nil {
+				planPIndexNode.Priority, swap.Priority =
+					swap.Priority, planPIndexNode.Priority
+			}
+		}
+	}
+}
+
 // BlancePartitionModel returns a blance library PartitionModel and
 // model constraints based on an input index definition.
 func BlancePartitionModel(indexDef *IndexDef) (
@@ -829,6 +1155,24 @@ func CasePlanFrozen(indexDef *IndexDef,
 	return true
 }
 
+// CaseResplit copies the plan pindexes of the previous generation of
+// an index that's being re-split from the previous plan, so that
+// they keep serving queries until the new generation is caught up.
+func CaseResplit(indexDef *IndexDef,
+	begPlanPIndexes, endPlanPIndexes *PlanPIndexes) {
+	resplit := indexDef.PlanParams.Resplit
+	if resplit == nil || begPlanPIndexes == nil || endPlanPIndexes == nil {
+		return
+	}
+
+	for n, p := range begPlanPIndexes.PlanPIndexes {
+		if p.IndexName == indexDef.Name &&
+			p.IndexUUID == resplit.PrevIndexUUID {
+			endPlanPIndexes.PlanPIndexes[n] = p
+		}
+	}
+}
+
 // --------------------------------------------------------
 
 // NOTE: PlanPIndex.Name must be unique across the cluster and ideally
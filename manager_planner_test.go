@@ -0,0 +1,76 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNodeDefMatchesSelector(t *testing.T) {
+	nodeDef := &NodeDef{
+		Tags:      []string{"pindex", "ssd", "gen:2"},
+		Container: "us-east-1a/rack2",
+	}
+
+	tests := []struct {
+		selector map[string]string
+		exp      bool
+	}{
+		{nil, true},
+		{map[string]string{"ssd": "true"}, true},
+		{map[string]string{"gen": "2"}, true},
+		{map[string]string{"gen": "3"}, false},
+		{map[string]string{"nvme": "true"}, false},
+		{map[string]string{"container": "us-east-1a"}, true},
+		{map[string]string{"container": "us-east-1a/rack2"}, true},
+		{map[string]string{"container": "us-east-1"}, false},
+		{map[string]string{"ssd": "true", "container": "us-west-1"}, false},
+	}
+	for i, test := range tests {
+		if got := NodeDefMatchesSelector(nodeDef, test.selector); got != test.exp {
+			t.Errorf("test %d, expected %v, got: %v, selector: %v",
+				i, test.exp, got, test.selector)
+		}
+	}
+}
+
+func TestCalcNodesLayoutForIndex(t *testing.T) {
+	nodeDefs := &NodeDefs{
+		NodeDefs: map[string]*NodeDef{
+			"a": {UUID: "a", Tags: []string{"pindex", "ssd"}},
+			"b": {UUID: "b", Tags: []string{"pindex"}},
+			"c": {UUID: "c", Tags: []string{"pindex", "ssd"}},
+		},
+	}
+	nodeUUIDsAll := []string{"a", "b", "c", "d"}
+	nodeUUIDsToAdd := []string{"b", "c"}
+	nodeUUIDsToRemove := []string{"d"}
+
+	indexDef := &IndexDef{Name: "foo"}
+
+	adds, removes := CalcNodesLayoutForIndex(indexDef, nodeDefs,
+		nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove)
+	if !reflect.DeepEqual(adds, nodeUUIDsToAdd) ||
+		!reflect.DeepEqual(removes, nodeUUIDsToRemove) {
+		t.Errorf("expected unchanged layout, got: %v, %v", adds, removes)
+	}
+
+	indexDef.PlanParams.NodeSelector = map[string]string{"ssd": "true"}
+
+	adds, removes = CalcNodesLayoutForIndex(indexDef, nodeDefs,
+		nodeUUIDsAll, nodeUUIDsToAdd, nodeUUIDsToRemove)
+	if !reflect.DeepEqual(adds, []string{"c"}) ||
+		!reflect.DeepEqual(removes, []string{"b", "d"}) {
+		t.Errorf("expected selected layout, got: %v, %v", adds, removes)
+	}
+}
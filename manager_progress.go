@@ -0,0 +1,201 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// An IndexProgress summarizes how caught up the local pindexes of an
+// index are with the index's data source.
+type IndexProgress struct {
+	IndexName string `json:"indexName"`
+
+	// Totals across the local pindexes.
+	Seq             uint64  `json:"seq"`
+	SourceSeq       uint64  `json:"sourceSeq"`
+	PercentComplete float64 `json:"percentComplete"`
+	CaughtUp        bool    `json:"caughtUp"`
+
+	// Non-empty when the data source was seen as missing by the
+	// source watcher (see SourceBrokenIndexes()).
+	SourceBroken string `json:"sourceBroken,omitempty"`
+
+	// Keyed by pindex name.
+	PIndexes map[string]*PIndexProgress `json:"pindexes"`
+}
+
+// A PIndexProgress represents how caught up a local pindex is with
+// its source partitions.
+type PIndexProgress struct {
+	Seq             uint64  `json:"seq"`
+	SourceSeq       uint64  `json:"sourceSeq"`
+	PercentComplete float64 `json:"percentComplete"`
+
+	Warm     bool `json:"warm"`
+	Building bool `json:"building"`
+
+	// The last time that the persisted seqs of the pindex were seen
+	// to advance by IndexProgress().
+	LastFlush time.Time `json:"lastFlush"`
+
+	FeedErrors            uint64 `json:"feedErrors"`
+	ConsistencyWaitErrors uint64 `json:"consistencyWaitErrors"`
+
+	// Keyed by partition.
+	Partitions map[string]*PartitionProgress `json:"partitions"`
+
+	// Errors seen while retrieving the progress, if any.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// A PartitionProgress represents the persisted seq of a partition of
+// a pindex versus the high seq of the source partition.
+type PartitionProgress struct {
+	Seq       uint64 `json:"seq"`
+	SourceSeq uint64 `json:"sourceSeq"`
+}
+
+// IndexProgress returns the progress of the local pindexes of an
+// index.  When the index's source type doesn't provide partition
+// seqs, the source seqs are reported as 0 and the pindexes are
+// considered complete.
+func (mgr *Manager) IndexProgress(indexName string) (*IndexProgress, error) {
+	indexDef, _, err := mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &IndexProgress{
+		IndexName:    indexName,
+		SourceBroken: mgr.sourceBrokenMsg(indexName),
+		PIndexes:     map[string]*PIndexProgress{},
+	}
+
+	var sourceSeqs map[string]UUIDSeq
+	var sourceSeqsErr error
+
+	feedType := FeedTypes[indexDef.SourceType]
+	if feedType != nil && feedType.PartitionSeqs != nil {
+		sourceSeqs, sourceSeqsErr = feedType.PartitionSeqs(
+			indexDef.SourceType, indexDef.SourceName, indexDef.SourceUUID,
+			indexDef.SourceParams, mgr.server, mgr.Options())
+	}
+
+	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
+
+	feeds, pindexes := mgr.CurrentMaps()
+	for pindexName, pindex := range pindexes {
+		if pindex.IndexName != indexName {
+			continue
+		}
+
+		p := &PIndexProgress{
+			Warm:       mgr.IsPIndexWarm(pindexName),
+			Partitions: map[string]*PartitionProgress{},
+		}
+
+		if sourceSeqsErr != nil {
+			p.Errors = append(p.Errors, fmt.Sprintf("PartitionSeqs,"+
+				" err: %v", sourceSeqsErr))
+		}
+
+		mgr.m.Lock()
+		_, p.Building = mgr.pindexBuilds[pindexName]
+		mgr.m.Unlock()
+
+		for partition := range pindex.sourcePartitionsMap {
+			pp := &PartitionProgress{}
+			if uuidSeq, exists := sourceSeqs[partition]; exists {
+				pp.SourceSeq = uuidSeq.Seq
+			}
+
+			if pindex.Dest != nil {
+				_, lastSeq, err := pindex.Dest.OpaqueGet(partition)
+				if err != nil {
+					p.Errors = append(p.Errors, fmt.Sprintf("OpaqueGet,"+
+						" partition: %s, err: %v", partition, err))
+				} else {
+					pp.Seq = lastSeq
+				}
+			}
+
+			p.Partitions[partition] = pp
+
+			p.Seq += pp.Seq
+			p.SourceSeq += pp.SourceSeq
+		}
+
+		p.PercentComplete = progressPercent(p.Partitions)
+		p.LastFlush = pindex.observeProgressSeq(p.Seq, time.Now())
+
+		if feedErrorCounter, ok :=
+			feeds[FeedNameForPIndex(pindex, feedAllotment)].(FeedErrorCounter); ok {
+			p.FeedErrors = feedErrorCounter.ErrorCount()
+		}
+
+		cws := pindex.ConsistencyWaitStats()
+		p.ConsistencyWaitErrors = atomic.LoadUint64(&cws.TotTimeout) +
+			atomic.LoadUint64(&cws.TotError)
+
+		rv.PIndexes[pindexName] = p
+
+		rv.Seq += p.Seq
+		rv.SourceSeq += p.SourceSeq
+	}
+
+	allPartitions := map[string]*PartitionProgress{}
+	for pindexName, p := range rv.PIndexes {
+		for partition, pp := range p.Partitions {
+			allPartitions[pindexName+"/"+partition] = pp
+		}
+	}
+
+	rv.PercentComplete = progressPercent(allPartitions)
+	rv.CaughtUp = rv.PercentComplete >= 100.0 && rv.SourceBroken == ""
+
+	return rv, nil
+}
+
+// progressPercent returns how complete the partitions are, where a
+// partition that's ahead of its source seq, such as after a source
+// rollback, is counted as complete.
+func progressPercent(partitions map[string]*PartitionProgress) float64 {
+	var seq, sourceSeq uint64
+	for _, pp := range partitions {
+		if pp.Seq < pp.SourceSeq {
+			seq += pp.Seq
+		} else {
+			seq += pp.SourceSeq
+		}
+		sourceSeq += pp.SourceSeq
+	}
+	if sourceSeq <= 0 {
+		return 100.0
+	}
+	return 100.0 * float64(seq) / float64(sourceSeq)
+}
+
+// observeProgressSeq remembers the total persisted seq of a pindex,
+// returning the last time that the total seq was seen to change.
+func (p *PIndex) observeProgressSeq(seq uint64, now time.Time) time.Time {
+	p.m.Lock()
+	if p.progressTime.IsZero() || p.progressSeq != seq {
+		p.progressSeq = seq
+		p.progressTime = now
+	}
+	rv := p.progressTime
+	p.m.Unlock()
+	return rv
+}
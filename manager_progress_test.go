@@ -0,0 +1,117 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerIndexProgress(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if _, err := m.IndexProgress("foo"); err == nil {
+		t.Errorf("expected err on missing index")
+	}
+
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":1}`,
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	progress, err := m.IndexProgress("foo")
+	if err != nil {
+		t.Fatalf("expected IndexProgress() to work, err: %v", err)
+	}
+	if !progress.CaughtUp || progress.PercentComplete != 100.0 ||
+		len(progress.PIndexes) != 1 {
+		t.Errorf("expected caught up without source seqs, got: %#v",
+			progress)
+	}
+
+	primary := FeedTypes["primary"]
+	primary.PartitionSeqs = func(sourceType, sourceName, sourceUUID,
+		sourceParams, server string, options map[string]string) (
+		map[string]UUIDSeq, error) {
+		return map[string]UUIDSeq{"0": UUIDSeq{Seq: 10}}, nil
+	}
+	progress, err = m.IndexProgress("foo")
+	primary.PartitionSeqs = nil
+	if err != nil {
+		t.Fatalf("expected IndexProgress() to work, err: %v", err)
+	}
+	if progress.CaughtUp || progress.PercentComplete != 0 ||
+		progress.SourceSeq != 10 || progress.Seq != 0 {
+		t.Errorf("expected lagging progress, got: %#v", progress)
+	}
+	for _, p := range progress.PIndexes {
+		pp := p.Partitions["0"]
+		if pp == nil || pp.SourceSeq != 10 || pp.Seq != 0 {
+			t.Errorf("expected partition progress, got: %#v", pp)
+		}
+		if p.LastFlush.IsZero() {
+			t.Errorf("expected lastFlush")
+		}
+	}
+}
+
+func TestProgressPercent(t *testing.T) {
+	tests := []struct {
+		partitions map[string]*PartitionProgress
+		exp        float64
+	}{
+		{nil, 100},
+		{map[string]*PartitionProgress{
+			"0": &PartitionProgress{Seq: 0, SourceSeq: 0}}, 100},
+		{map[string]*PartitionProgress{
+			"0": &PartitionProgress{Seq: 5, SourceSeq: 10},
+			"1": &PartitionProgress{Seq: 10, SourceSeq: 10}}, 75},
+		{map[string]*PartitionProgress{
+			"0": &PartitionProgress{Seq: 20, SourceSeq: 10},
+			"1": &PartitionProgress{Seq: 0, SourceSeq: 10}}, 50},
+	}
+
+	for i, test := range tests {
+		if got := progressPercent(test.partitions); got != test.exp {
+			t.Errorf("i: %d, expected: %v, got: %v", i, test.exp, got)
+		}
+	}
+}
+
+func TestPIndexObserveProgressSeq(t *testing.T) {
+	p := &PIndex{}
+
+	t0 := time.Now()
+	if got := p.observeProgressSeq(5, t0); !got.Equal(t0) {
+		t.Errorf("expected first observation time")
+	}
+	if got := p.observeProgressSeq(5, t0.Add(time.Second)); !got.Equal(t0) {
+		t.Errorf("expected unchanged time when seq is unchanged")
+	}
+	t1 := t0.Add(2 * time.Second)
+	if got := p.observeProgressSeq(6, t1); !got.Equal(t1) {
+		t.Errorf("expected new time when seq changes")
+	}
+}
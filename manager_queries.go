@@ -0,0 +1,137 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A QueryHandle represents an active query that's registered with a
+// Manager, so that the query can be listed and cancelled.  Query
+// implementations should stop their work, such as a scatter-gather
+// across pindexes, when the CancelCh() is closed.
+type QueryHandle struct {
+	ID        string    `json:"id"`
+	IndexName string    `json:"indexName"`
+	Consumer  string    `json:"consumer"` // Like the client's address.
+	StartTime time.Time `json:"startTime"`
+	RequestID string    `json:"requestID,omitempty"`
+
+	cancelCh   chan bool
+	cancelOnce sync.Once
+}
+
+// CancelCh returns a channel that's closed when the query is
+// cancelled.
+func (h *QueryHandle) CancelCh() <-chan bool {
+	return h.cancelCh
+}
+
+// Cancel closes the query's CancelCh(), and may be called more than
+// once.
+func (h *QueryHandle) Cancel() {
+	h.cancelOnce.Do(func() { close(h.cancelCh) })
+}
+
+// RegisterQuery tracks a new active query on an index, which must be
+// unregistered via UnregisterQuery() when the query is done.
+func (mgr *Manager) RegisterQuery(indexName, consumer string) *QueryHandle {
+	return mgr.RegisterQueryCtx(context.Background(), indexName, consumer)
+}
+
+// RegisterQueryCtx is like RegisterQuery, but also tracks the ctx's
+// request ID with the query.
+func (mgr *Manager) RegisterQueryCtx(ctx context.Context,
+	indexName, consumer string) *QueryHandle {
+	h := &QueryHandle{
+		IndexName: indexName,
+		Consumer:  consumer,
+		StartTime: time.Now(),
+		RequestID: RequestID(ctx),
+		cancelCh:  make(chan bool),
+	}
+
+	mgr.m.Lock()
+	mgr.querySeq++
+	h.ID = mgr.uuid + "-" + strconv.FormatUint(mgr.querySeq, 10)
+	if mgr.queries == nil {
+		mgr.queries = map[string]*QueryHandle{}
+	}
+	mgr.queries[h.ID] = h
+	mgr.m.Unlock()
+
+	return h
+}
+
+// UnregisterQuery stops tracking a query that was registered via
+// RegisterQuery().
+func (mgr *Manager) UnregisterQuery(h *QueryHandle) {
+	mgr.m.Lock()
+	delete(mgr.queries, h.ID)
+	mgr.m.Unlock()
+
+	mgr.timers.TimerQuery.UpdateSince(h.StartTime)
+}
+
+// ActiveQueries returns the active queries, oldest first.
+func (mgr *Manager) ActiveQueries() []*QueryHandle {
+	mgr.m.Lock()
+	rv := make([]*QueryHandle, 0, len(mgr.queries))
+	for _, h := range mgr.queries {
+		rv = append(rv, h)
+	}
+	mgr.m.Unlock()
+
+	sort.Sort(queryHandlesByStartTime(rv))
+
+	return rv
+}
+
+type queryHandlesByStartTime []*QueryHandle
+
+func (a queryHandlesByStartTime) Len() int {
+	return len(a)
+}
+
+func (a queryHandlesByStartTime) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a queryHandlesByStartTime) Less(i, j int) bool {
+	if a[i].StartTime.Equal(a[j].StartTime) {
+		return a[i].ID < a[j].ID
+	}
+	return a[i].StartTime.Before(a[j].StartTime)
+}
+
+// CancelQuery cancels an active query, returning false if there's no
+// active query with the given ID.
+func (mgr *Manager) CancelQuery(id string) bool {
+	mgr.m.Lock()
+	h := mgr.queries[id]
+	mgr.m.Unlock()
+
+	if h == nil {
+		return false
+	}
+
+	atomic.AddUint64(&mgr.stats.TotQueryCancelled, 1)
+
+	h.Cancel()
+
+	return true
+}
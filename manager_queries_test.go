@@ -0,0 +1,66 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"testing"
+)
+
+func TestManagerQueries(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	if len(m.ActiveQueries()) != 0 {
+		t.Errorf("expected no active queries")
+	}
+	if m.CancelQuery("not-a-query") {
+		t.Errorf("expected cancel of unknown query to fail")
+	}
+
+	h0 := m.RegisterQuery("idx0", "client0")
+	h1 := m.RegisterQuery("idx1", "client1")
+	if h0.ID == "" || h0.ID == h1.ID {
+		t.Errorf("expected unique query IDs, got: %s, %s", h0.ID, h1.ID)
+	}
+
+	queries := m.ActiveQueries()
+	if len(queries) != 2 || queries[0] != h0 || queries[1] != h1 {
+		t.Errorf("expected 2 active queries, got: %#v", queries)
+	}
+
+	if !m.CancelQuery(h0.ID) || !m.CancelQuery(h0.ID) {
+		t.Errorf("expected cancel of active query to work")
+	}
+	select {
+	case <-h0.CancelCh():
+	default:
+		t.Errorf("expected cancelled query")
+	}
+	select {
+	case <-h1.CancelCh():
+		t.Errorf("expected uncancelled query")
+	default:
+	}
+
+	m.UnregisterQuery(h0)
+	m.UnregisterQuery(h1)
+
+	if len(m.ActiveQueries()) != 0 || m.CancelQuery(h1.ID) {
+		t.Errorf("expected no active queries after unregister")
+	}
+
+	var stats ManagerStats
+	m.StatsCopyTo(&stats)
+	if stats.TotQueryCancelled != 2 {
+		t.Errorf("expected 2 cancels, got: %d", stats.TotQueryCancelled)
+	}
+}
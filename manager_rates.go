@@ -0,0 +1,57 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// ManagerTimers complement the monotonic counters of ManagerStats
+// with the 1, 5 and 15 minute moving-window rates and the latency
+// percentiles of the manager's recurring work.
+type ManagerTimers struct {
+	TimerPlannerOnce metrics.Timer
+	TimerJanitorOnce metrics.Timer
+	TimerFeedBatch   metrics.Timer // DCP snapshots and push batches.
+	TimerQuery       metrics.Timer // Registered queries.
+}
+
+func NewManagerTimers() *ManagerTimers {
+	return &ManagerTimers{
+		TimerPlannerOnce: metrics.NewTimer(),
+		TimerJanitorOnce: metrics.NewTimer(),
+		TimerFeedBatch:   metrics.NewTimer(),
+		TimerQuery:       metrics.NewTimer(),
+	}
+}
+
+// Timers returns the ManagerTimers of a Manager.
+func (mgr *Manager) Timers() *ManagerTimers {
+	return mgr.timers
+}
+
+// WriteJSON writes the ManagerTimers as JSON to a writer.
+func (t *ManagerTimers) WriteJSON(w io.Writer) {
+	t.WriteJSONEx(w, MetricsJSONOptionsDefault)
+}
+
+// WriteJSONEx writes the ManagerTimers as JSON to a writer.
+func (t *ManagerTimers) WriteJSONEx(w io.Writer, opts MetricsJSONOptions) {
+	WriteMetricsJSON(w, map[string]*TimerJSON{
+		"plannerOnce": NewTimerJSON(t.TimerPlannerOnce, opts.Percentiles),
+		"janitorOnce": NewTimerJSON(t.TimerJanitorOnce, opts.Percentiles),
+		"feedBatch":   NewTimerJSON(t.TimerFeedBatch, opts.Percentiles),
+		"query":       NewTimerJSON(t.TimerQuery, opts.Percentiles),
+	}, opts)
+}
@@ -0,0 +1,52 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestManagerTimers(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	h := m.RegisterQuery("foo", "test")
+	m.UnregisterQuery(h)
+
+	m.PlannerOnce("test")
+
+	if m.Timers().TimerQuery.Count() != 1 {
+		t.Errorf("expected 1 query, got: %d", m.Timers().TimerQuery.Count())
+	}
+	if m.Timers().TimerPlannerOnce.Count() != 1 {
+		t.Errorf("expected 1 planner run, got: %d",
+			m.Timers().TimerPlannerOnce.Count())
+	}
+
+	var buf bytes.Buffer
+	m.Timers().WriteJSON(&buf)
+
+	var rates map[string]map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &rates)
+	if err != nil {
+		t.Fatalf("expected JSON, err: %v, got: %s", err, buf.String())
+	}
+	for _, k := range []string{"plannerOnce", "janitorOnce", "feedBatch", "query"} {
+		if rates[k] == nil || rates[k]["rates"] == nil ||
+			rates[k]["percentiles"] == nil {
+			t.Errorf("expected rates and percentiles for %s, got: %s",
+				k, buf.String())
+		}
+	}
+}
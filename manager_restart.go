@@ -0,0 +1,491 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// When an index's params are updated in a way that its pindex
+// implementation type can handle by reopening the existing pindex
+// files (see PIndexImplType.AnalyzeIndexParamsUpdate), the janitor
+// restarts the local pindexes of the index one at a time, instead of
+// removing and rebuilding all of them at once, so that the index
+// stays queryable.  As the names of the plan pindexes change along
+// with the index UUID, a local pindex is matched to its updated plan
+// pindex by the index name and source partitions, and the pindex's
+// files are moved to the path of the updated plan pindex.
+//
+// The replicas of a pindex on different nodes are restarted in a
+// staggered order, where each node waits for its rank among the
+// pindex's nodes (ordered by node UUID) times the
+// "rollingRestartStagger" manager option, like "10s", which is
+// parsed by time.ParseDuration() and defaults to
+// ROLLING_RESTART_STAGGER.
+//
+// A node restarts only one pindex at a time, waiting until the
+// restarted pindex is warm before restarting the next one, and a
+// pindex is only restarted while its replicas on the other nodes are
+// alive and not being restarted themselves.  The in-flight restarts
+// are tracked in the Cfg (see PIndexRestarts), so that every node
+// knows which replicas are still warming up.
+
+// PINDEXES_RESTART means the pindexes of an index can adopt updated
+// index params by being restarted via PIndexImplType.OpenUsing().
+const PINDEXES_RESTART = "restart"
+
+// PINDEXES_REBUILD means the pindexes of an index need to be rebuilt
+// from scratch to adopt updated index params.
+const PINDEXES_REBUILD = "rebuild"
+
+// ROLLING_RESTART_STAGGER is the default for the
+// rollingRestartStagger manager option.
+var ROLLING_RESTART_STAGGER = 10 * time.Second
+
+// PINDEX_RESTARTS_RETRY is how long the janitor waits to recheck
+// restarts that are waiting on an in-flight restart.
+var PINDEX_RESTARTS_RETRY = 5 * time.Second
+
+// PINDEX_RESTARTS_KEY is the key used for Cfg access of the
+// PIndexRestarts.
+const PINDEX_RESTARTS_KEY = "pindexRestarts"
+
+// PIndexRestarts represents the in-flight restarts of a cluster.
+type PIndexRestarts struct {
+	// The plan pindex that a node is restarting a pindex as, until
+	// the restarted pindex is warm, keyed by node UUID.
+	Restarting  map[string]string `json:"restarting"`
+	ImplVersion string            `json:"implVersion"`
+}
+
+// CfgGetPIndexRestarts retrieves the PIndexRestarts from a Cfg
+// provider.
+func CfgGetPIndexRestarts(cfg Cfg) (*PIndexRestarts, uint64, error) {
+	v, cas, err := cfg.Get(PINDEX_RESTARTS_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &PIndexRestarts{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// cfgUpdatePIndexRestarts performs a read-modify-write of the
+// PIndexRestarts with CAS retries, where the update callback returns
+// false to leave the PIndexRestarts unchanged.
+func (mgr *Manager) cfgUpdatePIndexRestarts(
+	update func(r *PIndexRestarts) bool) error {
+	_, err := CfgSetRetry(mgr.cfg, PINDEX_RESTARTS_KEY,
+		CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			r := &PIndexRestarts{}
+			if val != nil {
+				err := json.Unmarshal(val, r)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if r.Restarting == nil {
+				r.Restarting = map[string]string{}
+			}
+
+			if !update(r) {
+				return nil, nil
+			}
+
+			r.ImplVersion = mgr.version
+
+			return json.Marshal(r)
+		})
+
+	return err
+}
+
+// pindexRestarting returns the in-flight restarts of the cluster,
+// keyed by node UUID.
+func (mgr *Manager) pindexRestarting() map[string]string {
+	if mgr.cfg == nil { // Can occur during testing.
+		return nil
+	}
+
+	r, _, err := CfgGetPIndexRestarts(mgr.cfg)
+	if err != nil {
+		log.Printf("janitor: CfgGetPIndexRestarts, err: %v", err)
+		return nil
+	}
+	if r == nil {
+		return nil
+	}
+	return r.Restarting
+}
+
+// pindexRestartInFlight returns true if a restarted pindex is still
+// warming up.
+func (mgr *Manager) pindexRestartInFlight(pindexName string) bool {
+	return pindexName != "" && mgr.GetPIndex(pindexName) != nil &&
+		!mgr.IsPIndexWarm(pindexName)
+}
+
+// restartPeersHealthy returns true if the replicas of a plan pindex on
+// the other nodes are alive and not being restarted.
+func (mgr *Manager) restartPeersHealthy(planPIndex *PlanPIndex,
+	restarting map[string]string) bool {
+	for nodeUUID := range planPIndex.Nodes {
+		if nodeUUID == mgr.uuid {
+			continue
+		}
+		if !mgr.IsNodeAlive(nodeUUID) ||
+			restarting[nodeUUID] == planPIndex.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// PIndexRestartable returns true if a pindex can adopt a plan pindex
+// via a restart, where the plan pindex is for the same index and
+// source partitions, with only a different name, index UUID or index
+// params, and the pindex implementation type allows a restart for
+// the index params update.
+func PIndexRestartable(pindex *PIndex, planPIndex *PlanPIndex) bool {
+	if pindex.IndexType != planPIndex.IndexType ||
+		pindex.IndexName != planPIndex.IndexName ||
+		pindex.SourceType != planPIndex.SourceType ||
+		pindex.SourceName != planPIndex.SourceName ||
+		pindex.SourceUUID != planPIndex.SourceUUID ||
+		!sameSourceParams(pindex.SourceParams, planPIndex.SourceParams) ||
+		pindex.SourcePartitions != planPIndex.SourcePartitions {
+		return false
+	}
+
+	t, exists := PIndexImplTypes[pindex.IndexType]
+	if !exists || t == nil ||
+		t.OpenUsing == nil || t.AnalyzeIndexParamsUpdate == nil {
+		return false
+	}
+
+	return t.AnalyzeIndexParamsUpdate(pindex.IndexType,
+		pindex.IndexParams, planPIndex.IndexParams) == PINDEXES_RESTART
+}
+
+// sameSourceParams returns true if both source params are the same,
+// where empty source params might have been round-tripped through the
+// nested IndexDef JSON format as "{}" or "null".
+func sameSourceParams(a, b string) bool {
+	empty := func(s string) bool {
+		return s == "" || s == "{}" || s == "null"
+	}
+	return a == b || (empty(a) && empty(b))
+}
+
+// restartRank returns the position of this node among the nodes of a
+// plan pindex, ordered by node UUID.
+func (mgr *Manager) restartRank(planPIndex *PlanPIndex) int {
+	nodeUUIDs := make([]string, 0, len(planPIndex.Nodes))
+	for nodeUUID := range planPIndex.Nodes {
+		nodeUUIDs = append(nodeUUIDs, nodeUUID)
+	}
+	sort.Strings(nodeUUIDs)
+
+	for i, nodeUUID := range nodeUUIDs {
+		if nodeUUID == mgr.uuid {
+			return i
+		}
+	}
+	return 0
+}
+
+// A pindexRestart pairs a local pindex with the updated plan pindex
+// that the pindex is restarted as.
+type pindexRestart struct {
+	pindex     *PIndex
+	planPIndex *PlanPIndex
+}
+
+// filterPIndexRestarts takes the pairs of pindexes to add and remove
+// where the pindex to remove can be restarted as the plan pindex to
+// add instead (see PIndexRestartable()) out of the janitor's adds and
+// removes.  At most one restart is returned, whose staggered wait is
+// over and whose peer replicas are healthy, and only when this node
+// has no other restart in flight.
+func (mgr *Manager) filterPIndexRestarts(addPlanPIndexes []*PlanPIndex,
+	removePIndexes []*PIndex) (
+	adds []*PlanPIndex, removes []*PIndex, restarts []*pindexRestart) {
+	removingByIndex := map[string][]*PIndex{}
+	for _, removePIndex := range removePIndexes {
+		removingByIndex[removePIndex.IndexName] =
+			append(removingByIndex[removePIndex.IndexName], removePIndex)
+	}
+
+	stagger := mgr.optionDuration("rollingRestartStagger")
+	if stagger <= 0 {
+		stagger = ROLLING_RESTART_STAGGER
+	}
+
+	mgr.m.Lock()
+	pendingPrev := mgr.pindexRestartsPending
+	mgr.m.Unlock()
+
+	restarting := mgr.pindexRestarting()
+	inFlight := mgr.pindexRestartInFlight(restarting[mgr.uuid])
+	waiting := false
+
+	now := time.Now()
+	pending := map[string]time.Time{}
+	paired := map[*PIndex]bool{}
+
+	for _, addPlanPIndex := range addPlanPIndexes {
+		var removePIndex *PIndex
+		for _, p := range removingByIndex[addPlanPIndex.IndexName] {
+			if !paired[p] && PIndexRestartable(p, addPlanPIndex) {
+				removePIndex = p
+				break
+			}
+		}
+		if removePIndex == nil {
+			adds = append(adds, addPlanPIndex)
+			continue
+		}
+
+		paired[removePIndex] = true
+
+		since, exists := pendingPrev[addPlanPIndex.Name]
+		if !exists {
+			since = now
+		}
+		pending[addPlanPIndex.Name] = since
+
+		wait := time.Duration(mgr.restartRank(addPlanPIndex))*stagger -
+			now.Sub(since)
+		if wait > 0 {
+			if !exists {
+				time.AfterFunc(wait, func() {
+					mgr.JanitorKick("rolling restart")
+				})
+			}
+			continue
+		}
+
+		if inFlight || !mgr.restartPeersHealthy(addPlanPIndex, restarting) {
+			waiting = true
+			continue
+		}
+
+		restarts = append(restarts, &pindexRestart{
+			pindex:     removePIndex,
+			planPIndex: addPlanPIndex,
+		})
+	}
+
+	sort.Sort(pindexRestartsByName(restarts))
+
+	if len(restarts) > 1 {
+		restarts = restarts[:1]
+		waiting = true
+	}
+
+	for _, removePIndex := range removePIndexes {
+		if !paired[removePIndex] {
+			removes = append(removes, removePIndex)
+		}
+	}
+
+	mgr.m.Lock()
+	mgr.pindexRestartsPending = pending
+	mgr.m.Unlock()
+
+	if waiting {
+		mgr.retryPIndexRestarts()
+	}
+
+	return adds, removes, restarts
+}
+
+// retryPIndexRestarts kicks the janitor later to recheck the waiting
+// restarts.
+func (mgr *Manager) retryPIndexRestarts() {
+	mgr.m.Lock()
+	retrying := mgr.pindexRestartsRetrying
+	mgr.pindexRestartsRetrying = true
+	mgr.m.Unlock()
+
+	if !retrying {
+		time.AfterFunc(PINDEX_RESTARTS_RETRY, func() {
+			mgr.m.Lock()
+			mgr.pindexRestartsRetrying = false
+			mgr.m.Unlock()
+
+			mgr.JanitorKick("rolling restart")
+		})
+	}
+}
+
+// claimPIndexRestart records in the Cfg that this node is restarting
+// a pindex as a plan pindex, returning false if a peer replica
+// started restarting meanwhile.
+func (mgr *Manager) claimPIndexRestart(planPIndex *PlanPIndex) (
+	bool, error) {
+	if mgr.cfg == nil { // Can occur during testing.
+		return true, nil
+	}
+
+	claimed := false
+
+	err := mgr.cfgUpdatePIndexRestarts(func(r *PIndexRestarts) bool {
+		claimed = mgr.restartPeersHealthy(planPIndex, r.Restarting)
+		if !claimed {
+			return false
+		}
+		r.Restarting[mgr.uuid] = planPIndex.Name
+		return true
+	})
+
+	return claimed, err
+}
+
+// ackPIndexRestart clears this node's restart from the Cfg once the
+// restarted pindex is warm, or is gone, such as after a failed
+// restart.  While the restarted pindex is warming up, the janitor is
+// kicked again later.
+func (mgr *Manager) ackPIndexRestart() {
+	pindexName := mgr.pindexRestarting()[mgr.uuid]
+	if pindexName == "" {
+		return
+	}
+
+	if mgr.pindexRestartInFlight(pindexName) {
+		mgr.retryPIndexRestarts()
+		return
+	}
+
+	err := mgr.cfgUpdatePIndexRestarts(func(r *PIndexRestarts) bool {
+		if r.Restarting[mgr.uuid] != pindexName {
+			return false
+		}
+		delete(r.Restarting, mgr.uuid)
+		return true
+	})
+	if err != nil {
+		log.Printf("janitor: ackPIndexRestart, err: %v", err)
+	}
+}
+
+// PIndexRestartsPending returns the names of the plan pindexes that
+// local pindexes are waiting to be restarted as, sorted.
+func (mgr *Manager) PIndexRestartsPending() []string {
+	mgr.m.Lock()
+	rv := make([]string, 0, len(mgr.pindexRestartsPending))
+	for pindexName := range mgr.pindexRestartsPending {
+		rv = append(rv, pindexName)
+	}
+	mgr.m.Unlock()
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// restartPIndexUsing closes a pindex, keeping its files, which are
+// moved to the path of its updated plan pindex, and reopens it with
+// the updated plan pindex's name and index params.  If the reopen
+// fails, the pindex stays closed, so that a later janitor pass
+// rebuilds it.
+func (mgr *Manager) restartPIndexUsing(r *pindexRestart) error {
+	claimed, err := mgr.claimPIndexRestart(r.planPIndex)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotPIndexRestartErr, 1)
+		return err
+	}
+	if !claimed {
+		log.Printf("janitor: restart of pindex: %s, waiting for peers",
+			r.pindex.Name)
+		mgr.retryPIndexRestarts()
+		return nil
+	}
+
+	mgr.m.Lock()
+	delete(mgr.pindexRestartsPending, r.planPIndex.Name)
+	mgr.m.Unlock()
+
+	err = mgr.restartPIndexUsingErr(r)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotPIndexRestartErr, 1)
+		return err
+	}
+
+	atomic.AddUint64(&mgr.stats.TotPIndexRestart, 1)
+
+	return nil
+}
+
+func (mgr *Manager) restartPIndexUsingErr(r *pindexRestart) error {
+	err := mgr.stopPIndex(r.pindex, false)
+	if err != nil {
+		return err
+	}
+
+	path := mgr.PIndexPath(r.planPIndex.Name)
+	if path != r.pindex.Path {
+		err = mgr.mkPIndexParentDir(path)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(r.pindex.Path, path)
+		if err != nil {
+			return fmt.Errorf("janitor: restart rename, from: %s, to: %s,"+
+				" err: %v", r.pindex.Path, path, err)
+		}
+	}
+
+	restarted, err := OpenPIndexUsing(mgr, path, r.planPIndex)
+	if err != nil {
+		return fmt.Errorf("janitor: OpenPIndexUsing, name: %s, err: %v",
+			r.planPIndex.Name, err)
+	}
+
+	err = mgr.registerPIndex(restarted)
+	if err != nil {
+		restarted.Close(false)
+		return err
+	}
+
+	log.Printf("janitor: restarted pindex: %s, as: %s",
+		r.pindex.Name, restarted.Name)
+
+	mgr.emitPIndexEvent(MANAGER_EVENT_PINDEX_OPENED, restarted)
+
+	return nil
+}
+
+type pindexRestartsByName []*pindexRestart
+
+func (a pindexRestartsByName) Len() int {
+	return len(a)
+}
+
+func (a pindexRestartsByName) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a pindexRestartsByName) Less(i, j int) bool {
+	return a[i].planPIndex.Name < a[j].planPIndex.Name
+}
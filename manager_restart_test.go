@@ -0,0 +1,240 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func setBlackHoleRestartable(restartable bool) {
+	blackhole := PIndexImplTypes["blackhole"]
+	if !restartable {
+		blackhole.OpenUsing = nil
+		blackhole.AnalyzeIndexParamsUpdate = nil
+		return
+	}
+	blackhole.OpenUsing = func(indexType, path, indexParams string,
+		restart func()) (PIndexImpl, Dest, error) {
+		return OpenBlackHolePIndexImpl(indexType, path, restart)
+	}
+	blackhole.AnalyzeIndexParamsUpdate = func(indexType,
+		prevIndexParams, nextIndexParams string) string {
+		return PINDEXES_RESTART
+	}
+}
+
+func TestPIndexRestartable(t *testing.T) {
+	pindex := &PIndex{
+		Name:             "foo_1_0",
+		IndexType:        "blackhole",
+		IndexName:        "foo",
+		IndexUUID:        "1",
+		SourcePartitions: "0",
+	}
+	planPIndex := &PlanPIndex{
+		Name:             "foo_2_0",
+		IndexType:        "blackhole",
+		IndexName:        "foo",
+		IndexUUID:        "2",
+		IndexParams:      `{"x":1}`,
+		SourcePartitions: "0",
+	}
+
+	if PIndexRestartable(pindex, planPIndex) {
+		t.Errorf("expected not restartable without OpenUsing")
+	}
+
+	setBlackHoleRestartable(true)
+	defer setBlackHoleRestartable(false)
+
+	if !PIndexRestartable(pindex, planPIndex) {
+		t.Errorf("expected restartable")
+	}
+
+	planPIndex.SourcePartitions = "1"
+	if PIndexRestartable(pindex, planPIndex) {
+		t.Errorf("expected not restartable for other source partitions")
+	}
+}
+
+func TestFilterPIndexRestartsStagger(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	setBlackHoleRestartable(true)
+	defer setBlackHoleRestartable(false)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	m.SetOptions(map[string]string{"rollingRestartStagger": "1h"})
+
+	pindex := &PIndex{
+		Name:             "foo_1_0",
+		IndexType:        "blackhole",
+		IndexName:        "foo",
+		SourcePartitions: "0",
+	}
+	planPIndex := &PlanPIndex{
+		Name:             "foo_2_0",
+		IndexType:        "blackhole",
+		IndexName:        "foo",
+		SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{
+			"":     {CanRead: true, CanWrite: true},
+			m.uuid: {CanRead: true, CanWrite: true},
+		},
+	}
+
+	adds, removes, restarts := m.filterPIndexRestarts(
+		[]*PlanPIndex{planPIndex}, []*PIndex{pindex})
+	if len(adds) != 0 || len(removes) != 0 || len(restarts) != 0 {
+		t.Errorf("expected a staggered, pending restart, got: %v, %v, %v",
+			adds, removes, restarts)
+	}
+	pending := m.PIndexRestartsPending()
+	if len(pending) != 1 || pending[0] != "foo_2_0" {
+		t.Errorf("expected pending restart, got: %v", pending)
+	}
+
+	delete(planPIndex.Nodes, "")
+
+	adds, removes, restarts = m.filterPIndexRestarts(
+		[]*PlanPIndex{planPIndex}, []*PIndex{pindex})
+	if len(adds) != 0 || len(removes) != 0 || len(restarts) != 1 ||
+		restarts[0].pindex != pindex || restarts[0].planPIndex != planPIndex {
+		t.Errorf("expected a restart, got: %v, %v, %v",
+			adds, removes, restarts)
+	}
+}
+
+func TestFilterPIndexRestartsOneAtATime(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	setBlackHoleRestartable(true)
+	defer setBlackHoleRestartable(false)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	var pindexes []*PIndex
+	var planPIndexes []*PlanPIndex
+	for _, partition := range []string{"0", "1"} {
+		pindexes = append(pindexes, &PIndex{
+			Name:             "foo_1_" + partition,
+			IndexType:        "blackhole",
+			IndexName:        "foo",
+			SourcePartitions: partition,
+		})
+		planPIndexes = append(planPIndexes, &PlanPIndex{
+			Name:             "foo_2_" + partition,
+			IndexType:        "blackhole",
+			IndexName:        "foo",
+			SourcePartitions: partition,
+			Nodes: map[string]*PlanPIndexNode{
+				m.uuid: {CanRead: true, CanWrite: true},
+				"zzzz": {CanRead: true, CanWrite: true},
+			},
+		})
+	}
+
+	_, _, restarts := m.filterPIndexRestarts(planPIndexes, pindexes)
+	if len(restarts) != 1 || restarts[0].planPIndex.Name != "foo_2_0" {
+		t.Fatalf("expected one restart, got: %v", restarts)
+	}
+
+	// A peer replica that's restarting holds off the restart.
+	err := m.cfgUpdatePIndexRestarts(func(r *PIndexRestarts) bool {
+		r.Restarting["zzzz"] = "foo_2_0"
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expected cfgUpdatePIndexRestarts() to work, err: %v", err)
+	}
+
+	_, _, restarts = m.filterPIndexRestarts(planPIndexes, pindexes)
+	if len(restarts) != 1 || restarts[0].planPIndex.Name != "foo_2_1" {
+		t.Errorf("expected the other restart, got: %v", restarts)
+	}
+
+	claimed, err := m.claimPIndexRestart(planPIndexes[0])
+	if err != nil || claimed {
+		t.Errorf("expected no claim, got: %v, err: %v", claimed, err)
+	}
+
+	claimed, err = m.claimPIndexRestart(planPIndexes[1])
+	if err != nil || !claimed {
+		t.Errorf("expected a claim, got: %v, err: %v", claimed, err)
+	}
+	if m.pindexRestarting()[m.uuid] != "foo_2_1" {
+		t.Errorf("expected restarting, got: %v", m.pindexRestarting())
+	}
+
+	// The claimed restart isn't a local pindex, such as after a
+	// failed restart, so it's cleared.
+	m.ackPIndexRestart()
+	if _, exists := m.pindexRestarting()[m.uuid]; exists {
+		t.Errorf("expected cleared restart, got: %v", m.pindexRestarting())
+	}
+}
+
+func TestRollingRestart(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	setBlackHoleRestartable(true)
+	defer setBlackHoleRestartable(false)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexBefore := m.GetPIndex(m.LocalPIndexNamesForIndex("foo")[0])
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", `{"x":1}`, PlanParams{}, "*"); err != nil {
+		t.Errorf("expected CreateIndex() update to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexNames := m.LocalPIndexNamesForIndex("foo")
+	if len(pindexNames) != 1 || pindexNames[0] == pindexBefore.Name {
+		t.Fatalf("expected a renamed pindex, got: %v", pindexNames)
+	}
+
+	pindexAfter := m.GetPIndex(pindexNames[0])
+	if pindexAfter.IndexParams != `{"x":1}` ||
+		pindexAfter.UUID != pindexBefore.UUID ||
+		pindexAfter.Path != m.PIndexPath(pindexAfter.Name) {
+		t.Errorf("expected restarted pindex, got: %#v", pindexAfter)
+	}
+	if _, err := os.Stat(pindexBefore.Path); !os.IsNotExist(err) {
+		t.Errorf("expected old pindex path to be moved, err: %v", err)
+	}
+	if m.stats.TotPIndexRestart != 1 || m.stats.TotPIndexRestartErr != 0 {
+		t.Errorf("expected 1 restart, got: %d, errs: %d",
+			m.stats.TotPIndexRestart, m.stats.TotPIndexRestartErr)
+	}
+}
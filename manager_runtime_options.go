@@ -0,0 +1,237 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// Runtime options are a safe subset of the manager options that can
+// be changed while nodes are running.  They're kept in the Cfg, so
+// they apply to the whole cluster and survive restarts, and every
+// node overlays them onto its own manager options as they change.
+// The runtime options are all read by the manager whenever they're
+// used, so changes take effect without a restart, although the feed
+// options only take effect as feeds are (re-)started.
+
+// MANAGER_OPTIONS_KEY is the key used for Cfg access of the
+// RuntimeOptions.
+const MANAGER_OPTIONS_KEY = "managerOptions"
+
+// RuntimeOptionValidators are the manager options that may be changed
+// at runtime, keyed by option name, with a validator of an option's
+// value.  Applications may register more options, but only during the
+// init()'ialization phase of process startup.
+var RuntimeOptionValidators = map[string]func(v string) error{
+	"memoryQuota":             validateUintOption,
+	"memoryThrottleMaxWait":   validateDurationOption,
+	"diskFreeWatermarkBytes":  validateUintOption,
+	"feedBackpressureMaxLag":  validateUintOption,
+	"feedBackpressureMaxWait": validateDurationOption,
+	"destBatchSize":           validateUintOption,
+	"destBatchFlushInterval":  validateDurationOption,
+	"pindexWarmupMaxLag":      validateUintOption,
+	"pindexBuildTimeout":      validateDurationOption,
+	"stalenessSourceSeqsTTL":  validateDurationOption,
+	"orphanRetention":         validateDurationOption,
+	"rollingRestartStagger":   validateDurationOption,
+	"planRolloutWavePercent": func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= 100 {
+			return fmt.Errorf("must be a percent from 0 to 99")
+		}
+		return nil
+	},
+}
+
+func validateUintOption(v string) error {
+	_, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("must be a non-negative integer")
+	}
+	return nil
+}
+
+func validateDurationOption(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return fmt.Errorf("must be a non-negative duration, like \"10s\"")
+	}
+	return nil
+}
+
+// RuntimeOptions represents the runtime manager options of a cluster.
+type RuntimeOptions struct {
+	Options     map[string]string `json:"options"`
+	ImplVersion string            `json:"implVersion"`
+}
+
+// ValidateRuntimeOptions checks that the options may be changed at
+// runtime and that their values are valid, where an empty value,
+// which resets an option, is always valid.
+func ValidateRuntimeOptions(options map[string]string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		validator := RuntimeOptionValidators[name]
+		if validator == nil {
+			return fmt.Errorf("manager_runtime_options: option cannot be"+
+				" changed at runtime, name: %s", name)
+		}
+		if options[name] == "" {
+			continue
+		}
+		err := validator(options[name])
+		if err != nil {
+			return fmt.Errorf("manager_runtime_options: invalid option,"+
+				" name: %s, value: %q, err: %v", name, options[name], err)
+		}
+	}
+
+	return nil
+}
+
+// CfgGetRuntimeOptions retrieves the RuntimeOptions from a Cfg
+// provider.
+func CfgGetRuntimeOptions(cfg Cfg) (*RuntimeOptions, uint64, error) {
+	v, cas, err := cfg.Get(MANAGER_OPTIONS_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &RuntimeOptions{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// SetRuntimeOptions validates and merges options into the runtime
+// options of the cluster, where an empty value removes an option so
+// that nodes revert to their own value of the option.  The merged
+// runtime options are applied to this node right away, and to the
+// other nodes as they see the Cfg change.
+func (mgr *Manager) SetRuntimeOptions(
+	options map[string]string) (map[string]string, error) {
+	err := ValidateRuntimeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged map[string]string
+
+	_, err = CfgSetRetry(mgr.cfg, MANAGER_OPTIONS_KEY,
+		CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			ro := &RuntimeOptions{}
+			if val != nil {
+				err := json.Unmarshal(val, ro)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			merged = map[string]string{}
+			for name, v := range ro.Options {
+				merged[name] = v
+			}
+			for name, v := range options {
+				if v == "" {
+					delete(merged, name)
+				} else {
+					merged[name] = v
+				}
+			}
+
+			return json.Marshal(&RuntimeOptions{
+				Options:     merged,
+				ImplVersion: mgr.version,
+			})
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.applyRuntimeOptions(merged)
+
+	return merged, nil
+}
+
+// LoadRuntimeOptions applies the runtime options from the Cfg to this
+// node.
+func (mgr *Manager) LoadRuntimeOptions() error {
+	if mgr.cfg == nil { // Can occur during testing.
+		return nil
+	}
+
+	ro, _, err := CfgGetRuntimeOptions(mgr.cfg)
+	if err != nil {
+		return err
+	}
+
+	var options map[string]string
+	if ro != nil {
+		options = ro.Options
+	}
+
+	mgr.applyRuntimeOptions(options)
+
+	return nil
+}
+
+// applyRuntimeOptions overlays the runtime options onto the node's
+// own manager options, so that an option that's no longer a runtime
+// option reverts to the node's own value.
+func (mgr *Manager) applyRuntimeOptions(runtimeOptions map[string]string) {
+	mgr.m.Lock()
+	mgr.runtimeOptions = runtimeOptions
+	mgr.overlayRuntimeOptionsLOCKED()
+	mgr.m.Unlock()
+}
+
+// overlayRuntimeOptionsLOCKED recomputes the manager options from the
+// node's own options and the runtime options.  Invalid values, like
+// from a node of another version, are skipped.
+func (mgr *Manager) overlayRuntimeOptionsLOCKED() {
+	options := make(map[string]string, len(mgr.optionsBase))
+	for name, v := range mgr.optionsBase {
+		options[name] = v
+	}
+
+	for name, validator := range RuntimeOptionValidators {
+		v, exists := mgr.runtimeOptions[name]
+		if !exists || v == "" {
+			continue
+		}
+		err := validator(v)
+		if err != nil {
+			log.Printf("manager_runtime_options: skipping invalid option,"+
+				" name: %s, value: %q, err: %v", name, v, err)
+			continue
+		}
+		options[name] = v
+	}
+
+	mgr.options = options
+	atomic.AddUint64(&mgr.stats.TotSetOptions, 1)
+}
@@ -0,0 +1,134 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidateRuntimeOptions(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		ok      bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"memoryQuota": "100"}, true},
+		{map[string]string{"memoryQuota": ""}, true},
+		{map[string]string{"feedBackpressureMaxWait": "5s"}, true},
+		{map[string]string{"planRolloutWavePercent": "25"}, true},
+		{map[string]string{"memoryQuota": "-1"}, false},
+		{map[string]string{"feedBackpressureMaxWait": "5"}, false},
+		{map[string]string{"planRolloutWavePercent": "100"}, false},
+		{map[string]string{"dataDir": "/tmp"}, false},
+	}
+
+	for i, test := range tests {
+		err := ValidateRuntimeOptions(test.options)
+		if (err == nil) != test.ok {
+			t.Errorf("test: %d, options: %v, expected ok: %v, err: %v",
+				i, test.options, test.ok, err)
+		}
+	}
+}
+
+func TestManagerRuntimeOptions(t *testing.T) {
+	emptyDir0, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir0)
+	emptyDir1, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir1)
+
+	cfg := NewCfgMem()
+
+	m0 := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir0, "some-datasource", nil, map[string]string{
+			"memoryQuota": "10",
+		})
+	if err := m0.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m0.Stop()
+
+	m1 := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1001",
+		emptyDir1, "some-datasource", nil)
+	if err := m1.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m1.Stop()
+
+	_, err := m0.SetRuntimeOptions(map[string]string{"dataDir": "/tmp"})
+	if err == nil {
+		t.Errorf("expected an error for a non-runtime option")
+	}
+
+	merged, err := m0.SetRuntimeOptions(map[string]string{
+		"memoryQuota":   "20",
+		"destBatchSize": "50",
+	})
+	if err != nil || merged["memoryQuota"] != "20" ||
+		merged["destBatchSize"] != "50" {
+		t.Fatalf("expected SetRuntimeOptions() to work, got: %v, err: %v",
+			merged, err)
+	}
+
+	if m0.Options()["memoryQuota"] != "20" {
+		t.Errorf("expected the options applied right away, got: %v",
+			m0.Options())
+	}
+
+	// Other nodes apply the options as they see the Cfg change.
+	waitOption := func(m *Manager, name, expected string) {
+		for i := 0; i < 500 && m.Options()[name] != expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if m.Options()[name] != expected {
+			t.Errorf("expected option: %s, value: %q, got: %q",
+				name, expected, m.Options()[name])
+		}
+	}
+
+	waitOption(m1, "memoryQuota", "20")
+	waitOption(m1, "destBatchSize", "50")
+
+	// Removed options revert to each node's own value.
+	_, err = m0.SetRuntimeOptions(map[string]string{"memoryQuota": ""})
+	if err != nil {
+		t.Errorf("expected SetRuntimeOptions() to work, err: %v", err)
+	}
+
+	waitOption(m0, "memoryQuota", "10")
+	waitOption(m1, "memoryQuota", "")
+	waitOption(m1, "destBatchSize", "50")
+
+	// Changing a node's own options keeps the runtime options.
+	m1.SetOptions(map[string]string{"destBatchSize": "5", "foo": "bar"})
+	if m1.Options()["destBatchSize"] != "50" || m1.Options()["foo"] != "bar" {
+		t.Errorf("expected runtime options kept, got: %v", m1.Options())
+	}
+	if m1.BaseOptions()["destBatchSize"] != "5" {
+		t.Errorf("expected own options, got: %v", m1.BaseOptions())
+	}
+
+	// A restarted node loads the options from the Cfg.
+	m2 := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1002",
+		emptyDir1, "some-datasource", nil)
+	if err := m2.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m2.Stop()
+
+	if m2.Options()["destBatchSize"] != "50" {
+		t.Errorf("expected runtime options on start, got: %v", m2.Options())
+	}
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// BeginQuery should be invoked before a query is processed by this
+// node, and returns false if the manager is shutting down, in which
+// case the query should be rejected.  A true result must be followed
+// by a call to EndQuery() when the query is done.
+func (mgr *Manager) BeginQuery() bool {
+	mgr.m.Lock()
+	if mgr.shuttingDown {
+		mgr.m.Unlock()
+		atomic.AddUint64(&mgr.stats.TotQueryRejected, 1)
+		return false
+	}
+	mgr.queriesInFlight++
+	mgr.m.Unlock()
+	return true
+}
+
+// EndQuery marks the end of a query started with BeginQuery().
+func (mgr *Manager) EndQuery() {
+	mgr.m.Lock()
+	mgr.queriesInFlight--
+	if mgr.queriesInFlight <= 0 && mgr.queriesDoneCh != nil {
+		close(mgr.queriesDoneCh)
+		mgr.queriesDoneCh = nil
+	}
+	mgr.m.Unlock()
+}
+
+// ShuttingDown returns true once Shutdown() has been invoked.
+func (mgr *Manager) ShuttingDown() bool {
+	mgr.m.Lock()
+	rv := mgr.shuttingDown
+	mgr.m.Unlock()
+	return rv
+}
+
+// Shutdown gracefully stops a Manager.  See ShutdownEx().
+func (mgr *Manager) Shutdown(ctx context.Context) error {
+	return mgr.ShutdownEx(ctx, false)
+}
+
+// ShutdownEx gracefully stops a Manager.  New queries are rejected
+// immediately, while in-flight queries are allowed to finish until
+// the ctx is done.  If unregister is true, the node is also removed
+// from the wanted nodes, so that planners will reassign its pindexes
+// to other nodes.  Then the planner and janitor are stopped, and the
+// feeds and pindexes are closed, without removing any pindex files.
+// If the ctx was done before the in-flight queries finished, the
+// shutdown still completes, but ctx.Err() is returned.
+func (mgr *Manager) ShutdownEx(ctx context.Context, unregister bool) error {
+	mgr.m.Lock()
+	if mgr.shuttingDown {
+		mgr.m.Unlock()
+		return fmt.Errorf("manager_shutdown: already shutting down")
+	}
+	mgr.shuttingDown = true
+
+	var queriesDoneCh chan struct{}
+	if mgr.queriesInFlight > 0 {
+		queriesDoneCh = make(chan struct{})
+		mgr.queriesDoneCh = queriesDoneCh
+	}
+	mgr.m.Unlock()
+
+	log.Printf("manager_shutdown: starting, unregister: %t", unregister)
+
+	if unregister {
+		err := mgr.RemoveNodeDef(NODE_DEFS_WANTED)
+		if err != nil {
+			log.Printf("manager_shutdown: could not unregister, err: %v", err)
+		}
+	}
+
+	var errCtx error
+
+	if queriesDoneCh != nil {
+		select {
+		case <-queriesDoneCh:
+		case <-ctx.Done():
+			errCtx = ctx.Err()
+			log.Printf("manager_shutdown: in-flight queries did not finish,"+
+				" err: %v", errCtx)
+		}
+	}
+
+	mgr.Stop()
+
+	feeds, pindexes := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		err := mgr.stopFeed(feed)
+		if err != nil {
+			log.Printf("manager_shutdown: stopFeed, name: %s, err: %v",
+				feed.Name(), err)
+		}
+	}
+	for _, pindex := range pindexes {
+		err := mgr.stopPIndex(pindex, false)
+		if err != nil {
+			log.Printf("manager_shutdown: stopPIndex, name: %s, err: %v",
+				pindex.Name, err)
+		}
+	}
+
+	log.Printf("manager_shutdown: done")
+
+	return errCtx
+}
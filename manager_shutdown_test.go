@@ -0,0 +1,106 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerShutdown(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if !m.BeginQuery() {
+		t.Errorf("expected BeginQuery to work before shutdown")
+	}
+
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- m.ShutdownEx(context.Background(), true)
+	}()
+
+	for !m.ShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	if m.BeginQuery() {
+		t.Errorf("expected BeginQuery to be rejected during shutdown")
+	}
+
+	select {
+	case <-doneCh:
+		t.Errorf("expected shutdown to wait for in-flight query")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	m.EndQuery()
+
+	err = <-doneCh
+	if err != nil {
+		t.Errorf("expected shutdown to work, err: %v", err)
+	}
+
+	nd, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if err != nil || nd.NodeDefs[m.uuid] != nil {
+		t.Errorf("expected mgr to be unregistered, err: %v", err)
+	}
+	nd, _, err = CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil || nd.NodeDefs[m.uuid] == nil {
+		t.Errorf("expected mgr to still be known, err: %v", err)
+	}
+
+	if m.Shutdown(context.Background()) == nil {
+		t.Errorf("expected err on repeated shutdown")
+	}
+	m.Stop()
+}
+
+func TestManagerShutdownTimeout(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	m.BeginQuery()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	err = m.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, err: %v", err)
+	}
+
+	m.EndQuery()
+
+	nd, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	if err != nil || nd.NodeDefs[m.uuid] == nil {
+		t.Errorf("expected mgr to still be wanted, err: %v", err)
+	}
+}
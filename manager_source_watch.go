@@ -0,0 +1,215 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// A planner Manager can watch the data sources of the indexes, so
+// that topology changes of a data source are acted upon without
+// waiting for feed errors.  When the topology of a data source
+// changes, such as the server list or vbucket to server assignments
+// of a couchbase bucket after a rebalance or failover (see
+// DataSourceTopology()), the planner and janitor are kicked.  When a data source is missing, such as a deleted or
+// recreated bucket, the indexes of the data source are flagged as
+// broken (see SourceBrokenIndexes()).  Watching is controlled by the
+// manager option:
+//
+// * sourceWatchInterval - how often to check the data sources, like
+//   "30s"; watching is disabled when empty.
+
+// SourceWatchLoop is the main loop for watching data sources, and
+// exits when the manager is stopped.
+func (mgr *Manager) SourceWatchLoop() {
+	interval := mgr.optionDuration("sourceWatchInterval")
+	if interval <= 0 || mgr.cfg == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		err := mgr.SourceWatchOnce()
+		if err != nil {
+			log.Printf("source_watch: SourceWatchOnce, err: %v", err)
+		}
+	}
+}
+
+// SourceWatchOnce checks the topology of the data source of every
+// index once, comparing it to the topology seen by the previous
+// check.
+func (mgr *Manager) SourceWatchOnce() error {
+	atomic.AddUint64(&mgr.stats.TotSourceWatch, 1)
+
+	indexDefs, _, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotSourceWatchErr, 1)
+		return err
+	}
+
+	// Indexes that share a data source are checked together.
+	sourceIndexDefs := map[sourceWatchKey][]*IndexDef{}
+	if indexDefs != nil {
+		for _, indexDef := range indexDefs.IndexDefs {
+			k := newSourceWatchKey(indexDef)
+			sourceIndexDefs[k] = append(sourceIndexDefs[k], indexDef)
+		}
+	}
+
+	mgr.m.Lock()
+	sourceTopologyPrev := mgr.sourceTopology
+	mgr.m.Unlock()
+
+	sourceTopology := map[sourceWatchKey]string{}
+	sourceBroken := map[string]string{}
+
+	changed := false
+
+	for k, indexDefsForSource := range sourceIndexDefs {
+		// The watcher bypasses the partitions cache, as it's what
+		// notices stale cached partitions.
+		topology, err := DataSourceTopology(k.SourceType,
+			k.SourceName, k.SourceUUID, k.SourceParams,
+			mgr.server, mgr.Options())
+		if err != nil {
+			if !SourceMissingErr(err) {
+				// Possibly transient, so remember the previous
+				// topology and broken indexes, if any.
+				atomic.AddUint64(&mgr.stats.TotSourceWatchErr, 1)
+
+				log.Printf("source_watch: DataSourceTopology,"+
+					" sourceType: %s, sourceName: %s, err: %v",
+					k.SourceType, k.SourceName, err)
+
+				if prev, exists := sourceTopologyPrev[k]; exists {
+					sourceTopology[k] = prev
+				}
+				for _, indexDef := range indexDefsForSource {
+					if msg := mgr.sourceBrokenMsg(indexDef.Name); msg != "" {
+						sourceBroken[indexDef.Name] = msg
+					}
+				}
+				continue
+			}
+
+			InvalidateDataSourcePartitions(k.SourceType, k.SourceName)
+
+			for _, indexDef := range indexDefsForSource {
+				sourceBroken[indexDef.Name] = err.Error()
+
+				if mgr.sourceBrokenMsg(indexDef.Name) == "" {
+					atomic.AddUint64(&mgr.stats.TotSourceWatchMissing, 1)
+
+					mgr.EmitEvent(ManagerEvent{
+						Kind:      MANAGER_EVENT_SOURCE_MISSING,
+						IndexName: indexDef.Name,
+						Err:       err.Error(),
+					})
+				}
+			}
+			continue
+		}
+
+		sourceTopology[k] = topology
+
+		prev, exists := sourceTopologyPrev[k]
+		if !exists || prev == topology {
+			continue
+		}
+
+		changed = true
+
+		InvalidateDataSourcePartitions(k.SourceType, k.SourceName)
+
+		for _, indexDef := range indexDefsForSource {
+			mgr.EmitEvent(ManagerEvent{
+				Kind:      MANAGER_EVENT_SOURCE_CHANGED,
+				IndexName: indexDef.Name,
+			})
+		}
+	}
+
+	mgr.m.Lock()
+	mgr.sourceTopology = sourceTopology
+	mgr.sourceBroken = sourceBroken
+	mgr.m.Unlock()
+
+	if changed {
+		atomic.AddUint64(&mgr.stats.TotSourceWatchChanged, 1)
+
+		mgr.PlannerKick("source changed")
+		mgr.JanitorKick("source changed")
+	}
+
+	return nil
+}
+
+// A sourceWatchKey identifies the data source of an index.
+type sourceWatchKey struct {
+	SourceType   string
+	SourceName   string
+	SourceUUID   string
+	SourceParams string
+}
+
+func newSourceWatchKey(indexDef *IndexDef) sourceWatchKey {
+	return sourceWatchKey{
+		SourceType:   indexDef.SourceType,
+		SourceName:   indexDef.SourceName,
+		SourceUUID:   indexDef.SourceUUID,
+		SourceParams: indexDef.SourceParams,
+	}
+}
+
+func (mgr *Manager) sourceBrokenMsg(indexName string) string {
+	mgr.m.Lock()
+	msg := mgr.sourceBroken[indexName]
+	mgr.m.Unlock()
+	return msg
+}
+
+// SourceBrokenIndexes returns a copy of the indexes whose data
+// sources were seen as missing by the latest SourceWatchOnce(), where
+// the value is the error message, keyed by index name.
+func (mgr *Manager) SourceBrokenIndexes() map[string]string {
+	mgr.m.Lock()
+	rv := make(map[string]string, len(mgr.sourceBroken))
+	for indexName, msg := range mgr.sourceBroken {
+		rv[indexName] = msg
+	}
+	mgr.m.Unlock()
+	return rv
+}
+
+// SourceMissingErr returns true if an error from a data source means
+// that the data source does not exist anymore, as opposed to, for
+// example, a connection failure.
+func SourceMissingErr(err error) bool {
+	if _, ok := err.(*couchbase.BucketNotFoundError); ok {
+		return true
+	}
+	return err == ErrCouchbaseMismatchedBucketUUID
+}
@@ -0,0 +1,196 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+var testSourceWatchM sync.Mutex
+var testSourceWatchPartitions = []string{"0", "1"}
+var testSourceWatchErr error
+var testSourceWatchTopology = "a"
+
+func init() {
+	RegisterFeedType("testSourceWatch", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			testSourceWatchM.Lock()
+			defer testSourceWatchM.Unlock()
+			return testSourceWatchPartitions, testSourceWatchErr
+		},
+	})
+	RegisterFeedType("testSourceWatchTopology", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			return []string{"0", "1"}, nil
+		},
+		Topology: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) (string, error) {
+			testSourceWatchM.Lock()
+			defer testSourceWatchM.Unlock()
+			return testSourceWatchTopology, nil
+		},
+	})
+}
+
+// testSourceWatchEvent returns the first already emitted event of a
+// kind, skipping other kinds of events, such as from the planner.
+func testSourceWatchEvent(eventCh chan ManagerEvent,
+	kind string) *ManagerEvent {
+	for {
+		select {
+		case event := <-eventCh:
+			if event.Kind == kind {
+				return &event
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func TestManagerSourceWatch(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"planner"},
+		"", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	err = m.CreateIndex("testSourceWatch", "src", "", "",
+		"blackhole", "idx", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	eventCh := make(chan ManagerEvent, 10)
+	m.SubscribeEvents(eventCh)
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+	if m.stats.TotSourceWatchChanged != 0 {
+		t.Errorf("expected no change on first watch")
+	}
+
+	testSourceWatchM.Lock()
+	testSourceWatchPartitions = []string{"0", "1", "2"}
+	testSourceWatchM.Unlock()
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+	if m.stats.TotSourceWatchChanged != 1 {
+		t.Errorf("expected a change after partitions changed")
+	}
+	event := testSourceWatchEvent(eventCh, MANAGER_EVENT_SOURCE_CHANGED)
+	if event == nil || event.IndexName != "idx" {
+		t.Errorf("expected sourceChanged event, got: %#v", event)
+	}
+
+	testSourceWatchM.Lock()
+	testSourceWatchErr = ErrCouchbaseMismatchedBucketUUID
+	testSourceWatchM.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if err = m.SourceWatchOnce(); err != nil {
+			t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+		}
+	}
+	if len(m.SourceBrokenIndexes()) != 1 ||
+		m.SourceBrokenIndexes()["idx"] == "" {
+		t.Errorf("expected broken idx, got: %#v", m.SourceBrokenIndexes())
+	}
+	if m.stats.TotSourceWatchMissing != 1 {
+		t.Errorf("expected one missing, got: %d",
+			m.stats.TotSourceWatchMissing)
+	}
+	if testSourceWatchEvent(eventCh, MANAGER_EVENT_SOURCE_MISSING) == nil {
+		t.Errorf("expected sourceMissing event")
+	}
+
+	testSourceWatchM.Lock()
+	testSourceWatchErr = nil
+	testSourceWatchM.Unlock()
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+	if len(m.SourceBrokenIndexes()) != 0 {
+		t.Errorf("expected no broken indexes, got: %#v",
+			m.SourceBrokenIndexes())
+	}
+
+	m.Stop()
+}
+
+func TestManagerSourceWatchTopology(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"planner"},
+		"", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	err = m.CreateIndex("testSourceWatchTopology", "src", "", "",
+		"blackhole", "idx", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+
+	// Same partitions, but moved to other servers.
+	testSourceWatchM.Lock()
+	testSourceWatchTopology = "b"
+	testSourceWatchM.Unlock()
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+	if m.stats.TotSourceWatchChanged != 1 {
+		t.Errorf("expected a change after the topology changed")
+	}
+
+	if err = m.SourceWatchOnce(); err != nil {
+		t.Errorf("expected SourceWatchOnce() to work, err: %v", err)
+	}
+	if m.stats.TotSourceWatchChanged != 1 {
+		t.Errorf("expected no change on an unchanged topology")
+	}
+
+	m.Stop()
+}
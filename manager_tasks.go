@@ -0,0 +1,238 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A task is a generic, possibly long running operation on an index,
+// like a compaction, merge or backup, that's run by the index's
+// pindex implementation type (see PIndexImplType.SubmitTaskRequest).
+// The statuses of tasks are tracked in the Cfg, so that any node can
+// report on a task that was submitted to another node.
+
+// TASKS_KEY is the key used for Cfg access of the
+// TaskRequestStatuses.
+const TASKS_KEY = "tasks"
+
+// MAX_TASKS is the max number of task statuses tracked in the Cfg,
+// beyond which the statuses of the oldest finished tasks are
+// dropped.
+var MAX_TASKS = 100
+
+const (
+	TASK_STATUS_SUBMITTED = "submitted"
+	TASK_STATUS_RUNNING   = "running"
+	TASK_STATUS_DONE      = "done"
+	TASK_STATUS_FAILED    = "failed"
+)
+
+// A TaskRequestStatus represents the status of a task on an index.
+type TaskRequestStatus struct {
+	TaskID     string          `json:"taskID"`
+	IndexName  string          `json:"indexName"`
+	IndexUUID  string          `json:"indexUUID"`
+	NodeUUID   string          `json:"nodeUUID"` // The node that ran the task.
+	Request    json.RawMessage `json:"request"`
+	Status     string          `json:"status"`
+	Total      int             `json:"total"`     // Like the number of pindexes.
+	Completed  int             `json:"completed"` // Out of the Total.
+	Err        string          `json:"err,omitempty"`
+	StartTime  time.Time       `json:"startTime"`
+	UpdateTime time.Time       `json:"updateTime"`
+}
+
+// Finished returns true if the task is done or has failed.
+func (s *TaskRequestStatus) Finished() bool {
+	return s.Status == TASK_STATUS_DONE || s.Status == TASK_STATUS_FAILED
+}
+
+// TaskRequestStatuses represents the statuses of the tasks of a
+// cluster, keyed by task ID.
+type TaskRequestStatuses struct {
+	Tasks       map[string]*TaskRequestStatus `json:"tasks"`
+	ImplVersion string                        `json:"implVersion"`
+}
+
+// CfgGetTaskRequestStatuses retrieves the TaskRequestStatuses from a
+// Cfg provider.
+func CfgGetTaskRequestStatuses(cfg Cfg) (*TaskRequestStatuses, uint64, error) {
+	v, cas, err := cfg.Get(TASKS_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &TaskRequestStatuses{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// cfgSetTaskRequestStatus adds or updates a task's status in the Cfg
+// with CAS retries, dropping the statuses of the oldest finished
+// tasks beyond MAX_TASKS.
+func cfgSetTaskRequestStatus(cfg Cfg, status *TaskRequestStatus,
+	version string) error {
+	_, err := CfgSetRetry(cfg, TASKS_KEY, CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			statuses := &TaskRequestStatuses{}
+			if val != nil {
+				err := json.Unmarshal(val, statuses)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if statuses.Tasks == nil {
+				statuses.Tasks = map[string]*TaskRequestStatus{}
+			}
+
+			statuses.Tasks[status.TaskID] = status
+			statuses.ImplVersion = version
+
+			if len(statuses.Tasks) > MAX_TASKS {
+				var finished []*TaskRequestStatus
+				for _, s := range statuses.Tasks {
+					if s.Finished() && s.TaskID != status.TaskID {
+						finished = append(finished, s)
+					}
+				}
+				sort.Sort(taskRequestStatusesByStartTime(finished))
+				for _, s := range finished {
+					if len(statuses.Tasks) <= MAX_TASKS {
+						break
+					}
+					delete(statuses.Tasks, s.TaskID)
+				}
+			}
+
+			return json.Marshal(statuses)
+		})
+
+	return err
+}
+
+// SubmitTask submits a task on an index to the index's pindex
+// implementation type, where the requestBody is a JSON object that
+// describes the task.  The task's status is tracked in the Cfg.
+func (mgr *Manager) SubmitTask(indexName string, requestBody []byte) (
+	*TaskRequestStatus, error) {
+	var request map[string]interface{}
+	err := json.Unmarshal(requestBody, &request)
+	if err != nil {
+		return nil, fmt.Errorf("manager_tasks: request is not a JSON object,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	indexDef, t, err := GetIndexDef(mgr.cfg, indexName)
+	if err != nil {
+		return nil, fmt.Errorf("manager_tasks: no index, indexName: %s,"+
+			" err: %v", indexName, err)
+	}
+	if indexDef == nil || t == nil {
+		return nil, fmt.Errorf("manager_tasks: no index, indexName: %s",
+			indexName)
+	}
+	if t.SubmitTaskRequest == nil {
+		return nil, fmt.Errorf("manager_tasks: tasks not supported,"+
+			" indexName: %s, indexType: %s", indexName, indexDef.Type)
+	}
+
+	now := time.Now()
+
+	status := &TaskRequestStatus{
+		TaskID:     NewUUID(),
+		IndexName:  indexName,
+		IndexUUID:  indexDef.UUID,
+		NodeUUID:   mgr.uuid,
+		Request:    json.RawMessage(requestBody),
+		Status:     TASK_STATUS_SUBMITTED,
+		StartTime:  now,
+		UpdateTime: now,
+	}
+
+	err = cfgSetTaskRequestStatus(mgr.cfg, status, mgr.version)
+	if err != nil {
+		return nil, fmt.Errorf("manager_tasks: could not save task status,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	atomic.AddUint64(&mgr.stats.TotTaskSubmit, 1)
+
+	rv, err := t.SubmitTaskRequest(mgr, indexName, indexDef.UUID,
+		status.TaskID, requestBody)
+	if err != nil {
+		atomic.AddUint64(&mgr.stats.TotTaskSubmitErr, 1)
+		status.Status = TASK_STATUS_FAILED
+		status.Err = err.Error()
+	} else {
+		status.Status = TASK_STATUS_RUNNING
+		if rv != nil {
+			if rv.Status != "" {
+				status.Status = rv.Status
+			}
+			status.Total = rv.Total
+			status.Completed = rv.Completed
+			status.Err = rv.Err
+		}
+	}
+
+	errUpdate := mgr.UpdateTaskRequestStatus(status)
+	if err != nil {
+		return status, fmt.Errorf("manager_tasks: SubmitTaskRequest,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	return status, errUpdate
+}
+
+// UpdateTaskRequestStatus saves the latest status of a task, such as
+// by a pindex implementation that's reporting the progress of a
+// running task.
+func (mgr *Manager) UpdateTaskRequestStatus(status *TaskRequestStatus) error {
+	status.UpdateTime = time.Now()
+
+	return cfgSetTaskRequestStatus(mgr.cfg, status, mgr.version)
+}
+
+// GetTaskRequestStatus returns the status of a task, or nil if the
+// task is unknown.
+func (mgr *Manager) GetTaskRequestStatus(taskID string) (
+	*TaskRequestStatus, error) {
+	statuses, _, err := CfgGetTaskRequestStatuses(mgr.cfg)
+	if err != nil || statuses == nil {
+		return nil, err
+	}
+	return statuses.Tasks[taskID], nil
+}
+
+type taskRequestStatusesByStartTime []*TaskRequestStatus
+
+func (a taskRequestStatusesByStartTime) Len() int {
+	return len(a)
+}
+
+func (a taskRequestStatusesByStartTime) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a taskRequestStatusesByStartTime) Less(i, j int) bool {
+	if a[i].StartTime.Equal(a[j].StartTime) {
+		return a[i].TaskID < a[j].TaskID
+	}
+	return a[i].StartTime.Before(a[j].StartTime)
+}
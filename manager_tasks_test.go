@@ -0,0 +1,116 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSubmitTask(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	if _, err := m.SubmitTask("foo", []byte(`{"kind":"compact"}`)); err == nil {
+		t.Errorf("expected err when the index type has no tasks")
+	}
+	if _, err := m.SubmitTask("foo", []byte(`not json`)); err == nil {
+		t.Errorf("expected err on a non-JSON request")
+	}
+	if _, err := m.SubmitTask("not-an-index", []byte(`{}`)); err == nil {
+		t.Errorf("expected err on a missing index")
+	}
+
+	blackhole := PIndexImplTypes["blackhole"]
+	blackhole.SubmitTaskRequest = func(mgr *Manager,
+		indexName, indexUUID, taskID string,
+		requestBody []byte) (*TaskRequestStatus, error) {
+		if string(requestBody) == `{"kind":"bad"}` {
+			return nil, fmt.Errorf("bad task")
+		}
+		return &TaskRequestStatus{Total: 2, Completed: 1}, nil
+	}
+	defer func() { blackhole.SubmitTaskRequest = nil }()
+
+	task, err := m.SubmitTask("foo", []byte(`{"kind":"compact"}`))
+	if err != nil || task.Status != TASK_STATUS_RUNNING ||
+		task.Total != 2 || task.Completed != 1 || task.NodeUUID != m.uuid {
+		t.Errorf("expected running task, got: %#v, err: %v", task, err)
+	}
+
+	task.Status = TASK_STATUS_DONE
+	task.Completed = 2
+	if err = m.UpdateTaskRequestStatus(task); err != nil {
+		t.Errorf("expected update to work, err: %v", err)
+	}
+
+	// Another node sees the task's status via the Cfg.
+	m2 := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1001",
+		emptyDir, "some-datasource", nil)
+	task2, err := m2.GetTaskRequestStatus(task.TaskID)
+	if err != nil || task2 == nil ||
+		task2.Status != TASK_STATUS_DONE || task2.Completed != 2 {
+		t.Errorf("expected done task, got: %#v, err: %v", task2, err)
+	}
+
+	task, err = m.SubmitTask("foo", []byte(`{"kind":"bad"}`))
+	if err == nil || task == nil || task.Status != TASK_STATUS_FAILED {
+		t.Errorf("expected failed task, got: %#v, err: %v", task, err)
+	}
+
+	task2, err = m.GetTaskRequestStatus("not-a-task")
+	if err != nil || task2 != nil {
+		t.Errorf("expected no task, got: %#v, err: %v", task2, err)
+	}
+}
+
+func TestTaskRequestStatusesMax(t *testing.T) {
+	cfg := NewCfgMem()
+
+	maxTasks := MAX_TASKS
+	MAX_TASKS = 2
+	defer func() { MAX_TASKS = maxTasks }()
+
+	for i := 0; i < 4; i++ {
+		status := &TaskRequestStatus{
+			TaskID: fmt.Sprintf("t%d", i),
+			Status: TASK_STATUS_DONE,
+		}
+		if i == 0 {
+			status.Status = TASK_STATUS_RUNNING
+		}
+		if err := cfgSetTaskRequestStatus(cfg, status, VERSION); err != nil {
+			t.Errorf("expected set to work, err: %v", err)
+		}
+	}
+
+	statuses, _, err := CfgGetTaskRequestStatuses(cfg)
+	if err != nil || len(statuses.Tasks) != 2 ||
+		statuses.Tasks["t0"] == nil || statuses.Tasks["t3"] == nil {
+		t.Errorf("expected running and latest tasks, got: %#v, err: %v",
+			statuses, err)
+	}
+}
@@ -740,6 +740,65 @@ func TestManagerRemovePIndex(t *testing.T) {
 	}
 }
 
+func TestManagerJanitorPlan(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", "",
+		emptyDir, "", nil)
+	if _, err := m.JanitorPlan(); err == nil {
+		t.Errorf("expected JanitorPlan() to fail on nil cfg")
+	}
+
+	cfg := NewCfgMem()
+	m = NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	janitorPlan, err := m.JanitorPlan()
+	if err != nil || len(janitorPlan.AddPIndexes) != 0 ||
+		len(janitorPlan.RemovePIndexes) != 0 ||
+		len(janitorPlan.AddFeeds) != 0 || len(janitorPlan.RemoveFeeds) != 0 {
+		t.Errorf("expected no janitor work, got: %#v, err: %v",
+			janitorPlan, err)
+	}
+
+	feeds, pindexes := m.CurrentMaps()
+	var feedName string
+	for feedName = range feeds {
+	}
+	var pindex *PIndex
+	for _, pindex = range pindexes {
+	}
+
+	// A manager for the same node whose janitor hasn't run yet has
+	// neither the pindex nor its feed, so should want to add both.
+	m2 := NewManager(VERSION, cfg, m.UUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	janitorPlan, err = m2.JanitorPlan()
+	if err != nil ||
+		!reflect.DeepEqual(janitorPlan.AddPIndexes, []string{pindex.Name}) ||
+		!reflect.DeepEqual(janitorPlan.AddFeeds, []string{feedName}) ||
+		len(janitorPlan.RemovePIndexes) != 0 ||
+		len(janitorPlan.RemoveFeeds) != 0 {
+		t.Errorf("expected janitor to want to add pindex and feed,"+
+			" got: %#v, err: %v", janitorPlan, err)
+	}
+
+	if m2.GetPIndex(pindex.Name) != nil {
+		t.Errorf("expected JanitorPlan() to not make changes")
+	}
+}
+
 func TestManagerStrangeWorkReqs(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -0,0 +1,213 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// After a pindex is registered, such as after a process restart, the
+// pindex may still be catching up with its data source.  A Manager
+// tracks the warmup of its local pindexes by periodically comparing
+// each pindex's persisted seqs against the high seqs of its data
+// source.  Warmup tracking is controlled by these manager options:
+//
+// * pindexWarmupInterval - how often to check the pindexes that are
+//   still warming up, like "5s", which is parsed by
+//   time.ParseDuration(); warmup tracking is disabled when empty,
+//   unless pindex builds are limited (see
+//   MaxConcurrentPIndexBuildsOption).
+// * pindexWarmupMaxLag - the total seq lag across a pindex's source
+//   partitions at or below which the pindex is considered warm;
+//   defaults to PINDEX_WARMUP_MAX_LAG.
+// * pindexWarmupGating - when "true", local pindexes that are still
+//   warming up are excluded from CoveringPIndexes(), unless the
+//   CoveringPIndexesSpec has IncludeWarmingUp.
+
+// PINDEX_WARMUP_MAX_LAG is the default of the pindexWarmupMaxLag
+// manager option.  It's non-zero, as a pindex of a source with steady
+// ingest is usually a little behind its source.
+var PINDEX_WARMUP_MAX_LAG = uint64(1000)
+
+// A PIndexWarmup represents the warmup state of a local pindex.  Once
+// a pindex is warm, it's no longer checked.
+type PIndexWarmup struct {
+	Warm bool      `json:"warm"`
+	Lag  uint64    `json:"lag"`  // Total seq lag behind the source.
+	Time time.Time `json:"time"` // When the lag was last checked.
+}
+
+// warmupEnabledLOCKED returns true if warmup tracking is enabled,
+// which is also needed to detect when limited pindex builds finish.
+func (mgr *Manager) warmupEnabledLOCKED() bool {
+	return mgr.options["pindexWarmupInterval"] != "" ||
+		maxConcurrentPIndexBuilds(mgr.options) > 0
+}
+
+// WarmupLoop is the main loop for pindex warmup tracking, and exits
+// when the manager is stopped.
+func (mgr *Manager) WarmupLoop() {
+	interval := mgr.optionDuration("pindexWarmupInterval")
+	if interval <= 0 && maxConcurrentPIndexBuilds(mgr.Options()) > 0 {
+		interval = PINDEX_BUILDS_CHECK_INTERVAL
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		mgr.WarmupOnce()
+	}
+}
+
+// WarmupOnce refreshes the warmup state of the local pindexes that
+// are still warming up.  A pindex whose source type doesn't provide
+// partition seqs is considered warm.  Pindex builds that have timed
+// out are also finished (see PINDEX_BUILD_TIMEOUT).
+func (mgr *Manager) WarmupOnce() {
+	mgr.timeoutPIndexBuilds()
+
+	maxLag := PINDEX_WARMUP_MAX_LAG
+	if v := mgr.Options()["pindexWarmupMaxLag"]; v != "" {
+		maxLag, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	// Keyed by sourceType/Name/UUID/Params, as many pindexes usually
+	// share a data source.
+	sourceSeqs := map[[4]string]map[string]UUIDSeq{}
+
+	_, pindexes := mgr.CurrentMaps()
+	for pindexName, pindex := range pindexes {
+		warmup := mgr.PIndexWarmup(pindexName)
+		if warmup == nil || warmup.Warm {
+			continue
+		}
+
+		feedType := FeedTypes[pindex.SourceType]
+		if feedType == nil || feedType.PartitionSeqs == nil ||
+			pindex.Dest == nil {
+			mgr.setPIndexWarmup(pindex, &PIndexWarmup{
+				Warm: true,
+				Time: time.Now(),
+			})
+			continue
+		}
+
+		sourceKey := [4]string{pindex.SourceType, pindex.SourceName,
+			pindex.SourceUUID, pindex.SourceParams}
+
+		seqs, exists := sourceSeqs[sourceKey]
+		if !exists {
+			var err error
+			seqs, err = feedType.PartitionSeqs(pindex.SourceType,
+				pindex.SourceName, pindex.SourceUUID, pindex.SourceParams,
+				mgr.server, mgr.Options())
+			if err != nil {
+				log.Printf("warmup: PartitionSeqs, pindex: %s, err: %v",
+					pindexName, err)
+			}
+			sourceSeqs[sourceKey] = seqs
+		}
+		if seqs == nil {
+			continue
+		}
+
+		var lag uint64
+		for partition := range pindex.sourcePartitionsMap {
+			_, lastSeq, err := pindex.Dest.OpaqueGet(partition)
+			if err != nil {
+				log.Printf("warmup: OpaqueGet, pindex: %s, partition: %s,"+
+					" err: %v", pindexName, partition, err)
+				continue
+			}
+			if uuidSeq, exists := seqs[partition]; exists &&
+				uuidSeq.Seq > lastSeq {
+				lag += uuidSeq.Seq - lastSeq
+			}
+		}
+
+		mgr.setPIndexWarmup(pindex, &PIndexWarmup{
+			Warm: lag <= maxLag,
+			Lag:  lag,
+			Time: time.Now(),
+		})
+	}
+}
+
+// setPIndexWarmup updates the warmup state of a registered pindex.
+// When a building pindex is warm, the janitor is kicked so that any
+// queued pindex builds may start.
+func (mgr *Manager) setPIndexWarmup(pindex *PIndex, warmup *PIndexWarmup) {
+	var buildDone bool
+
+	mgr.m.Lock()
+	if mgr.pindexes[pindex.Name] == pindex {
+		if mgr.pindexWarmup == nil {
+			mgr.pindexWarmup = map[string]*PIndexWarmup{}
+		}
+		mgr.pindexWarmup[pindex.Name] = warmup
+		if warmup.Warm {
+			atomic.AddUint64(&mgr.stats.TotRefreshPIndexWarmup, 1)
+			mgr.coveringCache = nil
+
+			log.Printf("warmup: pindex is warm: %s", pindex.Name)
+
+			buildDone = mgr.finishPIndexBuildLOCKED(pindex.Name)
+		}
+	}
+	mgr.m.Unlock()
+
+	if buildDone {
+		mgr.JanitorKick("warmup: pindex build done: " + pindex.Name)
+	}
+}
+
+// PIndexWarmup returns the warmup state of a local pindex, or nil if
+// the pindex isn't tracked, such as when warmup tracking is disabled.
+func (mgr *Manager) PIndexWarmup(pindexName string) *PIndexWarmup {
+	mgr.m.Lock()
+	rv := mgr.pindexWarmup[pindexName]
+	mgr.m.Unlock()
+	return rv
+}
+
+// PIndexWarmups returns a copy of the warmup states of the local
+// pindexes, keyed by pindex name.
+func (mgr *Manager) PIndexWarmups() map[string]*PIndexWarmup {
+	rv := map[string]*PIndexWarmup{}
+	mgr.m.Lock()
+	for pindexName, warmup := range mgr.pindexWarmup {
+		rv[pindexName] = warmup
+	}
+	mgr.m.Unlock()
+	return rv
+}
+
+// IsPIndexWarm returns true if a local pindex has finished warming
+// up, or if the pindex's warmup isn't tracked.
+func (mgr *Manager) IsPIndexWarm(pindexName string) bool {
+	warmup := mgr.PIndexWarmup(pindexName)
+	return warmup == nil || warmup.Warm
+}
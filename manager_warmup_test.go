@@ -0,0 +1,93 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerPIndexWarmup(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			"pindexWarmupInterval": "1h",
+			"pindexWarmupMaxLag":   "5",
+			"pindexWarmupGating":   "true",
+		})
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":1}`,
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+	if m.IsPIndexWarm(pindexName) || len(m.PIndexWarmups()) != 1 {
+		t.Errorf("expected pindex to be warming up, got: %#v",
+			m.PIndexWarmup(pindexName))
+	}
+
+	covering := func(includeWarmingUp bool) ([]*PIndex, []string) {
+		localPIndexes, _, missingPIndexNames, err :=
+			m.CoveringPIndexesEx(CoveringPIndexesSpec{
+				IndexName:            "foo",
+				PlanPIndexFilterName: "ok",
+				IncludeWarmingUp:     includeWarmingUp,
+			}, nil, false)
+		if err != nil {
+			t.Errorf("expected covering pindexes to work, err: %v", err)
+		}
+		return localPIndexes, missingPIndexNames
+	}
+
+	localPIndexes, missingPIndexNames := covering(false)
+	if len(localPIndexes) != 0 || len(missingPIndexNames) != 1 {
+		t.Errorf("expected warming up pindex to be skipped")
+	}
+	localPIndexes, missingPIndexNames = covering(true)
+	if len(localPIndexes) != 1 || len(missingPIndexNames) != 0 {
+		t.Errorf("expected warming up pindex when included")
+	}
+
+	primary := FeedTypes["primary"]
+	primary.PartitionSeqs = func(sourceType, sourceName, sourceUUID,
+		sourceParams, server string, options map[string]string) (
+		map[string]UUIDSeq, error) {
+		return map[string]UUIDSeq{"0": UUIDSeq{Seq: 10}}, nil
+	}
+	m.WarmupOnce()
+	primary.PartitionSeqs = nil
+
+	warmup := m.PIndexWarmup(pindexName)
+	if warmup == nil || warmup.Warm || warmup.Lag != 10 {
+		t.Errorf("expected lagging pindex, got: %#v", warmup)
+	}
+
+	m.WarmupOnce()
+
+	if !m.IsPIndexWarm(pindexName) {
+		t.Errorf("expected pindex to be warm, got: %#v",
+			m.PIndexWarmup(pindexName))
+	}
+	localPIndexes, missingPIndexNames = covering(false)
+	if len(localPIndexes) != 1 || len(missingPIndexNames) != 0 {
+		t.Errorf("expected warm pindex to be covering")
+	}
+}
@@ -0,0 +1,244 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// EventWebhooksOption is the manager option key whose value is a
+// JSON array of EventWebhook's, which are read when the manager is
+// started.
+const EventWebhooksOption = "eventWebhooks"
+
+// EVENT_WEBHOOK_QUEUE_SIZE is the number of events that may be
+// queued for each webhook before events are dropped.
+var EVENT_WEBHOOK_QUEUE_SIZE = 1000
+
+// EventWebhookHttpClient is used to issue the http requests of event
+// webhooks, and may be overridden such as for testing.  Its Timeout
+// bounds each request, so that a hung webhook can't stall its queue.
+var EventWebhookHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// An EventWebhook is an HTTP sink for a Manager's lifecycle events
+// (see ManagerEvent).  Each event is POST'ed as JSON to the URL.
+type EventWebhook struct {
+	URL string `json:"url"`
+
+	// The event kinds to send, like "pindexRolledBack" or
+	// "rebalanceDone"; all event kinds are sent when empty.
+	Events []string `json:"events,omitempty"`
+
+	// When non-empty, each request has an X-Cbgt-Signature header of
+	// "sha256=" followed by the hex HMAC-SHA256 of the request body
+	// keyed by the Secret.
+	Secret string `json:"secret,omitempty"`
+
+	MaxRetries     int `json:"maxRetries,omitempty"`     // Defaults to 3.
+	RetryBackoffMS int `json:"retryBackoffMS,omitempty"` // Defaults to 100.
+}
+
+// ParseEventWebhooks parses the value of the EventWebhooksOption.
+func ParseEventWebhooks(s string) ([]*EventWebhook, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var rv []*EventWebhook
+	err := json.Unmarshal([]byte(s), &rv)
+	if err != nil {
+		return nil, fmt.Errorf("manager_webhook: could not parse"+
+			" webhooks: %s, err: %v", s, err)
+	}
+	for _, w := range rv {
+		if w == nil || w.URL == "" {
+			return nil, fmt.Errorf("manager_webhook: missing webhook url,"+
+				" webhooks: %s", s)
+		}
+	}
+
+	return rv, nil
+}
+
+// Wants returns true if the webhook should receive the event.
+func (w *EventWebhook) Wants(event *ManagerEvent) bool {
+	if len(w.Events) <= 0 {
+		return true
+	}
+	for _, kind := range w.Events {
+		if kind == event.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Signature returns the HMAC-SHA256 signature of a request body.
+func (w *EventWebhook) Signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post sends a single event to the webhook, with retries and
+// exponential backoff, giving up early when stopCh is closed, which
+// also cancels any in-flight request.
+func (w *EventWebhook) Post(event *ManagerEvent,
+	stopCh chan struct{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	maxRetries := w.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+	backoff := time.Duration(w.RetryBackoffMS) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	for i := 0; ; i++ {
+		err = w.post(ctx, event, body)
+		if err == nil || i >= maxRetries {
+			return err
+		}
+
+		select {
+		case <-stopCh:
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff = backoff * 2
+	}
+}
+
+func (w *EventWebhook) post(ctx context.Context,
+	event *ManagerEvent, body []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cbgt-Event", event.Kind)
+	if w.Secret != "" {
+		req.Header.Set("X-Cbgt-Signature", w.Signature(body))
+	}
+
+	resp, err := EventWebhookHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("manager_webhook: url: %s, status code: %d",
+			w.URL, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// startWebhooks subscribes to the manager's events and starts
+// delivering them to the webhooks configured by the
+// EventWebhooksOption, until the manager is stopped.  Each webhook
+// has its own queue, so a slow or failing webhook doesn't delay the
+// others.
+func (mgr *Manager) startWebhooks() {
+	webhooks, err := ParseEventWebhooks(mgr.Options()[EventWebhooksOption])
+	if err != nil {
+		log.Printf("manager_webhook: %v", err)
+		return
+	}
+	if len(webhooks) <= 0 {
+		return
+	}
+
+	queues := make([]chan ManagerEvent, len(webhooks))
+	for i, webhook := range webhooks {
+		queues[i] = make(chan ManagerEvent, EVENT_WEBHOOK_QUEUE_SIZE)
+
+		go mgr.webhookWorker(webhook, queues[i])
+	}
+
+	eventCh := make(chan ManagerEvent, EVENT_WEBHOOK_QUEUE_SIZE)
+	mgr.SubscribeEvents(eventCh)
+
+	go func() {
+		defer mgr.UnsubscribeEvents(eventCh)
+
+		for {
+			select {
+			case <-mgr.stopCh:
+				return
+
+			case event := <-eventCh:
+				for i, webhook := range webhooks {
+					if !webhook.Wants(&event) {
+						continue
+					}
+					select {
+					case queues[i] <- event:
+					default:
+						atomic.AddUint64(&mgr.stats.TotWebhookDrop, 1)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (mgr *Manager) webhookWorker(webhook *EventWebhook,
+	queue chan ManagerEvent) {
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+
+		case event := <-queue:
+			atomic.AddUint64(&mgr.stats.TotWebhookPost, 1)
+
+			err := webhook.Post(&event, mgr.stopCh)
+			if err != nil {
+				atomic.AddUint64(&mgr.stats.TotWebhookPostErr, 1)
+
+				log.Printf("manager_webhook: post, url: %s, event: %s,"+
+					" err: %v", webhook.URL, event.Kind, err)
+			}
+		}
+	}
+}
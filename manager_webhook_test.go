@@ -0,0 +1,141 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseEventWebhooks(t *testing.T) {
+	webhooks, err := ParseEventWebhooks("")
+	if err != nil || webhooks != nil {
+		t.Errorf("expected no webhooks, got: %v, err: %v", webhooks, err)
+	}
+	if _, err = ParseEventWebhooks("not json"); err == nil {
+		t.Errorf("expected err on bad json")
+	}
+	if _, err = ParseEventWebhooks(`[{"events":["janitor"]}]`); err == nil {
+		t.Errorf("expected err on missing url")
+	}
+
+	webhooks, err = ParseEventWebhooks(
+		`[{"url":"http://x","events":["rebalanceDone"]}]`)
+	if err != nil || len(webhooks) != 1 {
+		t.Errorf("expected a webhook, got: %v, err: %v", webhooks, err)
+	}
+	if !webhooks[0].Wants(&ManagerEvent{Kind: MANAGER_EVENT_REBALANCE_DONE}) ||
+		webhooks[0].Wants(&ManagerEvent{Kind: MANAGER_EVENT_JANITOR}) {
+		t.Errorf("expected webhook to only want rebalanceDone")
+	}
+}
+
+func TestManagerWebhooks(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var numRequests int32
+
+	receivedCh := make(chan ManagerEvent, 10)
+
+	webhook := &EventWebhook{Secret: "shh"}
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&numRequests, 1) == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(req.Body)
+			if req.Header.Get("X-Cbgt-Signature") != webhook.Signature(body) {
+				t.Errorf("expected signature to match")
+			}
+
+			var event ManagerEvent
+			json.Unmarshal(body, &event)
+			receivedCh <- event
+		}))
+	defer s.Close()
+
+	webhook.URL = s.URL
+	webhook.Events = []string{MANAGER_EVENT_REBALANCE_DONE}
+	webhook.RetryBackoffMS = 1
+
+	webhooksJSON, _ := json.Marshal([]*EventWebhook{webhook})
+
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, map[string]string{
+			EventWebhooksOption: string(webhooksJSON),
+		})
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	m.EmitEvent(ManagerEvent{Kind: MANAGER_EVENT_JANITOR})
+	m.EmitEvent(ManagerEvent{
+		Kind: MANAGER_EVENT_REBALANCE_DONE,
+		Msg:  "mode: topology-change-rebalance",
+	})
+
+	select {
+	case event := <-receivedCh:
+		if event.Kind != MANAGER_EVENT_REBALANCE_DONE ||
+			event.Msg != "mode: topology-change-rebalance" {
+			t.Errorf("expected rebalanceDone event, got: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected webhook to receive an event")
+	}
+
+	if atomic.LoadInt32(&numRequests) != 2 {
+		t.Errorf("expected a retry, numRequests: %d", numRequests)
+	}
+}
+
+func TestEventWebhookPostStop(t *testing.T) {
+	releaseCh := make(chan struct{})
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			<-releaseCh // Hangs until the test is done.
+		}))
+	defer s.Close()
+	defer close(releaseCh)
+
+	webhook := &EventWebhook{URL: s.URL, MaxRetries: 1}
+
+	stopCh := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(stopCh) })
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- webhook.Post(&ManagerEvent{Kind: MANAGER_EVENT_JANITOR},
+			stopCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("expected an err from a cancelled post")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected stopCh to cancel the in-flight post")
+	}
+}
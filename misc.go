@@ -13,7 +13,11 @@ package cbgt
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -22,9 +26,11 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	log "github.com/couchbase/clog"
 	"github.com/rcrowley/go-metrics"
 )
 
@@ -53,6 +59,9 @@ var JsonOpenBrace = []byte("{")
 var JsonCloseBrace = []byte("}")
 var JsonCloseBraceComma = []byte("},")
 var JsonComma = []byte(",")
+var JsonOpenBracket = []byte("[")
+var JsonCloseBracket = []byte("]")
+var JsonNewLine = []byte("\n")
 
 // IndentJSON is a helper func that returns indented JSON for its
 // interface{} x parameter.
@@ -79,39 +88,149 @@ func ErrorToString(e error) string {
 }
 
 // Compares two dotted versioning strings, like "1.0.1" and "1.2.3".
-// Returns true when x >= y.
-//
-// TODO: Need to handle non-numeric parts?
+// Returns true when x >= y, and false when either version can't be
+// parsed.  See CompareVersions().
 func VersionGTE(x, y string) bool {
-	xa := strings.Split(x, ".")
-	ya := strings.Split(y, ".")
-	for i := range xa {
-		if i >= len(ya) {
-			return true
+	c, err := CompareVersions(x, y)
+	return err == nil && c >= 0
+}
+
+// CompareVersions compares two versioning strings, returning -1, 0
+// or +1 when x is less than, equal to or greater than y.  A version
+// has dotted numeric parts, like "5.5.0", optionally followed by a
+// "-" and dotted pre-release identifiers, like "5.5.0-MP1", and by a
+// "+" and build metadata, which is ignored.  As with semver, a
+// pre-release version is less than its release version, and
+// pre-release identifiers are compared numerically when they're
+// numeric, otherwise lexically.  Unlike semver, a version with fewer
+// numeric parts is less than a version with the same leading parts,
+// so "1.0" is less than "1.0.0".
+func CompareVersions(x, y string) (int, error) {
+	xv, err := parseVersion(x)
+	if err != nil {
+		return 0, err
+	}
+	yv, err := parseVersion(y)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(xv.parts) && i < len(yv.parts); i++ {
+		if xv.parts[i] != yv.parts[i] {
+			return compareInts(xv.parts[i], yv.parts[i]), nil
 		}
-		xv, err := strconv.Atoi(xa[i])
-		if err != nil {
-			return false
+	}
+	if len(xv.parts) != len(yv.parts) {
+		return compareInts(len(xv.parts), len(yv.parts)), nil
+	}
+
+	// A release is greater than its pre-releases.
+	if len(xv.pre) == 0 || len(yv.pre) == 0 {
+		return compareInts(len(yv.pre), len(xv.pre)), nil
+	}
+
+	for i := 0; i < len(xv.pre) && i < len(yv.pre); i++ {
+		if c := comparePreRelease(xv.pre[i], yv.pre[i]); c != 0 {
+			return c, nil
 		}
-		yv, err := strconv.Atoi(ya[i])
-		if err != nil {
-			return false
+	}
+	return compareInts(len(xv.pre), len(yv.pre)), nil
+}
+
+type parsedVersion struct {
+	parts []int
+	pre   []string // Pre-release identifiers.
+}
+
+func parseVersion(s string) (*parsedVersion, error) {
+	v := s
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var pre string
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+		if pre == "" {
+			return nil, fmt.Errorf("misc: empty pre-release in version: %q", s)
 		}
-		if xv > yv {
-			return true
+	}
+
+	rv := &parsedVersion{}
+
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part[0] == '+' {
+			return nil, fmt.Errorf("misc: could not parse version: %q", s)
 		}
-		if xv < yv {
-			return false
+		rv.parts = append(rv.parts, n)
+	}
+
+	if pre != "" {
+		rv.pre = strings.Split(pre, ".")
+		for _, id := range rv.pre {
+			if id == "" {
+				return nil, fmt.Errorf("misc: empty pre-release"+
+					" identifier in version: %q", s)
+			}
 		}
 	}
-	return len(xa) >= len(ya)
+
+	return rv, nil
+}
+
+func comparePreRelease(x, y string) int {
+	xn, xerr := strconv.Atoi(x)
+	yn, yerr := strconv.Atoi(y)
+	if xerr == nil && yerr == nil {
+		return compareInts(xn, yn)
+	}
+	if xerr == nil {
+		return -1 // Numeric identifiers are lower than alphanumeric.
+	}
+	if yerr == nil {
+		return 1
+	}
+	return strings.Compare(x, y)
+}
+
+func compareInts(x, y int) int {
+	if x < y {
+		return -1
+	}
+	if x > y {
+		return 1
+	}
+	return 0
 }
 
+// NewUUID returns a random 16 hex character UUID, which is the form
+// used for node, plan and index UUIDs.  The randomness comes from
+// crypto/rand, so that nodes that start at the same time don't
+// generate the same UUIDs.
 func NewUUID() string {
-	val1 := rand.Int63()
-	val2 := rand.Int63()
-	uuid := fmt.Sprintf("%x%x", val1, val2)
-	return uuid[0:16]
+	return hex.EncodeToString(newUUIDBytes(8))
+}
+
+// NewUUIDv4 returns a random RFC 4122 version 4 UUID, like
+// "f47ac10b-58cc-4372-a567-0e02b2c3d479".
+func NewUUIDv4() string {
+	b := newUUIDBytes(16)
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4.
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// newUUIDBytes returns n random bytes from crypto/rand, falling back
+// to math/rand only if crypto/rand fails.
+func newUUIDBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		for i := range b {
+			b[i] = byte(rand.Intn(256))
+		}
+	}
+	return b
 }
 
 // Calls f() in a loop, sleeping in an exponential backoff if needed.
@@ -124,24 +243,107 @@ func ExponentialBackoffLoop(name string,
 	startSleepMS int,
 	backoffFactor float32,
 	maxSleepMS int) {
-	nextSleepMS := startSleepMS
+	ExponentialBackoffLoopEx(name, f, BackoffOptions{
+		StartSleepMS:  startSleepMS,
+		BackoffFactor: backoffFactor,
+		MaxSleepMS:    maxSleepMS,
+	})
+}
+
+// BackoffOptions controls an ExponentialBackoffLoopEx().
+type BackoffOptions struct {
+	// The exponential backoff sleep parameters, as with
+	// ExponentialBackoffLoop().
+	StartSleepMS  int
+	BackoffFactor float32
+	MaxSleepMS    int
+
+	// Jitter is the fraction, between 0 and 1, of each sleep that's
+	// randomized, so that many loops backing off from the same
+	// failure don't all retry at the same time.
+	Jitter float64
+
+	// The loop stops, without waiting for a sleep to finish, when
+	// either the StopCh is closed or the Context is done.  Both are
+	// optional.
+	StopCh  <-chan struct{}
+	Context context.Context
+
+	// MaxAttempts is the max number of consecutive invocations of f()
+	// that make no progress, where <= 0 means no limit.  When reached,
+	// OnMaxAttempts is invoked, if not nil, with the attempt count.
+	MaxAttempts   int
+	OnMaxAttempts func(attempts int)
+}
+
+// ErrBackoffStopped is returned by ExponentialBackoffLoopEx() when
+// the loop was stopped by its StopCh or Context.
+var ErrBackoffStopped = errors.New("backoff loop stopped")
+
+// ErrBackoffMaxAttempts is returned by ExponentialBackoffLoopEx() when
+// the loop reached its MaxAttempts.
+var ErrBackoffMaxAttempts = errors.New("backoff loop reached max attempts")
+
+// ExponentialBackoffLoopEx is like ExponentialBackoffLoop(), with the
+// additional jitter, cancellation and max attempts of its options.
+// Returns nil when f() returns < 0, otherwise ErrBackoffStopped or
+// ErrBackoffMaxAttempts.
+func ExponentialBackoffLoopEx(name string, f func() int,
+	opts BackoffOptions) error {
+	var doneCh <-chan struct{}
+	if opts.Context != nil {
+		doneCh = opts.Context.Done()
+	}
+
+	nextSleepMS := opts.StartSleepMS
+	attempts := 0
 	for {
 		progress := f()
 		if progress < 0 {
-			return
+			return nil
 		}
 		if progress > 0 {
 			// When there was some progress, we can reset nextSleepMS.
-			nextSleepMS = startSleepMS
-		} else {
-			// If zero progress was made this cycle, then sleep.
-			time.Sleep(time.Duration(nextSleepMS) * time.Millisecond)
-
-			// Increase nextSleepMS in case next time also has 0 progress.
-			nextSleepMS = int(float32(nextSleepMS) * backoffFactor)
-			if nextSleepMS > maxSleepMS {
-				nextSleepMS = maxSleepMS
+			nextSleepMS = opts.StartSleepMS
+			attempts = 0
+			continue
+		}
+
+		attempts++
+		if opts.MaxAttempts > 0 && attempts >= opts.MaxAttempts {
+			log.Printf("misc: backoff loop reached max attempts,"+
+				" name: %s, attempts: %d", name, attempts)
+			if opts.OnMaxAttempts != nil {
+				opts.OnMaxAttempts(attempts)
 			}
+			return ErrBackoffMaxAttempts
+		}
+
+		// If zero progress was made this cycle, then sleep.
+		sleep := time.Duration(nextSleepMS) * time.Millisecond
+		if opts.Jitter > 0 && sleep > 0 {
+			jitter := time.Duration(opts.Jitter * float64(sleep))
+			if jitter > 0 {
+				sleep = sleep - jitter +
+					time.Duration(rand.Int63n(int64(jitter)+1))
+			}
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-opts.StopCh:
+			timer.Stop()
+			return ErrBackoffStopped
+		case <-doneCh:
+			timer.Stop()
+			return ErrBackoffStopped
+		case <-timer.C:
+		}
+
+		// Increase nextSleepMS in case next time also has 0 progress.
+		nextSleepMS = int(float32(nextSleepMS) * opts.BackoffFactor)
+		if nextSleepMS > opts.MaxSleepMS {
+			nextSleepMS = opts.MaxSleepMS
 		}
 	}
 }
@@ -188,6 +390,24 @@ func StringsIntersectStrings(a, b []string) []string {
 	return rv
 }
 
+// ParseOptionsBool parses the options "name-suffix" and then "name"
+// as boolean (strconv.ParseBool), otherwise returns defaultVal.
+func ParseOptionsBool(options map[string]string, name, suffix string,
+	defaultVal bool) bool {
+	if options != nil {
+		for _, optionName := range []string{name + "-" + suffix, name} {
+			if v, exists := options[optionName]; exists {
+				vb, err := strconv.ParseBool(v)
+				if err == nil {
+					return vb
+				}
+			}
+		}
+	}
+
+	return defaultVal
+}
+
 // TimeoutCancelChan creates a channel that closes after a given
 // timeout in milliseconds.
 func TimeoutCancelChan(timeout int64) <-chan bool {
@@ -202,6 +422,34 @@ func TimeoutCancelChan(timeout int64) <-chan bool {
 	return nil
 }
 
+// ContextCancelChan creates a channel that closes when the given ctx
+// is done, for use with the API's that take a cancelCh.  The returned
+// stop func releases the channel's resources, and should be invoked
+// once the channel is no longer needed.
+func ContextCancelChan(ctx context.Context) (cancelCh <-chan bool,
+	stop func()) {
+	if ctx == nil || ctx.Done() == nil {
+		return nil, func() {}
+	}
+
+	ch := make(chan bool)
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-stopCh: // Already stopped, so leave ch open.
+			default:
+				close(ch)
+			}
+		case <-stopCh:
+		}
+	}()
+
+	var stopOnce sync.Once
+	return ch, func() { stopOnce.Do(func() { close(stopCh) }) }
+}
+
 // Time invokes a func f and updates the totalDuration, totalCount and
 // maxDuration metrics.  See also Timer() for a metrics based
 // alternative.
@@ -298,41 +546,151 @@ func StructChanges(a1, a2 interface{}) (rv []string) {
 	return rv
 }
 
-var timerPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+// MetricsJSONOptions controls the JSON encoding of metrics timers
+// and histograms.
+type MetricsJSONOptions struct {
+	Pretty      bool      // Indented instead of compact JSON.
+	Percentiles []float64 // Like 0.5 for the median.
+}
+
+// MetricsJSONOptionsDefault are the options used by WriteTimerJSON()
+// and WriteHistogramJSON(), which applications may change, such as
+// for different percentiles.
+var MetricsJSONOptionsDefault = MetricsJSONOptions{
+	Percentiles: []float64{0.5, 0.75, 0.95, 0.99, 0.999},
+}
+
+// HistogramJSON is the JSON form of a metrics.Histogram.  The mean
+// and stddev are omitted when they're NaN or Inf, as are percentiles.
+type HistogramJSON struct {
+	Count       int64              `json:"count"`
+	Min         int64              `json:"min"`
+	Max         int64              `json:"max"`
+	Mean        *float64           `json:"mean,omitempty"`
+	StdDev      *float64           `json:"stddev,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+// TimerJSON is the JSON form of a metrics.Timer, which adds the 1, 5
+// and 15 minute and mean rates to its histogram.
+type TimerJSON struct {
+	HistogramJSON
+	Rates map[string]float64 `json:"rates"`
+}
+
+// NewHistogramJSON returns the JSON form of a metrics.Histogram with
+// the given percentiles.
+func NewHistogramJSON(histogram metrics.Histogram,
+	percentiles []float64) *HistogramJSON {
+	h := histogram.Snapshot()
+
+	return &HistogramJSON{
+		Count:       h.Count(),
+		Min:         h.Min(),
+		Max:         h.Max(),
+		Mean:        finiteFloat(h.Mean()),
+		StdDev:      finiteFloat(h.StdDev()),
+		Percentiles: percentilesMap(percentiles, h.Percentiles(percentiles)),
+	}
+}
+
+// NewTimerJSON returns the JSON form of a metrics.Timer with the
+// given percentiles.
+func NewTimerJSON(timer metrics.Timer, percentiles []float64) *TimerJSON {
+	t := timer.Snapshot()
+
+	return &TimerJSON{
+		HistogramJSON: HistogramJSON{
+			Count:       t.Count(),
+			Min:         t.Min(),
+			Max:         t.Max(),
+			Mean:        finiteFloat(t.Mean()),
+			StdDev:      finiteFloat(t.StdDev()),
+			Percentiles: percentilesMap(percentiles, t.Percentiles(percentiles)),
+		},
+		Rates: finiteFloatMap(map[string]float64{
+			"1-min":  t.Rate1(),
+			"5-min":  t.Rate5(),
+			"15-min": t.Rate15(),
+			"mean":   t.RateMean(),
+		}),
+	}
+}
 
 // WriteTimerJSON writes a metrics.Timer instance as JSON to a
-// io.Writer.
+// io.Writer, using the MetricsJSONOptionsDefault.
 func WriteTimerJSON(w io.Writer, timer metrics.Timer) {
-	t := timer.Snapshot()
-	p := t.Percentiles(timerPercentiles)
-
-	fmt.Fprintf(w, `{"count":%9d,`, t.Count())
-	fmt.Fprintf(w, `"min":%9d,`, t.Min())
-	fmt.Fprintf(w, `"max":%9d,`, t.Max())
-	mean := t.Mean()
-	if !isNanOrInf(mean) {
-		fmt.Fprintf(w, `"mean":%12.2f,`, mean)
-	}
-	stddev := t.StdDev()
-	if !isNanOrInf(stddev) {
-		fmt.Fprintf(w, `"stddev":%12.2f,`, stddev)
-	}
-
-	fPrintFloatMap(w, "percentiles", map[string]float64{
-		"median": p[0],
-		"75%":    p[1],
-		"95%":    p[2],
-		"99%":    p[3],
-		"99.9%":  p[4],
-	})
-	fmt.Fprintf(w, `,`)
-	fPrintFloatMap(w, "rates", map[string]float64{
-		"1-min":  t.Rate1(),
-		"5-min":  t.Rate5(),
-		"15-min": t.Rate15(),
-		"mean":   t.RateMean(),
-	})
-	fmt.Fprintf(w, `}`)
+	WriteTimerJSONEx(w, timer, MetricsJSONOptionsDefault)
+}
+
+// WriteTimerJSONEx writes a metrics.Timer instance as JSON to a
+// io.Writer.
+func WriteTimerJSONEx(w io.Writer, timer metrics.Timer,
+	opts MetricsJSONOptions) {
+	WriteMetricsJSON(w, NewTimerJSON(timer, opts.Percentiles), opts)
+}
+
+// WriteHistogramJSON writes a metrics.Histogram instance as JSON to a
+// io.Writer, using the MetricsJSONOptionsDefault.
+func WriteHistogramJSON(w io.Writer, histogram metrics.Histogram) {
+	WriteHistogramJSONEx(w, histogram, MetricsJSONOptionsDefault)
+}
+
+// WriteHistogramJSONEx writes a metrics.Histogram instance as JSON to
+// a io.Writer.
+func WriteHistogramJSONEx(w io.Writer, histogram metrics.Histogram,
+	opts MetricsJSONOptions) {
+	WriteMetricsJSON(w, NewHistogramJSON(histogram, opts.Percentiles), opts)
+}
+
+// WriteMetricsJSON writes a value, such as a struct of TimerJSON's, as
+// compact or pretty JSON to a io.Writer.
+func WriteMetricsJSON(w io.Writer, v interface{}, opts MetricsJSONOptions) {
+	var buf []byte
+	var err error
+	if opts.Pretty {
+		buf, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		buf, err = json.Marshal(v)
+	}
+	if err != nil {
+		w.Write(JsonNULL)
+		return
+	}
+	w.Write(buf)
+}
+
+// percentilesMap returns a map keyed by percentile names, like
+// "median", "75%" and "99.9%".
+func percentilesMap(percentiles, vals []float64) map[string]float64 {
+	rv := make(map[string]float64, len(percentiles))
+	for i, p := range percentiles {
+		if i >= len(vals) || isNanOrInf(vals[i]) {
+			continue
+		}
+		k := "median"
+		if p != 0.5 {
+			k = strconv.FormatFloat(p*100, 'f', -1, 32) + "%"
+		}
+		rv[k] = vals[i]
+	}
+	return rv
+}
+
+func finiteFloat(v float64) *float64 {
+	if isNanOrInf(v) {
+		return nil
+	}
+	return &v
+}
+
+func finiteFloatMap(vals map[string]float64) map[string]float64 {
+	for k, v := range vals {
+		if isNanOrInf(v) {
+			delete(vals, k)
+		}
+	}
+	return vals
 }
 
 // a helper to safely print a json map with string keys and float64 values
@@ -361,3 +719,38 @@ func isNanOrInf(v float64) bool {
 	}
 	return false
 }
+
+// jsonPointerGet returns the value at a JSON pointer (RFC 6901) of a
+// parsed JSON document.
+func jsonPointerGet(doc interface{}, ptr string) (interface{}, bool) {
+	if ptr == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, false
+	}
+
+	for _, part := range strings.Split(ptr[1:], "/") {
+		part = strings.Replace(part, "~1", "/", -1)
+		part = strings.Replace(part, "~0", "~", -1)
+
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var exists bool
+			doc, exists = v[part]
+			if !exists {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
@@ -13,12 +13,17 @@ package cbgt
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 func TestVersionGTE(t *testing.T) {
@@ -50,6 +55,13 @@ func TestVersionGTE(t *testing.T) {
 		{"3.1.0", "3.2.0", false},
 		{"3.2.0", "3.1.0", true},
 		{"4.0.0", "3.1.0", true},
+		{"5.5.0-MP1", "5.5.0", false},
+		{"5.5.0", "5.5.0-MP1", true},
+		{"5.5.1-MP1", "5.5.0", true},
+		{"5.5.0-MP1", "5.0.0", true},
+		{"5.5.0-MP2", "5.5.0-MP1", true},
+		{"5.5.0+build.7", "5.5.0", true},
+		{"5.5.0-", "5.5.0", false},
 	}
 
 	for i, test := range tests {
@@ -61,12 +73,109 @@ func TestVersionGTE(t *testing.T) {
 	}
 }
 
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		x        string
+		y        string
+		expected int
+		err      bool
+	}{
+		{"1.0.0", "1.0.0", 0, false},
+		{"1.0.0", "1.0.1", -1, false},
+		{"1.10.0", "1.9.0", 1, false},
+		{"1.0", "1.0.0", -1, false},
+		{"1.0.0", "1.0", 1, false},
+		{"1.0.0-alpha", "1.0.0", -1, false},
+		{"1.0.0", "1.0.0-alpha", 1, false},
+		{"1.0.0-alpha", "1.0.0-alpha", 0, false},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1, false},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1, false},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1, false},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1, false},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1, false},
+		{"5.5.0-MP1", "5.5.0-MP10", -1, false},
+		{"1.0.0+a", "1.0.0+b", 0, false},
+		{"1.0.0-rc.1+a", "1.0.0-rc.1", 0, false},
+		{"", "1.0.0", 0, true},
+		{"1.0.0", "", 0, true},
+		{"hello", "1.0.0", 0, true},
+		{"1.x.0", "1.0.0", 0, true},
+		{"1..0", "1.0.0", 0, true},
+		{"1.+1", "1.1", 0, true},
+		{"1.0.0-", "1.0.0", 0, true},
+		{"1.0.0-a..b", "1.0.0", 0, true},
+	}
+
+	for i, test := range tests {
+		actual, err := CompareVersions(test.x, test.y)
+		if (err != nil) != test.err {
+			t.Errorf("test: %d, %s vs %s, expected err: %v, got: %v",
+				i, test.x, test.y, test.err, err)
+		}
+		if actual != test.expected {
+			t.Errorf("test: %d, expected: %d, when %s vs %s, got: %d",
+				i, test.expected, test.x, test.y, actual)
+		}
+	}
+}
+
 func TestNewUUID(t *testing.T) {
 	u0 := NewUUID()
 	u1 := NewUUID()
 	if u0 == "" || u1 == "" || u0 == u1 {
 		t.Errorf("NewUUID() failed, %s, %s", u0, u1)
 	}
+
+	re := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100000; i++ {
+		u := NewUUID()
+		if !re.MatchString(u) {
+			t.Fatalf("NewUUID() bad format: %q", u)
+		}
+		if seen[u] {
+			t.Fatalf("NewUUID() collision: %q", u)
+		}
+		seen[u] = true
+	}
+}
+
+func TestNewUUIDv4(t *testing.T) {
+	re := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100000; i++ {
+		u := NewUUIDv4()
+		if !re.MatchString(u) {
+			t.Fatalf("NewUUIDv4() bad format: %q", u)
+		}
+		if seen[u] {
+			t.Fatalf("NewUUIDv4() collision: %q", u)
+		}
+		seen[u] = true
+	}
+}
+
+func TestNewUUIDConcurrent(t *testing.T) {
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				u := NewUUID()
+				m.Lock()
+				if seen[u] {
+					t.Errorf("NewUUID() concurrent collision: %q", u)
+				}
+				seen[u] = true
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 func TestExponentialBackoffLoop(t *testing.T) {
@@ -122,6 +231,111 @@ func TestExponentialBackoffLoop(t *testing.T) {
 	}
 }
 
+func TestExponentialBackoffLoopEx(t *testing.T) {
+	called := 0
+	maxAttempts := 0
+	err := ExponentialBackoffLoopEx("test", func() int {
+		called += 1
+		if called == 2 {
+			return 1 // Progress resets the attempts.
+		}
+		return 0
+	}, BackoffOptions{
+		MaxAttempts:   3,
+		OnMaxAttempts: func(attempts int) { maxAttempts = attempts },
+	})
+	if err != ErrBackoffMaxAttempts || called != 5 || maxAttempts != 3 {
+		t.Errorf("expected max attempts, err: %v, called: %d,"+
+			" maxAttempts: %d", err, called, maxAttempts)
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	startTime := time.Now()
+	err = ExponentialBackoffLoopEx("test", func() int {
+		return 0
+	}, BackoffOptions{StartSleepMS: 100000, StopCh: stopCh})
+	if err != ErrBackoffStopped || time.Since(startTime) > 10*time.Second {
+		t.Errorf("expected stop while sleeping, err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = ExponentialBackoffLoopEx("test", func() int {
+		return 0
+	}, BackoffOptions{StartSleepMS: 100000, Context: ctx})
+	if err != ErrBackoffStopped {
+		t.Errorf("expected stop on ctx cancel, err: %v", err)
+	}
+
+	called = 0
+	err = ExponentialBackoffLoopEx("test", func() int {
+		called += 1
+		if called >= 10 {
+			return -1
+		}
+		return 0
+	}, BackoffOptions{StartSleepMS: 1, BackoffFactor: 1.5, MaxSleepMS: 2,
+		Jitter: 1.0})
+	if err != nil || called != 10 {
+		t.Errorf("expected jittered loop to finish, err: %v, called: %d",
+			err, called)
+	}
+}
+
+func TestWriteTimerJSON(t *testing.T) {
+	timer := metrics.NewTimer()
+	for i := 1; i <= 100; i++ {
+		timer.Update(time.Duration(i))
+	}
+
+	var buf bytes.Buffer
+	WriteTimerJSON(&buf, timer)
+	if strings.Contains(buf.String(), " ") {
+		t.Errorf("expected compact JSON, got: %s", buf.String())
+	}
+
+	var tj TimerJSON
+	err := json.Unmarshal(buf.Bytes(), &tj)
+	if err != nil {
+		t.Fatalf("expected JSON, err: %v, got: %s", err, buf.String())
+	}
+	if tj.Count != 100 || tj.Min != 1 || tj.Max != 100 || tj.Mean == nil {
+		t.Errorf("unexpected timer JSON: %s", buf.String())
+	}
+	for _, k := range []string{"median", "75%", "95%", "99%", "99.9%"} {
+		if _, exists := tj.Percentiles[k]; !exists {
+			t.Errorf("expected percentile: %s, got: %s", k, buf.String())
+		}
+	}
+	if _, exists := tj.Rates["1-min"]; !exists {
+		t.Errorf("expected rates, got: %s", buf.String())
+	}
+
+	buf.Reset()
+	WriteHistogramJSONEx(&buf, metrics.NewHistogram(metrics.NewUniformSample(10)),
+		MetricsJSONOptions{Pretty: true, Percentiles: []float64{0.25, 0.999}})
+	if !strings.Contains(buf.String(), "\n") {
+		t.Errorf("expected pretty JSON, got: %s", buf.String())
+	}
+
+	var hj map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &hj)
+	if err != nil {
+		t.Fatalf("expected JSON, err: %v, got: %s", err, buf.String())
+	}
+	if hj["rates"] != nil {
+		t.Errorf("expected no rates, got: %s", buf.String())
+	}
+	p, _ := hj["percentiles"].(map[string]interface{})
+	if len(p) != 2 || p["25%"] == nil || p["99.9%"] == nil {
+		t.Errorf("expected custom percentiles, got: %s", buf.String())
+	}
+}
+
 func TestTimeoutCancelChan(t *testing.T) {
 	c := TimeoutCancelChan(0)
 	if c != nil {
@@ -144,6 +358,42 @@ func TestTimeoutCancelChan(t *testing.T) {
 	}
 }
 
+func TestContextCancelChan(t *testing.T) {
+	c, stop := ContextCancelChan(context.Background())
+	if c != nil {
+		t.Errorf("expected nil for a ctx that's never done")
+	}
+	stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, stop = ContextCancelChan(ctx)
+	defer stop()
+	if c == nil {
+		t.Errorf("expected non-nil")
+	}
+	select {
+	case <-c:
+		t.Errorf("expected open before cancel")
+	default:
+	}
+	cancel()
+	_, ok := <-c
+	if ok {
+		t.Errorf("expected closed")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	c, stop = ContextCancelChan(ctx)
+	stop()
+	stop()
+	cancel()
+	select {
+	case <-c:
+		t.Errorf("expected open after stop")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
 func TestTime(t *testing.T) {
 	count := uint64(10)
 	duration := uint64(100)
@@ -360,3 +610,30 @@ func TestFPrintFloatMap(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONPointerGet(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"a":{"b/c":[1,{"d~e":2.5}]},"x":"y"}`), &doc)
+
+	tests := []struct {
+		ptr string
+		exp interface{}
+		ok  bool
+	}{
+		{"/a/b~1c/0", 1.0, true},
+		{"/a/b~1c/1/d~0e", 2.5, true},
+		{"/x", "y", true},
+		{"/a/b~1c/2", nil, false},
+		{"/a/b~1c/z", nil, false},
+		{"/x/y", nil, false},
+		{"/nope", nil, false},
+	}
+
+	for i, test := range tests {
+		v, ok := jsonPointerGet(doc, test.ptr)
+		if ok != test.ok || (ok && v != test.exp) {
+			t.Errorf("test: %d, ptr: %s, expected: %v, %v, got: %v, %v",
+				i, test.ptr, test.exp, test.ok, v, ok)
+		}
+	}
+}
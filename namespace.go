@@ -0,0 +1,122 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strings"
+)
+
+// An index may optionally belong to a namespace (or tenant), where
+// the namespace is part of the index's qualified name, like
+// "tenantA.myIndex".  As the NAMESPACE_SEPARATOR is not allowed by
+// the INDEX_NAME_REGEXP, an index name without a namespace remains
+// unambiguous.
+//
+// A namespace's indexes can be isolated onto a subset of the nodes
+// by tagging those nodes with NAMESPACE_NODE_TAG_PREFIX plus the
+// namespace, like "ns:tenantA", see NamespaceIneligibleNodeUUIDs().
+
+// NAMESPACE_SEPARATOR separates a namespace from an index name in a
+// qualified index name.
+const NAMESPACE_SEPARATOR = "."
+
+// NAMESPACE_NODE_TAG_PREFIX is the prefix of node tags that dedicate
+// a node to the indexes of a namespace.
+const NAMESPACE_NODE_TAG_PREFIX = "ns:"
+
+// NamespacedIndexName returns the qualified name of an index in a
+// namespace, where a namespace of "" means no namespace.
+func NamespacedIndexName(ns, indexName string) string {
+	if ns == "" {
+		return indexName
+	}
+	return ns + NAMESPACE_SEPARATOR + indexName
+}
+
+// SplitNamespacedIndexName splits a qualified index name into its
+// namespace, which is "" when there's no namespace, and index name.
+func SplitNamespacedIndexName(name string) (ns, indexName string) {
+	i := strings.Index(name, NAMESPACE_SEPARATOR)
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+len(NAMESPACE_SEPARATOR):]
+}
+
+// FilterIndexDefsByNamespace returns a copy of the IndexDefs with
+// only the index definitions of a namespace.
+func FilterIndexDefsByNamespace(indexDefs *IndexDefs, ns string) *IndexDefs {
+	if indexDefs == nil {
+		return nil
+	}
+
+	rv := &IndexDefs{
+		UUID:        indexDefs.UUID,
+		IndexDefs:   map[string]*IndexDef{},
+		ImplVersion: indexDefs.ImplVersion,
+	}
+	for name, indexDef := range indexDefs.IndexDefs {
+		if indexDef.Namespace == ns {
+			rv.IndexDefs[name] = indexDef
+		}
+	}
+	return rv
+}
+
+// nodeNamespaces returns the namespaces that a node is dedicated to
+// via its tags.
+func nodeNamespaces(nodeDef *NodeDef) (rv []string) {
+	for _, tag := range nodeDef.Tags {
+		if strings.HasPrefix(tag, NAMESPACE_NODE_TAG_PREFIX) {
+			rv = append(rv, tag[len(NAMESPACE_NODE_TAG_PREFIX):])
+		}
+	}
+	return rv
+}
+
+// NamespaceIneligibleNodeUUIDs returns the subset of nodeUUIDs that
+// should not host the pindexes of a namespace's indexes.  When some
+// nodes are tagged for the namespace, only those nodes are eligible.
+// Otherwise, only the nodes that aren't tagged for any namespace are
+// eligible.  Nodes without a NodeDef are left for the planner's usual
+// node removal handling.
+func NamespaceIneligibleNodeUUIDs(nodeDefs *NodeDefs, ns string,
+	nodeUUIDs []string) (rv []string) {
+	if nodeDefs == nil {
+		return nil
+	}
+
+	tagged := false // True if any nodes are tagged for the namespace.
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		if ns != "" && StringsToMap(nodeNamespaces(nodeDef))[ns] {
+			tagged = true
+			break
+		}
+	}
+
+	for _, nodeUUID := range nodeUUIDs {
+		nodeDef, exists := nodeDefs.NodeDefs[nodeUUID]
+		if !exists || nodeDef == nil {
+			continue
+		}
+		nodeNSs := nodeNamespaces(nodeDef)
+		if tagged {
+			if !StringsToMap(nodeNSs)[ns] {
+				rv = append(rv, nodeUUID)
+			}
+		} else if len(nodeNSs) > 0 {
+			rv = append(rv, nodeUUID)
+		}
+	}
+
+	return rv
+}
@@ -0,0 +1,106 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNamespacedIndexName(t *testing.T) {
+	tests := []struct {
+		name      string
+		ns        string
+		indexName string
+	}{
+		{"foo", "", "foo"},
+		{"tenant1.foo", "tenant1", "foo"},
+	}
+	for _, test := range tests {
+		ns, indexName := SplitNamespacedIndexName(test.name)
+		if ns != test.ns || indexName != test.indexName {
+			t.Errorf("expected %s, %s, got: %s, %s, for: %s",
+				test.ns, test.indexName, ns, indexName, test.name)
+		}
+		if NamespacedIndexName(ns, indexName) != test.name {
+			t.Errorf("expected round trip for: %s", test.name)
+		}
+	}
+}
+
+func TestNamespaceIneligibleNodeUUIDs(t *testing.T) {
+	nodeDefs := &NodeDefs{
+		NodeDefs: map[string]*NodeDef{
+			"a": {UUID: "a"},
+			"b": {UUID: "b", Tags: []string{"feed", "ns:tenant1"}},
+			"c": {UUID: "c", Tags: []string{"ns:tenant2"}},
+		},
+	}
+	nodeUUIDs := []string{"a", "b", "c", "gone"}
+
+	tests := []struct {
+		ns  string
+		exp []string
+	}{
+		{"", []string{"b", "c"}},
+		{"tenant1", []string{"a", "c"}},
+		{"tenant2", []string{"a", "b"}},
+		{"tenant3", []string{"b", "c"}},
+	}
+	for _, test := range tests {
+		got := NamespaceIneligibleNodeUUIDs(nodeDefs, test.ns, nodeUUIDs)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("expected %v, got: %v, for ns: %s", test.exp, got, test.ns)
+		}
+	}
+}
+
+func TestCreateIndexNamespace(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	for _, indexName := range []string{".foo", "tenant1.", "1a.foo", "a.b.c"} {
+		if err := m.CreateIndex("primary", "default", "123", "",
+			"blackhole", indexName, "", PlanParams{}, ""); err == nil {
+			t.Errorf("expected CreateIndex() to fail for: %s", indexName)
+		}
+	}
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "tenant1.foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	indexDefs, _, _ := CfgGetIndexDefs(m.cfg)
+	indexDef := indexDefs.IndexDefs["tenant1.foo"]
+	if indexDef == nil || indexDef.Namespace != "tenant1" {
+		t.Errorf("expected namespaced indexDef, got: %#v", indexDef)
+	}
+
+	filtered := FilterIndexDefsByNamespace(indexDefs, "tenant1")
+	if len(filtered.IndexDefs) != 1 {
+		t.Errorf("expected 1 indexDef in namespace, got: %#v", filtered)
+	}
+	filtered = FilterIndexDefsByNamespace(indexDefs, "")
+	if len(filtered.IndexDefs) != 0 {
+		t.Errorf("expected 0 indexDefs without namespace, got: %#v", filtered)
+	}
+}
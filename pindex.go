@@ -14,11 +14,14 @@ package cbgt
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"os"
+	"reflect"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const PINDEX_META_FILENAME string = "PINDEX_META"
@@ -47,6 +50,23 @@ type PIndex struct {
 
 	m      sync.Mutex
 	closed bool
+
+	consistencyWaitStats *ConsistencyWaitStats
+
+	progressSeq  uint64    // See IndexProgress().
+	progressTime time.Time // See IndexProgress().
+}
+
+// ConsistencyWaitStats returns the stats of the consistency waits on
+// the pindex.
+func (p *PIndex) ConsistencyWaitStats() *ConsistencyWaitStats {
+	p.m.Lock()
+	if p.consistencyWaitStats == nil {
+		p.consistencyWaitStats = NewConsistencyWaitStats()
+	}
+	rv := p.consistencyWaitStats
+	p.m.Unlock()
+	return rv
 }
 
 // Close down a pindex, optionally removing its stored files.
@@ -69,6 +89,7 @@ func (p *PIndex) Close(remove bool) error {
 
 	if remove {
 		os.RemoveAll(p.Path)
+		os.RemoveAll(p.Path + pindexSnapshotSuffix)
 	}
 
 	return nil
@@ -133,8 +154,7 @@ func NewPIndex(mgr *Manager, name, uuid,
 		return nil, err
 	}
 
-	err = ioutil.WriteFile(path+string(os.PathSeparator)+PINDEX_META_FILENAME,
-		buf, 0600)
+	err = WritePIndexMeta(path, buf)
 	if err != nil {
 		dest.Close()
 		os.RemoveAll(path)
@@ -148,9 +168,11 @@ func NewPIndex(mgr *Manager, name, uuid,
 // OpenPIndex reopens a previously created pindex.  The path argument
 // must be a directory for the pindex.
 func OpenPIndex(mgr *Manager, path string) (*PIndex, error) {
-	buf, err := ioutil.ReadFile(path +
-		string(os.PathSeparator) + PINDEX_META_FILENAME)
+	buf, err := ReadPIndexMeta(path)
 	if err != nil {
+		if _, ok := err.(*PIndexMetaCorruptError); ok {
+			return nil, err
+		}
 		return nil, fmt.Errorf("pindex: could not load PINDEX_META_FILENAME,"+
 			" path: %s, err: %v", path, err)
 	}
@@ -184,13 +206,75 @@ func OpenPIndex(mgr *Manager, path string) (*PIndex, error) {
 	return pindex, nil
 }
 
+// OpenPIndexUsing reopens a previously created pindex, where the
+// pindex adopts the name, index UUID, updated index params and
+// (equivalent) source params of a plan pindex, which are then
+// persisted into the pindex's PINDEX_META_FILENAME.  See
+// PINDEXES_RESTART.
+func OpenPIndexUsing(mgr *Manager, path string,
+	planPIndex *PlanPIndex) (*PIndex, error) {
+	buf, err := ReadPIndexMeta(path)
+	if err != nil {
+		if _, ok := err.(*PIndexMetaCorruptError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("pindex: could not load PINDEX_META_FILENAME,"+
+			" path: %s, err: %v", path, err)
+	}
+
+	pindex := &PIndex{}
+	err = json.Unmarshal(buf, pindex)
+	if err != nil {
+		return nil, fmt.Errorf("pindex: could not parse pindex json,"+
+			" path: %s, err: %v", path, err)
+	}
+
+	pindex.Name = planPIndex.Name
+	pindex.IndexUUID = planPIndex.IndexUUID
+	pindex.IndexParams = planPIndex.IndexParams
+	pindex.SourceParams = planPIndex.SourceParams
+
+	restart := func() {
+		go restartPIndex(mgr, pindex)
+	}
+
+	impl, dest, err := OpenPIndexImplUsing(pindex.IndexType, path,
+		pindex.IndexParams, restart)
+	if err != nil {
+		return nil, fmt.Errorf("pindex: could not open using indexType: %s,"+
+			" path: %s, err: %v", pindex.IndexType, path, err)
+	}
+
+	pindex.Path = path
+	pindex.Impl = impl
+	pindex.Dest = dest
+
+	pindex.sourcePartitionsMap = map[string]bool{}
+	for _, partition := range strings.Split(pindex.SourcePartitions, ",") {
+		pindex.sourcePartitionsMap[partition] = true
+	}
+
+	buf, err = json.Marshal(pindex)
+	if err == nil {
+		err = WritePIndexMeta(path, buf)
+	}
+	if err != nil {
+		dest.Close()
+		return nil, fmt.Errorf("pindex: could not save PINDEX_META_FILENAME,"+
+			" path: %s, err: %v", path, err)
+	}
+
+	return pindex, nil
+}
+
 // Computes the storage path for a pindex.
 func PIndexPath(dataDir, pindexName string) string {
 	// TODO: Need path security checks / mapping here; ex: "../etc/pswd"
 	return dataDir + string(os.PathSeparator) + pindexName + pindexPathSuffix
 }
 
-// Retrieves a pindex name from a pindex path.
+// Retrieves a pindex name from a pindex path, in either the flat or
+// the index-scoped dataDir layout.  See PIndexPathEx().
 func ParsePIndexPath(dataDir, pindexPath string) (string, bool) {
 	if !strings.HasSuffix(pindexPath, pindexPathSuffix) {
 		return "", false
@@ -201,6 +285,18 @@ func ParsePIndexPath(dataDir, pindexPath string) (string, bool) {
 	}
 	pindexName := pindexPath[len(prefix):]
 	pindexName = pindexName[0 : len(pindexName)-len(pindexPathSuffix)]
+
+	// An index-scoped path has the index directory as a prefix.
+	sep := strings.Index(pindexName, string(os.PathSeparator))
+	if sep >= 0 {
+		indexDir := pindexName[:sep]
+		pindexName = pindexName[sep+1:]
+		if strings.Contains(pindexName, string(os.PathSeparator)) ||
+			indexDir != PIndexIndexName(pindexName) {
+			return "", false
+		}
+	}
+
 	return pindexName, true
 }
 
@@ -222,6 +318,25 @@ type CoveringPIndexesSpec struct {
 	IndexName            string
 	IndexUUID            string
 	PlanPIndexFilterName string // See PlanPIndexesFilters.
+
+	// When true, local pindexes that are still warming up are not
+	// skipped, even when the pindexWarmupGating option is enabled.
+	IncludeWarmingUp bool
+
+	// When non-empty, a comma separated list of source partitions,
+	// where only the pindexes that cover any of those partitions are
+	// selected.  See QueryCtl.CoveringPIndexesSpec().
+	SourcePartitions string
+
+	// When non-empty, a comma separated list of pindex names, where
+	// only those pindexes are selected.
+	PIndexNames string
+
+	// When non-empty, the load of the selected pindexes is spread
+	// across all their usable nodes, both primaries and replicas,
+	// instead of preferring the lowest priority node.  Selections
+	// vary per call, so they're not cached.  See PARTITION_SELECTION_*.
+	PartitionSelection string
 }
 
 // CoveringPIndexes represents a non-overlapping, disjoint set of
@@ -230,6 +345,8 @@ type CoveringPIndexes struct {
 	LocalPIndexes      []*PIndex
 	RemotePlanPIndexes []*RemotePlanPIndex
 	MissingPIndexNames []string
+
+	planUUID string // The UUID of the plan when cached.
 }
 
 // PlanPIndexFilters represent registered PlanPIndexFilter func's, and
@@ -245,7 +362,11 @@ var PlanPIndexFilters = map[string]PlanPIndexFilter{
 // of PIndexes (either local or remote) that cover all the partitons
 // of an index so that the caller can perform scatter/gather queries,
 // etc.  Only PlanPIndexes on wanted nodes that pass the
-// planPIndexFilter filter will be returned.
+// planPIndexFilter filter will be returned.  Remote nodes whose
+// heartbeats have expired are skipped (see Manager.IsNodeAlive()).
+// When the pindexWarmupGating manager option is "true", local
+// pindexes that are still warming up are skipped in favor of remote
+// replicas (see Manager.IsPIndexWarm()).
 //
 // TODO: Perhaps need a tighter check around indexUUID, as the current
 // implementation might have a race where old pindexes with a matching
@@ -303,34 +424,63 @@ func (mgr *Manager) CoveringPIndexesBestEffort(indexName, indexUUID string,
 // of an index so that the caller can perform scatter/gather queries.
 //
 // If the planPIndexFilter param is nil, then the
-// spec.PlanPIndexFilterName is used.
+// spec.PlanPIndexFilterName is used.  Results are cached per spec and
+// plan, unless noCache is true or the planPIndexFilter isn't one of
+// the registered PlanPIndexFilters.
 func (mgr *Manager) CoveringPIndexesEx(spec CoveringPIndexesSpec,
 	planPIndexFilter PlanPIndexFilter, noCache bool) (
 	[]*PIndex, []*RemotePlanPIndex, []string, error) {
+	if spec.PartitionSelection != "" {
+		noCache = true
+	}
+
+	if planPIndexFilter != nil {
+		// A registered filter func is cacheable by its name.
+		name, ok := planPIndexFilterName(planPIndexFilter)
+		if ok && (spec.PlanPIndexFilterName == "" ||
+			spec.PlanPIndexFilterName == name) {
+			spec.PlanPIndexFilterName = name
+			planPIndexFilter = nil
+		}
+	}
+
 	var ver uint64
+	var planUUID string
 
 	ppf := planPIndexFilter
 	if ppf == nil {
 		if !noCache {
 			var cp *CoveringPIndexes
 
+			// Load the node defs and plan first, as a refresh of
+			// them changes the cache version.
+			mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+			mgr.GetPlanPIndexes(false)
+
 			mgr.m.Lock()
+			ver = mgr.coveringCacheVerLOCKED()
+			if mgr.lastPlanPIndexes != nil {
+				planUUID = mgr.lastPlanPIndexes.UUID
+			}
 			if mgr.coveringCache != nil {
 				cp = mgr.coveringCache[spec]
-				ver = mgr.coveringCacheVerLOCKED()
 			}
 			mgr.m.Unlock()
 
-			if cp != nil {
+			if cp != nil && cp.planUUID == planUUID {
+				atomic.AddUint64(&mgr.stats.TotCoveringCacheHit, 1)
+
 				return cp.LocalPIndexes, cp.RemotePlanPIndexes, cp.MissingPIndexNames, nil
 			}
+
+			atomic.AddUint64(&mgr.stats.TotCoveringCacheMiss, 1)
 		}
 
 		ppf = PlanPIndexFilters[spec.PlanPIndexFilterName]
 	}
 
 	localPIndexes, remotePlanPIndexes, missingPIndexNames, err :=
-		mgr.coveringPIndexesEx(spec.IndexName, spec.IndexUUID, ppf)
+		mgr.coveringPIndexesEx(spec, ppf)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -340,6 +490,7 @@ func (mgr *Manager) CoveringPIndexesEx(spec CoveringPIndexesSpec,
 			LocalPIndexes:      localPIndexes,
 			RemotePlanPIndexes: remotePlanPIndexes,
 			MissingPIndexNames: missingPIndexNames,
+			planUUID:           planUUID,
 		}
 
 		mgr.m.Lock()
@@ -355,12 +506,39 @@ func (mgr *Manager) CoveringPIndexesEx(spec CoveringPIndexesSpec,
 	return localPIndexes, remotePlanPIndexes, missingPIndexNames, err
 }
 
-func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
+// planPIndexFilterName returns the registered name of a
+// PlanPIndexFilter func, if any.  Closures are never matched, as
+// closures of the same func literal share their code pointer.
+func planPIndexFilterName(ppf PlanPIndexFilter) (string, bool) {
+	p := reflect.ValueOf(ppf).Pointer()
+
+	f := runtime.FuncForPC(p)
+	if f == nil || strings.Contains(f.Name(), ".func") {
+		return "", false
+	}
+
+	for name, f := range PlanPIndexFilters {
+		if reflect.ValueOf(f).Pointer() == p {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (mgr *Manager) coveringPIndexesEx(spec CoveringPIndexesSpec,
 	planPIndexFilter PlanPIndexFilter) (
 	localPIndexes []*PIndex,
 	remotePlanPIndexes []*RemotePlanPIndex,
 	missingPIndexNames []string,
 	err error) {
+	indexName, indexUUID := spec.IndexName, spec.IndexUUID
+
+	if !ValidPartitionSelection(spec.PartitionSelection) {
+		return nil, nil, nil,
+			fmt.Errorf("pindex: unknown partitionSelection: %s",
+				spec.PartitionSelection)
+	}
+
 	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
 	if err != nil {
 		return nil, nil, nil,
@@ -368,10 +546,11 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 				" err: %v", err)
 	}
 
-	// Returns true if the node has the "pindex" tag.
+	// Returns true if the node has the "pindex" tag, and is not a
+	// standby node, as standby nodes serve no queries.
 	nodeDoesPIndexes := func(nodeUUID string) (*NodeDef, bool) {
 		nodeDef, ok := nodeDefs.NodeDefs[nodeUUID]
-		if ok && nodeDef.UUID == nodeUUID {
+		if ok && nodeDef.UUID == nodeUUID && !NodeDefIsStandby(nodeDef) {
 			if len(nodeDef.Tags) <= 0 {
 				return nodeDef, true
 			}
@@ -398,6 +577,9 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 				indexName)
 	}
 
+	planPIndexes, indexUUID = mgr.servingPlanPIndexes(indexName,
+		indexUUID, planPIndexes)
+
 	localPIndexes = make([]*PIndex, 0, len(planPIndexes))
 	remotePlanPIndexes = make([]*RemotePlanPIndex, 0, len(planPIndexes))
 	missingPIndexNames = make([]string, 0)
@@ -406,10 +588,37 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 
 	selfUUID := mgr.UUID()
 
+	warmupGating := !spec.IncludeWarmingUp &&
+		mgr.Options()["pindexWarmupGating"] == "true"
+
+	var wantSourcePartitions, wantPIndexNames map[string]bool
+	if spec.SourcePartitions != "" {
+		wantSourcePartitions =
+			StringsToMap(strings.Split(spec.SourcePartitions, ","))
+	}
+	if spec.PIndexNames != "" {
+		wantPIndexNames = StringsToMap(strings.Split(spec.PIndexNames, ","))
+	}
+
+	numTargeted := 0
+
 	for _, planPIndex := range planPIndexes {
+		if wantPIndexNames != nil && !wantPIndexNames[planPIndex.Name] {
+			continue
+		}
+		if wantSourcePartitions != nil &&
+			!planPIndexCoversAny(planPIndex, wantSourcePartitions) {
+			continue
+		}
+
+		numTargeted++
+
 		lowestNodePriority := math.MaxInt64
 		var lowestNode *NodeDef
 
+		// All the usable nodes, for balanced partition selection.
+		var candidates []*NodeDef
+
 		// look through each of the nodes
 		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
 			// if node is local, do additional checks
@@ -421,14 +630,22 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 					localPIndex != nil &&
 					localPIndex.Name == planPIndex.Name &&
 					localPIndex.IndexName == indexName &&
-					(indexUUID == "" || localPIndex.IndexUUID == indexUUID) {
+					(indexUUID == "" || localPIndex.IndexUUID == indexUUID) &&
+					(!warmupGating || mgr.IsPIndexWarm(planPIndex.Name)) {
 					nodeLocalOK = true
 				}
 			}
 
-			// node does pindexes and it is wanted
+			// node does pindexes, it is wanted, and it's not dead
 			if nodeDef, ok := nodeDoesPIndexes(nodeUUID); ok &&
-				planPIndexFilter(planPIndexNode) {
+				NodeDefSupportsIndexType(nodeDef, planPIndex.IndexType) &&
+				planPIndexFilter(planPIndexNode) &&
+				(nodeLocal || mgr.IsNodeAlive(nodeUUID)) {
+				if spec.PartitionSelection != "" &&
+					(!nodeLocal || nodeLocalOK) {
+					candidates = append(candidates, nodeDef)
+				}
+
 				if planPIndexNode.Priority < lowestNodePriority {
 					// candidate node has lower priority
 					if !nodeLocal || (nodeLocal && nodeLocalOK) {
@@ -445,6 +662,11 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 			}
 		}
 
+		if len(candidates) > 1 {
+			lowestNode = mgr.selectBalancedNode(spec.PartitionSelection,
+				candidates)
+		}
+
 		// now add the node we found to the correct list
 		if lowestNode == nil {
 			// couldn't find anyone with this pindex
@@ -463,15 +685,72 @@ func (mgr *Manager) coveringPIndexesEx(indexName, indexUUID string,
 		}
 	}
 
+	if numTargeted <= 0 {
+		return nil, nil, nil,
+			fmt.Errorf("pindex: no planPIndexes for indexName: %s,"+
+				" sourcePartitions: %s, pindexNames: %s",
+				indexName, spec.SourcePartitions, spec.PIndexNames)
+	}
+
 	return localPIndexes, remotePlanPIndexes, missingPIndexNames, nil
 }
 
+// servingPlanPIndexes returns the plan pindexes of the generation of
+// an index that serves queries, which is the previous generation
+// while the index is being re-split (see PlanResplit), along with the
+// index UUID to match against local pindexes.
+func (mgr *Manager) servingPlanPIndexes(indexName, indexUUID string,
+	planPIndexes []*PlanPIndex) ([]*PlanPIndex, string) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil || indexDefsByName[indexName] == nil {
+		return planPIndexes, indexUUID
+	}
+	indexDef := indexDefsByName[indexName]
+
+	servingUUID := indexDef.UUID
+	if indexDef.PlanParams.Resplit != nil {
+		servingUUID = indexDef.PlanParams.Resplit.PrevIndexUUID
+	}
+
+	rv := make([]*PlanPIndex, 0, len(planPIndexes))
+	for _, planPIndex := range planPIndexes {
+		if planPIndex.IndexUUID == servingUUID {
+			rv = append(rv, planPIndex)
+		}
+	}
+	if len(rv) <= 0 {
+		// The plan hasn't caught up yet with an updated index
+		// definition.
+		return planPIndexes, indexUUID
+	}
+
+	if indexUUID == indexDef.UUID {
+		indexUUID = servingUUID
+	}
+
+	return rv, indexUUID
+}
+
+// planPIndexCoversAny returns true if the plan pindex has any of the
+// given source partitions.
+func planPIndexCoversAny(planPIndex *PlanPIndex,
+	sourcePartitions map[string]bool) bool {
+	for _, partition := range strings.Split(planPIndex.SourcePartitions, ",") {
+		if sourcePartitions[partition] {
+			return true
+		}
+	}
+	return false
+}
+
 // coveringCacheVerLOCKED computes a CAS-like number that can be
 // quickly compared to see if any inputs to the covering pindexes
 // computation have changed.
 func (mgr *Manager) coveringCacheVerLOCKED() uint64 {
 	return mgr.stats.TotRefreshLastNodeDefs +
 		mgr.stats.TotRefreshLastPlanPIndexes +
+		mgr.stats.TotRefreshNodeLiveness +
+		mgr.stats.TotRefreshPIndexWarmup +
 		mgr.stats.TotRegisterPIndex +
 		mgr.stats.TotUnregisterPIndex
 }
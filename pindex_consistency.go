@@ -12,21 +12,41 @@
 package cbgt
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
+// The consistency levels of a ConsistencyParams.
+const CONSISTENCY_LEVEL_AT_PLUS = "at_plus"
+const CONSISTENCY_LEVEL_REQUEST_PLUS = "request_plus"
+
 // ConsistencyParams represent the consistency requirements of a
 // client's request.
 type ConsistencyParams struct {
 	// A Level value of "" means stale is ok; "at_plus" means we need
 	// consistency at least at or beyond the consistency vector but
-	// not before.
+	// not before; "request_plus" means we need consistency at least
+	// at or beyond the data source's seqs at the time of the request,
+	// and must be resolved into "at_plus" via
+	// Manager.ResolveConsistencyParams() before waiting.
 	Level string `json:"level"`
 
 	// Keyed by indexName.
 	Vectors map[string]ConsistencyVector `json:"vectors"`
+
+	// When > 0, the max time in milliseconds to wait for each
+	// partition to reach its seq, after which the wait fails with an
+	// ErrorConsistencyWait that describes the lagging partitions.
+	PartitionTimeoutMS int64 `json:"partitionTimeoutMS,omitempty"`
 }
 
 // Key is partition or partition/partitionUUID.  Value is seq.
@@ -34,6 +54,48 @@ type ConsistencyParams struct {
 // "vbucketId" or "vbucketId/vbucketUUID".
 type ConsistencyVector map[string]uint64
 
+// A MutationToken identifies a mutation in a couchbase data source,
+// in the JSON format of the mutation tokens of the Couchbase SDK's.
+type MutationToken struct {
+	VBucketId   uint16 `json:"vbid"`
+	VBucketUUID uint64 `json:"vbuuid"`
+	Seq         uint64 `json:"seqno"`
+}
+
+// MutationTokensConsistencyVector converts mutation tokens into a
+// consistency vector, keyed by "vbucketId/vbucketUUID" (or just by
+// "vbucketId" when a token has no vbucketUUID), keeping the highest
+// seq of the tokens for a key.
+func MutationTokensConsistencyVector(
+	mutationTokens []MutationToken) ConsistencyVector {
+	rv := ConsistencyVector{}
+	for _, mt := range mutationTokens {
+		k := strconv.Itoa(int(mt.VBucketId))
+		if mt.VBucketUUID != 0 {
+			k = k + "/" + strconv.FormatUint(mt.VBucketUUID, 10)
+		}
+		if mt.Seq > rv[k] {
+			rv[k] = mt.Seq
+		}
+	}
+	return rv
+}
+
+// MutationTokensConsistencyParams returns "at_plus" consistency
+// params, so that queries on the given indexes will see at least the
+// mutations of the mutation tokens.
+func MutationTokensConsistencyParams(indexNames []string,
+	mutationTokens []MutationToken) *ConsistencyParams {
+	rv := &ConsistencyParams{
+		Level:   CONSISTENCY_LEVEL_AT_PLUS,
+		Vectors: map[string]ConsistencyVector{},
+	}
+	for _, indexName := range indexNames {
+		rv.Vectors[indexName] = MutationTokensConsistencyVector(mutationTokens)
+	}
+	return rv
+}
+
 // ConsistencyWaiter interface represents a service that can wait for
 // consistency.
 type ConsistencyWaiter interface {
@@ -61,13 +123,111 @@ type ErrorConsistencyWait struct {
 
 	// Keyed by partitionId, value is pair of start/end seq's.
 	StartEndSeqs map[string][]uint64
+
+	// Keyed by partitionId, the partitions that didn't reach their
+	// required seq, when known.
+	Lagging map[string]*ConsistencyLag
 }
 
 func (e *ErrorConsistencyWait) Error() string {
+	if len(e.Lagging) > 0 {
+		lagging := make([]string, 0, len(e.Lagging))
+		for partition, lag := range e.Lagging {
+			lagging = append(lagging, fmt.Sprintf("%s: %d < %d (%.1f/s)",
+				partition, lag.CurrSeq, lag.WantSeq, lag.SeqsPerSec))
+		}
+		sort.Strings(lagging)
+
+		return fmt.Sprintf("ErrorConsistencyWait, status: %s,"+
+			" lagging: [%s], err: %v",
+			e.Status, strings.Join(lagging, ", "), e.Err)
+	}
+
 	return fmt.Sprintf("ErrorConsistencyWait, startEndSeqs: %#v,"+
 		" err: %v", e.StartEndSeqs, e.Err)
 }
 
+// A ConsistencyLag describes a partition that didn't reach its
+// required seq during a consistency wait.
+type ConsistencyLag struct {
+	CurrSeq uint64 `json:"currSeq"`
+	WantSeq uint64 `json:"wantSeq"`
+
+	// The observed ingest rate of the partition during the wait.
+	SeqsPerSec float64 `json:"seqsPerSec"`
+}
+
+// ---------------------------------------------------------
+
+// ResolveConsistencyParams returns the consistency params of a
+// request on an index, where a "request_plus" level is converted into
+// an "at_plus" level with a consistency vector of the data source's
+// current partition seqs, merged with any vector that the request
+// already had.  Other levels are returned as is.
+func (mgr *Manager) ResolveConsistencyParams(indexName string,
+	consistencyParams *ConsistencyParams) (*ConsistencyParams, error) {
+	if consistencyParams == nil ||
+		consistencyParams.Level != CONSISTENCY_LEVEL_REQUEST_PLUS {
+		return consistencyParams, nil
+	}
+
+	indexDef, _, err := mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	feedType, exists := FeedTypes[indexDef.SourceType]
+	if !exists || feedType == nil || feedType.PartitionSeqs == nil {
+		return nil, fmt.Errorf("pindex_consistency: request_plus"+
+			" unsupported, indexName: %s, sourceType: %s",
+			indexName, indexDef.SourceType)
+	}
+
+	partitionSeqs, err := feedType.PartitionSeqs(indexDef.SourceType,
+		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		mgr.server, mgr.Options())
+	if err != nil {
+		return nil, fmt.Errorf("pindex_consistency: request_plus"+
+			" PartitionSeqs, indexName: %s, err: %v", indexName, err)
+	}
+
+	// The vector is keyed only by partition, as a partition's UUID
+	// changes on failover and the dest might not have seen it yet.
+	consistencyVector := ConsistencyVector{}
+	for k, seq := range consistencyParams.Vectors[indexName] {
+		consistencyVector[k] = seq
+	}
+	for partition, uuidSeq := range partitionSeqs {
+		if uuidSeq.Seq > consistencyVector[partition] {
+			consistencyVector[partition] = uuidSeq.Seq
+		}
+	}
+
+	vectors := map[string]ConsistencyVector{}
+	for k, v := range consistencyParams.Vectors {
+		vectors[k] = v
+	}
+	vectors[indexName] = consistencyVector
+
+	return &ConsistencyParams{
+		Level:              CONSISTENCY_LEVEL_AT_PLUS,
+		Vectors:            vectors,
+		PartitionTimeoutMS: consistencyParams.PartitionTimeoutMS,
+	}, nil
+}
+
+// errConsistencyUnresolved returns an error if the consistency params
+// have a level that must be resolved before waiting, rather than
+// silently not waiting.
+func errConsistencyUnresolved(consistencyParams *ConsistencyParams) error {
+	if consistencyParams != nil &&
+		consistencyParams.Level == CONSISTENCY_LEVEL_REQUEST_PLUS {
+		return fmt.Errorf("pindex_consistency: request_plus consistency" +
+			" must be resolved via ResolveConsistencyParams()")
+	}
+	return nil
+}
+
 // ---------------------------------------------------------
 
 // ConsistencyWaitDone() waits for either the cancelCh or doneCh to
@@ -100,13 +260,29 @@ func ConsistencyWaitDone(partition string,
 // reach the required consistency level.
 func ConsistencyWaitPIndex(pindex *PIndex, t ConsistencyWaiter,
 	consistencyParams *ConsistencyParams, cancelCh <-chan bool) error {
+	if err := errConsistencyUnresolved(consistencyParams); err != nil {
+		return err
+	}
+
 	if consistencyParams != nil &&
 		consistencyParams.Level != "" &&
 		consistencyParams.Vectors != nil {
 		consistencyVector := consistencyParams.Vectors[pindex.IndexName]
 		if consistencyVector != nil {
-			err := ConsistencyWaitPartitions(t, pindex.sourcePartitionsMap,
-				consistencyParams.Level, consistencyVector, cancelCh)
+			startTime := time.Now()
+
+			err := ConsistencyWaitPartitionsDeadline(t,
+				pindex.sourcePartitionsMap,
+				consistencyParams.Level, consistencyVector,
+				consistencyParams.partitionTimeout(), cancelCh)
+
+			pindex.ConsistencyWaitStats().Record(startTime, err)
+
+			LogDebugf("pindex", "pindex_consistency: waited,"+
+				" pindex: %s, level: %s, duration: %v, err: %v",
+				pindex.Name, consistencyParams.Level,
+				time.Since(startTime), err)
+
 			if err != nil {
 				return err
 			}
@@ -121,6 +297,10 @@ func ConsistencyWaitGroup(indexName string,
 	consistencyParams *ConsistencyParams, cancelCh <-chan bool,
 	localPIndexes []*PIndex,
 	addLocalPIndex func(*PIndex) error) error {
+	if err := errConsistencyUnresolved(consistencyParams); err != nil {
+		return err
+	}
+
 	var errConsistencyM sync.Mutex
 	var errConsistency error
 
@@ -142,11 +322,18 @@ func ConsistencyWaitGroup(indexName string,
 					consistencyVector map[string]uint64) {
 					defer wg.Done()
 
-					err := ConsistencyWaitPartitions(localPIndex.Dest,
+					startTime := time.Now()
+
+					err := ConsistencyWaitPartitionsDeadline(
+						localPIndex.Dest,
 						localPIndex.sourcePartitionsMap,
 						consistencyParams.Level,
 						consistencyVector,
+						consistencyParams.partitionTimeout(),
 						cancelCh)
+
+					localPIndex.ConsistencyWaitStats().Record(startTime, err)
+
 					if err != nil {
 						errConsistencyM.Lock()
 						errConsistency = err
@@ -181,6 +368,55 @@ func ConsistencyWaitGroup(indexName string,
 	return nil
 }
 
+// ConsistencyWaitPIndexCtx is like ConsistencyWaitPIndex(), but
+// waits until the ctx is done instead of until a cancelCh is closed.
+func ConsistencyWaitPIndexCtx(ctx context.Context, pindex *PIndex,
+	t ConsistencyWaiter, consistencyParams *ConsistencyParams) error {
+	cancelCh, stop := ContextCancelChan(ctx)
+	defer stop()
+
+	return consistencyCtxErr(ctx,
+		ConsistencyWaitPIndex(pindex, t, consistencyParams, cancelCh))
+}
+
+// ConsistencyWaitGroupCtx is like ConsistencyWaitGroup(), but waits
+// until the ctx is done instead of until a cancelCh is closed.
+func ConsistencyWaitGroupCtx(ctx context.Context, indexName string,
+	consistencyParams *ConsistencyParams, localPIndexes []*PIndex,
+	addLocalPIndex func(*PIndex) error) error {
+	cancelCh, stop := ContextCancelChan(ctx)
+	defer stop()
+
+	return consistencyCtxErr(ctx,
+		ConsistencyWaitGroup(indexName, consistencyParams, cancelCh,
+			localPIndexes, addLocalPIndex))
+}
+
+// ConsistencyWaitCtx waits for a partition of a ConsistencyWaiter,
+// such as a Dest, to reach the required consistency level, until the
+// ctx is done.
+func ConsistencyWaitCtx(ctx context.Context, t ConsistencyWaiter,
+	partition, partitionUUID string,
+	consistencyLevel string, consistencySeq uint64) error {
+	cancelCh, stop := ContextCancelChan(ctx)
+	defer stop()
+
+	return consistencyCtxErr(ctx,
+		t.ConsistencyWait(partition, partitionUUID,
+			consistencyLevel, consistencySeq, cancelCh))
+}
+
+// consistencyCtxErr marks a cancelled ErrorConsistencyWait as a
+// timeout when the ctx's deadline was exceeded.
+func consistencyCtxErr(ctx context.Context, err error) error {
+	ecw, ok := err.(*ErrorConsistencyWait)
+	if ok && ecw.Status == "cancelled" &&
+		ctx.Err() == context.DeadlineExceeded {
+		ecw.Status = "timeout"
+	}
+	return err
+}
+
 // ConsistencyWaitPartitions waits for the given partitions to reach
 // the required consistency level.
 func ConsistencyWaitPartitions(
@@ -189,6 +425,52 @@ func ConsistencyWaitPartitions(
 	consistencyLevel string,
 	consistencyVector map[string]uint64,
 	cancelCh <-chan bool) error {
+	return ConsistencyWaitPartitionsDeadline(t, partitions,
+		consistencyLevel, consistencyVector, 0, cancelCh)
+}
+
+// ConsistencyWaitPartitionsDeadline waits concurrently for the given
+// partitions to reach the required consistency level, where each
+// partition's wait is cancelled after the partitionTimeout, if > 0.
+// When partitions time out or are cancelled, the returned
+// ErrorConsistencyWait has the seqs and ingest rates of all the
+// lagging partitions.  Any other error cancels the waits of the other
+// partitions and is returned right away.
+func ConsistencyWaitPartitionsDeadline(
+	t ConsistencyWaiter,
+	partitions map[string]bool,
+	consistencyLevel string,
+	consistencyVector map[string]uint64,
+	partitionTimeout time.Duration,
+	cancelCh <-chan bool) error {
+	type waitResult struct {
+		wantSeq  uint64
+		elapsed  time.Duration
+		timedOut bool
+		err      error
+	}
+
+	resultCh := make(chan waitResult, len(consistencyVector))
+
+	// Closed on the first error that isn't a lagging partition, to
+	// cancel the waits of the other partitions.
+	abortCh := make(chan bool)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	waitAllCh := make(chan bool)
+	go func() {
+		select {
+		case <-cancelCh:
+		case <-abortCh:
+		case <-doneCh:
+			return
+		}
+		close(waitAllCh)
+	}()
+
+	numWaits := 0
+
 	// Key of consistencyVector looks like either just "partition" or
 	// like "partition/partitionUUID".
 	for k, consistencySeq := range consistencyVector {
@@ -201,17 +483,114 @@ func ConsistencyWaitPartitions(
 				if len(arr) > 1 {
 					partitionUUID = arr[1]
 				}
-				err := t.ConsistencyWait(partition, partitionUUID,
-					consistencyLevel, consistencySeq, cancelCh)
-				if err != nil {
-					return err
-				}
+
+				numWaits++
+				go func(partition, partitionUUID string,
+					consistencySeq uint64) {
+					waitCancelCh := waitAllCh
+					var timedOut int32
+
+					if partitionTimeout > 0 {
+						deadlineCh := make(chan bool)
+						doneCh := make(chan struct{})
+						defer close(doneCh)
+
+						timer := time.NewTimer(partitionTimeout)
+						defer timer.Stop()
+
+						go func() {
+							select {
+							case <-timer.C:
+								atomic.StoreInt32(&timedOut, 1)
+								close(deadlineCh)
+							case <-waitAllCh:
+								close(deadlineCh)
+							case <-doneCh:
+							}
+						}()
+
+						waitCancelCh = deadlineCh
+					}
+
+					startTime := time.Now()
+
+					err := t.ConsistencyWait(partition, partitionUUID,
+						consistencyLevel, consistencySeq, waitCancelCh)
+
+					resultCh <- waitResult{
+						wantSeq:  consistencySeq,
+						elapsed:  time.Since(startTime),
+						timedOut: atomic.LoadInt32(&timedOut) != 0,
+						err:      err,
+					}
+				}(partition, partitionUUID, consistencySeq)
 			}
 		}
 	}
+
+	var errWait *ErrorConsistencyWait
+
+	for i := 0; i < numWaits; i++ {
+		result := <-resultCh
+		if result.err == nil {
+			continue
+		}
+
+		ecw, ok := result.err.(*ErrorConsistencyWait)
+		if !ok {
+			close(abortCh)
+			return result.err
+		}
+
+		if errWait == nil {
+			errWait = &ErrorConsistencyWait{
+				Err:          ecw.Err,
+				Status:       ecw.Status,
+				StartEndSeqs: map[string][]uint64{},
+				Lagging:      map[string]*ConsistencyLag{},
+			}
+		}
+
+		if result.timedOut && errWait.Status != "timeout" {
+			errWait.Status = "timeout"
+			errWait.Err = fmt.Errorf("pindex_consistency:" +
+				" partition consistency wait deadline exceeded")
+		}
+
+		for partition, startEndSeqs := range ecw.StartEndSeqs {
+			errWait.StartEndSeqs[partition] = startEndSeqs
+
+			if len(startEndSeqs) < 2 {
+				continue
+			}
+
+			lag := &ConsistencyLag{
+				CurrSeq: startEndSeqs[1],
+				WantSeq: result.wantSeq,
+			}
+			if startEndSeqs[1] > startEndSeqs[0] &&
+				result.elapsed > 0 {
+				lag.SeqsPerSec = float64(startEndSeqs[1]-startEndSeqs[0]) /
+					result.elapsed.Seconds()
+			}
+			errWait.Lagging[partition] = lag
+		}
+	}
+
+	if errWait != nil {
+		return errWait
+	}
 	return nil
 }
 
+// partitionTimeout returns the PartitionTimeoutMS as a duration.
+func (p *ConsistencyParams) partitionTimeout() time.Duration {
+	if p == nil || p.PartitionTimeoutMS <= 0 {
+		return 0
+	}
+	return time.Duration(p.PartitionTimeoutMS) * time.Millisecond
+}
+
 // ---------------------------------------------------------
 
 // A CwrQueue is a consistency wait request queue, implementing the
@@ -240,3 +619,70 @@ func (pq *CwrQueue) Pop() interface{} {
 	*pq = old[0 : n-1]
 	return item
 }
+
+// ---------------------------------------------------------
+
+// CONSISTENCY_WAIT_IMMEDIATE is the max duration of a successful
+// consistency wait that's counted as satisfied immediately.
+var CONSISTENCY_WAIT_IMMEDIATE = time.Millisecond
+
+// ConsistencyWaitStats tracks the outcomes and latencies of the
+// consistency waits on a pindex.
+type ConsistencyWaitStats struct {
+	TotImmediate uint64 // Satisfied without waiting.
+	TotWaited    uint64 // Satisfied after waiting.
+	TotTimeout   uint64
+	TotCancelled uint64
+	TotError     uint64
+
+	TimerWait metrics.Timer
+}
+
+// NewConsistencyWaitStats creates a new, ready-to-use
+// ConsistencyWaitStats.
+func NewConsistencyWaitStats() *ConsistencyWaitStats {
+	return &ConsistencyWaitStats{
+		TimerWait: metrics.NewTimer(),
+	}
+}
+
+// Record tracks the outcome of a consistency wait that was started
+// at startTime.
+func (s *ConsistencyWaitStats) Record(startTime time.Time, err error) {
+	elapsed := time.Since(startTime)
+
+	s.TimerWait.Update(elapsed)
+
+	if err == nil {
+		if elapsed <= CONSISTENCY_WAIT_IMMEDIATE {
+			atomic.AddUint64(&s.TotImmediate, 1)
+		} else {
+			atomic.AddUint64(&s.TotWaited, 1)
+		}
+		return
+	}
+
+	ecw, ok := err.(*ErrorConsistencyWait)
+	if ok && ecw.Status == "timeout" {
+		atomic.AddUint64(&s.TotTimeout, 1)
+	} else if ok && ecw.Status == "cancelled" {
+		atomic.AddUint64(&s.TotCancelled, 1)
+	} else {
+		atomic.AddUint64(&s.TotError, 1)
+	}
+}
+
+func (s *ConsistencyWaitStats) WriteJSON(w io.Writer) {
+	fmt.Fprintf(w, `{"TotImmediate":%d,"TotWaited":%d,`+
+		`"TotTimeout":%d,"TotCancelled":%d,"TotError":%d`,
+		atomic.LoadUint64(&s.TotImmediate),
+		atomic.LoadUint64(&s.TotWaited),
+		atomic.LoadUint64(&s.TotTimeout),
+		atomic.LoadUint64(&s.TotCancelled),
+		atomic.LoadUint64(&s.TotError))
+
+	w.Write([]byte(`,"TimerWait":`))
+	WriteTimerJSON(w, s.TimerWait)
+
+	w.Write(JsonCloseBrace)
+}
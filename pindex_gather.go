@@ -0,0 +1,292 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager.Gather() is a shared scatter-gather engine for index types,
+// which handles the covering pindex selection, the batched queries of
+// remote pindexes, consistency waits and errors, so that an index
+// type need only provide a Merger of its per-pindex query results,
+// via PIndexImplType.NewMerger, and register GatherQueryCtx as its
+// QueryCtx.
+
+// A Merger merges the per-pindex query results of a scatter-gather
+// into a single query response.  Add() is not invoked concurrently.
+type Merger interface {
+	// Add merges the JSON query result of a pindex.  An error marks
+	// the pindex as failed.
+	Add(pindexName string, result json.RawMessage) error
+
+	// Finish writes the merged response, such as by streaming it, and
+	// may fail the query based on the status, such as when some
+	// pindexes failed.
+	Finish(res io.Writer, status *GatherStatus) error
+}
+
+// GatherStatus describes the outcome of a scatter-gather across the
+// pindexes of an index.
+type GatherStatus struct {
+	Total      int `json:"total"`
+	Failed     int `json:"failed"`
+	Successful int `json:"successful"`
+
+	// Keyed by pindex name.
+	Errors map[string]string `json:"errors,omitempty"`
+
+	// The pindexes that were answered while stale, per the "flag"
+	// policy of QueryCtl.StalenessPolicy.
+	Stale []string `json:"stale,omitempty"`
+}
+
+// GatherHttpDo is used to issue the http requests to remote nodes of
+// a Gather(), and may be overridden such as for testing or auth.
+var GatherHttpDo = http.DefaultClient.Do
+
+// GatherQueryCtx queries an index via Manager.Gather(), and has the
+// signature of a PIndexImplType.QueryCtx.
+func GatherQueryCtx(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string, req []byte, res io.Writer) error {
+	return mgr.Gather(ctx, indexName, indexUUID, req, res)
+}
+
+// Gather queries the covering pindexes of an index, both local and
+// remote, and merges their results via the Merger from the index
+// type's NewMerger().  The query request's "ctl" controls the
+// timeout, consistency, staleness and pindex targeting.  A failed
+// consistency wait fails the whole query, while other failures of
+// pindexes are left to the Merger's Finish().
+func (mgr *Manager) Gather(ctx context.Context, indexName, indexUUID string,
+	req []byte, res io.Writer) error {
+	_, pindexImplType, err := GetIndexDef(mgr.cfg, indexName)
+	if err != nil {
+		return err
+	}
+	if pindexImplType.NewMerger == nil {
+		return fmt.Errorf("pindex_gather: NewMerger not supported,"+
+			" indexName: %s", indexName)
+	}
+
+	var queryCtlParams QueryCtlParams
+	err = json.Unmarshal(req, &queryCtlParams)
+	if err != nil {
+		return fmt.Errorf("pindex_gather: could not parse query request,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	ctl := &queryCtlParams.Ctl
+
+	timeoutMS := ctl.Timeout
+	if timeoutMS <= 0 {
+		timeoutMS = QUERY_CTL_DEFAULT_TIMEOUT_MS
+	}
+
+	ctx, cancel := context.WithTimeout(ctx,
+		time.Duration(timeoutMS)*time.Millisecond)
+	defer cancel()
+
+	if ctl.Consistency != nil &&
+		ctl.Consistency.Level == CONSISTENCY_LEVEL_REQUEST_PLUS {
+		// Resolved once, so that all the nodes wait for the same seqs.
+		ctl.Consistency, err =
+			mgr.ResolveConsistencyParams(indexName, ctl.Consistency)
+		if err != nil {
+			return err
+		}
+
+		req, err = replaceQueryCtl(req, ctl)
+		if err != nil {
+			return err
+		}
+	}
+
+	merger, err := pindexImplType.NewMerger(indexName, req)
+	if err != nil {
+		return err
+	}
+
+	localPIndexes, remotePlanPIndexes, missingPIndexNames, err :=
+		mgr.CoveringPIndexesEx(
+			ctl.CoveringPIndexesSpec(indexName, indexUUID, "canRead"),
+			nil, false)
+	if err != nil {
+		return err
+	}
+
+	status := &GatherStatus{
+		Total: len(localPIndexes) + len(remotePlanPIndexes) +
+			len(missingPIndexNames),
+		Errors: map[string]string{},
+	}
+
+	for _, pindexName := range missingPIndexNames {
+		status.Errors[pindexName] = "pindex_gather: no usable node"
+	}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var errConsistency error
+
+	gathered := func(pindexNames []string,
+		results *QueryPIndexesResults, err error) {
+		m.Lock()
+		defer m.Unlock()
+
+		if err != nil {
+			if _, ok := err.(*ErrorConsistencyWait); ok {
+				errConsistency = err
+			}
+			for _, pindexName := range pindexNames {
+				status.Errors[pindexName] = err.Error()
+			}
+			return
+		}
+
+		status.Stale = append(status.Stale, results.Stale...)
+
+		for pindexName, errMsg := range results.Errors {
+			status.Errors[pindexName] = errMsg
+		}
+
+		for pindexName, result := range results.Results {
+			err := merger.Add(pindexName, result)
+			if err != nil {
+				status.Errors[pindexName] = err.Error()
+			}
+		}
+	}
+
+	if len(localPIndexes) > 0 {
+		pindexNames := make([]string, 0, len(localPIndexes))
+		for _, pindex := range localPIndexes {
+			pindexNames = append(pindexNames, pindex.Name)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			results, err := mgr.QueryPIndexes(ctx, indexName, pindexNames, req)
+			gathered(pindexNames, results, err)
+		}()
+	}
+
+	for _, group := range GroupRemotePlanPIndexes(remotePlanPIndexes) {
+		pindexNames := make([]string, 0, len(group.PlanPIndexes))
+		for _, planPIndex := range group.PlanPIndexes {
+			pindexNames = append(pindexNames, planPIndex.Name)
+		}
+
+		wg.Add(1)
+		go func(nodeDef *NodeDef, pindexNames []string) {
+			defer wg.Done()
+
+			results, err := GatherRemoteQuery(ctx, nodeDef,
+				indexName, pindexNames, req)
+			gathered(pindexNames, results, err)
+		}(group.NodeDef, pindexNames)
+	}
+
+	wg.Wait()
+
+	if errConsistency != nil {
+		return errConsistency
+	}
+
+	sort.Strings(status.Stale)
+
+	status.Failed = len(status.Errors)
+	status.Successful = status.Total - status.Failed
+
+	return merger.Finish(res, status)
+}
+
+// GatherRemoteQuery queries some pindexes of an index on a remote
+// node, via the node's /api/index/{indexName}/pindexesQuery endpoint.
+func GatherRemoteQuery(ctx context.Context, nodeDef *NodeDef,
+	indexName string, pindexNames []string, req []byte) (
+	*QueryPIndexesResults, error) {
+	body, err := json.Marshal(struct {
+		PIndexNames []string        `json:"pindexNames"`
+		Query       json.RawMessage `json:"query"`
+	}{
+		PIndexNames: pindexNames,
+		Query:       req,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := "http://" + nodeDef.HostPort + "/api/index/" + indexName +
+		"/pindexesQuery"
+
+	httpReq, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := GatherHttpDo(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pindex_gather: remote node: %s,"+
+			" status code: %d, body: %s",
+			nodeDef.HostPort, resp.StatusCode, respBody)
+	}
+
+	var rv QueryPIndexesResults
+	err = json.Unmarshal(respBody, &rv)
+	if err != nil {
+		return nil, fmt.Errorf("pindex_gather: remote node: %s,"+
+			" could not parse response, err: %v", nodeDef.HostPort, err)
+	}
+
+	return &rv, nil
+}
+
+// replaceQueryCtl returns a copy of a query request with its "ctl"
+// replaced.
+func replaceQueryCtl(req []byte, ctl *QueryCtl) ([]byte, error) {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(req, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	m["ctl"], err = json.Marshal(ctl)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,169 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+type TestDestJSON struct {
+	BlackHole
+}
+
+func (t *TestDestJSON) Query(pindex *PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	_, err := w.Write([]byte(`{"hits":1}`))
+	return err
+}
+
+type TestMerger struct {
+	req  []byte
+	hits int
+}
+
+func (t *TestMerger) Add(pindexName string, result json.RawMessage) error {
+	var r struct {
+		Hits int `json:"hits"`
+	}
+	err := json.Unmarshal(result, &r)
+	t.hits += r.Hits
+	return err
+}
+
+func (t *TestMerger) Finish(res io.Writer, status *GatherStatus) error {
+	if status.Failed > 0 {
+		return fmt.Errorf("failed pindexes: %v", status.Errors)
+	}
+	_, err := fmt.Fprintf(res, `{"hits":%d,"total":%d}`,
+		t.hits, status.Total)
+	return err
+}
+
+func TestGather(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	ctx := context.Background()
+
+	var res bytes.Buffer
+	if err := m.Gather(ctx, "foo", "", []byte(`{}`), &res); err == nil {
+		t.Errorf("expected err without NewMerger")
+	}
+
+	var merger *TestMerger
+
+	blackhole := PIndexImplTypes["blackhole"]
+	blackhole.NewMerger = func(indexName string, req []byte) (
+		Merger, error) {
+		merger = &TestMerger{req: req}
+		return merger, nil
+	}
+	defer func() { blackhole.NewMerger = nil }()
+
+	// The blackhole's empty query results aren't JSON.
+	if err := m.Gather(ctx, "foo", "", []byte(`{}`), &res); err == nil {
+		t.Errorf("expected err from Finish() with failed pindexes")
+	}
+
+	_, pindexes := m.CurrentMaps()
+	for _, pindex := range pindexes {
+		pindex.Dest = &TestDestJSON{}
+	}
+
+	primary := FeedTypes["primary"]
+	primary.PartitionSeqs = func(sourceType, sourceName, sourceUUID,
+		sourceParams, server string, options map[string]string) (
+		map[string]UUIDSeq, error) {
+		return map[string]UUIDSeq{}, nil
+	}
+	defer func() { primary.PartitionSeqs = nil }()
+
+	res.Reset()
+	err := GatherQueryCtx(ctx, m, "foo", "",
+		[]byte(`{"q":1,"ctl":{"consistency":{"level":"request_plus"}}}`),
+		&res)
+	if err != nil || res.String() != `{"hits":1,"total":1}` {
+		t.Errorf("expected merged result, res: %s, err: %v",
+			res.String(), err)
+	}
+	if !strings.Contains(string(merger.req), `"level":"at_plus"`) ||
+		!strings.Contains(string(merger.req), `"q":1`) {
+		t.Errorf("expected resolved consistency, req: %s", merger.req)
+	}
+}
+
+func TestGatherRemoteQuery(t *testing.T) {
+	prevGatherHttpDo := GatherHttpDo
+	defer func() { GatherHttpDo = prevGatherHttpDo }()
+
+	var reqURL string
+	var reqBody []byte
+
+	GatherHttpDo = func(req *http.Request) (*http.Response, error) {
+		reqURL = req.URL.String()
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"results":{"p0":{"hits":2}},"errors":{"p1":"oops"}}`)),
+		}, nil
+	}
+
+	rv, err := GatherRemoteQuery(context.Background(),
+		&NodeDef{HostPort: "10.0.0.1:8094"}, "foo",
+		[]string{"p0", "p1"}, []byte(`{"q":1}`))
+	if err != nil || string(rv.Results["p0"]) != `{"hits":2}` ||
+		rv.Errors["p1"] != "oops" {
+		t.Errorf("expected remote results, rv: %#v, err: %v", rv, err)
+	}
+	if reqURL != "http://10.0.0.1:8094/api/index/foo/pindexesQuery" ||
+		string(reqBody) != `{"pindexNames":["p0","p1"],"query":{"q":1}}` {
+		t.Errorf("unexpected request, url: %s, body: %s", reqURL, reqBody)
+	}
+
+	GatherHttpDo = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       ioutil.NopCloser(strings.NewReader(`bad`)),
+		}, nil
+	}
+
+	_, err = GatherRemoteQuery(context.Background(),
+		&NodeDef{HostPort: "10.0.0.1:8094"}, "foo",
+		[]string{"p0"}, []byte(`{}`))
+	if err == nil {
+		t.Errorf("expected err on a remote error status")
+	}
+}
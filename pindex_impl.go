@@ -12,10 +12,15 @@
 package cbgt
 
 import (
+	"bytes"
 	"container/list"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -46,16 +51,66 @@ type PIndexImplType struct {
 	Open func(indexType, path string, restart func()) (
 		PIndexImpl, Dest, error)
 
+	// Optional, like Open(), but the reloaded pindex instance uses
+	// the given, updated indexParams.  See AnalyzeIndexParamsUpdate.
+	OpenUsing func(indexType, path, indexParams string, restart func()) (
+		PIndexImpl, Dest, error)
+
+	// Optional, invoked by the janitor when an index's params have
+	// changed, to decide whether the index's existing pindexes can be
+	// restarted via OpenUsing() with the next indexParams, returning
+	// PINDEXES_RESTART, or need to be rebuilt from scratch, returning
+	// PINDEXES_REBUILD.  When nil, the pindexes are rebuilt.
+	AnalyzeIndexParamsUpdate func(indexType,
+		prevIndexParams, nextIndexParams string) string
+
 	// Invoked by the manager when it wants a count of documents from
 	// an index.  The registered Count() function can be nil.
 	Count func(mgr *Manager, indexName, indexUUID string) (
 		uint64, error)
 
+	// Optional, invoked instead of Count() with a ctx whose
+	// cancellation or deadline should be honored.
+	CountCtx func(ctx context.Context, mgr *Manager,
+		indexName, indexUUID string) (uint64, error)
+
 	// Invoked by the manager when it wants to query an index.  The
 	// registered Query() function can be nil.
 	Query func(mgr *Manager, indexName, indexUUID string,
 		req []byte, res io.Writer) error
 
+	// Optional, invoked instead of Query() when the query is
+	// cancelable, where the query should stop its work, such as a
+	// scatter-gather across pindexes, when the cancelCh is closed.
+	QueryEx func(mgr *Manager, indexName, indexUUID string,
+		req []byte, res io.Writer, cancelCh <-chan bool) error
+
+	// Optional, invoked instead of QueryEx() or Query() with a ctx
+	// whose cancellation or deadline should be honored.
+	QueryCtx func(ctx context.Context, mgr *Manager,
+		indexName, indexUUID string, req []byte, res io.Writer) error
+
+	// Optional, invoked by Manager.Gather() at the start of a query to
+	// create the Merger of the query's per-pindex results, which
+	// allows an index type to use GatherQueryCtx as its QueryCtx
+	// instead of its own scatter-gather.
+	NewMerger func(indexName string, req []byte) (Merger, error)
+
+	// Optional, invoked by the manager to count the documents of all
+	// the targets of an index alias that are indexes of this type at
+	// once, such as via a bleve.IndexAlias.  When nil, each target is
+	// counted on its own.  See Manager.CountAlias().
+	AliasCount func(ctx context.Context, mgr *Manager,
+		targets []AliasTarget) (uint64, error)
+
+	// Optional, invoked by the manager to query all the targets of an
+	// index alias that are indexes of this type, gathering and merging
+	// their results into a single response.  When nil, only an alias
+	// with a single target of this type can be queried.  See
+	// Manager.QueryAlias().
+	AliasQuery func(ctx context.Context, mgr *Manager,
+		targets []AliasTarget, req []byte, res io.Writer) error
+
 	// Description is used to populate docs, UI, etc, such as index
 	// type drop-down control in the web admin UI.  Format of the
 	// description string:
@@ -92,6 +147,81 @@ type PIndexImplType struct {
 	// Optional, allows pindex implementation to specify advanced UI
 	// implementations and information.
 	UI map[string]string
+
+	// Optional, invoked by the manager to run a generic task on an
+	// index, like a compaction, merge or backup, where the
+	// requestBody is a JSON object that describes the task.  The
+	// returned status may be for a task that's still running, whose
+	// later progress the implementation can report via
+	// Manager.UpdateTaskRequestStatus().  See Manager.SubmitTask().
+	SubmitTaskRequest func(mgr *Manager, indexName, indexUUID, taskID string,
+		requestBody []byte) (*TaskRequestStatus, error)
+
+	// Optional, invoked by the manager to return what a pindex stores
+	// for a document, such as its stored fields or back index
+	// entries, which helps when debugging why a document isn't
+	// indexed.  The returned value must be JSON encodable, and may be
+	// nil when the pindex has nothing for the document.  See
+	// Manager.LookUpDoc().
+	DocLookUp func(pindex *PIndex, docID string) (interface{}, error)
+
+	// Optional, invoked by the manager when it wants a pindex
+	// implementation to check the integrity of a pindex's storage,
+	// such as its storage file structures.  See VerifyPIndex().
+	Verify func(pindex *PIndex) error
+}
+
+// CanQuery returns true if the pindex implementation type supports
+// queries.
+func (t *PIndexImplType) CanQuery() bool {
+	return t.QueryCtx != nil || t.QueryEx != nil || t.Query != nil
+}
+
+// QueryContext queries an index using the most capable query func of
+// the pindex implementation type, where the ctx's cancellation is
+// propagated to QueryEx() as its cancelCh.  The ctx isn't honored by
+// a plain Query().
+func (t *PIndexImplType) QueryContext(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string, req []byte, res io.Writer) error {
+	if t.QueryCtx != nil {
+		return t.QueryCtx(ctx, mgr, indexName, indexUUID, req, res)
+	}
+
+	if t.QueryEx != nil {
+		cancelCh, stop := ContextCancelChan(ctx)
+		defer stop()
+
+		return t.QueryEx(mgr, indexName, indexUUID, req, res, cancelCh)
+	}
+
+	if t.Query != nil {
+		return t.Query(mgr, indexName, indexUUID, req, res)
+	}
+
+	return fmt.Errorf("pindex_impl: Query not supported, indexName: %s",
+		indexName)
+}
+
+// CanCount returns true if the pindex implementation type supports
+// counts.
+func (t *PIndexImplType) CanCount() bool {
+	return t.CountCtx != nil || t.Count != nil
+}
+
+// CountContext counts the documents of an index, using CountCtx()
+// when available.  The ctx isn't honored by a plain Count().
+func (t *PIndexImplType) CountContext(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string) (uint64, error) {
+	if t.CountCtx != nil {
+		return t.CountCtx(ctx, mgr, indexName, indexUUID)
+	}
+
+	if t.Count != nil {
+		return t.Count(mgr, indexName, indexUUID)
+	}
+
+	return 0, fmt.Errorf("pindex_impl: Count not supported, indexName: %s",
+		indexName)
 }
 
 // ErrPIndexQueryTimeout may be returned for queries that took too
@@ -135,6 +265,20 @@ func OpenPIndexImpl(indexType, path string, restart func()) (
 	return t.Open(indexType, path, restart)
 }
 
+// OpenPIndexImplUsing loads an index partition of the given,
+// registered index type from a given path, using updated
+// indexParams.
+func OpenPIndexImplUsing(indexType, path, indexParams string,
+	restart func()) (PIndexImpl, Dest, error) {
+	t, exists := PIndexImplTypes[indexType]
+	if !exists || t == nil || t.OpenUsing == nil {
+		return nil, nil, fmt.Errorf("pindex_impl: OpenPIndexImplUsing"+
+			" indexType: %s", indexType)
+	}
+
+	return t.OpenUsing(indexType, path, indexParams, restart)
+}
+
 // PIndexImplTypeForIndex retrieves from the Cfg provider the index
 // type for a given index.
 func PIndexImplTypeForIndex(cfg Cfg, indexName string) (
@@ -184,6 +328,58 @@ type QueryCtlParams struct {
 type QueryCtl struct {
 	Timeout     int64              `json:"timeout"`
 	Consistency *ConsistencyParams `json:"consistency"`
+
+	// When true, the query opts in to using local pindexes that are
+	// still warming up; see CoveringPIndexesSpec.IncludeWarmingUp.
+	IncludeWarmingUp bool `json:"includeWarmingUp,omitempty"`
+
+	// When non-empty, the query is restricted to the pindexes that
+	// cover any of these source partitions, like vbucket ID's.
+	SourcePartitions []string `json:"sourcePartitions,omitempty"`
+
+	// When non-empty, the query is restricted to these pindexes.
+	PIndexNames []string `json:"pindexNames,omitempty"`
+
+	// How the query's load is spread across the nodes of the
+	// pindexes; see CoveringPIndexesSpec.PartitionSelection.
+	PartitionSelection string `json:"partitionSelection,omitempty"`
+
+	// When > 0, the max number of seqs that the local pindexes of the
+	// query may be behind their data source, for bounded staleness
+	// that's short of an at_plus consistency wait.  See
+	// Manager.CheckStaleness().
+	MaxStalenessSeqs uint64 `json:"maxStalenessSeqs,omitempty"`
+
+	// Either "reject", the default, to fail a query whose pindexes
+	// are too stale, or "flag" to answer the query while flagging
+	// the stale pindexes.  See STALENESS_POLICY_*.
+	StalenessPolicy string `json:"stalenessPolicy,omitempty"`
+}
+
+// CoveringPIndexesSpec returns the spec for the covering pindexes of
+// a query on an index, honoring the query's pindex targeting.
+func (ctl *QueryCtl) CoveringPIndexesSpec(indexName, indexUUID,
+	planPIndexFilterName string) CoveringPIndexesSpec {
+	return CoveringPIndexesSpec{
+		IndexName:            indexName,
+		IndexUUID:            indexUUID,
+		PlanPIndexFilterName: planPIndexFilterName,
+		IncludeWarmingUp:     ctl.IncludeWarmingUp,
+		SourcePartitions:     sortedJoin(ctl.SourcePartitions),
+		PIndexNames:          sortedJoin(ctl.PIndexNames),
+		PartitionSelection:   ctl.PartitionSelection,
+	}
+}
+
+// sortedJoin returns a canonical, comma separated string of the
+// strs, so that equivalent lists are equal as map keys.
+func sortedJoin(strs []string) string {
+	if len(strs) <= 0 {
+		return ""
+	}
+	sorted := append([]string(nil), strs...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
 }
 
 // QUERY_CTL_DEFAULT_TIMEOUT_MS is the default query timeout.
@@ -200,31 +396,89 @@ var PINDEX_STORE_MAX_ERRORS = 40
 type PIndexStoreStats struct {
 	TimerBatchStore metrics.Timer
 	Errors          *list.List // Capped list of string (json).
+
+	// Optional, such as from PIndex.ConsistencyWaitStats().
+	ConsistencyWait *ConsistencyWaitStats
+
+	// Optional histograms of the workload's shape, which help to
+	// tune settings like MaxPartitionsPerPIndex, and which are
+	// updated via RecordValueSize() and RecordBatchSize().
+	HistogramValueSize metrics.Histogram // Of mutation value bytes.
+	HistogramBatchSize metrics.Histogram // Of mutations per snapshot.
+}
+
+// NewPIndexStoreSizeHistogram returns a histogram that's suitable for
+// the HistogramValueSize and HistogramBatchSize of a
+// PIndexStoreStats.
+func NewPIndexStoreSizeHistogram() metrics.Histogram {
+	return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+}
+
+// RecordValueSize tracks the value size of a mutation, if there's a
+// HistogramValueSize.
+func (d *PIndexStoreStats) RecordValueSize(size int) {
+	if d.HistogramValueSize != nil {
+		d.HistogramValueSize.Update(int64(size))
+	}
+}
+
+// RecordBatchSize tracks the number of mutations of a snapshot or
+// batch, if there's a HistogramBatchSize.
+func (d *PIndexStoreStats) RecordBatchSize(size int) {
+	if d.HistogramBatchSize != nil {
+		d.HistogramBatchSize.Update(int64(size))
+	}
 }
 
 func (d *PIndexStoreStats) WriteJSON(w io.Writer) {
-	w.Write([]byte(`{"TimerBatchStore":`))
-	WriteTimerJSON(w, d.TimerBatchStore)
+	d.WriteJSONEx(w, MetricsJSONOptionsDefault)
+}
+
+// WriteJSONEx writes the PIndexStoreStats as JSON to a writer.
+func (d *PIndexStoreStats) WriteJSONEx(w io.Writer, opts MetricsJSONOptions) {
+	var rv struct {
+		TimerBatchStore    *TimerJSON
+		ConsistencyWait    json.RawMessage    `json:",omitempty"`
+		HistogramValueSize *HistogramJSON     `json:",omitempty"`
+		HistogramBatchSize *HistogramJSON     `json:",omitempty"`
+		Errors             *[]json.RawMessage `json:",omitempty"`
+	}
+
+	rv.TimerBatchStore = NewTimerJSON(d.TimerBatchStore, opts.Percentiles)
+
+	if d.ConsistencyWait != nil {
+		var buf bytes.Buffer
+		d.ConsistencyWait.WriteJSON(&buf)
+		rv.ConsistencyWait = json.RawMessage(buf.Bytes())
+	}
+
+	if d.HistogramValueSize != nil {
+		rv.HistogramValueSize =
+			NewHistogramJSON(d.HistogramValueSize, opts.Percentiles)
+	}
+
+	if d.HistogramBatchSize != nil {
+		rv.HistogramBatchSize =
+			NewHistogramJSON(d.HistogramBatchSize, opts.Percentiles)
+	}
 
 	if d.Errors != nil {
-		w.Write([]byte(`,"Errors":[`))
-		e := d.Errors.Front()
-		i := 0
-		for e != nil {
+		errs := []json.RawMessage{}
+		for e := d.Errors.Front(); e != nil; e = e.Next() {
 			j, ok := e.Value.(string)
 			if ok && j != "" {
-				if i > 0 {
-					w.Write(JsonComma)
+				var v interface{}
+				if json.Unmarshal([]byte(j), &v) != nil {
+					jb, _ := json.Marshal(j) // Not JSON, so quote it.
+					j = string(jb)
 				}
-				w.Write([]byte(j))
+				errs = append(errs, json.RawMessage(j))
 			}
-			e = e.Next()
-			i = i + 1
 		}
-		w.Write([]byte(`]`))
+		rv.Errors = &errs
 	}
 
-	w.Write(JsonCloseBrace)
+	WriteMetricsJSON(w, &rv, opts)
 }
 
 var prefixPIndexStoreStats = []byte(`{"pindexStoreStats":`)
@@ -0,0 +1,735 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A rollup index maintains time-bucketed counts and sums of a numeric
+// field of the documents of its data source, like a ready-made
+// metrics index.  Each document contributes its field's value to the
+// bucket of its time, so that updates and deletions of documents are
+// reflected exactly.  The rollup state of a pindex is kept in memory
+// and saved to its ROLLUP_FILENAME whenever a partition's opaque
+// value is set, which checkpoints the partition.
+
+// ROLLUP_FILENAME is the name of the file of a rollup pindex.
+const ROLLUP_FILENAME = "rollup.json"
+
+func init() {
+	RegisterPIndexImplType("rollup", &PIndexImplType{
+		Validate:  ValidateRollupPIndexImpl,
+		New:       NewRollupPIndexImpl,
+		Open:      OpenRollupPIndexImpl,
+		CountCtx:  CountRollup,
+		QueryCtx:  GatherQueryCtx,
+		NewMerger: NewRollupMerger,
+		Description: "general/rollup" +
+			" - a rollup index maintains time-bucketed counts and sums" +
+			" of a numeric field",
+		StartSample: &RollupParams{
+			Field:      "/amount",
+			TimeField:  "/timestamp",
+			BucketSize: "1m",
+			Retention:  "24h",
+		},
+		QuerySamples: func() []Documentation {
+			return []Documentation{
+				{
+					Text: "A query for the buckets in a time range:",
+					JSON: &RollupQueryRequest{
+						Start: "2016-01-01T00:00:00Z",
+						End:   "2016-01-02T00:00:00Z",
+					},
+				},
+			}
+		},
+		QueryHelp: `The optional start (inclusive) and end (exclusive) of a
+rollup query are RFC3339 times.`,
+	})
+}
+
+// RollupParams are the index params of a rollup index.
+type RollupParams struct {
+	// The JSON pointer of the numeric field, like "/amount".
+	Field string `json:"field"`
+
+	// The JSON pointer of the time field, whose value is either an
+	// RFC3339 string or a number of seconds since the unix epoch.
+	// When empty, the ingest time is used.
+	TimeField string `json:"timeField"`
+
+	// The duration of a bucket, like "1m".
+	BucketSize string `json:"bucketSize"`
+
+	// How long buckets are kept, like "24h", where an empty value
+	// keeps all buckets.
+	Retention string `json:"retention"`
+}
+
+// A RollupBucket has the count and sum of the values of a bucket.
+type RollupBucket struct {
+	Start time.Time `json:"start"`
+	Count uint64    `json:"count"`
+	Sum   float64   `json:"sum"`
+}
+
+// A RollupQueryRequest is the query request of a rollup index.
+type RollupQueryRequest struct {
+	Start string `json:"start,omitempty"` // RFC3339, inclusive.
+	End   string `json:"end,omitempty"`   // RFC3339, exclusive.
+
+	// When true, only the count of documents is returned.
+	DocCountOnly bool `json:"docCountOnly,omitempty"`
+}
+
+// A RollupQueryResult is the query response of a rollup index, and
+// of each of its pindexes.
+type RollupQueryResult struct {
+	DocCount uint64          `json:"docCount"`
+	Buckets  []*RollupBucket `json:"buckets"`
+}
+
+// parseRollupParams parses and validates the params of a rollup
+// index, returning the bucket size and retention.
+func parseRollupParams(indexParams string) (
+	*RollupParams, time.Duration, time.Duration, error) {
+	params := &RollupParams{}
+	err := json.Unmarshal([]byte(indexParams), params)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("rollup: could not parse params,"+
+			" err: %v", err)
+	}
+
+	if !strings.HasPrefix(params.Field, "/") {
+		return nil, 0, 0, fmt.Errorf("rollup: field must be a JSON pointer,"+
+			" field: %q", params.Field)
+	}
+	if params.TimeField != "" && !strings.HasPrefix(params.TimeField, "/") {
+		return nil, 0, 0, fmt.Errorf("rollup: timeField must be a JSON"+
+			" pointer, timeField: %q", params.TimeField)
+	}
+
+	bucketSize, err := time.ParseDuration(params.BucketSize)
+	if err != nil || bucketSize <= 0 {
+		return nil, 0, 0, fmt.Errorf("rollup: could not parse bucketSize: %q",
+			params.BucketSize)
+	}
+
+	var retention time.Duration
+	if params.Retention != "" {
+		retention, err = time.ParseDuration(params.Retention)
+		if err != nil || retention < bucketSize {
+			return nil, 0, 0, fmt.Errorf("rollup: retention: %q must be a"+
+				" duration of at least the bucketSize", params.Retention)
+		}
+	}
+
+	return params, bucketSize, retention, nil
+}
+
+func ValidateRollupPIndexImpl(indexType, indexName, indexParams string) error {
+	_, _, _, err := parseRollupParams(indexParams)
+	return err
+}
+
+func NewRollupPIndexImpl(indexType, indexParams, path string,
+	restart func()) (PIndexImpl, Dest, error) {
+	params, bucketSize, retention, err := parseRollupParams(indexParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := newRollup(path, params, bucketSize, retention, restart)
+
+	err = r.save()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, r, nil
+}
+
+func OpenRollupPIndexImpl(indexType, path string, restart func()) (
+	PIndexImpl, Dest, error) {
+	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) +
+		ROLLUP_FILENAME)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var state rollupState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rollup: could not parse %s, path: %s,"+
+			" err: %v", ROLLUP_FILENAME, path, err)
+	}
+
+	paramsJSON, err := json.Marshal(state.Params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params, bucketSize, retention, err := parseRollupParams(string(paramsJSON))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := newRollup(path, params, bucketSize, retention, restart)
+
+	for _, b := range state.Buckets {
+		r.buckets[b.Start.UnixNano()] = b
+	}
+	for docID, c := range state.Docs {
+		r.docs[docID] = c
+	}
+	for partition, p := range state.Partitions {
+		r.partitions[partition] = p
+		p.seqMax = p.LastSeq
+	}
+
+	return r, r, nil
+}
+
+// ---------------------------------------------------------
+
+// Rollup implements both the Dest and PIndexImpl interfaces of a
+// rollup pindex.
+type Rollup struct {
+	path       string
+	params     *RollupParams
+	bucketSize time.Duration
+	retention  time.Duration
+	restart    func()
+
+	m          sync.Mutex
+	buckets    map[int64]*RollupBucket // Keyed by bucket start nanos.
+	docs       map[string]rollupDoc    // Keyed by doc ID.
+	partitions map[string]*checkpointPartition
+	seqCh      chan struct{} // Closed and replaced when seqs advance.
+}
+
+// The contribution of a document to a bucket.
+type rollupDoc struct {
+	Bucket int64   `json:"bucket"`
+	Value  float64 `json:"value"`
+}
+
+// A checkpointPartition is the checkpoint of a partition of a pindex
+// that's saved as a whole, like a rollup or subset pindex.
+type checkpointPartition struct {
+	Opaque  []byte `json:"opaque"`
+	LastSeq uint64 `json:"lastSeq"` // As of the last save.
+
+	seqMax uint64 // The max seq received.
+}
+
+// The JSON of a ROLLUP_FILENAME.
+type rollupState struct {
+	Params     *RollupParams                   `json:"params"`
+	Buckets    []*RollupBucket                 `json:"buckets"`
+	Docs       map[string]rollupDoc            `json:"docs"`
+	Partitions map[string]*checkpointPartition `json:"partitions"`
+}
+
+func newRollup(path string, params *RollupParams,
+	bucketSize, retention time.Duration, restart func()) *Rollup {
+	return &Rollup{
+		path:       path,
+		params:     params,
+		bucketSize: bucketSize,
+		retention:  retention,
+		restart:    restart,
+		buckets:    map[int64]*RollupBucket{},
+		docs:       map[string]rollupDoc{},
+		partitions: map[string]*checkpointPartition{},
+		seqCh:      make(chan struct{}),
+	}
+}
+
+func (r *Rollup) Close() error {
+	return nil
+}
+
+func (r *Rollup) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	var doc interface{}
+	json.Unmarshal(val, &doc) // A non-JSON doc doesn't contribute.
+
+	value, ok := jsonPointerFloat(doc, r.params.Field)
+
+	t := time.Now()
+	if ok && r.params.TimeField != "" {
+		v, _ := jsonPointerGet(doc, r.params.TimeField)
+		t = rollupTime(v)
+		ok = !t.IsZero()
+	}
+
+	r.m.Lock()
+	r.removeDocLOCKED(string(key))
+	if ok && !r.expiredLOCKED(t, time.Now()) {
+		bucket := r.bucketStart(t)
+		r.addLOCKED(bucket, 1, value)
+		r.docs[string(key)] = rollupDoc{Bucket: bucket, Value: value}
+	}
+	r.updateSeqLOCKED(partition, seq)
+	r.m.Unlock()
+
+	return nil
+}
+
+func (r *Rollup) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	r.m.Lock()
+	r.removeDocLOCKED(string(key))
+	r.updateSeqLOCKED(partition, seq)
+	r.m.Unlock()
+
+	return nil
+}
+
+func (r *Rollup) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return nil
+}
+
+func (r *Rollup) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	p := r.partitions[partition]
+	if p == nil {
+		return nil, 0, nil
+	}
+
+	return p.Opaque, p.LastSeq, nil
+}
+
+// OpaqueSet checkpoints the partition, by expiring the buckets that
+// are beyond the retention and saving the rollup state.
+func (r *Rollup) OpaqueSet(partition string, value []byte) error {
+	r.m.Lock()
+	p := r.partitions[partition]
+	if p == nil {
+		p = &checkpointPartition{}
+		r.partitions[partition] = p
+	}
+	p.Opaque = append([]byte(nil), value...)
+	p.LastSeq = p.seqMax
+
+	r.expireLOCKED(time.Now())
+	r.m.Unlock()
+
+	return r.save()
+}
+
+// Rollback resets the rollup to zero, as the contributions of
+// documents aren't tracked by seq, and restarts the pindex.
+func (r *Rollup) Rollback(partition string, rollbackSeq uint64) error {
+	r.m.Lock()
+	r.buckets = map[int64]*RollupBucket{}
+	r.docs = map[string]rollupDoc{}
+	r.partitions = map[string]*checkpointPartition{}
+	r.m.Unlock()
+
+	err := r.save()
+	if err != nil {
+		return err
+	}
+
+	if r.restart != nil {
+		r.restart()
+	}
+
+	return nil
+}
+
+func (r *Rollup) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if consistencyLevel == "" {
+		return nil
+	}
+	if consistencyLevel != CONSISTENCY_LEVEL_AT_PLUS {
+		return fmt.Errorf("rollup: unsupported consistencyLevel: %s",
+			consistencyLevel)
+	}
+
+	seqStart, _ := r.PartitionSeqMax(partition)
+
+	for {
+		r.m.Lock()
+		var seqMax uint64
+		if p := r.partitions[partition]; p != nil {
+			seqMax = p.seqMax
+		}
+		seqCh := r.seqCh
+		r.m.Unlock()
+
+		if seqMax >= consistencySeq {
+			return nil
+		}
+
+		select {
+		case <-seqCh:
+		case <-cancelCh:
+			return &ErrorConsistencyWait{
+				Err:    fmt.Errorf("rollup: ConsistencyWait cancelled"),
+				Status: "cancelled",
+				StartEndSeqs: map[string][]uint64{
+					partition: []uint64{seqStart, seqMax},
+				},
+			}
+		}
+	}
+}
+
+// PartitionSeqMax implements the DestUnflushed interface.
+func (r *Rollup) PartitionSeqMax(partition string) (
+	seqMax, seqMaxBatch uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if p := r.partitions[partition]; p != nil {
+		return p.seqMax, p.LastSeq
+	}
+	return 0, 0
+}
+
+func (r *Rollup) Count(pindex *PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return uint64(len(r.docs)), nil
+}
+
+func (r *Rollup) Query(pindex *PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	var q RollupQueryRequest
+	err := json.Unmarshal(req, &q)
+	if err != nil {
+		return fmt.Errorf("rollup: could not parse query request,"+
+			" err: %v", err)
+	}
+
+	start, end, err := q.timeRange()
+	if err != nil {
+		return err
+	}
+
+	rv := &RollupQueryResult{Buckets: []*RollupBucket{}}
+
+	r.m.Lock()
+	rv.DocCount = uint64(len(r.docs))
+	if !q.DocCountOnly {
+		for _, b := range r.buckets {
+			if (start.IsZero() || !b.Start.Before(start)) &&
+				(end.IsZero() || b.Start.Before(end)) {
+				c := *b
+				rv.Buckets = append(rv.Buckets, &c)
+			}
+		}
+	}
+	r.m.Unlock()
+
+	sort.Sort(rollupBucketsByStart(rv.Buckets))
+
+	return EncodeJSON(w, rv)
+}
+
+func (r *Rollup) Stats(w io.Writer) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	_, err := fmt.Fprintf(w, `{"docCount":%d,"bucketCount":%d}`,
+		len(r.docs), len(r.buckets))
+	return err
+}
+
+// bucketStart returns the start of the bucket of a time, in unix
+// nanos.
+func (r *Rollup) bucketStart(t time.Time) int64 {
+	n := t.UnixNano()
+	b := n - n%int64(r.bucketSize)
+	if n < 0 && n%int64(r.bucketSize) != 0 {
+		b -= int64(r.bucketSize)
+	}
+	return b
+}
+
+func (r *Rollup) expiredLOCKED(t, now time.Time) bool {
+	return r.retention > 0 && t.Before(now.Add(-r.retention))
+}
+
+func (r *Rollup) addLOCKED(bucket int64, count int64, value float64) {
+	b := r.buckets[bucket]
+	if b == nil {
+		if count <= 0 {
+			return
+		}
+		b = &RollupBucket{Start: time.Unix(0, bucket).UTC()}
+		r.buckets[bucket] = b
+	}
+
+	b.Count = uint64(int64(b.Count) + count)
+	b.Sum += value * float64(count)
+
+	if b.Count <= 0 {
+		delete(r.buckets, bucket)
+	}
+}
+
+func (r *Rollup) removeDocLOCKED(docID string) {
+	if d, exists := r.docs[docID]; exists {
+		r.addLOCKED(d.Bucket, -1, d.Value)
+		delete(r.docs, docID)
+	}
+}
+
+func (r *Rollup) updateSeqLOCKED(partition string, seq uint64) {
+	p := r.partitions[partition]
+	if p == nil {
+		p = &checkpointPartition{}
+		r.partitions[partition] = p
+	}
+	if seq > p.seqMax {
+		p.seqMax = seq
+		close(r.seqCh)
+		r.seqCh = make(chan struct{})
+	}
+}
+
+// expireLOCKED removes the buckets, and the contributions of docs to
+// those buckets, that are beyond the retention.
+func (r *Rollup) expireLOCKED(now time.Time) {
+	if r.retention <= 0 {
+		return
+	}
+
+	expired := map[int64]bool{}
+	for bucket, b := range r.buckets {
+		if r.expiredLOCKED(b.Start.Add(r.bucketSize), now) {
+			expired[bucket] = true
+			delete(r.buckets, bucket)
+		}
+	}
+
+	if len(expired) > 0 {
+		for docID, d := range r.docs {
+			if expired[d.Bucket] {
+				delete(r.docs, docID)
+			}
+		}
+	}
+}
+
+// save writes the rollup state to the ROLLUP_FILENAME, via a rename
+// so that a crash doesn't leave a partial file.
+func (r *Rollup) save() error {
+	r.m.Lock()
+	state := &rollupState{
+		Params:     r.params,
+		Buckets:    make([]*RollupBucket, 0, len(r.buckets)),
+		Docs:       r.docs,
+		Partitions: r.partitions,
+	}
+	for _, b := range r.buckets {
+		state.Buckets = append(state.Buckets, b)
+	}
+	sort.Sort(rollupBucketsByStart(state.Buckets))
+
+	buf, err := json.Marshal(state)
+	r.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fname := r.path + string(os.PathSeparator) + ROLLUP_FILENAME
+
+	err = ioutil.WriteFile(fname+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
+
+// timeRange parses the optional start and end of a query request.
+func (q *RollupQueryRequest) timeRange() (start, end time.Time, err error) {
+	if q.Start != "" {
+		start, err = time.Parse(time.RFC3339, q.Start)
+		if err != nil {
+			return start, end, fmt.Errorf("rollup: could not parse start,"+
+				" err: %v", err)
+		}
+	}
+	if q.End != "" {
+		end, err = time.Parse(time.RFC3339, q.End)
+		if err != nil {
+			return start, end, fmt.Errorf("rollup: could not parse end,"+
+				" err: %v", err)
+		}
+	}
+	return start, end, nil
+}
+
+type rollupBucketsByStart []*RollupBucket
+
+func (a rollupBucketsByStart) Len() int {
+	return len(a)
+}
+
+func (a rollupBucketsByStart) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a rollupBucketsByStart) Less(i, j int) bool {
+	return a[i].Start.Before(a[j].Start)
+}
+
+// ---------------------------------------------------------
+
+// RollupMerger merges the query results of the pindexes of a rollup
+// index, summing the buckets that have the same start.
+type RollupMerger struct {
+	docCount uint64
+	buckets  map[int64]*RollupBucket
+}
+
+func NewRollupMerger(indexName string, req []byte) (Merger, error) {
+	var q RollupQueryRequest
+	err := json.Unmarshal(req, &q)
+	if err != nil {
+		return nil, fmt.Errorf("rollup: could not parse query request,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	_, _, err = q.timeRange()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RollupMerger{buckets: map[int64]*RollupBucket{}}, nil
+}
+
+func (m *RollupMerger) Add(pindexName string, result json.RawMessage) error {
+	var r RollupQueryResult
+	err := json.Unmarshal(result, &r)
+	if err != nil {
+		return err
+	}
+
+	m.docCount += r.DocCount
+
+	for _, b := range r.Buckets {
+		k := b.Start.UnixNano()
+		if m.buckets[k] == nil {
+			m.buckets[k] = &RollupBucket{Start: b.Start}
+		}
+		m.buckets[k].Count += b.Count
+		m.buckets[k].Sum += b.Sum
+	}
+
+	return nil
+}
+
+// Finish fails the query if any pindex failed, as partial rollups
+// would be silently wrong.
+func (m *RollupMerger) Finish(res io.Writer, status *GatherStatus) error {
+	if status.Failed > 0 {
+		return fmt.Errorf("rollup: pindexes failed: %d of %d, errors: %v",
+			status.Failed, status.Total, status.Errors)
+	}
+
+	rv := &RollupQueryResult{
+		DocCount: m.docCount,
+		Buckets:  make([]*RollupBucket, 0, len(m.buckets)),
+	}
+	for _, b := range m.buckets {
+		rv.Buckets = append(rv.Buckets, b)
+	}
+	sort.Sort(rollupBucketsByStart(rv.Buckets))
+
+	return EncodeJSON(res, rv)
+}
+
+// CountRollup counts the documents that contribute to a rollup
+// index.
+func CountRollup(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string) (uint64, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	err := mgr.Gather(ctx, indexName, indexUUID,
+		[]byte(`{"docCountOnly":true}`), buf)
+	if err != nil {
+		return 0, err
+	}
+
+	var r RollupQueryResult
+	err = json.Unmarshal(buf.Bytes(), &r)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.DocCount, nil
+}
+
+// ---------------------------------------------------------
+
+// jsonPointerFloat returns the numeric value at a JSON pointer.
+func jsonPointerFloat(doc interface{}, ptr string) (float64, bool) {
+	v, ok := jsonPointerGet(doc, ptr)
+	if !ok {
+		return 0, false
+	}
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// rollupTime converts the value of a time field, which is either an
+// RFC3339 string or a number of seconds since the unix epoch, into a
+// time, which is zero if the value isn't a time.
+func rollupTime(v interface{}) time.Time {
+	switch x := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339, x)
+		if err == nil {
+			return t
+		}
+	case float64:
+		return time.Unix(0, int64(x*float64(time.Second)))
+	}
+	return time.Time{}
+}
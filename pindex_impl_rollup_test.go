@@ -0,0 +1,267 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValidateRollupParams(t *testing.T) {
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{`{"field":"/amount","bucketSize":"1m"}`, true},
+		{`{"field":"/amount","timeField":"/ts","bucketSize":"1h",` +
+			`"retention":"24h"}`, true},
+		{`{"field":"amount","bucketSize":"1m"}`, false},
+		{`{"field":"/amount","timeField":"ts","bucketSize":"1m"}`, false},
+		{`{"field":"/amount"}`, false},
+		{`{"field":"/amount","bucketSize":"-1m"}`, false},
+		{`{"field":"/amount","bucketSize":"1h","retention":"1m"}`, false},
+		{`not json`, false},
+	}
+
+	for i, test := range tests {
+		err := ValidateRollupPIndexImpl("rollup", "r", test.params)
+		if (err == nil) != test.ok {
+			t.Errorf("test: %d, params: %s, expected ok: %v, err: %v",
+				i, test.params, test.ok, err)
+		}
+	}
+}
+
+func queryRollup(t *testing.T, r *Rollup, req string) *RollupQueryResult {
+	var buf bytes.Buffer
+	err := r.Query(nil, []byte(req), &buf, nil)
+	if err != nil {
+		t.Fatalf("expected Query() to work, err: %v", err)
+	}
+
+	var rv RollupQueryResult
+	err = json.Unmarshal(buf.Bytes(), &rv)
+	if err != nil {
+		t.Fatalf("expected parseable query result, err: %v", err)
+	}
+
+	return &rv
+}
+
+func TestRollup(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "r"
+
+	impl, dest, err := NewRollupPIndexImpl("rollup",
+		`{"field":"/amount","timeField":"/ts","bucketSize":"1h"}`,
+		path, nil)
+	if err != nil || impl == nil || dest == nil {
+		t.Fatalf("expected NewRollupPIndexImpl() to work, err: %v", err)
+	}
+
+	updates := []struct {
+		key string
+		val string
+	}{
+		{"a", `{"amount":10,"ts":"2016-01-01T00:10:00Z"}`},
+		{"b", `{"amount":5,"ts":"2016-01-01T00:50:00Z"}`},
+		{"c", `{"amount":1,"ts":"2016-01-01T01:30:00Z"}`},
+		{"d", `{"other":1,"ts":"2016-01-01T01:30:00Z"}`},
+		{"e", `not json`},
+		{"a", `{"amount":20,"ts":"2016-01-01T00:20:00Z"}`},
+	}
+	for i, u := range updates {
+		err = dest.DataUpdate("0", []byte(u.key), uint64(i+1),
+			[]byte(u.val), 0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatalf("expected DataUpdate() to work, err: %v", err)
+		}
+	}
+
+	err = dest.DataDelete("0", []byte("c"), 7, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Fatalf("expected DataDelete() to work, err: %v", err)
+	}
+
+	r := dest.(*Rollup)
+
+	rv := queryRollup(t, r, `{}`)
+	if rv.DocCount != 2 || len(rv.Buckets) != 1 ||
+		rv.Buckets[0].Count != 2 || rv.Buckets[0].Sum != 25 {
+		t.Errorf("expected 1 bucket of 2 docs, got: %#v, %#v", rv, rv.Buckets)
+	}
+
+	rv = queryRollup(t, r, `{"start":"2016-01-01T01:00:00Z"}`)
+	if len(rv.Buckets) != 0 {
+		t.Errorf("expected no buckets after start, got: %#v", rv.Buckets)
+	}
+
+	seqMax, seqMaxBatch := r.PartitionSeqMax("0")
+	if seqMax != 7 || seqMaxBatch != 0 {
+		t.Errorf("expected unflushed seqs, got: %d, %d", seqMax, seqMaxBatch)
+	}
+
+	err = dest.OpaqueSet("0", []byte("opaque"))
+	if err != nil {
+		t.Fatalf("expected OpaqueSet() to work, err: %v", err)
+	}
+
+	err = dest.ConsistencyWait("0", "", CONSISTENCY_LEVEL_AT_PLUS, 7, nil)
+	if err != nil {
+		t.Errorf("expected ConsistencyWait() to be reached, err: %v", err)
+	}
+
+	cancelCh := make(chan bool)
+	close(cancelCh)
+	err = dest.ConsistencyWait("0", "", CONSISTENCY_LEVEL_AT_PLUS, 8, cancelCh)
+	if _, ok := err.(*ErrorConsistencyWait); !ok {
+		t.Errorf("expected ErrorConsistencyWait, got: %v", err)
+	}
+
+	impl.(*Rollup).Close()
+
+	_, dest, err = OpenRollupPIndexImpl("rollup", path, nil)
+	if err != nil {
+		t.Fatalf("expected OpenRollupPIndexImpl() to work, err: %v", err)
+	}
+
+	opaque, lastSeq, err := dest.OpaqueGet("0")
+	if err != nil || string(opaque) != "opaque" || lastSeq != 7 {
+		t.Errorf("expected reopened opaque, got: %s, %d, err: %v",
+			opaque, lastSeq, err)
+	}
+
+	r = dest.(*Rollup)
+
+	rv = queryRollup(t, r, `{}`)
+	if rv.DocCount != 2 || len(rv.Buckets) != 1 || rv.Buckets[0].Sum != 25 {
+		t.Errorf("expected reopened buckets, got: %#v", rv)
+	}
+
+	// An update that moves a doc to another bucket.
+	dest.DataUpdate("0", []byte("b"), 8,
+		[]byte(`{"amount":5,"ts":1451613600}`), 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	rv = queryRollup(t, r, `{}`)
+	if len(rv.Buckets) != 2 ||
+		rv.Buckets[0].Count != 1 || rv.Buckets[0].Sum != 20 ||
+		rv.Buckets[1].Count != 1 || rv.Buckets[1].Sum != 5 {
+		t.Errorf("expected moved doc, got: %#v, %#v, %#v",
+			rv, rv.Buckets[0], rv.Buckets[1])
+	}
+
+	restarted := false
+	r.restart = func() { restarted = true }
+
+	err = dest.Rollback("0", 0)
+	if err != nil || !restarted {
+		t.Errorf("expected Rollback() to restart, err: %v", err)
+	}
+
+	rv = queryRollup(t, r, `{}`)
+	if rv.DocCount != 0 || len(rv.Buckets) != 0 {
+		t.Errorf("expected empty rollup after rollback, got: %#v", rv)
+	}
+}
+
+func TestRollupRetention(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewRollupPIndexImpl("rollup",
+		`{"field":"/amount","timeField":"/ts","bucketSize":"1h",`+
+			`"retention":"1h"}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewRollupPIndexImpl() to work, err: %v", err)
+	}
+
+	dest.DataUpdate("0", []byte("old"), 1,
+		[]byte(`{"amount":1,"ts":"2016-01-01T00:00:00Z"}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("0", []byte("new"), 2,
+		[]byte(`{"amount":2}`), 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	rv := queryRollup(t, dest.(*Rollup), `{}`)
+	if rv.DocCount != 0 || len(rv.Buckets) != 0 {
+		t.Errorf("expected expired and timeless docs to be dropped,"+
+			" got: %#v", rv)
+	}
+}
+
+func TestRollupMerger(t *testing.T) {
+	m, err := NewRollupMerger("r", []byte(`{"start":"bad"}`))
+	if err == nil || m != nil {
+		t.Errorf("expected NewRollupMerger() to fail on bad start")
+	}
+
+	m, err = NewRollupMerger("r", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("expected NewRollupMerger() to work, err: %v", err)
+	}
+
+	m.Add("p0", json.RawMessage(`{"docCount":2,"buckets":[`+
+		`{"start":"2016-01-01T01:00:00Z","count":1,"sum":3},`+
+		`{"start":"2016-01-01T00:00:00Z","count":1,"sum":1}]}`))
+	m.Add("p1", json.RawMessage(`{"docCount":1,"buckets":[`+
+		`{"start":"2016-01-01T01:00:00Z","count":1,"sum":4}]}`))
+
+	var buf bytes.Buffer
+	err = m.Finish(&buf, &GatherStatus{Total: 2, Successful: 2})
+	if err != nil {
+		t.Fatalf("expected Finish() to work, err: %v", err)
+	}
+
+	var rv RollupQueryResult
+	json.Unmarshal(buf.Bytes(), &rv)
+	if rv.DocCount != 3 || len(rv.Buckets) != 2 ||
+		rv.Buckets[0].Sum != 1 ||
+		rv.Buckets[1].Count != 2 || rv.Buckets[1].Sum != 7 {
+		t.Errorf("expected merged buckets, got: %s", buf.String())
+	}
+
+	err = m.Finish(&buf, &GatherStatus{Total: 2, Successful: 1, Failed: 1})
+	if err == nil {
+		t.Errorf("expected Finish() to fail on failed pindexes")
+	}
+}
+
+func TestRollupCount(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"rollup", "r", `{"field":"/amount","bucketSize":"1m"}`,
+		PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	count, err := PIndexImplTypes["rollup"].CountContext(
+		context.Background(), m, "r", "")
+	if err != nil || count != 0 {
+		t.Errorf("expected zero count, got: %d, err: %v", count, err)
+	}
+}
@@ -0,0 +1,1216 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// A subset index materializes the documents of its data source that
+// match a declarative filter, as a key-value subset that's sorted by
+// document key and supports key range queries.  The documents may
+// also be projected down to a few fields, to keep the subset compact.
+// Documents whose mutations carry an expiry time are purged once
+// they've expired.  The subset of a pindex is kept in memory, in
+// SUBSET_SHARDS independently locked shards of documents so that the
+// partitions of a pindex can be ingested in parallel, and is saved to
+// its SUBSET_FILENAME whenever a partition's opaque value is set,
+// which checkpoints the partition.
+
+// SUBSET_FILENAME is the name of the file of a subset pindex.
+const SUBSET_FILENAME = "subset.json"
+
+// SUBSET_EXPIRY_PURGE_INTERVAL is how often a subset pindex purges
+// its documents whose expiry time has passed, so logically expired
+// documents may be seen by queries until the next purge.
+var SUBSET_EXPIRY_PURGE_INTERVAL = time.Minute
+
+// SUBSET_SHARDS is the number of shards of the documents of a subset
+// pindex, where a document's shard is chosen by a hash of its key.
+var SUBSET_SHARDS = 16
+
+func init() {
+	RegisterPIndexImplType("subset", &PIndexImplType{
+		Validate:  ValidateSubsetPIndexImpl,
+		New:       NewSubsetPIndexImpl,
+		Open:      OpenSubsetPIndexImpl,
+		CountCtx:  CountSubset,
+		QueryCtx:  GatherQueryCtx,
+		NewMerger: NewSubsetMerger,
+		DocLookUp: SubsetDocLookUp,
+
+		SubmitTaskRequest: SubmitSubsetTask,
+
+		Description: "general/subset" +
+			" - a subset index stores the documents that match a filter," +
+			" for key range queries",
+		StartSample: &SubsetParams{
+			Conditions: []SubsetCondition{
+				{Path: "/type", Equals: "order"},
+				{Path: "/region", Prefix: "us-"},
+			},
+			Match:  SUBSET_MATCH_ALL,
+			Fields: []string{"/type", "/region", "/total"},
+		},
+		QuerySamples: func() []Documentation {
+			return []Documentation{
+				{
+					Text: "A query for up to 10 documents in a key range:",
+					JSON: &SubsetQueryRequest{
+						StartKey: "order::1000",
+						EndKey:   "order::2000",
+						Limit:    10,
+					},
+				},
+			}
+		},
+		QueryHelp: `The optional startKey (inclusive), endKey (exclusive)
+and prefix of a subset query limit the document keys of the results.
+The count of the results is the number of documents in the key range,
+regardless of the limit, and with docCountOnly only counts are
+returned.`,
+	})
+}
+
+// SUBSET_MATCH_ALL means a document must match all the conditions
+// of a subset index.
+const SUBSET_MATCH_ALL = "all"
+
+// SUBSET_MATCH_ANY means a document must match at least one of the
+// conditions of a subset index.
+const SUBSET_MATCH_ANY = "any"
+
+// SubsetParams are the index params of a subset index.
+type SubsetParams struct {
+	Conditions []SubsetCondition `json:"conditions"`
+
+	// Either SUBSET_MATCH_ALL, the default, or SUBSET_MATCH_ANY.
+	Match string `json:"match,omitempty"`
+
+	// The optional JSON pointers of the fields that are stored, as
+	// an object keyed by JSON pointer, where empty means the whole
+	// documents are stored.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// A SubsetCondition matches a document whose value at a JSON pointer
+// Path either equals a JSON value or is a string with a prefix.
+type SubsetCondition struct {
+	Path   string      `json:"path"`
+	Equals interface{} `json:"equals,omitempty"`
+	Prefix string      `json:"prefix,omitempty"`
+}
+
+// Matches returns true when the condition matches a parsed JSON
+// document.
+func (c *SubsetCondition) Matches(doc interface{}) bool {
+	return c.matchesValue(jsonPointerGet(doc, c.Path))
+}
+
+func (c *SubsetCondition) matchesValue(v interface{}, ok bool) bool {
+	if !ok {
+		return false
+	}
+	if c.Equals != nil {
+		return reflect.DeepEqual(v, c.Equals)
+	}
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, c.Prefix)
+}
+
+// subsetMatches returns true when the conditions match, as combined
+// by the match, where get returns the value at a condition's path.
+func subsetMatches(conditions []SubsetCondition, match string,
+	get func(path string) (interface{}, bool)) bool {
+	// Stop at the first condition that decides the match, which is a
+	// mismatch for SUBSET_MATCH_ALL or a match for SUBSET_MATCH_ANY.
+	matches := match != SUBSET_MATCH_ANY
+	for i := range conditions {
+		if conditions[i].matchesValue(get(conditions[i].Path)) != matches {
+			return !matches
+		}
+	}
+	return matches
+}
+
+// validateSubsetConditions checks conditions and a match, returning
+// the match with its default applied.
+func validateSubsetConditions(conditions []SubsetCondition,
+	match string) (string, error) {
+	if len(conditions) <= 0 {
+		return "", fmt.Errorf("subset: conditions are required")
+	}
+	for i, c := range conditions {
+		if !strings.HasPrefix(c.Path, "/") {
+			return "", fmt.Errorf("subset: condition: %d, path must be"+
+				" a JSON pointer, path: %q", i, c.Path)
+		}
+		if (c.Equals == nil) == (c.Prefix == "") {
+			return "", fmt.Errorf("subset: condition: %d, needs either"+
+				" equals or prefix, path: %q", i, c.Path)
+		}
+	}
+
+	if match == "" {
+		match = SUBSET_MATCH_ALL
+	}
+	if match != SUBSET_MATCH_ALL && match != SUBSET_MATCH_ANY {
+		return "", fmt.Errorf("subset: unknown match: %q", match)
+	}
+
+	return match, nil
+}
+
+// A SubsetQueryRequest is the query request of a subset index.
+type SubsetQueryRequest struct {
+	StartKey string `json:"startKey,omitempty"` // Inclusive.
+	EndKey   string `json:"endKey,omitempty"`   // Exclusive.
+
+	// When not empty, only the keys with this prefix are in range.
+	Prefix string `json:"prefix,omitempty"`
+
+	// The max number of rows, where <= 0 means no limit.
+	Limit int `json:"limit,omitempty"`
+
+	// When true, only the counts of documents are returned.
+	DocCountOnly bool `json:"docCountOnly,omitempty"`
+}
+
+// keyRange returns the inclusive start and exclusive end keys of a
+// query request, where an empty end means no end.
+func (q *SubsetQueryRequest) keyRange() (string, string) {
+	start, end := q.StartKey, q.EndKey
+	if q.Prefix != "" {
+		if start < q.Prefix {
+			start = q.Prefix
+		}
+		prefixEnd := subsetPrefixEnd(q.Prefix)
+		if prefixEnd != "" && (end == "" || end > prefixEnd) {
+			end = prefixEnd
+		}
+	}
+	return start, end
+}
+
+// subsetPrefixEnd returns the smallest key that's greater than all
+// the keys with a prefix, or "" when there's no such key.
+func subsetPrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// A SubsetRow is a document of a subset query result.
+type SubsetRow struct {
+	Key string          `json:"key"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// A SubsetQueryResult is the query response of a subset index, and of
+// each of its pindexes.
+type SubsetQueryResult struct {
+	DocCount uint64 `json:"docCount"` // All the stored documents.
+
+	// The documents in the key range of the request, regardless of
+	// the limit.
+	Count uint64 `json:"count"`
+
+	Rows []*SubsetRow `json:"rows"`
+}
+
+func parseSubsetParams(indexParams string) (*SubsetParams, error) {
+	params := &SubsetParams{}
+	err := json.Unmarshal([]byte(indexParams), params)
+	if err != nil {
+		return nil, fmt.Errorf("subset: could not parse params,"+
+			" err: %v", err)
+	}
+
+	params.Match, err = validateSubsetConditions(params.Conditions,
+		params.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range params.Fields {
+		if !strings.HasPrefix(field, "/") {
+			return nil, fmt.Errorf("subset: field must be a JSON pointer,"+
+				" field: %q", field)
+		}
+	}
+
+	return params, nil
+}
+
+func ValidateSubsetPIndexImpl(indexType, indexName, indexParams string) error {
+	_, err := parseSubsetParams(indexParams)
+	return err
+}
+
+func NewSubsetPIndexImpl(indexType, indexParams, path string,
+	restart func()) (PIndexImpl, Dest, error) {
+	params, err := parseSubsetParams(indexParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := newSubset(path, params, restart)
+
+	err = s.save()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, s, nil
+}
+
+func OpenSubsetPIndexImpl(indexType, path string, restart func()) (
+	PIndexImpl, Dest, error) {
+	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) +
+		SUBSET_FILENAME)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var state subsetState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("subset: could not parse %s, path: %s,"+
+			" err: %v", SUBSET_FILENAME, path, err)
+	}
+	if state.Params == nil {
+		return nil, nil, fmt.Errorf("subset: missing params, path: %s", path)
+	}
+
+	s := newSubset(path, state.Params, restart)
+
+	for key, doc := range state.Docs {
+		s.shard(key).docs[key] = doc
+	}
+	for key, expiry := range state.Expiries {
+		s.shard(key).expiries[key] = expiry
+	}
+	for partition, p := range state.Partitions {
+		s.partitions[partition] = p
+		p.seqMax = p.LastSeq
+	}
+
+	return s, s, nil
+}
+
+// ---------------------------------------------------------
+
+// Subset implements both the Dest and PIndexImpl interfaces of a
+// subset pindex.  A data mutation locks only the shard of its
+// document, and then briefly locks the subset to advance its
+// partition's seq.
+type Subset struct {
+	path    string
+	params  *SubsetParams
+	restart func()
+	shards  []*subsetShard // Immutable.
+
+	m          sync.Mutex // Protects the fields that follow.
+	partitions map[string]*checkpointPartition
+	seqCh      chan struct{} // Closed and replaced when seqs advance.
+	stopCh     chan struct{} // Closed when the subset is closed.
+
+	totExpired uint64 // Atomic; expirations from the source or purges.
+}
+
+// A subsetShard holds the documents whose keys hash to the shard.
+type subsetShard struct {
+	m        sync.Mutex
+	docs     map[string]json.RawMessage // Keyed by doc key.
+	keys     []string                   // Sorted doc keys, or nil.
+	expiries map[string]uint32          // Unix secs, keyed by doc key.
+}
+
+// The JSON of a SUBSET_FILENAME.
+type subsetState struct {
+	Params     *SubsetParams                   `json:"params"`
+	Docs       map[string]json.RawMessage      `json:"docs"`
+	Expiries   map[string]uint32               `json:"expiries,omitempty"`
+	Partitions map[string]*checkpointPartition `json:"partitions"`
+}
+
+func newSubset(path string, params *SubsetParams, restart func()) *Subset {
+	s := &Subset{
+		path:       path,
+		params:     params,
+		restart:    restart,
+		partitions: map[string]*checkpointPartition{},
+		seqCh:      make(chan struct{}),
+		stopCh:     make(chan struct{}),
+	}
+
+	numShards := SUBSET_SHARDS
+	if numShards < 1 {
+		numShards = 1
+	}
+	s.shards = make([]*subsetShard, numShards)
+	for i := range s.shards {
+		s.shards[i] = newSubsetShard()
+	}
+
+	go s.purgeLoop(SUBSET_EXPIRY_PURGE_INTERVAL)
+
+	return s
+}
+
+func newSubsetShard() *subsetShard {
+	return &subsetShard{
+		docs:     map[string]json.RawMessage{},
+		expiries: map[string]uint32{},
+	}
+}
+
+// shard returns the shard of a doc key, via an FNV-1a hash.
+func (s *Subset) shard(key string) *subsetShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+func (s *Subset) Close() error {
+	s.m.Lock()
+	select {
+	case <-s.stopCh:
+	default:
+		close(s.stopCh)
+	}
+	s.m.Unlock()
+
+	return nil
+}
+
+func (s *Subset) purgeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case now := <-ticker.C:
+			s.PurgeExpired(now)
+		}
+	}
+}
+
+// PurgeExpired deletes the documents whose expiry time is not after
+// now, returning the number of purged documents.
+func (s *Subset) PurgeExpired(now time.Time) int {
+	nowSecs := now.Unix()
+
+	var rv int
+
+	for _, sh := range s.shards {
+		sh.m.Lock()
+		var purged []string
+		for key, expiry := range sh.expiries {
+			if int64(expiry) <= nowSecs {
+				purged = append(purged, key)
+			}
+		}
+		for _, key := range purged {
+			sh.deleteLOCKED(key)
+		}
+		sh.m.Unlock()
+
+		rv += len(purged)
+	}
+
+	atomic.AddUint64(&s.totExpired, uint64(rv))
+
+	return rv
+}
+
+// filter returns the doc, projected to the fields of the params, if
+// the doc matches the conditions of the params, or else nil.
+func (s *Subset) filter(val []byte) json.RawMessage {
+	var doc interface{}
+	err := json.Unmarshal(val, &doc)
+	if err != nil {
+		return nil
+	}
+
+	if !subsetMatches(s.params.Conditions, s.params.Match,
+		func(path string) (interface{}, bool) {
+			return jsonPointerGet(doc, path)
+		}) {
+		return nil
+	}
+
+	if len(s.params.Fields) <= 0 {
+		return append(json.RawMessage(nil), val...)
+	}
+
+	projection := map[string]interface{}{}
+	for _, field := range s.params.Fields {
+		if v, ok := jsonPointerGet(doc, field); ok {
+			projection[field] = v
+		}
+	}
+
+	rv, err := json.Marshal(projection)
+	if err != nil {
+		return nil
+	}
+
+	return rv
+}
+
+func (s *Subset) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	doc := s.filter(val)
+	expiry := subsetExpiry(doc, extrasType, extras)
+
+	k := string(key)
+	sh := s.shard(k)
+	sh.m.Lock()
+	sh.updateLOCKED(k, doc, expiry)
+	sh.m.Unlock()
+
+	s.updateSeq(partition, seq)
+
+	return nil
+}
+
+func (s *Subset) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	k := string(key)
+	sh := s.shard(k)
+	sh.m.Lock()
+	sh.deleteLOCKED(k)
+	sh.m.Unlock()
+
+	s.updateSeq(partition, seq)
+
+	return nil
+}
+
+// DataExpire implements the DestExpirer interface.
+func (s *Subset) DataExpire(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	k := string(key)
+	sh := s.shard(k)
+	sh.m.Lock()
+	expired := sh.deleteLOCKED(k)
+	sh.m.Unlock()
+
+	if expired {
+		atomic.AddUint64(&s.totExpired, 1)
+	}
+
+	s.updateSeq(partition, seq)
+
+	return nil
+}
+
+// ApplyBatch implements the DestBatch interface, filtering the
+// batch's documents outside of any lock and then applying the batch
+// with a single lock acquisition per shard and a single seq update.
+func (s *Subset) ApplyBatch(partition string,
+	mutations []DestMutation) error {
+	if len(mutations) <= 0 {
+		return nil
+	}
+
+	docs := make([]json.RawMessage, len(mutations))
+	expiries := make([]uint32, len(mutations))
+	for i, mutation := range mutations {
+		if mutation.Op == DEST_MUTATION_UPDATE {
+			docs[i] = s.filter(mutation.Val)
+			expiries[i] = subsetExpiry(docs[i],
+				mutation.ExtrasType, mutation.Extras)
+		}
+	}
+
+	// A key's mutations stay in seq order within the key's shard.
+	shardMutations := map[*subsetShard][]int{}
+	for i, mutation := range mutations {
+		sh := s.shard(string(mutation.Key))
+		shardMutations[sh] = append(shardMutations[sh], i)
+	}
+
+	var expired uint64
+
+	for sh, indexes := range shardMutations {
+		sh.m.Lock()
+		for _, i := range indexes {
+			key := string(mutations[i].Key)
+			switch mutations[i].Op {
+			case DEST_MUTATION_UPDATE:
+				sh.updateLOCKED(key, docs[i], expiries[i])
+			case DEST_MUTATION_EXPIRE:
+				if sh.deleteLOCKED(key) {
+					expired++
+				}
+			default:
+				sh.deleteLOCKED(key)
+			}
+		}
+		sh.m.Unlock()
+	}
+
+	if expired > 0 {
+		atomic.AddUint64(&s.totExpired, expired)
+	}
+
+	s.updateSeq(partition, mutations[len(mutations)-1].Seq)
+
+	return nil
+}
+
+// subsetExpiry returns the expiry from a mutation's extras, or 0 when
+// the document was filtered out or doesn't expire.
+func subsetExpiry(doc json.RawMessage,
+	extrasType DestExtrasType, extras []byte) uint32 {
+	if doc == nil || extrasType == DEST_EXTRAS_TYPE_NIL {
+		return 0
+	}
+	meta, err := DecodeDestExtrasMeta(extrasType, extras)
+	if err != nil {
+		return 0
+	}
+	return meta.Expiry
+}
+
+func (s *Subset) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return nil
+}
+
+func (s *Subset) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	p := s.partitions[partition]
+	if p == nil {
+		return nil, 0, nil
+	}
+
+	return p.Opaque, p.LastSeq, nil
+}
+
+// OpaqueSet checkpoints the partition by saving the subset.
+func (s *Subset) OpaqueSet(partition string, value []byte) error {
+	s.m.Lock()
+	p := s.partitions[partition]
+	if p == nil {
+		p = &checkpointPartition{}
+		s.partitions[partition] = p
+	}
+	p.Opaque = append([]byte(nil), value...)
+	p.LastSeq = p.seqMax
+	s.m.Unlock()
+
+	return s.save()
+}
+
+// Rollback resets the subset to empty, as documents aren't tracked
+// by seq, and restarts the pindex.
+func (s *Subset) Rollback(partition string, rollbackSeq uint64) error {
+	s.m.Lock()
+	s.partitions = map[string]*checkpointPartition{}
+	s.m.Unlock()
+
+	for _, sh := range s.shards {
+		sh.m.Lock()
+		sh.docs = map[string]json.RawMessage{}
+		sh.keys = nil
+		sh.expiries = map[string]uint32{}
+		sh.m.Unlock()
+	}
+
+	err := s.save()
+	if err != nil {
+		return err
+	}
+
+	if s.restart != nil {
+		s.restart()
+	}
+
+	return nil
+}
+
+func (s *Subset) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if consistencyLevel == "" {
+		return nil
+	}
+	if consistencyLevel != CONSISTENCY_LEVEL_AT_PLUS {
+		return fmt.Errorf("subset: unsupported consistencyLevel: %s",
+			consistencyLevel)
+	}
+
+	seqStart, _ := s.PartitionSeqMax(partition)
+
+	for {
+		s.m.Lock()
+		var seqMax uint64
+		if p := s.partitions[partition]; p != nil {
+			seqMax = p.seqMax
+		}
+		seqCh := s.seqCh
+		s.m.Unlock()
+
+		if seqMax >= consistencySeq {
+			return nil
+		}
+
+		select {
+		case <-seqCh:
+		case <-cancelCh:
+			return &ErrorConsistencyWait{
+				Err:    fmt.Errorf("subset: ConsistencyWait cancelled"),
+				Status: "cancelled",
+				StartEndSeqs: map[string][]uint64{
+					partition: []uint64{seqStart, seqMax},
+				},
+			}
+		}
+	}
+}
+
+// PartitionSeqMax implements the DestUnflushed interface.
+func (s *Subset) PartitionSeqMax(partition string) (
+	seqMax, seqMaxBatch uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if p := s.partitions[partition]; p != nil {
+		return p.seqMax, p.LastSeq
+	}
+	return 0, 0
+}
+
+func (s *Subset) Count(pindex *PIndex,
+	cancelCh <-chan bool) (uint64, error) {
+	return s.docCount(), nil
+}
+
+func (s *Subset) docCount() (rv uint64) {
+	for _, sh := range s.shards {
+		sh.m.Lock()
+		rv += uint64(len(sh.docs))
+		sh.m.Unlock()
+	}
+	return rv
+}
+
+func (s *Subset) Query(pindex *PIndex, req []byte, w io.Writer,
+	cancelCh <-chan bool) error {
+	var q SubsetQueryRequest
+	err := json.Unmarshal(req, &q)
+	if err != nil {
+		return fmt.Errorf("subset: could not parse query request,"+
+			" err: %v", err)
+	}
+
+	rv := &SubsetQueryResult{Rows: []*SubsetRow{}}
+
+	start, end := q.keyRange()
+
+	// Each shard is queried in turn, and the shards' rows, which are
+	// each within the limit, are merged like the SubsetMerger merges
+	// the rows of pindexes.
+	for _, sh := range s.shards {
+		sh.m.Lock()
+		rv.DocCount += uint64(len(sh.docs))
+
+		// The range is counted by searching the sorted keys, so
+		// counts don't need to materialize the rows.
+		i, j := sh.keyRangeLOCKED(start, end)
+		if i < j {
+			rv.Count += uint64(j - i)
+
+			if !q.DocCountOnly {
+				keys := sh.sortedKeysLOCKED()
+				if q.Limit > 0 && j-i > q.Limit {
+					j = i + q.Limit
+				}
+				for ; i < j; i++ {
+					rv.Rows = append(rv.Rows, &SubsetRow{
+						Key: keys[i],
+						Doc: sh.docs[keys[i]],
+					})
+				}
+			}
+		}
+		sh.m.Unlock()
+	}
+
+	sort.Sort(subsetRowsByKey(rv.Rows))
+	if q.Limit > 0 && len(rv.Rows) > q.Limit {
+		rv.Rows = rv.Rows[:q.Limit]
+	}
+
+	return EncodeJSON(w, rv)
+}
+
+func (s *Subset) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"docCount":%d,"totExpired":%d}`,
+		s.docCount(), atomic.LoadUint64(&s.totExpired))
+	return err
+}
+
+// Get returns the stored doc of a key, or nil.
+func (s *Subset) Get(key string) json.RawMessage {
+	sh := s.shard(key)
+	sh.m.Lock()
+	defer sh.m.Unlock()
+
+	return sh.docs[key]
+}
+
+// sortedKeysLOCKED returns the shard's sorted doc keys, which are
+// lazily sorted on the first query after the keys change.
+func (sh *subsetShard) sortedKeysLOCKED() []string {
+	if sh.keys == nil {
+		sh.keys = make([]string, 0, len(sh.docs))
+		for key := range sh.docs {
+			sh.keys = append(sh.keys, key)
+		}
+		sort.Strings(sh.keys)
+	}
+	return sh.keys
+}
+
+// keyRangeLOCKED returns the indexes into the sorted keys of the
+// inclusive start key and the exclusive end key, where an empty end
+// key means no end.
+func (sh *subsetShard) keyRangeLOCKED(start, end string) (int, int) {
+	keys := sh.sortedKeysLOCKED()
+	i := sort.SearchStrings(keys, start)
+	j := len(keys)
+	if end != "" {
+		j = sort.SearchStrings(keys, end)
+	}
+	return i, j
+}
+
+// deleteLOCKED deletes a key, returning true if the key existed.
+func (sh *subsetShard) deleteLOCKED(key string) bool {
+	if _, exists := sh.docs[key]; !exists {
+		return false
+	}
+	delete(sh.docs, key)
+	delete(sh.expiries, key)
+	sh.keys = nil
+	return true
+}
+
+// updateLOCKED stores a filtered document, or deletes the key when
+// the document was filtered out.
+func (sh *subsetShard) updateLOCKED(key string, doc json.RawMessage,
+	expiry uint32) {
+	if doc == nil {
+		sh.deleteLOCKED(key)
+		return
+	}
+	if _, exists := sh.docs[key]; !exists {
+		sh.keys = nil
+	}
+	sh.docs[key] = doc
+	if expiry > 0 {
+		sh.expiries[key] = expiry
+	} else {
+		delete(sh.expiries, key)
+	}
+}
+
+func (s *Subset) updateSeq(partition string, seq uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	p := s.partitions[partition]
+	if p == nil {
+		p = &checkpointPartition{}
+		s.partitions[partition] = p
+	}
+	if seq > p.seqMax {
+		p.seqMax = seq
+		close(s.seqCh)
+		s.seqCh = make(chan struct{})
+	}
+}
+
+// save writes the subset to the SUBSET_FILENAME, via a rename so
+// that a crash doesn't leave a partial file.  The partitions are
+// copied before the shards, so that the saved docs are at least as
+// recent as the saved checkpoints.
+func (s *Subset) save() error {
+	state := &subsetState{
+		Params:     s.params,
+		Docs:       map[string]json.RawMessage{},
+		Expiries:   map[string]uint32{},
+		Partitions: map[string]*checkpointPartition{},
+	}
+
+	s.m.Lock()
+	for partition, p := range s.partitions {
+		pCopy := *p
+		state.Partitions[partition] = &pCopy
+	}
+	s.m.Unlock()
+
+	for _, sh := range s.shards {
+		sh.m.Lock()
+		for key, doc := range sh.docs {
+			state.Docs[key] = doc
+		}
+		for key, expiry := range sh.expiries {
+			state.Expiries[key] = expiry
+		}
+		sh.m.Unlock()
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	fname := s.path + string(os.PathSeparator) + SUBSET_FILENAME
+
+	err = ioutil.WriteFile(fname+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
+
+// ---------------------------------------------------------
+
+// SubsetMerger merges the query results of the pindexes of a subset
+// index, as pindexes hold disjoint keys.
+type SubsetMerger struct {
+	limit    int
+	docCount uint64
+	count    uint64
+	rows     []*SubsetRow
+}
+
+func NewSubsetMerger(indexName string, req []byte) (Merger, error) {
+	var q SubsetQueryRequest
+	err := json.Unmarshal(req, &q)
+	if err != nil {
+		return nil, fmt.Errorf("subset: could not parse query request,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	return &SubsetMerger{limit: q.Limit, rows: []*SubsetRow{}}, nil
+}
+
+func (m *SubsetMerger) Add(pindexName string, result json.RawMessage) error {
+	var r SubsetQueryResult
+	err := json.Unmarshal(result, &r)
+	if err != nil {
+		return err
+	}
+
+	m.docCount += r.DocCount
+	m.count += r.Count
+	m.rows = append(m.rows, r.Rows...)
+
+	return nil
+}
+
+// Finish fails the query if any pindex failed, as the rows of a
+// failed pindex might have been within the limit.
+func (m *SubsetMerger) Finish(res io.Writer, status *GatherStatus) error {
+	if status.Failed > 0 {
+		return fmt.Errorf("subset: pindexes failed: %d of %d, errors: %v",
+			status.Failed, status.Total, status.Errors)
+	}
+
+	sort.Sort(subsetRowsByKey(m.rows))
+	if m.limit > 0 && len(m.rows) > m.limit {
+		m.rows = m.rows[:m.limit]
+	}
+
+	return EncodeJSON(res, &SubsetQueryResult{
+		DocCount: m.docCount,
+		Count:    m.count,
+		Rows:     m.rows,
+	})
+}
+
+type subsetRowsByKey []*SubsetRow
+
+func (a subsetRowsByKey) Len() int {
+	return len(a)
+}
+
+func (a subsetRowsByKey) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a subsetRowsByKey) Less(i, j int) bool {
+	return a[i].Key < a[j].Key
+}
+
+// CountSubset counts the documents of a subset index.
+func CountSubset(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string) (uint64, error) {
+	return CountSubsetRange(ctx, mgr, indexName, indexUUID,
+		SubsetQueryRequest{})
+}
+
+// CountSubsetRange counts the documents of a subset index within the
+// key range of a query request, where each pindex counts its own
+// range and the counts are summed by the SubsetMerger.
+func CountSubsetRange(ctx context.Context, mgr *Manager,
+	indexName, indexUUID string, q SubsetQueryRequest) (uint64, error) {
+	q.DocCountOnly = true
+	q.Limit = 0
+
+	req, err := json.Marshal(&q)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	err = mgr.Gather(ctx, indexName, indexUUID, req, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	var r SubsetQueryResult
+	err = json.Unmarshal(buf.Bytes(), &r)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.Count, nil
+}
+
+// SubsetDocLookUp returns the stored doc of a key from a subset
+// pindex, and has the signature of a PIndexImplType.DocLookUp.
+func SubsetDocLookUp(pindex *PIndex, docID string) (interface{}, error) {
+	s, ok := pindex.Impl.(*Subset)
+	if !ok {
+		return nil, fmt.Errorf("subset: not a subset pindex: %s", pindex.Name)
+	}
+
+	doc := s.Get(docID)
+	if doc == nil {
+		return nil, nil
+	}
+
+	return doc, nil
+}
+
+// ---------------------------------------------------------
+
+// SUBSET_TASK_DELETE is the op of a subset task that deletes the
+// stored documents that match a key range and conditions.
+const SUBSET_TASK_DELETE = "delete"
+
+// A SubsetTaskRequest is the request body of a task on a subset
+// index (see Manager.SubmitTask()).  For the SUBSET_TASK_DELETE op,
+// the stored documents in the key range that also match the optional
+// conditions are deleted, like to purge a tenant.  The conditions
+// are evaluated against the stored documents, so with projected
+// fields, a condition's path must be one of the fields.  Later
+// mutations of a deleted document that match the index's filter will
+// store the document again.
+type SubsetTaskRequest struct {
+	Op string `json:"op"`
+
+	StartKey string `json:"startKey,omitempty"` // Inclusive.
+	EndKey   string `json:"endKey,omitempty"`   // Exclusive.
+	Prefix   string `json:"prefix,omitempty"`
+
+	Conditions []SubsetCondition `json:"conditions,omitempty"`
+	Match      string            `json:"match,omitempty"`
+}
+
+// SubmitSubsetTask runs a task on the local pindexes of a subset
+// index, one pindex at a time, reporting its progress after each
+// pindex, and has the signature of a PIndexImplType.SubmitTaskRequest.
+// Only the pindexes on this node are processed, so a task should be
+// submitted to each node of the index.
+func SubmitSubsetTask(mgr *Manager, indexName, indexUUID, taskID string,
+	requestBody []byte) (*TaskRequestStatus, error) {
+	var r SubsetTaskRequest
+	err := json.Unmarshal(requestBody, &r)
+	if err != nil {
+		return nil, fmt.Errorf("subset: could not parse task request,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+	if r.Op != SUBSET_TASK_DELETE {
+		return nil, fmt.Errorf("subset: unknown task op: %q,"+
+			" indexName: %s", r.Op, indexName)
+	}
+	if len(r.Conditions) > 0 {
+		r.Match, err = validateSubsetConditions(r.Conditions, r.Match)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var subsets []*Subset
+
+	_, pindexes := mgr.CurrentMaps()
+	for _, pindexName := range mgr.LocalPIndexNamesForIndex(indexName) {
+		pindex := pindexes[pindexName]
+		if pindex == nil || pindex.IndexUUID != indexUUID {
+			continue
+		}
+		s, ok := pindex.Impl.(*Subset)
+		if !ok {
+			return nil, fmt.Errorf("subset: not a subset pindex: %s",
+				pindexName)
+		}
+		subsets = append(subsets, s)
+	}
+
+	status, err := mgr.GetTaskRequestStatus(taskID)
+	if err != nil || status == nil {
+		return nil, fmt.Errorf("subset: no task status, taskID: %s,"+
+			" err: %v", taskID, err)
+	}
+
+	status.Status = TASK_STATUS_RUNNING
+	status.Total = len(subsets)
+
+	for _, s := range subsets {
+		deleted, err := s.Delete(&r)
+		if err != nil {
+			return nil, fmt.Errorf("subset: delete task, indexName: %s,"+
+				" path: %s, err: %v", indexName, s.path, err)
+		}
+
+		log.Printf("subset: delete task, taskID: %s, indexName: %s,"+
+			" path: %s, deleted: %d", taskID, indexName, s.path, deleted)
+
+		status.Completed++
+
+		err = mgr.UpdateTaskRequestStatus(status)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status.Status = TASK_STATUS_DONE
+
+	return status, nil
+}
+
+// Delete deletes the stored documents that match a delete task
+// request, and saves the subset, returning the number of deleted
+// documents.
+func (s *Subset) Delete(r *SubsetTaskRequest) (int, error) {
+	start, end := (&SubsetQueryRequest{
+		StartKey: r.StartKey,
+		EndKey:   r.EndKey,
+		Prefix:   r.Prefix,
+	}).keyRange()
+
+	var deleted int
+
+	for _, sh := range s.shards {
+		sh.m.Lock()
+
+		keys := sh.sortedKeysLOCKED()
+		i, j := sh.keyRangeLOCKED(start, end)
+
+		var deleteKeys []string
+		for ; i < j; i++ {
+			if len(r.Conditions) > 0 &&
+				!s.storedMatches(sh.docs[keys[i]], r) {
+				continue
+			}
+			deleteKeys = append(deleteKeys, keys[i])
+		}
+
+		for _, key := range deleteKeys {
+			sh.deleteLOCKED(key)
+		}
+
+		sh.m.Unlock()
+
+		deleted += len(deleteKeys)
+	}
+
+	if deleted <= 0 {
+		return 0, nil
+	}
+
+	return deleted, s.save()
+}
+
+// storedMatches returns true when a stored document matches the
+// conditions of a task request.
+func (s *Subset) storedMatches(stored json.RawMessage,
+	r *SubsetTaskRequest) bool {
+	var doc interface{}
+	err := json.Unmarshal(stored, &doc)
+	if err != nil {
+		return false
+	}
+
+	return subsetMatches(r.Conditions, r.Match,
+		func(path string) (interface{}, bool) {
+			if len(s.params.Fields) > 0 {
+				// A projection is keyed by the JSON pointers.
+				projection, ok := doc.(map[string]interface{})
+				if !ok {
+					return nil, false
+				}
+				v, ok := projection[path]
+				return v, ok
+			}
+			return jsonPointerGet(doc, path)
+		})
+}
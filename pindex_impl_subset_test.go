@@ -0,0 +1,457 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateSubsetParams(t *testing.T) {
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{`{"conditions":[{"path":"/type","equals":"order"}]}`, true},
+		{`{"conditions":[{"path":"/a","prefix":"x"},` +
+			`{"path":"/b","equals":1}],"match":"any","fields":["/a"]}`, true},
+		{`{}`, false},
+		{`{"conditions":[{"path":"type","equals":"order"}]}`, false},
+		{`{"conditions":[{"path":"/type"}]}`, false},
+		{`{"conditions":[{"path":"/t","equals":1,"prefix":"x"}]}`, false},
+		{`{"conditions":[{"path":"/t","equals":1}],"match":"some"}`, false},
+		{`{"conditions":[{"path":"/t","equals":1}],"fields":["t"]}`, false},
+		{`not json`, false},
+	}
+
+	for i, test := range tests {
+		err := ValidateSubsetPIndexImpl("subset", "s", test.params)
+		if (err == nil) != test.ok {
+			t.Errorf("test: %d, params: %s, expected ok: %v, err: %v",
+				i, test.params, test.ok, err)
+		}
+	}
+}
+
+func querySubset(t *testing.T, s *Subset, req string) *SubsetQueryResult {
+	var buf bytes.Buffer
+	err := s.Query(nil, []byte(req), &buf, nil)
+	if err != nil {
+		t.Fatalf("expected Query() to work, err: %v", err)
+	}
+
+	var rv SubsetQueryResult
+	err = json.Unmarshal(buf.Bytes(), &rv)
+	if err != nil {
+		t.Fatalf("expected parseable query result, err: %v", err)
+	}
+
+	return &rv
+}
+
+func subsetRowKeys(rows []*SubsetRow) string {
+	var keys []string
+	for _, row := range rows {
+		keys = append(keys, row.Key)
+	}
+	b, _ := json.Marshal(keys)
+	return string(b)
+}
+
+func TestSubset(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "s"
+
+	impl, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/type","equals":"order"},`+
+			`{"path":"/region","prefix":"us-"}],`+
+			`"fields":["/type","/total"]}`, path, nil)
+	if err != nil || impl == nil || dest == nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+
+	updates := []struct {
+		key string
+		val string
+	}{
+		{"o3", `{"type":"order","region":"us-west","total":3}`},
+		{"o1", `{"type":"order","region":"us-east","total":1,"x":"y"}`},
+		{"o2", `{"type":"order","region":"eu-west","total":2}`},
+		{"u1", `{"type":"user","region":"us-east"}`},
+		{"o4", `{"type":"order","region":"us-east","total":4}`},
+		{"o5", `not json`},
+		{"o4", `{"type":"order","region":"eu-east","total":4}`},
+		{"o2", `{"type":"order","region":"us-west","total":2}`},
+	}
+	for i, u := range updates {
+		err = dest.DataUpdate("0", []byte(u.key), uint64(i+1),
+			[]byte(u.val), 0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Fatalf("expected DataUpdate() to work, err: %v", err)
+		}
+	}
+
+	s := dest.(*Subset)
+
+	rv := querySubset(t, s, `{}`)
+	if rv.DocCount != 3 || subsetRowKeys(rv.Rows) != `["o1","o2","o3"]` {
+		t.Errorf("expected 3 matching docs, got: %d, %s",
+			rv.DocCount, subsetRowKeys(rv.Rows))
+	}
+	if string(rv.Rows[0].Doc) != `{"/total":1,"/type":"order"}` {
+		t.Errorf("expected projected doc, got: %s", rv.Rows[0].Doc)
+	}
+
+	rv = querySubset(t, s, `{"startKey":"o2","endKey":"o3"}`)
+	if subsetRowKeys(rv.Rows) != `["o2"]` {
+		t.Errorf("expected key range, got: %s", subsetRowKeys(rv.Rows))
+	}
+
+	rv = querySubset(t, s, `{"limit":2}`)
+	if subsetRowKeys(rv.Rows) != `["o1","o2"]` || rv.Count != 3 {
+		t.Errorf("expected limit, got: %d, %s",
+			rv.Count, subsetRowKeys(rv.Rows))
+	}
+
+	rv = querySubset(t, s,
+		`{"prefix":"o","startKey":"o2","docCountOnly":true}`)
+	if rv.Count != 2 || rv.DocCount != 3 || len(rv.Rows) != 0 {
+		t.Errorf("expected range count only, got: %#v", rv)
+	}
+
+	rv = querySubset(t, s, `{"prefix":"x"}`)
+	if rv.Count != 0 || len(rv.Rows) != 0 {
+		t.Errorf("expected empty prefix range, got: %#v", rv)
+	}
+
+	err = dest.DataDelete("0", []byte("o1"), 9, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Fatalf("expected DataDelete() to work, err: %v", err)
+	}
+
+	err = dest.OpaqueSet("0", []byte("opaque"))
+	if err != nil {
+		t.Fatalf("expected OpaqueSet() to work, err: %v", err)
+	}
+
+	impl.(*Subset).Close()
+
+	impl, dest, err = OpenSubsetPIndexImpl("subset", path, nil)
+	if err != nil {
+		t.Fatalf("expected OpenSubsetPIndexImpl() to work, err: %v", err)
+	}
+
+	opaque, lastSeq, err := dest.OpaqueGet("0")
+	if err != nil || string(opaque) != "opaque" || lastSeq != 9 {
+		t.Errorf("expected reopened opaque, got: %s, %d, err: %v",
+			opaque, lastSeq, err)
+	}
+
+	s = dest.(*Subset)
+
+	rv = querySubset(t, s, `{}`)
+	if subsetRowKeys(rv.Rows) != `["o2","o3"]` {
+		t.Errorf("expected reopened docs, got: %s", subsetRowKeys(rv.Rows))
+	}
+
+	doc, err := SubsetDocLookUp(&PIndex{Name: "p", Impl: impl}, "o3")
+	if err != nil || string(doc.(json.RawMessage)) !=
+		`{"/total":3,"/type":"order"}` {
+		t.Errorf("expected doc lookup, got: %v, err: %v", doc, err)
+	}
+
+	doc, err = SubsetDocLookUp(&PIndex{Name: "p", Impl: impl}, "o1")
+	if err != nil || doc != nil {
+		t.Errorf("expected no doc, got: %v, err: %v", doc, err)
+	}
+}
+
+func TestSubsetKeyRange(t *testing.T) {
+	tests := []struct {
+		q          SubsetQueryRequest
+		start, end string
+	}{
+		{SubsetQueryRequest{}, "", ""},
+		{SubsetQueryRequest{StartKey: "a", EndKey: "c"}, "a", "c"},
+		{SubsetQueryRequest{Prefix: "ab"}, "ab", "ac"},
+		{SubsetQueryRequest{Prefix: "ab", StartKey: "abc"}, "abc", "ac"},
+		{SubsetQueryRequest{Prefix: "ab", StartKey: "a"}, "ab", "ac"},
+		{SubsetQueryRequest{Prefix: "ab", EndKey: "abc"}, "ab", "abc"},
+		{SubsetQueryRequest{Prefix: "ab", EndKey: "b"}, "ab", "ac"},
+		{SubsetQueryRequest{Prefix: "a\xff"}, "a\xff", "b"},
+		{SubsetQueryRequest{Prefix: "\xff"}, "\xff", ""},
+	}
+
+	for i, test := range tests {
+		start, end := test.q.keyRange()
+		if start != test.start || end != test.end {
+			t.Errorf("test: %d, expected: %q, %q, got: %q, %q",
+				i, test.start, test.end, start, end)
+		}
+	}
+}
+
+func TestSubsetMatchAny(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/a","equals":1},{"path":"/b","equals":true}],`+
+			`"match":"any"}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+
+	dest.DataUpdate("0", []byte("k0"), 1, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("0", []byte("k1"), 2, []byte(`{"b":true}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.DataUpdate("0", []byte("k2"), 3, []byte(`{"a":2,"b":false}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	rv := querySubset(t, dest.(*Subset), `{}`)
+	if subsetRowKeys(rv.Rows) != `["k0","k1"]` ||
+		string(rv.Rows[0].Doc) != `{"a":1}` {
+		t.Errorf("expected any match of whole docs, got: %s",
+			subsetRowKeys(rv.Rows))
+	}
+}
+
+func TestSubsetMerger(t *testing.T) {
+	m, err := NewSubsetMerger("s", []byte(`{"limit":3}`))
+	if err != nil {
+		t.Fatalf("expected NewSubsetMerger() to work, err: %v", err)
+	}
+
+	m.Add("p0", json.RawMessage(`{"docCount":5,"count":4,"rows":[`+
+		`{"key":"a","doc":{}},{"key":"c","doc":{}},{"key":"e","doc":{}}]}`))
+	m.Add("p1", json.RawMessage(`{"docCount":2,"count":2,"rows":[`+
+		`{"key":"b","doc":{}},{"key":"d","doc":{}}]}`))
+
+	var buf bytes.Buffer
+	err = m.Finish(&buf, &GatherStatus{Total: 2, Successful: 2})
+	if err != nil {
+		t.Fatalf("expected Finish() to work, err: %v", err)
+	}
+
+	var rv SubsetQueryResult
+	json.Unmarshal(buf.Bytes(), &rv)
+	if rv.DocCount != 7 || rv.Count != 6 ||
+		subsetRowKeys(rv.Rows) != `["a","b","c"]` {
+		t.Errorf("expected merged rows, got: %s", buf.String())
+	}
+
+	err = m.Finish(&buf, &GatherStatus{Total: 2, Successful: 1, Failed: 1})
+	if err == nil {
+		t.Errorf("expected Finish() to fail on failed pindexes")
+	}
+}
+
+func TestSubsetDelete(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/type","equals":"order"}],`+
+			`"fields":["/tenant"]}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+
+	for i, key := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		tenant := "t1"
+		if i%2 == 1 {
+			tenant = "t2"
+		}
+		dest.DataUpdate("0", []byte(key), uint64(i+1),
+			[]byte(`{"type":"order","tenant":"`+tenant+`"}`),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+	}
+
+	s := dest.(*Subset)
+
+	deleted, err := s.Delete(&SubsetTaskRequest{
+		Op:         SUBSET_TASK_DELETE,
+		Conditions: []SubsetCondition{{Path: "/tenant", Equals: "t2"}},
+	})
+	if err != nil || deleted != 2 {
+		t.Errorf("expected 2 deletes, got: %d, err: %v", deleted, err)
+	}
+
+	deleted, err = s.Delete(&SubsetTaskRequest{
+		Op:     SUBSET_TASK_DELETE,
+		Prefix: "b",
+	})
+	if err != nil || deleted != 1 {
+		t.Errorf("expected 1 delete, got: %d, err: %v", deleted, err)
+	}
+
+	rv := querySubset(t, s, `{}`)
+	if subsetRowKeys(rv.Rows) != `["a1","c1"]` {
+		t.Errorf("expected remaining docs, got: %s", subsetRowKeys(rv.Rows))
+	}
+}
+
+func TestSubmitSubsetTask(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"subset", "s", `{"conditions":[{"path":"/a","equals":1}]}`,
+		PlanParams{}, ""); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindex := m.GetPIndex(m.LocalPIndexNamesForIndex("s")[0])
+	pindex.Dest.DataUpdate("0", []byte("k0"), 1, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	pindex.Dest.DataUpdate("0", []byte("k1"), 2, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	task, err := m.SubmitTask("s", []byte(`{"op":"bogus"}`))
+	if err == nil || task.Status != TASK_STATUS_FAILED {
+		t.Errorf("expected failed task on unknown op, got: %#v", task)
+	}
+
+	task, err = m.SubmitTask("s", []byte(`{"op":"delete","startKey":"k1"}`))
+	if err != nil || task.Status != TASK_STATUS_DONE ||
+		task.Total != 1 || task.Completed != 1 {
+		t.Errorf("expected done task, got: %#v, err: %v", task, err)
+	}
+
+	count, err := pindex.Dest.Count(pindex, nil)
+	if err != nil || count != 1 {
+		t.Errorf("expected 1 remaining doc, got: %d, err: %v", count, err)
+	}
+}
+
+func TestSubsetExpiry(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/a","equals":1}]}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	now := time.Now()
+
+	for i, expiry := range []time.Time{
+		now.Add(-time.Minute), now.Add(time.Hour), time.Time{}, time.Time{},
+	} {
+		var secs uint32
+		if !expiry.IsZero() {
+			secs = uint32(expiry.Unix())
+		}
+		dest.DataUpdate("0", []byte(fmt.Sprintf("k%d", i)), uint64(i+1),
+			[]byte(`{"a":1}`), 0, DEST_EXTRAS_TYPE_META,
+			EncodeDestExtrasMeta(&DestExtrasMeta{Expiry: secs}))
+	}
+
+	s := dest.(*Subset)
+
+	if purged := s.PurgeExpired(now); purged != 1 {
+		t.Errorf("expected 1 purged, got: %d", purged)
+	}
+
+	err = DestDataExpire(dest, "0", []byte("k2"), 5,
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected DataExpire() to work, err: %v", err)
+	}
+
+	// An update without an expiry clears the expiry.
+	dest.DataUpdate("0", []byte("k1"), 6, []byte(`{"a":1}`),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	if purged := s.PurgeExpired(now.Add(2 * time.Hour)); purged != 0 {
+		t.Errorf("expected none purged, got: %d", purged)
+	}
+
+	rv := querySubset(t, s, `{}`)
+	if subsetRowKeys(rv.Rows) != `["k1","k3"]` {
+		t.Errorf("expected unexpired docs, got: %s", subsetRowKeys(rv.Rows))
+	}
+
+	var buf bytes.Buffer
+	s.Stats(&buf)
+	if buf.String() != `{"docCount":2,"totExpired":2}` {
+		t.Errorf("expected expired stats, got: %s", buf.String())
+	}
+}
+
+func TestSubsetShardsParallelIngest(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewSubsetPIndexImpl("subset",
+		`{"conditions":[{"path":"/a","equals":1}]}`, emptyDir, nil)
+	if err != nil {
+		t.Fatalf("expected NewSubsetPIndexImpl() to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	s := dest.(*Subset)
+	if len(s.shards) != SUBSET_SHARDS {
+		t.Errorf("expected %d shards, got: %d", SUBSET_SHARDS, len(s.shards))
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func(partition string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				dest.DataUpdate(partition,
+					[]byte(fmt.Sprintf("%s-%03d", partition, i)),
+					uint64(i+1), []byte(`{"a":1}`),
+					0, DEST_EXTRAS_TYPE_NIL, nil)
+			}
+		}(strconv.Itoa(p))
+	}
+	wg.Wait()
+
+	for p := 0; p < 4; p++ {
+		if seqMax, _ := s.PartitionSeqMax(strconv.Itoa(p)); seqMax != 100 {
+			t.Errorf("expected seqMax 100, partition: %d, got: %d",
+				p, seqMax)
+		}
+	}
+
+	// Rows are merged across the shards in key order.
+	rv := querySubset(t, s, `{"startKey":"1-098","limit":4}`)
+	if rv.DocCount != 400 || rv.Count != 202 ||
+		subsetRowKeys(rv.Rows) != `["1-098","1-099","2-000","2-001"]` {
+		t.Errorf("expected merged rows, got: %d, %d, %s",
+			rv.DocCount, rv.Count, subsetRowKeys(rv.Rows))
+	}
+}
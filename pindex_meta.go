@@ -0,0 +1,149 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/couchbase/clog"
+)
+
+// A PINDEX_META_FILENAME file starts with a header line of the form
+// "PINDEX_META_HEADER VERSION CRC32", where the CRC32 is of the JSON
+// body that follows the header, so that a torn or corrupted write is
+// detected when the pindex is opened.  Files without the header,
+// written by older versions, are read as a plain JSON body.
+
+// PINDEX_META_HEADER starts the header line of a PINDEX_META_FILENAME.
+const PINDEX_META_HEADER = "cbgt-pindex-meta"
+
+// PINDEX_META_VERSION is the version of the PINDEX_META_FILENAME
+// header and body.
+const PINDEX_META_VERSION = 1
+
+// PIndexMetaCorruptError is returned when a PINDEX_META_FILENAME file
+// fails its checksum or has an unknown header.
+type PIndexMetaCorruptError struct {
+	Path string
+	Msg  string
+}
+
+func (e *PIndexMetaCorruptError) Error() string {
+	return fmt.Sprintf("pindex_meta: corrupt PINDEX_META_FILENAME,"+
+		" path: %s, %s", e.Path, e.Msg)
+}
+
+// WritePIndexMeta atomically writes the JSON body of a pindex's
+// PINDEX_META_FILENAME, with a checksum header, by writing to a temp
+// file that's then renamed, so that a crash mid-write leaves either
+// the old or the new file.
+func WritePIndexMeta(pindexPath string, body []byte) error {
+	path := filepath.Join(pindexPath, PINDEX_META_FILENAME)
+	tmpPath := path + ".tmp"
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d %08x\n", PINDEX_META_HEADER,
+		PINDEX_META_VERSION, crc32.ChecksumIEEE(body))
+	buf.Write(body)
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// ReadPIndexMeta reads the JSON body of a pindex's
+// PINDEX_META_FILENAME, verifying its checksum header if any.
+func ReadPIndexMeta(pindexPath string) ([]byte, error) {
+	path := filepath.Join(pindexPath, PINDEX_META_FILENAME)
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(buf, []byte(PINDEX_META_HEADER+" ")) {
+		return buf, nil // An older file without a header.
+	}
+
+	nl := bytes.IndexByte(buf, '\n')
+	if nl < 0 {
+		return nil, &PIndexMetaCorruptError{Path: path, Msg: "no body"}
+	}
+
+	header := bytes.Fields(buf[:nl])
+	body := buf[nl+1:]
+
+	if len(header) != 3 {
+		return nil, &PIndexMetaCorruptError{Path: path,
+			Msg: fmt.Sprintf("bad header: %q", buf[:nl])}
+	}
+
+	version, err := strconv.Atoi(string(header[1]))
+	if err != nil || version != PINDEX_META_VERSION {
+		return nil, &PIndexMetaCorruptError{Path: path,
+			Msg: fmt.Sprintf("unknown version: %q", header[1])}
+	}
+
+	checksum, err := strconv.ParseUint(string(header[2]), 16, 32)
+	if err != nil || uint32(checksum) != crc32.ChecksumIEEE(body) {
+		return nil, &PIndexMetaCorruptError{Path: path,
+			Msg: fmt.Sprintf("checksum mismatch: %q", header[2])}
+	}
+
+	return body, nil
+}
+
+// notePIndexOpenErr logs a pindex that couldn't be opened, and emits
+// a MANAGER_EVENT_PINDEX_CORRUPT when its PINDEX_META_FILENAME is
+// corrupt, in which case the janitor rebuilds just that pindex if
+// it's still assigned to this node.
+func (mgr *Manager) notePIndexOpenErr(path string, err error) {
+	if _, ok := err.(*PIndexMetaCorruptError); !ok {
+		log.Printf("manager: could not open pindex path: %s, err: %v",
+			path, err)
+		return
+	}
+
+	pindexName, _ := mgr.ParsePIndexPath(path)
+
+	log.Printf("manager: corrupt pindex, will be rebuilt if planned,"+
+		" path: %s, err: %v", path, err)
+
+	mgr.EmitEvent(ManagerEvent{
+		Kind:       MANAGER_EVENT_PINDEX_CORRUPT,
+		IndexName:  PIndexIndexName(pindexName),
+		PIndexName: pindexName,
+		Err:        err.Error(),
+	})
+}
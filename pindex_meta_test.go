@@ -0,0 +1,103 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPIndexMeta(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	body := []byte(`{"name":"p0"}`)
+
+	if err := WritePIndexMeta(emptyDir, body); err != nil {
+		t.Errorf("expected WritePIndexMeta() to work, err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(emptyDir,
+		PINDEX_META_FILENAME+".tmp")); err == nil {
+		t.Errorf("expected no leftover temp file")
+	}
+
+	buf, err := ReadPIndexMeta(emptyDir)
+	if err != nil || !bytes.Equal(buf, body) {
+		t.Errorf("expected ReadPIndexMeta() to work, buf: %s, err: %v",
+			buf, err)
+	}
+
+	path := filepath.Join(emptyDir, PINDEX_META_FILENAME)
+
+	// Files of older versions have no header.
+	ioutil.WriteFile(path, body, 0600)
+	buf, err = ReadPIndexMeta(emptyDir)
+	if err != nil || !bytes.Equal(buf, body) {
+		t.Errorf("expected ReadPIndexMeta() of an older file to work,"+
+			" buf: %s, err: %v", buf, err)
+	}
+
+	for _, corrupt := range []string{
+		PINDEX_META_HEADER + " 1 00000000",
+		PINDEX_META_HEADER + " 1\n{}",
+		PINDEX_META_HEADER + " 99 00000000\n{}",
+		PINDEX_META_HEADER + " 1 00000000\n" + string(body),
+	} {
+		ioutil.WriteFile(path, []byte(corrupt), 0600)
+		_, err = ReadPIndexMeta(emptyDir)
+		if _, ok := err.(*PIndexMetaCorruptError); !ok {
+			t.Errorf("expected corrupt error for: %q, err: %v", corrupt, err)
+		}
+	}
+}
+
+func TestOpenCorruptPIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+
+	eventCh := make(chan ManagerEvent, 10)
+	m.SubscribeEvents(eventCh)
+
+	path := m.PIndexPath("idx_uuid_00000000")
+	pindex, err := NewPIndex(m, "idx_uuid_00000000", "uuid", "blackhole",
+		"idx", "uuid", "", "nil", "", "", "", "", path)
+	if err != nil {
+		t.Fatalf("expected NewPIndex() to work, err: %v", err)
+	}
+	pindex.Close(false)
+
+	ioutil.WriteFile(filepath.Join(path, PINDEX_META_FILENAME),
+		[]byte(PINDEX_META_HEADER+" 1 00000000\n{}"), 0600)
+
+	_, err = OpenPIndex(m, path)
+	if _, ok := err.(*PIndexMetaCorruptError); !ok {
+		t.Errorf("expected OpenPIndex() corrupt error, err: %v", err)
+	}
+
+	m.notePIndexOpenErr(path, err)
+
+	select {
+	case e := <-eventCh:
+		if e.Kind != MANAGER_EVENT_PINDEX_CORRUPT || e.IndexName != "idx" ||
+			e.PIndexName != "idx_uuid_00000000" {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	default:
+		t.Errorf("expected a pindexCorrupt event")
+	}
+}
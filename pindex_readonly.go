@@ -0,0 +1,199 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// PINDEX_READ_ONLY_BUFFER is the read-only policy where a pindex's
+// feed is stopped, so that mutations are retained by the data source
+// and ingested from the pindex's persisted sequence numbers once the
+// pindex is writable again.
+const PINDEX_READ_ONLY_BUFFER = "buffer"
+
+// PINDEX_READ_ONLY_DROP is the read-only policy where a pindex's feed
+// keeps running, but the pindex's incoming data mutations are
+// dropped, so the pindex misses those mutations unless its feed is
+// later restarted from an earlier persisted sequence number.
+const PINDEX_READ_ONLY_DROP = "drop"
+
+// SetPIndexReadOnly places a local pindex into read-only mode with
+// the given policy, or makes the pindex writable again when the
+// policy is "".  Queries are allowed on read-only pindexes.  Unlike
+// the index-wide ingestControl, read-only mode only affects this
+// node and is not persisted, so it's cleared by a restart.
+func (mgr *Manager) SetPIndexReadOnly(pindexName, policy string) error {
+	if policy != "" &&
+		policy != PINDEX_READ_ONLY_BUFFER && policy != PINDEX_READ_ONLY_DROP {
+		return fmt.Errorf("pindex_readonly: unknown policy: %q", policy)
+	}
+
+	if mgr.GetPIndex(pindexName) == nil {
+		return fmt.Errorf("pindex_readonly: no pindex, pindexName: %s",
+			pindexName)
+	}
+
+	mgr.m.Lock()
+	if policy == "" {
+		delete(mgr.pindexReadOnly, pindexName)
+	} else {
+		if mgr.pindexReadOnly == nil {
+			mgr.pindexReadOnly = map[string]string{}
+		}
+		mgr.pindexReadOnly[pindexName] = policy
+	}
+	mgr.m.Unlock()
+
+	log.Printf("pindex_readonly: pindex: %s, policy: %q", pindexName, policy)
+
+	mgr.JanitorKick("api/SetPIndexReadOnly, pindex: " + pindexName)
+
+	return nil
+}
+
+// PIndexReadOnly returns the read-only policy of a pindex, or "" if
+// the pindex is writable.
+func (mgr *Manager) PIndexReadOnly(pindexName string) string {
+	mgr.m.Lock()
+	rv := mgr.pindexReadOnly[pindexName]
+	mgr.m.Unlock()
+	return rv
+}
+
+// PIndexesReadOnly returns the read-only policies of the current
+// local read-only pindexes, keyed by pindex name.
+func (mgr *Manager) PIndexesReadOnly() map[string]string {
+	_, pindexes := mgr.CurrentMaps()
+
+	rv := map[string]string{}
+
+	mgr.m.Lock()
+	for pindexName, policy := range mgr.pindexReadOnly {
+		if pindexes[pindexName] != nil {
+			rv[pindexName] = policy
+		}
+	}
+	mgr.m.Unlock()
+
+	return rv
+}
+
+// feedDest returns the Dest that a feed should send a pindex's data
+// to, based on the pindex's read-only policy, feed backpressure, the
+// memory quota, fault injection and doc tracing.
+func (mgr *Manager) feedDest(pindex *PIndex) Dest {
+	if mgr.PIndexReadOnly(pindex.Name) == PINDEX_READ_ONLY_DROP {
+		return &DestReadOnly{Dest: pindex.Dest, mgr: mgr}
+	}
+	return mgr.feedDestDocTrace(pindex.IndexName,
+		mgr.feedDestFaults(pindex.IndexName,
+			mgr.feedDestMemoryThrottle(mgr.feedDestBackpressure(
+				mgr.feedDestBatch(pindex.Dest)))))
+}
+
+// feedDestsStale returns true if a feed's dests for the given
+// pindexes don't reflect the current read-only policies of the
+// pindexes, so that the feed needs to be restarted.
+func (mgr *Manager) feedDestsStale(feed Feed, pindexes []*PIndex) bool {
+	dests := feed.Dests()
+	for _, pindex := range pindexes {
+		for partition := range pindex.sourcePartitionsMap {
+			dest, exists := dests[partition]
+			if !exists {
+				continue
+			}
+			_, dropping := dest.(*DestReadOnly)
+			if dropping !=
+				(mgr.PIndexReadOnly(pindex.Name) == PINDEX_READ_ONLY_DROP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restartStaleFeeds adds feeds whose dests are stale, per
+// feedDestsStale(), to the janitor's feeds to remove and re-add,
+// unless CalcFeedsDelta() already decided to remove or add them.
+func (mgr *Manager) restartStaleFeeds(currFeeds map[string]Feed,
+	planPIndexes *PlanPIndexes, pindexes map[string]*PIndex,
+	feedAllotment string, addFeeds [][]*PIndex, removeFeeds []Feed) (
+	[][]*PIndex, []Feed) {
+	skip := map[string]bool{}
+	for _, removeFeed := range removeFeeds {
+		skip[removeFeed.Name()] = true
+	}
+	for _, addFeedPIndexes := range addFeeds {
+		if len(addFeedPIndexes) > 0 {
+			skip[FeedNameForPIndex(addFeedPIndexes[0], feedAllotment)] = true
+		}
+	}
+
+	groupedPIndexes := map[string][]*PIndex{}
+	for _, pindex := range pindexes {
+		planPIndex := planPIndexes.PlanPIndexes[pindex.Name]
+		if planPIndex != nil &&
+			PlanPIndexNodeCanWrite(planPIndex.Nodes[mgr.uuid]) {
+			feedName := FeedNameForPIndex(pindex, feedAllotment)
+			groupedPIndexes[feedName] =
+				append(groupedPIndexes[feedName], pindex)
+		}
+	}
+
+	for feedName, feedPIndexes := range groupedPIndexes {
+		currFeed := currFeeds[feedName]
+		if currFeed != nil && !skip[feedName] &&
+			mgr.feedDestsStale(currFeed, feedPIndexes) {
+			removeFeeds = append(removeFeeds, currFeed)
+			addFeeds = append(addFeeds, feedPIndexes)
+		}
+	}
+
+	return addFeeds, removeFeeds
+}
+
+// ------------------------------------------------------------------------
+
+// DestReadOnly is a Dest wrapper used for pindexes in read-only mode
+// with the PINDEX_READ_ONLY_DROP policy, which drops incoming data
+// mutations while passing through everything else, such as queries
+// and opaque state.
+type DestReadOnly struct {
+	Dest
+
+	mgr *Manager
+}
+
+func (d *DestReadOnly) DataUpdate(partition string, key []byte, seq uint64,
+	val []byte, cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	atomic.AddUint64(&d.mgr.stats.TotReadOnlyDrop, 1)
+	return nil
+}
+
+func (d *DestReadOnly) DataDelete(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	atomic.AddUint64(&d.mgr.stats.TotReadOnlyDrop, 1)
+	return nil
+}
+
+func (d *DestReadOnly) DataExpire(partition string, key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	atomic.AddUint64(&d.mgr.stats.TotReadOnlyDrop, 1)
+	return nil
+}
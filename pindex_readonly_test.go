@@ -0,0 +1,89 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerPIndexReadOnly(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+	pindex := m.GetPIndex(pindexName)
+
+	if m.SetPIndexReadOnly(pindexName, "not-a-policy") == nil {
+		t.Errorf("expected err on unknown policy")
+	}
+	if m.SetPIndexReadOnly("not-a-pindex", PINDEX_READ_ONLY_BUFFER) == nil {
+		t.Errorf("expected err on unknown pindex")
+	}
+
+	feedDest := func() Dest {
+		feeds, _ := m.CurrentMaps()
+		for _, feed := range feeds {
+			for _, dest := range feed.Dests() {
+				return dest
+			}
+		}
+		return nil
+	}
+
+	err := m.SetPIndexReadOnly(pindexName, PINDEX_READ_ONLY_BUFFER)
+	if err != nil {
+		t.Errorf("expected read-only to work, err: %v", err)
+	}
+	if feedDest() != nil || m.GetPIndex(pindexName) != pindex {
+		t.Errorf("expected buffered read-only pindex to have no feed")
+	}
+	if m.PIndexesReadOnly()[pindexName] != PINDEX_READ_ONLY_BUFFER {
+		t.Errorf("expected read-only policy, got: %v", m.PIndexesReadOnly())
+	}
+
+	err = m.SetPIndexReadOnly(pindexName, PINDEX_READ_ONLY_DROP)
+	if err != nil {
+		t.Errorf("expected read-only to work, err: %v", err)
+	}
+	destReadOnly, ok := feedDest().(*DestReadOnly)
+	if !ok || destReadOnly.Dest != pindex.Dest {
+		t.Errorf("expected dropping feed dest, got: %#v", feedDest())
+	}
+	destReadOnly.DataUpdate("", []byte("k"), 1, []byte("v"), 0,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if m.stats.TotReadOnlyDrop != 1 {
+		t.Errorf("expected a dropped mutation")
+	}
+
+	err = m.SetPIndexReadOnly(pindexName, "")
+	if err != nil {
+		t.Errorf("expected writable to work, err: %v", err)
+	}
+	if feedDest() != pindex.Dest || len(m.PIndexesReadOnly()) != 0 {
+		t.Errorf("expected writable pindex feed dest, got: %#v", feedDest())
+	}
+}
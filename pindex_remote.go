@@ -0,0 +1,180 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A scatter-gather across the covering pindexes of a wide index can
+// query all the pindexes that are on the same remote node with a
+// single request, instead of one request per remote pindex.  See
+// GroupRemotePlanPIndexes() and Manager.QueryPIndexes().
+
+// A RemoteNodePlanPIndexes represents the remote plan pindexes of a
+// scatter-gather that are on the same node.
+type RemoteNodePlanPIndexes struct {
+	NodeDef      *NodeDef
+	PlanPIndexes []*PlanPIndex
+}
+
+// GroupRemotePlanPIndexes groups remote plan pindexes by their node,
+// where the groups are ordered by node UUID.
+func GroupRemotePlanPIndexes(
+	remotePlanPIndexes []*RemotePlanPIndex) []*RemoteNodePlanPIndexes {
+	byNode := map[string]*RemoteNodePlanPIndexes{}
+	nodeUUIDs := []string(nil)
+
+	for _, remotePlanPIndex := range remotePlanPIndexes {
+		nodeUUID := remotePlanPIndex.NodeDef.UUID
+
+		group, exists := byNode[nodeUUID]
+		if !exists {
+			group = &RemoteNodePlanPIndexes{NodeDef: remotePlanPIndex.NodeDef}
+			byNode[nodeUUID] = group
+			nodeUUIDs = append(nodeUUIDs, nodeUUID)
+		}
+
+		group.PlanPIndexes = append(group.PlanPIndexes,
+			remotePlanPIndex.PlanPIndex)
+	}
+
+	sort.Strings(nodeUUIDs)
+
+	rv := make([]*RemoteNodePlanPIndexes, 0, len(nodeUUIDs))
+	for _, nodeUUID := range nodeUUIDs {
+		rv = append(rv, byNode[nodeUUID])
+	}
+
+	return rv
+}
+
+// QueryPIndexesResults represents the per-pindex outcomes of
+// Manager.QueryPIndexes(), keyed by pindex name.
+type QueryPIndexesResults struct {
+	Results map[string]json.RawMessage `json:"results"`
+	Errors  map[string]string          `json:"errors,omitempty"`
+
+	// The pindexes that were answered while staler than the query's
+	// QueryCtl.MaxStalenessSeqs, per the "flag" staleness policy.
+	Stale []string `json:"stale,omitempty"`
+}
+
+// QueryPIndexes concurrently runs the same query against several
+// local pindexes of an index, such as for a batched remote request
+// of a scatter-gather.  The query results of the pindexes must be
+// JSON, and merging them is left to the caller.  The query's "ctl"
+// consistency requirements and staleness bound, if any, are checked
+// before the pindexes are queried; see Manager.CheckStaleness().
+func (mgr *Manager) QueryPIndexes(ctx context.Context, indexName string,
+	pindexNames []string, req []byte) (rv *QueryPIndexesResults, err error) {
+	ctx, span := mgr.StartTraceSpan(ctx, "cbgt.queryPIndexes")
+	span.SetTag("indexName", indexName)
+	span.SetTag("numPIndexes", len(pindexNames))
+	defer func() { span.Finish(err) }()
+
+	_, pindexes := mgr.CurrentMaps()
+
+	for _, pindexName := range pindexNames {
+		pindex := pindexes[pindexName]
+		if pindex == nil || pindex.IndexName != indexName ||
+			pindex.Dest == nil {
+			return nil, fmt.Errorf("pindex_remote: no pindex,"+
+				" indexName: %s, pindexName: %s", indexName, pindexName)
+		}
+	}
+
+	var stale []string
+
+	var queryCtlParams QueryCtlParams
+	if json.Unmarshal(req, &queryCtlParams) == nil &&
+		(queryCtlParams.Ctl.Consistency != nil ||
+			queryCtlParams.Ctl.MaxStalenessSeqs > 0) {
+		localPIndexes := make([]*PIndex, 0, len(pindexNames))
+		for _, pindexName := range pindexNames {
+			localPIndexes = append(localPIndexes, pindexes[pindexName])
+		}
+
+		consistencyParams, err := mgr.ResolveConsistencyParams(indexName,
+			queryCtlParams.Ctl.Consistency)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ConsistencyWaitGroupCtx(ctx, indexName, consistencyParams,
+			localPIndexes, func(*PIndex) error { return nil })
+		if err != nil {
+			return nil, err
+		}
+
+		stale, err = mgr.CheckStaleness(&queryCtlParams.Ctl, localPIndexes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rv = &QueryPIndexesResults{
+		Results: map[string]json.RawMessage{},
+		Stale:   stale,
+	}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, pindexName := range pindexNames {
+		wg.Add(1)
+		go func(pindex *PIndex) {
+			defer wg.Done()
+
+			ctx, span := mgr.StartTraceSpan(ctx, "cbgt.queryPIndex")
+			span.SetTag("pindexName", pindex.Name)
+
+			// The result is unmarshaled into a copy, so the buffer
+			// can be reused.
+			buf := GetBuffer()
+			var result json.RawMessage
+
+			err := DestQueryContext(ctx, pindex.Dest, pindex, req, buf)
+			if err == nil {
+				err = json.Unmarshal(buf.Bytes(), &result)
+				if err != nil {
+					err = fmt.Errorf("pindex_remote: query result"+
+						" is not JSON, pindexName: %s, err: %v",
+						pindex.Name, err)
+				}
+			}
+
+			PutBuffer(buf)
+
+			span.Finish(err)
+
+			m.Lock()
+			if err != nil {
+				if rv.Errors == nil {
+					rv.Errors = map[string]string{}
+				}
+				rv.Errors[pindex.Name] = err.Error()
+			} else {
+				rv.Results[pindex.Name] = result
+			}
+			m.Unlock()
+		}(pindexes[pindexName])
+	}
+
+	wg.Wait()
+
+	return rv, nil
+}
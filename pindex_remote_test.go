@@ -0,0 +1,55 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGroupRemotePlanPIndexes(t *testing.T) {
+	a := &NodeDef{UUID: "a"}
+	b := &NodeDef{UUID: "b"}
+
+	groups := GroupRemotePlanPIndexes([]*RemotePlanPIndex{
+		{PlanPIndex: &PlanPIndex{Name: "p0"}, NodeDef: b},
+		{PlanPIndex: &PlanPIndex{Name: "p1"}, NodeDef: a},
+		{PlanPIndex: &PlanPIndex{Name: "p2"}, NodeDef: b},
+	})
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got: %d", len(groups))
+	}
+	if groups[0].NodeDef != a || len(groups[0].PlanPIndexes) != 1 ||
+		groups[0].PlanPIndexes[0].Name != "p1" {
+		t.Errorf("unexpected group[0]: %#v", groups[0])
+	}
+	if groups[1].NodeDef != b || len(groups[1].PlanPIndexes) != 2 ||
+		groups[1].PlanPIndexes[0].Name != "p0" ||
+		groups[1].PlanPIndexes[1].Name != "p2" {
+		t.Errorf("unexpected group[1]: %#v", groups[1])
+	}
+
+	if len(GroupRemotePlanPIndexes(nil)) != 0 {
+		t.Errorf("expected no groups")
+	}
+}
+
+func TestQueryPIndexesNoPIndex(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	_, err := m.QueryPIndexes(context.Background(), "foo",
+		[]string{"not-a-pindex"}, []byte("{}"))
+	if err == nil {
+		t.Errorf("expected err on unknown pindex")
+	}
+}
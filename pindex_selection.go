@@ -0,0 +1,115 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PARTITION_SELECTION_BALANCED spreads the queries of a pindex
+// round-robin across its usable nodes.
+const PARTITION_SELECTION_BALANCED = "balanced"
+
+// PARTITION_SELECTION_ADVANCED_BALANCED spreads the queries of a
+// pindex across its usable nodes, favoring the nodes with lower
+// observed query latencies (see NodeQueryLatencyUpdate()).
+const PARTITION_SELECTION_ADVANCED_BALANCED = "advanced-balanced"
+
+// NODE_QUERY_LATENCY_ALPHA is the weight of a new sample in the
+// exponentially weighted moving average of a node's query latency.
+var NODE_QUERY_LATENCY_ALPHA = 0.2
+
+// ValidPartitionSelection returns true for a known partition
+// selection, or for "", which prefers the lowest priority node.
+func ValidPartitionSelection(partitionSelection string) bool {
+	return partitionSelection == "" ||
+		partitionSelection == PARTITION_SELECTION_BALANCED ||
+		partitionSelection == PARTITION_SELECTION_ADVANCED_BALANCED
+}
+
+// NodeQueryLatencyUpdate records the latency of a query request to a
+// node, such as a scatter-gather request to a remote pindex, which
+// is used by the advanced-balanced partition selection.
+func (mgr *Manager) NodeQueryLatencyUpdate(nodeUUID string,
+	latency time.Duration) {
+	mgr.m.Lock()
+	if mgr.nodeQueryLatencies == nil {
+		mgr.nodeQueryLatencies = map[string]float64{}
+	}
+	prev, exists := mgr.nodeQueryLatencies[nodeUUID]
+	if exists {
+		mgr.nodeQueryLatencies[nodeUUID] = prev +
+			NODE_QUERY_LATENCY_ALPHA*(float64(latency)-prev)
+	} else {
+		mgr.nodeQueryLatencies[nodeUUID] = float64(latency)
+	}
+	mgr.m.Unlock()
+}
+
+// NodeQueryLatencies returns a copy of the moving averages of the
+// query latencies of the nodes, keyed by node UUID.
+func (mgr *Manager) NodeQueryLatencies() map[string]time.Duration {
+	mgr.m.Lock()
+	rv := make(map[string]time.Duration, len(mgr.nodeQueryLatencies))
+	for nodeUUID, latency := range mgr.nodeQueryLatencies {
+		rv[nodeUUID] = time.Duration(latency)
+	}
+	mgr.m.Unlock()
+	return rv
+}
+
+// selectBalancedNode chooses one of the candidate nodes of a pindex
+// for a partition selection.
+func (mgr *Manager) selectBalancedNode(partitionSelection string,
+	candidates []*NodeDef) *NodeDef {
+	sort.Sort(nodeDefsByUUID(candidates))
+
+	if partitionSelection == PARTITION_SELECTION_ADVANCED_BALANCED {
+		// Of two random candidates, choose the one with the lower
+		// latency, which favors faster nodes without herding all
+		// queries onto the fastest node.  Nodes without latency
+		// samples yet are favored, so that they get sampled.
+		a := candidates[rand.Intn(len(candidates))]
+		b := candidates[rand.Intn(len(candidates))]
+
+		mgr.m.Lock()
+		latencyA, existsA := mgr.nodeQueryLatencies[a.UUID]
+		latencyB, existsB := mgr.nodeQueryLatencies[b.UUID]
+		mgr.m.Unlock()
+
+		if !existsA || (existsB && latencyA <= latencyB) {
+			return a
+		}
+		return b
+	}
+
+	i := atomic.AddUint64(&mgr.balancedSeq, 1)
+
+	return candidates[i%uint64(len(candidates))]
+}
+
+type nodeDefsByUUID []*NodeDef
+
+func (a nodeDefsByUUID) Len() int {
+	return len(a)
+}
+
+func (a nodeDefsByUUID) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a nodeDefsByUUID) Less(i, j int) bool {
+	return a[i].UUID < a[j].UUID
+}
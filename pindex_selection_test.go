@@ -0,0 +1,87 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidPartitionSelection(t *testing.T) {
+	for _, s := range []string{"", "balanced", "advanced-balanced"} {
+		if !ValidPartitionSelection(s) {
+			t.Errorf("expected valid: %s", s)
+		}
+	}
+	if ValidPartitionSelection("random") {
+		t.Errorf("expected invalid")
+	}
+}
+
+func TestNodeQueryLatencyUpdate(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	m.NodeQueryLatencyUpdate("a", 100*time.Millisecond)
+	m.NodeQueryLatencyUpdate("a", 200*time.Millisecond)
+
+	latencies := m.NodeQueryLatencies()
+	if len(latencies) != 1 ||
+		latencies["a"] < 119*time.Millisecond ||
+		latencies["a"] > 121*time.Millisecond {
+		t.Errorf("expected moving average latency, got: %v", latencies)
+	}
+}
+
+func TestSelectBalancedNode(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	candidates := func() []*NodeDef {
+		return []*NodeDef{{UUID: "c"}, {UUID: "a"}, {UUID: "b"}}
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		counts[m.selectBalancedNode(PARTITION_SELECTION_BALANCED,
+			candidates()).UUID]++
+	}
+	if counts["a"] != 10 || counts["b"] != 10 || counts["c"] != 10 {
+		t.Errorf("expected round-robin, got: %v", counts)
+	}
+
+	m.NodeQueryLatencyUpdate("a", time.Millisecond)
+	m.NodeQueryLatencyUpdate("b", time.Second)
+	m.NodeQueryLatencyUpdate("c", time.Second)
+
+	counts = map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[m.selectBalancedNode(PARTITION_SELECTION_ADVANCED_BALANCED,
+			candidates()).UUID]++
+	}
+	if counts["a"] <= counts["b"] || counts["a"] <= counts["c"] {
+		t.Errorf("expected the faster node to be favored, got: %v", counts)
+	}
+}
+
+func TestCoveringPIndexesBadPartitionSelection(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	_, _, _, err := m.CoveringPIndexesEx(CoveringPIndexesSpec{
+		IndexName:          "foo",
+		PartitionSelection: "not-a-selection",
+	}, PlanPIndexNodeOk, false)
+	if err == nil {
+		t.Errorf("expected err on unknown partition selection")
+	}
+}
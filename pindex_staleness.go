@@ -0,0 +1,202 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A query with a QueryCtl.MaxStalenessSeqs gets bounded staleness,
+// short of an at_plus consistency wait: before answering, the seqs of
+// its local pindexes are compared against the high seqs of their
+// source partitions, and a pindex that's too far behind rejects the
+// query, or flags it, per the QueryCtl.StalenessPolicy.
+//
+// The high seqs of a data source are cached, so that queries don't
+// each make a round trip to the data source, controlled by the
+// option:
+//
+// * stalenessSourceSeqsTTL - how long cached source seqs are used,
+//   like "500ms"; defaults to STALENESS_SOURCE_SEQS_TTL.
+
+// The staleness policies of a QueryCtl.
+const STALENESS_POLICY_REJECT = "reject"
+const STALENESS_POLICY_FLAG = "flag"
+
+// STALENESS_SOURCE_SEQS_TTL is the default time that the high seqs
+// of a data source are cached for staleness checks.
+var STALENESS_SOURCE_SEQS_TTL = time.Second
+
+type sourceSeqsEntry struct {
+	seqs    map[string]UUIDSeq
+	expires time.Time
+}
+
+var sourceSeqsCacheM sync.Mutex // Protects the cache.
+var sourceSeqsCache = map[dataSourcePartitionsKey]*sourceSeqsEntry{}
+
+// sourceSeqsCached returns the possibly cached high seqs of the
+// source partitions of a pindex, or nil when its source type doesn't
+// provide partition seqs.
+func (mgr *Manager) sourceSeqsCached(pindex *PIndex) (
+	map[string]UUIDSeq, error) {
+	feedType := FeedTypes[pindex.SourceType]
+	if feedType == nil || feedType.PartitionSeqs == nil {
+		return nil, nil
+	}
+
+	options := mgr.Options()
+
+	k := dataSourcePartitionsKey{
+		sourceType:   pindex.SourceType,
+		sourceName:   pindex.SourceName,
+		sourceUUID:   pindex.SourceUUID,
+		sourceParams: pindex.SourceParams,
+		server:       mgr.server,
+	}
+
+	sourceSeqsCacheM.Lock()
+	e := sourceSeqsCache[k]
+	sourceSeqsCacheM.Unlock()
+
+	if e != nil && e.expires.After(time.Now()) {
+		return e.seqs, nil
+	}
+
+	seqs, err := feedType.PartitionSeqs(pindex.SourceType,
+		pindex.SourceName, pindex.SourceUUID, pindex.SourceParams,
+		mgr.server, options)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := mgr.optionDuration("stalenessSourceSeqsTTL")
+	if ttl <= 0 {
+		ttl = STALENESS_SOURCE_SEQS_TTL
+	}
+
+	sourceSeqsCacheM.Lock()
+	sourceSeqsCache[k] = &sourceSeqsEntry{
+		seqs:    seqs,
+		expires: time.Now().Add(ttl),
+	}
+	sourceSeqsCacheM.Unlock()
+
+	return seqs, nil
+}
+
+// PIndexStaleness returns the source partitions of a local pindex
+// that are more than maxSeqs behind the high seqs of their data
+// source, keyed by partition.  A pindex's seq for a partition is the
+// max seq that's been flushed to storage, when its Dest is a
+// DestUnflushed, or else its last persisted seq per OpaqueGet().
+func (mgr *Manager) PIndexStaleness(pindex *PIndex, maxSeqs uint64) (
+	map[string]*ConsistencyLag, error) {
+	sourceSeqs, err := mgr.sourceSeqsCached(pindex)
+	if err != nil || sourceSeqs == nil || pindex.Dest == nil {
+		return nil, err
+	}
+
+	unflushed, _ := pindex.Dest.(DestUnflushed)
+
+	var rv map[string]*ConsistencyLag
+
+	for partition := range pindex.sourcePartitionsMap {
+		uuidSeq, exists := sourceSeqs[partition]
+		if !exists {
+			continue
+		}
+
+		var seq uint64
+		if unflushed != nil {
+			_, seq = unflushed.PartitionSeqMax(partition)
+		} else {
+			_, seq, err = pindex.Dest.OpaqueGet(partition)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if uuidSeq.Seq > seq && uuidSeq.Seq-seq > maxSeqs {
+			if rv == nil {
+				rv = map[string]*ConsistencyLag{}
+			}
+			rv[partition] = &ConsistencyLag{
+				CurrSeq: seq,
+				WantSeq: uuidSeq.Seq,
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// CheckStaleness checks the local pindexes of a query against the
+// query's QueryCtl.MaxStalenessSeqs, if any, returning the names of
+// the stale pindexes.  With the "reject" policy, stale pindexes also
+// result in an ErrorConsistencyWait whose Status is "stale" and which
+// describes the lagging partitions.
+func (mgr *Manager) CheckStaleness(ctl *QueryCtl,
+	localPIndexes []*PIndex) ([]string, error) {
+	if ctl == nil || ctl.MaxStalenessSeqs <= 0 {
+		return nil, nil
+	}
+
+	policy := ctl.StalenessPolicy
+	if policy == "" {
+		policy = STALENESS_POLICY_REJECT
+	}
+	if policy != STALENESS_POLICY_REJECT && policy != STALENESS_POLICY_FLAG {
+		return nil, fmt.Errorf("pindex_staleness: unknown"+
+			" stalenessPolicy: %s", ctl.StalenessPolicy)
+	}
+
+	var stale []string
+	var lagging map[string]*ConsistencyLag
+
+	for _, pindex := range localPIndexes {
+		lags, err := mgr.PIndexStaleness(pindex, ctl.MaxStalenessSeqs)
+		if err != nil {
+			return nil, fmt.Errorf("pindex_staleness: PIndexStaleness,"+
+				" pindex: %s, err: %v", pindex.Name, err)
+		}
+		if len(lags) <= 0 {
+			continue
+		}
+
+		stale = append(stale, pindex.Name)
+
+		if lagging == nil {
+			lagging = map[string]*ConsistencyLag{}
+		}
+		for partition, lag := range lags {
+			lagging[partition] = lag
+		}
+	}
+
+	sort.Strings(stale)
+
+	if len(stale) > 0 && policy == STALENESS_POLICY_REJECT {
+		return stale, &ErrorConsistencyWait{
+			Err: fmt.Errorf("pindex_staleness: pindexes more than"+
+				" %d seqs behind, pindexes: %v", ctl.MaxStalenessSeqs, stale),
+			Status:       "stale",
+			StartEndSeqs: map[string][]uint64{},
+			Lagging:      lagging,
+		}
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCheckStaleness(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	m.SetOptions(map[string]string{"stalenessSourceSeqsTTL": "1h"})
+
+	numPartitionSeqs := 0
+
+	primary := FeedTypes["primary"]
+	primary.PartitionSeqs = func(sourceType, sourceName, sourceUUID,
+		sourceParams, server string, options map[string]string) (
+		map[string]UUIDSeq, error) {
+		numPartitionSeqs++
+		return map[string]UUIDSeq{
+			"0": UUIDSeq{Seq: 100},
+			"1": UUIDSeq{Seq: 100},
+		}, nil
+	}
+	defer func() { primary.PartitionSeqs = nil }()
+
+	d := &TestDestUnflushed{}
+	d.setSeqs(100, 80)
+
+	pindex := &PIndex{
+		Name:                "p",
+		SourceType:          "primary",
+		SourceName:          "staleness-test",
+		Dest:                d,
+		sourcePartitionsMap: map[string]bool{"0": true},
+	}
+
+	stale, err := m.CheckStaleness(&QueryCtl{}, []*PIndex{pindex})
+	if err != nil || stale != nil || numPartitionSeqs != 0 {
+		t.Errorf("expected no check without maxStalenessSeqs,"+
+			" stale: %v, err: %v", stale, err)
+	}
+
+	stale, err = m.CheckStaleness(&QueryCtl{MaxStalenessSeqs: 20},
+		[]*PIndex{pindex})
+	if err != nil || stale != nil {
+		t.Errorf("expected not stale, stale: %v, err: %v", stale, err)
+	}
+
+	stale, err = m.CheckStaleness(&QueryCtl{MaxStalenessSeqs: 10},
+		[]*PIndex{pindex})
+	ecw, ok := err.(*ErrorConsistencyWait)
+	if !ok || ecw.Status != "stale" ||
+		!reflect.DeepEqual(stale, []string{"p"}) ||
+		!reflect.DeepEqual(ecw.Lagging, map[string]*ConsistencyLag{
+			"0": &ConsistencyLag{CurrSeq: 80, WantSeq: 100},
+		}) {
+		t.Errorf("expected stale rejection, stale: %v, err: %v", stale, err)
+	}
+
+	stale, err = m.CheckStaleness(&QueryCtl{MaxStalenessSeqs: 10,
+		StalenessPolicy: STALENESS_POLICY_FLAG}, []*PIndex{pindex})
+	if err != nil || !reflect.DeepEqual(stale, []string{"p"}) {
+		t.Errorf("expected stale flag, stale: %v, err: %v", stale, err)
+	}
+
+	_, err = m.CheckStaleness(&QueryCtl{MaxStalenessSeqs: 10,
+		StalenessPolicy: "nope"}, []*PIndex{pindex})
+	if err == nil {
+		t.Errorf("expected err for unknown staleness policy")
+	}
+
+	if numPartitionSeqs != 1 {
+		t.Errorf("expected cached source seqs, numPartitionSeqs: %d",
+			numPartitionSeqs)
+	}
+}
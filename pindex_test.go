@@ -14,10 +14,16 @@ package cbgt
 import (
 	"bytes"
 	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rcrowley/go-metrics"
 )
@@ -151,6 +157,103 @@ func TestErrorConsistencyWait(t *testing.T) {
 	}
 }
 
+func TestResolveConsistencyParams(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	RegisterFeedType("testRequestPlus", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			return []string{"0", "1"}, nil
+		},
+		PartitionSeqs: func(sourceType, sourceName, sourceUUID,
+			sourceParams, server string,
+			options map[string]string) (map[string]UUIDSeq, error) {
+			return map[string]UUIDSeq{
+				"0": {UUID: "u0", Seq: 10},
+				"1": {UUID: "u1", Seq: 20},
+			}, nil
+		},
+	})
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil,
+		"", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	err = m.CreateIndex("testRequestPlus", "src", "", "",
+		"blackhole", "idx", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	err = m.CreateIndex("nil", "", "", "",
+		"blackhole", "idxNil", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	atPlus := &ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS}
+	cp, err := m.ResolveConsistencyParams("idx", atPlus)
+	if err != nil || cp != atPlus {
+		t.Errorf("expected at_plus as is, got: %#v, err: %v", cp, err)
+	}
+
+	cp, err = m.ResolveConsistencyParams("idx", &ConsistencyParams{
+		Level: CONSISTENCY_LEVEL_REQUEST_PLUS,
+		Vectors: map[string]ConsistencyVector{
+			"idx":   {"1": 30, "0/u0": 5},
+			"other": {"0": 1},
+		},
+	})
+	if err != nil || cp.Level != CONSISTENCY_LEVEL_AT_PLUS {
+		t.Fatalf("expected request_plus to resolve, got: %#v, err: %v",
+			cp, err)
+	}
+	expected := ConsistencyVector{"0": 10, "1": 30, "0/u0": 5}
+	if !reflect.DeepEqual(cp.Vectors["idx"], expected) ||
+		cp.Vectors["other"]["0"] != 1 {
+		t.Errorf("expected merged vectors, got: %#v", cp.Vectors)
+	}
+
+	_, err = m.ResolveConsistencyParams("idxNil", &ConsistencyParams{
+		Level: CONSISTENCY_LEVEL_REQUEST_PLUS,
+	})
+	if err == nil {
+		t.Errorf("expected request_plus on nil source to fail")
+	}
+
+	err = ConsistencyWaitGroup("idx", &ConsistencyParams{
+		Level: CONSISTENCY_LEVEL_REQUEST_PLUS,
+	}, nil, nil, nil)
+	if err == nil {
+		t.Errorf("expected unresolved request_plus to fail")
+	}
+}
+
+func TestMutationTokensConsistencyParams(t *testing.T) {
+	cp := MutationTokensConsistencyParams([]string{"a", "b"},
+		[]MutationToken{
+			{VBucketId: 1, VBucketUUID: 1234, Seq: 10},
+			{VBucketId: 1, VBucketUUID: 1234, Seq: 5},
+			{VBucketId: 2, Seq: 7},
+		})
+	expected := ConsistencyVector{"1/1234": 10, "2": 7}
+	if cp.Level != CONSISTENCY_LEVEL_AT_PLUS ||
+		!reflect.DeepEqual(cp.Vectors["a"], expected) ||
+		!reflect.DeepEqual(cp.Vectors["b"], expected) {
+		t.Errorf("expected at_plus vectors, got: %#v", cp)
+	}
+}
+
 func TestErrorConsistencyWaitDone(t *testing.T) {
 	currSeqFunc := func() uint64 {
 		return 101
@@ -204,6 +307,337 @@ func TestErrorConsistencyWaitDone(t *testing.T) {
 	}
 }
 
+// A testSeqsWaiter is a ConsistencyWaiter whose partitions are at
+// fixed seqs, and which waits until cancelled for higher seqs, unless
+// the partition has an err.
+type testSeqsWaiter struct {
+	seqs map[string]uint64
+	errs map[string]error
+}
+
+func (w *testSeqsWaiter) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string, consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	if w.errs[partition] != nil {
+		return w.errs[partition]
+	}
+	if w.seqs[partition] >= consistencySeq {
+		return nil
+	}
+	return ConsistencyWaitDone(partition, cancelCh, make(chan error),
+		func() uint64 { return w.seqs[partition] })
+}
+
+func TestConsistencyWaitPartitionsDeadline(t *testing.T) {
+	w := &testSeqsWaiter{seqs: map[string]uint64{"0": 10, "1": 5, "2": 3}}
+
+	partitions := map[string]bool{"0": true, "1": true, "2": true}
+
+	err := ConsistencyWaitPartitionsDeadline(w, partitions,
+		CONSISTENCY_LEVEL_AT_PLUS,
+		map[string]uint64{"0": 10, "1": 5, "3": 100},
+		time.Millisecond, nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	err = ConsistencyWaitPartitionsDeadline(w, partitions,
+		CONSISTENCY_LEVEL_AT_PLUS,
+		map[string]uint64{"0": 10, "1": 20, "2/uuid": 30},
+		time.Millisecond, nil)
+	ecw, ok := err.(*ErrorConsistencyWait)
+	if !ok {
+		t.Fatalf("expected ErrorConsistencyWait, got: %v", err)
+	}
+	if ecw.Status != "timeout" {
+		t.Errorf("expected timeout status, got: %s", ecw.Status)
+	}
+	if len(ecw.Lagging) != 2 {
+		t.Errorf("expected 2 lagging partitions, got: %#v", ecw.Lagging)
+	}
+	if lag := ecw.Lagging["1"]; lag == nil ||
+		lag.CurrSeq != 5 || lag.WantSeq != 20 {
+		t.Errorf("expected lag for partition 1, got: %#v", lag)
+	}
+	if lag := ecw.Lagging["2"]; lag == nil ||
+		lag.CurrSeq != 3 || lag.WantSeq != 30 {
+		t.Errorf("expected lag for partition 2, got: %#v", lag)
+	}
+	if !strings.Contains(ecw.Error(), "1: 5 < 20") {
+		t.Errorf("expected lagging partitions in err msg, got: %v", ecw)
+	}
+
+	cancelCh := make(chan bool)
+	close(cancelCh)
+
+	err = ConsistencyWaitPartitionsDeadline(w, partitions,
+		CONSISTENCY_LEVEL_AT_PLUS,
+		map[string]uint64{"1": 20}, 0, cancelCh)
+	ecw, ok = err.(*ErrorConsistencyWait)
+	if !ok || ecw.Status != "cancelled" || ecw.Lagging["1"] == nil {
+		t.Errorf("expected cancelled ErrorConsistencyWait, got: %v", err)
+	}
+
+	// Without a deadline or cancelCh, an err of a partition must not
+	// wait for a lagging partition.
+	partitionErr := fmt.Errorf("partitionErr")
+	w.errs = map[string]error{"2": partitionErr}
+
+	err = ConsistencyWaitPartitionsDeadline(w, partitions,
+		CONSISTENCY_LEVEL_AT_PLUS,
+		map[string]uint64{"1": 20, "2": 1}, 0, nil)
+	if err != partitionErr {
+		t.Errorf("expected partitionErr, got: %v", err)
+	}
+}
+
+func TestConsistencyWaitStats(t *testing.T) {
+	w := &testSeqsWaiter{seqs: map[string]uint64{"0": 10}}
+
+	pindex := &PIndex{
+		IndexName:           "idx",
+		sourcePartitionsMap: map[string]bool{"0": true},
+	}
+
+	cancelCh := make(chan bool)
+	close(cancelCh)
+
+	tests := []struct {
+		cp  *ConsistencyParams
+		ch  <-chan bool
+		err bool
+	}{
+		{&ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS,
+			Vectors: map[string]ConsistencyVector{
+				"idx": ConsistencyVector{"0": 5}}}, nil, false},
+		{&ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS,
+			Vectors: map[string]ConsistencyVector{
+				"idx": ConsistencyVector{"0": 20}},
+			PartitionTimeoutMS: 1}, nil, true},
+		{&ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS,
+			Vectors: map[string]ConsistencyVector{
+				"idx": ConsistencyVector{"0": 20}}}, cancelCh, true},
+		{&ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS,
+			Vectors: map[string]ConsistencyVector{
+				"not-idx": ConsistencyVector{"0": 20}}}, nil, false},
+	}
+
+	for i, test := range tests {
+		err := ConsistencyWaitPIndex(pindex, w, test.cp, test.ch)
+		if (err != nil) != test.err {
+			t.Errorf("i: %d, expected err: %v, got: %v", i, test.err, err)
+		}
+	}
+
+	s := pindex.ConsistencyWaitStats()
+	if s.TotImmediate+s.TotWaited != 1 ||
+		s.TotTimeout != 1 || s.TotCancelled != 1 || s.TotError != 0 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+	if s.TimerWait.Count() != 3 {
+		t.Errorf("expected 3 timed waits, got: %d", s.TimerWait.Count())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	s.WriteJSON(buf)
+	if !strings.Contains(buf.String(), `"TotTimeout":1`) {
+		t.Errorf("expected TotTimeout in json, got: %s", buf.String())
+	}
+}
+
+func TestConsistencyWaitPIndexCtx(t *testing.T) {
+	w := &testSeqsWaiter{seqs: map[string]uint64{"0": 10}}
+
+	pindex := &PIndex{
+		IndexName:           "idx",
+		sourcePartitionsMap: map[string]bool{"0": true},
+	}
+
+	cp := &ConsistencyParams{Level: CONSISTENCY_LEVEL_AT_PLUS,
+		Vectors: map[string]ConsistencyVector{
+			"idx": ConsistencyVector{"0": 20}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond)
+	defer cancel()
+
+	err := ConsistencyWaitPIndexCtx(ctx, pindex, w, cp)
+	ecw, ok := err.(*ErrorConsistencyWait)
+	if !ok || ecw.Status != "timeout" {
+		t.Errorf("expected timeout ErrorConsistencyWait, got: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	err = ConsistencyWaitCtx(ctx, w, "0", "", CONSISTENCY_LEVEL_AT_PLUS, 20)
+	ecw, ok = err.(*ErrorConsistencyWait)
+	if !ok || ecw.Status != "cancelled" {
+		t.Errorf("expected cancelled ErrorConsistencyWait, got: %v", err)
+	}
+
+	err = ConsistencyWaitCtx(context.Background(), w, "0", "",
+		CONSISTENCY_LEVEL_AT_PLUS, 5)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+}
+
+func TestPIndexImplTypeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	pit := &PIndexImplType{}
+	if pit.CanQuery() || pit.CanCount() {
+		t.Errorf("expected no query or count")
+	}
+	if pit.QueryContext(ctx, nil, "idx", "", nil, nil) == nil {
+		t.Errorf("expected err when query not supported")
+	}
+	if _, err := pit.CountContext(ctx, nil, "idx", ""); err == nil {
+		t.Errorf("expected err when count not supported")
+	}
+
+	pit.QueryEx = func(mgr *Manager, indexName, indexUUID string,
+		req []byte, res io.Writer, cancelCh <-chan bool) error {
+		<-cancelCh
+		return fmt.Errorf("cancelled")
+	}
+	if !pit.CanQuery() ||
+		pit.QueryContext(ctx, nil, "idx", "", nil, nil) == nil {
+		t.Errorf("expected QueryEx to see the cancelled ctx")
+	}
+
+	pit.CountCtx = func(ctx context.Context, mgr *Manager,
+		indexName, indexUUID string) (uint64, error) {
+		return 0, ctx.Err()
+	}
+	if _, err := pit.CountContext(ctx, nil, "idx", ""); err != context.Canceled {
+		t.Errorf("expected CountCtx to see the cancelled ctx, err: %v", err)
+	}
+}
+
+func TestCoveringPIndexesTargeting(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":4}`,
+		"blackhole", "foo", "", PlanParams{MaxPartitionsPerPIndex: 1},
+		""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	ctl := &QueryCtl{SourcePartitions: []string{"2", "1"}}
+	spec := ctl.CoveringPIndexesSpec("foo", "", "ok")
+	if spec.SourcePartitions != "1,2" || spec.PIndexNames != "" {
+		t.Errorf("expected sorted source partitions, got: %#v", spec)
+	}
+
+	localPIndexes, _, _, err := m.CoveringPIndexesEx(spec, nil, false)
+	if err != nil || len(localPIndexes) != 2 {
+		t.Fatalf("expected 2 targeted pindexes, got: %#v, err: %v",
+			localPIndexes, err)
+	}
+	for _, pindex := range localPIndexes {
+		if pindex.SourcePartitions != "1" && pindex.SourcePartitions != "2" {
+			t.Errorf("unexpected pindex: %#v", pindex)
+		}
+	}
+
+	ctl = &QueryCtl{PIndexNames: []string{localPIndexes[0].Name}}
+	targeted, _, _, err := m.CoveringPIndexesEx(
+		ctl.CoveringPIndexesSpec("foo", "", "ok"), nil, false)
+	if err != nil || len(targeted) != 1 ||
+		targeted[0].Name != localPIndexes[0].Name {
+		t.Errorf("expected targeted pindex, got: %#v, err: %v",
+			targeted, err)
+	}
+
+	all, _, _, err := m.CoveringPIndexesEx(
+		(&QueryCtl{}).CoveringPIndexesSpec("foo", "", "ok"), nil, false)
+	if err != nil || len(all) != 4 {
+		t.Errorf("expected all pindexes, got: %#v, err: %v", all, err)
+	}
+
+	ctl = &QueryCtl{SourcePartitions: []string{"not-a-partition"}}
+	_, _, _, err = m.CoveringPIndexesEx(
+		ctl.CoveringPIndexesSpec("foo", "", "ok"), nil, false)
+	if err == nil {
+		t.Errorf("expected err when no pindexes are targeted")
+	}
+}
+
+func TestCoveringPIndexesCache(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	if err := m.CreateIndex("primary", "default", "123", `{"numPartitions":2}`,
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	hitsMisses := func() (uint64, uint64) {
+		var stats ManagerStats
+		m.StatsCopyTo(&stats)
+		return stats.TotCoveringCacheHit, stats.TotCoveringCacheMiss
+	}
+
+	hits0, misses0 := hitsMisses()
+
+	for i := 0; i < 3; i++ {
+		localPIndexes, _, err :=
+			m.CoveringPIndexes("foo", "", PlanPIndexNodeOk, "queries")
+		if err != nil || len(localPIndexes) != 1 {
+			t.Errorf("expected covering pindexes, got: %#v, err: %v",
+				localPIndexes, err)
+		}
+	}
+
+	hits, misses := hitsMisses()
+	if hits-hits0 != 2 || misses-misses0 != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got: %d, %d",
+			hits-hits0, misses-misses0)
+	}
+
+	m.GetPlanPIndexes(true)
+	m.CoveringPIndexes("foo", "", PlanPIndexNodeOk, "queries")
+
+	hits, misses = hitsMisses()
+	if hits-hits0 != 2 || misses-misses0 != 2 {
+		t.Errorf("expected a miss after plan refresh, got: %d, %d",
+			hits-hits0, misses-misses0)
+	}
+
+	closure := func(*PlanPIndexNode) bool { return true }
+	if _, ok := planPIndexFilterName(closure); ok {
+		t.Errorf("expected closures to not be cacheable")
+	}
+	m.CoveringPIndexes("foo", "", closure, "queries")
+
+	hits2, misses2 := hitsMisses()
+	if hits2 != hits || misses2 != misses {
+		t.Errorf("expected closure filters to bypass the cache")
+	}
+}
+
 func TestPIndexStoreStats(t *testing.T) {
 	s := PIndexStoreStats{
 		TimerBatchStore: metrics.NewTimer(),
@@ -224,4 +658,53 @@ func TestPIndexStoreStats(t *testing.T) {
 	if w2.String() == "" {
 		t.Errorf("expected some writes")
 	}
+
+	s.Errors.PushBack(`{"err":"json"}`)
+
+	w3 := bytes.NewBuffer(nil)
+	s.WriteJSON(w3)
+
+	var m struct {
+		Errors []interface{}
+	}
+	err := json.Unmarshal(w3.Bytes(), &m)
+	if err != nil || len(m.Errors) != 3 || m.Errors[0] != "hello" {
+		t.Errorf("expected parseable errors, err: %v, got: %s",
+			err, w3.String())
+	}
+}
+
+func TestPIndexStoreStatsHistograms(t *testing.T) {
+	s := PIndexStoreStats{
+		TimerBatchStore: metrics.NewTimer(),
+	}
+
+	s.RecordValueSize(100) // No-op without histograms.
+	s.RecordBatchSize(10)
+
+	s.HistogramValueSize = NewPIndexStoreSizeHistogram()
+	s.HistogramBatchSize = NewPIndexStoreSizeHistogram()
+
+	for i := 1; i <= 10; i++ {
+		s.RecordValueSize(i * 100)
+	}
+	s.RecordBatchSize(10)
+
+	if s.HistogramValueSize.Count() != 10 ||
+		s.HistogramValueSize.Max() != 1000 ||
+		s.HistogramBatchSize.Count() != 1 {
+		t.Errorf("unexpected histograms")
+	}
+
+	w := bytes.NewBuffer(nil)
+	s.WriteJSON(w)
+
+	var m map[string]interface{}
+	err := json.Unmarshal(w.Bytes(), &m)
+	if err != nil {
+		t.Fatalf("expected JSON, err: %v, got: %s", err, w.String())
+	}
+	if m["HistogramValueSize"] == nil || m["HistogramBatchSize"] == nil {
+		t.Errorf("expected histograms, got: %s", w.String())
+	}
 }
@@ -0,0 +1,558 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// pindexTransferSuffix is the path suffix of the directory that
+// receives a pindex's files during a transfer.  Partially received
+// files are kept there so that a later transfer attempt can resume.
+const pindexTransferSuffix string = ".transfer"
+
+// pindexSnapshotSuffix is the path suffix of the directory that holds
+// the point-in-time copies of a pindex's files that are served to
+// other nodes during transfers.
+const pindexSnapshotSuffix string = ".snapshot"
+
+// PINDEX_SNAPSHOT_TTL is how long a pindex snapshot is kept for
+// transfers, after which it's removed when a later snapshot of the
+// same pindex is taken.
+var PINDEX_SNAPSHOT_TTL = time.Hour
+
+// PIndexTransferHttpDo is used to issue the http requests of pindex
+// file transfers, and may be overridden such as for authentication
+// or for testing.
+var PIndexTransferHttpDo = http.DefaultClient.Do
+
+// A PIndexFile describes a single file of a pindex's directory.
+type PIndexFile struct {
+	Path     string `json:"path"` // Relative to the pindex directory.
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"` // CRC32 (IEEE) of the file.
+}
+
+// PIndexFiles describes the files of a pindex's directory, which
+// are the unit of a pindex transfer between nodes.
+type PIndexFiles struct {
+	PIndexName string       `json:"pindexName"`
+	PIndexUUID string       `json:"pindexUUID"`
+	Snapshot   string       `json:"snapshot,omitempty"`
+	Files      []PIndexFile `json:"files"`
+}
+
+// ListPIndexFiles returns the files of a pindex's directory, sorted
+// by path, along with their sizes and checksums.
+func ListPIndexFiles(pindex *PIndex) (*PIndexFiles, error) {
+	return listPIndexFiles(pindex, pindex.Path)
+}
+
+func listPIndexFiles(pindex *PIndex, dir string) (*PIndexFiles, error) {
+	rv := &PIndexFiles{
+		PIndexName: pindex.Name,
+		PIndexUUID: pindex.UUID,
+		Files:      []PIndexFile{},
+	}
+
+	err := filepath.Walk(dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			checksum, err := checksumFile(path)
+			if err != nil {
+				return err
+			}
+
+			rv.Files = append(rv.Files, PIndexFile{
+				Path:     filepath.ToSlash(relPath),
+				Size:     info.Size(),
+				Checksum: checksum,
+			})
+
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("pindex_transfer: ListPIndexFiles,"+
+			" pindex: %s, err: %v", pindex.Name, err)
+	}
+
+	sort.Sort(pindexFilesByPath(rv.Files))
+
+	return rv, nil
+}
+
+type pindexFilesByPath []PIndexFile
+
+func (a pindexFilesByPath) Len() int           { return len(a) }
+func (a pindexFilesByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a pindexFilesByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+// PIndexFilePath returns the local path of a file of a pindex's
+// directory, given the file's relative path, and rejects relative
+// paths that would escape the pindex's directory.
+func PIndexFilePath(pindex *PIndex, relPath string) (string, error) {
+	return pindexFilePath(pindex.Path, relPath)
+}
+
+// PIndexSnapshotFilePath is like PIndexFilePath(), but for a file of
+// a snapshot of the pindex (see SnapshotPIndexFiles()).
+func PIndexSnapshotFilePath(pindex *PIndex, snapshot, relPath string) (
+	string, error) {
+	if snapshot == "" || filepath.Base(snapshot) != snapshot ||
+		snapshot == "." || snapshot == ".." {
+		return "", fmt.Errorf("pindex_transfer: invalid snapshot: %q",
+			snapshot)
+	}
+	return pindexFilePath(
+		filepath.Join(pindex.Path+pindexSnapshotSuffix, snapshot), relPath)
+}
+
+func pindexFilePath(dir, relPath string) (string, error) {
+	cleanPath := filepath.Clean(filepath.FromSlash(relPath))
+	if relPath == "" || filepath.IsAbs(cleanPath) ||
+		cleanPath == ".." ||
+		strings.HasPrefix(cleanPath, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("pindex_transfer: invalid file path: %q",
+			relPath)
+	}
+	return filepath.Join(dir, cleanPath), nil
+}
+
+func checksumFile(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
+
+// ------------------------------------------------------------------------
+
+// SnapshotPIndexFiles pauses ingest into a local pindex while copying
+// the pindex's files into a new snapshot directory, so that the files
+// served to another node during a transfer are consistent with each
+// other and with the sequence numbers they've persisted, even as
+// ingest resumes.  The returned PIndexFiles describe the snapshot's
+// files, whose paths are resolved by PIndexSnapshotFilePath().
+func (mgr *Manager) SnapshotPIndexFiles(pindex *PIndex) (
+	*PIndexFiles, error) {
+	snapshotsDir := pindex.Path + pindexSnapshotSuffix
+
+	removeStalePIndexSnapshots(snapshotsDir)
+
+	snapshot := NewUUID()
+	dir := filepath.Join(snapshotsDir, snapshot)
+
+	mgr.PausePIndex(pindex.Name)
+	err := copyPIndexFiles(pindex, dir)
+	mgr.ResumePIndex(pindex.Name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("pindex_transfer: SnapshotPIndexFiles,"+
+			" pindex: %s, err: %v", pindex.Name, err)
+	}
+
+	rv, err := listPIndexFiles(pindex, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	rv.Snapshot = snapshot
+
+	return rv, nil
+}
+
+func copyPIndexFiles(pindex *PIndex, dir string) error {
+	return filepath.Walk(pindex.Path,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+
+			relPath, err := filepath.Rel(pindex.Path, path)
+			if err != nil {
+				return err
+			}
+
+			dstPath := filepath.Join(dir, relPath)
+
+			err = os.MkdirAll(filepath.Dir(dstPath), 0700)
+			if err != nil {
+				return err
+			}
+
+			return copyFile(path, dstPath)
+		})
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	errClose := dst.Close()
+	if err != nil {
+		return err
+	}
+
+	return errClose
+}
+
+// removeStalePIndexSnapshots removes the snapshots of a pindex that
+// are older than PINDEX_SNAPSHOT_TTL, and removes the snapshots
+// directory once it's empty.
+func removeStalePIndexSnapshots(snapshotsDir string) {
+	fileInfos, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return
+	}
+
+	for _, fi := range fileInfos {
+		if time.Since(fi.ModTime()) > PINDEX_SNAPSHOT_TTL {
+			os.RemoveAll(filepath.Join(snapshotsDir, fi.Name()))
+		}
+	}
+
+	os.Remove(snapshotsDir) // Only succeeds when empty.
+}
+
+// ------------------------------------------------------------------------
+
+// TransferPIndexFiles copies the files of a pindex from a remote
+// node, whose REST API is at baseURL (ex: "http://host:8095"), into
+// the local pindex path.  Files are streamed over http and verified
+// against their checksums.  The files are first received into a
+// temporary directory, where partially received files are kept on
+// error, so that a retried transfer resumes where it left off.  Once
+// all files are received and verified, the temporary directory is
+// renamed to the pindex path.
+func TransferPIndexFiles(baseURL, pindexName, path string) error {
+	files, err := getPIndexFiles(baseURL, pindexName)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + pindexTransferSuffix
+
+	wanted := map[string]bool{}
+	for _, file := range files.Files {
+		err = transferPIndexFile(baseURL, pindexName, files.Snapshot,
+			tmpPath, file)
+		if err != nil {
+			return err
+		}
+
+		localPath, _ := pindexFilePath(tmpPath, file.Path)
+		wanted[localPath] = true
+	}
+
+	// Remove any leftover files from earlier transfer attempts that
+	// are no longer part of the pindex.
+	err = filepath.Walk(tmpPath,
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !wanted[path] {
+				return os.Remove(path)
+			}
+			return err
+		})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("pindex_transfer: TransferPIndexFiles,"+
+			" cleanup, path: %s, err: %v", path, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("pindex_transfer: TransferPIndexFiles,"+
+			" rename, path: %s, err: %v", path, err)
+	}
+
+	return nil
+}
+
+func getPIndexFiles(baseURL, pindexName string) (*PIndexFiles, error) {
+	req, err := http.NewRequest("GET",
+		baseURL+"/api/pindex/"+url.QueryEscape(pindexName)+"/files", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := PIndexTransferHttpDo(req)
+	if err != nil {
+		return nil, fmt.Errorf("pindex_transfer: getPIndexFiles,"+
+			" pindex: %s, err: %v", pindexName, err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pindex_transfer: getPIndexFiles,"+
+			" pindex: %s, status code: %d, resp: %s",
+			pindexName, resp.StatusCode, buf)
+	}
+
+	rv := struct {
+		Status string       `json:"status"`
+		Files  *PIndexFiles `json:"files"`
+	}{}
+	err = json.Unmarshal(buf, &rv)
+	if err != nil || rv.Files == nil {
+		return nil, fmt.Errorf("pindex_transfer: getPIndexFiles,"+
+			" pindex: %s, could not parse resp: %s, err: %v",
+			pindexName, buf, err)
+	}
+
+	return rv.Files, nil
+}
+
+// transferPIndexFile receives a single file, resuming from the size
+// of any partially received file.  A file that fails its checksum is
+// received again once from the start, as the local partial file might
+// have been stale.
+func transferPIndexFile(baseURL, pindexName, snapshot, dir string,
+	file PIndexFile) error {
+	localPath, err := pindexFilePath(dir, file.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(localPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err = receivePIndexFile(baseURL, pindexName, snapshot,
+			localPath, file)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := checksumFile(localPath)
+		if err != nil {
+			return err
+		}
+		if checksum == file.Checksum {
+			return nil
+		}
+
+		log.Printf("pindex_transfer: checksum mismatch, pindex: %s,"+
+			" file: %s, attempt: %d", pindexName, file.Path, attempt)
+
+		os.Remove(localPath)
+	}
+
+	return fmt.Errorf("pindex_transfer: checksum mismatch, pindex: %s,"+
+		" file: %s", pindexName, file.Path)
+}
+
+func receivePIndexFile(baseURL, pindexName, snapshot, localPath string,
+	file PIndexFile) error {
+	var offset int64
+
+	fi, err := os.Stat(localPath)
+	if err == nil {
+		offset = fi.Size()
+	}
+	if offset > file.Size {
+		os.Remove(localPath)
+		offset = 0
+	}
+	if offset == file.Size {
+		return nil
+	}
+
+	u := baseURL + "/api/pindex/" + url.QueryEscape(pindexName) +
+		"/file?path=" + url.QueryEscape(file.Path)
+	if snapshot != "" {
+		u += "&snapshot=" + url.QueryEscape(snapshot)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := PIndexTransferHttpDo(req)
+	if err != nil {
+		return fmt.Errorf("pindex_transfer: receivePIndexFile,"+
+			" pindex: %s, file: %s, err: %v", pindexName, file.Path, err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK: // The server ignored the range, so start over.
+		flags |= os.O_TRUNC
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("pindex_transfer: receivePIndexFile,"+
+			" pindex: %s, file: %s, status code: %d, resp: %s",
+			pindexName, file.Path, resp.StatusCode, buf)
+	}
+
+	f, err := os.OpenFile(localPath, flags, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	errClose := f.Close()
+	if err != nil {
+		return fmt.Errorf("pindex_transfer: receivePIndexFile,"+
+			" pindex: %s, file: %s, err: %v", pindexName, file.Path, err)
+	}
+
+	return errClose
+}
+
+// ------------------------------------------------------------------------
+
+// transferPIndex attempts to copy a planned pindex's files from
+// another node that's assigned the same pindex, so that the pindex
+// doesn't need to be rebuilt from its data source.  The copied
+// pindex then catches up from its feed, starting from the sequence
+// numbers persisted in the copied files.
+func (mgr *Manager) transferPIndex(planPIndex *PlanPIndex,
+	path string) error {
+	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+	if err != nil {
+		return err
+	}
+	if nodeDefs == nil {
+		return fmt.Errorf("pindex_transfer: no node defs")
+	}
+
+	mgr.m.Lock()
+	planPIndexesPrev := mgr.janitorPlanPIndexesPrev
+	mgr.m.Unlock()
+
+	nodeUUIDs := PIndexTransferSources(mgr.uuid, planPIndex,
+		planPIndexesPrev, nodeDefs)
+
+	var aliveUUIDs []string
+	for _, nodeUUID := range nodeUUIDs {
+		if mgr.IsNodeAlive(nodeUUID) {
+			aliveUUIDs = append(aliveUUIDs, nodeUUID)
+		}
+	}
+	nodeUUIDs = aliveUUIDs
+
+	errs := []string{}
+
+	for _, nodeUUID := range nodeUUIDs {
+		baseURL := "http://" + nodeDefs.NodeDefs[nodeUUID].HostPort
+
+		err = TransferPIndexFiles(baseURL, planPIndex.Name, path)
+		if err == nil {
+			log.Printf("pindex_transfer: transferred pindex: %s,"+
+				" from node: %s", planPIndex.Name, nodeUUID)
+			return nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return fmt.Errorf("pindex_transfer: could not transfer pindex: %s,"+
+		" nodeUUIDs: %v, errs: %v", planPIndex.Name, nodeUUIDs, errs)
+}
+
+// PIndexTransferSources returns the UUIDs of the wanted nodes, other
+// than selfUUID, that might have a copy of a planned pindex's files.
+// The nodes that were assigned the pindex in the previous plan come
+// first, sorted, as they're the ones that have already built the
+// pindex, such as when the pindex is moving off of them.  They're
+// followed by the other nodes of the current plan, sorted.
+func PIndexTransferSources(selfUUID string, planPIndex *PlanPIndex,
+	planPIndexesPrev *PlanPIndexes, nodeDefs *NodeDefs) []string {
+	var prevUUIDs, currUUIDs []string
+
+	seen := map[string]bool{selfUUID: true}
+
+	if planPIndexesPrev != nil {
+		prev := planPIndexesPrev.PlanPIndexes[planPIndex.Name]
+		if prev != nil {
+			for nodeUUID := range prev.Nodes {
+				if !seen[nodeUUID] && nodeDefs.NodeDefs[nodeUUID] != nil {
+					seen[nodeUUID] = true
+					prevUUIDs = append(prevUUIDs, nodeUUID)
+				}
+			}
+		}
+	}
+
+	for nodeUUID := range planPIndex.Nodes {
+		if !seen[nodeUUID] && nodeDefs.NodeDefs[nodeUUID] != nil {
+			seen[nodeUUID] = true
+			currUUIDs = append(currUUIDs, nodeUUID)
+		}
+	}
+
+	sort.Strings(prevUUIDs)
+	sort.Strings(currUUIDs)
+
+	return append(prevUUIDs, currUUIDs...)
+}
+
+// pindexTransferEnabled returns true when the "pindexTransfer"
+// manager option is "true".
+func (mgr *Manager) pindexTransferEnabled() bool {
+	return mgr.Options()["pindexTransfer"] == "true"
+}
@@ -0,0 +1,280 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPIndexFilePath(t *testing.T) {
+	pindex := &PIndex{Path: "/data/p.pindex"}
+
+	for _, relPath := range []string{"", "..", "../x", "a/../../x", "/etc/x"} {
+		_, err := PIndexFilePath(pindex, relPath)
+		if err == nil {
+			t.Errorf("expected err for relPath: %q", relPath)
+		}
+	}
+
+	path, err := PIndexFilePath(pindex, "store/a/../b")
+	if err != nil || path != filepath.Join("/data/p.pindex", "store", "b") {
+		t.Errorf("expected path, got: %s, err: %v", path, err)
+	}
+
+	for _, snapshot := range []string{"", ".", "..", "a/b", "../a"} {
+		_, err = PIndexSnapshotFilePath(pindex, snapshot, "store/b")
+		if err == nil {
+			t.Errorf("expected err for snapshot: %q", snapshot)
+		}
+	}
+
+	path, err = PIndexSnapshotFilePath(pindex, "s0", "store/b")
+	if err != nil || path != filepath.Join("/data/p.pindex.snapshot",
+		"s0", "store", "b") {
+		t.Errorf("expected snapshot path, got: %s, err: %v", path, err)
+	}
+}
+
+func TestTransferPIndexFiles(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	dstDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dstDir)
+
+	srcPath := PIndexPath(srcDir, "p")
+	os.MkdirAll(filepath.Join(srcPath, "store"), 0700)
+	ioutil.WriteFile(filepath.Join(srcPath, PINDEX_META_FILENAME),
+		[]byte(`{"name":"p"}`), 0600)
+	ioutil.WriteFile(filepath.Join(srcPath, "store", "data"),
+		[]byte(strings.Repeat("0123456789", 100)), 0600)
+
+	pindex := &PIndex{Name: "p", UUID: "pu", Path: srcPath}
+
+	var numRangeReqs uint64
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/pindex/p/files":
+				files, err := ListPIndexFiles(pindex)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				json.NewEncoder(w).Encode(struct {
+					Status string       `json:"status"`
+					Files  *PIndexFiles `json:"files"`
+				}{"ok", files})
+			case "/api/pindex/p/file":
+				path, err := PIndexFilePath(pindex, req.FormValue("path"))
+				if err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+				if req.Header.Get("Range") != "" {
+					atomic.AddUint64(&numRangeReqs, 1)
+				}
+				http.ServeFile(w, req, path)
+			default:
+				http.NotFound(w, req)
+			}
+		}))
+	defer server.Close()
+
+	files, err := ListPIndexFiles(pindex)
+	if err != nil || len(files.Files) != 2 ||
+		files.Files[0].Path != PINDEX_META_FILENAME ||
+		files.Files[1].Path != "store/data" ||
+		files.Files[1].Size != 1000 {
+		t.Errorf("expected files, got: %#v, err: %v", files, err)
+	}
+
+	dstPath := PIndexPath(dstDir, "p")
+
+	err = TransferPIndexFiles(server.URL, "not-a-pindex", dstPath)
+	if err == nil {
+		t.Errorf("expected err on unknown pindex")
+	}
+
+	// Simulate an earlier, interrupted transfer, with a partially
+	// received file and a leftover file.
+	tmpPath := dstPath + pindexTransferSuffix
+	os.MkdirAll(filepath.Join(tmpPath, "store"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpPath, "store", "data"),
+		[]byte(strings.Repeat("0123456789", 40)), 0600)
+	ioutil.WriteFile(filepath.Join(tmpPath, "store", "stale"),
+		[]byte("stale"), 0600)
+
+	err = TransferPIndexFiles(server.URL, "p", dstPath)
+	if err != nil {
+		t.Errorf("expected transfer to work, err: %v", err)
+	}
+	if atomic.LoadUint64(&numRangeReqs) != 1 {
+		t.Errorf("expected a resumed transfer, numRangeReqs: %d",
+			numRangeReqs)
+	}
+
+	dstFiles, err := ListPIndexFiles(&PIndex{Name: "p", Path: dstPath})
+	if err != nil || !reflect.DeepEqual(dstFiles.Files, files.Files) {
+		t.Errorf("expected same files, got: %#v, err: %v", dstFiles, err)
+	}
+	if _, err = os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("expected transfer dir to be gone, err: %v", err)
+	}
+
+	// A stale partial file that fails its checksum is received again.
+	os.RemoveAll(dstPath)
+	os.MkdirAll(filepath.Join(tmpPath, "store"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpPath, "store", "data"),
+		[]byte(strings.Repeat("x", 400)), 0600)
+
+	err = TransferPIndexFiles(server.URL, "p", dstPath)
+	if err != nil {
+		t.Errorf("expected transfer to work, err: %v", err)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(dstPath, "store", "data"))
+	if string(buf) != strings.Repeat("0123456789", 100) {
+		t.Errorf("expected stale partial file to be replaced")
+	}
+}
+
+func TestSnapshotPIndexFiles(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+	dstDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dstDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	srcPath := PIndexPath(emptyDir, "p")
+	os.MkdirAll(filepath.Join(srcPath, "store"), 0700)
+	ioutil.WriteFile(filepath.Join(srcPath, "store", "data"),
+		[]byte("before"), 0600)
+
+	pindex := &PIndex{Name: "p", UUID: "pu", Path: srcPath}
+
+	// A stale snapshot is removed by the next snapshot.
+	staleDir := filepath.Join(srcPath+pindexSnapshotSuffix, "stale")
+	os.MkdirAll(staleDir, 0700)
+	prevTTL := PINDEX_SNAPSHOT_TTL
+	defer func() { PINDEX_SNAPSHOT_TTL = prevTTL }()
+	PINDEX_SNAPSHOT_TTL = 0
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/pindex/p/files":
+				files, err := m.SnapshotPIndexFiles(pindex)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+
+				// Ingest that continues after the snapshot does not
+				// affect the transferred files.
+				ioutil.WriteFile(filepath.Join(srcPath, "store", "data"),
+					[]byte("after"), 0600)
+
+				json.NewEncoder(w).Encode(struct {
+					Status string       `json:"status"`
+					Files  *PIndexFiles `json:"files"`
+				}{"ok", files})
+			case "/api/pindex/p/file":
+				path, err := PIndexSnapshotFilePath(pindex,
+					req.FormValue("snapshot"), req.FormValue("path"))
+				if err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+				http.ServeFile(w, req, path)
+			default:
+				http.NotFound(w, req)
+			}
+		}))
+	defer server.Close()
+
+	dstPath := PIndexPath(dstDir, "p")
+
+	err = TransferPIndexFiles(server.URL, "p", dstPath)
+	if err != nil {
+		t.Errorf("expected transfer to work, err: %v", err)
+	}
+
+	buf, _ := ioutil.ReadFile(filepath.Join(dstPath, "store", "data"))
+	if string(buf) != "before" {
+		t.Errorf("expected the snapshotted file, got: %s", buf)
+	}
+	if m.IsPIndexPaused("p") {
+		t.Errorf("expected ingest to be resumed after the snapshot")
+	}
+	if _, err = os.Stat(staleDir); !os.IsNotExist(err) {
+		t.Errorf("expected stale snapshot to be removed, err: %v", err)
+	}
+
+	pindex.Close(true)
+	if _, err = os.Stat(srcPath + pindexSnapshotSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected snapshots removed with the pindex, err: %v", err)
+	}
+}
+
+func TestPIndexTransferSources(t *testing.T) {
+	nodeDefs := &NodeDefs{NodeDefs: map[string]*NodeDef{
+		"a": {UUID: "a"},
+		"b": {UUID: "b"},
+		"c": {UUID: "c"},
+		"d": {UUID: "d"},
+	}}
+
+	planPIndex := &PlanPIndex{
+		Name: "p",
+		Nodes: map[string]*PlanPIndexNode{
+			"self": {}, "a": {}, "d": {}, "gone": {},
+		},
+	}
+
+	prev := NewPlanPIndexes(VERSION)
+	prev.PlanPIndexes["p"] = &PlanPIndex{
+		Name: "p",
+		Nodes: map[string]*PlanPIndexNode{
+			"c": {}, "d": {}, "removed": {},
+		},
+	}
+
+	for i, test := range []struct {
+		prev *PlanPIndexes
+		exp  []string
+	}{
+		{nil, []string{"a", "d"}},
+		{NewPlanPIndexes(VERSION), []string{"a", "d"}},
+		{prev, []string{"c", "d", "a"}},
+	} {
+		got := PIndexTransferSources("self", planPIndex, test.prev, nodeDefs)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%d: expected: %v, got: %v", i, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// A PIndexVerifyResult holds the outcome of a pindex integrity
+// verification.
+type PIndexVerifyResult struct {
+	Time     time.Time `json:"time"`
+	OK       bool      `json:"ok"`
+	Errors   []string  `json:"errors,omitempty"`
+	Repaired bool      `json:"repaired,omitempty"`
+}
+
+// VerifyPIndex checks the integrity of a pindex's storage, returning
+// the integrity problems that were found.  The generic checks are
+// that the pindex's PINDEX_META file matches the pindex and that the
+// pindex's Dest can provide the persisted seq/opaque state of every
+// source partition.  The pindex implementation type's optional
+// Verify() hook is then invoked for implementation specific checks.
+func VerifyPIndex(pindex *PIndex) []string {
+	var errs []string
+
+	buf, err := ReadPIndexMeta(pindex.Path)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("could not load"+
+			" PINDEX_META_FILENAME, err: %v", err))
+	} else {
+		meta := &PIndex{}
+		err = json.Unmarshal(buf, meta)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not parse"+
+				" PINDEX_META_FILENAME, err: %v", err))
+		} else if meta.Name != pindex.Name || meta.UUID != pindex.UUID ||
+			meta.IndexType != pindex.IndexType ||
+			meta.IndexName != pindex.IndexName ||
+			meta.IndexUUID != pindex.IndexUUID ||
+			meta.SourcePartitions != pindex.SourcePartitions {
+			errs = append(errs, "PINDEX_META_FILENAME does not match pindex")
+		}
+	}
+
+	if pindex.Dest == nil {
+		errs = append(errs, "no pindex.Dest")
+	} else {
+		partitions := make([]string, 0, len(pindex.sourcePartitionsMap))
+		for partition := range pindex.sourcePartitionsMap {
+			partitions = append(partitions, partition)
+		}
+		sort.Strings(partitions)
+
+		for _, partition := range partitions {
+			_, _, err = pindex.Dest.OpaqueGet(partition)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("OpaqueGet,"+
+					" partition: %s, err: %v", partition, err))
+			}
+		}
+	}
+
+	pindexImplType := PIndexImplTypes[pindex.IndexType]
+	if pindexImplType != nil && pindexImplType.Verify != nil {
+		err = pindexImplType.Verify(pindex)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Verify, err: %v", err))
+		}
+	}
+
+	return errs
+}
+
+// VerifyPIndex checks the integrity of a local pindex.  When repair
+// is true, a pindex that fails verification is removed, including
+// its files, and the janitor then rebuilds the pindex from its data
+// source.  The result is also remembered for PIndexVerifyResults().
+func (mgr *Manager) VerifyPIndex(pindexName string, repair bool) (
+	*PIndexVerifyResult, error) {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return nil, fmt.Errorf("pindex_verify: no pindex, pindexName: %s",
+			pindexName)
+	}
+
+	atomic.AddUint64(&mgr.stats.TotVerifyPIndex, 1)
+
+	errs := VerifyPIndex(pindex)
+
+	rv := &PIndexVerifyResult{
+		Time:   time.Now(),
+		OK:     len(errs) == 0,
+		Errors: errs,
+	}
+
+	if !rv.OK {
+		atomic.AddUint64(&mgr.stats.TotVerifyPIndexErr, 1)
+
+		log.Printf("pindex_verify: pindex: %s, errs: %v", pindexName, errs)
+
+		if repair {
+			err := mgr.RepairPIndex(pindex)
+			if err != nil {
+				return nil, err
+			}
+			rv.Repaired = true
+		}
+	}
+
+	mgr.m.Lock()
+	if mgr.pindexVerifyResults == nil {
+		mgr.pindexVerifyResults = map[string]*PIndexVerifyResult{}
+	}
+	mgr.pindexVerifyResults[pindexName] = rv
+	mgr.m.Unlock()
+
+	return rv, nil
+}
+
+// VerifyPIndexes checks the integrity of all the local pindexes,
+// returning the results keyed by pindex name.  See VerifyPIndex().
+func (mgr *Manager) VerifyPIndexes(repair bool) (
+	map[string]*PIndexVerifyResult, error) {
+	rv := map[string]*PIndexVerifyResult{}
+
+	_, pindexes := mgr.CurrentMaps()
+	for pindexName := range pindexes {
+		result, err := mgr.VerifyPIndex(pindexName, repair)
+		if err != nil {
+			return nil, err
+		}
+		rv[pindexName] = result
+	}
+
+	return rv, nil
+}
+
+// RepairPIndex removes a local pindex, including its files, and then
+// has the janitor rebuild the pindex from its data source.
+func (mgr *Manager) RepairPIndex(pindex *PIndex) error {
+	atomic.AddUint64(&mgr.stats.TotRepairPIndex, 1)
+
+	err := mgr.RemovePIndex(pindex)
+	if err != nil {
+		return fmt.Errorf("pindex_verify: RepairPIndex, pindex: %s,"+
+			" err: %v", pindex.Name, err)
+	}
+
+	log.Printf("pindex_verify: repairing pindex: %s", pindex.Name)
+
+	mgr.JanitorKick("api/RepairPIndex, pindex: " + pindex.Name)
+
+	return nil
+}
+
+// PIndexVerifyResults returns a copy of the latest verification
+// results of the current local pindexes, keyed by pindex name.
+func (mgr *Manager) PIndexVerifyResults() map[string]*PIndexVerifyResult {
+	_, pindexes := mgr.CurrentMaps()
+
+	rv := map[string]*PIndexVerifyResult{}
+
+	mgr.m.Lock()
+	for pindexName, result := range mgr.pindexVerifyResults {
+		if pindexes[pindexName] != nil {
+			rv[pindexName] = result
+		}
+	}
+	mgr.m.Unlock()
+
+	return rv
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManagerVerifyPIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, ""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	m.PlannerNOOP("test")
+	m.JanitorNOOP("test")
+
+	if _, err := m.VerifyPIndex("not-a-pindex", false); err == nil {
+		t.Errorf("expected err on unknown pindex")
+	}
+
+	results, err := m.VerifyPIndexes(false)
+	if err != nil || len(results) != 1 {
+		t.Errorf("expected 1 result, got: %v, err: %v", results, err)
+	}
+	pindexName := m.LocalPIndexNamesForIndex("foo")[0]
+	if !results[pindexName].OK {
+		t.Errorf("expected pindex to verify ok, got: %#v", results[pindexName])
+	}
+
+	// The pindex implementation's Verify hook is used.
+	blackhole := PIndexImplTypes["blackhole"]
+	blackhole.Verify = func(pindex *PIndex) error {
+		return fmt.Errorf("corrupt")
+	}
+	result, err := m.VerifyPIndex(pindexName, false)
+	blackhole.Verify = nil
+	if err != nil || result.OK || len(result.Errors) != 1 || result.Repaired {
+		t.Errorf("expected hook verify failure, got: %#v, err: %v",
+			result, err)
+	}
+
+	pindexBefore := m.GetPIndex(pindexName)
+
+	err = ioutil.WriteFile(pindexBefore.Path+string(os.PathSeparator)+
+		PINDEX_META_FILENAME, []byte("not json"), 0600)
+	if err != nil {
+		t.Errorf("expected write to work, err: %v", err)
+	}
+
+	result, err = m.VerifyPIndex(pindexName, false)
+	if err != nil || result.OK || result.Repaired {
+		t.Errorf("expected verify failure, got: %#v, err: %v", result, err)
+	}
+	if m.PIndexVerifyResults()[pindexName] != result {
+		t.Errorf("expected verify result to be remembered")
+	}
+
+	result, err = m.VerifyPIndex(pindexName, true)
+	if err != nil || result.OK || !result.Repaired {
+		t.Errorf("expected repair, got: %#v, err: %v", result, err)
+	}
+
+	pindexAfter := m.GetPIndex(pindexName)
+	if pindexAfter == nil || pindexAfter.UUID == pindexBefore.UUID {
+		t.Errorf("expected pindex to be rebuilt, after: %#v", pindexAfter)
+	}
+	if len(VerifyPIndex(pindexAfter)) != 0 {
+		t.Errorf("expected rebuilt pindex to verify ok")
+	}
+}
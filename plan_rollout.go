@@ -0,0 +1,415 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// A staged plan rollout applies a new plan to the nodes in waves, so
+// that a bad index definition change only affects some of the nodes
+// until an operator notices.  When the planner saves a changed plan,
+// it also saves a PlanRollout to the Cfg that assigns the nodes of the
+// new plan whose pindexes changed to waves.  The janitors of nodes in
+// later waves keep their previously applied plan, or their current
+// pindexes after a restart, until their wave is allowed, and each
+// janitor records in the PlanRollout when it has applied the plan.
+// The next wave is allowed once all the nodes of the earlier waves
+// have applied the plan without errors and are alive (see
+// Manager.IsNodeAlive()).  Staged rollouts are controlled by these
+// manager options:
+//
+// * planRolloutWavePercent - the percentage of nodes in each wave,
+//   like "25"; staged rollouts are disabled when empty.
+// * planRolloutWaveWait - the minimum time between waves, like "5m",
+//   which is parsed by time.ParseDuration(); defaults to 0.
+// * planRolloutCheckInterval - how often nodes with the planner tag
+//   check whether the next wave can be allowed; defaults to "5s".
+//
+// Failovers are not staged.
+
+// PLAN_ROLLOUT_KEY is the key used for Cfg access of the PlanRollout.
+const PLAN_ROLLOUT_KEY = "planRollout"
+
+// PLAN_ROLLOUT_CHECK_INTERVAL is the default for the
+// planRolloutCheckInterval manager option.
+var PLAN_ROLLOUT_CHECK_INTERVAL = 5 * time.Second
+
+// A PlanRollout represents the staged rollout of a plan.
+type PlanRollout struct {
+	UUID        string     `json:"uuid"`
+	PlanUUID    string     `json:"planUUID"` // The PlanPIndexes.UUID.
+	Waves       [][]string `json:"waves"`    // Node UUIDs per wave.
+	Wave        int        `json:"wave"`     // The latest allowed wave.
+	WaveStarted time.Time  `json:"waveStarted"`
+	ImplVersion string     `json:"implVersion"`
+
+	// Nodes that have applied the plan, keyed by node UUID.
+	Applied map[string]bool `json:"applied"`
+
+	// Janitor errors while applying the plan, keyed by node UUID,
+	// which halt the rollout until resolved or forced.
+	Errs map[string]string `json:"errs,omitempty"`
+}
+
+// NewPlanRollout returns a PlanRollout for a plan, assigning the
+// nodes of the plan whose pindex assignments differ from the previous
+// plan to waves of the given percentage of nodes.  Nodes whose
+// assignments are unchanged aren't part of the rollout, nor are nodes
+// that are only in the previous plan, like removed nodes, which
+// can't be relied on to ever apply the plan.
+func NewPlanRollout(planPIndexes, planPIndexesPrev *PlanPIndexes,
+	wavePercent int, version string) *PlanRollout {
+	// Nodes are compared by their pindex definitions and assignments,
+	// ignoring the generated PlanPIndex.UUID's.
+	type nodePIndex struct {
+		planPIndex     PlanPIndex
+		planPIndexNode PlanPIndexNode
+	}
+
+	nodePIndexes := func(p *PlanPIndexes) map[string]map[string]nodePIndex {
+		rv := map[string]map[string]nodePIndex{}
+		if p == nil {
+			return rv
+		}
+		for _, planPIndex := range p.PlanPIndexes {
+			v := *planPIndex
+			v.UUID = ""
+			v.Nodes = nil
+			for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+				m := rv[nodeUUID]
+				if m == nil {
+					m = map[string]nodePIndex{}
+					rv[nodeUUID] = m
+				}
+				m[planPIndex.Name] = nodePIndex{v, *planPIndexNode}
+			}
+		}
+		return rv
+	}
+
+	curr := nodePIndexes(planPIndexes)
+	prev := nodePIndexes(planPIndexesPrev)
+
+	nodes := make([]string, 0, len(curr))
+	for nodeUUID := range curr {
+		if !reflect.DeepEqual(curr[nodeUUID], prev[nodeUUID]) {
+			nodes = append(nodes, nodeUUID)
+		}
+	}
+	sort.Strings(nodes)
+
+	waveSize := (len(nodes)*wavePercent + 99) / 100
+	if waveSize < 1 {
+		waveSize = 1
+	}
+
+	var waves [][]string
+	for len(nodes) > 0 {
+		n := waveSize
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		waves = append(waves, nodes[:n])
+		nodes = nodes[n:]
+	}
+
+	return &PlanRollout{
+		UUID:        NewUUID(),
+		PlanUUID:    planPIndexes.UUID,
+		Waves:       waves,
+		WaveStarted: time.Now(),
+		ImplVersion: version,
+		Applied:     map[string]bool{},
+	}
+}
+
+// NodeWave returns the wave of a node, or -1 if the node isn't part
+// of the rollout.
+func (r *PlanRollout) NodeWave(nodeUUID string) int {
+	for i, wave := range r.Waves {
+		for _, n := range wave {
+			if n == nodeUUID {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// NodeAllowed returns true if a node may apply a plan.
+func (r *PlanRollout) NodeAllowed(nodeUUID, planUUID string) bool {
+	if r == nil || r.PlanUUID != planUUID {
+		return true
+	}
+	return r.NodeWave(nodeUUID) <= r.Wave
+}
+
+// Done returns true if all the waves have been allowed.
+func (r *PlanRollout) Done() bool {
+	return r.Wave >= len(r.Waves)-1
+}
+
+// PlanRolloutWavePercent returns the planRolloutWavePercent option,
+// or 0 if staged rollouts are disabled.
+func PlanRolloutWavePercent(options map[string]string) int {
+	v, err := strconv.Atoi(options["planRolloutWavePercent"])
+	if err != nil || v <= 0 || v >= 100 {
+		return 0
+	}
+	return v
+}
+
+// CfgGetPlanRollout retrieves the PlanRollout from a Cfg provider.
+func CfgGetPlanRollout(cfg Cfg) (*PlanRollout, uint64, error) {
+	v, cas, err := cfg.Get(PLAN_ROLLOUT_KEY, 0)
+	if err != nil || v == nil {
+		return nil, cas, err
+	}
+	rv := &PlanRollout{}
+	err = json.Unmarshal(v, rv)
+	if err != nil {
+		return nil, cas, err
+	}
+	return rv, cas, nil
+}
+
+// CfgSetPlanRollout updates the PlanRollout on a Cfg provider.
+func CfgSetPlanRollout(cfg Cfg, r *PlanRollout, cas uint64) (
+	uint64, error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Set(PLAN_ROLLOUT_KEY, buf, cas)
+}
+
+// cfgUpdatePlanRollout performs a read-modify-write of the
+// PlanRollout with CAS retries, where the update callback returns
+// false to leave the PlanRollout unchanged.
+func cfgUpdatePlanRollout(cfg Cfg,
+	update func(r *PlanRollout) (bool, error)) (*PlanRollout, error) {
+	var rv *PlanRollout
+
+	_, err := CfgSetRetry(cfg, PLAN_ROLLOUT_KEY, CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			rv = nil
+			if val == nil {
+				return nil, nil
+			}
+
+			r := &PlanRollout{}
+			err := json.Unmarshal(val, r)
+			if err != nil {
+				return nil, err
+			}
+			rv = r
+
+			changed, err := update(r)
+			if err != nil || !changed {
+				return nil, err
+			}
+
+			return json.Marshal(r)
+		})
+
+	return rv, err
+}
+
+// ------------------------------------------------------------------------
+
+// janitorPlanPIndexes returns the plan that the janitor should apply
+// on this node, which is the previously applied plan when the node
+// must wait for its wave of a staged rollout.  The returned
+// PlanRollout is non-nil when the janitor is applying a plan that's
+// being rolled out, and should record that it applied the plan.
+func (mgr *Manager) janitorPlanPIndexes(planPIndexes *PlanPIndexes) (
+	*PlanPIndexes, *PlanRollout, error) {
+	r, _, err := CfgGetPlanRollout(mgr.cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("janitor: CfgGetPlanRollout, err: %v", err)
+	}
+	if r == nil || r.PlanUUID != planPIndexes.UUID || r.NodeWave(mgr.uuid) < 0 {
+		return planPIndexes, nil, nil
+	}
+
+	if r.NodeAllowed(mgr.uuid, planPIndexes.UUID) {
+		return planPIndexes, r, nil
+	}
+
+	mgr.m.Lock()
+	planPIndexesPrev := mgr.janitorPlanPIndexesPrev
+	mgr.m.Unlock()
+
+	// A node that hasn't applied any plan since it started, like a
+	// newly added or restarted node, waits with its current pindexes,
+	// such as those loaded from its dataDir.
+	if planPIndexesPrev == nil {
+		planPIndexesPrev = mgr.localPIndexesPlan()
+	}
+
+	log.Printf("janitor: waiting for plan rollout wave: %d,"+
+		" keeping previous plan: %s", r.NodeWave(mgr.uuid),
+		planPIndexesPrev.UUID)
+
+	return planPIndexesPrev, nil, nil
+}
+
+// localPIndexesPlan returns a plan of just this node's current
+// pindexes.
+func (mgr *Manager) localPIndexesPlan() *PlanPIndexes {
+	_, pindexes := mgr.CurrentMaps()
+
+	rv := NewPlanPIndexes(mgr.version)
+	for _, pindex := range pindexes {
+		rv.PlanPIndexes[pindex.Name] = &PlanPIndex{
+			Name:             pindex.Name,
+			UUID:             pindex.UUID,
+			IndexType:        pindex.IndexType,
+			IndexName:        pindex.IndexName,
+			IndexUUID:        pindex.IndexUUID,
+			IndexParams:      pindex.IndexParams,
+			SourceType:       pindex.SourceType,
+			SourceName:       pindex.SourceName,
+			SourceUUID:       pindex.SourceUUID,
+			SourceParams:     pindex.SourceParams,
+			SourcePartitions: pindex.SourcePartitions,
+			Nodes: map[string]*PlanPIndexNode{
+				mgr.uuid: {CanRead: true, CanWrite: true},
+			},
+		}
+	}
+	return rv
+}
+
+// ackPlanRollout records in the PlanRollout whether this node's
+// janitor applied the rollout's plan without errors.
+func (mgr *Manager) ackPlanRollout(r *PlanRollout, errs []error) {
+	_, err := cfgUpdatePlanRollout(mgr.cfg, func(r2 *PlanRollout) (bool, error) {
+		if r2.UUID != r.UUID {
+			return false, nil
+		}
+
+		if len(errs) > 0 {
+			if r2.Errs == nil {
+				r2.Errs = map[string]string{}
+			}
+			r2.Errs[mgr.uuid] = fmt.Sprintf("%v", errs)
+			return true, nil
+		}
+
+		if r2.Applied[mgr.uuid] && r2.Errs[mgr.uuid] == "" {
+			return false, nil
+		}
+		if r2.Applied == nil {
+			r2.Applied = map[string]bool{}
+		}
+		r2.Applied[mgr.uuid] = true
+		delete(r2.Errs, mgr.uuid)
+		return true, nil
+	})
+	if err != nil {
+		log.Printf("janitor: ackPlanRollout, err: %v", err)
+	}
+}
+
+// AdvancePlanRollout allows the next wave of the current staged
+// rollout if the earlier waves are healthy, or regardless of health
+// when force is true.  When finish is true, all remaining waves are
+// allowed.  Returns the resulting PlanRollout, or nil if there's no
+// rollout.
+func (mgr *Manager) AdvancePlanRollout(force, finish bool) (
+	*PlanRollout, error) {
+	if mgr.cfg == nil {
+		return nil, fmt.Errorf("plan_rollout: nil cfg")
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	waveWait := mgr.optionDuration("planRolloutWaveWait")
+
+	return cfgUpdatePlanRollout(mgr.cfg, func(r *PlanRollout) (bool, error) {
+		if r.Done() {
+			return false, nil
+		}
+		if planPIndexes == nil || r.PlanUUID != planPIndexes.UUID {
+			return false, nil // The rollout is stale.
+		}
+
+		if finish {
+			r.Wave = len(r.Waves) - 1
+			r.WaveStarted = time.Now()
+			return true, nil
+		}
+
+		if !force {
+			if time.Since(r.WaveStarted) < waveWait {
+				return false, nil
+			}
+			for i := 0; i <= r.Wave; i++ {
+				for _, nodeUUID := range r.Waves[i] {
+					if !r.Applied[nodeUUID] || r.Errs[nodeUUID] != "" ||
+						!mgr.IsNodeAlive(nodeUUID) {
+						return false, nil
+					}
+				}
+			}
+		}
+
+		r.Wave++
+		r.WaveStarted = time.Now()
+
+		log.Printf("plan_rollout: allowing wave: %d of %d, plan: %s",
+			r.Wave, len(r.Waves), r.PlanUUID)
+
+		return true, nil
+	})
+}
+
+// PlanRolloutLoop is the main loop for advancing staged rollouts, and
+// exits when the manager is stopped.
+func (mgr *Manager) PlanRolloutLoop() {
+	if PlanRolloutWavePercent(mgr.Options()) <= 0 || mgr.cfg == nil {
+		return
+	}
+
+	interval := mgr.optionDuration("planRolloutCheckInterval")
+	if interval <= 0 {
+		interval = PLAN_ROLLOUT_CHECK_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := mgr.AdvancePlanRollout(false, false)
+		if err != nil {
+			log.Printf("plan_rollout: AdvancePlanRollout, err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewPlanRollout(t *testing.T) {
+	planPIndexes := &PlanPIndexes{
+		UUID: "plan1",
+		PlanPIndexes: map[string]*PlanPIndex{
+			"p0": {Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {}}},
+			"p1": {Nodes: map[string]*PlanPIndexNode{"c": {}}},
+		},
+	}
+	planPIndexesPrev := &PlanPIndexes{
+		PlanPIndexes: map[string]*PlanPIndex{
+			"p0": {Nodes: map[string]*PlanPIndexNode{"d": {}}},
+		},
+	}
+
+	r := NewPlanRollout(planPIndexes, planPIndexesPrev, 50, VERSION)
+	if r.PlanUUID != "plan1" ||
+		!reflect.DeepEqual(r.Waves, [][]string{{"a", "b"}, {"c"}}) {
+		t.Errorf("expected 2 waves, without removed nodes, got: %#v", r)
+	}
+
+	// 40% of 3 nodes rounds up to waves of 2 nodes.
+	r = NewPlanRollout(planPIndexes, planPIndexesPrev, 40, VERSION)
+	if len(r.Waves) != 2 || len(r.Waves[0]) != 2 {
+		t.Errorf("expected wave sizes to round up, got: %#v", r.Waves)
+	}
+
+	r = NewPlanRollout(planPIndexes, nil, 1, VERSION)
+	if len(r.Waves) != 3 || r.Done() {
+		t.Errorf("expected 3 waves, got: %#v", r.Waves)
+	}
+	if !r.NodeAllowed("a", "plan1") || r.NodeAllowed("b", "plan1") ||
+		!r.NodeAllowed("b", "another-plan") || !r.NodeAllowed("x", "plan1") {
+		t.Errorf("expected only the first wave to be allowed")
+	}
+
+	r = NewPlanRollout(planPIndexes, planPIndexes, 50, VERSION)
+	if len(r.Waves) != 0 || !r.Done() || !r.NodeAllowed("a", "plan1") {
+		t.Errorf("expected unchanged nodes not to be staged, got: %#v", r)
+	}
+
+	var rNil *PlanRollout
+	if !rNil.NodeAllowed("a", "plan1") {
+		t.Errorf("expected nodes to be allowed without a rollout")
+	}
+
+	if PlanRolloutWavePercent(map[string]string{}) != 0 ||
+		PlanRolloutWavePercent(map[string]string{
+			"planRolloutWavePercent": "25",
+		}) != 25 {
+		t.Errorf("expected planRolloutWavePercent parsing")
+	}
+}
+
+func TestManagerPlanRollout(t *testing.T) {
+	cfg := NewCfgMem()
+
+	options := map[string]string{
+		"planRolloutWavePercent": "50",
+		// Advance the rollout explicitly instead of in the background.
+		"planRolloutCheckInterval": "1h",
+	}
+
+	var mgrs []*Manager
+	for _, uuid := range []string{"aaa", "bbb"} {
+		dataDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(dataDir)
+
+		m := NewManagerEx(VERSION, cfg, uuid, nil, "", 1, "",
+			":1000"+uuid, dataDir, "some-datasource", nil, options)
+		if err := m.Start("wanted"); err != nil {
+			t.Errorf("expected Manager.Start() to work, err: %v", err)
+		}
+		mgrs = append(mgrs, m)
+	}
+	m0, m1 := mgrs[0], mgrs[1]
+
+	sync := func() {
+		m0.PlannerNOOP("test")
+		m0.PlannerKick("test")
+		for _, m := range mgrs {
+			m.JanitorKick("test")
+		}
+	}
+
+	numPIndexes := func(m *Manager, indexName string) int {
+		return len(m.LocalPIndexNamesForIndex(indexName))
+	}
+
+	planParams := PlanParams{MaxPartitionsPerPIndex: 1}
+	if err := m0.CreateIndex("primary", "default", "123",
+		`{"numPartitions":4}`, "blackhole", "foo", "{}", planParams,
+		""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	sync()
+
+	// Finish any rollout of plans made while the nodes were starting.
+	if _, err := m0.AdvancePlanRollout(true, true); err != nil {
+		t.Errorf("expected AdvancePlanRollout() to work, err: %v", err)
+	}
+	sync()
+
+	if numPIndexes(m0, "foo") == 0 || numPIndexes(m1, "foo") == 0 {
+		t.Errorf("expected foo pindexes on both nodes")
+	}
+
+	if err := m0.CreateIndex("primary", "default", "123",
+		`{"numPartitions":4}`, "blackhole", "bar", "{}", planParams,
+		""); err != nil {
+		t.Errorf("expected CreateIndex() to work, err: %v", err)
+	}
+	sync()
+
+	r, _, err := CfgGetPlanRollout(cfg)
+	if err != nil || r == nil ||
+		!reflect.DeepEqual(r.Waves, [][]string{{"aaa"}, {"bbb"}}) {
+		t.Fatalf("expected plan rollout, got: %#v, err: %v", r, err)
+	}
+	if numPIndexes(m0, "bar") == 0 || numPIndexes(m1, "bar") != 0 {
+		t.Errorf("expected bar pindexes only on the first wave node")
+	}
+	if !r.Applied["aaa"] || r.Applied["bbb"] {
+		t.Errorf("expected only the first wave to be applied, got: %#v", r)
+	}
+
+	janitorPlan, err := m1.JanitorPlan()
+	if err != nil || len(janitorPlan.AddPIndexes) != 0 {
+		t.Errorf("expected second wave node to wait, got: %#v, err: %v",
+			janitorPlan, err)
+	}
+
+	// A restarted node, which hasn't applied any plan yet, keeps its
+	// current pindexes while it waits.
+	m1.m.Lock()
+	m1.janitorPlanPIndexesPrev = nil
+	m1.m.Unlock()
+
+	janitorPlan, err = m1.JanitorPlan()
+	if err != nil || len(janitorPlan.AddPIndexes) != 0 ||
+		len(janitorPlan.RemovePIndexes) != 0 {
+		t.Errorf("expected restarted node to wait, got: %#v, err: %v",
+			janitorPlan, err)
+	}
+
+	r, err = m0.AdvancePlanRollout(false, false)
+	if err != nil || r.Wave != 1 || !r.Done() {
+		t.Errorf("expected healthy rollout to advance, got: %#v, err: %v",
+			r, err)
+	}
+	m1.JanitorKick("test")
+
+	if numPIndexes(m1, "bar") == 0 {
+		t.Errorf("expected bar pindexes on the second wave node")
+	}
+	r, _, _ = CfgGetPlanRollout(cfg)
+	if !r.Applied["bbb"] {
+		t.Errorf("expected second wave to be applied, got: %#v", r)
+	}
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The HierarchyRules of an index are only a preference to blance, so
+// the copies of a PIndex may still land in the same zone, such as
+// when there are too few zones.  An index can ask the planner to
+// check the zone spread of its PIndexes via PlanParams.ZoneSpread,
+// where the zone of a node is the first level of its container path
+// (like "zone1" for a container of "zone1/rack2").
+
+// ZONE_SPREAD_WARN means a PIndex whose copies aren't in distinct
+// zones is planned anyway, with a ZONE_VIOLATED warning attached to
+// the plan.
+const ZONE_SPREAD_WARN = "warn"
+
+// ZONE_SPREAD_STRICT means a PIndex whose copies aren't in distinct
+// zones fails the plan with a ZoneViolationError.
+const ZONE_SPREAD_STRICT = "strict"
+
+// ZONE_VIOLATED prefixes the plan warnings about zone spread.
+const ZONE_VIOLATED = "zone-violated"
+
+// A ZoneViolationError is returned by the planner when an index with
+// a ZoneSpread of ZONE_SPREAD_STRICT could not have the copies of its
+// PIndexes placed in distinct zones.
+type ZoneViolationError struct {
+	IndexName  string
+	Violations []string
+}
+
+func (e *ZoneViolationError) Error() string {
+	return fmt.Sprintf("planner: zone spread violated, indexName: %s,"+
+		" violations: %v", e.IndexName, e.Violations)
+}
+
+// NodeDefZone returns the zone of a node, which is the first level of
+// its container path, or "" if the node has no container.
+func NodeDefZone(nodeDef *NodeDef) string {
+	if nodeDef == nil {
+		return ""
+	}
+	return strings.Split(nodeDef.Container, "/")[0]
+}
+
+// CheckZoneSpread returns ZONE_VIOLATED warnings for the PIndexes of
+// an index whose NumReplicas+1 copies are not assigned to as many
+// distinct zones.
+func CheckZoneSpread(indexDef *IndexDef,
+	planPIndexesForIndex map[string]*PlanPIndex,
+	nodeDefs *NodeDefs) (rv []string) {
+	numCopies := indexDef.PlanParams.NumReplicas + 1
+
+	var planPIndexNames []string
+	for planPIndexName := range planPIndexesForIndex {
+		planPIndexNames = append(planPIndexNames, planPIndexName)
+	}
+	sort.Strings(planPIndexNames)
+
+	for _, planPIndexName := range planPIndexNames {
+		planPIndex := planPIndexesForIndex[planPIndexName]
+
+		var zones []string
+		for nodeUUID := range planPIndex.Nodes {
+			var nodeDef *NodeDef
+			if nodeDefs != nil {
+				nodeDef = nodeDefs.NodeDefs[nodeUUID]
+			}
+			zones = append(zones, NodeDefZone(nodeDef))
+		}
+		sort.Strings(zones)
+
+		zonesDistinct := StringsIntersectStrings(zones, zones)
+		if len(zonesDistinct) < numCopies {
+			rv = append(rv, fmt.Sprintf("%s: planPIndex: %s,"+
+				" copies: %d, zones: %q", ZONE_VIOLATED,
+				planPIndexName, numCopies, zones))
+		}
+	}
+
+	return rv
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckZoneSpread(t *testing.T) {
+	nodeDefs := &NodeDefs{
+		NodeDefs: map[string]*NodeDef{
+			"a": {UUID: "a", Container: "zone1/rack1"},
+			"b": {UUID: "b", Container: "zone1/rack2"},
+			"c": {UUID: "c", Container: "zone2"},
+		},
+	}
+	indexDef := &IndexDef{
+		Name:       "foo",
+		PlanParams: PlanParams{NumReplicas: 1},
+	}
+	planPIndexesForIndex := map[string]*PlanPIndex{
+		"foo_0": {Nodes: map[string]*PlanPIndexNode{"a": {}, "c": {}}},
+		"foo_1": {Nodes: map[string]*PlanPIndexNode{"a": {}, "b": {}}},
+		"foo_2": {Nodes: map[string]*PlanPIndexNode{"c": {}}},
+	}
+
+	warnings := CheckZoneSpread(indexDef, planPIndexesForIndex, nodeDefs)
+	if len(warnings) != 2 ||
+		!strings.HasPrefix(warnings[0], ZONE_VIOLATED+": planPIndex: foo_1") ||
+		!strings.HasPrefix(warnings[1], ZONE_VIOLATED+": planPIndex: foo_2") {
+		t.Errorf("expected 2 zone violations, got: %v", warnings)
+	}
+}
+
+func TestCalcPlanZoneSpread(t *testing.T) {
+	nodeDefs := &NodeDefs{
+		NodeDefs: map[string]*NodeDef{
+			"a": {UUID: "a", Container: "zone1"},
+			"b": {UUID: "b", Container: "zone1"},
+		},
+	}
+	indexDef := &IndexDef{
+		Type:       "blackhole",
+		Name:       "foo",
+		UUID:       "1",
+		SourceType: "nil",
+		PlanParams: PlanParams{NumReplicas: 1, ZoneSpread: ZONE_SPREAD_WARN},
+	}
+	indexDefs := &IndexDefs{
+		IndexDefs: map[string]*IndexDef{"foo": indexDef},
+	}
+
+	planPIndexes, err := CalcPlan("", indexDefs, nodeDefs, nil,
+		VERSION, "", nil, nil)
+	if err != nil {
+		t.Errorf("expected CalcPlan() to work, err: %v", err)
+	}
+	warnings := planPIndexes.Warnings["foo"]
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], ZONE_VIOLATED) {
+		t.Errorf("expected a zone violated warning, got: %v", warnings)
+	}
+
+	indexDef.PlanParams.ZoneSpread = ZONE_SPREAD_STRICT
+
+	_, err = CalcPlan("", indexDefs, nodeDefs, nil, VERSION, "", nil, nil)
+	if _, ok := err.(*ZoneViolationError); !ok {
+		t.Errorf("expected a ZoneViolationError, got: %v", err)
+	}
+
+	_, err = CalcPlan("failover", indexDefs, nodeDefs, nil,
+		VERSION, "", nil, nil)
+	if err != nil {
+		t.Errorf("expected failover CalcPlan() to work, err: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Query results may be streamed to a client as they're produced,
+// instead of being buffered into a single JSON response body, so
+// that huge result sets don't balloon memory.  The streaming mode of
+// a query is carried in the ctx of QueryCtx() and DestCtx.QueryCtx()
+// (see QueryStreamMode()), and a pindex implementation that supports
+// streaming writes its results via a QueryStreamWriter.  Since the
+// writes block when the client reads slowly, a producer, like a
+// merge of results across pindexes, is naturally backpressured.
+
+// QUERY_STREAM_NDJSON streams each result as a JSON line.
+const QUERY_STREAM_NDJSON = "ndjson"
+
+// QUERY_STREAM_CHUNKED streams the results as a JSON array.
+const QUERY_STREAM_CHUNKED = "chunked"
+
+// QUERY_STREAM_FLUSH_BYTES is the number of written bytes after
+// which a QueryStreamWriter flushes.
+var QUERY_STREAM_FLUSH_BYTES = 32 * 1024
+
+// QUERY_STREAM_FLUSH_INTERVAL is the max time that a
+// QueryStreamWriter holds written results before flushing.
+var QUERY_STREAM_FLUSH_INTERVAL = 100 * time.Millisecond
+
+type queryStreamModeKey struct{}
+
+// ValidQueryStreamMode returns true for a known streaming mode, or
+// for "", which means no streaming.
+func ValidQueryStreamMode(mode string) bool {
+	return mode == "" ||
+		mode == QUERY_STREAM_NDJSON ||
+		mode == QUERY_STREAM_CHUNKED
+}
+
+// WithQueryStreamMode returns a ctx that carries a query streaming
+// mode.
+func WithQueryStreamMode(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, queryStreamModeKey{}, mode)
+}
+
+// QueryStreamMode returns the query streaming mode of a ctx, or ""
+// when results should not be streamed.
+func QueryStreamMode(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	mode, _ := ctx.Value(queryStreamModeKey{}).(string)
+	return mode
+}
+
+// A QueryStreamFlusher is implemented by writers, like a
+// http.ResponseWriter, that can flush buffered data to the client.
+type QueryStreamFlusher interface {
+	Flush()
+}
+
+// A QueryStreamWriter writes query result records, where each record
+// is a JSON value, in a streaming mode, flushing the underlying
+// writer periodically.
+type QueryStreamWriter struct {
+	w       io.Writer
+	mode    string
+	flusher QueryStreamFlusher
+
+	numRecords int
+	unflushed  int
+	lastFlush  time.Time
+	closed     bool
+}
+
+// NewQueryStreamWriter returns a QueryStreamWriter for a streaming
+// mode, where the writer is flushed if it's a QueryStreamFlusher.
+func NewQueryStreamWriter(w io.Writer, mode string) (
+	*QueryStreamWriter, error) {
+	if mode != QUERY_STREAM_NDJSON && mode != QUERY_STREAM_CHUNKED {
+		return nil, fmt.Errorf("query_stream: unknown mode: %s", mode)
+	}
+
+	flusher, _ := w.(QueryStreamFlusher)
+
+	return &QueryStreamWriter{
+		w:         w,
+		mode:      mode,
+		flusher:   flusher,
+		lastFlush: time.Now(),
+	}, nil
+}
+
+// WriteRecord writes a single JSON result record.
+func (s *QueryStreamWriter) WriteRecord(record []byte) error {
+	if s.closed {
+		return fmt.Errorf("query_stream: closed")
+	}
+
+	var prefix, suffix []byte
+	if s.mode == QUERY_STREAM_NDJSON {
+		suffix = JsonNewLine
+	} else if s.numRecords == 0 {
+		prefix = JsonOpenBracket
+	} else {
+		prefix = JsonComma
+	}
+
+	for _, b := range [][]byte{prefix, record, suffix} {
+		if len(b) <= 0 {
+			continue
+		}
+		n, err := s.w.Write(b)
+		s.unflushed += n
+		if err != nil {
+			return err
+		}
+	}
+
+	s.numRecords++
+
+	if s.unflushed >= QUERY_STREAM_FLUSH_BYTES ||
+		time.Since(s.lastFlush) >= QUERY_STREAM_FLUSH_INTERVAL {
+		s.Flush()
+	}
+
+	return nil
+}
+
+// Flush flushes the records that were written so far.
+func (s *QueryStreamWriter) Flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	s.unflushed = 0
+	s.lastFlush = time.Now()
+}
+
+// NumRecords returns the number of records written so far.
+func (s *QueryStreamWriter) NumRecords() int {
+	return s.numRecords
+}
+
+// Close finishes the stream, such as by closing the JSON array of
+// the chunked mode, and flushes.
+func (s *QueryStreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.mode == QUERY_STREAM_CHUNKED {
+		end := JsonCloseBracket
+		if s.numRecords == 0 {
+			end = []byte("[]")
+		}
+		if _, err := s.w.Write(end); err != nil {
+			return err
+		}
+	}
+
+	s.Flush()
+
+	return nil
+}
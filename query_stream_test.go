@@ -0,0 +1,108 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+type testFlushBuffer struct {
+	bytes.Buffer
+	numFlushes int
+}
+
+func (b *testFlushBuffer) Flush() {
+	b.numFlushes++
+}
+
+func TestQueryStreamMode(t *testing.T) {
+	if QueryStreamMode(context.Background()) != "" {
+		t.Errorf("expected no stream mode")
+	}
+	ctx := WithQueryStreamMode(context.Background(), QUERY_STREAM_NDJSON)
+	if QueryStreamMode(ctx) != QUERY_STREAM_NDJSON {
+		t.Errorf("expected ndjson stream mode")
+	}
+	if !ValidQueryStreamMode("") || !ValidQueryStreamMode("chunked") ||
+		ValidQueryStreamMode("xml") {
+		t.Errorf("unexpected ValidQueryStreamMode")
+	}
+	if _, err := NewQueryStreamWriter(nil, "xml"); err == nil {
+		t.Errorf("expected err on unknown mode")
+	}
+}
+
+func TestQueryStreamWriter(t *testing.T) {
+	tests := []struct {
+		mode    string
+		records []string
+		exp     string
+	}{
+		{QUERY_STREAM_NDJSON, nil, ""},
+		{QUERY_STREAM_NDJSON, []string{`{"a":1}`, `{"b":2}`},
+			"{\"a\":1}\n{\"b\":2}\n"},
+		{QUERY_STREAM_CHUNKED, nil, "[]"},
+		{QUERY_STREAM_CHUNKED, []string{`1`}, "[1]"},
+		{QUERY_STREAM_CHUNKED, []string{`1`, `{"b":2}`, `3`},
+			`[1,{"b":2},3]`},
+	}
+
+	for i, test := range tests {
+		var b testFlushBuffer
+
+		s, err := NewQueryStreamWriter(&b, test.mode)
+		if err != nil {
+			t.Fatalf("i: %d, expected no err, got: %v", i, err)
+		}
+		for _, record := range test.records {
+			if err = s.WriteRecord([]byte(record)); err != nil {
+				t.Errorf("i: %d, expected no err, got: %v", i, err)
+			}
+		}
+		if s.NumRecords() != len(test.records) {
+			t.Errorf("i: %d, expected num records: %d, got: %d",
+				i, len(test.records), s.NumRecords())
+		}
+		s.Close()
+		s.Close()
+
+		if b.String() != test.exp {
+			t.Errorf("i: %d, expected: %q, got: %q", i, test.exp, b.String())
+		}
+		if b.numFlushes <= 0 {
+			t.Errorf("i: %d, expected a flush on close", i)
+		}
+		if s.WriteRecord([]byte(`1`)) == nil {
+			t.Errorf("i: %d, expected err after close", i)
+		}
+	}
+}
+
+func TestQueryStreamWriterFlushBytes(t *testing.T) {
+	prev := QUERY_STREAM_FLUSH_BYTES
+	QUERY_STREAM_FLUSH_BYTES = 4
+	defer func() { QUERY_STREAM_FLUSH_BYTES = prev }()
+
+	var b testFlushBuffer
+
+	s, _ := NewQueryStreamWriter(&b, QUERY_STREAM_NDJSON)
+	s.WriteRecord([]byte(`1`))
+	if b.numFlushes != 0 {
+		t.Errorf("expected no flush yet")
+	}
+	s.WriteRecord([]byte(`12345`))
+	if b.numFlushes != 1 {
+		t.Errorf("expected a flush, got: %d", b.numFlushes)
+	}
+}
@@ -654,23 +654,45 @@ func (r *Rebalancer) assignPIndexLOCKED(index, pindex, node, state, op string) (
 		return nil, nil, "", err
 	}
 
-	indexDefs, err := cbgt.PlannerGetIndexDefs(r.cfg, r.version)
-	if err != nil {
-		return nil, nil, "", err
-	}
+	var indexDef *cbgt.IndexDef
+	var planPIndexes *cbgt.PlanPIndexes
+	var formerPrimaryNode string
+
+	// Retry on CAS conflicts, such as from a concurrent planner, by
+	// re-applying the assignment onto the latest plan.
+	err = cbgt.CfgRetry(cbgt.CfgRetryOptionsDefault, func(tries int) error {
+		indexDefs, err := cbgt.PlannerGetIndexDefs(r.cfg, r.version)
+		if err != nil {
+			return err
+		}
 
-	indexDef := indexDefs.IndexDefs[index]
-	if indexDef == nil {
-		return nil, nil, "", ErrorNoIndexDefinitionFound
-	}
+		indexDef = indexDefs.IndexDefs[index]
+		if indexDef == nil {
+			return ErrorNoIndexDefinitionFound
+		}
 
-	planPIndexes, cas, err := cbgt.PlannerGetPlanPIndexes(r.cfg, r.version)
-	if err != nil {
-		return nil, nil, "", err
-	}
+		var cas uint64
 
-	formerPrimaryNode, err := r.updatePlanPIndexesLOCKED(planPIndexes,
-		indexDef, pindex, node, state, op)
+		planPIndexes, cas, err =
+			cbgt.PlannerGetPlanPIndexes(r.cfg, r.version)
+		if err != nil {
+			return err
+		}
+
+		formerPrimaryNode, err = r.updatePlanPIndexesLOCKED(planPIndexes,
+			indexDef, pindex, node, state, op)
+		if err != nil {
+			return err
+		}
+
+		if r.optionsReb.DryRun {
+			return nil
+		}
+
+		_, err = cbgt.CfgSetPlanPIndexes(r.cfg, planPIndexes, cas)
+
+		return err
+	})
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -679,12 +701,7 @@ func (r *Rebalancer) assignPIndexLOCKED(index, pindex, node, state, op string) (
 		return nil, nil, formerPrimaryNode, nil
 	}
 
-	_, err = cbgt.CfgSetPlanPIndexes(r.cfg, planPIndexes, cas)
-	if err != nil {
-		return nil, nil, "", err
-	}
-
-	return indexDef, planPIndexes, formerPrimaryNode, err
+	return indexDef, planPIndexes, formerPrimaryNode, nil
 }
 
 // --------------------------------------------------------
@@ -36,10 +36,10 @@ import (
 
 var StartTime = time.Now()
 
+// ShowError responds with a RESTError JSON body for an error message.
 func ShowError(w http.ResponseWriter, r *http.Request,
 	msg string, code int) {
-	log.Printf("rest: error code: %d, msg: %s", code, msg)
-	http.Error(w, msg, code)
+	ShowRESTError(w, r, &RESTError{Message: msg}, code)
 }
 
 func MustEncode(w io.Writer, i interface{}) {
@@ -97,9 +97,20 @@ func DocIDLookup(req *http.Request) string {
 	return RequestVariableLookup(req, "docID")
 }
 
-// IndexNameLookup returns the indexName param from an http.Request.
+// IndexNameLookup returns the indexName param from an http.Request,
+// qualified by the ns param for the namespaced endpoints.
 func IndexNameLookup(req *http.Request) string {
-	return RequestVariableLookup(req, "indexName")
+	indexName := RequestVariableLookup(req, "indexName")
+	if indexName == "" {
+		return ""
+	}
+	return cbgt.NamespacedIndexName(NamespaceLookup(req), indexName)
+}
+
+// NamespaceLookup returns the ns param from an http.Request, which is
+// "" for the endpoints that aren't namespaced.
+func NamespaceLookup(req *http.Request) string {
+	return RequestVariableLookup(req, "ns")
 }
 
 // PIndexNameLookup returns the pindexName param from an http.Request.
@@ -150,6 +161,19 @@ var RESTMethodOrds = map[string]string{
 
 // -------------------------------------------------------
 
+// REQUEST_ID_HEADER is the header of a REST request's ID, which is
+// honored when provided by the client, or else generated, and which
+// is echoed in the response.
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// RequestIDLookup returns the request ID of an http.Request.
+func RequestIDLookup(req *http.Request) string {
+	if req == nil || req.Header == nil {
+		return ""
+	}
+	return req.Header.Get(REQUEST_ID_HEADER)
+}
+
 // HandlerWithRESTMeta wrapper associates a http.Handler with
 // RESTMeta information.
 type HandlerWithRESTMeta struct {
@@ -175,10 +199,25 @@ func (h *HandlerWithRESTMeta) ServeHTTP(
 		startTime = time.Now()
 	}
 
+	requestID := RequestIDLookup(req)
+	if requestID == "" {
+		requestID = cbgt.NewUUID()
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		req.Header.Set(REQUEST_ID_HEADER, requestID)
+	}
+	w.Header().Set(REQUEST_ID_HEADER, requestID)
+
 	crw := &CountResponseWriter{ResponseWriter: w}
 
 	h.h.ServeHTTP(crw, req)
 
+	if cbgt.LogEnabled("rest", cbgt.LOG_LEVEL_DEBUG) {
+		log.Printf("rest: %s %s, requestID: %s, bytes: %d",
+			req.Method, req.URL.Path, requestID, crw.TotBytesWritten)
+	}
+
 	if focusStats != nil {
 		atomic.AddUint64(&focusStats.TotRequestTimeNS,
 			uint64(time.Now().Sub(startTime)))
@@ -262,6 +301,33 @@ func (s *RESTFocusStats) AtomicCopyTo(r *RESTFocusStats) {
 
 // -------------------------------------------------------
 
+// The roles of REST routes, so that the management endpoints can be
+// served by a separate listener than the query endpoints, such as on
+// a port that's not exposed to the query clients.  When the
+// "bindHttpManagement" manager option is set, the router of
+// InitRESTRouterEx() serves only the query endpoints, and the
+// embedding process should bind a router that's initialized with an
+// options["role"] of REST_ROLE_MANAGEMENT to that address.
+const REST_ROLE_QUERY = "query"
+const REST_ROLE_MANAGEMENT = "management"
+
+// RESTRouteHasRole returns true if a REST route, given its path spec
+// and its RESTMeta opts, should be served by a router of a role.
+// Query endpoints are those categorized as querying, and the rest are
+// management endpoints, except that /api/ping is served by both.
+func RESTRouteHasRole(path string, opts map[string]string,
+	role string) bool {
+	if path == "/api/ping" {
+		return true
+	}
+	if strings.HasSuffix(opts["_category"], "querying") {
+		return role == REST_ROLE_QUERY
+	}
+	return role == REST_ROLE_MANAGEMENT
+}
+
+// -------------------------------------------------------
+
 // NewRESTRouter creates a mux.Router initialized with the REST API
 // and web UI routes.  See also InitStaticRouter and InitRESTRouter if
 // you need finer control of the router initialization.
@@ -313,6 +379,8 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 
 	mapRESTPathStats := map[string]*RESTPathStats{} // Keyed by path spec.
 
+	role := ""
+
 	if options != nil {
 		if v, ok := options["auth"]; ok {
 			authHandler, ok = v.(func(http.Handler) http.Handler)
@@ -327,16 +395,45 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 				return nil, nil, fmt.Errorf("rest: mapRESTPathStats invalid")
 			}
 		}
+
+		if v, ok := options["role"]; ok {
+			role, ok = v.(string)
+			if !ok || (role != "" &&
+				role != REST_ROLE_QUERY && role != REST_ROLE_MANAGEMENT) {
+				return nil, nil, fmt.Errorf("rest: role invalid")
+			}
+		}
+	}
+
+	// When the management endpoints have their own listener, a
+	// router serves only the endpoints of its role.
+	if role == "" && mgr.Options()["bindHttpManagement"] != "" {
+		role = REST_ROLE_QUERY
 	}
 
 	prefix := mgr.Options()["urlPrefix"]
 
+	httpServerOptions, err := ParseHTTPServerOptions(mgr.Options())
+	if err != nil {
+		return nil, nil, err
+	}
+	hardenHandler := httpServerOptions.Middleware()
+
+	corsOptions, err := ParseCORSOptions(mgr.Options())
+	if err != nil {
+		return nil, nil, err
+	}
+	corsPreflightPaths := map[string]bool{}
+
 	PIndexTypesInitRouter(r, "manager.before", mgr)
 
 	meta := map[string]RESTMeta{}
 
 	handle := func(path string, method string, h http.Handler,
 		opts map[string]string) {
+		if role != "" && !RESTRouteHasRole(path, opts, role) {
+			return
+		}
 		opts["_path"] = path
 		if a, ok := h.(RESTOpts); ok {
 			a.RESTOpts(opts)
@@ -353,7 +450,29 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 		if authHandler != nil {
 			h = authHandler(h)
 		}
+		h = hardenHandler(h)
+		if corsOptions != nil {
+			h = corsOptions.Middleware()(h)
+			if !corsPreflightPaths[prefixPath] {
+				corsPreflightPaths[prefixPath] = true
+				r.Handle(prefixPath, corsOptions.PreflightHandler()).
+					Methods("OPTIONS")
+			}
+		}
 		r.Handle(prefixPath, h).Methods(method).Name(prefixPath)
+
+		// The index endpoints are also available for the indexes of a
+		// namespace, like /api/ns/{ns}/index/{indexName}, where the
+		// handlers see the namespaced index name via IndexNameLookup().
+		if strings.HasPrefix(path, "/api/index") {
+			nsPath := prefix + "/api/ns/{ns}" + path[len("/api"):]
+			if corsOptions != nil && !corsPreflightPaths[nsPath] {
+				corsPreflightPaths[nsPath] = true
+				r.Handle(nsPath, corsOptions.PreflightHandler()).
+					Methods("OPTIONS")
+			}
+			r.Handle(nsPath, h).Methods(method).Name(nsPath)
+		}
 	}
 
 	handle("/api/index", "GET", NewListIndexHandler(mgr),
@@ -399,6 +518,16 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			})
 	}
 
+	handle("/api/alias/{aliasName}/{op}", "POST",
+		NewAliasTargetsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Atomically retargets an index alias, where the op
+                       is swap, add-target, remove-target or
+                       set-routing.`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/index/{indexName}/planFreezeControl/{op}", "POST",
 		NewIndexControlHandler(mgr, "planFreeze", map[string]bool{
 			"freeze":   true,
@@ -462,6 +591,80 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 				"_category":          "x/Advanced|x/Index partition querying",
 				"version introduced": "0.2.0",
 			})
+		handle("/api/index/{indexName}/pindexesQuery", "POST",
+			NewQueryPIndexesHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition querying",
+				"_about":             `Queries several index partitions on this node with a single request.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/ingestControl/{op}", "POST",
+			NewPIndexIngestControlHandler(mgr),
+			map[string]string{
+				"_category": "x/Advanced|x/Index partition management",
+				"_about": `Pause or resume the ingest of an index partition
+                          on this node, leaving it read-only for queries.`,
+				"param: op": "required, string, URL path parameter\n\n" +
+					`Allowed values for op are "pause" or "resume".`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/ingest", "POST",
+			NewIngestPIndexHandler(mgr),
+			map[string]string{
+				"_category": "x/Advanced|x/Index partition management",
+				"_about": `Ingests a batch of mutations into an index
+                          partition whose data source type is "push".`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/files", "GET",
+			NewListPIndexFilesHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition transfer",
+				"_about":             `Lists the files of an index partition with their checksums.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/file", "GET",
+			NewGetPIndexFileHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition transfer",
+				"_about":             `Streams a file of an index partition, supporting range requests.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/backup", "GET",
+			NewBackupPIndexHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition backup",
+				"_about":             `Streams a tar archive backup of an index partition.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/index/{indexName}/backup", "GET",
+			NewBackupIndexHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition backup",
+				"_about":             `Streams a tar archive backup of the index partitions on this node.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/restore", "POST",
+			NewRestoreHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition backup",
+				"_about":             `Restores the index partitions of a tar archive backup.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/pindex/{pindexName}/verify", "POST",
+			NewVerifyPIndexHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition integrity",
+				"_about":             `Verifies the storage integrity of an index partition.`,
+				"version introduced": "5.0.0",
+			})
+		handle("/api/verify", "POST",
+			NewVerifyHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition integrity",
+				"_about":             `Verifies the storage integrity of the index partitions on this node.`,
+				"version introduced": "5.0.0",
+			})
 	}
 	handle("/api/index/{indexName}/pindexLookup", "POST", NewPIndexLookUpHandler(mgr),
 		map[string]string{
@@ -470,6 +673,106 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "5.0.0",
 		})
 
+	handle("/api/index/{indexName}/doc/{docID}", "GET", NewDocLookUpHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|PIndex lookup",
+			"_about":             `Returns the PIndex that owns a document and what it stores for the document.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/docTrace", "GET", NewGetDocTraceHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index monitoring",
+			"_about":             `Returns the recorded ingest events of the traced docs of an index on this node.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/docTrace", "PUT", NewPutDocTraceHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Starts recording the data mutations, snapshots,
+                       checkpoints and rollbacks that affect some docs
+                       of an index on this node, for debugging.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/docTrace", "DELETE", NewDeleteDocTraceHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index monitoring",
+			"_about":             `Stops tracing the docs of an index on this node.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/queries", "GET", NewListQueriesHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index querying",
+			"_about":             `Returns the active queries on this node.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/queries/{queryID}", "DELETE", NewCancelQueryHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index querying",
+			"_about":             `Cancels an active query on this node.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/tasks", "POST",
+		NewSubmitTaskHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Submits a task, like a compaction, merge or backup,
+                          to an index.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/tasks/{taskID}", "GET",
+		NewGetTaskHandler(mgr),
+		map[string]string{
+			"_category":          "Indexing|Index management",
+			"_about":             `Returns the status of a task on an index.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/progress", "GET",
+		NewIndexProgressHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Returns how caught up the index partitions on
+                          this node are with the data source, as JSON.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/partitionsAdvice", "GET",
+		NewPartitionsAdviceHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index monitoring",
+			"_about": `Analyzes the sizes of the index partitions on
+                          this node and recommends a new
+                          maxPartitionsPerPIndex, as JSON.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/partitionsAdvice", "POST",
+		NewPartitionsAdviceHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Analyzes the sizes of the index partitions on
+                          this node and, with the apply param, re-splits
+                          the index with the recommended
+                          maxPartitionsPerPIndex.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/index/{indexName}/consistencyVector", "POST",
+		NewConsistencyVectorHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index querying",
+			"_about": `Converts mutation tokens into the at_plus
+                          consistency params of a query on an index.`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/managerOptions", "PUT", NewManagerOptions(mgr),
 		map[string]string{
 			"_category":          "Node|Node configuration",
@@ -477,6 +780,16 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "4.2.0",
 		})
 
+	handle("/api/managerOptions", "POST", NewRuntimeOptionsHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Changes runtime manager options, like memory and
+                       feed tuning, for the whole cluster, where the
+                       options are validated and persisted in the
+                       cluster's configuration, so they survive restarts.`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/cfg", "GET", NewCfgGetHandler(mgr),
 		map[string]string{
 			"_category": "Node|Node configuration",
@@ -485,6 +798,16 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "0.0.1",
 		})
 
+	handle("/api/cfg/stream", "GET", NewCfgStreamHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Streams changes to the cluster's configuration,
+                       like index definitions and plans, as server-sent
+                       events, each with the changed key and its new
+                       CAS, and optionally its new value.`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/cfgRefresh", "POST", NewCfgRefreshHandler(mgr),
 		map[string]string{
 			"_category": "Node|Node configuration",
@@ -493,6 +816,95 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "0.0.1",
 		})
 
+	handle("/api/maintenance/schedules", "GET",
+		NewListMaintenanceSchedulesHandler(mgr),
+		map[string]string{
+			"_category":          "Node|Node maintenance",
+			"_about":             `Returns the maintenance schedules of the cluster.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/maintenance/schedules/{scheduleName}", "PUT",
+		NewPutMaintenanceScheduleHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node maintenance",
+			"_about": `Adds or replaces a maintenance schedule, which
+                       defers an operation to a recurring window.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/maintenance/schedules/{scheduleName}", "DELETE",
+		NewDeleteMaintenanceScheduleHandler(mgr),
+		map[string]string{
+			"_category":          "Node|Node maintenance",
+			"_about":             `Removes a maintenance schedule.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/maintenance/schedules/{scheduleName}/runNow", "POST",
+		NewRunMaintenanceNowHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node maintenance",
+			"_about": `Runs the operation of a maintenance schedule on
+                       this node now, regardless of its window.`,
+			"version introduced": "5.0.0",
+		})
+
+	clusterJoinHandler := NewClusterJoinHandler(mgr)
+	clusterJoinHandler.authenticated = authHandler != nil
+
+	handle("/api/cluster/join", "POST", clusterJoinHandler,
+		map[string]string{
+			"_category": "Node|Node membership",
+			"_about": `Returns the Cfg connection info of the cluster,
+                       so that a new node that's pointed at this node
+                       can connect to the Cfg and register itself;
+                       only enabled when REST auth is configured.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/upgradeStatus", "GET", NewUpgradeStatusHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node membership",
+			"_about": `Returns the cluster's compat version and whether
+                       each node runs the newest version among the
+                       nodes, for orchestrating rolling upgrades.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/node/drain", "POST", NewDrainNodeHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node membership",
+			"_about": `Gracefully shuts down the node, by rejecting new
+                       queries, waiting for in-flight queries to finish,
+                       and then stopping its feeds and closing its
+                       index partitions.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/node/{nodeUUID}", "PUT", NewAddNodeHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node membership",
+			"_about": `Adds a node to the cluster, by registering the
+                       node as known and wanted.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/node/{nodeUUID}/{op}", "POST", NewNodeControlHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node membership",
+			"_about": `Changes the membership of a node.  The "remove" op
+                       gracefully moves the node's index partitions to
+                       the remaining nodes before unregistering the node.
+                       The "failover" op immediately unregisters a dead
+                       node and reassigns its index partitions.
+                       The "promote" op turns a standby node into a
+                       regular node that serves queries.`,
+			"param: op": "required, string, URL path parameter\n\n" +
+				`Allowed values for op are "remove", "failover" or "promote".`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/log", "GET", NewLogGetHandler(mgr, mr),
 		map[string]string{
 			"_category": "Node|Node diagnostics",
@@ -518,6 +930,46 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "0.0.1",
 		})
 
+	handle("/api/janitor/plan", "GET", NewJanitorPlanHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the index partitions and feeds that the
+                       janitor on this node intends to add or remove
+                       to reconcile with the latest plan.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/orphans/sweep", "POST", NewOrphanSweepHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Moves the pindex directories of this node that
+                       aren't opened or planned into quarantine, and
+                       deletes those quarantined longer than the
+                       orphanRetention manager option.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/planRollout", "GET", NewGetPlanRolloutHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the staged rollout of the current plan
+                       across the nodes, if any, including which
+                       waves of nodes are allowed to apply the plan.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/planRollout/{op}", "POST",
+		NewPlanRolloutControlHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Forces the staged rollout of the current plan to
+                       allow its next wave of nodes, regardless of
+                       health checks, or to allow all remaining waves.`,
+			"param: op": "required, string, URL path parameter\n\n" +
+				`Allowed values for op are "advance" or "finish".`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/managerMeta", "GET", NewManagerMetaHandler(mgr, meta),
 		map[string]string{
 			"_category": "Node|Node configuration",
@@ -568,6 +1020,30 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "5.0.0",
 		})
 
+	handle("/api/faults", "GET", NewListFaultsHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Returns the faults injected on this node into the
+                       data sent by feeds to index partitions.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/faults/{faultName}", "PUT", NewPutFaultHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node diagnostics",
+			"_about": `Injects latencies, dropped snapshots, rollbacks or
+                       errors on this node into the data sent by feeds
+                       to index partitions, for chaos testing.`,
+			"version introduced": "5.0.0",
+		})
+
+	handle("/api/faults/{faultName}", "DELETE", NewDeleteFaultHandler(mgr),
+		map[string]string{
+			"_category":          "Node|Node diagnostics",
+			"_about":             `Removes an injected fault from this node.`,
+			"version introduced": "5.0.0",
+		})
+
 	handle("/api/runtime/gc", "POST",
 		http.HandlerFunc(RESTPostRuntimeGC),
 		map[string]string{
@@ -593,6 +1069,12 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
                        memory usage profiling information.`,
 			"version introduced": "0.0.1",
 		})
+	handle("/api/runtime/logLevel", "POST", NewLogLevelHandler(),
+		map[string]string{
+			"_category":          "Node|Node diagnostics",
+			"_about":             `Changes the log level of a subsystem at runtime.`,
+			"version introduced": "5.0.0",
+		})
 
 	handle("/api/runtime/stats", "GET",
 		http.HandlerFunc(RESTGetRuntimeStats),
@@ -616,7 +1098,10 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 		map[string]string{
 			"_category": "Indexing|Index monitoring",
 			"_about": `Returns indexing and data related metrics,
-                       timings and counters from the node as JSON.`,
+                       timings and counters from the node as JSON.
+                       The stats are cached for the statsCacheTTL
+                       manager option (default 1s), and responses have
+                       an ETag for If-None-Match requests.`,
 			"version introduced": "0.0.1",
 		})
 
@@ -649,6 +1134,16 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "4.2.0",
 		})
 
+	handle("/api/source/validate", "POST",
+		NewSourceValidateHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index definition",
+			"_about": `Checks that a data source is usable, such as
+                       its connectivity, auth and existence, so that
+                       it can be validated before an index is created.`,
+			"version introduced": "5.0.0",
+		})
+
 	PIndexTypesInitRouter(r, "manager.after", mgr)
 
 	return r, meta, nil
@@ -748,14 +1243,14 @@ func RESTPostRuntimeGC(w http.ResponseWriter, r *http.Request) {
 func RESTProfileCPU(w http.ResponseWriter, r *http.Request) {
 	secs, err := strconv.Atoi(r.FormValue("secs"))
 	if err != nil || secs <= 0 {
-		http.Error(w, "incorrect or missing secs parameter", 400)
+		ShowError(w, r, "incorrect or missing secs parameter", 400)
 		return
 	}
 	fname := "./run-cpu.pprof"
 	os.Remove(fname)
 	f, err := os.Create(fname)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("profileCPU:"+
+		ShowError(w, r, fmt.Sprintf("profileCPU:"+
 			" couldn't create file: %s, err: %v",
 			fname, err), 500)
 		return
@@ -763,7 +1258,7 @@ func RESTProfileCPU(w http.ResponseWriter, r *http.Request) {
 	log.Printf("profileCPU: start, file: %s", fname)
 	err = pprof.StartCPUProfile(f)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("profileCPU:"+
+		ShowError(w, r, fmt.Sprintf("profileCPU:"+
 			" couldn't start CPU profile, file: %s, err: %v",
 			fname, err), 500)
 		return
@@ -786,7 +1281,7 @@ func RESTProfileMemory(w http.ResponseWriter, r *http.Request) {
 	os.Remove(fname)
 	f, err := os.Create(fname)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("profileMemory:"+
+		ShowError(w, r, fmt.Sprintf("profileMemory:"+
 			" couldn't create file: %v, err: %v",
 			fname, err), 500)
 		return
@@ -835,6 +1330,12 @@ func (cw *CountResponseWriter) WriteHeader(n int) {
 	cw.ResponseWriter.WriteHeader(n)
 }
 
+func (cw *CountResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (cw *CountResponseWriter) CloseNotify() <-chan bool {
 	cn, ok := cw.ResponseWriter.(http.CloseNotifier)
 	if ok && cn != nil {
@@ -0,0 +1,146 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// AliasTargetsHandler is a REST handler that atomically retargets an
+// index alias.
+type AliasTargetsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewAliasTargetsHandler(mgr *cbgt.Manager) *AliasTargetsHandler {
+	return &AliasTargetsHandler{mgr: mgr}
+}
+
+func (h *AliasTargetsHandler) RESTOpts(opts map[string]string) {
+	opts["param: aliasName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index alias."
+	opts["param: op"] =
+		"required, string, URL path parameter\n\n" +
+			"One of swap, add-target, remove-target or set-routing."
+	opts[""] =
+		`For the swap op, the request's POST body is JSON of` +
+			` {"from": "oldIndex", "to": "newIndex", "prevIndexUUID": ""},` +
+			` which replaces the from target with the to target in one` +
+			` update.  For the add-target and remove-target ops, the POST` +
+			` body is JSON of {"target": "index", "prevIndexUUID": ""}.` +
+			`  For the set-routing op, the POST body is JSON of` +
+			` {"routing": "weighted", "weights": {"index": 3},` +
+			` "prevIndexUUID": ""}, where the routing is one of all,` +
+			` firstHealthy or weighted, and the weights of targets` +
+			` default to 1.  The optional routing and weights may also` +
+			` be part of the other ops.  When the optional prevIndexUUID` +
+			` is not empty, the update fails unless it matches the` +
+			` alias's current index UUID.`
+
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "uuid": "..."},` +
+			` where the uuid is the alias's new index UUID`
+}
+
+func (h *AliasTargetsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	aliasName := RequestVariableLookup(req, "aliasName")
+	op := RequestVariableLookup(req, "op")
+	if aliasName == "" {
+		ShowError(w, req, "rest_alias: alias name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_alias: could not read"+
+			" request body, aliasName: %s", aliasName), http.StatusBadRequest)
+		return
+	}
+
+	var r struct {
+		From          string         `json:"from"`
+		To            string         `json:"to"`
+		Target        string         `json:"target"`
+		Weights       map[string]int `json:"weights"`
+		Routing       string         `json:"routing"`
+		PrevIndexUUID string         `json:"prevIndexUUID"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_alias: could not parse"+
+			" request body, aliasName: %s, err: %v", aliasName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	u := cbgt.AliasTargetsUpdate{
+		PrevIndexUUID: r.PrevIndexUUID,
+		Weights:       r.Weights,
+		Routing:       r.Routing,
+	}
+
+	switch op {
+	case "swap":
+		if r.From == "" || r.To == "" {
+			ShowError(w, req, "rest_alias: from and to are required",
+				http.StatusBadRequest)
+			return
+		}
+		u.Remove = []string{r.From}
+		u.Add = []string{r.To}
+	case "add-target", "remove-target":
+		if r.Target == "" {
+			ShowError(w, req, "rest_alias: target is required",
+				http.StatusBadRequest)
+			return
+		}
+		if op == "add-target" {
+			u.Add = []string{r.Target}
+		} else {
+			u.Remove = []string{r.Target}
+		}
+	case "set-routing":
+		if r.Routing == "" && len(r.Weights) <= 0 {
+			ShowError(w, req, "rest_alias: routing or weights are required",
+				http.StatusBadRequest)
+			return
+		}
+	default:
+		ShowError(w, req, fmt.Sprintf("rest_alias: unknown op: %s", op),
+			http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := h.mgr.UpdateAliasTargets(aliasName, u)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_alias:"+
+			" UpdateAliasTargets, aliasName: %s, err: %v", aliasName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+		UUID   string `json:"uuid"`
+	}{
+		Status: "ok",
+		UUID:   uuid,
+	})
+}
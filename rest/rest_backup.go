@@ -0,0 +1,125 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/cbgt"
+)
+
+// BackupPIndexHandler is a REST handler that streams a tar archive
+// backup of a single local pindex.
+type BackupPIndexHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewBackupPIndexHandler(mgr *cbgt.Manager) *BackupPIndexHandler {
+	return &BackupPIndexHandler{mgr: mgr}
+}
+
+func (h *BackupPIndexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_backup: pindex name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	if h.mgr.GetPIndex(pindexName) == nil {
+		ShowError(w, req, fmt.Sprintf("rest_backup:"+
+			" no pindex, pindexName: %s", pindexName), http.StatusBadRequest)
+		return
+	}
+
+	backupPIndexes(h.mgr, w, req, pindexName, []string{pindexName})
+}
+
+// ---------------------------------------------------
+
+// BackupIndexHandler is a REST handler that streams a tar archive
+// backup of all of an index's pindexes on this node.
+type BackupIndexHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewBackupIndexHandler(mgr *cbgt.Manager) *BackupIndexHandler {
+	return &BackupIndexHandler{mgr: mgr}
+}
+
+func (h *BackupIndexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "rest_backup: index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	pindexNames := h.mgr.LocalPIndexNamesForIndex(indexName)
+	if len(pindexNames) == 0 {
+		ShowError(w, req, fmt.Sprintf("rest_backup:"+
+			" no local pindexes, indexName: %s", indexName),
+			http.StatusBadRequest)
+		return
+	}
+
+	backupPIndexes(h.mgr, w, req, indexName, pindexNames)
+}
+
+func backupPIndexes(mgr *cbgt.Manager, w http.ResponseWriter,
+	req *http.Request, name string, pindexNames []string) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s.tar"`, name))
+
+	// Once streaming has started, errors can only be logged, and the
+	// client will see a truncated archive.
+	err := mgr.BackupPIndexes(pindexNames, w)
+	if err != nil {
+		log.Printf("rest_backup: backup, name: %s, err: %v", name, err)
+	}
+}
+
+// ---------------------------------------------------
+
+// RestoreHandler is a REST handler that installs the pindexes of a
+// tar archive backup, which is the request body, on this node.
+type RestoreHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRestoreHandler(mgr *cbgt.Manager) *RestoreHandler {
+	return &RestoreHandler{mgr: mgr}
+}
+
+func (h *RestoreHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexNames, err := h.mgr.RestorePIndexes(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_backup: restore, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status   string   `json:"status"`
+		PIndexes []string `json:"pindexes"`
+	}{
+		Status:   "ok",
+		PIndexes: pindexNames,
+	})
+}
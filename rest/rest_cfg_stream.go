@@ -0,0 +1,192 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// CfgStreamKeepAlive is how often an idle cfg stream sends an SSE
+// comment, so that proxies and clients don't time out the stream.
+var CfgStreamKeepAlive = 30 * time.Second
+
+// CfgStreamBufferSize is the number of cfg changes buffered for a
+// slow cfg stream client before changes are dropped.
+var CfgStreamBufferSize = 100
+
+// A CfgChange is the data of a "cfgChange" event of a cfg stream.
+type CfgChange struct {
+	Key string `json:"key"`
+	CAS uint64 `json:"cas"` // 0 when the key was deleted.
+	Err string `json:"err,omitempty"`
+
+	// The current value and CAS of the key, only when requested.
+	Value    json.RawMessage `json:"value,omitempty"`
+	ValueCAS uint64          `json:"valueCAS,omitempty"`
+}
+
+// CfgStreamHandler is a REST handler that streams the changes of the
+// Cfg keys of cbgt.CfgChangeKeys() as server-sent events, so that
+// external controllers can react to index definition or plan changes
+// without polling /api/cfg.
+type CfgStreamHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgStreamHandler(mgr *cbgt.Manager) *CfgStreamHandler {
+	return &CfgStreamHandler{mgr: mgr}
+}
+
+func (h *CfgStreamHandler) RESTOpts(opts map[string]string) {
+	opts["param: keys"] =
+		"optional, string, form parameter" +
+			"\n\nA comma separated list of the Cfg keys to stream, of: " +
+			strings.Join(cbgt.CfgChangeKeys(), ", ") +
+			"; defaults to all of them."
+	opts["param: payload"] =
+		"optional, bool, form parameter" +
+			"\n\nWhen true, each change also has the key's current value" +
+			" and CAS."
+}
+
+func (h *CfgStreamHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	keys := map[string]bool{}
+	for _, key := range cbgt.CfgChangeKeys() {
+		keys[key] = true
+	}
+
+	keysStr := req.FormValue("keys")
+	if keysStr != "" {
+		wanted := map[string]bool{}
+		for _, key := range strings.Split(keysStr, ",") {
+			key = strings.TrimSpace(key)
+			if !keys[key] {
+				ShowError(w, req, fmt.Sprintf("rest_cfg_stream:"+
+					" unknown key: %q", key), http.StatusBadRequest)
+				return
+			}
+			wanted[key] = true
+		}
+		keys = wanted
+	}
+
+	var payload bool
+	payloadStr := req.FormValue("payload")
+	if payloadStr != "" {
+		var err error
+		payload, err = strconv.ParseBool(payloadStr)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_cfg_stream:"+
+				" bad payload param: %q", payloadStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ShowError(w, req, "rest_cfg_stream: streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan cbgt.CfgEvent, CfgStreamBufferSize)
+
+	err := h.mgr.SubscribeCfgChanges(ch)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_stream: subscribe,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer h.mgr.UnsubscribeCfgChanges(ch)
+
+	ctx, cancel := requestContext(w, req)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// An initial comment tells the client that it's subscribed.
+	_, err = w.Write([]byte(": subscribed\n\n"))
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(CfgStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var msg []byte
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-keepAlive.C:
+			msg = []byte(": keepalive\n\n")
+
+		case e := <-ch:
+			if !keys[e.Key] {
+				continue
+			}
+
+			msg, err = h.cfgChangeEvent(e, payload)
+			if err != nil {
+				return
+			}
+		}
+
+		_, err = w.Write(msg)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// cfgChangeEvent returns the server-sent event of a cfg change.
+func (h *CfgStreamHandler) cfgChangeEvent(e cbgt.CfgEvent,
+	payload bool) ([]byte, error) {
+	c := &CfgChange{Key: e.Key, CAS: e.CAS}
+	if e.Error != nil {
+		c.Err = e.Error.Error()
+	}
+
+	if payload {
+		val, cas, err := h.mgr.Cfg().Get(e.Key, 0)
+		if err != nil {
+			c.Err = err.Error()
+		} else if val != nil {
+			var v json.RawMessage
+			if json.Unmarshal(val, &v) == nil {
+				c.Value = v
+			}
+			c.ValueCAS = cas
+		}
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("event: cfgChange\ndata: " + string(data) + "\n\n"), nil
+}
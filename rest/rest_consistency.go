@@ -0,0 +1,91 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// ConsistencyVectorHandler is a REST handler that converts mutation
+// tokens from a Couchbase SDK into the "at_plus" consistency params
+// of a query on an index.
+type ConsistencyVectorHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewConsistencyVectorHandler(mgr *cbgt.Manager) *ConsistencyVectorHandler {
+	return &ConsistencyVectorHandler{mgr: mgr}
+}
+
+func (h *ConsistencyVectorHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index to be queried."
+	opts["param: mutationTokens"] =
+		"required, array, JSON request body field\n\n" +
+			`The mutation tokens, each like` +
+			` {"vbid": 12, "vbuuid": 140737488355328, "seqno": 1001}.`
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "consistency": {...}},` +
+			` where the consistency can be used as the "ctl"` +
+			` "consistency" of a query request`
+}
+
+func (h *ConsistencyVectorHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "rest_consistency: index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	_, _, err := h.mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_consistency:"+
+			" GetIndexDef, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_consistency:"+
+			" could not read request body, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	var tokens struct {
+		MutationTokens []cbgt.MutationToken `json:"mutationTokens"`
+	}
+	err = json.Unmarshal(requestBody, &tokens)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_consistency:"+
+			" could not parse request body, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status      string                  `json:"status"`
+		Consistency *cbgt.ConsistencyParams `json:"consistency"`
+	}{
+		Status: "ok",
+		Consistency: cbgt.MutationTokensConsistencyParams(
+			[]string{indexName}, tokens.MutationTokens),
+	})
+}
@@ -0,0 +1,167 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSOptions allow web UIs that are hosted on other origins to call
+// the REST API, and are parsed from the manager options of
+// corsAllowedOrigins (comma separated origins, like
+// "https://console.example.com", or "*" for any origin),
+// corsAllowedMethods, corsAllowedHeaders and corsAllowCredentials.
+// As credentialed requests from any origin would let any website call
+// the REST API as the user, corsAllowCredentials requires an explicit
+// list of origins.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+// CORS_DEFAULT_ALLOWED_METHODS are the default methods allowed for
+// cross-origin requests.
+var CORS_DEFAULT_ALLOWED_METHODS = []string{"GET", "POST", "PUT", "DELETE"}
+
+// CORS_DEFAULT_ALLOWED_HEADERS are the default headers allowed for
+// cross-origin requests.
+var CORS_DEFAULT_ALLOWED_HEADERS = []string{
+	"Authorization", "Content-Type", REQUEST_ID_HEADER,
+}
+
+// CORS_EXPOSED_HEADERS are the response headers that cross-origin
+// clients are allowed to read.
+var CORS_EXPOSED_HEADERS = []string{REQUEST_ID_HEADER, QUERY_ID_HEADER}
+
+// ParseCORSOptions parses the CORSOptions from manager options,
+// returning nil when no origins are allowed.
+func ParseCORSOptions(options map[string]string) (*CORSOptions, error) {
+	origins := splitCSV(options["corsAllowedOrigins"])
+	if len(origins) <= 0 {
+		return nil, nil
+	}
+
+	rv := &CORSOptions{
+		AllowedOrigins: origins,
+		AllowedMethods: splitCSV(options["corsAllowedMethods"]),
+		AllowedHeaders: splitCSV(options["corsAllowedHeaders"]),
+	}
+	if len(rv.AllowedMethods) <= 0 {
+		rv.AllowedMethods = CORS_DEFAULT_ALLOWED_METHODS
+	}
+	if len(rv.AllowedHeaders) <= 0 {
+		rv.AllowedHeaders = CORS_DEFAULT_ALLOWED_HEADERS
+	}
+
+	if v := options["corsAllowCredentials"]; v != "" {
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("rest_cors: could not parse"+
+				" corsAllowCredentials: %q, err: %v", v, err)
+		}
+		rv.AllowCredentials = x
+	}
+
+	if rv.AllowCredentials {
+		for _, origin := range rv.AllowedOrigins {
+			if origin == "*" {
+				return nil, fmt.Errorf("rest_cors: corsAllowCredentials" +
+					" requires an explicit list of corsAllowedOrigins," +
+					" not \"*\"")
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+func splitCSV(s string) []string {
+	var rv []string
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			rv = append(rv, x)
+		}
+	}
+	return rv
+}
+
+// allowOrigin sets the CORS response headers when the request's
+// origin is allowed, returning false otherwise.
+func (o *CORSOptions) allowOrigin(w http.ResponseWriter,
+	req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	allowed := false
+	wildcard := false
+	for _, x := range o.AllowedOrigins {
+		if x == "*" {
+			allowed, wildcard = true, true
+		} else if x == origin {
+			allowed, wildcard = true, false
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if wildcard {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if o.AllowCredentials && !wildcard {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	return true
+}
+
+// Middleware returns a func that wraps a handler to add the CORS
+// response headers for allowed origins.
+func (o *CORSOptions) Middleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if o.allowOrigin(w, req) {
+				w.Header().Set("Access-Control-Expose-Headers",
+					strings.Join(CORS_EXPOSED_HEADERS, ", "))
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// PreflightHandler returns a handler of the OPTIONS preflight
+// requests that browsers send before cross-origin requests.
+func (o *CORSOptions) PreflightHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if o.allowOrigin(w, req) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Methods",
+				strings.Join(o.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers",
+				strings.Join(o.AllowedHeaders, ", "))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,159 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// GetDocTraceHandler is a REST handler that returns the traced doc
+// IDs of an index on this node and their recorded ingest events.
+type GetDocTraceHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewGetDocTraceHandler(mgr *cbgt.Manager) *GetDocTraceHandler {
+	return &GetDocTraceHandler{mgr: mgr}
+}
+
+func (h *GetDocTraceHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "docTrace":` +
+			` {"indexName": "", "docIDs": [...], "events": [...]}},` +
+			` with the events oldest first`
+}
+
+func (h *GetDocTraceHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+
+	dt := h.mgr.GetDocTrace(indexName)
+	if dt == nil {
+		ShowError(w, req, fmt.Sprintf("rest_doc_trace: no doc trace,"+
+			" indexName: %s", indexName), http.StatusNotFound)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status   string         `json:"status"`
+		DocTrace *cbgt.DocTrace `json:"docTrace"`
+	}{
+		Status:   "ok",
+		DocTrace: dt,
+	})
+}
+
+// ---------------------------------------------------
+
+// PutDocTraceHandler is a REST handler that starts tracing the
+// ingest of some docs of an index on this node.
+type PutDocTraceHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPutDocTraceHandler(mgr *cbgt.Manager) *PutDocTraceHandler {
+	return &PutDocTraceHandler{mgr: mgr}
+}
+
+func (h *PutDocTraceHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index."
+	opts[""] =
+		`The request's PUT body is JSON of {"docIDs": ["doc1", "doc2"]},` +
+			` which replaces any previously traced doc IDs and events of` +
+			` the index.  Doc tracing must be enabled with the` +
+			` "docTracing" manager option.`
+}
+
+func (h *PutDocTraceHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "rest_doc_trace: index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_doc_trace: could not read"+
+			" request body, indexName: %s", indexName), http.StatusBadRequest)
+		return
+	}
+
+	var r struct {
+		DocIDs []string `json:"docIDs"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_doc_trace: could not parse"+
+			" request body, indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	err = h.mgr.SetDocTrace(indexName, r.DocIDs)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_doc_trace:"+
+			" SetDocTrace, indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// DeleteDocTraceHandler is a REST handler that stops tracing the
+// docs of an index on this node.
+type DeleteDocTraceHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDeleteDocTraceHandler(mgr *cbgt.Manager) *DeleteDocTraceHandler {
+	return &DeleteDocTraceHandler{mgr: mgr}
+}
+
+func (h *DeleteDocTraceHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index."
+}
+
+func (h *DeleteDocTraceHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+
+	err := h.mgr.DeleteDocTrace(indexName)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_doc_trace:"+
+			" DeleteDocTrace, indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
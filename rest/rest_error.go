@@ -0,0 +1,145 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/couchbase/clog"
+)
+
+// The codes of a RESTError, which are stable across releases so
+// that clients can handle errors programmatically.
+const (
+	REST_ERROR_CODE_BAD_REQUEST         = "bad_request"
+	REST_ERROR_CODE_FORBIDDEN           = "forbidden"
+	REST_ERROR_CODE_NOT_FOUND           = "not_found"
+	REST_ERROR_CODE_TIMEOUT             = "timeout"
+	REST_ERROR_CODE_CONFLICT            = "conflict"
+	REST_ERROR_CODE_PRECONDITION_FAILED = "precondition_failed"
+	REST_ERROR_CODE_TOO_MANY_REQUESTS   = "too_many_requests"
+	REST_ERROR_CODE_INTERNAL            = "internal"
+	REST_ERROR_CODE_UNAVAILABLE         = "unavailable"
+	REST_ERROR_CODE_CONSISTENCY_WAIT    = "consistency_wait"
+	REST_ERROR_CODE_UNKNOWN             = "unknown"
+)
+
+// REST_ERROR_VERBOSE_PARAM is the request parameter that, when
+// "true", asks for the errorChain of an error response.
+const REST_ERROR_VERBOSE_PARAM = "verboseErrors"
+
+// A RESTError is the JSON body of an error response.
+type RESTError struct {
+	Status     string `json:"status"` // Always "fail".
+	Code       string `json:"code"`   // One of the REST_ERROR_CODE_XXX.
+	HTTPStatus int    `json:"httpStatus"`
+	Message    string `json:"message"`
+	IndexName  string `json:"indexName,omitempty"`
+	PIndexName string `json:"pindexName,omitempty"`
+	RequestID  string `json:"requestID,omitempty"`
+
+	// Retryable is true when the same request might succeed later,
+	// such as after a timeout or when the node is less busy.
+	Retryable bool `json:"retryable"`
+
+	// ErrorChain is the Message split into its wrapped errors,
+	// outermost first, and is only provided to verbose requests.
+	ErrorChain []string `json:"errorChain,omitempty"`
+
+	Details interface{} `json:"details,omitempty"`
+}
+
+var restErrorCodes = map[int]string{
+	http.StatusBadRequest:          REST_ERROR_CODE_BAD_REQUEST,
+	http.StatusUnauthorized:        REST_ERROR_CODE_FORBIDDEN,
+	http.StatusForbidden:           REST_ERROR_CODE_FORBIDDEN,
+	http.StatusNotFound:            REST_ERROR_CODE_NOT_FOUND,
+	http.StatusRequestTimeout:      REST_ERROR_CODE_TIMEOUT,
+	http.StatusConflict:            REST_ERROR_CODE_CONFLICT,
+	http.StatusPreconditionFailed:  REST_ERROR_CODE_PRECONDITION_FAILED,
+	http.StatusTooManyRequests:     REST_ERROR_CODE_TOO_MANY_REQUESTS,
+	http.StatusInternalServerError: REST_ERROR_CODE_INTERNAL,
+	http.StatusServiceUnavailable:  REST_ERROR_CODE_UNAVAILABLE,
+	http.StatusGatewayTimeout:      REST_ERROR_CODE_TIMEOUT,
+}
+
+var restErrorRetryable = map[int]bool{
+	http.StatusRequestTimeout:     true,
+	http.StatusTooManyRequests:    true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// ShowRESTError writes a RESTError as the response, filling in any
+// of its unset fields from the HTTP status code and the request.
+func ShowRESTError(w http.ResponseWriter, req *http.Request,
+	e *RESTError, code int) {
+	if e.RequestID == "" {
+		e.RequestID = RequestIDLookup(req)
+	}
+
+	log.Printf("rest: error code: %d, requestID: %s, msg: %s",
+		code, e.RequestID, e.Message)
+
+	e.Status = "fail"
+	e.HTTPStatus = code
+	if e.Code == "" {
+		e.Code = restErrorCodes[code]
+		if e.Code == "" {
+			if code >= 500 {
+				e.Code = REST_ERROR_CODE_INTERNAL
+			} else {
+				e.Code = REST_ERROR_CODE_UNKNOWN
+			}
+		}
+	}
+	e.Retryable = e.Retryable || restErrorRetryable[code]
+
+	if req != nil {
+		if e.IndexName == "" {
+			e.IndexName = IndexNameLookup(req)
+		}
+		if e.PIndexName == "" {
+			e.PIndexName = PIndexNameLookup(req)
+		}
+		if v, _ := strconv.ParseBool(
+			req.FormValue(REST_ERROR_VERBOSE_PARAM)); v {
+			e.ErrorChain = restErrorChain(e.Message)
+		}
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+}
+
+// restErrorChain splits an error message into its wrapped errors,
+// following the ", err: " convention of the error messages.
+func restErrorChain(msg string) []string {
+	rv := []string(nil)
+	for _, s := range strings.Split(msg, ", err: ") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			rv = append(rv, s)
+		}
+	}
+	return rv
+}
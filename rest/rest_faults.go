@@ -0,0 +1,145 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// ListFaultsHandler is a REST handler that lists the injected faults
+// of this node.
+type ListFaultsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewListFaultsHandler(mgr *cbgt.Manager) *ListFaultsHandler {
+	return &ListFaultsHandler{mgr: mgr}
+}
+
+func (h *ListFaultsHandler) RESTOpts(opts map[string]string) {
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "faults": [...]},` +
+			` sorted by fault name`
+}
+
+func (h *ListFaultsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	MustEncode(w, struct {
+		Status string        `json:"status"`
+		Faults []*cbgt.Fault `json:"faults"`
+	}{
+		Status: "ok",
+		Faults: h.mgr.ListFaults(),
+	})
+}
+
+// ---------------------------------------------------
+
+// PutFaultHandler is a REST handler that adds or replaces an injected
+// fault on this node.
+type PutFaultHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPutFaultHandler(mgr *cbgt.Manager) *PutFaultHandler {
+	return &PutFaultHandler{mgr: mgr}
+}
+
+func (h *PutFaultHandler) RESTOpts(opts map[string]string) {
+	opts["param: faultName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the fault."
+	opts[""] =
+		`The request's PUT body is JSON of {"indexName": "",` +
+			` "partition": "", "latency": "50ms", "dropSnapshotRate": 0.1,` +
+			` "rollbackRate": 0.01, "errRate": 0.05}, where an empty` +
+			` indexName or partition matches all.  Fault injection must` +
+			` be enabled with the "faultInjection" manager option.`
+}
+
+func (h *PutFaultHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := RequestVariableLookup(req, "faultName")
+	if name == "" {
+		ShowError(w, req, "rest_faults: fault name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_faults: could not read"+
+			" request body, name: %s", name), http.StatusBadRequest)
+		return
+	}
+
+	f := &cbgt.Fault{}
+	err = json.Unmarshal(requestBody, f)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_faults: could not parse"+
+			" fault, name: %s, err: %v", name, err), http.StatusBadRequest)
+		return
+	}
+	f.Name = name
+
+	err = h.mgr.SetFault(f)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_faults:"+
+			" SetFault, name: %s, err: %v", name, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// DeleteFaultHandler is a REST handler that removes an injected
+// fault from this node.
+type DeleteFaultHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDeleteFaultHandler(mgr *cbgt.Manager) *DeleteFaultHandler {
+	return &DeleteFaultHandler{mgr: mgr}
+}
+
+func (h *DeleteFaultHandler) RESTOpts(opts map[string]string) {
+	opts["param: faultName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the fault to remove."
+}
+
+func (h *DeleteFaultHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := RequestVariableLookup(req, "faultName")
+
+	err := h.mgr.DeleteFault(name)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_faults:"+
+			" DeleteFault, name: %s, err: %v", name, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -10,11 +10,13 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -26,6 +28,10 @@ import (
 const CLUSTER_ACTION = "Internal-Cluster-Action"
 const FTS_SCATTER_GATHER = "fts-scatter/gather"
 
+// QUERY_ID_HEADER is the response header that has the ID of a query,
+// which can be used to cancel the query (see CancelQueryHandler).
+const QUERY_ID_HEADER = "X-Query-Id"
+
 // ListIndexHandler is a REST handler for list indexes.
 type ListIndexHandler struct {
 	mgr *cbgt.Manager
@@ -43,12 +49,34 @@ func (h *ListIndexHandler) ServeHTTP(
 		return
 	}
 
+	if ns := NamespaceLookup(req); ns != "" {
+		indexDefs = cbgt.FilterIndexDefsByNamespace(indexDefs, ns)
+	}
+
+	// Surface the zone spread warnings of the plan, if any.
+	var warnings map[string][]string
+	planPIndexes, _, err := h.mgr.GetPlanPIndexes(false)
+	if err == nil && planPIndexes != nil && indexDefs != nil {
+		for indexName := range indexDefs.IndexDefs {
+			for _, warning := range planPIndexes.Warnings[indexName] {
+				if strings.HasPrefix(warning, cbgt.ZONE_VIOLATED) {
+					if warnings == nil {
+						warnings = map[string][]string{}
+					}
+					warnings[indexName] = append(warnings[indexName], warning)
+				}
+			}
+		}
+	}
+
 	rv := struct {
-		Status    string          `json:"status"`
-		IndexDefs *cbgt.IndexDefs `json:"indexDefs"`
+		Status    string              `json:"status"`
+		IndexDefs *cbgt.IndexDefs     `json:"indexDefs"`
+		Warnings  map[string][]string `json:"warnings,omitempty"`
 	}{
 		Status:    "ok",
 		IndexDefs: indexDefs,
+		Warnings:  warnings,
 	}
 	MustEncode(w, rv)
 }
@@ -149,6 +177,11 @@ func (h *CountHandler) RESTOpts(opts map[string]string) {
 
 func (h *CountHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	if !beginQuery(h.mgr, w, req) {
+		return
+	}
+	defer h.mgr.EndQuery()
+
 	indexName := IndexNameLookup(req)
 	if indexName == "" {
 		ShowError(w, req, "index name is required", http.StatusBadRequest)
@@ -159,15 +192,18 @@ func (h *CountHandler) ServeHTTP(
 
 	pindexImplType, err :=
 		cbgt.PIndexImplTypeForIndex(h.mgr.Cfg(), indexName)
-	if err != nil || pindexImplType.Count == nil {
+	if err != nil || !pindexImplType.CanCount() {
 		ShowError(w, req, fmt.Sprintf("rest_index: Count,"+
 			" no pindexImplType, indexName: %s, err: %v",
 			indexName, err), http.StatusBadRequest)
 		return
 	}
 
+	ctx, cancel := requestContext(w, req)
+	defer cancel()
+
 	count, err :=
-		pindexImplType.Count(h.mgr, indexName, indexUUID)
+		pindexImplType.CountContext(ctx, h.mgr, indexName, indexUUID)
 	if err != nil {
 		ShowError(w, req, fmt.Sprintf("rest_index: Count,"+
 			" indexName: %s, err: %v",
@@ -187,6 +223,140 @@ func (h *CountHandler) ServeHTTP(
 
 // ---------------------------------------------------
 
+// IndexProgressHandler is a REST handler for retrieving how caught up
+// the pindexes of an index on this node are with the data source.
+type IndexProgressHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIndexProgressHandler(mgr *cbgt.Manager) *IndexProgressHandler {
+	return &IndexProgressHandler{mgr: mgr}
+}
+
+func (h *IndexProgressHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index whose progress is to be retrieved."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "progress": {...}},` +
+			` where the progress has the seqs of the index's pindexes` +
+			` on this node versus the source seqs, the percent` +
+			` complete, whether the index is caught up, and error counts`
+}
+
+func (h *IndexProgressHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	progress, err := h.mgr.IndexProgress(indexName)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: IndexProgress,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status   string              `json:"status"`
+		Progress *cbgt.IndexProgress `json:"progress"`
+	}{
+		Status:   "ok",
+		Progress: progress,
+	})
+}
+
+// ---------------------------------------------------
+
+// PartitionsAdviceHandler is a REST handler that analyzes the sizes
+// of the pindexes of an index on this node and recommends a new
+// maxPartitionsPerPIndex, optionally applying it by re-splitting the
+// index via an updated index definition.
+type PartitionsAdviceHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPartitionsAdviceHandler(mgr *cbgt.Manager) *PartitionsAdviceHandler {
+	return &PartitionsAdviceHandler{mgr: mgr}
+}
+
+func (h *PartitionsAdviceHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index to be analyzed."
+	opts["param: apply"] =
+		"optional, bool, form parameter\n\n" +
+			"When true, and only for a POST, a recommended change is" +
+			" applied by updating the index definition, so that the" +
+			" index is re-split into a new generation of pindexes." +
+			" The previous generation keeps serving queries until" +
+			" the new generation has caught up on every node."
+	opts["param: prevIndexUUID"] =
+		"optional, string, form parameter\n\n" +
+			"When applying, the advice is only applied if the index" +
+			" UUID still matches."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "advice": {...}},` +
+			` where the advice has the measured doc counts and sizes of` +
+			` the index's pindexes on this node, the current and` +
+			` recommended maxPartitionsPerPIndex, and whether a change` +
+			` is recommended`
+}
+
+func (h *PartitionsAdviceHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	var apply bool
+	applyStr := req.FormValue("apply")
+	if applyStr != "" {
+		var err error
+		apply, err = strconv.ParseBool(applyStr)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_index: bad apply param: %q",
+				applyStr), http.StatusBadRequest)
+			return
+		}
+		if apply && req.Method != "POST" {
+			ShowError(w, req, "rest_index: apply requires a POST",
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	var advice *cbgt.PartitionsAdvice
+	var err error
+	if apply {
+		advice, err = h.mgr.ApplyPartitionsAdvice(indexName,
+			req.FormValue("prevIndexUUID"))
+	} else {
+		advice, err = h.mgr.PartitionsAdvice(indexName)
+	}
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: PartitionsAdvice,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                 `json:"status"`
+		Advice *cbgt.PartitionsAdvice `json:"advice"`
+	}{
+		Status: "ok",
+		Advice: advice,
+	})
+}
+
+// ---------------------------------------------------
+
 // QueryHandler is a REST handler for querying an index.
 type QueryHandler struct {
 	mgr *cbgt.Manager
@@ -239,6 +409,11 @@ func (h *QueryHandler) RESTOpts(opts map[string]string) {
 	opts["param: indexName"] =
 		"required, string, URL path parameter\n\n" +
 			"The name of the index to be queried."
+	opts["param: stream"] =
+		"optional, string, form parameter\n\n" +
+			"When \"ndjson\" or \"chunked\", the results are streamed" +
+			" as JSON lines or as a JSON array, for index types" +
+			" that support streaming."
 	opts[""] =
 		"The request's POST body depends on the index type:\n\n" +
 			strings.Join(indexTypes, "\n")
@@ -246,6 +421,11 @@ func (h *QueryHandler) RESTOpts(opts map[string]string) {
 
 func (h *QueryHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	if !beginQuery(h.mgr, w, req) {
+		return
+	}
+	defer h.mgr.EndQuery()
+
 	startTime := time.Now()
 
 	indexName := IndexNameLookup(req)
@@ -265,14 +445,36 @@ func (h *QueryHandler) ServeHTTP(
 	}
 
 	_, pindexImplType, err := h.mgr.GetIndexDef(indexName, false)
-	if err != nil || pindexImplType.Query == nil {
+	if err != nil || !pindexImplType.CanQuery() {
 		ShowError(w, req, fmt.Sprintf("rest_index: Query,"+
 			" no pindexImplType, indexName: %s, err: %v",
 			indexName, err), http.StatusBadRequest)
 		return
 	}
 
-	err = pindexImplType.Query(h.mgr, indexName, indexUUID, requestBody, w)
+	ctx, cancel, ok := queryStreamContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	// Only queries of pindex types with QueryCtx() or QueryEx() are
+	// cancelable, but all queries are listed as active.
+	queryHandle := h.mgr.RegisterQueryCtx(ctx, indexName, req.RemoteAddr)
+	defer h.mgr.UnregisterQuery(queryHandle)
+
+	go func() {
+		select {
+		case <-queryHandle.CancelCh():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	w.Header().Set(QUERY_ID_HEADER, queryHandle.ID)
+
+	err = pindexImplType.QueryContext(ctx, h.mgr, indexName, indexUUID,
+		requestBody, w)
 
 	//update the total client queries statistics.
 	var focusStats *RESTFocusStats
@@ -289,8 +491,8 @@ func (h *QueryHandler) ServeHTTP(
 		d := time.Since(startTime)
 		if d > h.slowQueryLogTimeout {
 			log.Printf("slow-query:"+
-				" index: %s, query: %s, duration: %v, err: %v",
-				indexName, string(requestBody), d, err)
+				" index: %s, requestID: %s, query: %s, duration: %v, err: %v",
+				indexName, queryHandle.RequestID, string(requestBody), d, err)
 			if focusStats != nil {
 				atomic.AddUint64(&focusStats.TotRequestSlow, 1)
 			}
@@ -298,6 +500,8 @@ func (h *QueryHandler) ServeHTTP(
 	}
 
 	if err != nil {
+		h.mgr.AddError(cbgt.MANAGER_ERROR_QUERY, indexName, err.Error())
+
 		if focusStats != nil {
 			atomic.AddUint64(&focusStats.TotRequestErr, 1)
 
@@ -384,6 +588,67 @@ func (h *IndexControlHandler) ServeHTTP(
 
 // ------------------------------------------------------------------
 
+// PIndexIngestControlHandler is a REST handler that places a local
+// pindex into read-only mode, or makes it writable again.
+type PIndexIngestControlHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPIndexIngestControlHandler(
+	mgr *cbgt.Manager) *PIndexIngestControlHandler {
+	return &PIndexIngestControlHandler{mgr: mgr}
+}
+
+func (h *PIndexIngestControlHandler) RESTOpts(opts map[string]string) {
+	opts["param: pindexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index partition whose ingest will be controlled."
+	opts["param: policy"] =
+		"optional, string, form parameter\n\n" +
+			`For the "pause" op, how to handle mutations while` +
+			` paused, either "buffer" (the default), where mutations` +
+			` are ingested later when resumed, or "drop".`
+}
+
+func (h *PIndexIngestControlHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_index: pindex name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	policy := ""
+
+	op := RequestVariableLookup(req, "op")
+	if op == "pause" {
+		policy = req.FormValue("policy")
+		if policy == "" {
+			policy = cbgt.PINDEX_READ_ONLY_BUFFER
+		}
+	} else if op != "resume" {
+		ShowError(w, req, fmt.Sprintf("rest_index: PIndexIngestControl,"+
+			" error: unsupported op: %s", op), http.StatusBadRequest)
+		return
+	}
+
+	err := h.mgr.SetPIndexReadOnly(pindexName, policy)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: PIndexIngestControl,"+
+			" could not op: %s, err: %v", op, err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{
+		Status: "ok",
+	})
+}
+
+// ------------------------------------------------------------------
+
 // ListPIndexHandler is a REST handler for listing pindexes.
 type ListPIndexHandler struct {
 	mgr *cbgt.Manager
@@ -393,16 +658,61 @@ func NewListPIndexHandler(mgr *cbgt.Manager) *ListPIndexHandler {
 	return &ListPIndexHandler{mgr: mgr}
 }
 
+func (h *ListPIndexHandler) RESTOpts(opts map[string]string) {
+	opts["param: summary"] =
+		"optional, boolean, URL query parameter\n\n" +
+			"When true, only a summary of each pindex is returned, with" +
+			" its name, index, source partitions, seq and health."
+	opts["param: stats"] =
+		"optional, string, URL query parameter\n\n" +
+			"In summary mode, a comma separated list of the pindex names" +
+			" whose detailed stats should also be returned."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "pindexes": {...}},` +
+			` keyed by pindex name`
+}
+
 func (h *ListPIndexHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("summary") == "true" {
+		statsPIndexes := map[string]bool{}
+		for _, pindexName := range strings.Split(req.FormValue("stats"), ",") {
+			if pindexName != "" {
+				statsPIndexes[pindexName] = true
+			}
+		}
+
+		MustEncode(w, struct {
+			Status   string                         `json:"status"`
+			PIndexes map[string]*cbgt.PIndexSummary `json:"pindexes"`
+		}{
+			Status:   "ok",
+			PIndexes: h.mgr.PIndexSummaries(statsPIndexes),
+		})
+		return
+	}
+
 	_, pindexes := h.mgr.CurrentMaps()
 
 	rv := struct {
-		Status   string                  `json:"status"`
-		PIndexes map[string]*cbgt.PIndex `json:"pindexes"`
+		Status   string                              `json:"status"`
+		PIndexes map[string]*cbgt.PIndex             `json:"pindexes"`
+		Verify   map[string]*cbgt.PIndexVerifyResult `json:"verify,omitempty"`
+		ReadOnly map[string]string                   `json:"readOnly,omitempty"`
+		Warmup   map[string]*cbgt.PIndexWarmup       `json:"warmup,omitempty"`
+		Builds   *cbgt.PIndexBuilds                  `json:"builds"`
+
+		DiskUsage map[string]uint64 `json:"diskUsage,omitempty"`
+		DiskLow   bool              `json:"diskLow,omitempty"`
 	}{
-		Status:   "ok",
-		PIndexes: pindexes,
+		Status:    "ok",
+		PIndexes:  pindexes,
+		Verify:    h.mgr.PIndexVerifyResults(),
+		ReadOnly:  h.mgr.PIndexesReadOnly(),
+		Warmup:    h.mgr.PIndexWarmups(),
+		Builds:    h.mgr.PIndexBuilds(),
+		DiskUsage: h.mgr.PIndexesDiskUsage(),
+		DiskLow:   h.mgr.DiskLow(),
 	}
 	MustEncode(w, rv)
 }
@@ -457,6 +767,11 @@ func NewCountPIndexHandler(mgr *cbgt.Manager) *CountPIndexHandler {
 
 func (h *CountPIndexHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	if !beginQuery(h.mgr, w, req) {
+		return
+	}
+	defer h.mgr.EndQuery()
+
 	pindexName := PIndexNameLookup(req)
 	if pindexName == "" {
 		ShowError(w, req, "rest_index: pindex name is required", http.StatusBadRequest)
@@ -483,17 +798,10 @@ func (h *CountPIndexHandler) ServeHTTP(
 		return
 	}
 
-	var cancelCh <-chan bool
+	ctx, cancel := requestContext(w, req)
+	defer cancel()
 
-	cn, ok := w.(http.CloseNotifier)
-	if ok && cn != nil {
-		cnc := cn.CloseNotify()
-		if cnc != nil {
-			cancelCh = cnc
-		}
-	}
-
-	count, err := pindex.Dest.Count(pindex, cancelCh)
+	count, err := cbgt.DestCountContext(ctx, pindex.Dest, pindex)
 	if err != nil {
 		ShowError(w, req, fmt.Sprintf("rest_index: CountPIndex,"+
 			" pindexName: %s, req: %#v, err: %v",
@@ -524,6 +832,11 @@ func NewQueryPIndexHandler(mgr *cbgt.Manager) *QueryPIndexHandler {
 
 func (h *QueryPIndexHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	if !beginQuery(h.mgr, w, req) {
+		return
+	}
+	defer h.mgr.EndQuery()
+
 	pindexName := PIndexNameLookup(req)
 	if pindexName == "" {
 		ShowError(w, req, "rest_index: pindex name is required", http.StatusBadRequest)
@@ -558,17 +871,13 @@ func (h *QueryPIndexHandler) ServeHTTP(
 		return
 	}
 
-	var cancelCh <-chan bool
-
-	cn, ok := w.(http.CloseNotifier)
-	if ok && cn != nil {
-		cnc := cn.CloseNotify()
-		if cnc != nil {
-			cancelCh = cnc
-		}
+	ctx, cancel, ok := queryStreamContext(w, req)
+	if !ok {
+		return
 	}
+	defer cancel()
 
-	err = pindex.Dest.Query(pindex, requestBody, w, cancelCh)
+	err = cbgt.DestQueryContext(ctx, pindex.Dest, pindex, requestBody, w)
 	if err != nil {
 		if showConsistencyError(err, "QueryPIndex", pindexName, requestBody, w, req) {
 			return
@@ -581,25 +890,111 @@ func (h *QueryPIndexHandler) ServeHTTP(
 	}
 }
 
+// ---------------------------------------------------
+
+// QueryPIndexesHandler is a REST handler for querying several pindexes
+// of an index on this node with a single request, such as for the
+// remote pindexes of a scatter-gather that are on this node.
+type QueryPIndexesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewQueryPIndexesHandler(mgr *cbgt.Manager) *QueryPIndexesHandler {
+	return &QueryPIndexesHandler{mgr: mgr}
+}
+
+func (h *QueryPIndexesHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index whose pindexes are to be queried."
+	opts[""] =
+		`The request's POST body is JSON of` +
+			` {"pindexNames": [...], "query": {...}}, where the query` +
+			` is sent to each of the pindexes on this node.`
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok",` +
+			` "results": {...}, "errors": {...}}, keyed by pindex name`
+}
+
+func (h *QueryPIndexesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	if !beginQuery(h.mgr, w, req) {
+		return
+	}
+	defer h.mgr.EndQuery()
+
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: QueryPIndexes,"+
+			" could not read request body, indexName: %s",
+			indexName), http.StatusBadRequest)
+		return
+	}
+
+	var r struct {
+		PIndexNames []string        `json:"pindexNames"`
+		Query       json.RawMessage `json:"query"`
+	}
+	err = json.Unmarshal(requestBody, &r)
+	if err != nil || len(r.PIndexNames) <= 0 {
+		ShowError(w, req, fmt.Sprintf("rest_index: QueryPIndexes,"+
+			" pindexNames and query are required, indexName: %s, err: %v",
+			indexName, err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := requestContext(w, req)
+	defer cancel()
+
+	results, err := h.mgr.QueryPIndexes(ctx, indexName,
+		r.PIndexNames, r.Query)
+	if err != nil {
+		if showConsistencyError(err, "QueryPIndexes", indexName,
+			requestBody, w, req) {
+			return
+		}
+
+		ShowError(w, req, fmt.Sprintf("rest_index: QueryPIndexes,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+		*cbgt.QueryPIndexesResults
+	}{
+		Status:               "ok",
+		QueryPIndexesResults: results,
+	})
+}
+
 func showConsistencyError(err error, methodName, itemName string,
 	requestBody []byte, w http.ResponseWriter, req *http.Request) bool {
 	if errCW, ok := err.(*cbgt.ErrorConsistencyWait); ok {
-		rv := struct {
-			Status       string              `json:"status"`
-			Message      string              `json:"message"`
-			StartEndSeqs map[string][]uint64 `json:"startEndSeqs"`
-		}{
-			Status: errCW.Status,
+		ShowRESTError(w, req, &RESTError{
+			Code: REST_ERROR_CODE_CONSISTENCY_WAIT,
 			Message: fmt.Sprintf("rest_index: %s,"+
 				" name: %s, requestBody: %s, req: %#v, err: %v",
 				methodName, itemName, requestBody, req, err),
-			StartEndSeqs: errCW.StartEndSeqs,
-		}
-		buf, err := json.Marshal(rv)
-		if err == nil && buf != nil {
-			ShowError(w, req, string(buf), http.StatusPreconditionFailed)
-			return true
-		}
+			Retryable: errCW.Status == "timeout",
+			Details: struct {
+				Status       string                          `json:"status"`
+				StartEndSeqs map[string][]uint64             `json:"startEndSeqs"`
+				Lagging      map[string]*cbgt.ConsistencyLag `json:"lagging,omitempty"`
+			}{
+				Status:       errCW.Status,
+				StartEndSeqs: errCW.StartEndSeqs,
+				Lagging:      errCW.Lagging,
+			},
+		}, http.StatusPreconditionFailed)
+		return true
 	}
 	return false
 }
@@ -700,3 +1095,128 @@ func (h *PIndexLookUpHandler) ServeHTTP(
 	}
 	MustEncode(w, rv)
 }
+
+// ---------------------------------------------------
+
+// DocLookUpHandler is a REST handler for looking up the pindex that
+// owns a document and what that pindex stores for the document.
+type DocLookUpHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDocLookUpHandler(mgr *cbgt.Manager) *DocLookUpHandler {
+	return &DocLookUpHandler{mgr: mgr}
+}
+
+func (h *DocLookUpHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index."
+	opts["param: docID"] =
+		"required, string, URL path parameter\n\n" +
+			"The ID of the document."
+	opts[""] =
+		`Locates the index partition (pindex) that owns the document,` +
+			` via the source's partition mapping, and when that pindex is` +
+			` on this node, returns what the pindex stores for the` +
+			` document, if its index type supports that.`
+}
+
+func (h *DocLookUpHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	docID := RequestVariableLookup(req, "docID")
+	if docID == "" {
+		ShowError(w, req, "document id (docID) is missing",
+			http.StatusBadRequest)
+		return
+	}
+
+	rv, err := h.mgr.LookUpDoc(indexName, docID, req)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: LookUpDoc,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+		*cbgt.DocLookUpResult
+	}{
+		Status:          "ok",
+		DocLookUpResult: rv,
+	})
+}
+
+// ------------------------------------------------------------------
+
+// beginQuery tracks an in-flight query on the manager, and responds
+// with a 503 error and returns false if the node is shutting down.
+func beginQuery(mgr *cbgt.Manager, w http.ResponseWriter,
+	req *http.Request) bool {
+	if !mgr.BeginQuery() {
+		ShowError(w, req, "rest_index: node is shutting down",
+			http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// requestContext returns a ctx for a request that carries the
+// request ID and that's cancelled when the client disconnects, and
+// the returned cancel func must be invoked when the request is done.
+func requestContext(w http.ResponseWriter,
+	req *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(
+		cbgt.WithRequestID(req.Context(), RequestIDLookup(req)))
+
+	cn, ok := w.(http.CloseNotifier)
+	if ok && cn != nil {
+		cnc := cn.CloseNotify()
+		if cnc != nil {
+			go func() {
+				select {
+				case <-cnc:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+
+	return ctx, cancel
+}
+
+// queryStreamContext returns a requestContext() that carries the
+// query streaming mode of the optional "stream" request parameter,
+// setting the response content type for the mode.  Only pindex types
+// that support streaming honor the mode (see cbgt.QueryStreamMode()).
+// It responds with an error and returns false for an unknown mode.
+func queryStreamContext(w http.ResponseWriter, req *http.Request) (
+	context.Context, context.CancelFunc, bool) {
+	mode := req.FormValue("stream")
+	if !cbgt.ValidQueryStreamMode(mode) {
+		ShowError(w, req, fmt.Sprintf("rest_index: unknown stream mode: %s",
+			mode), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	ctx, cancel := requestContext(w, req)
+	if mode == "" {
+		return ctx, cancel, true
+	}
+
+	if mode == cbgt.QUERY_STREAM_NDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	return cbgt.WithQueryStreamMode(ctx, mode), cancel, true
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// IngestPIndexHandler is a REST handler that accepts a batch of
+// mutations for a local pindex whose data source is a "push" feed.
+type IngestPIndexHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewIngestPIndexHandler(mgr *cbgt.Manager) *IngestPIndexHandler {
+	return &IngestPIndexHandler{mgr: mgr}
+}
+
+func (h *IngestPIndexHandler) RESTOpts(opts map[string]string) {
+	opts["param: mutations"] =
+		"required, array, JSON request body field" +
+			"\n\nThe mutations, where each mutation has a" +
+			` "key", a JSON "val", an optional "seq",` +
+			` an optional "partition" and an optional "delete" flag.`
+}
+
+func (h *IngestPIndexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_ingest: pindex name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_ingest: could not read"+
+			" request body, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var batch struct {
+		Mutations []cbgt.PushMutation `json:"mutations"`
+	}
+	err = json.Unmarshal(requestBody, &batch)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_ingest: could not parse"+
+			" request body, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := requestContext(w, req)
+	defer cancel()
+
+	result, err := h.mgr.PushIngestCtx(ctx, pindexName, batch.Mutations)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_ingest: PushIngest,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                 `json:"status"`
+		Result *cbgt.PushIngestResult `json:"result"`
+	}{
+		Status: "ok",
+		Result: result,
+	})
+}
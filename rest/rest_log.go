@@ -13,6 +13,7 @@ package rest
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/couchbase/cbgt"
@@ -63,3 +64,44 @@ func (h *LogGetHandler) ServeHTTP(
 	}
 	w.Write([]byte(`]}`))
 }
+
+// ---------------------------------------------------
+
+// LogLevelHandler is a REST handler that changes the log level of a
+// subsystem at runtime.
+type LogLevelHandler struct{}
+
+func NewLogLevelHandler() *LogLevelHandler {
+	return &LogLevelHandler{}
+}
+
+func (h *LogLevelHandler) RESTOpts(opts map[string]string) {
+	opts["param: subsystem"] =
+		"required, string, form parameter\n\n" +
+			"One of planner, janitor, feed, pindex or rest."
+	opts["param: level"] =
+		"required, string, form parameter\n\n" +
+			"One of error, warn, info or debug."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "logLevels": {...}},` +
+			` with the log levels of all the subsystems`
+}
+
+func (h *LogLevelHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	err := cbgt.SetLogLevel(req.FormValue("subsystem"),
+		req.FormValue("level"))
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_log: could not set"+
+			" log level, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status    string            `json:"status"`
+		LogLevels map[string]string `json:"logLevels"`
+	}{
+		Status:    "ok",
+		LogLevels: cbgt.LogLevels(),
+	})
+}
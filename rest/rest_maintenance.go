@@ -0,0 +1,204 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// ListMaintenanceSchedulesHandler is a REST handler that lists the
+// maintenance schedules of the cluster.
+type ListMaintenanceSchedulesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewListMaintenanceSchedulesHandler(
+	mgr *cbgt.Manager) *ListMaintenanceSchedulesHandler {
+	return &ListMaintenanceSchedulesHandler{mgr: mgr}
+}
+
+func (h *ListMaintenanceSchedulesHandler) RESTOpts(opts map[string]string) {
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "schedules": [...]},` +
+			` sorted by schedule name`
+}
+
+func (h *ListMaintenanceSchedulesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	schedules, err := h.mgr.ListMaintenanceSchedules()
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance:"+
+			" ListMaintenanceSchedules, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status    string                      `json:"status"`
+		Schedules []*cbgt.MaintenanceSchedule `json:"schedules"`
+	}{
+		Status:    "ok",
+		Schedules: schedules,
+	})
+}
+
+// ---------------------------------------------------
+
+// PutMaintenanceScheduleHandler is a REST handler that adds or
+// replaces a maintenance schedule.
+type PutMaintenanceScheduleHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPutMaintenanceScheduleHandler(
+	mgr *cbgt.Manager) *PutMaintenanceScheduleHandler {
+	return &PutMaintenanceScheduleHandler{mgr: mgr}
+}
+
+func (h *PutMaintenanceScheduleHandler) RESTOpts(opts map[string]string) {
+	opts["param: scheduleName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the maintenance schedule."
+	opts[""] =
+		`The request's PUT body is JSON of {"op": "verify",` +
+			` "indexName": "", "params": {...}, "days": [0, 6],` +
+			` "start": "02:30", "duration": "2h"}, where start is a` +
+			` time of day in UTC, and days are days of the week,` +
+			` where 0 is Sunday, or every day when empty.`
+}
+
+func (h *PutMaintenanceScheduleHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := RequestVariableLookup(req, "scheduleName")
+	if name == "" {
+		ShowError(w, req, "rest_maintenance: schedule name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance: could not read"+
+			" request body, name: %s", name), http.StatusBadRequest)
+		return
+	}
+
+	s := &cbgt.MaintenanceSchedule{}
+	err = json.Unmarshal(requestBody, s)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance: could not parse"+
+			" schedule, name: %s, err: %v", name, err), http.StatusBadRequest)
+		return
+	}
+	s.Name = name
+	s.LastRuns = nil
+	s.LastErrs = nil
+
+	err = h.mgr.SetMaintenanceSchedule(s)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance:"+
+			" SetMaintenanceSchedule, name: %s, err: %v", name, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// DeleteMaintenanceScheduleHandler is a REST handler that removes a
+// maintenance schedule.
+type DeleteMaintenanceScheduleHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDeleteMaintenanceScheduleHandler(
+	mgr *cbgt.Manager) *DeleteMaintenanceScheduleHandler {
+	return &DeleteMaintenanceScheduleHandler{mgr: mgr}
+}
+
+func (h *DeleteMaintenanceScheduleHandler) RESTOpts(opts map[string]string) {
+	opts["param: scheduleName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the maintenance schedule to remove."
+}
+
+func (h *DeleteMaintenanceScheduleHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := RequestVariableLookup(req, "scheduleName")
+	if name == "" {
+		ShowError(w, req, "rest_maintenance: schedule name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	err := h.mgr.DeleteMaintenanceSchedule(name)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance:"+
+			" DeleteMaintenanceSchedule, name: %s, err: %v", name, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// RunMaintenanceNowHandler is a REST handler that runs a maintenance
+// schedule's op on this node right away, regardless of its window.
+type RunMaintenanceNowHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRunMaintenanceNowHandler(
+	mgr *cbgt.Manager) *RunMaintenanceNowHandler {
+	return &RunMaintenanceNowHandler{mgr: mgr}
+}
+
+func (h *RunMaintenanceNowHandler) RESTOpts(opts map[string]string) {
+	opts["param: scheduleName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the maintenance schedule to run."
+}
+
+func (h *RunMaintenanceNowHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	name := RequestVariableLookup(req, "scheduleName")
+	if name == "" {
+		ShowError(w, req, "rest_maintenance: schedule name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	err := h.mgr.RunMaintenanceNow(name)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_maintenance:"+
+			" RunMaintenanceNow, name: %s, err: %v", name, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
@@ -13,40 +13,141 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"sort"
-
-	"github.com/gorilla/mux"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/couchbase/cbgt"
 )
 
 // ---------------------------------------------------
 
+// StatsCacheTTL is the default for the statsCacheTTL manager option,
+// which is how long a StatsHandler reuses an encoded stats snapshot,
+// so that monitoring systems that poll frequently don't re-encode
+// the same stats; like "1s", and "0" disables the cache.
+var StatsCacheTTL = time.Second
+
 // StatsHandler is a REST handler that provides stats/metrics for a
-// node.
+// node.  Responses have an ETag, and a request whose If-None-Match
+// matches the current stats snapshot gets a 304 Not Modified.
 type StatsHandler struct {
-	mgr *cbgt.Manager
+	mgr      *cbgt.Manager
+	cacheTTL time.Duration
+
+	m     sync.Mutex
+	cache map[string]*statsSnapshot // Keyed by indexName.
+}
+
+// A statsSnapshot is an encoded stats response.
+type statsSnapshot struct {
+	json    []byte
+	etag    string
+	expires time.Time
 }
 
 func NewStatsHandler(mgr *cbgt.Manager) *StatsHandler {
-	return &StatsHandler{mgr: mgr}
+	cacheTTL := StatsCacheTTL
+	cacheTTLV := mgr.Options()["statsCacheTTL"]
+	if cacheTTLV != "" {
+		d, err := time.ParseDuration(cacheTTLV)
+		if err == nil {
+			cacheTTL = d
+		}
+	}
+
+	return &StatsHandler{
+		mgr:      mgr,
+		cacheTTL: cacheTTL,
+		cache:    map[string]*statsSnapshot{},
+	}
 }
 
 var statsFeedsPrefix = []byte("\"feeds\":{")
 var statsPIndexesPrefix = []byte("\"pindexes\":{")
+var statsConsistencyWaitPrefix = []byte(",\"consistencyWait\":{")
+var statsDiskUsagePrefix = []byte(",\"diskUsage\":{")
 var statsManagerPrefix = []byte(",\"manager\":")
+var statsRatesPrefix = []byte(",\"rates\":")
+var statsErrorsPrefix = []byte(",\"errors\":")
+var statsMemoryPrefix = []byte(",\"memory\":")
 var statsNamePrefix = []byte("\"")
 var statsNameSuffix = []byte("\":")
 
 func (h *StatsHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
-	err := WriteManagerStatsJSON(h.mgr, w, mux.Vars(req)["indexName"])
+	snapshot, err := h.snapshot(IndexNameLookup(req))
 	if err != nil {
 		ShowError(w, req, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("ETag", snapshot.etag)
+
+	if etagMatches(req.Header.Get("If-None-Match"), snapshot.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
+
+	w.Write(snapshot.json)
+}
+
+// snapshot returns the cached stats snapshot for an indexName, or
+// encodes a new snapshot if the cached snapshot has expired.
+func (h *StatsHandler) snapshot(indexName string) (*statsSnapshot, error) {
+	now := time.Now()
+
+	h.m.Lock()
+	snapshot := h.cache[indexName]
+	h.m.Unlock()
+
+	if snapshot != nil && now.Before(snapshot.expires) {
+		return snapshot, nil
+	}
+
+	var buf bytes.Buffer
+	err := WriteManagerStatsJSON(h.mgr, &buf, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot = &statsSnapshot{
+		json: buf.Bytes(),
+		etag: fmt.Sprintf(`"%08x-%x"`,
+			crc32.ChecksumIEEE(buf.Bytes()), buf.Len()),
+		expires: now.Add(h.cacheTTL),
+	}
+
+	if h.cacheTTL > 0 {
+		h.m.Lock()
+		for k, v := range h.cache {
+			if !now.Before(v.expires) {
+				delete(h.cache, k)
+			}
+		}
+		h.cache[indexName] = snapshot
+		h.m.Unlock()
+	}
+
+	return snapshot, nil
+}
+
+// etagMatches returns true when an If-None-Match header value, which
+// may be a list of possibly weak ETags, matches an etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // WriteManagerStatsJSON writes JSON stats for a manager, and is
@@ -120,6 +221,42 @@ func WriteManagerStatsJSON(mgr *cbgt.Manager, w io.Writer,
 	}
 	w.Write(cbgt.JsonCloseBrace)
 
+	first = true
+	w.Write(statsConsistencyWaitPrefix)
+	for _, pindexName := range pindexNames {
+		if indexName == "" || indexName == pindexes[pindexName].IndexName {
+			if !first {
+				w.Write(cbgt.JsonComma)
+			}
+			first = false
+			w.Write(statsNamePrefix)
+			w.Write([]byte(pindexName))
+			w.Write(statsNameSuffix)
+			pindexes[pindexName].ConsistencyWaitStats().WriteJSON(w)
+		}
+	}
+	w.Write(cbgt.JsonCloseBrace)
+
+	diskUsage := mgr.PIndexesDiskUsage()
+
+	first = true
+	w.Write(statsDiskUsagePrefix)
+	for _, pindexName := range pindexNames {
+		size, exists := diskUsage[pindexName]
+		if exists &&
+			(indexName == "" || indexName == pindexes[pindexName].IndexName) {
+			if !first {
+				w.Write(cbgt.JsonComma)
+			}
+			first = false
+			w.Write(statsNamePrefix)
+			w.Write([]byte(pindexName))
+			w.Write(statsNameSuffix)
+			w.Write([]byte(strconv.FormatUint(size, 10)))
+		}
+	}
+	w.Write(cbgt.JsonCloseBrace)
+
 	if indexName == "" {
 		w.Write(statsManagerPrefix)
 		var mgrStats cbgt.ManagerStats
@@ -130,6 +267,25 @@ func WriteManagerStatsJSON(mgr *cbgt.Manager, w io.Writer,
 		} else {
 			w.Write(cbgt.JsonNULL)
 		}
+
+		w.Write(statsRatesPrefix)
+		mgr.Timers().WriteJSON(w)
+
+		w.Write(statsErrorsPrefix)
+		errorsJSON, err := json.Marshal(mgr.Errors())
+		if err == nil && len(errorsJSON) > 0 {
+			w.Write(errorsJSON)
+		} else {
+			w.Write(cbgt.JsonNULL)
+		}
+
+		w.Write(statsMemoryPrefix)
+		memoryJSON, err := json.Marshal(mgr.MemoryUsage())
+		if err == nil && len(memoryJSON) > 0 {
+			w.Write(memoryJSON)
+		} else {
+			w.Write(cbgt.JsonNULL)
+		}
 	}
 
 	w.Write(cbgt.JsonCloseBrace)
@@ -149,8 +305,46 @@ func NewManagerKickHandler(mgr *cbgt.Manager) *ManagerKickHandler {
 	return &ManagerKickHandler{mgr: mgr}
 }
 
+func (h *ManagerKickHandler) RESTOpts(opts map[string]string) {
+	opts["param: dryRun"] =
+		"optional, bool, form parameter" +
+			"\n\nWhen true, the node is not kicked, and the response" +
+			" instead has the actions that the janitor would take" +
+			" on this node (see GET /api/janitor/plan)."
+}
+
 func (h *ManagerKickHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
+	dryRunStr := req.FormValue("dryRun")
+	if dryRunStr != "" {
+		dryRun, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_manage: bad dryRun param: %q",
+				dryRunStr), http.StatusBadRequest)
+			return
+		}
+
+		if dryRun {
+			janitorPlan, err := h.mgr.JanitorPlan()
+			if err != nil {
+				ShowError(w, req, fmt.Sprintf("rest_manage: JanitorPlan,"+
+					" err: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			MustEncode(w, struct {
+				Status      string            `json:"status"`
+				DryRun      bool              `json:"dryRun"`
+				JanitorPlan *cbgt.JanitorPlan `json:"janitorPlan"`
+			}{
+				Status:      "ok",
+				DryRun:      true,
+				JanitorPlan: janitorPlan,
+			})
+			return
+		}
+	}
+
 	h.mgr.Kick(req.FormValue("msg"))
 	MustEncode(w, struct {
 		Status string `json:"status"`
@@ -159,6 +353,86 @@ func (h *ManagerKickHandler) ServeHTTP(
 
 // ---------------------------------------------------
 
+// JanitorPlanHandler is a REST handler that returns the actions that
+// the janitor currently intends to take on this node.
+type JanitorPlanHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewJanitorPlanHandler(mgr *cbgt.Manager) *JanitorPlanHandler {
+	return &JanitorPlanHandler{mgr: mgr}
+}
+
+func (h *JanitorPlanHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	janitorPlan, err := h.mgr.JanitorPlan()
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_manage: JanitorPlan,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status      string            `json:"status"`
+		JanitorPlan *cbgt.JanitorPlan `json:"janitorPlan"`
+	}{
+		Status:      "ok",
+		JanitorPlan: janitorPlan,
+	})
+}
+
+// ---------------------------------------------------
+
+// OrphanSweepHandler is a REST handler that sweeps the orphaned
+// pindex directories of this node.
+type OrphanSweepHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewOrphanSweepHandler(mgr *cbgt.Manager) *OrphanSweepHandler {
+	return &OrphanSweepHandler{mgr: mgr}
+}
+
+func (h *OrphanSweepHandler) RESTOpts(opts map[string]string) {
+	opts["param: dryRun"] =
+		"optional, bool, form parameter" +
+			"\n\nWhen true, nothing is moved or deleted, and the response" +
+			" has the orphans that would be quarantined or deleted."
+}
+
+func (h *OrphanSweepHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	dryRun := false
+
+	dryRunStr := req.FormValue("dryRun")
+	if dryRunStr != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_manage: bad dryRun param: %q",
+				dryRunStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.mgr.SweepOrphans(dryRun, time.Now())
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_manage: SweepOrphans,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                  `json:"status"`
+		Result *cbgt.OrphanSweepResult `json:"result"`
+	}{
+		Status: "ok",
+		Result: result,
+	})
+}
+
+// ---------------------------------------------------
+
 type RESTCfg struct {
 	Status            string             `json:"status"`
 	IndexDefs         *cbgt.IndexDefs    `json:"indexDefs"`
@@ -290,11 +564,13 @@ func (h *ManagerOptions) ServeHTTP(
 	if err != nil {
 		msg := fmt.Sprintf("rest_manage:"+
 			" could not read request body err: %v", err)
-		http.Error(w, msg, 400)
+		ShowError(w, req, msg, 400)
 		return
 	}
 
-	opt := h.mgr.Options()
+	// Starts from the node's own options, as the runtime options stay
+	// overlaid by the manager.
+	opt := h.mgr.BaseOptions()
 	newOptions := map[string]string{}
 	for k, v := range opt {
 		newOptions[k] = v
@@ -303,7 +579,7 @@ func (h *ManagerOptions) ServeHTTP(
 	if err != nil {
 		msg := fmt.Sprintf("rest_manage:"+
 			" error in unmarshalling err: %v", err)
-		http.Error(w, msg, 400)
+		ShowError(w, req, msg, 400)
 		return
 	}
 
@@ -312,3 +588,72 @@ func (h *ManagerOptions) ServeHTTP(
 		Status string `json:"status"`
 	}{Status: "ok"})
 }
+
+// ---------------------------------------------------
+
+// RuntimeOptionsHandler is a REST handler that changes the runtime
+// manager options of the cluster (see cbgt.RuntimeOptionValidators),
+// which are persisted in the Cfg and applied by every node.
+type RuntimeOptionsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewRuntimeOptionsHandler(mgr *cbgt.Manager) *RuntimeOptionsHandler {
+	return &RuntimeOptionsHandler{mgr: mgr}
+}
+
+func (h *RuntimeOptionsHandler) RESTOpts(opts map[string]string) {
+	names := make([]string, 0, len(cbgt.RuntimeOptionValidators))
+	for name := range cbgt.RuntimeOptionValidators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	opts[""] =
+		`The request's POST body is a JSON object of the options to` +
+			` change, like {"memoryQuota": "1000000"}, of: ` +
+			strings.Join(names, ", ") + `; an empty value removes an` +
+			` option, so that nodes revert to their own value of it.`
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok",` +
+			` "options": {...}}, with all the runtime options`
+}
+
+func (h *RuntimeOptionsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_manage:"+
+			" could not read request body, err: %v", err), 400)
+		return
+	}
+
+	var options map[string]string
+	err = json.Unmarshal(requestBody, &options)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_manage:"+
+			" could not parse options, err: %v", err), 400)
+		return
+	}
+
+	err = cbgt.ValidateRuntimeOptions(options)
+	if err != nil {
+		ShowError(w, req, err.Error(), 400)
+		return
+	}
+
+	merged, err := h.mgr.SetRuntimeOptions(options)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_manage:"+
+			" could not set options, err: %v", err), 500)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status  string            `json:"status"`
+		Options map[string]string `json:"options"`
+	}{
+		Status:  "ok",
+		Options: merged,
+	})
+}
@@ -33,6 +33,9 @@ type MetaDesc struct {
 	Description     string            `json:"description"`
 	StartSample     interface{}       `json:"startSample"`
 	StartSampleDocs map[string]string `json:"startSampleDocs"`
+
+	// A JSON Schema of the params, derived from the StartSample.
+	StartSampleSchema map[string]interface{} `json:"startSampleSchema"`
 }
 
 // MetaDescSource represents the source-type/feed-type parts of the
@@ -50,6 +53,9 @@ type MetaDescIndex struct {
 	QuerySamples interface{} `json:"querySamples"`
 	QueryHelp    string      `json:"queryHelp"`
 
+	// A JSON Schema of query requests, derived from the QuerySamples.
+	QuerySchema map[string]interface{} `json:"querySchema,omitempty"`
+
 	UI map[string]string `json:"ui"`
 }
 
@@ -63,6 +69,11 @@ func (h *ManagerMetaHandler) ServeHTTP(
 		},
 	}
 
+	startSchemas := map[string]interface{}{}
+	for k, startSample := range startSamples {
+		startSchemas[k] = cbgt.JSONSchema(startSample, nil)
+	}
+
 	// Key is sourceType, value is description.
 	sourceTypes := map[string]*MetaDescSource{}
 	for sourceType, f := range cbgt.FeedTypes {
@@ -71,6 +82,8 @@ func (h *ManagerMetaHandler) ServeHTTP(
 				Description:     f.Description,
 				StartSample:     f.StartSample,
 				StartSampleDocs: f.StartSampleDocs,
+				StartSampleSchema: cbgt.JSONSchema(f.StartSample,
+					f.StartSampleDocs),
 			}
 		}
 	}
@@ -80,8 +93,9 @@ func (h *ManagerMetaHandler) ServeHTTP(
 	for indexType, t := range cbgt.PIndexImplTypes {
 		mdi := &MetaDescIndex{
 			MetaDesc: MetaDesc{
-				Description: t.Description,
-				StartSample: t.StartSample,
+				Description:       t.Description,
+				StartSample:       t.StartSample,
+				StartSampleSchema: cbgt.JSONSchema(t.StartSample, nil),
 			},
 			CanCount:  t.Count != nil,
 			CanQuery:  t.Query != nil,
@@ -90,7 +104,11 @@ func (h *ManagerMetaHandler) ServeHTTP(
 		}
 
 		if t.QuerySamples != nil {
-			mdi.QuerySamples = t.QuerySamples()
+			querySamples := t.QuerySamples()
+			mdi.QuerySamples = querySamples
+			mdi.QuerySchema = cbgt.QuerySchema(querySamples)
+		} else if mdi.CanQuery {
+			mdi.QuerySchema = cbgt.QuerySchema(nil)
 		}
 
 		indexTypes[indexType] = mdi
@@ -99,6 +117,7 @@ func (h *ManagerMetaHandler) ServeHTTP(
 	r := map[string]interface{}{
 		"status":       "ok",
 		"startSamples": startSamples,
+		"startSchemas": startSchemas,
 		"sourceTypes":  sourceTypes,
 		"indexNameRE":  cbgt.INDEX_NAME_REGEXP,
 		"indexTypes":   indexTypes,
@@ -0,0 +1,306 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// NodeUUIDLookup returns the nodeUUID param from an http.Request.
+func NodeUUIDLookup(req *http.Request) string {
+	return RequestVariableLookup(req, "nodeUUID")
+}
+
+// ---------------------------------------------------
+
+// AddNodeHandler is a REST handler for adding a node to the cluster.
+type AddNodeHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewAddNodeHandler(mgr *cbgt.Manager) *AddNodeHandler {
+	return &AddNodeHandler{mgr: mgr}
+}
+
+func (h *AddNodeHandler) RESTOpts(opts map[string]string) {
+	opts["param: nodeUUID"] =
+		"required, string, URL path parameter\n\n" +
+			"The uuid of the node to add."
+	opts["param: hostPort"] =
+		"required, string, JSON body field\n\n" +
+			"The REST bind address of the node, like \"10.1.1.10:8095\"."
+}
+
+func (h *AddNodeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	nodeUUID := NodeUUIDLookup(req)
+	if nodeUUID == "" {
+		ShowError(w, req, "node uuid is required", http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_node: AddNode,"+
+			" could not read request body, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	nodeDef := &cbgt.NodeDef{}
+	if len(requestBody) > 0 {
+		err = json.Unmarshal(requestBody, nodeDef)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_node: AddNode,"+
+				" could not parse nodeDef, err: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	nodeDef.UUID = nodeUUID
+
+	err = h.mgr.AddNode(nodeDef)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_node: AddNode,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// ClusterJoinHandler is a REST handler that lets a new node bootstrap
+// off of this node, by returning the connection info of the Cfg
+// provider of the cluster, from the "cfgConnect" manager option.  The
+// new node then connects to the Cfg and registers itself as usual.
+// As the connection info may have credentials, the handler is only
+// enabled when the REST API has an auth handler, and passwords are
+// removed from the connection info unless the
+// "clusterJoinShareCredentials" manager option is "true".
+type ClusterJoinHandler struct {
+	mgr *cbgt.Manager
+
+	authenticated bool // True when requests pass through REST auth.
+}
+
+func NewClusterJoinHandler(mgr *cbgt.Manager) *ClusterJoinHandler {
+	return &ClusterJoinHandler{mgr: mgr}
+}
+
+func (h *ClusterJoinHandler) RESTOpts(opts map[string]string) {
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "cfgConnect": "...",` +
+			` "credentialsRemoved": true|false, "version": "..."},` +
+			` where a password in cfgConnect is removed, unless the` +
+			` clusterJoinShareCredentials manager option is "true";` +
+			` requires REST auth`
+}
+
+func (h *ClusterJoinHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	if !h.authenticated {
+		ShowError(w, req, "rest_node: ClusterJoin,"+
+			" requires REST auth to be configured", http.StatusForbidden)
+		return
+	}
+
+	options := h.mgr.Options()
+
+	cfgConnect := options["cfgConnect"]
+	if cfgConnect == "" || cfgConnect == "simple" ||
+		strings.HasPrefix(cfgConnect, "join:") {
+		ShowError(w, req, fmt.Sprintf("rest_node: ClusterJoin,"+
+			" this node's cfg can't be shared, cfgConnect: %q", cfgConnect),
+			http.StatusBadRequest)
+		return
+	}
+
+	var credentialsRemoved bool
+	if options["clusterJoinShareCredentials"] != "true" {
+		cfgConnect, credentialsRemoved = removeCfgConnectPassword(cfgConnect)
+	}
+
+	MustEncode(w, struct {
+		Status             string `json:"status"`
+		CfgConnect         string `json:"cfgConnect"`
+		CredentialsRemoved bool   `json:"credentialsRemoved"`
+		Version            string `json:"version"`
+	}{
+		Status:             "ok",
+		CfgConnect:         cfgConnect,
+		CredentialsRemoved: credentialsRemoved,
+		Version:            h.mgr.Version(),
+	})
+}
+
+// removeCfgConnectPassword removes the password from the user info of
+// the URL of a cfgConnect, like "couchbase:http://bucket:pswd@cb:8091",
+// keeping the user name, which may be meaningful, like a bucket name.
+func removeCfgConnectPassword(cfgConnect string) (string, bool) {
+	i := strings.Index(cfgConnect, "://")
+	if i < 0 {
+		return cfgConnect, false
+	}
+	hostStart := i + len("://")
+
+	hostEnd := strings.IndexAny(cfgConnect[hostStart:], "/?#")
+	if hostEnd < 0 {
+		hostEnd = len(cfgConnect)
+	} else {
+		hostEnd += hostStart
+	}
+
+	at := strings.LastIndex(cfgConnect[hostStart:hostEnd], "@")
+	if at < 0 {
+		return cfgConnect, false
+	}
+	at += hostStart
+
+	colon := strings.Index(cfgConnect[hostStart:at], ":")
+	if colon < 0 {
+		return cfgConnect, false
+	}
+	colon += hostStart
+
+	return cfgConnect[:colon] + cfgConnect[at:], true
+}
+
+// ---------------------------------------------------
+
+// NodeControlHandler is a REST handler for processing cluster
+// membership requests on a node, like a graceful removal, a failover
+// or a promotion of a standby node.
+type NodeControlHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewNodeControlHandler(mgr *cbgt.Manager) *NodeControlHandler {
+	return &NodeControlHandler{mgr: mgr}
+}
+
+func (h *NodeControlHandler) RESTOpts(opts map[string]string) {
+	opts["param: nodeUUID"] =
+		"required, string, URL path parameter\n\n" +
+			"The uuid of the node whose membership will be modified."
+}
+
+func (h *NodeControlHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	nodeUUID := NodeUUIDLookup(req)
+	if nodeUUID == "" {
+		ShowError(w, req, "node uuid is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	op := RequestVariableLookup(req, "op")
+	switch op {
+	case "remove":
+		err = h.mgr.RemoveNode(nodeUUID)
+	case "failover":
+		err = h.mgr.FailoverNode(nodeUUID)
+	case "promote":
+		err = h.mgr.PromoteNode(nodeUUID)
+	default:
+		ShowError(w, req, fmt.Sprintf("rest_node: NodeControl,"+
+			" error: unsupported op: %s", op), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_node: NodeControl,"+
+			" could not op: %s, err: %v", op, err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+// DrainTimeoutDefault is the default max time that a drain request
+// waits for in-flight queries to finish.
+var DrainTimeoutDefault = 30 * time.Second
+
+// DrainNodeHandler is a REST handler for gracefully shutting down this
+// node.  See Manager.ShutdownEx().
+type DrainNodeHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDrainNodeHandler(mgr *cbgt.Manager) *DrainNodeHandler {
+	return &DrainNodeHandler{mgr: mgr}
+}
+
+func (h *DrainNodeHandler) RESTOpts(opts map[string]string) {
+	opts["param: unregister"] =
+		"optional, boolean, form parameter\n\n" +
+			"When true, the node is also unregistered from the wanted nodes."
+	opts["param: timeout"] =
+		"optional, duration string, form parameter\n\n" +
+			"The max time to wait for in-flight queries, like \"30s\"."
+}
+
+func (h *DrainNodeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	unregister := false
+	if v := req.FormValue("unregister"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_node: Drain,"+
+				" could not parse unregister: %s, err: %v", v, err),
+				http.StatusBadRequest)
+			return
+		}
+		unregister = b
+	}
+
+	timeout := DrainTimeoutDefault
+	if v := req.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_node: Drain,"+
+				" could not parse timeout: %s, err: %v", v, err),
+				http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := h.mgr.ShutdownEx(ctx, unregister)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_node: Drain,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
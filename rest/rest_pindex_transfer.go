@@ -0,0 +1,143 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/couchbase/cbgt"
+)
+
+// ListPIndexFilesHandler is a REST handler that snapshots the files
+// of a pindex and lists them, along with their sizes and checksums,
+// so that another node can copy the pindex's files instead of
+// rebuilding the pindex.
+type ListPIndexFilesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewListPIndexFilesHandler(mgr *cbgt.Manager) *ListPIndexFilesHandler {
+	return &ListPIndexFilesHandler{mgr: mgr}
+}
+
+func (h *ListPIndexFilesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindex := getPIndexForTransfer(h.mgr, w, req)
+	if pindex == nil {
+		return
+	}
+
+	files, err := h.mgr.SnapshotPIndexFiles(pindex)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_pindex_transfer:"+
+			" SnapshotPIndexFiles, err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string            `json:"status"`
+		Files  *cbgt.PIndexFiles `json:"files"`
+	}{
+		Status: "ok",
+		Files:  files,
+	})
+}
+
+// ---------------------------------------------------
+
+// GetPIndexFileHandler is a REST handler that streams a single file
+// of a pindex, or of a snapshot of the pindex.  Range requests are
+// supported, so that an interrupted transfer can be resumed.
+type GetPIndexFileHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewGetPIndexFileHandler(mgr *cbgt.Manager) *GetPIndexFileHandler {
+	return &GetPIndexFileHandler{mgr: mgr}
+}
+
+func (h *GetPIndexFileHandler) RESTOpts(opts map[string]string) {
+	opts["param: path"] =
+		"required, string, form parameter" +
+			"\n\nThe path of the file, relative to the pindex's directory."
+	opts["param: snapshot"] =
+		"optional, string, form parameter" +
+			"\n\nThe snapshot of the pindex that holds the file," +
+			" as listed by the pindex files handler."
+}
+
+func (h *GetPIndexFileHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindex := getPIndexForTransfer(h.mgr, w, req)
+	if pindex == nil {
+		return
+	}
+
+	var path string
+	var err error
+
+	snapshot := req.FormValue("snapshot")
+	if snapshot != "" {
+		path, err = cbgt.PIndexSnapshotFilePath(pindex, snapshot,
+			req.FormValue("path"))
+	} else {
+		path, err = cbgt.PIndexFilePath(pindex, req.FormValue("path"))
+	}
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_pindex_transfer:"+
+			" GetPIndexFile, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_pindex_transfer:"+
+			" GetPIndexFile, err: %v", err), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		ShowError(w, req, fmt.Sprintf("rest_pindex_transfer:"+
+			" GetPIndexFile, not a file, path: %s", req.FormValue("path")),
+			http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, filepath.Base(path), fi.ModTime(), f)
+}
+
+// ---------------------------------------------------
+
+func getPIndexForTransfer(mgr *cbgt.Manager, w http.ResponseWriter,
+	req *http.Request) *cbgt.PIndex {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_pindex_transfer: pindex name is required",
+			http.StatusBadRequest)
+		return nil
+	}
+
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		ShowError(w, req, fmt.Sprintf("rest_pindex_transfer:"+
+			" no pindex, pindexName: %s", pindexName), http.StatusBadRequest)
+		return nil
+	}
+
+	return pindex
+}
@@ -0,0 +1,95 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// GetPlanRolloutHandler is a REST handler that returns the staged
+// rollout of the current plan, if any.
+type GetPlanRolloutHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewGetPlanRolloutHandler(mgr *cbgt.Manager) *GetPlanRolloutHandler {
+	return &GetPlanRolloutHandler{mgr: mgr}
+}
+
+func (h *GetPlanRolloutHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfg := h.mgr.Cfg()
+	if cfg == nil {
+		ShowError(w, req, "rest_plan_rollout: no cfg",
+			http.StatusInternalServerError)
+		return
+	}
+
+	planRollout, _, err := cbgt.CfgGetPlanRollout(cfg)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_plan_rollout:"+
+			" CfgGetPlanRollout, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status      string            `json:"status"`
+		PlanRollout *cbgt.PlanRollout `json:"planRollout"`
+	}{
+		Status:      "ok",
+		PlanRollout: planRollout,
+	})
+}
+
+// ---------------------------------------------------
+
+// PlanRolloutControlHandler is a REST handler that forces the staged
+// rollout of the current plan to allow its next wave ("advance"), or
+// all its remaining waves ("finish"), regardless of health checks.
+type PlanRolloutControlHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewPlanRolloutControlHandler(
+	mgr *cbgt.Manager) *PlanRolloutControlHandler {
+	return &PlanRolloutControlHandler{mgr: mgr}
+}
+
+func (h *PlanRolloutControlHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	op := RequestVariableLookup(req, "op")
+	if op != "advance" && op != "finish" {
+		ShowError(w, req, fmt.Sprintf("rest_plan_rollout:"+
+			" unsupported op: %s", op), http.StatusBadRequest)
+		return
+	}
+
+	planRollout, err := h.mgr.AdvancePlanRollout(true, op == "finish")
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_plan_rollout:"+
+			" AdvancePlanRollout, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status      string            `json:"status"`
+		PlanRollout *cbgt.PlanRollout `json:"planRollout"`
+	}{
+		Status:      "ok",
+		PlanRollout: planRollout,
+	})
+}
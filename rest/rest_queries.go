@@ -0,0 +1,87 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// ListQueriesHandler is a REST handler that lists the active queries
+// on this node.
+type ListQueriesHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewListQueriesHandler(mgr *cbgt.Manager) *ListQueriesHandler {
+	return &ListQueriesHandler{mgr: mgr}
+}
+
+func (h *ListQueriesHandler) RESTOpts(opts map[string]string) {
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "queries": [...]},` +
+			` where each query has its id, indexName, consumer` +
+			` and startTime, oldest first`
+}
+
+func (h *ListQueriesHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	MustEncode(w, struct {
+		Status  string              `json:"status"`
+		Queries []*cbgt.QueryHandle `json:"queries"`
+	}{
+		Status:  "ok",
+		Queries: h.mgr.ActiveQueries(),
+	})
+}
+
+// ---------------------------------------------------
+
+// CancelQueryHandler is a REST handler that cancels an active query
+// on this node.
+type CancelQueryHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCancelQueryHandler(mgr *cbgt.Manager) *CancelQueryHandler {
+	return &CancelQueryHandler{mgr: mgr}
+}
+
+func (h *CancelQueryHandler) RESTOpts(opts map[string]string) {
+	opts["param: queryID"] =
+		"required, string, URL path parameter\n\n" +
+			"The ID of the query to cancel, as listed by" +
+			" GET /api/queries or from the " + QUERY_ID_HEADER +
+			" response header of the query."
+}
+
+func (h *CancelQueryHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	queryID := RequestVariableLookup(req, "queryID")
+	if queryID == "" {
+		ShowError(w, req, "rest_queries: query ID is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	if !h.mgr.CancelQuery(queryID) {
+		ShowError(w, req, fmt.Sprintf("rest_queries: no active query,"+
+			" queryID: %s", queryID), http.StatusNotFound)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
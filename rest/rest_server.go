@@ -0,0 +1,303 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPServerOptions are the hardening options of the REST API's HTTP
+// server, which are parsed from the manager options of
+// httpReadTimeout, httpWriteTimeout and httpIdleTimeout (durations,
+// like "30s", where the write timeout also bounds streamed query
+// responses), httpMaxRequestBodyBytes (such as for a query or an
+// index definition), httpGzip ("true" to gzip the responses to
+// clients that accept gzip), and httpRateLimitPerIP (the sustained
+// requests per second allowed from a client IP address) with
+// httpRateLimitBurst (which defaults to the rate).  Zero values mean
+// no limit.
+type HTTPServerOptions struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	MaxRequestBodyBytes int64
+
+	Gzip bool
+
+	RateLimitPerIP float64
+	RateLimitBurst int
+}
+
+// ParseHTTPServerOptions parses the HTTPServerOptions from manager
+// options.
+func ParseHTTPServerOptions(options map[string]string) (
+	*HTTPServerOptions, error) {
+	rv := &HTTPServerOptions{}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"httpReadTimeout", &rv.ReadTimeout},
+		{"httpWriteTimeout", &rv.WriteTimeout},
+		{"httpIdleTimeout", &rv.IdleTimeout},
+	}
+	for _, d := range durations {
+		if v := options[d.name]; v != "" {
+			x, err := time.ParseDuration(v)
+			if err != nil || x < 0 {
+				return nil, fmt.Errorf("rest_server: could not parse"+
+					" %s: %q, err: %v", d.name, v, err)
+			}
+			*d.dst = x
+		}
+	}
+
+	if v := options["httpMaxRequestBodyBytes"]; v != "" {
+		x, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || x < 0 {
+			return nil, fmt.Errorf("rest_server: could not parse"+
+				" httpMaxRequestBodyBytes: %q, err: %v", v, err)
+		}
+		rv.MaxRequestBodyBytes = x
+	}
+
+	if v := options["httpGzip"]; v != "" {
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("rest_server: could not parse"+
+				" httpGzip: %q, err: %v", v, err)
+		}
+		rv.Gzip = x
+	}
+
+	if v := options["httpRateLimitPerIP"]; v != "" {
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || x < 0 {
+			return nil, fmt.Errorf("rest_server: could not parse"+
+				" httpRateLimitPerIP: %q, err: %v", v, err)
+		}
+		rv.RateLimitPerIP = x
+	}
+
+	if v := options["httpRateLimitBurst"]; v != "" {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 0 {
+			return nil, fmt.Errorf("rest_server: could not parse"+
+				" httpRateLimitBurst: %q, err: %v", v, err)
+		}
+		rv.RateLimitBurst = x
+	}
+
+	return rv, nil
+}
+
+// NewHTTPServer returns an http.Server for a handler, like the
+// router returned by InitRESTRouterEx(), with the timeouts of the
+// HTTPServerOptions.
+func NewHTTPServer(addr string, handler http.Handler,
+	o *HTTPServerOptions) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  o.ReadTimeout,
+		WriteTimeout: o.WriteTimeout,
+		IdleTimeout:  o.IdleTimeout,
+	}
+}
+
+// Middleware returns a func that wraps a handler with the request
+// body limit, per-IP rate limiting and gzip compression of the
+// HTTPServerOptions, where the rate limits are shared by all the
+// handlers wrapped by the same returned func.
+func (o *HTTPServerOptions) Middleware() func(http.Handler) http.Handler {
+	var limiter *ipRateLimiter
+	if o.RateLimitPerIP > 0 {
+		burst := float64(o.RateLimitBurst)
+		if burst <= 0 {
+			burst = o.RateLimitPerIP
+		}
+		limiter = &ipRateLimiter{
+			rate:    o.RateLimitPerIP,
+			burst:   burst,
+			buckets: map[string]*ipRateBucket{},
+		}
+	}
+
+	maxRequestBodyBytes := o.MaxRequestBodyBytes
+	gzipOk := o.Gzip
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if limiter != nil &&
+				!limiter.allow(requestIP(req), time.Now()) {
+				ShowError(w, req, "rest_server: too many requests",
+					http.StatusTooManyRequests)
+				return
+			}
+
+			if maxRequestBodyBytes > 0 && req.Body != nil {
+				req.Body = http.MaxBytesReader(w, req.Body,
+					maxRequestBodyBytes)
+			}
+
+			if gzipOk && strings.Contains(
+				req.Header.Get("Accept-Encoding"), "gzip") {
+				gw := &gzipResponseWriter{ResponseWriter: w}
+				defer gw.Close()
+				w = gw
+			}
+
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requestIP returns the client IP address of a request.
+func requestIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ---------------------------------------------------
+
+// An ipRateLimiter is a token bucket rate limiter per client IP.
+type ipRateLimiter struct {
+	rate  float64 // Tokens added per second.
+	burst float64 // Max tokens of a bucket.
+
+	m         sync.Mutex // Protects the fields that follow.
+	buckets   map[string]*ipRateBucket
+	lastPrune time.Time
+}
+
+type ipRateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *ipRateLimiter) allow(ip string, now time.Time) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	// Periodically forget the buckets that have refilled, which
+	// behave the same as new buckets.
+	if now.Sub(l.lastPrune) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &ipRateBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// ---------------------------------------------------
+
+// A gzipResponseWriter gzips the body of a response, except for
+// responses that must not have a body.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	gz          *gzip.Writer
+	wroteHeader bool
+	noBody      bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	g.noBody = code == http.StatusNoContent ||
+		code == http.StatusNotModified || code < 200
+	if !g.noBody {
+		h := g.ResponseWriter.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.ResponseWriter.Header().Get("Content-Type") == "" {
+			g.ResponseWriter.Header().Set("Content-Type",
+				http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.noBody {
+		return g.ResponseWriter.Write(p)
+	}
+	if g.gz == nil {
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	return g.gz.Write(p)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) CloseNotify() <-chan bool {
+	cn, ok := g.ResponseWriter.(http.CloseNotifier)
+	if ok && cn != nil {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
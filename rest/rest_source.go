@@ -10,6 +10,9 @@
 package rest
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/couchbase/cbgt"
@@ -160,3 +163,71 @@ func (h *SourceStatsHandler) ServeHTTP(
 
 	MustEncode(w, stats)
 }
+
+// ---------------------------------------------------
+
+// SourceValidateHandler is a REST handler for checking that a data
+// source is usable, such as before an index is created.
+type SourceValidateHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewSourceValidateHandler(mgr *cbgt.Manager) *SourceValidateHandler {
+	return &SourceValidateHandler{mgr: mgr}
+}
+
+func (h *SourceValidateHandler) RESTOpts(opts map[string]string) {
+	opts["param: sourceType"] =
+		"required, string, JSON request body field\n\n" +
+			`The type of the data source, like "couchbase".`
+	opts["param: sourceName"] =
+		"optional, string, JSON request body field\n\n" +
+			"The name of the data source, like a bucket name."
+	opts["param: sourceUUID"] =
+		"optional, string, JSON request body field\n\n" +
+			"The UUID that the data source is expected to have."
+	opts["param: sourceParams"] =
+		"optional, JSON object, JSON request body field\n\n" +
+			"The source type specific parameters, like auth credentials."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "valid": true},` +
+			` or of {"status": "ok", "valid": false, "error": {...}},` +
+			` where the error has a "kind" and a "msg"`
+}
+
+func (h *SourceValidateHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_source:"+
+			" could not read request body, err: %v", err), 400)
+		return
+	}
+
+	var indexDef cbgt.IndexDef
+	err = json.Unmarshal(requestBody, &indexDef)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_source:"+
+			" could not unmarshal json, err: %v", err), 400)
+		return
+	}
+
+	if indexDef.SourceType == "" {
+		ShowError(w, req, "rest_source: sourceType is required", 400)
+		return
+	}
+
+	sve := cbgt.DataSourceValidate(indexDef.SourceType,
+		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		h.mgr.Server(), h.mgr.Options())
+
+	MustEncode(w, struct {
+		Status string                    `json:"status"`
+		Valid  bool                      `json:"valid"`
+		Error  *cbgt.SourceValidateError `json:"error,omitempty"`
+	}{
+		Status: "ok",
+		Valid:  sve == nil,
+		Error:  sve,
+	})
+}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// SubmitTaskHandler is a REST handler that submits a task, like a
+// compaction, merge or backup, to an index.
+type SubmitTaskHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewSubmitTaskHandler(mgr *cbgt.Manager) *SubmitTaskHandler {
+	return &SubmitTaskHandler{mgr: mgr}
+}
+
+func (h *SubmitTaskHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index to run the task on."
+	opts[""] =
+		`The request's POST body is a JSON object that describes the` +
+			` task, which is passed to the index's type.`
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "task": {...}},` +
+			` where the task's taskID can be used with` +
+			` GET /api/index/{indexName}/tasks/{taskID}`
+}
+
+func (h *SubmitTaskHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_tasks: could not read"+
+			" request body, indexName: %s", indexName), http.StatusBadRequest)
+		return
+	}
+
+	task, err := h.mgr.SubmitTask(indexName, requestBody)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_tasks: SubmitTask,"+
+			" indexName: %s, err: %v", indexName, err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                  `json:"status"`
+		Task   *cbgt.TaskRequestStatus `json:"task"`
+	}{
+		Status: "ok",
+		Task:   task,
+	})
+}
+
+// ---------------------------------------------------
+
+// GetTaskHandler is a REST handler that returns the status of a task
+// on an index, which may have been submitted to any node.
+type GetTaskHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewGetTaskHandler(mgr *cbgt.Manager) *GetTaskHandler {
+	return &GetTaskHandler{mgr: mgr}
+}
+
+func (h *GetTaskHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index of the task."
+	opts["param: taskID"] =
+		"required, string, URL path parameter\n\n" +
+			"The ID of the task, as returned when the task was submitted."
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "task": {...}},` +
+			` where the task's status is one of "submitted",` +
+			` "running", "done" or "failed"`
+}
+
+func (h *GetTaskHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	taskID := RequestVariableLookup(req, "taskID")
+	if taskID == "" {
+		ShowError(w, req, "rest_tasks: task ID is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	task, err := h.mgr.GetTaskRequestStatus(taskID)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_tasks: GetTaskRequestStatus,"+
+			" taskID: %s, err: %v", taskID, err),
+			http.StatusInternalServerError)
+		return
+	}
+	if task == nil || task.IndexName != indexName {
+		ShowError(w, req, fmt.Sprintf("rest_tasks: no task,"+
+			" indexName: %s, taskID: %s", indexName, taskID),
+			http.StatusNotFound)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                  `json:"status"`
+		Task   *cbgt.TaskRequestStatus `json:"task"`
+	}{
+		Status: "ok",
+		Task:   task,
+	})
+}
@@ -12,14 +12,19 @@
 package rest
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -334,6 +339,67 @@ func TestHandlersForEmptyManager(t *testing.T) {
 				`{"status":"ok"}`: true,
 			},
 		},
+		{
+			Desc:   "manager kick dry run on empty manager",
+			Path:   "/api/managerKick",
+			Method: "POST",
+			Params: url.Values{"dryRun": []string{"true"}},
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"dryRun":true`:         true,
+				`"addPIndexes":[]`:      true,
+				`"removeFeeds":[]`:      true,
+				`"janitorPlan":{"addPI`: true,
+			},
+		},
+		{
+			Desc:   "manager kick with bad dry run param",
+			Path:   "/api/managerKick",
+			Method: "POST",
+			Params: url.Values{"dryRun": []string{"not-a-bool"}},
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`bad dryRun param`: true,
+			},
+		},
+		{
+			Desc:   "janitor plan on empty manager",
+			Path:   "/api/janitor/plan",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`:       true,
+				`"removePIndexes":[]`: true,
+				`"addFeeds":[]`:       true,
+			},
+		},
+		{
+			Desc:   "plan rollout when no rollout",
+			Path:   "/api/planRollout",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`:      true,
+				`"planRollout":null`: true,
+			},
+		},
+		{
+			Desc:   "plan rollout with unsupported op",
+			Path:   "/api/planRollout/bogus",
+			Method: "POST",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`unsupported op`: true,
+			},
+		},
 		{
 			Desc:   "manager meta",
 			Path:   "/api/managerMeta",
@@ -342,8 +408,10 @@ func TestHandlersForEmptyManager(t *testing.T) {
 			Body:   nil,
 			Status: http.StatusOK,
 			ResponseMatch: map[string]bool{
-				`"status":"ok"`:    true,
-				`"startSamples":{`: true,
+				`"status":"ok"`:         true,
+				`"startSamples":{`:      true,
+				`"startSchemas":{`:      true,
+				`"startSampleSchema":{`: true,
 			},
 		},
 		{
@@ -354,8 +422,321 @@ func TestHandlersForEmptyManager(t *testing.T) {
 			Body:   nil,
 			Status: http.StatusOK,
 			ResponseMatch: map[string]bool{
-				`{`: true,
-				`}`: true,
+				`{`:                    true,
+				`}`:                    true,
+				`"consistencyWait":{}`: true,
+				`"rates":{`:            true,
+				`"plannerOnce":{`:      true,
+				`"errors":{}`:          true,
+			},
+		},
+		{
+			Desc:   "list queries when no queries",
+			Path:   "/api/queries",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`: true,
+				`"queries":[]`:  true,
+			},
+		},
+		{
+			Desc:   "cancel query when no queries",
+			Path:   "/api/queries/NOT-A-QUERY",
+			Method: "DELETE",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusNotFound,
+			ResponseMatch: map[string]bool{
+				`rest_queries: no active query`: true,
+			},
+		},
+		{
+			Desc:   "index progress when no index",
+			Path:   "/api/index/NOT-AN-INDEX/progress",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`rest_index: IndexProgress`: true,
+			},
+		},
+		{
+			Desc:   "partitions advice when no index",
+			Path:   "/api/index/NOT-AN-INDEX/partitionsAdvice",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`rest_index: PartitionsAdvice`: true,
+			},
+		},
+		{
+			Desc:   "partitions advice apply requires a POST",
+			Path:   "/api/index/NOT-AN-INDEX/partitionsAdvice",
+			Method: "GET",
+			Params: url.Values{
+				"apply": []string{"true"},
+			},
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`apply requires a POST`: true,
+			},
+		},
+		{
+			Desc:   "log level with bad subsystem",
+			Path:   "/api/runtime/logLevel",
+			Method: "POST",
+			Params: url.Values{
+				"subsystem": []string{"not-a-subsystem"},
+				"level":     []string{"debug"},
+			},
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unknown subsystem`: true,
+			},
+		},
+		{
+			Desc:   "log level",
+			Path:   "/api/runtime/logLevel",
+			Method: "POST",
+			Params: url.Values{
+				"subsystem": []string{"rest"},
+				"level":     []string{"info"},
+			},
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"rest":"info"`: true,
+			},
+		},
+		{
+			Desc:   "query pindexes when no pindexes",
+			Path:   "/api/index/NOT-AN-INDEX/pindexesQuery",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{"pindexNames":["NOT-A-PINDEX"],"query":{}}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`rest_index: QueryPIndexes`: true,
+				`no pindex`:                 true,
+			},
+		},
+		{
+			Desc:   "submit task when no index",
+			Path:   "/api/index/NOT-AN-INDEX/tasks",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{"kind":"compact"}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`rest_tasks: SubmitTask`: true,
+				`no index`:               true,
+			},
+		},
+		{
+			Desc:   "cluster join without REST auth",
+			Path:   "/api/cluster/join",
+			Method: "POST",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusForbidden,
+			ResponseMatch: map[string]bool{
+				`requires REST auth`: true,
+			},
+		},
+		{
+			Desc:   "upgrade status",
+			Path:   "/api/upgradeStatus",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"upgrade":{"compatVersion":`: true,
+				`"ready":true`:                true,
+			},
+		},
+		{
+			Desc:   "orphan sweep with a bad dryRun param",
+			Path:   "/api/orphans/sweep",
+			Method: "POST",
+			Params: url.Values{"dryRun": []string{"maybe"}},
+			Body:   nil,
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`bad dryRun param`: true,
+			},
+		},
+		{
+			Desc:   "list faults when none",
+			Path:   "/api/faults",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"faults":[]`: true,
+			},
+		},
+		{
+			Desc:   "put fault when fault injection is disabled",
+			Path:   "/api/faults/slow",
+			Method: "PUT",
+			Params: nil,
+			Body:   []byte(`{"latency":"10ms"}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`fault injection is disabled`: true,
+			},
+		},
+		{
+			Desc:   "delete missing fault",
+			Path:   "/api/faults/slow",
+			Method: "DELETE",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`no fault`: true,
+			},
+		},
+		{
+			Desc:   "swap targets of a missing alias",
+			Path:   "/api/alias/live/swap",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{"from":"blue","to":"green"}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`no indexes`: true,
+			},
+		},
+		{
+			Desc:   "add-target without a target",
+			Path:   "/api/alias/live/add-target",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`target is required`: true,
+			},
+		},
+		{
+			Desc:   "set-routing without a routing or weights",
+			Path:   "/api/alias/live/set-routing",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`routing or weights are required`: true,
+			},
+		},
+		{
+			Desc:   "doc lookup on a non-existent index",
+			Path:   "/api/index/NOT_AN_INDEX/doc/someDoc",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`rest_index: LookUpDoc`: true,
+			},
+		},
+		{
+			Desc:   "get doc trace when none",
+			Path:   "/api/index/idx/docTrace",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusNotFound,
+			ResponseMatch: map[string]bool{
+				`no doc trace`: true,
+			},
+		},
+		{
+			Desc:   "put doc trace when disabled",
+			Path:   "/api/index/idx/docTrace",
+			Method: "PUT",
+			Params: nil,
+			Body:   []byte(`{"docIDs":["a"]}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`doc tracing is disabled`: true,
+			},
+		},
+		{
+			Desc:   "list pindex summaries when none",
+			Path:   "/api/pindex",
+			Method: "GET",
+			Params: url.Values{"summary": []string{"true"}},
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok","pindexes":{}}`: true,
+			},
+		},
+		{
+			Desc:   "unknown alias op",
+			Path:   "/api/alias/live/rename",
+			Method: "POST",
+			Params: nil,
+			Body:   []byte(`{}`),
+			Status: http.StatusBadRequest,
+			ResponseMatch: map[string]bool{
+				`unknown op`: true,
+			},
+		},
+		{
+			Desc:   "list maintenance schedules when none",
+			Path:   "/api/maintenance/schedules",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"schedules":[]`: true,
+			},
+		},
+		{
+			Desc:   "put bad maintenance schedule",
+			Path:   "/api/maintenance/schedules/nightly",
+			Method: "PUT",
+			Params: nil,
+			Body:   []byte(`{"op":"not-an-op","start":"02:00","duration":"1h"}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unknown op`: true,
+			},
+		},
+		{
+			Desc:   "run missing maintenance schedule now",
+			Path:   "/api/maintenance/schedules/nightly/runNow",
+			Method: "POST",
+			Params: nil,
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no schedule`: true,
+			},
+		},
+		{
+			Desc:   "get task when no task",
+			Path:   "/api/index/NOT-AN-INDEX/tasks/NOT-A-TASK",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: 404,
+			ResponseMatch: map[string]bool{
+				`rest_tasks: no task`: true,
 			},
 		},
 		{
@@ -390,13 +771,18 @@ func TestHandlersForEmptyManager(t *testing.T) {
 			ResponseBody: []byte(`{"status":"ok","indexDefs":null}`),
 		},
 		{
-			Desc:         "try to get a nonexistent index",
-			Path:         "/api/index/NOT-AN-INDEX",
-			Method:       "GET",
-			Params:       nil,
-			Body:         nil,
-			Status:       400,
-			ResponseBody: []byte(`index not found`),
+			Desc:   "try to get a nonexistent index",
+			Path:   "/api/index/NOT-AN-INDEX",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`"status":"fail"`:             true,
+				`"code":"bad_request"`:        true,
+				`"message":"index not found"`: true,
+				`"indexName":"NOT-AN-INDEX"`:  true,
+			},
 		},
 		{
 			Desc:   "try to create a default index with no params",
@@ -572,18 +958,355 @@ func TestHandlersForEmptyManager(t *testing.T) {
 			Status: 200,
 		},
 		{
-			Desc:   "look up a pindexId for a non existant indexname and document ID",
-			Path:   "/api/index/idx/pindexLookup",
-			Method: "POST",
-			Params: url.Values{
-				"u": []string{"Administrator:asdasd"},
-			},
-			Body:   []byte(`{"docId":"blabla"}`),
-			Status: 404,
-			ResponseMatch: map[string]bool{
+			Desc:   "create a blackhole index in a namespace",
+			Path:   "/api/ns/tenant1/index/bh4",
+			Method: "PUT",
+			Body:   []byte(`{"type":"blackhole","sourceType":"nil"}`),
+			Status: 200,
+		},
+		{
+			Desc:   "get a namespaced index",
+			Path:   "/api/ns/tenant1/index/bh4",
+			Method: "GET",
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"name":"tenant1.bh4"`:  true,
+				`"namespace":"tenant1"`: true,
+			},
+		},
+		{
+			Desc:   "list the indexes of a namespace",
+			Path:   "/api/ns/tenant1/index",
+			Method: "GET",
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"tenant1.bh4"`: true,
+				`"bh3s"`:        false,
+			},
+		},
+		{
+			Desc:   "delete a namespaced index",
+			Path:   "/api/ns/tenant1/index/bh4",
+			Method: "DELETE",
+			Status: 200,
+		},
+		{
+			Desc:   "list the indexes of a namespace after a delete",
+			Path:   "/api/ns/tenant1/index",
+			Method: "GET",
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"tenant1.bh4"`: false,
+			},
+		},
+		{
+			Desc:   "look up a pindexId for a non existant indexname and document ID",
+			Path:   "/api/index/idx/pindexLookup",
+			Method: "POST",
+			Params: url.Values{
+				"u": []string{"Administrator:asdasd"},
+			},
+			Body:   []byte(`{"docId":"blabla"}`),
+			Status: 404,
+			ResponseMatch: map[string]bool{
 				`manager: no indexDef, indexName: idx`: true,
 			},
 		},
+		{
+			Desc:   "consistency vector for a non-existent index",
+			Path:   "/api/index/NOT_AN_INDEX/consistencyVector",
+			Method: "POST",
+			Body:   []byte(`{"mutationTokens":[]}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no indexDef`: true,
+			},
+		},
+		{
+			Desc:   "set runtime manager options",
+			Path:   "/api/managerOptions",
+			Method: "POST",
+			Body:   []byte(`{"memoryQuota":"1000000"}`),
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`:            true,
+				`"memoryQuota":"1000000"`: true,
+			},
+		},
+		{
+			Desc:   "set a manager option that's not a runtime option",
+			Path:   "/api/managerOptions",
+			Method: "POST",
+			Body:   []byte(`{"dataDir":"/tmp"}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`cannot be changed at runtime`: true,
+			},
+		},
+		{
+			Desc:   "set an invalid runtime manager option",
+			Path:   "/api/managerOptions",
+			Method: "POST",
+			Body:   []byte(`{"memoryQuota":"lots"}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`invalid option`: true,
+			},
+		},
+		{
+			Desc:   "validate a nil source",
+			Path:   "/api/source/validate",
+			Method: "POST",
+			Body:   []byte(`{"sourceType":"nil"}`),
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"valid":true`: true,
+			},
+		},
+		{
+			Desc:   "validate an unknown source type",
+			Path:   "/api/source/validate",
+			Method: "POST",
+			Body:   []byte(`{"sourceType":"not-a-source-type"}`),
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"valid":false`:              true,
+				`"kind":"unknownSourceType"`: true,
+			},
+		},
+		{
+			Desc:   "validate without a source type",
+			Path:   "/api/source/validate",
+			Method: "POST",
+			Body:   []byte(`{}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`sourceType is required`: true,
+			},
+		},
+		{
+			Desc:   "ingest into a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/ingest",
+			Method: "POST",
+			Body:   []byte(`{"mutations":[{"key":"a","val":{}}]}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "list files of a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/files",
+			Method: "GET",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "get file of a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/file",
+			Method: "GET",
+			Params: url.Values{
+				"path": []string{"PINDEX_META"},
+			},
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "backup a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/backup",
+			Method: "GET",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "backup an index with no local pindexes",
+			Path:   "/api/index/NOT_AN_INDEX/backup",
+			Method: "GET",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no local pindexes`: true,
+			},
+		},
+		{
+			Desc:   "restore a bad archive",
+			Path:   "/api/restore",
+			Method: "POST",
+			Body:   []byte("not a tar archive"),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`rest_backup: restore`: true,
+			},
+		},
+		{
+			Desc:   "verify a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/verify",
+			Method: "POST",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "verify with a bad repair param",
+			Path:   "/api/verify",
+			Method: "POST",
+			Params: url.Values{
+				"repair": []string{"not-a-bool"},
+			},
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`bad repair param`: true,
+			},
+		},
+		{
+			Desc:   "verify all local pindexes",
+			Path:   "/api/verify",
+			Method: "POST",
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`: true,
+			},
+		},
+		{
+			Desc:   "pause ingest of a non-existent pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/ingestControl/pause",
+			Method: "POST",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no pindex`: true,
+			},
+		},
+		{
+			Desc:   "bad ingest control op on a pindex",
+			Path:   "/api/pindex/NOT_A_PINDEX/ingestControl/bogus",
+			Method: "POST",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unsupported op`: true,
+			},
+		},
+		{
+			Desc:   "add a node with no hostPort",
+			Path:   "/api/node/nodeB",
+			Method: "PUT",
+			Body:   []byte(`{}`),
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`hostPort is required`: true,
+			},
+		},
+		{
+			Desc:   "add a node",
+			Path:   "/api/node/nodeB",
+			Method: "PUT",
+			Body:   []byte(`{"hostPort":"nodeB:1000"}`),
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+		{
+			Desc:   "unsupported node op",
+			Path:   "/api/node/nodeB/bogus",
+			Method: "POST",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`unsupported op: bogus`: true,
+			},
+		},
+		{
+			Desc:   "remove a node",
+			Path:   "/api/node/nodeB/remove",
+			Method: "POST",
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+		{
+			Desc:   "failover an already removed node",
+			Path:   "/api/node/nodeB/failover",
+			Method: "POST",
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`no such node`: true,
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestHandlersForDrain(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	meh := &TestMEH{}
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", meh)
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Errorf("expected start ok")
+	}
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "drain with bad timeout",
+			Path:   "/api/node/drain",
+			Method: "POST",
+			Params: url.Values{
+				"timeout": []string{"not-a-duration"},
+			},
+			Status: 400,
+			ResponseMatch: map[string]bool{
+				`could not parse timeout`: true,
+			},
+		},
+		{
+			Desc:   "drain",
+			Path:   "/api/node/drain",
+			Method: "POST",
+			Params: url.Values{
+				"unregister": []string{"true"},
+			},
+			Status: 200,
+			ResponseMatch: map[string]bool{
+				`{"status":"ok"}`: true,
+			},
+		},
+		{
+			Desc:   "query after drain",
+			Path:   "/api/index/NOT-AN-INDEX/query",
+			Method: "POST",
+			Status: 503,
+			ResponseMatch: map[string]bool{
+				`node is shutting down`: true,
+			},
+		},
+		{
+			Desc:   "drain again",
+			Path:   "/api/node/drain",
+			Method: "POST",
+			Status: 500,
+			ResponseMatch: map[string]bool{
+				`already shutting down`: true,
+			},
+		},
 	}
 
 	testRESTHandlers(t, tests, router)
@@ -608,3 +1331,563 @@ func TestPathFocusName(t *testing.T) {
 		}
 	}
 }
+
+func TestShowError(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/index/foo"},
+		Form:   url.Values{REST_ERROR_VERBOSE_PARAM: []string{"true"}},
+	}
+	record := httptest.NewRecorder()
+	ShowError(record, req, "rest_index: oops, err: inner <problem>",
+		http.StatusServiceUnavailable)
+
+	if record.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got: %d", record.Code)
+	}
+	if record.HeaderMap.Get("Content-Type") != "application/json" {
+		t.Errorf("expected JSON content type, got: %v", record.HeaderMap)
+	}
+
+	var e RESTError
+	err := json.Unmarshal(record.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatalf("expected JSON error body, err: %v", err)
+	}
+	if e.Status != "fail" ||
+		e.Code != REST_ERROR_CODE_UNAVAILABLE ||
+		e.HTTPStatus != http.StatusServiceUnavailable ||
+		e.Message != "rest_index: oops, err: inner <problem>" ||
+		!e.Retryable {
+		t.Errorf("unexpected error body: %#v", e)
+	}
+	if !reflect.DeepEqual(e.ErrorChain,
+		[]string{"rest_index: oops", "inner <problem>"}) {
+		t.Errorf("unexpected error chain: %#v", e.ErrorChain)
+	}
+
+	req.Form = nil
+	record = httptest.NewRecorder()
+	ShowError(record, req, "bad, err: worse", http.StatusBadRequest)
+
+	e = RESTError{}
+	err = json.Unmarshal(record.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatalf("expected JSON error body, err: %v", err)
+	}
+	if e.Code != REST_ERROR_CODE_BAD_REQUEST || e.Retryable ||
+		e.ErrorChain != nil {
+		t.Errorf("unexpected error body: %#v", e)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Fatalf("no mux router")
+	}
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/index/NOT-AN-INDEX"},
+		Header: http.Header{},
+	}
+	req.Header.Set(REQUEST_ID_HEADER, "r0")
+	record := httptest.NewRecorder()
+	router.ServeHTTP(record, req)
+
+	if record.HeaderMap.Get(REQUEST_ID_HEADER) != "r0" {
+		t.Errorf("expected the request ID to be echoed, got: %v",
+			record.HeaderMap)
+	}
+	if !bytes.Contains(record.Body.Bytes(), []byte(`"requestID":"r0"`)) {
+		t.Errorf("expected the request ID in the error, got: %s",
+			record.Body.String())
+	}
+
+	req = &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/index"},
+	}
+	record = httptest.NewRecorder()
+	router.ServeHTTP(record, req)
+
+	if record.HeaderMap.Get(REQUEST_ID_HEADER) == "" {
+		t.Errorf("expected a generated request ID")
+	}
+}
+
+func TestParseHTTPServerOptions(t *testing.T) {
+	o, err := ParseHTTPServerOptions(map[string]string{
+		"httpReadTimeout":         "10s",
+		"httpIdleTimeout":         "1m",
+		"httpMaxRequestBodyBytes": "100",
+		"httpGzip":                "true",
+		"httpRateLimitPerIP":      "2.5",
+	})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if o.ReadTimeout != 10*time.Second || o.WriteTimeout != 0 ||
+		o.IdleTimeout != time.Minute || o.MaxRequestBodyBytes != 100 ||
+		!o.Gzip || o.RateLimitPerIP != 2.5 || o.RateLimitBurst != 0 {
+		t.Errorf("unexpected options: %#v", o)
+	}
+
+	s := NewHTTPServer(":0", nil, o)
+	if s.ReadTimeout != 10*time.Second || s.IdleTimeout != time.Minute {
+		t.Errorf("unexpected server: %#v", s)
+	}
+
+	for _, bad := range []map[string]string{
+		{"httpWriteTimeout": "not-a-duration"},
+		{"httpMaxRequestBodyBytes": "-1"},
+		{"httpGzip": "maybe"},
+		{"httpRateLimitPerIP": "fast"},
+		{"httpRateLimitBurst": "1.5"},
+	} {
+		_, err = ParseHTTPServerOptions(bad)
+		if err == nil {
+			t.Errorf("expected err for options: %v", bad)
+		}
+	}
+}
+
+func TestHTTPServerOptionsMiddleware(t *testing.T) {
+	o := &HTTPServerOptions{
+		MaxRequestBodyBytes: 5,
+		Gzip:                true,
+		RateLimitPerIP:      0.001,
+		RateLimitBurst:      2,
+	}
+
+	h := o.Middleware()(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				ShowError(w, req, "body too big", 400)
+				return
+			}
+			w.Write(body)
+		}))
+
+	request := func(body string, ip string) *httptest.ResponseRecorder {
+		req := &http.Request{
+			Method:     "POST",
+			URL:        &url.URL{Path: "/"},
+			RemoteAddr: ip + ":1234",
+			Header:     http.Header{"Accept-Encoding": []string{"gzip"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		return record
+	}
+
+	record := request("hello", "1.2.3.4")
+	if record.Code != 200 ||
+		record.HeaderMap.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip response, got: %d, %v",
+			record.Code, record.HeaderMap)
+	}
+	gz, err := gzip.NewReader(record.Body)
+	if err != nil {
+		t.Fatalf("expected gzip body, err: %v", err)
+	}
+	body, _ := ioutil.ReadAll(gz)
+	if string(body) != "hello" {
+		t.Errorf("expected hello, got: %q", body)
+	}
+
+	record = request("too long", "1.2.3.4")
+	if record.Code != 400 {
+		t.Errorf("expected body limit, got: %d", record.Code)
+	}
+
+	record = request("", "1.2.3.4")
+	if record.Code != http.StatusTooManyRequests {
+		t.Errorf("expected rate limit, got: %d", record.Code)
+	}
+
+	record = request("", "5.6.7.8")
+	if record.Code != 200 {
+		t.Errorf("expected other IP to not be limited, got: %d",
+			record.Code)
+	}
+}
+
+func TestParseCORSOptions(t *testing.T) {
+	o, err := ParseCORSOptions(map[string]string{})
+	if err != nil || o != nil {
+		t.Errorf("expected no CORS without origins, got: %v, %v", o, err)
+	}
+
+	o, err = ParseCORSOptions(map[string]string{
+		"corsAllowedOrigins":   " http://a.example.com , http://b.example.com",
+		"corsAllowedMethods":   "GET",
+		"corsAllowCredentials": "true",
+	})
+	if err != nil || o == nil {
+		t.Fatalf("expected CORS options, err: %v", err)
+	}
+	if !reflect.DeepEqual(o.AllowedOrigins,
+		[]string{"http://a.example.com", "http://b.example.com"}) ||
+		!reflect.DeepEqual(o.AllowedMethods, []string{"GET"}) ||
+		!reflect.DeepEqual(o.AllowedHeaders, CORS_DEFAULT_ALLOWED_HEADERS) ||
+		!o.AllowCredentials {
+		t.Errorf("unexpected options: %#v", o)
+	}
+
+	_, err = ParseCORSOptions(map[string]string{
+		"corsAllowedOrigins":   "*",
+		"corsAllowCredentials": "maybe",
+	})
+	if err == nil {
+		t.Errorf("expected err on bad corsAllowCredentials")
+	}
+
+	_, err = ParseCORSOptions(map[string]string{
+		"corsAllowedOrigins":   "http://a.example.com,*",
+		"corsAllowCredentials": "true",
+	})
+	if err == nil {
+		t.Errorf("expected err on credentials with any origin")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.SetOptions(map[string]string{
+		"corsAllowedOrigins": "http://ui.example.com",
+	})
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Fatalf("no mux router")
+	}
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := &http.Request{
+			Method: method,
+			URL:    &url.URL{Path: "/api/index"},
+			Header: http.Header{
+				"Origin":                        []string{origin},
+				"Access-Control-Request-Method": []string{"GET"},
+			},
+		}
+		record := httptest.NewRecorder()
+		router.ServeHTTP(record, req)
+		return record
+	}
+
+	record := request("OPTIONS", "http://ui.example.com")
+	if record.Code != http.StatusNoContent ||
+		record.HeaderMap.Get("Access-Control-Allow-Origin") !=
+			"http://ui.example.com" ||
+		record.HeaderMap.Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("unexpected preflight response: %d, %v",
+			record.Code, record.HeaderMap)
+	}
+
+	record = request("GET", "http://ui.example.com")
+	if record.Code != http.StatusOK ||
+		record.HeaderMap.Get("Access-Control-Allow-Origin") !=
+			"http://ui.example.com" {
+		t.Errorf("unexpected response: %d, %v",
+			record.Code, record.HeaderMap)
+	}
+
+	record = request("GET", "http://evil.example.com")
+	if record.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected disallowed origin, got: %v", record.HeaderMap)
+	}
+}
+
+func TestRESTRouterRoles(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	mgr.SetOptions(map[string]string{
+		"bindHttpManagement": "localhost:9999",
+	})
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	queryRouter, _, err := InitRESTRouterEx(mux.NewRouter(), "v0", mgr,
+		"static", "", mr, AssetDir, Asset, nil)
+	if err != nil || queryRouter == nil {
+		t.Fatalf("no query router, err: %v", err)
+	}
+
+	managementRouter, _, err := InitRESTRouterEx(mux.NewRouter(), "v0", mgr,
+		"static", "", mr, AssetDir, Asset, map[string]interface{}{
+			"role": REST_ROLE_MANAGEMENT,
+		})
+	if err != nil || managementRouter == nil {
+		t.Fatalf("no management router, err: %v", err)
+	}
+
+	_, _, err = InitRESTRouterEx(mux.NewRouter(), "v0", mgr,
+		"static", "", mr, AssetDir, Asset, map[string]interface{}{
+			"role": "not-a-role",
+		})
+	if err == nil {
+		t.Errorf("expected err on bad role")
+	}
+
+	status := func(router *mux.Router, method, path string) int {
+		req := &http.Request{
+			Method: method,
+			URL:    &url.URL{Path: path},
+			Body:   ioutil.NopCloser(bytes.NewBuffer(nil)),
+		}
+		record := httptest.NewRecorder()
+		router.ServeHTTP(record, req)
+		return record.Code
+	}
+
+	countPath := "/api/index/NOT-AN-INDEX/count"
+
+	if status(queryRouter, "GET", countPath) == http.StatusNotFound {
+		t.Errorf("expected query router to serve queries")
+	}
+	if status(queryRouter, "GET", "/api/manager") != http.StatusNotFound {
+		t.Errorf("expected query router to not serve management")
+	}
+	if status(queryRouter, "GET", "/api/ping") != http.StatusOK {
+		t.Errorf("expected query router to serve ping")
+	}
+
+	if status(managementRouter, "GET", countPath) != http.StatusNotFound {
+		t.Errorf("expected management router to not serve queries")
+	}
+	if status(managementRouter, "GET", "/api/manager") != http.StatusOK {
+		t.Errorf("expected management router to serve management")
+	}
+	if status(managementRouter, "GET", "/api/ping") != http.StatusOK {
+		t.Errorf("expected management router to serve ping")
+	}
+}
+
+func TestStatsHandlerCache(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil,
+		map[string]string{"statsCacheTTL": "1h"})
+
+	h := NewStatsHandler(mgr)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/api/stats"},
+			Header: http.Header{},
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		record := httptest.NewRecorder()
+		h.ServeHTTP(record, req)
+		return record
+	}
+
+	record := get("")
+	etag := record.HeaderMap.Get("ETag")
+	if record.Code != http.StatusOK || etag == "" ||
+		!bytes.Contains(record.Body.Bytes(), []byte(`"manager":`)) {
+		t.Fatalf("expected stats with an ETag, got: %d, %q, %s",
+			record.Code, etag, record.Body.String())
+	}
+	body := record.Body.String()
+
+	snapshot := h.cache[""]
+	if snapshot == nil {
+		t.Fatalf("expected a cached snapshot")
+	}
+
+	record = get(`"other", W/` + etag)
+	if record.Code != http.StatusNotModified || record.Body.Len() != 0 {
+		t.Errorf("expected not modified, got: %d, %s",
+			record.Code, record.Body.String())
+	}
+
+	record = get(`"other"`)
+	if record.Code != http.StatusOK || record.Body.String() != body ||
+		record.HeaderMap.Get("ETag") != etag {
+		t.Errorf("expected the cached stats, got: %d, %s",
+			record.Code, record.Body.String())
+	}
+	if h.cache[""] != snapshot {
+		t.Errorf("expected the snapshot to be reused")
+	}
+
+	mgr = cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil,
+		map[string]string{"statsCacheTTL": "0"})
+
+	h = NewStatsHandler(mgr)
+
+	record = get("")
+	if record.Code != http.StatusOK || record.HeaderMap.Get("ETag") == "" {
+		t.Errorf("expected stats with an ETag, got: %d", record.Code)
+	}
+	if len(h.cache) != 0 {
+		t.Errorf("expected no cached snapshots when disabled")
+	}
+}
+
+func TestCfgStreamHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	defer mgr.Stop()
+
+	s := httptest.NewServer(NewCfgStreamHandler(mgr))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "?keys=bogus")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an unknown key, got: %v, %v",
+			resp, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(s.URL + "?keys=" + cbgt.INDEX_DEFS_KEY +
+		"&payload=true")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a stream, got: %v, %v", resp, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected an event stream, got: %v", resp.Header)
+	}
+
+	r := bufio.NewReader(resp.Body)
+
+	readLine := func() string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected a line, err: %v", err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	if line := readLine(); line != ": subscribed" {
+		t.Fatalf("expected a subscribed comment, got: %q", line)
+	}
+	readLine()
+
+	// A change of a key that's not streamed is skipped.
+	cfg.Set(cbgt.PLAN_PINDEXES_KEY, []byte(`{}`), 0)
+
+	cas, err := cfg.Set(cbgt.INDEX_DEFS_KEY, []byte(`{"uuid":"x"}`), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work, err: %v", err)
+	}
+
+	if line := readLine(); line != "event: cfgChange" {
+		t.Fatalf("expected a cfgChange event, got: %q", line)
+	}
+
+	var c CfgChange
+	line := readLine()
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &c)
+	if err != nil || c.Key != cbgt.INDEX_DEFS_KEY || c.CAS != cas ||
+		string(c.Value) != `{"uuid":"x"}` || c.ValueCAS != cas {
+		t.Errorf("expected an indexDefs change, got: %q, err: %v", line, err)
+	}
+}
+
+func TestClusterJoinHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	options := map[string]string{
+		"cfgConnect": "couchbase:http://cfg-bucket:secret@cb:8091/pools",
+	}
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil, options)
+
+	join := func(h *ClusterJoinHandler) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/cluster/join", nil)
+		h.ServeHTTP(record, req)
+		return record
+	}
+
+	h := NewClusterJoinHandler(mgr)
+	record := join(h)
+	if record.Code != http.StatusForbidden {
+		t.Errorf("expected join to need REST auth, got: %d", record.Code)
+	}
+
+	h.authenticated = true
+	record = join(h)
+	body := record.Body.String()
+	if record.Code != http.StatusOK ||
+		strings.Contains(body, "secret") ||
+		!strings.Contains(body, `"cfgConnect":"couchbase:http://cfg-bucket@cb:8091/pools"`) ||
+		!strings.Contains(body, `"credentialsRemoved":true`) {
+		t.Errorf("expected a cfgConnect without the password, got: %d, %s",
+			record.Code, body)
+	}
+
+	options["clusterJoinShareCredentials"] = "true"
+	mgr.SetOptions(options)
+
+	record = join(h)
+	body = record.Body.String()
+	if record.Code != http.StatusOK ||
+		!strings.Contains(body, "cfg-bucket:secret@cb") ||
+		!strings.Contains(body, `"credentialsRemoved":false`) {
+		t.Errorf("expected a shared cfgConnect, got: %d, %s",
+			record.Code, body)
+	}
+}
+
+func TestRemoveCfgConnectPassword(t *testing.T) {
+	tests := []struct {
+		in, out string
+		removed bool
+	}{
+		{"metakv", "metakv", false},
+		{"couchbase:http://cb:8091", "couchbase:http://cb:8091", false},
+		{"couchbase:http://b@cb:8091", "couchbase:http://b@cb:8091", false},
+		{"couchbase:http://b:p@cb:8091", "couchbase:http://b@cb:8091", true},
+		{"couchbase:http://b:p@cb:8091/x@y", "couchbase:http://b@cb:8091/x@y",
+			true},
+	}
+	for i, test := range tests {
+		out, removed := removeCfgConnectPassword(test.in)
+		if out != test.out || removed != test.removed {
+			t.Errorf("test: %d, expected: %s, %v, got: %s, %v",
+				i, test.out, test.removed, out, removed)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/cbgt"
+)
+
+// UpgradeStatusHandler is a REST handler that returns the readiness
+// of the nodes of the cluster for a rolling upgrade.
+type UpgradeStatusHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewUpgradeStatusHandler(mgr *cbgt.Manager) *UpgradeStatusHandler {
+	return &UpgradeStatusHandler{mgr: mgr}
+}
+
+func (h *UpgradeStatusHandler) RESTOpts(opts map[string]string) {
+	opts["result on success"] =
+		`HTTP 200 with body JSON of {"status": "ok", "upgrade": {...}},` +
+			` where the upgrade has the cluster's compatVersion, the` +
+			` targetVersion, and the version of each node`
+}
+
+func (h *UpgradeStatusHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	upgradeStatus, err := cbgt.CfgGetUpgradeStatus(h.mgr.Cfg())
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_upgrade:"+
+			" CfgGetUpgradeStatus, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status  string              `json:"status"`
+		Upgrade *cbgt.UpgradeStatus `json:"upgrade"`
+	}{
+		Status:  "ok",
+		Upgrade: upgradeStatus,
+	})
+}
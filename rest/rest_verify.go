@@ -0,0 +1,130 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/cbgt"
+)
+
+// VerifyPIndexHandler is a REST handler that checks the storage
+// integrity of a local pindex, optionally rebuilding the pindex if
+// it's corrupt.
+type VerifyPIndexHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewVerifyPIndexHandler(mgr *cbgt.Manager) *VerifyPIndexHandler {
+	return &VerifyPIndexHandler{mgr: mgr}
+}
+
+func (h *VerifyPIndexHandler) RESTOpts(opts map[string]string) {
+	verifyRESTOpts(opts)
+}
+
+func (h *VerifyPIndexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_verify: pindex name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	repair, ok := verifyRepairParam(w, req)
+	if !ok {
+		return
+	}
+
+	result, err := h.mgr.VerifyPIndex(pindexName, repair)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_verify: VerifyPIndex,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                   `json:"status"`
+		Result *cbgt.PIndexVerifyResult `json:"result"`
+	}{
+		Status: "ok",
+		Result: result,
+	})
+}
+
+// ---------------------------------------------------
+
+// VerifyHandler is a REST handler that checks the storage integrity
+// of all the local pindexes, optionally rebuilding corrupt pindexes.
+type VerifyHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewVerifyHandler(mgr *cbgt.Manager) *VerifyHandler {
+	return &VerifyHandler{mgr: mgr}
+}
+
+func (h *VerifyHandler) RESTOpts(opts map[string]string) {
+	verifyRESTOpts(opts)
+}
+
+func (h *VerifyHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	repair, ok := verifyRepairParam(w, req)
+	if !ok {
+		return
+	}
+
+	results, err := h.mgr.VerifyPIndexes(repair)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_verify: VerifyPIndexes,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status  string                              `json:"status"`
+		Results map[string]*cbgt.PIndexVerifyResult `json:"results"`
+	}{
+		Status:  "ok",
+		Results: results,
+	})
+}
+
+// ---------------------------------------------------
+
+func verifyRESTOpts(opts map[string]string) {
+	opts["param: repair"] =
+		"optional, bool, form parameter" +
+			"\n\nWhen true, index partitions that fail verification" +
+			" are removed and rebuilt from their data source."
+}
+
+func verifyRepairParam(w http.ResponseWriter, req *http.Request) (
+	bool, bool) {
+	repairStr := req.FormValue("repair")
+	if repairStr == "" {
+		return false, true
+	}
+
+	repair, err := strconv.ParseBool(repairStr)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_verify: bad repair param: %q",
+			repairStr), http.StatusBadRequest)
+		return false, false
+	}
+
+	return repair, true
+}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ScatterGatherOptions controls a ScatterGather() across targets,
+// such as the target indexes of an index alias.
+type ScatterGatherOptions struct {
+	// Timeout limits the time for each target, where 0 means no
+	// timeout other than the ctx of the ScatterGather().
+	Timeout time.Duration
+
+	// Concurrency limits the number of targets that are processed
+	// at once, where <= 0 means all targets at once.
+	Concurrency int
+
+	// When AllowPartial is true, targets that fail or time out are
+	// dropped from the results, which are then marked as Partial,
+	// instead of failing the whole ScatterGather().
+	AllowPartial bool
+}
+
+// ScatterGatherResult holds the results of a ScatterGather(), keyed
+// by target.
+type ScatterGatherResult struct {
+	Results map[string]interface{}
+	Errs    map[string]error // Of the dropped targets.
+	Partial bool
+}
+
+// ScatterGather invokes f concurrently for each target, as limited by
+// the options, and gathers the results.  A target that doesn't
+// finish within the timeout isn't waited for, so f should also honor
+// its ctx.
+func ScatterGather(ctx context.Context, targets []string,
+	opts ScatterGatherOptions,
+	f func(ctx context.Context, target string) (interface{}, error)) (
+	*ScatterGatherResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(targets) {
+		concurrency = len(targets)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	rv := &ScatterGatherResult{
+		Results: map[string]interface{}{},
+		Errs:    map[string]error{},
+	}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			var val interface{}
+			var err error
+
+			select {
+			case sem <- struct{}{}:
+				val, err = scatterGatherTarget(ctx, target, opts.Timeout, f)
+				<-sem
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			m.Lock()
+			if err != nil {
+				rv.Errs[target] = err
+				if firstErr == nil {
+					firstErr = fmt.Errorf("scatter_gather: target: %s,"+
+						" err: %v", target, err)
+				}
+				if !opts.AllowPartial {
+					cancel() // Fail fast, as the whole will fail.
+				}
+			} else {
+				rv.Results[target] = val
+			}
+			m.Unlock()
+		}(target)
+	}
+
+	wg.Wait()
+
+	if len(rv.Errs) > 0 {
+		if !opts.AllowPartial {
+			return nil, firstErr
+		}
+		rv.Partial = true
+	}
+
+	return rv, nil
+}
+
+// scatterGatherTarget invokes f for a target, but stops waiting for
+// it when the timeout or ctx is done.
+func scatterGatherTarget(ctx context.Context, target string,
+	timeout time.Duration,
+	f func(ctx context.Context, target string) (interface{}, error)) (
+	interface{}, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		val interface{}
+		err error
+	}
+
+	resultCh := make(chan result, 1)
+
+	go func() {
+		val, err := f(ctx, target)
+		resultCh <- result{val, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.val, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
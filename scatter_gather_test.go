@@ -0,0 +1,87 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScatterGather(t *testing.T) {
+	slowCh := make(chan struct{})
+	defer close(slowCh)
+
+	f := func(ctx context.Context, target string) (interface{}, error) {
+		switch target {
+		case "slow":
+			<-slowCh // Ignores its ctx, but isn't waited for.
+		case "bad":
+			return nil, fmt.Errorf("bad target")
+		}
+		return "result-" + target, nil
+	}
+
+	rv, err := ScatterGather(context.Background(),
+		[]string{"a", "b", "slow", "bad"},
+		ScatterGatherOptions{
+			Timeout:      10 * time.Millisecond,
+			AllowPartial: true,
+		}, f)
+	if err != nil || !rv.Partial || len(rv.Results) != 2 ||
+		rv.Results["a"] != "result-a" || len(rv.Errs) != 2 ||
+		rv.Errs["slow"] != context.DeadlineExceeded {
+		t.Errorf("expected partial results, rv: %+v, err: %v", rv, err)
+	}
+
+	_, err = ScatterGather(context.Background(),
+		[]string{"a", "slow", "bad"},
+		ScatterGatherOptions{Timeout: time.Minute}, f)
+	if err == nil {
+		t.Errorf("expected err without AllowPartial")
+	}
+
+	rv, err = ScatterGather(context.Background(), []string{"a", "b"},
+		ScatterGatherOptions{}, f)
+	if err != nil || rv.Partial || len(rv.Results) != 2 {
+		t.Errorf("expected full results, rv: %+v, err: %v", rv, err)
+	}
+}
+
+func TestScatterGatherConcurrency(t *testing.T) {
+	var running, maxRunning int64
+
+	targets := []string{"a", "b", "c", "d", "e", "f"}
+
+	rv, err := ScatterGather(context.Background(), targets,
+		ScatterGatherOptions{Concurrency: 2},
+		func(ctx context.Context, target string) (interface{}, error) {
+			n := atomic.AddInt64(&running, 1)
+			for {
+				m := atomic.LoadInt64(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			return target, nil
+		})
+	if err != nil || len(rv.Results) != len(targets) {
+		t.Errorf("expected all results, rv: %+v, err: %v", rv, err)
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected concurrency <= 2, got: %d", maxRunning)
+	}
+}
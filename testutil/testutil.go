@@ -0,0 +1,344 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package testutil provides an in-process cluster of cbgt Managers,
+// sharing a CfgMem and each serving the REST API from a local HTTP
+// server, so that applications can write integration tests of
+// planning, failover and querying without a Couchbase server.  Index
+// data is fed through the "primary" source type.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// SETTLE_TIMEOUT is the default max duration of a Cluster.Settle().
+var SETTLE_TIMEOUT = 10 * time.Second
+
+// A Cluster is a set of in-process nodes that share a Cfg.
+type Cluster struct {
+	Cfg     cbgt.Cfg
+	Options map[string]string // Manager options for new nodes.
+
+	dir string
+
+	m     sync.Mutex
+	nodes []*Node // Includes failed nodes.
+}
+
+// A Node is a Manager of a Cluster and its REST server.
+type Node struct {
+	Mgr    *cbgt.Manager
+	Server *httptest.Server
+	URL    string // Base URL of the REST API, like "http://127.0.0.1:1234".
+	Dir    string
+
+	failed bool
+}
+
+// NewCluster starts a Cluster of numNodes nodes, where the options
+// are the Manager options of each node.
+func NewCluster(numNodes int, options map[string]string) (*Cluster, error) {
+	dir, err := ioutil.TempDir("", "cbgt-testutil")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		Cfg:     cbgt.NewCfgMem(),
+		Options: options,
+		dir:     dir,
+	}
+
+	for i := 0; i < numNodes; i++ {
+		_, err = c.AddNode(nil)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// AddNode starts and registers a new node with the given tags, where
+// nil tags means the node has all roles.
+func (c *Cluster) AddNode(tags []string) (*Node, error) {
+	c.m.Lock()
+	dir := filepath.Join(c.dir, "node"+strconv.Itoa(len(c.nodes)))
+	c.m.Unlock()
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server's listener is bound before the manager is created,
+	// so that the manager's bindHttp is the server's real address.
+	server := httptest.NewUnstartedServer(nil)
+
+	options := map[string]string{}
+	for k, v := range c.Options {
+		options[k] = v
+	}
+
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, c.Cfg, cbgt.NewUUID(), tags,
+		"", 1, "", server.Listener.Addr().String(), dir, "", nil, options)
+
+	router, _, err := rest.InitRESTRouter(mux.NewRouter(), cbgt.VERSION,
+		mgr, "", "", nil, nil, nil)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	server.Config.Handler = router
+	server.Start()
+
+	err = mgr.Start("wanted")
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	node := &Node{Mgr: mgr, Server: server, URL: server.URL, Dir: dir}
+
+	c.m.Lock()
+	c.nodes = append(c.nodes, node)
+	c.m.Unlock()
+
+	return node, nil
+}
+
+// Nodes returns the nodes that haven't failed.
+func (c *Cluster) Nodes() []*Node {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var rv []*Node
+	for _, node := range c.nodes {
+		if !node.failed {
+			rv = append(rv, node)
+		}
+	}
+	return rv
+}
+
+// FailNode simulates the crash of a node and its failover: the node's
+// server and manager are stopped, and the node is then removed from
+// the Cfg, so that the planners of the remaining nodes reassign its
+// pindexes.
+func (c *Cluster) FailNode(node *Node) error {
+	c.m.Lock()
+	if node.failed {
+		c.m.Unlock()
+		return fmt.Errorf("testutil: node already failed, uuid: %s",
+			node.Mgr.UUID())
+	}
+	node.failed = true
+	c.m.Unlock()
+
+	node.Server.Close()
+	node.Mgr.Shutdown(context.Background())
+
+	return cbgt.UnregisterNodes(c.Cfg, cbgt.VERSION,
+		[]string{node.Mgr.UUID()})
+}
+
+// Close stops all the nodes and removes their data directories.
+func (c *Cluster) Close() {
+	for _, node := range c.Nodes() {
+		node.Server.Close()
+		node.Mgr.Shutdown(context.Background())
+	}
+	os.RemoveAll(c.dir)
+}
+
+// ------------------------------------------------------------------------
+
+// CreateIndex creates an index fed by a primary source with the given
+// number of source partitions.
+func (c *Cluster) CreateIndex(indexType, indexName, indexParams string,
+	planParams cbgt.PlanParams, numPartitions int) error {
+	nodes := c.Nodes()
+	if len(nodes) <= 0 {
+		return fmt.Errorf("testutil: no nodes")
+	}
+
+	sourceParams := fmt.Sprintf(`{"numPartitions":%d}`, numPartitions)
+
+	return nodes[0].Mgr.CreateIndex("primary", indexName, "",
+		sourceParams, indexType, indexName, indexParams, planParams, "")
+}
+
+// Settle kicks the planners and janitors of the nodes until every
+// node runs the pindexes that the plan assigns to it, and no others,
+// or until the SETTLE_TIMEOUT.
+func (c *Cluster) Settle() error {
+	deadline := time.Now().Add(SETTLE_TIMEOUT)
+
+	for {
+		nodes := c.Nodes()
+		for _, node := range nodes {
+			node.Mgr.Kick("testutil-settle")
+		}
+
+		err := c.checkSettled(nodes)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Cluster) checkSettled(nodes []*Node) error {
+	indexDefs, _, err := cbgt.CfgGetIndexDefs(c.Cfg)
+	if err != nil {
+		return err
+	}
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(c.Cfg)
+	if err != nil {
+		return err
+	}
+
+	if indexDefs != nil {
+		for _, indexDef := range indexDefs.IndexDefs {
+			if planPIndexes == nil ||
+				len(planPIndexes.PlanPIndexes) <= 0 ||
+				!planned(planPIndexes, indexDef) {
+				return fmt.Errorf("testutil: index not planned: %s",
+					indexDef.Name)
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		_, pindexes := node.Mgr.CurrentMaps()
+
+		wanted := 0
+		if planPIndexes != nil {
+			for _, planPIndex := range planPIndexes.PlanPIndexes {
+				if planPIndex.Nodes[node.Mgr.UUID()] == nil {
+					continue
+				}
+				wanted++
+				if pindexes[planPIndex.Name] == nil {
+					return fmt.Errorf("testutil: node: %s, missing pindex: %s",
+						node.Mgr.UUID(), planPIndex.Name)
+				}
+			}
+		}
+
+		if len(pindexes) != wanted {
+			return fmt.Errorf("testutil: node: %s, has %d pindexes,"+
+				" wanted: %d", node.Mgr.UUID(), len(pindexes), wanted)
+		}
+	}
+
+	return nil
+}
+
+func planned(planPIndexes *cbgt.PlanPIndexes, indexDef *cbgt.IndexDef) bool {
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.IndexName == indexDef.Name &&
+			planPIndex.IndexUUID == indexDef.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------
+
+// DataUpdate feeds a document mutation of a source partition to every
+// copy of the index's pindexes that covers the partition.
+func (c *Cluster) DataUpdate(indexName, partition string,
+	key []byte, seq uint64, val []byte) error {
+	return c.feed(indexName, partition, func(feed *cbgt.PrimaryFeed) error {
+		return feed.DataUpdate(partition, key, seq, val,
+			0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	})
+}
+
+// DataDelete feeds a document deletion of a source partition to every
+// copy of the index's pindexes that covers the partition.
+func (c *Cluster) DataDelete(indexName, partition string,
+	key []byte, seq uint64) error {
+	return c.feed(indexName, partition, func(feed *cbgt.PrimaryFeed) error {
+		return feed.DataDelete(partition, key, seq,
+			0, cbgt.DEST_EXTRAS_TYPE_NIL, nil)
+	})
+}
+
+func (c *Cluster) feed(indexName, partition string,
+	f func(feed *cbgt.PrimaryFeed) error) error {
+	fed := 0
+
+	for _, node := range c.Nodes() {
+		feeds, _ := node.Mgr.CurrentMaps()
+		for _, feed := range feeds {
+			pf, ok := feed.(*cbgt.PrimaryFeed)
+			if !ok || pf.IndexName() != indexName ||
+				pf.Dests()[partition] == nil {
+				continue
+			}
+
+			err := f(pf)
+			if err != nil {
+				return err
+			}
+			fed++
+		}
+	}
+
+	if fed <= 0 {
+		return fmt.Errorf("testutil: no feed for index: %s, partition: %s",
+			indexName, partition)
+	}
+
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// Query sends a query request to the REST API of a node, and returns
+// the HTTP status code and response body.
+func (node *Node) Query(indexName string, req []byte) (int, []byte, error) {
+	resp, err := http.Post(node.URL+"/api/index/"+indexName+"/query",
+		"application/json", bytes.NewReader(req))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, body, err
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package testutil
+
+import (
+	"testing"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestClusterFailover(t *testing.T) {
+	c, err := NewCluster(2, nil)
+	if err != nil {
+		t.Fatalf("expected NewCluster() to work, err: %v", err)
+	}
+	defer c.Close()
+
+	err = c.CreateIndex("blackhole", "bh", "",
+		cbgt.PlanParams{MaxPartitionsPerPIndex: 1, NumReplicas: 1}, 4)
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	if err = c.Settle(); err != nil {
+		t.Fatalf("expected Settle() to work, err: %v", err)
+	}
+
+	nodes := c.Nodes()
+	for _, node := range nodes {
+		_, pindexes := node.Mgr.CurrentMaps()
+		if len(pindexes) != 4 {
+			t.Errorf("expected 4 pindexes per node, got: %d", len(pindexes))
+		}
+	}
+
+	if err = c.DataUpdate("bh", "0", []byte("k"), 1, []byte("v")); err != nil {
+		t.Errorf("expected DataUpdate() to work, err: %v", err)
+	}
+	if err = c.DataUpdate("bh", "99", []byte("k"), 1, []byte("v")); err == nil {
+		t.Errorf("expected DataUpdate() of an unknown partition to fail")
+	}
+
+	if err = c.FailNode(nodes[1]); err != nil {
+		t.Fatalf("expected FailNode() to work, err: %v", err)
+	}
+	if err = c.FailNode(nodes[1]); err == nil {
+		t.Errorf("expected a 2nd FailNode() to fail")
+	}
+
+	if err = c.Settle(); err != nil {
+		t.Fatalf("expected Settle() after failover to work, err: %v", err)
+	}
+
+	if len(c.Nodes()) != 1 {
+		t.Errorf("expected 1 remaining node")
+	}
+	if err = c.DataDelete("bh", "3", []byte("k"), 2); err != nil {
+		t.Errorf("expected DataDelete() after failover to work, err: %v", err)
+	}
+
+	// A blackhole index isn't queryable, but the request should
+	// still reach the REST API of the node.
+	status, _, err := nodes[0].Query("bh", []byte("{}"))
+	if err != nil || status == 0 {
+		t.Errorf("expected Query() to reach the node, err: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+)
+
+// A request ID, like from the X-Request-ID header of a REST request,
+// is carried in a ctx so that it can be included in the log lines,
+// errors and trace spans of the work done for the request.
+
+type requestIDKey struct{}
+
+// WithRequestID returns a ctx that carries a request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID of a ctx, or "".
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// TraceHooks allows applications to register a tracing system, like
+// an OpenTracing or OpenTelemetry adapter, by name, where the
+// "traceHookName" manager option chooses the TraceHook to use.
+var TraceHooks = map[string]TraceHook{}
+
+// A TraceHook is an optional callback func that starts a span of an
+// operation, like "cbgt.planner", returning a ctx that carries the
+// span so that it becomes the parent of any spans started with the
+// returned ctx.
+type TraceHook func(ctx context.Context, operationName string) (
+	context.Context, TraceSpan)
+
+// A TraceSpan represents a started span of a tracing system.
+type TraceSpan interface {
+	SetTag(key string, value interface{})
+
+	// Finish ends the span, with the err of the operation, if any.
+	Finish(err error)
+}
+
+type noopTraceSpan struct{}
+
+func (noopTraceSpan) SetTag(key string, value interface{}) {}
+
+func (noopTraceSpan) Finish(err error) {}
+
+// StartTraceSpan starts a span of an operation via the manager's
+// TraceHook, if any, tagging the span with the ctx's request ID.
+// When there's no TraceHook, the returned span does nothing.
+func (mgr *Manager) StartTraceSpan(ctx context.Context,
+	operationName string) (context.Context, TraceSpan) {
+	traceHook := TraceHooks[mgr.Options()["traceHookName"]]
+	if traceHook == nil {
+		return ctx, noopTraceSpan{}
+	}
+
+	ctx, span := traceHook(ctx, operationName)
+	if span == nil {
+		return ctx, noopTraceSpan{}
+	}
+
+	if requestID := RequestID(ctx); requestID != "" {
+		span.SetTag("requestID", requestID)
+	}
+
+	return ctx, span
+}
@@ -0,0 +1,94 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	if RequestID(nil) != "" || RequestID(context.Background()) != "" {
+		t.Errorf("expected no request ID")
+	}
+
+	ctx := WithRequestID(context.Background(), "r0")
+	if RequestID(ctx) != "r0" {
+		t.Errorf("expected request ID r0, got: %s", RequestID(ctx))
+	}
+
+	if WithRequestID(ctx, "") != ctx {
+		t.Errorf("expected empty request ID to leave ctx alone")
+	}
+}
+
+type testTraceSpan struct {
+	name string
+	tags map[string]interface{}
+	err  error
+	done bool
+}
+
+func (s *testTraceSpan) SetTag(key string, value interface{}) {
+	s.tags[key] = value
+}
+
+func (s *testTraceSpan) Finish(err error) {
+	s.err = err
+	s.done = true
+}
+
+func TestStartTraceSpan(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", "", "", nil)
+
+	_, span := m.StartTraceSpan(context.Background(), "noop")
+	if _, ok := span.(noopTraceSpan); !ok {
+		t.Errorf("expected a noop span without a trace hook")
+	}
+	span.SetTag("a", 1)
+	span.Finish(nil)
+
+	var spans []*testTraceSpan
+
+	TraceHooks["test"] = func(ctx context.Context, operationName string) (
+		context.Context, TraceSpan) {
+		s := &testTraceSpan{
+			name: operationName,
+			tags: map[string]interface{}{},
+		}
+		spans = append(spans, s)
+		return ctx, s
+	}
+	defer delete(TraceHooks, "test")
+
+	m.SetOptions(map[string]string{"traceHookName": "test"})
+
+	ctx := WithRequestID(context.Background(), "r0")
+
+	_, span = m.StartTraceSpan(ctx, "op")
+	span.Finish(fmt.Errorf("oops"))
+
+	if len(spans) != 1 || spans[0].name != "op" ||
+		spans[0].tags["requestID"] != "r0" ||
+		!spans[0].done || spans[0].err == nil {
+		t.Errorf("unexpected spans: %#v", spans)
+	}
+
+	m.PlannerOnce("test")
+
+	if len(spans) != 2 || spans[1].name != "cbgt.planner" ||
+		spans[1].tags["reason"] != "test" || !spans[1].done {
+		t.Errorf("expected a planner span, got: %#v", spans)
+	}
+}
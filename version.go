@@ -61,7 +61,11 @@ func CheckVersion(cfg Cfg, myVersion string) (bool, error) {
 			continue
 		}
 
-		if VersionGTE(myVersion, string(clusterVersion)) == false {
+		c, err := CompareVersions(myVersion, string(clusterVersion))
+		if err != nil {
+			return false, fmt.Errorf("version: CheckVersion, err: %v", err)
+		}
+		if c < 0 {
 			return false, nil
 		}
 
@@ -0,0 +1,220 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// During a rolling upgrade, the nodes of a cluster run a mix of
+// versions.  The cluster-wide compat version in the Cfg is the
+// lowest VERSION that all the known nodes report in their NodeDefs,
+// and only advances (never retreats) once every node reports a newer
+// version, so features that older nodes don't understand can be
+// gated until the upgrade is done.  See PlanFeatureVersions.
+
+// COMPAT_VERSION_KEY is the key used for Cfg access of the cluster's
+// compat version.
+const COMPAT_VERSION_KEY = "compatVersion"
+
+// PlanFeatureVersions maps the plan features of index definitions to
+// the compat version that's required before index definitions may
+// use them.  Applications may register their own features during
+// init().
+var PlanFeatureVersions = map[string]string{
+	"namespace":    "5.0.0",
+	"nodeSelector": "5.0.0",
+	"zoneSpread":   "5.0.0",
+}
+
+// CfgGetCompatVersion returns the cluster's compat version, or "" if
+// it hasn't been computed yet.
+func CfgGetCompatVersion(cfg Cfg) (string, uint64, error) {
+	v, cas, err := cfg.Get(COMPAT_VERSION_KEY, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(v), cas, nil
+}
+
+// NodeDefsMinVersion returns the lowest ImplVersion of the nodes, or
+// "" if there are no nodes.
+func NodeDefsMinVersion(nodeDefs *NodeDefs) string {
+	rv := ""
+	if nodeDefs != nil {
+		for _, nodeDef := range nodeDefs.NodeDefs {
+			if rv == "" || !VersionGTE(nodeDef.ImplVersion, rv) {
+				rv = nodeDef.ImplVersion
+			}
+		}
+	}
+	return rv
+}
+
+// CfgAdvanceCompatVersion advances the cluster's compat version to
+// the lowest version of the known nodes, if that's higher, and
+// returns the resulting compat version.
+func CfgAdvanceCompatVersion(cfg Cfg) (string, error) {
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return "", err
+	}
+
+	minVersion := NodeDefsMinVersion(nodeDefs)
+
+	var rv string
+
+	_, err = CfgSetRetry(cfg, COMPAT_VERSION_KEY, CfgRetryOptionsDefault,
+		func(val []byte, cas uint64) ([]byte, error) {
+			rv = string(val)
+			if minVersion == "" ||
+				(rv != "" && VersionGTE(rv, minVersion)) {
+				return nil, nil
+			}
+			rv = minVersion
+			return []byte(rv), nil
+		})
+
+	return rv, err
+}
+
+// CompatVersion returns the cluster's compat version, computing it
+// first if needed.
+func (mgr *Manager) CompatVersion() (string, error) {
+	compatVersion, _, err := CfgGetCompatVersion(mgr.cfg)
+	if err != nil || compatVersion != "" {
+		return compatVersion, err
+	}
+	return CfgAdvanceCompatVersion(mgr.cfg)
+}
+
+// PlanFeatureEnabled returns true if the cluster's compat version
+// allows a plan feature (see PlanFeatureVersions).  Unregistered
+// features are always allowed.
+func (mgr *Manager) PlanFeatureEnabled(feature string) (bool, error) {
+	featureVersion, exists := PlanFeatureVersions[feature]
+	if !exists {
+		return true, nil
+	}
+	compatVersion, err := mgr.CompatVersion()
+	if err != nil {
+		return false, err
+	}
+	return compatVersion != "" && VersionGTE(compatVersion, featureVersion), nil
+}
+
+// IndexDefPlanFeatures returns the plan features that an index
+// definition uses, sorted.
+func IndexDefPlanFeatures(indexDef *IndexDef) []string {
+	var rv []string
+	if indexDef.Namespace != "" {
+		rv = append(rv, "namespace")
+	}
+	if len(indexDef.PlanParams.NodeSelector) > 0 {
+		rv = append(rv, "nodeSelector")
+	}
+	if indexDef.PlanParams.ZoneSpread != "" {
+		rv = append(rv, "zoneSpread")
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// checkIndexDefCompat errors if an index definition uses a plan
+// feature that the cluster's compat version doesn't allow yet.
+func (mgr *Manager) checkIndexDefCompat(indexDef *IndexDef) error {
+	for _, feature := range IndexDefPlanFeatures(indexDef) {
+		ok, err := mgr.PlanFeatureEnabled(feature)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("version_compat: plan feature not allowed"+
+				" until all nodes are upgraded, feature: %s,"+
+				" requires version: %s", feature, PlanFeatureVersions[feature])
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// An UpgradeStatus represents the readiness of the nodes of a cluster
+// for a rolling upgrade to the highest version among the nodes.
+type UpgradeStatus struct {
+	CompatVersion string               `json:"compatVersion"`
+	TargetVersion string               `json:"targetVersion"`
+	Ready         bool                 `json:"ready"` // All nodes upgraded.
+	Nodes         []*UpgradeNodeStatus `json:"nodes"`
+}
+
+// An UpgradeNodeStatus represents the upgrade readiness of a node.
+type UpgradeNodeStatus struct {
+	UUID        string `json:"uuid"`
+	HostPort    string `json:"hostPort"`
+	ImplVersion string `json:"implVersion"`
+	Ready       bool   `json:"ready"` // The node runs the TargetVersion.
+}
+
+// CfgGetUpgradeStatus returns the upgrade readiness of the known
+// nodes of a cluster, sorted by node UUID.
+func CfgGetUpgradeStatus(cfg Cfg) (*UpgradeStatus, error) {
+	compatVersion, _, err := CfgGetCompatVersion(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &UpgradeStatus{
+		CompatVersion: compatVersion,
+		Ready:         true,
+		Nodes:         []*UpgradeNodeStatus{},
+	}
+
+	if nodeDefs == nil {
+		return rv, nil
+	}
+
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		if rv.TargetVersion == "" ||
+			VersionGTE(nodeDef.ImplVersion, rv.TargetVersion) {
+			rv.TargetVersion = nodeDef.ImplVersion
+		}
+	}
+
+	nodeUUIDs := make([]string, 0, len(nodeDefs.NodeDefs))
+	for nodeUUID := range nodeDefs.NodeDefs {
+		nodeUUIDs = append(nodeUUIDs, nodeUUID)
+	}
+	sort.Strings(nodeUUIDs)
+
+	for _, nodeUUID := range nodeUUIDs {
+		nodeDef := nodeDefs.NodeDefs[nodeUUID]
+		ready := VersionGTE(nodeDef.ImplVersion, rv.TargetVersion)
+		if !ready {
+			rv.Ready = false
+		}
+		rv.Nodes = append(rv.Nodes, &UpgradeNodeStatus{
+			UUID:        nodeUUID,
+			HostPort:    nodeDef.HostPort,
+			ImplVersion: nodeDef.ImplVersion,
+			Ready:       ready,
+		})
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,111 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func setTestNodeVersions(t *testing.T, cfg Cfg, versions map[string]string) {
+	nodeDefs := NewNodeDefs(VERSION)
+	for nodeUUID, version := range versions {
+		nodeDefs.NodeDefs[nodeUUID] = &NodeDef{
+			UUID:        nodeUUID,
+			HostPort:    nodeUUID + ":1000",
+			ImplVersion: version,
+		}
+	}
+	_, cas, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if _, err := CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, nodeDefs, cas); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs() to work, err: %v", err)
+	}
+}
+
+func TestCfgAdvanceCompatVersion(t *testing.T) {
+	cfg := NewCfgMem()
+
+	v, err := CfgAdvanceCompatVersion(cfg)
+	if err != nil || v != "" {
+		t.Errorf("expected no compat version without nodes, got: %q, err: %v",
+			v, err)
+	}
+
+	setTestNodeVersions(t, cfg, map[string]string{"a": "4.5.0", "b": "5.0.0"})
+
+	v, err = CfgAdvanceCompatVersion(cfg)
+	if err != nil || v != "4.5.0" {
+		t.Errorf("expected compat version 4.5.0, got: %q, err: %v", v, err)
+	}
+
+	status, err := CfgGetUpgradeStatus(cfg)
+	if err != nil || status.Ready || status.TargetVersion != "5.0.0" ||
+		len(status.Nodes) != 2 || status.Nodes[0].Ready || !status.Nodes[1].Ready {
+		t.Errorf("expected node a not ready, got: %#v, err: %v", status, err)
+	}
+
+	setTestNodeVersions(t, cfg, map[string]string{"a": "5.0.0", "b": "5.0.0"})
+
+	v, err = CfgAdvanceCompatVersion(cfg)
+	if err != nil || v != "5.0.0" {
+		t.Errorf("expected compat version 5.0.0, got: %q, err: %v", v, err)
+	}
+
+	// A rejoining older node doesn't make the compat version retreat.
+	setTestNodeVersions(t, cfg, map[string]string{"a": "4.5.0", "b": "5.0.0"})
+
+	v, err = CfgAdvanceCompatVersion(cfg)
+	if err != nil || v != "5.0.0" {
+		t.Errorf("expected compat version to stay 5.0.0, got: %q, err: %v",
+			v, err)
+	}
+}
+
+func TestCreateIndexCompatGating(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	setTestNodeVersions(t, cfg, map[string]string{"a": "4.5.0"})
+
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := m.Start("wanted"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	defer m.Stop()
+
+	err := m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{ZoneSpread: ZONE_SPREAD_WARN}, "")
+	if err == nil {
+		t.Errorf("expected zoneSpread to be gated during an upgrade")
+	}
+
+	err = m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "foo", "", PlanParams{}, "")
+	if err != nil {
+		t.Errorf("expected CreateIndex() without new features to work,"+
+			" err: %v", err)
+	}
+
+	setTestNodeVersions(t, cfg, map[string]string{"a": VERSION})
+	if _, err = CfgAdvanceCompatVersion(cfg); err != nil {
+		t.Errorf("expected CfgAdvanceCompatVersion() to work, err: %v", err)
+	}
+
+	err = m.CreateIndex("primary", "default", "123", "",
+		"blackhole", "bar", "", PlanParams{ZoneSpread: ZONE_SPREAD_WARN}, "")
+	if err != nil {
+		t.Errorf("expected zoneSpread after the upgrade, err: %v", err)
+	}
+}
@@ -12,6 +12,7 @@
 package cbgt
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -83,3 +84,23 @@ func TestCheckVersion(t *testing.T) {
 		t.Errorf("expected err when forcing cfg Set() error during verison upgrade")
 	}
 }
+
+func TestCheckVersionUnparseable(t *testing.T) {
+	cfg := NewCfgMem()
+	cfg.Set(VERSION_KEY, []byte("5.5.0-MP1"), 0)
+
+	ok, err := CheckVersion(cfg, "5.5.0")
+	if err != nil || !ok {
+		t.Errorf("expected release >= pre-release, ok: %v, err: %v", ok, err)
+	}
+
+	ok, err = CheckVersion(cfg, "hello")
+	if err == nil || ok {
+		t.Errorf("expected err on unparseable version")
+	}
+
+	err = PlannerCheckVersion(cfg, "hello")
+	if err == nil || strings.Contains(err.Error(), "too low") {
+		t.Errorf("expected a parse err, not too low, err: %v", err)
+	}
+}